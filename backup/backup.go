@@ -0,0 +1,159 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/smashwilson/az-coordinator/store"
+)
+
+// snapshotPrefix and snapshotSuffix surround the timestamp in the name of each scheduled snapshot, like
+// "coordinator-20061016T150405Z.json.gz", so that snapshots sort by the time that they were taken.
+const (
+	snapshotPrefix = "coordinator-"
+	snapshotSuffix = ".json.gz"
+	snapshotLayout = "20060102T150405Z"
+)
+
+// ParseS3URL returns the bucket and key of an s3://BUCKET/KEY URL, or false if raw isn't one.
+func ParseS3URL(raw string) (bucket, key string, ok bool) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "s3" || len(u.Host) == 0 {
+		return "", "", false
+	}
+	key = strings.TrimPrefix(u.Path, "/")
+	if len(key) == 0 {
+		return "", "", false
+	}
+	return u.Host, key, true
+}
+
+// Upload stores the contents of body as an S3 object. The object is encrypted at rest with the KMS key kmsKeyID, or
+// with S3's own keys if kmsKeyID is empty.
+func Upload(ctx context.Context, sess *session.Session, bucket, key, kmsKeyID string, body io.Reader) error {
+	input := &s3manager.UploadInput{
+		Bucket:               aws.String(bucket),
+		Key:                  aws.String(key),
+		Body:                 body,
+		ServerSideEncryption: aws.String(s3.ServerSideEncryptionAes256),
+	}
+	if len(kmsKeyID) > 0 {
+		input.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAwsKms)
+		input.SSEKMSKeyId = aws.String(kmsKeyID)
+	}
+
+	_, err := s3manager.NewUploader(sess).UploadWithContext(ctx, input)
+	return err
+}
+
+// Download reads an S3 object into memory.
+func Download(ctx context.Context, sess *session.Session, bucket, key string) (io.ReadCloser, error) {
+	buf := aws.NewWriteAtBuffer(make([]byte, 0))
+	_, err := s3manager.NewDownloader(sess).DownloadWithContext(ctx, buf, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("s3://%s/%s: %v", bucket, key, err)
+	}
+	return ioutil.NopCloser(bytes.NewReader(buf.Bytes())), nil
+}
+
+// Snapshot is the outcome of a scheduled backup.
+type Snapshot struct {
+	URL     string         `json:"url"`
+	Rows    map[string]int `json:"rows"`
+	Deleted []string       `json:"deleted,omitempty"`
+
+	// PruneError explains why older snapshots couldn't be deleted. The snapshot itself was still uploaded.
+	PruneError string `json:"prune_error,omitempty"`
+}
+
+// Scheduler takes snapshots of the database and uploads them to an S3 bucket, keeping only the most recent ones.
+type Scheduler struct {
+	sess     *session.Session
+	bucket   string
+	prefix   string
+	kmsKeyID string
+}
+
+// NewScheduler creates a Scheduler that uploads snapshots with sess to bucket, naming each one with prefix followed by
+// the time that it was taken.
+func NewScheduler(sess *session.Session, bucket, prefix, kmsKeyID string) *Scheduler {
+	return &Scheduler{sess: sess, bucket: bucket, prefix: prefix, kmsKeyID: kmsKeyID}
+}
+
+// Take archives the database, uploads the archive, then deletes all but the newest retain snapshots. An error is only
+// returned if the archive couldn't be uploaded; snapshots that can't be deleted are left for the next one to clean up.
+func (s *Scheduler) Take(ctx context.Context, db *store.DB, retain int) (*Snapshot, error) {
+	archive, err := db.Backup(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := archive.Write(&buf); err != nil {
+		return nil, err
+	}
+
+	key := s.prefix + snapshotPrefix + time.Unix(archive.CreatedAt, 0).UTC().Format(snapshotLayout) + snapshotSuffix
+	if err := Upload(ctx, s.sess, s.bucket, key, s.kmsKeyID, &buf); err != nil {
+		return nil, err
+	}
+
+	snapshot := &Snapshot{URL: fmt.Sprintf("s3://%s/%s", s.bucket, key), Rows: archive.Counts()}
+	snapshot.Deleted, err = s.prune(ctx, retain)
+	if err != nil {
+		snapshot.PruneError = err.Error()
+	}
+	return snapshot, nil
+}
+
+// prune deletes all but the newest retain snapshots, returning the keys that were deleted. Objects under the prefix
+// that aren't snapshots are left alone.
+func (s *Scheduler) prune(ctx context.Context, retain int) ([]string, error) {
+	keys := make([]string, 0)
+	err := s3.New(s.sess).ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.prefix + snapshotPrefix),
+	}, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, object := range page.Contents {
+			if key := aws.StringValue(object.Key); strings.HasSuffix(key, snapshotSuffix) {
+				keys = append(keys, key)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) <= retain {
+		return nil, nil
+	}
+
+	sort.Strings(keys)
+	expired := keys[:len(keys)-retain]
+	deleted := make([]string, 0, len(expired))
+	for _, key := range expired {
+		_, err := s3.New(s.sess).DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, key)
+	}
+	return deleted, nil
+}
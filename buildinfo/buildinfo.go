@@ -0,0 +1,29 @@
+package buildinfo
+
+import "runtime"
+
+// Version, Commit, and Date describe the release that this binary was built from. Release builds set them at link
+// time with -ldflags "-X github.com/smashwilson/az-coordinator/buildinfo.Version=...".
+var (
+	Version = "dev"
+	Commit  = "unknown"
+	Date    = "unknown"
+)
+
+// Info describes the build of the running binary.
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	Date      string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+// Current returns the build information of the running binary.
+func Current() Info {
+	return Info{
+		Version:   Version,
+		Commit:    Commit,
+		Date:      Date,
+		GoVersion: runtime.Version(),
+	}
+}
@@ -0,0 +1,40 @@
+package cli
+
+import (
+	"context"
+	"flag"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/fleet"
+)
+
+func agent(flags *flag.FlagSet, args []string) {
+	var once bool
+	flags.BoolVar(&once, "once", false, "Poll the controller a single time, then exit.")
+	parseFlags(flags, args)
+
+	r := prepare(needs{options: true})
+	r.options.ShipLogs(log.StandardLogger())
+
+	if !r.options.Fleet.Agent() {
+		log.Fatal(`The agent command requires the fleet role "agent" in the options file.`)
+	}
+
+	a, err := fleet.NewAgent(r.options, syncSettings(r.options))
+	if err != nil {
+		log.WithError(err).Fatal("Unable to create fleet agent.")
+	}
+
+	log.WithFields(log.Fields{
+		"host":       r.options.Fleet.Host(),
+		"controller": r.options.Fleet.ControllerURL,
+	}).Info("Polling the fleet controller.")
+
+	if once {
+		if err := a.Poll(context.Background()); err != nil {
+			log.WithError(err).Fatal("Unable to poll the fleet controller.")
+		}
+		return
+	}
+	a.Run()
+}
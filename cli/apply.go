@@ -0,0 +1,80 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/manifest"
+)
+
+// apply creates or updates the desired units described by a file of Pod and Deployment manifests.
+func apply(flags *flag.FlagSet, args []string) {
+	var path string
+	flags.StringVar(&path, "f", "", "Read manifests from this YAML or JSON file, or from stdin if it's -.")
+	flags.StringVar(&path, "file", "", "Same as -f.")
+	parseFlags(flags, args)
+	if len(path) == 0 {
+		usageError(flags, "apply requires a manifest file, given with -f.")
+	}
+
+	var (
+		data []byte
+		err  error
+	)
+	if path == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		log.WithError(err).Fatal("Unable to read manifest.")
+	}
+
+	manifests, err := manifest.Parse(data)
+	if err != nil {
+		log.WithError(err).Fatal("Unable to parse manifest.")
+	}
+	if len(manifests) == 0 {
+		log.Fatal("The manifest file is empty.")
+	}
+
+	var results []manifest.Result
+	if remote != nil {
+		if err := remote.do(http.MethodPost, "/desired/manifest", manifests, &results); err != nil {
+			log.WithError(err).Fatal("Unable to apply manifest.")
+		}
+	} else {
+		var r = prepare(needs{session: true})
+		defer r.session.Close()
+
+		var errs []error
+		results, errs = manifest.Apply(context.Background(), r.session, manifests)
+		if results == nil {
+			reportInvalidManifest(errs)
+		}
+		for _, err := range errs {
+			log.WithError(err).Fatal("Unable to store desired unit in the database.")
+		}
+	}
+
+	log.Info("Manifest applied. Run sync to apply the changes to the host.")
+	emit(results, func(w io.Writer) {
+		for _, result := range results {
+			fmt.Fprintf(w, "%s\t%s\n", result.Action, result.Unit)
+		}
+	})
+}
+
+func reportInvalidManifest(errs []error) {
+	fmt.Fprintf(os.Stderr, "Invalid manifest:\n")
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "  %v\n", err)
+	}
+	os.Exit(1)
+}
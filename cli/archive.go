@@ -0,0 +1,128 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/backup"
+	"github.com/smashwilson/az-coordinator/config"
+	"github.com/smashwilson/az-coordinator/store"
+)
+
+// backupDatabase writes desired units, apps, their history, and encrypted secrets to an archive file or S3 object.
+func backupDatabase(flags *flag.FlagSet, args []string) {
+	var output string
+	flags.StringVar(&output, "output", "", "Write the archive to this path, or to an s3://BUCKET/KEY URL.")
+	parseFlags(flags, args)
+
+	if len(output) == 0 {
+		usageError(flags, "backup requires --output.")
+	}
+
+	var r = prepare(needs{options: true, db: true})
+
+	log.Info("Reading database.")
+	archive, err := r.db.Backup(context.Background())
+	if err != nil {
+		log.WithError(err).Fatal("Unable to read database.")
+	}
+
+	var buf bytes.Buffer
+	if err := archive.Write(&buf); err != nil {
+		log.WithError(err).Fatal("Unable to write archive.")
+	}
+
+	if bucket, key, ok := backup.ParseS3URL(output); ok {
+		if err := uploadArchive(r.options, bucket, key, &buf); err != nil {
+			log.WithError(err).WithField("url", output).Fatal("Unable to upload archive.")
+		}
+	} else {
+		outf, err := os.OpenFile(output, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			log.WithError(err).WithField("path", output).Fatal("Unable to create archive file.")
+		}
+		if _, err := buf.WriteTo(outf); err != nil {
+			outf.Close()
+			os.Remove(output)
+			log.WithError(err).WithField("path", output).Fatal("Unable to write archive file.")
+		}
+		if err := outf.Close(); err != nil {
+			log.WithError(err).WithField("path", output).Fatal("Unable to write archive file.")
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"output": output,
+		"rows":   archive.Counts(),
+	}).Info("Database backed up.")
+}
+
+// restoreDatabase loads an archive written by backup into the database, creating its tables if needed.
+func restoreDatabase(flags *flag.FlagSet, args []string) {
+	var force bool
+	flags.BoolVar(&force, "force", false, "Replace the contents of a database that already holds units or secrets.")
+	parseFlags(flags, args)
+
+	if flags.NArg() < 1 {
+		usageError(flags, "restore requires the path or s3://BUCKET/KEY URL of an archive.")
+	}
+	input := flags.Arg(0)
+
+	var r = prepare(needs{options: true, db: true})
+
+	var (
+		source io.ReadCloser
+		err    error
+	)
+	if bucket, key, ok := backup.ParseS3URL(input); ok {
+		source, err = downloadArchive(r.options, bucket, key)
+	} else {
+		source, err = os.Open(input)
+	}
+	if err != nil {
+		log.WithError(err).WithField("input", input).Fatal("Unable to open archive.")
+	}
+	defer source.Close()
+
+	archive, err := store.ReadArchive(source)
+	if err != nil {
+		log.WithError(err).WithField("input", input).Fatal("Unable to read archive.")
+	}
+
+	createTables(r.db)
+
+	log.WithFields(log.Fields{
+		"dialect": archive.Dialect,
+		"rows":    archive.Counts(),
+	}).Info("Restoring database.")
+	if err := r.db.Restore(context.Background(), archive, force); err != nil {
+		if !force {
+			log.WithError(err).Fatal("Unable to restore database. Pass --force to replace its contents.")
+		}
+		log.WithError(err).Fatal("Unable to restore database.")
+	}
+	log.Info("Database restored. Run sync to bring this host to its desired state.")
+}
+
+// uploadArchive stores an archive in S3 with the AWS credentials and region that are used to reach KMS. It's encrypted
+// with the KMS key of the backups options, if one is set.
+func uploadArchive(options *config.Options, bucket, key string, body io.Reader) error {
+	sess, err := options.AWS().NewSession()
+	if err != nil {
+		return err
+	}
+	return backup.Upload(context.Background(), sess, bucket, key, options.Backups.KMSKeyID, body)
+}
+
+// downloadArchive reads an archive from S3 with the AWS credentials and region that are used to reach KMS.
+func downloadArchive(options *config.Options, bucket, key string) (io.ReadCloser, error) {
+	sess, err := options.AWS().NewSession()
+	if err != nil {
+		return nil, err
+	}
+	return backup.Download(context.Background(), sess, bucket, key)
+}
@@ -0,0 +1,124 @@
+package cli
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/secrets"
+)
+
+func exportSecrets(flags *flag.FlagSet, args []string) {
+	var (
+		ageRecipient string
+		gpgRecipient string
+		outputPath   string
+	)
+
+	flags.StringVar(&ageRecipient, "age-recipient", "", "Encrypt the backup to this age public key.")
+	flags.StringVar(&gpgRecipient, "gpg-recipient", "", "Encrypt the backup to this GPG key ID or email address.")
+	flags.StringVar(&outputPath, "output", "", "Write the encrypted backup to this path.")
+	parseFlags(flags, args)
+
+	tool, recipient := secrets.EnvelopeAge, ageRecipient
+	if len(gpgRecipient) > 0 {
+		tool, recipient = secrets.EnvelopeGPG, gpgRecipient
+	}
+	if len(recipient) == 0 || (len(ageRecipient) > 0 && len(gpgRecipient) > 0) || len(outputPath) == 0 {
+		usageError(flags, "export-secrets requires --output and exactly one of --age-recipient or --gpg-recipient.")
+	}
+
+	var r = prepare(needs{options: true, db: true, ring: true})
+
+	log.Info("Loading and decrypting existing secrets.")
+	bag, err := secrets.LoadFromDatabase(r.db, r.ring)
+	if err != nil {
+		log.WithError(err).Fatal("Unable to load and decrypt existing secrets.")
+	}
+
+	contents := make(map[string]string, bag.Len())
+	for _, key := range bag.Keys() {
+		contents[key] = bag.Get(key, "")
+	}
+	plaintext, err := json.Marshal(contents)
+	if err != nil {
+		log.WithError(err).Fatal("Unable to serialize secrets.")
+	}
+
+	outf, err := os.OpenFile(outputPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		log.WithError(err).WithField("path", outputPath).Fatal("Unable to create backup file.")
+	}
+	defer outf.Close()
+
+	if err := tool.Seal(plaintext, recipient, outf); err != nil {
+		os.Remove(outputPath)
+		log.WithError(err).Fatal("Unable to encrypt secrets.")
+	}
+
+	log.WithFields(log.Fields{
+		"count": bag.Len(),
+		"path":  outputPath,
+		"tool":  tool,
+	}).Info("Secrets exported.")
+}
+
+func importSecrets(flags *flag.FlagSet, args []string) {
+	var (
+		ageIdentity string
+		useGPG      bool
+	)
+
+	flags.StringVar(&ageIdentity, "age-identity", "", "Decrypt the backup with the age private key in this file.")
+	flags.BoolVar(&useGPG, "gpg", false, "Decrypt the backup with GPG, using the current user's keyring.")
+	parseFlags(flags, args)
+
+	if flags.NArg() < 1 || (len(ageIdentity) > 0) == useGPG {
+		usageError(flags, "import-secrets requires the path to a backup file and exactly one of --age-identity or --gpg.")
+	}
+	inputPath := flags.Arg(0)
+
+	tool := secrets.EnvelopeAge
+	if useGPG {
+		tool = secrets.EnvelopeGPG
+	}
+
+	var r = prepare(needs{options: true, db: true, ring: true})
+
+	inf, err := os.Open(inputPath)
+	if err != nil {
+		log.WithError(err).WithField("path", inputPath).Fatal("Unable to open backup file.")
+	}
+	defer inf.Close()
+
+	plaintext, err := tool.Open(inf, ageIdentity)
+	if err != nil {
+		log.WithError(err).Fatal("Unable to decrypt backup.")
+	}
+
+	var toLoad map[string]string
+	if err := json.Unmarshal(plaintext, &toLoad); err != nil {
+		log.WithError(err).WithField("path", inputPath).Fatal("Unable to parse decrypted backup.")
+	}
+
+	log.Info("Loading and decrypting existing secrets.")
+	bag, err := secrets.LoadFromDatabase(r.db, r.ring)
+	if err != nil {
+		log.WithError(err).Fatal("Unable to load and decrypt existing secrets.")
+	}
+
+	if err := bag.ValidateUpdates(toLoad); err != nil {
+		log.WithError(err).Fatal("Secrets rejected.")
+	}
+
+	for k, v := range toLoad {
+		bag.Set(k, v)
+	}
+
+	if err = bag.SaveToDatabase(r.db, r.ring, true); err != nil {
+		log.WithError(err).Fatal("Unable to encrypt and save imported secrets.")
+	}
+
+	log.WithFields(log.Fields{"count": bag.Len(), "imported": len(toLoad)}).Info("Secrets imported successfully.")
+}
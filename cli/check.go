@@ -0,0 +1,267 @@
+package cli
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/config"
+	"github.com/smashwilson/az-coordinator/state"
+	"github.com/smashwilson/az-coordinator/store"
+)
+
+// managedDirectories are created by init and must be writable by the azinfra group.
+func managedDirectories() []string {
+	return []string{
+		filepath.Dir(config.DefaultOptionsPath),
+		"/etc/ssl/az",
+		filepath.Clean(state.UnitDirectory()),
+	}
+}
+
+// hostCheck audits one aspect of the host configuration that init establishes.
+type hostCheck struct {
+	name string
+
+	// audit describes each way in which the host has drifted from the expected configuration. An empty result means
+	// that this aspect of the host is correct.
+	audit func() []string
+
+	// repair corrects drift found by audit.
+	repair func() error
+}
+
+func hostChecks(db *store.DB) []hostCheck {
+	checks := []hostCheck{
+		{
+			name: "group azinfra",
+			audit: func() []string {
+				if exists, _ := getGroupID("azinfra"); !exists {
+					return []string{"group does not exist"}
+				}
+				return nil
+			},
+			repair: func() error {
+				output, err := exec.Command("groupadd", "azinfra").CombinedOutput()
+				if err != nil {
+					return fmt.Errorf("Unable to create group (%v)\n%s", err, output)
+				}
+				return nil
+			},
+		},
+		{
+			name: "user coordinator",
+			audit: func() []string {
+				return auditUser("coordinator", "azinfra", "docker")
+			},
+			repair: func() error {
+				return fixUser("coordinator", "azinfra", "docker")
+			},
+		},
+	}
+
+	for _, dirName := range managedDirectories() {
+		dirName := dirName
+		checks = append(checks, hostCheck{
+			name:  "directory " + dirName,
+			audit: func() []string { return auditPath(dirName, true, 0770) },
+			repair: func() error {
+				exists, gid := getGroupID("azinfra")
+				if !exists {
+					return errors.New("group azinfra does not exist")
+				}
+				return fixDirectory(dirName, gid)
+			},
+		})
+	}
+
+	for confPath, contents := range map[string]string{dbusConfPath: dbusConf, polkitConfPath: polkitConf} {
+		confPath, contents := confPath, contents
+		checks = append(checks, hostCheck{
+			name: "file " + confPath,
+			audit: func() []string {
+				actual, err := ioutil.ReadFile(confPath)
+				if err != nil {
+					return []string{err.Error()}
+				}
+				if !bytes.Equal(actual, []byte(contents)) {
+					return []string{"contents differ from the expected configuration"}
+				}
+				return nil
+			},
+			repair: func() error {
+				return ioutil.WriteFile(confPath, []byte(contents), 0644)
+			},
+		})
+	}
+
+	checks = append(checks, hostCheck{
+		name:  "options file " + config.DefaultOptionsPath,
+		audit: func() []string { return auditPath(config.DefaultOptionsPath, false, 0640) },
+		repair: func() error {
+			exists, gid := getGroupID("azinfra")
+			if !exists {
+				return errors.New("group azinfra does not exist")
+			}
+			if err := os.Chown(config.DefaultOptionsPath, -1, gid); err != nil {
+				return err
+			}
+			return os.Chmod(config.DefaultOptionsPath, 0640)
+		},
+	})
+
+	for _, table := range store.Tables {
+		table := table
+		checks = append(checks, hostCheck{
+			name: "table " + table,
+			audit: func() []string {
+				missing, err := db.MissingColumns(table)
+				if err != nil {
+					return []string{err.Error()}
+				}
+				if len(missing) > 0 {
+					return []string{fmt.Sprintf("missing columns: %s", strings.Join(missing, ", "))}
+				}
+				return nil
+			},
+			repair: func() error {
+				for _, statement := range db.Dialect.Schema() {
+					if _, err := db.Exec(statement); err != nil {
+						return err
+					}
+				}
+				if missing, err := db.AddMissingColumns(table); err != nil {
+					return err
+				} else if len(missing) > 0 {
+					return fmt.Errorf("Existing table is missing columns (%s) and must be migrated by hand", strings.Join(missing, ", "))
+				}
+				return nil
+			},
+		})
+	}
+
+	return checks
+}
+
+// auditUser reports whether userName exists and belongs to exactly groupNames.
+func auditUser(userName string, groupNames ...string) []string {
+	exists, _ := getUserGroups(userName)
+	if !exists {
+		return []string{"user does not exist"}
+	}
+
+	output, err := exec.Command("id", "-Gn", userName).Output()
+	if err != nil {
+		return []string{err.Error()}
+	}
+	actual := make(map[string]bool)
+	for _, groupName := range strings.Fields(string(output)) {
+		actual[groupName] = true
+	}
+	// The user's own group is created by useradd --user-group.
+	delete(actual, userName)
+
+	drift := make([]string, 0)
+	for _, groupName := range groupNames {
+		if !actual[groupName] {
+			drift = append(drift, fmt.Sprintf("not a member of group %s", groupName))
+		}
+		delete(actual, groupName)
+	}
+	for groupName := range actual {
+		drift = append(drift, fmt.Sprintf("unexpected member of group %s", groupName))
+	}
+	return drift
+}
+
+// fixUser creates userName if it doesn't exist, or sets its supplementary groups if it does.
+func fixUser(userName string, groupNames ...string) error {
+	groupArg := fmt.Sprintf("-G%s", strings.Join(groupNames, ","))
+
+	var cmd *exec.Cmd
+	if exists, _ := getUserGroups(userName); exists {
+		cmd = exec.Command("usermod", groupArg, userName)
+	} else {
+		cmd = exec.Command("useradd", "--user-group", "--no-create-home", "--shell=/bin/false", groupArg, userName)
+	}
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("Unable to modify user (%v)\n%s", err, output)
+	}
+	return nil
+}
+
+// auditPath reports whether the file or directory at path exists with the expected permission bits and is owned by
+// the azinfra group.
+func auditPath(path string, dir bool, mode os.FileMode) []string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	drift := make([]string, 0)
+	if info.IsDir() != dir {
+		if dir {
+			drift = append(drift, "not a directory")
+		} else {
+			drift = append(drift, "is a directory")
+		}
+	}
+	if info.Mode().Perm() != mode {
+		drift = append(drift, fmt.Sprintf("mode is %#o, not %#o", info.Mode().Perm(), mode))
+	}
+
+	if exists, gid := getGroupID("azinfra"); exists {
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Gid) != gid {
+			drift = append(drift, fmt.Sprintf("group is %d, not azinfra (%d)", stat.Gid, gid))
+		}
+	}
+	return drift
+}
+
+// auditHost runs each hostCheck and logs any drift it finds. If repair is true, drifted checks are repaired and
+// audited again. It returns the number of checks that have drifted (or, if repairing, that are still drifted).
+func auditHost(db *store.DB, repair bool) int {
+	failed := 0
+	for _, check := range hostChecks(db) {
+		drift := check.audit()
+		if len(drift) == 0 {
+			log.WithField("check", check.name).Info("OK.")
+			continue
+		}
+
+		for _, detail := range drift {
+			log.WithFields(log.Fields{
+				"check":  check.name,
+				"detail": detail,
+			}).Warn("Drift detected.")
+		}
+		if !repair {
+			failed++
+			continue
+		}
+
+		if err := check.repair(); err != nil {
+			log.WithError(err).WithField("check", check.name).Error("Unable to repair.")
+			failed++
+			continue
+		}
+		if remaining := check.audit(); len(remaining) > 0 {
+			log.WithFields(log.Fields{
+				"check":  check.name,
+				"detail": strings.Join(remaining, "; "),
+			}).Error("Drift remains after repair.")
+			failed++
+			continue
+		}
+		log.WithField("check", check.name).Info("Repaired.")
+	}
+	return failed
+}
@@ -0,0 +1,96 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// command is a single CLI subcommand. Each command declares and parses its own flags from the arguments that follow
+// its name, so that options like "init --check" don't leak into the global flags.
+type command struct {
+	name string
+
+	// args summarizes the positional arguments the command accepts, for help output.
+	args string
+
+	// summary describes the command. Lines after the first are shown indented beneath it in the command list.
+	summary string
+
+	// remote is true if the command can run against a coordinator's API with the global -server flag.
+	remote bool
+
+	// run declares the command's flags on flags, calls parseFlags with args, then performs the command.
+	run func(flags *flag.FlagSet, args []string)
+}
+
+// lookupCommand finds the command with the given name.
+func lookupCommand(name string) (command, bool) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+// newFlagSet creates the flag set used to parse the arguments of cmd. Asking it for help with -h or -help shows the
+// command's own help.
+func newFlagSet(cmd command) *flag.FlagSet {
+	flags := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	flags.Usage = func() {
+		writeCommandHelp(flags.Output(), cmd, flags)
+	}
+	return flags
+}
+
+// parseFlags parses a command's arguments. It exits successfully after showing the command's help if it was asked for,
+// or unsuccessfully if the arguments can't be parsed.
+func parseFlags(flags *flag.FlagSet, args []string) {
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(0)
+		}
+		os.Exit(2)
+	}
+}
+
+// usageError reports a problem with a command's arguments, shows its help, and exits.
+func usageError(flags *flag.FlagSet, format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n\n", args...)
+	flags.SetOutput(os.Stderr)
+	flags.Usage()
+	os.Exit(1)
+}
+
+// writeCommandHelp shows the usage, description, and flags of a single command.
+func writeCommandHelp(out io.Writer, cmd command, flags *flag.FlagSet) {
+	fmt.Fprintf(out, "Usage: %s [flags] %s", os.Args[0], cmd.name)
+	if hasFlags(flags) {
+		fmt.Fprintf(out, " [%s flags]", cmd.name)
+	}
+	if len(cmd.args) > 0 {
+		fmt.Fprintf(out, " %s", cmd.args)
+	}
+	fmt.Fprintf(out, "\n\n")
+
+	for _, line := range strings.Split(cmd.summary, "\n") {
+		fmt.Fprintf(out, "%s\n", line)
+	}
+
+	if hasFlags(flags) {
+		fmt.Fprintf(out, "\nFlags:\n\n")
+		previous := flags.Output()
+		flags.SetOutput(out)
+		flags.PrintDefaults()
+		flags.SetOutput(previous)
+	}
+}
+
+func hasFlags(flags *flag.FlagSet) bool {
+	found := false
+	flags.VisitAll(func(*flag.Flag) { found = true })
+	return found
+}
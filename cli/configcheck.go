@@ -0,0 +1,267 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-systemd/dbus"
+	"github.com/docker/docker/api/types/versions"
+	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/config"
+	"github.com/smashwilson/az-coordinator/secrets"
+	"github.com/smashwilson/az-coordinator/state"
+	"github.com/smashwilson/az-coordinator/store"
+)
+
+// configCheck verifies one aspect of the coordinator's configuration or its access to the services it depends on.
+type configCheck struct {
+	name  string
+	check func(ctx context.Context, opts *config.Options) error
+
+	// stored is true if the check only applies to coordinators that keep their own desired state and secrets. Fleet
+	// agents skip it.
+	stored bool
+}
+
+var configChecks = []configCheck{
+	{name: "required options", check: checkRequiredOptions},
+	{name: "option values", check: checkOptionValues},
+	{name: "database", check: checkDatabase, stored: true},
+	{name: "kms", check: checkKMS, stored: true},
+	{name: "docker", check: checkDocker},
+	{name: "dbus", check: checkDBus},
+}
+
+// configCheckResult is the outcome of one check reported by the config-check command.
+type configCheckResult struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// configCheckReport is the output of the config-check command.
+type configCheckReport struct {
+	Passed bool                `json:"passed"`
+	Checks []configCheckResult `json:"checks"`
+}
+
+func checkConfig(flags *flag.FlagSet, args []string) {
+	parseFlags(flags, args)
+
+	report := configCheckReport{Passed: true, Checks: make([]configCheckResult, 0, len(configChecks)+1)}
+
+	opts, err := config.Load()
+	if err != nil {
+		report.Passed = false
+		report.Checks = append(report.Checks, configCheckResult{Name: "load options", Detail: err.Error()})
+	} else {
+		report.Checks = append(report.Checks, configCheckResult{Name: "load options", Passed: true, Detail: opts.OptionsPath})
+
+		for _, c := range configChecks {
+			if c.stored && opts.Fleet.Agent() {
+				continue
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			err := c.check(ctx, opts)
+			cancel()
+
+			result := configCheckResult{Name: c.name, Passed: err == nil}
+			if err != nil {
+				result.Detail = err.Error()
+				report.Passed = false
+			}
+			report.Checks = append(report.Checks, result)
+		}
+	}
+
+	emit(report, func(w io.Writer) {
+		failed := 0
+		for _, result := range report.Checks {
+			status := "PASS"
+			if !result.Passed {
+				status = "FAIL"
+				failed++
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", status, result.Name, result.Detail)
+		}
+
+		fmt.Fprintln(w)
+		if failed > 0 {
+			fmt.Fprintf(w, "%d of %d checks failed.\n", failed, len(report.Checks))
+		} else {
+			fmt.Fprintf(w, "All %d checks passed.\n", len(report.Checks))
+		}
+	})
+
+	if !report.Passed {
+		os.Exit(1)
+	}
+}
+
+func checkRequiredOptions(_ context.Context, opts *config.Options) error {
+	if opts.Fleet.Agent() {
+		// Agents are configured by the fleet controller, and need nothing more than their fleet options.
+		return nil
+	}
+
+	missing := make([]string, 0)
+
+	if len(opts.DatabaseURL) == 0 {
+		missing = append(missing, "database_url")
+	}
+	if len(opts.MasterKeyID) == 0 {
+		missing = append(missing, "master_key_id")
+	}
+	if len(opts.AWSRegion) == 0 && len(opts.AWSProfile) == 0 {
+		missing = append(missing, "aws_region")
+	}
+	if len(opts.AuthToken) == 0 && len(opts.ClientCAPath) == 0 && !opts.OIDC.Enabled() {
+		missing = append(missing, "auth_token")
+	}
+	if len(opts.ListenAddress) == 0 && len(opts.PlainHTTPAddress) == 0 && len(opts.ListenSocket) == 0 {
+		missing = append(missing, "listen_address")
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("missing %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func checkOptionValues(_ context.Context, opts *config.Options) error {
+	problems := make([]string, 0)
+	if _, err := config.NewLogFormatter(opts.LogFormat); err != nil {
+		problems = append(problems, fmt.Sprintf("log_format: %v", err))
+	}
+	if len(opts.LogLevel) > 0 {
+		if _, err := log.ParseLevel(opts.LogLevel); err != nil {
+			problems = append(problems, fmt.Sprintf("log_level: %v", err))
+		}
+	}
+	if _, err := opts.SecretPolicy.Policy(); err != nil {
+		problems = append(problems, fmt.Sprintf("secret_policy: %v", err))
+	}
+	if err := state.CheckAllowedImages(opts.AllowedImages); err != nil {
+		problems = append(problems, fmt.Sprintf("allowed_images: %v", err))
+	}
+	if err := state.CheckUnitLayout(opts.UnitPrefix, opts.UnitDirectory); err != nil {
+		problems = append(problems, fmt.Sprintf("unit_prefix and unit_directory: %v", err))
+	}
+	if len(opts.OIDC.Issuer) > 0 != (len(opts.OIDC.Audience) > 0) {
+		problems = append(problems, "oidc: issuer and audience must be set together")
+	}
+	if len(opts.ClientCAPath) > 0 {
+		if _, err := os.Stat(opts.ClientCAPath); err != nil {
+			problems = append(problems, fmt.Sprintf("client_ca_path: %v", err))
+		}
+	}
+	if err := opts.Fleet.Validate(); err != nil {
+		problems = append(problems, fmt.Sprintf("fleet: %v", err))
+	}
+	if len(opts.SlackSigningSecret) > 0 && len(opts.SlackAllowedUsers) == 0 {
+		problems = append(problems, "slack_allowed_users: no Slack user may run commands until it's set")
+	}
+	if err := opts.SelfUpdate.Validate(); err != nil {
+		problems = append(problems, fmt.Sprintf("self_update: %v", err))
+	}
+	if len(opts.Fleet.ControllerCAPath) > 0 {
+		if _, err := os.Stat(opts.Fleet.ControllerCAPath); err != nil {
+			problems = append(problems, fmt.Sprintf("fleet.controller_ca_path: %v", err))
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func checkDatabase(ctx context.Context, opts *config.Options) error {
+	db, err := store.Open(opts.DatabaseURL)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.PingContext(ctx); err != nil {
+		return err
+	}
+
+	for _, table := range store.Tables {
+		missing, err := db.MissingColumns(table)
+		if err != nil {
+			return fmt.Errorf("table %s: %v", table, err)
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("table %s is missing columns %s; run init --repair", table, strings.Join(missing, ", "))
+		}
+	}
+	return nil
+}
+
+// checkKMS encrypts and decrypts a value with the master key, which exercises every KMS permission the coordinator
+// needs.
+func checkKMS(_ context.Context, opts *config.Options) error {
+	ring, err := secrets.NewDecoderRing(opts.MasterKeyID, opts.AWS())
+	if err != nil {
+		return err
+	}
+
+	ciphertext, err := ring.Encrypt("config-check")
+	if err != nil {
+		return fmt.Errorf("encrypt: %v", err)
+	}
+	plaintext, err := ring.Decrypt(ciphertext)
+	if err != nil {
+		return fmt.Errorf("decrypt: %v", err)
+	}
+	if *plaintext != "config-check" {
+		return errors.New("decrypted value does not match")
+	}
+	return nil
+}
+
+func checkDocker(ctx context.Context, opts *config.Options) error {
+	cli, err := state.NewDockerClient(opts.DockerAPIVersion)
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	version, err := cli.ServerVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if len(opts.DockerAPIVersion) == 0 {
+		return nil
+	}
+	if versions.LessThan(opts.DockerAPIVersion, version.MinAPIVersion) || versions.GreaterThan(opts.DockerAPIVersion, version.APIVersion) {
+		return fmt.Errorf("docker_api_version %s is outside of the daemon's supported range %s to %s",
+			opts.DockerAPIVersion, version.MinAPIVersion, version.APIVersion)
+	}
+	return nil
+}
+
+// checkDBus connects to systemd and asks it to reload its unit files, which requires the permissions granted by init.
+func checkDBus(_ context.Context, _ *config.Options) error {
+	conn, err := dbus.NewSystemConnection()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ListUnitFilesByPatterns(nil, []string{state.UnitPrefix() + "*"}); err != nil {
+		return fmt.Errorf("list units: %v", err)
+	}
+	if err := conn.Reload(); err != nil {
+		return fmt.Errorf("reload: %v", err)
+	}
+	return nil
+}
@@ -1,33 +1,53 @@
 package cli
 
 import (
-	"encoding/json"
-	"os"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/state"
 )
 
-func diff() {
-	var r = prepare(needs{session: true})
+func diff(flags *flag.FlagSet, args []string) {
+	parseFlags(flags, args)
+
+	if remote != nil {
+		var delta state.Delta
+		if err := remote.do(http.MethodGet, "/diff", nil, &delta); err != nil {
+			log.WithError(err).Fatal("Unable to compute delta.")
+		}
+		emit(delta, func(w io.Writer) { writeDeltaTable(w, delta) })
+		return
+	}
+
+	var r = prepare(needs{options: true, session: true})
 	defer r.session.Close()
 
+	ctx := context.Background()
+
 	log.Info("Reading desired state.")
-	desired, err := r.session.ReadDesiredState()
+	desired, err := r.session.ReadDesiredState(ctx)
 	if err != nil {
 		log.WithError(err).Fatal("Unable to read desired state.")
 	}
+	scoped := desired.ForHost(r.options.Fleet.Host(), r.options.Fleet.Labels)
+	desired = &scoped
 
-	if err = desired.ReadImages(r.session); err != nil {
+	if err = desired.ReadImages(ctx, r.session); err != nil {
 		log.WithError(err).Fatal("Unable to read Docker images.")
 	}
 
 	log.Info("Reading actual state.")
-	actual, err := r.session.ReadActualState()
+	actual, err := r.session.ReadActualState(ctx)
 	if err != nil {
 		log.WithError(err).Fatal("Unable to read actual state.")
 	}
 
-	errs := actual.ReadImages(r.session, *desired)
+	errs := actual.ReadImages(ctx, r.session, *desired)
 	if len(errs) > 0 {
 		for _, err := range errs {
 			log.WithError(err).Error("Docker error.")
@@ -36,11 +56,40 @@ func diff() {
 	}
 
 	log.Info("Computing delta.")
-	delta := r.session.Between(desired, actual)
+	delta := r.session.Between(ctx, desired, actual)
+
+	emit(delta, func(w io.Writer) { writeDeltaTable(w, delta) })
+}
+
+// writeDeltaTable describes each conflict between desired units and each action in delta on its own line.
+func writeDeltaTable(w io.Writer, delta state.Delta) {
+	for _, conflict := range delta.Conflicts {
+		fmt.Fprintf(w, "conflict: %s\n", conflict.Detail)
+	}
+	for _, name := range delta.ProtectedUnits {
+		fmt.Fprintf(w, "protected: %s is no longer desired, but is kept. Sync with --force to remove it.\n", name)
+	}
+	for _, g := range delta.GatedUnits {
+		fmt.Fprintf(w, "gated: %s is held at its current image. The checks of %s@%s haven't passed: %s\n", g.Unit, g.Repository, g.ShortCommit(), g.Detail)
+	}
+
+	description := delta.String()
+	if len(description) == 0 {
+		fmt.Fprintln(w, "No changes.")
+		return
+	}
+	fmt.Fprint(w, description)
+
+	names := make([]string, 0, len(delta.UnitDiffs))
+	for name := range delta.UnitDiffs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "\n%s", delta.UnitDiffs[name])
+	}
 
-	encoder := json.NewEncoder(os.Stdout)
-	encoder.SetIndent("", "  ")
-	if err := encoder.Encode(delta); err != nil {
-		log.Fatalf("Unable to write JSON: %v.\n", err)
+	for _, result := range delta.FailedResults() {
+		fmt.Fprintf(w, "failed to %s %s: %s\n", result.Action, result.Unit, result.Detail())
 	}
 }
@@ -0,0 +1,50 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/state"
+)
+
+func drift(flags *flag.FlagSet, args []string) {
+	parseFlags(flags, args)
+
+	var report state.DriftReport
+	if remote != nil {
+		if err := remote.do(http.MethodGet, "/drift", nil, &report); err != nil {
+			log.WithError(err).Fatal("Unable to detect drift.")
+		}
+	} else {
+		var r = prepare(needs{options: true, session: true})
+		defer r.session.Close()
+
+		detected, err := r.session.DetectDrift(context.Background(), r.options.Fleet.Host(), r.options.Fleet.Labels)
+		if err != nil {
+			log.WithError(err).Fatal("Unable to detect drift.")
+		}
+		report = *detected
+	}
+
+	emit(report, func(w io.Writer) { writeDriftTable(w, report) })
+}
+
+// writeDriftTable lists each finding of report on its own line.
+func writeDriftTable(w io.Writer, report state.DriftReport) {
+	if len(report.Findings) == 0 {
+		fmt.Fprintf(w, "No drift on %s.\n", report.Host)
+		return
+	}
+
+	for _, finding := range report.Findings {
+		subject := finding.Unit
+		if len(subject) == 0 {
+			subject = finding.Container
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", finding.Kind, subject, finding.Detail)
+	}
+}
@@ -1,7 +1,27 @@
 package cli
 
-import "os"
+import (
+	"flag"
+	"fmt"
+	"os"
+)
 
-func help() {
-	writeHelp(os.Stdout, 0)
+func help(flags *flag.FlagSet, args []string) {
+	parseFlags(flags, args)
+
+	if flags.NArg() < 1 {
+		writeHelp(os.Stdout, 0)
+	}
+
+	cmd, ok := lookupCommand(flags.Arg(0))
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unrecognized command: %s.\n", flags.Arg(0))
+		writeHelp(os.Stderr, 1)
+	}
+
+	// Running the command with -help shows its help, including the flags it declares, and exits before it does
+	// anything else.
+	cmdFlags := newFlagSet(cmd)
+	cmdFlags.SetOutput(os.Stdout)
+	cmd.run(cmdFlags, []string{"-help"})
 }
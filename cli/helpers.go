@@ -1,15 +1,21 @@
 package cli
 
 import (
-	"database/sql"
+	"context"
 	"fmt"
 	"io"
 	"os"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/smashwilson/az-coordinator/config"
+	"github.com/smashwilson/az-coordinator/github"
+	"github.com/smashwilson/az-coordinator/retry"
 	"github.com/smashwilson/az-coordinator/secrets"
 	"github.com/smashwilson/az-coordinator/state"
+	"github.com/smashwilson/az-coordinator/store"
+	"github.com/smashwilson/az-coordinator/tracing"
 )
 
 type needs struct {
@@ -21,7 +27,7 @@ type needs struct {
 
 type results struct {
 	options *config.Options
-	db      *sql.DB
+	db      *store.DB
 	ring    *secrets.DecoderRing
 	session *state.SessionLease
 }
@@ -37,19 +43,63 @@ func prepare(n needs) results {
 		if err != nil {
 			log.WithError(err).Fatal("Unable to load options.")
 		}
+
+		tracing.Configure(r.options.OTLPEndpoint)
+
+		policy, err := r.options.SecretPolicy.Policy()
+		if err != nil {
+			log.WithError(err).Fatal("Invalid secret_policy option.")
+		}
+		secrets.ConfigurePolicy(policy)
+
+		if err := state.ConfigureAllowedImages(r.options.AllowedImages); err != nil {
+			log.WithError(err).Fatal("Invalid allowed_images option.")
+		}
+
+		if err := state.ConfigureUnitLayout(r.options.UnitPrefix, r.options.UnitDirectory); err != nil {
+			log.WithError(err).Fatal("Invalid unit_prefix or unit_directory option.")
+		}
+
+		if err := r.options.Fleet.Validate(); err != nil {
+			log.WithError(err).Fatal("Invalid fleet options.")
+		}
+
+		if len(logFormat) == 0 && len(r.options.LogFormat) > 0 {
+			formatter, err := config.NewLogFormatter(r.options.LogFormat)
+			if err != nil {
+				log.WithError(err).Fatal("Invalid log_format option.")
+			}
+			log.SetFormatter(formatter)
+		}
+
+		if !logLevelFlagged {
+			if err := r.options.ApplyLogLevel(); err != nil {
+				log.WithError(err).Fatal("Invalid log_level option.")
+			}
+		}
 	}
 
 	if n.db || n.session {
 		log.Info("Connecting to database.")
-		r.db, err = sql.Open("postgres", r.options.DatabaseURL)
+		r.db, err = store.Open(r.options.DatabaseURL)
 		if err != nil {
 			log.WithError(err).Fatal("Unable to connect to database.")
 		}
+		r.options.DatabasePool.Apply(r.db.DB)
+
+		err = retry.Transient(context.Background(), func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			return r.db.PingContext(ctx)
+		})
+		if err != nil {
+			log.WithError(err).Fatal("Unable to reach database.")
+		}
 	}
 
 	if n.ring || n.session {
 		log.WithField("keyID", r.options.MasterKeyID).Info("Creating decoder ring.")
-		r.ring, err = secrets.NewDecoderRing(r.options.MasterKeyID, r.options.AWSRegion)
+		r.ring, err = secrets.NewDecoderRing(r.options.MasterKeyID, r.options.AWS())
 		if err != nil {
 			log.WithError(err).Fatal("Unable to create decoder ring.")
 		}
@@ -67,6 +117,30 @@ func prepare(n needs) results {
 	return r
 }
 
+// syncSettings configures a sync with the phase timeouts requested in options.
+func syncSettings(options *config.Options) state.SyncSettings {
+	return state.SyncSettings{
+		ReadTimeout:  options.Timeouts.Read(),
+		PullTimeout:  options.Timeouts.Pull(),
+		ApplyTimeout: options.Timeouts.Apply(),
+		HealthDelay:  options.Timeouts.Health(),
+		Host:         options.Fleet.Host(),
+		Labels:       options.Fleet.Labels,
+		Prune: state.PrunePolicy{
+			ThresholdPercent: options.PruneThreshold(),
+			Mode:             state.PruneMode(options.PruneMode),
+			MinImageAge:      options.PruneMinImageAge(),
+		},
+		Pulls: state.PullPolicy{
+			Concurrency: options.Pulls.Limit(),
+			Timeout:     options.Pulls.Timeout(),
+			Attempts:    options.Pulls.Tries(),
+		},
+		MaxUnitRemovals: options.Guards.UnitRemovalLimit(),
+		CheckCommit:     github.CommitChecker(options.GitHub),
+	}
+}
+
 func writeHelp(out io.Writer, exitCode int) {
 	fmt.Fprintf(out, "Usage: %s [flags] [command]\n", os.Args[0])
 	fmt.Fprintf(out, "\n")
@@ -74,14 +148,26 @@ func writeHelp(out io.Writer, exitCode int) {
 	fmt.Fprintf(out, "\n")
 	fmt.Fprintf(out, "  --verbose,-v  Log everything that can be logged.\n")
 	fmt.Fprintf(out, "  --quiet,-q    Log only errors and warnings.\n")
+	fmt.Fprintf(out, "  --log-format  Log output format: text (default) or json.\n")
+	fmt.Fprintf(out, "  --output,-o   Format of command results: table (default), json, or yaml.\n")
+	fmt.Fprintf(out, "  --server      Run the command against the API of the coordinator at this URL. Also AZ_SERVER.\n")
+	fmt.Fprintf(out, "                Supported by diff, sync, version, set-secrets, secrets, and the unit commands.\n")
+	fmt.Fprintf(out, "  --token       API token for --server. Also AZ_TOKEN.\n")
+	fmt.Fprintf(out, "  --bearer      Send --token as an OIDC bearer token.\n")
+	fmt.Fprintf(out, "  --ca-cert     Trust the CA certificates in this PEM file when connecting to --server.\n")
 	fmt.Fprintf(out, "\n")
 	fmt.Fprintf(out, "Commands:\n")
 	fmt.Fprintf(out, "\n")
-	fmt.Fprintf(out, "  help         Show this message.\n")
-	fmt.Fprintf(out, "  init         Bootstrap the host and database if needed. Run as root.\n")
-	fmt.Fprintf(out, "  set-secrets  Add or override existing secrets from a JSON file.\n")
-	fmt.Fprintf(out, "  diff         Calculate the actions needed to be taken to bring the system to its desired state.\n")
-	fmt.Fprintf(out, "  sync         Bring the system to its desired state. Report the actions taken.\n")
-	fmt.Fprintf(out, "  serve        Begin the server that hosts the management API.\n")
+	for _, cmd := range commands {
+		for i, line := range strings.Split(cmd.summary, "\n") {
+			name := ""
+			if i == 0 {
+				name = cmd.name
+			}
+			fmt.Fprintf(out, "  %-17s%s\n", name, line)
+		}
+	}
+	fmt.Fprintf(out, "\n")
+	fmt.Fprintf(out, "Run \"%s help COMMAND\" to see the flags and arguments a command accepts.\n", os.Args[0])
 	os.Exit(exitCode)
 }
@@ -0,0 +1,60 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/state"
+)
+
+func unitHistory(flags *flag.FlagSet, args []string) {
+	parseFlags(flags, args)
+	id := parseUnitID(flags)
+
+	var revisions []state.UnitRevision
+	if remote != nil {
+		if err := remote.do(http.MethodGet, fmt.Sprintf("/desired/%d/history", id), nil, &revisions); err != nil {
+			log.WithError(err).Fatal("Unable to load unit history.")
+		}
+	} else {
+		var r = prepare(needs{session: true})
+		defer r.session.Close()
+
+		var err error
+		revisions, err = r.session.ReadUnitHistory(context.Background(), id)
+		if err != nil {
+			log.WithError(err).Fatal("Unable to load unit history.")
+		}
+	}
+
+	emit(revisions, func(w io.Writer) { writeHistoryTable(w, revisions) })
+}
+
+// writeHistoryTable lists each revision on its own line, followed by an indented line for each setting it changed.
+func writeHistoryTable(w io.Writer, revisions []state.UnitRevision) {
+	if len(revisions) == 0 {
+		fmt.Fprintln(w, "No recorded history.")
+		return
+	}
+
+	for _, rev := range revisions {
+		changedAt := time.Unix(rev.ChangedAt, 0).Format(time.RFC3339)
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", rev.Version, rev.Action, rev.Actor, changedAt)
+		for _, change := range rev.Changes {
+			fmt.Fprintf(w, "\t%s\t%s -> %s\n", change.Field, orNone(change.From), orNone(change.To))
+		}
+	}
+}
+
+// orNone describes an omitted setting in a change.
+func orNone(value []byte) string {
+	if len(value) == 0 {
+		return "(none)"
+	}
+	return string(value)
+}
@@ -1,13 +1,14 @@
 package cli
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"os/user"
-	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -16,8 +17,11 @@ import (
 	"github.com/smashwilson/az-coordinator/config"
 	"github.com/smashwilson/az-coordinator/secrets"
 	"github.com/smashwilson/az-coordinator/state"
+	"github.com/smashwilson/az-coordinator/store"
 )
 
+const dbusConfPath = "/etc/dbus-1/system.d/az-coordinator.conf"
+
 const dbusConf = `<!DOCTYPE busconfig PUBLIC "-//freedesktop//DTD D-Bus Bus Configuration 1.0//EN"
 "http://www.freedesktop.org/standards/dbus/1.0/busconfig.dtd">
 <busconfig>
@@ -37,6 +41,8 @@ const dbusConf = `<!DOCTYPE busconfig PUBLIC "-//freedesktop//DTD D-Bus Bus Conf
 	</policy>
 </busconfig>`
 
+const polkitConfPath = "/etc/polkit-1/rules.d/00-coordinator.rules"
+
 const polkitConf = `polkit.addRule(function(action, subject) {
     if (
         subject.user == "coordinator" &&
@@ -258,26 +264,12 @@ func ensureUser(userName string, groupNames ...string) int {
 }
 
 func ensureDirectory(dirName string, gid int) {
-	if err := os.MkdirAll(dirName, 0770); err != nil {
-		log.WithFields(log.Fields{
-			"err":     err,
-			"dirName": dirName,
-			"gid":     gid,
-		}).Fatal("Unable to create directory.")
-	}
-	if err := os.Chmod(dirName, 0770); err != nil {
+	if err := fixDirectory(dirName, gid); err != nil {
 		log.WithFields(log.Fields{
 			"err":     err,
 			"dirName": dirName,
 			"gid":     gid,
-		}).Fatal("Unable to change directory permissions.")
-	}
-	if err := os.Chown(dirName, -1, gid); err != nil {
-		log.WithFields(log.Fields{
-			"err":     err,
-			"dirName": dirName,
-			"gid":     gid,
-		}).Fatal("Unable to change directory ownership.")
+		}).Fatal("Unable to prepare directory.")
 	}
 
 	log.WithFields(log.Fields{
@@ -286,6 +278,20 @@ func ensureDirectory(dirName string, gid int) {
 	}).Debug("Directory exists and has proper permissions and ownership.")
 }
 
+// fixDirectory creates dirName if necessary and gives it the mode and group ownership that the coordinator expects.
+func fixDirectory(dirName string, gid int) error {
+	if err := os.MkdirAll(dirName, 0770); err != nil {
+		return fmt.Errorf("Unable to create directory (%v)", err)
+	}
+	if err := os.Chmod(dirName, 0770); err != nil {
+		return fmt.Errorf("Unable to change directory permissions (%v)", err)
+	}
+	if err := os.Chown(dirName, -1, gid); err != nil {
+		return fmt.Errorf("Unable to change directory ownership (%v)", err)
+	}
+	return nil
+}
+
 func getGid(groupName string) int {
 	group, err := user.LookupGroup(groupName)
 	if err != nil || group == nil {
@@ -328,49 +334,63 @@ func moveFile(sourcePath, destPath string) error {
 	return nil
 }
 
-func initialize() {
+// createTables creates the coordinator's tables if they don't exist, and adds any columns that existing tables lack.
+func createTables(db *store.DB) {
+	log.WithField("dialect", db.Dialect.Name()).Info("Creating tables.")
+	for _, statement := range db.Dialect.Schema() {
+		if _, err := db.Exec(statement); err != nil {
+			log.WithError(err).Error("Unable to create table.")
+		}
+	}
+	for _, table := range store.Tables {
+		missing, err := db.AddMissingColumns(table)
+		if err != nil {
+			log.WithError(err).WithField("table", table).Error("Unable to add columns.")
+		} else if len(missing) > 0 {
+			log.WithFields(log.Fields{
+				"table":   table,
+				"columns": missing,
+			}).Error("Existing table is missing columns and must be migrated by hand.")
+		}
+	}
+}
+
+func initialize(flags *flag.FlagSet, args []string) {
+	var check, repair bool
+
+	flags.BoolVar(&check, "check", false, "Report drift from the expected host configuration without changing anything.")
+	flags.BoolVar(&repair, "repair", false, "Correct drift from the expected host configuration, changing only what's broken.")
+	parseFlags(flags, args)
+
+	if check && repair {
+		usageError(flags, "--check and --repair may not be provided together.")
+	}
+
 	var r = prepare(needs{options: true, db: true})
 
-	if _, err := r.db.Exec(`
-		CREATE TABLE IF NOT EXISTS secrets (
-			key TEXT NOT NULL,
-			ciphertext bytea NOT NULL
-		)
-	`); err != nil {
-		log.WithError(err).Error("Unable to create secrets table.")
-	}
-
-	if _, err := r.db.Exec(`
-		CREATE TABLE IF NOT EXISTS state_systemd_units (
-			id SERIAL PRIMARY KEY,
-			path TEXT NOT NULL,
-			type INTEGER NOT NULL,
-			container_name TEXT NOT NULL,
-			container_image_name TEXT NOT NULL,
-			container_image_tag TEXT NOT NULL,
-			secrets JSONB NOT NULL,
-			env JSONB NOT NULL,
-			ports JSONB NOT NULL,
-			volumes JSONB NOT NULL,
-			schedule TEXT
-		)
-	`); err != nil {
-		log.WithError(err).Error("Unable to create secrets table.")
+	if check || repair {
+		if failed := auditHost(r.db, repair); failed > 0 {
+			log.WithField("failedChecks", failed).Fatal("Host configuration has drifted.")
+		}
+		log.Info("Host configuration is correct.")
+		return
 	}
 
+	createTables(r.db)
+
 	azinfraGID := ensureGroup("azinfra")
 	coordinatorUID := ensureUser("coordinator", "azinfra", "docker")
 
-	ensureDirectory(filepath.Dir(config.DefaultOptionsPath), azinfraGID)
-	ensureDirectory("/etc/ssl/az", azinfraGID)
-	ensureDirectory("/etc/systemd/system", azinfraGID)
+	for _, dirName := range managedDirectories() {
+		ensureDirectory(dirName, azinfraGID)
+	}
 
-	if err := ioutil.WriteFile("/etc/dbus-1/system.d/az-coordinator.conf", []byte(dbusConf), 0644); err != nil {
+	if err := ioutil.WriteFile(dbusConfPath, []byte(dbusConf), 0644); err != nil {
 		log.WithError(err).Error("Unable to write DBus configuration file.")
 	}
 	log.Debug("DBus permissions modified.")
 
-	if err := ioutil.WriteFile("/etc/polkit-1/rules.d/00-coordinator.rules", []byte(polkitConf), 0644); err != nil {
+	if err := ioutil.WriteFile(polkitConfPath, []byte(polkitConf), 0644); err != nil {
 		log.WithError(err).Error("Unable to write polkit configuration file.")
 	}
 	log.Debug("Polkit permissions modified.")
@@ -405,7 +425,7 @@ func initialize() {
 	}
 
 	log.WithField("keyID", r.options.MasterKeyID).Info("Creating decoder ring.")
-	ring, err := secrets.NewDecoderRing(r.options.MasterKeyID, r.options.AWSRegion)
+	ring, err := secrets.NewDecoderRing(r.options.MasterKeyID, r.options.AWS())
 	if err != nil {
 		log.WithError(err).Fatal("Unable to create decoder ring.")
 	}
@@ -419,11 +439,28 @@ func initialize() {
 	defer lease.Release()
 
 	log.Info("Creating Docker network.")
-	if err := lease.CreateNetwork(); err != nil {
+	if err := lease.CreateNetwork(context.Background()); err != nil {
 		log.WithError(err).Fatal("Unable to create Docker network.")
 	}
 
-	delta, errs := lease.Synchronize(state.SyncSettings{UID: coordinatorUID, GID: azinfraGID})
+	log.Info("Installing coordinator unit.")
+	if _, err := lease.InstallSelfUnit(context.Background(), coordinatorUID, azinfraGID); err != nil {
+		log.WithError(err).Fatal("Unable to install the coordinator's own unit.")
+	}
+
+	if state.SELinuxEnforcing() {
+		log.Info("Installing SELinux file contexts.")
+		if err := state.InstallSELinuxContexts(context.Background()); err != nil {
+			log.WithError(err).Fatal("Unable to install SELinux file contexts.")
+		}
+	}
+
+	settings := syncSettings(r.options)
+	settings.UID = coordinatorUID
+	settings.GID = azinfraGID
+	settings.Trigger = state.LocalTrigger(state.TriggerInit)
+
+	delta, errs := lease.Synchronize(context.Background(), settings)
 	if len(errs) > 0 {
 		for _, err := range errs {
 			log.WithError(err).Warn("Error encountered during synchronization.")
@@ -432,5 +469,9 @@ func initialize() {
 	}
 	log.Debugf("Synchronization complete.\n%s", delta)
 
+	if err := lease.RestartSelf(context.Background()); err != nil {
+		log.WithError(err).Fatal("Unable to start the coordinator's unit.")
+	}
+
 	log.Info("Initialization complete.")
 }
@@ -5,17 +5,73 @@ import (
 	"os"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/config"
+	"github.com/smashwilson/az-coordinator/secrets"
+	"github.com/smashwilson/az-coordinator/tracing"
 )
 
-var commands = map[string]func(){
-	"help":        help,
-	"init":        initialize,
-	"set-secrets": setSecrets,
-	"diff":        diff,
-	"sync":        sync,
-	"serve":       serve,
+// commands are listed in help output in this order. They're assigned in init because help refers back to them.
+var commands []command
+
+func init() {
+	commands = []command{
+		{name: "help", remote: true, args: "[COMMAND]", run: help,
+			summary: "Show this message, or the help for COMMAND."},
+		{name: "init", run: initialize,
+			summary: "Bootstrap the host and database if needed. Run as root.\nPass --check to report drift or --repair to fix only what's broken."},
+		{name: "config-check", run: checkConfig,
+			summary: "Validate the options file and access to the database, KMS, Docker, and DBus."},
+		{name: "set-secrets", remote: true, args: "FILE", run: setSecrets,
+			summary: "Add or override existing secrets from a JSON file."},
+		{name: "secrets", remote: true, args: "list | get [--reveal] KEY | delete KEY...", run: secretsCommand,
+			summary: "Manage stored secrets: secrets list, secrets get [--reveal] KEY,\nor secrets delete KEY..."},
+		{name: "migrate-secrets", run: migrateSecrets,
+			summary: "Re-encrypt secrets stored in the legacy ciphertext format."},
+		{name: "export-secrets", run: exportSecrets,
+			summary: "Write an encrypted backup of all secrets. Requires --output and either\n--age-recipient or --gpg-recipient."},
+		{name: "import-secrets", args: "FILE", run: importSecrets,
+			summary: "Add or override secrets from a backup file. Requires --age-identity or --gpg."},
+		{name: "backup", run: backupDatabase,
+			summary: "Archive desired units, apps, history, and encrypted secrets. Requires --output,\na path or an s3://BUCKET/KEY URL."},
+		{name: "restore", args: "PATH | s3://BUCKET/KEY", run: restoreDatabase,
+			summary: "Load a backup archive into an empty database. Pass --force to replace its contents."},
+		{name: "add-unit", remote: true, run: addUnit,
+			summary: "Add a desired unit from a --file spec and/or flags like --path, --type, --image."},
+		{name: "update-unit", remote: true, args: "ID", run: updateUnit,
+			summary: "Change a desired unit. Accepts the same spec file and flags as add-unit."},
+		{name: "remove-unit", remote: true, args: "ID", run: removeUnit,
+			summary: "Remove a desired unit."},
+		{name: "unit-history", remote: true, args: "ID", run: unitHistory,
+			summary: "List each change made to a desired unit: who made it, when, and the settings it changed."},
+		{name: "apply", remote: true, args: "-f FILE", run: apply,
+			summary: "Create or update desired units from a file of Kubernetes-style Pod and Deployment manifests."},
+		{name: "promote", remote: true, args: "[--from TAG] ID", run: promote,
+			summary: "Move the image at a unit's staging tag to the tag that it runs, then sync that unit."},
+		{name: "diff", remote: true, run: diff,
+			summary: "Calculate the actions needed to be taken to bring the system to its desired state."},
+		{name: "drift", remote: true, run: drift,
+			summary: "Audit the system against its desired state without pulling images or applying changes."},
+		{name: "sync", remote: true, run: sync,
+			summary: "Bring the system to its desired state. Report the actions taken."},
+		{name: "serve", run: serve,
+			summary: "Begin the server that hosts the management API."},
+		{name: "agent", run: agent,
+			summary: "Poll a fleet controller for this host's units and apply them. Pass --once to poll once."},
+		{name: "update-self", run: updateSelf,
+			summary: "Install the latest coordinator release and restart the coordinator's unit."},
+		{name: "version", remote: true, run: version,
+			summary: "Show the build of this binary and the Docker and systemd versions in use."},
+		{name: "uninstall", run: uninstall,
+			summary: "Remove units, configuration, and the coordinator user. Run as root.\nPass --drop-tables to also drop the database tables."},
+	}
 }
 
+// logFormat is the log format requested on the command line. It takes precedence over the log_format option.
+var logFormat string
+
+// logLevelFlagged is true if -verbose or -quiet was given. Either takes precedence over the log_level option.
+var logLevelFlagged bool
+
 // Launch parses and interprets CLI flags and performs the requested operation.
 func Launch() {
 	var (
@@ -32,17 +88,35 @@ func Launch() {
 	flag.BoolVar(&quiet, "quiet", false, quietDescription)
 	flag.BoolVar(&quiet, "q", false, quietDescription)
 
+	const logFormatDescription = "Log output format: text or json."
+	flag.StringVar(&logFormat, "log-format", "", logFormatDescription)
+
+	const outputDescription = "Format of command results on stdout: table, json, or yaml."
+	flag.Var(&output, "output", outputDescription)
+	flag.Var(&output, "o", outputDescription)
+
+	var rf remoteFlags
+	flag.StringVar(&rf.server, "server", "", "Run the command against the API of the coordinator at this URL.")
+	flag.StringVar(&rf.token, "token", "", "Authenticate to -server with this API token.")
+	flag.BoolVar(&rf.bearer, "bearer", false, "Send -token as an OIDC bearer token instead of the shared API token.")
+	flag.StringVar(&rf.caPath, "ca-cert", "", "Trust the CA certificates in this PEM file when connecting to -server.")
+
 	const helpDescription = "Show this message."
 	flag.BoolVar(&help, "help", false, helpDescription)
 	flag.BoolVar(&help, "h", false, helpDescription)
 
 	flag.Parse()
 
+	// Secret values are masked in every log entry. The hook is added first so that entries are masked before any
+	// shipping hook sends them elsewhere.
+	log.AddHook(secrets.DefaultRedactor.Hook())
+
 	if verbose && quiet {
 		log.Error("-verbose and -quiet may not be provided together.")
 		writeHelp(os.Stderr, 1)
 	}
 
+	logLevelFlagged = verbose || quiet
 	if verbose {
 		log.SetLevel(log.TraceLevel)
 	}
@@ -50,18 +124,39 @@ func Launch() {
 		log.SetLevel(log.WarnLevel)
 	}
 
+	if len(logFormat) > 0 {
+		formatter, err := config.NewLogFormatter(logFormat)
+		if err != nil {
+			log.WithError(err).Error("Invalid -log-format.")
+			writeHelp(os.Stderr, 1)
+		}
+		log.SetFormatter(formatter)
+	}
+
 	if help {
 		writeHelp(os.Stdout, 0)
 	}
 
+	client, err := newRemoteClient(rf)
+	if err != nil {
+		log.WithError(err).Error("Invalid remote options.")
+		writeHelp(os.Stderr, 1)
+	}
+	remote = client
+
 	if flag.NArg() < 1 {
 		log.Error("You must provide at least one command.")
 		writeHelp(os.Stderr, 1)
 	}
 
-	if fn, ok := commands[flag.Arg(0)]; ok {
-		fn()
-	} else {
+	cmd, ok := lookupCommand(flag.Arg(0))
+	if !ok {
+		log.WithField("command", flag.Arg(0)).Error("Unrecognized command.")
 		writeHelp(os.Stderr, 1)
 	}
+	if remote != nil && !cmd.remote {
+		log.WithField("command", cmd.name).Fatal("This command needs direct access to the host and can't be run with -server.")
+	}
+	cmd.run(newFlagSet(cmd), flag.Args()[1:])
+	tracing.Flush(tracing.FlushTimeout)
 }
@@ -0,0 +1,28 @@
+package cli
+
+import (
+	"flag"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/secrets"
+)
+
+func migrateSecrets(flags *flag.FlagSet, args []string) {
+	parseFlags(flags, args)
+
+	var r = prepare(needs{options: true, db: true, ring: true})
+
+	log.Info("Re-encrypting legacy secrets.")
+	migrated, skipped, err := secrets.MigrateCiphertexts(r.db, r.ring)
+	if err != nil {
+		log.WithError(err).Fatal("Unable to migrate secrets.")
+	}
+
+	log.WithFields(log.Fields{
+		"migrated": migrated,
+		"skipped":  skipped,
+	}).Info("Secrets migrated.")
+	if skipped > 0 {
+		log.Fatal("Some secrets could not be migrated.")
+	}
+}
@@ -0,0 +1,189 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// outputFormat chooses how commands write their results to stdout. Logging always goes to stderr.
+type outputFormat string
+
+const (
+	// outputTable is human-readable text, aligned into columns where that helps.
+	outputTable outputFormat = "table"
+
+	// outputJSON writes each result as a single indented JSON document.
+	outputJSON outputFormat = "json"
+
+	// outputYAML writes each result as a YAML document with the same structure as its JSON.
+	outputYAML outputFormat = "yaml"
+)
+
+// output is the format requested with the global -output flag.
+var output = outputTable
+
+// Set implements flag.Value.
+func (f *outputFormat) Set(value string) error {
+	switch outputFormat(value) {
+	case outputTable, outputJSON, outputYAML:
+		*f = outputFormat(value)
+		return nil
+	default:
+		return fmt.Errorf("unrecognized output format %q: expected table, json, or yaml", value)
+	}
+}
+
+func (f *outputFormat) String() string {
+	return string(*f)
+}
+
+// emit writes result to stdout in the requested output format. table renders the human-readable form.
+func emit(result interface{}, table func(w io.Writer)) {
+	switch output {
+	case outputJSON:
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(result); err != nil {
+			log.WithError(err).Fatal("Unable to write JSON.")
+		}
+	case outputYAML:
+		if err := writeYAML(os.Stdout, result); err != nil {
+			log.WithError(err).Fatal("Unable to write YAML.")
+		}
+	default:
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		table(w)
+		w.Flush()
+	}
+}
+
+// writeYAML writes result as YAML. It's serialized through its JSON form first, so that JSON struct tags and
+// MarshalJSON methods shape both formats identically.
+func writeYAML(out io.Writer, result interface{}) error {
+	raw, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var generic interface{}
+	if err := decoder.Decode(&generic); err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	b.WriteString("---\n")
+	writeYAMLValue(&b, generic, 0)
+	_, err = io.WriteString(out, b.String())
+	return err
+}
+
+func writeYAMLValue(b *strings.Builder, value interface{}, indent int) {
+	prefix := strings.Repeat("  ", indent)
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			b.WriteString(prefix + "{}\n")
+			return
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			b.WriteString(prefix + yamlScalar(key) + ":")
+			writeYAMLChild(b, v[key], indent)
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			b.WriteString(prefix + "[]\n")
+			return
+		}
+		for _, item := range v {
+			b.WriteString(prefix + "-")
+			writeYAMLChild(b, item, indent)
+		}
+	default:
+		b.WriteString(prefix + yamlScalar(v) + "\n")
+	}
+}
+
+// writeYAMLChild finishes the line of a mapping key or sequence entry with child, nesting collections beneath it.
+func writeYAMLChild(b *strings.Builder, child interface{}, indent int) {
+	switch c := child.(type) {
+	case map[string]interface{}:
+		if len(c) > 0 {
+			b.WriteString("\n")
+			writeYAMLValue(b, c, indent+1)
+			return
+		}
+		b.WriteString(" {}\n")
+	case []interface{}:
+		if len(c) > 0 {
+			b.WriteString("\n")
+			writeYAMLValue(b, c, indent+1)
+			return
+		}
+		b.WriteString(" []\n")
+	default:
+		b.WriteString(" " + yamlScalar(c) + "\n")
+	}
+}
+
+// yamlScalar formats a JSON scalar for YAML, quoting strings that would otherwise be read as another type or break
+// the document's structure.
+func yamlScalar(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(v)
+	case json.Number:
+		return v.String()
+	case string:
+		if yamlNeedsQuotes(v) {
+			return strconv.Quote(v)
+		}
+		return v
+	default:
+		return strconv.Quote(fmt.Sprint(v))
+	}
+}
+
+func yamlNeedsQuotes(s string) bool {
+	if len(s) == 0 || strings.TrimSpace(s) != s {
+		return true
+	}
+	switch strings.ToLower(s) {
+	case "null", "~", "true", "false", "yes", "no", "on", "off", "y", "n":
+		return true
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return true
+	}
+	if strings.ContainsAny(s[:1], "-?:,[]{}#&*!|>'\"%@`") {
+		return true
+	}
+	if strings.Contains(s, ": ") || strings.Contains(s, " #") || strings.HasSuffix(s, ":") {
+		return true
+	}
+	for _, r := range s {
+		if r < ' ' || r == 0x7f {
+			return true
+		}
+	}
+	return false
+}
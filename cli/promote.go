@@ -0,0 +1,86 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/state"
+)
+
+// promoteResult is the outcome of a promotion reported by the promote command.
+type promoteResult struct {
+	Promotion *state.Promotion `json:"promotion"`
+	Sync      syncResult       `json:"sync"`
+}
+
+func promote(flags *flag.FlagSet, args []string) {
+	var fromTag string
+	flags.StringVar(&fromTag, "from", "staging", "The tag to promote the unit's image from.")
+	parseFlags(flags, args)
+	id := parseUnitID(flags)
+
+	var result promoteResult
+	if remote != nil {
+		result = remotePromote(id, fromTag)
+	} else {
+		result = localPromote(id, fromTag)
+	}
+
+	emit(result, func(w io.Writer) {
+		p := result.Promotion
+		fmt.Fprintf(w, "unit\t%d\n", p.UnitID)
+		fmt.Fprintf(w, "from\t%s\n", p.FromTag)
+		fmt.Fprintf(w, "to\t%s\n", p.ToTag)
+		fmt.Fprintf(w, "image\t%s\n", p.ImageID)
+		if len(p.Digest) > 0 {
+			fmt.Fprintf(w, "digest\t%s\n", p.Digest)
+		}
+		if result.Sync.Delta != nil {
+			writeDeltaTable(w, *result.Sync.Delta)
+		}
+		for _, err := range result.Sync.Errors {
+			fmt.Fprintf(w, "error: %s\n", err)
+		}
+	})
+}
+
+// localPromote promotes a unit on this host, then syncs that unit alone.
+func localPromote(id int, fromTag string) promoteResult {
+	r := prepare(needs{options: true, session: true})
+	defer r.session.Release()
+	ctx := context.Background()
+
+	unit := readUnit(ctx, r.session, id)
+	trigger := state.LocalTrigger(state.TriggerCLI)
+	promotion, err := r.session.PromoteUnit(ctx, unit, fromTag, trigger.Actor)
+	if err != nil {
+		log.WithError(err).Fatal("Unable to promote unit.")
+	}
+	log.WithField("path", unit.Path).WithField("imageID", promotion.ImageID).Info("Unit promoted. Syncing it.")
+
+	settings := syncSettings(r.options)
+	settings.Trigger = trigger
+	settings.Trigger.Reason = fmt.Sprintf("promote %s from %s", unit.UnitName(), fromTag)
+	settings.Unit = &id
+	return promoteResult{Promotion: promotion, Sync: runLocalSync(r, settings)}
+}
+
+// remotePromote asks the coordinator at -server to promote a unit, then follows the sync of that unit.
+func remotePromote(id int, fromTag string) promoteResult {
+	body := struct {
+		FromTag string `json:"from_tag"`
+	}{fromTag}
+
+	var promotion state.Promotion
+	path := fmt.Sprintf("/desired/%d/promote?source=%s", id, state.TriggerCLI)
+	if err := remote.do(http.MethodPost, path, body, &promotion); err != nil {
+		log.WithError(err).Fatal("Unable to promote unit.")
+	}
+	log.WithField("id", id).WithField("imageID", promotion.ImageID).Info("Unit promoted. Syncing it.")
+
+	return promoteResult{Promotion: &promotion, Sync: followRemoteSync()}
+}
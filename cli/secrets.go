@@ -4,32 +4,43 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/smashwilson/az-coordinator/secrets"
+	"github.com/smashwilson/az-coordinator/state"
 )
 
-func setSecrets() {
-	if flag.NArg() < 2 {
-		fmt.Fprintf(os.Stderr, "set-secrets requires at least one argument: the path to a JSON file.\n")
-		writeHelp(os.Stderr, 1)
+func setSecrets(flags *flag.FlagSet, args []string) {
+	parseFlags(flags, args)
+	if flags.NArg() < 1 {
+		usageError(flags, "set-secrets requires at least one argument: the path to a JSON file.")
 	}
 
-	var r = prepare(needs{options: true, db: true})
-
 	var toLoad map[string]string
-	inf, err := os.Open(flag.Arg(1))
+	inf, err := os.Open(flags.Arg(0))
 	if err != nil {
-		log.WithError(err).WithField("path", flag.Arg(1)).Fatal("Unable to load secrets file.")
+		log.WithError(err).WithField("path", flags.Arg(0)).Fatal("Unable to load secrets file.")
 	}
 	decoder := json.NewDecoder(inf)
 	if err = decoder.Decode(&toLoad); err != nil {
-		log.WithError(err).WithField("path", flag.Arg(1)).Fatal("Unable to parse secrets file.")
+		log.WithError(err).WithField("path", flags.Arg(0)).Fatal("Unable to parse secrets file.")
+	}
+
+	if remote != nil {
+		if err := remote.do(http.MethodPost, "/secrets", toLoad, nil); err != nil {
+			log.WithError(err).Fatal("Secrets rejected.")
+		}
+		log.WithField("added", len(toLoad)).Info("Secrets added successfully.")
+		return
 	}
 
+	var r = prepare(needs{options: true, db: true})
+
 	log.Info("Creating decoder ring.")
-	ring, err := secrets.NewDecoderRing(r.options.MasterKeyID, r.options.AWSRegion)
+	ring, err := secrets.NewDecoderRing(r.options.MasterKeyID, r.options.AWS())
 	if err != nil {
 		log.WithError(err).Fatal("Unable to create decoder ring.")
 	}
@@ -41,6 +52,10 @@ func setSecrets() {
 	}
 	log.WithField("count", bag.Len()).Info("Secrets loaded successfully.")
 
+	if err := bag.ValidateUpdates(toLoad); err != nil {
+		log.WithError(err).Fatal("Secrets rejected.")
+	}
+
 	for k, v := range toLoad {
 		bag.Set(k, v)
 	}
@@ -51,3 +66,181 @@ func setSecrets() {
 
 	log.WithFields(log.Fields{"count": bag.Len(), "added": len(toLoad)}).Info("Secrets added successfully.")
 }
+
+// secretsCommand dispatches the "secrets list", "secrets get", and "secrets delete" subcommands.
+func secretsCommand(flags *flag.FlagSet, args []string) {
+	subcommands := []command{
+		{name: "secrets list", run: listSecrets,
+			summary: "List the keys of stored secrets, with the path of each one that's written to a file."},
+		{name: "secrets get", args: "KEY", run: getSecret,
+			summary: "Report whether a secret is set, or print its value with --reveal."},
+		{name: "secrets delete", args: "KEY...", run: deleteSecrets,
+			summary: "Remove stored secrets."},
+	}
+
+	parseFlags(flags, args)
+	if flags.NArg() < 1 {
+		usageError(flags, "secrets requires a subcommand: list, get, or delete.")
+	}
+	for _, subcommand := range subcommands {
+		if subcommand.name == "secrets "+flags.Arg(0) {
+			subcommand.run(newFlagSet(subcommand), flags.Args()[1:])
+			return
+		}
+	}
+	usageError(flags, "Unrecognized secrets subcommand: %s.", flags.Arg(0))
+}
+
+// loadSecrets decrypts the secrets stored in the database.
+func loadSecrets() (results, *secrets.Bag) {
+	var r = prepare(needs{db: true, ring: true})
+
+	bag, err := secrets.LoadFromDatabase(r.db, r.ring)
+	if err != nil {
+		log.WithError(err).Fatal("Unable to load and decrypt existing secrets.")
+	}
+	return r, bag
+}
+
+// secretListing describes one stored secret in the output of secrets list. Path is set for file-kind secrets.
+type secretListing struct {
+	Key  string `json:"key"`
+	Path string `json:"path,omitempty"`
+}
+
+// secretValue is the output of secrets get. Value is only included with --reveal.
+type secretValue struct {
+	Key    string  `json:"key"`
+	Length int     `json:"length"`
+	Value  *string `json:"value,omitempty"`
+}
+
+func listSecrets(flags *flag.FlagSet, args []string) {
+	parseFlags(flags, args)
+
+	var (
+		keys         []string
+		destinations map[string]secrets.FileDestination
+	)
+	if remote != nil {
+		if err := remote.do(http.MethodGet, "/secrets", nil, &keys); err != nil {
+			log.WithError(err).Fatal("Unable to list secrets.")
+		}
+		if err := remote.do(http.MethodGet, "/secrets/files", nil, &destinations); err != nil {
+			log.WithError(err).Fatal("Unable to list secret file destinations.")
+		}
+	} else {
+		_, bag := loadSecrets()
+		keys = bag.Keys()
+		destinations = bag.FileDestinations()
+	}
+
+	listings := make([]secretListing, 0, len(keys))
+	for _, key := range keys {
+		listings = append(listings, secretListing{Key: key, Path: destinations[key].Path})
+	}
+
+	emit(listings, func(w io.Writer) {
+		for _, listing := range listings {
+			fmt.Fprintf(w, "%s\t%s\n", listing.Key, listing.Path)
+		}
+	})
+}
+
+func getSecret(flags *flag.FlagSet, args []string) {
+	var reveal bool
+
+	flags.BoolVar(&reveal, "reveal", false, "Print the secret's value. Without this, only whether it's set is reported.")
+	parseFlags(flags, args)
+
+	if flags.NArg() != 1 {
+		usageError(flags, "secrets get requires exactly one secret key.")
+	}
+	key := flags.Arg(0)
+	if remote != nil {
+		log.Fatal("The API doesn't return secret values, so secrets get can't be run with -server.")
+	}
+
+	_, bag := loadSecrets()
+	if !bag.Has(key) {
+		reportUnknownSecrets(bag, []string{key})
+	}
+
+	value := bag.Get(key, "")
+	result := secretValue{Key: key, Length: len(value)}
+	if reveal {
+		log.WithField("key", key).Warn("Revealing secret value.")
+		result.Value = &value
+	}
+
+	emit(result, func(w io.Writer) {
+		if reveal {
+			fmt.Fprintln(w, value)
+		} else {
+			fmt.Fprintf(w, "%s is set (%d bytes). Pass --reveal to print its value.\n", key, len(value))
+		}
+	})
+}
+
+func deleteSecrets(flags *flag.FlagSet, args []string) {
+	var force bool
+	flags.BoolVar(&force, "force", false, "Delete any number of secrets at once.")
+	parseFlags(flags, args)
+
+	if flags.NArg() < 1 {
+		usageError(flags, "secrets delete requires at least one secret key.")
+	}
+	keys := flags.Args()
+	if remote != nil {
+		path := "/secrets"
+		if force {
+			path += "?force=true"
+		}
+		if err := remote.do(http.MethodDelete, path, keys, nil); err != nil {
+			log.WithError(err).Fatal("Unable to delete secrets.")
+		}
+		log.WithField("deleted", len(keys)).Info("Secrets deleted successfully.")
+		return
+	}
+
+	r, bag := loadSecrets()
+	if err := state.CheckForce("delete %d secrets", len(keys), r.options.Guards.SecretDeletionLimit(), force); err != nil {
+		log.WithError(err).Fatal("Secrets not deleted. Pass --force to delete them.")
+	}
+
+	missing := make([]string, 0)
+	for _, key := range keys {
+		if !bag.Has(key) {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		reportUnknownSecrets(bag, missing)
+	}
+
+	for _, key := range keys {
+		bag.Delete(key)
+	}
+
+	if err := bag.SaveToDatabase(r.db, r.ring, true); err != nil {
+		log.WithError(err).Fatal("Unable to save remaining secrets.")
+	}
+	if err := bag.SaveFileDestinations(r.db); err != nil {
+		log.WithError(err).Fatal("Unable to save secret file destinations.")
+	}
+
+	log.WithFields(log.Fields{"count": bag.Len(), "deleted": len(keys)}).Info("Secrets deleted successfully.")
+}
+
+// reportUnknownSecrets exits after listing keys that aren't present in bag, suggesting near matches.
+func reportUnknownSecrets(bag *secrets.Bag, keys []string) {
+	existing := bag.Keys()
+	for _, key := range keys {
+		if match, ok := secrets.NearDuplicate(key, existing); ok {
+			fmt.Fprintf(os.Stderr, "Unrecognized secret key: %s (did you mean %s?)\n", key, match)
+		} else {
+			fmt.Fprintf(os.Stderr, "Unrecognized secret key: %s\n", key)
+		}
+	}
+	os.Exit(1)
+}
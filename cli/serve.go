@@ -1,37 +1,120 @@
 package cli
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
 	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/leader"
 	"github.com/smashwilson/az-coordinator/state"
+	"github.com/smashwilson/az-coordinator/tracing"
 	"github.com/smashwilson/az-coordinator/web"
 )
 
-func serve() {
+func serve(flags *flag.FlagSet, args []string) {
+	parseFlags(flags, args)
+
 	r := prepare(needs{
 		options: true,
 		ring:    true,
 		session: true,
 		db:      true,
 	})
-	r.options.CloudwatchLogger(log.StandardLogger())
+	r.options.ShipLogs(log.StandardLogger())
+	log.WithFields(log.Fields{
+		"version": r.session.DockerAPIVersion(),
+		"pinned":  len(r.options.DockerAPIVersion) > 0,
+	}).Info("Using Docker API version.")
+
+	var elector *leader.Elector
+	isLeader := true
+	if r.options.LeaderElection {
+		elector = leader.NewElector(r.db, leader.DefaultLockKey, leader.DefaultInterval)
 
-	log.Info("Performing initial sync.")
-	delta, errs := r.session.Synchronize(state.SyncSettings{})
-	if len(errs) > 0 {
-		for _, err := range errs {
-			log.WithError(err).Warn("Synchronization error.")
+		var err error
+		isLeader, err = elector.Campaign()
+		if err != nil {
+			log.WithError(err).Fatal("Unable to campaign for leadership.")
 		}
-		log.WithField("errorCount", len(errs)).Fatal("Unable to synchronize.")
-	} else {
-		log.WithField("delta", delta).Debug("Delta applied.")
+		log.WithField("leader", isLeader).Info("Leader election complete.")
+	}
+
+	interrupted, err := r.session.ReadSyncCheckpoint(context.Background(), r.options.Fleet.Host())
+	if err != nil {
+		log.WithError(err).Warn("Unable to read the checkpoint of the previous sync.")
+	}
+	if interrupted != nil && !interrupted.Interrupted() {
+		interrupted = nil
+	}
+	if interrupted != nil {
+		log.WithFields(log.Fields{
+			"phase":   interrupted.Phase,
+			"trigger": interrupted.Trigger.String(),
+		}).Warn("The previous sync was interrupted.")
 	}
-	r.session.Release()
 
-	s, err := web.NewServer(r.options, r.db, r.ring)
+	s, err := web.NewServer(r.options, r.db, r.ring, elector)
 	if err != nil {
 		log.WithError(err).Fatal("Unable to create server.")
 	}
-	if err := s.Listen(); err != nil {
+
+	// Leadership is released on the way out, even if the initial sync is still running.
+	go func() {
+		terminations := make(chan os.Signal, 1)
+		signal.Notify(terminations, syscall.SIGTERM, os.Interrupt)
+		received := <-terminations
+		log.WithField("signal", received.String()).Info("Shutting down.")
+		s.Shutdown()
+		tracing.Flush(tracing.FlushTimeout)
+		os.Exit(0)
+	}()
+
+	// Serve while the initial sync runs, so that /healthz answers and /readyz reports that the coordinator is still
+	// starting.
+	listening := make(chan error, 1)
+	go func() { listening <- s.Listen() }()
+
+	if isLeader {
+		log.Info("Performing initial sync.")
+		settings := syncSettings(r.options)
+		settings.Trigger = state.SyncTrigger{Source: state.TriggerStartup}
+		if interrupted != nil {
+			// The initial sync covers every unit, so it also completes the work of the interrupted sync.
+			settings.Trigger.Reason = fmt.Sprintf("rerun sync interrupted at %s", interrupted.Phase)
+		}
+
+		s.StartInitialSync(settings.Trigger)
+		delta, errs := r.session.Synchronize(context.Background(), settings)
+		s.FinishInitialSync(delta, errs)
+		if len(errs) == 1 && errs[0] == state.ErrSyncInProgress {
+			log.Warn("A sync is already running elsewhere. Skipping initial sync.")
+		} else if len(errs) > 0 {
+			for _, err := range errs {
+				log.WithError(err).Warn("Synchronization error.")
+			}
+			s.Shutdown()
+			log.WithField("errorCount", len(errs)).Fatal("Unable to synchronize.")
+		} else {
+			log.WithField("delta", delta).Debug("Delta applied.")
+		}
+	} else {
+		log.Info("Following another coordinator instance. Skipping initial sync.")
+		s.MarkReady()
+	}
+	r.session.Release()
+
+	// The interrupted sync is reported once the initial sync, which would otherwise replace it, has finished.
+	if interrupted != nil {
+		s.ReportInterruptedSync(*interrupted)
+	}
+
+	err = <-listening
+	s.Shutdown()
+	if err != nil {
 		log.WithError(err).Fatal("Unable to bind socket.")
 	}
 }
@@ -1,19 +1,78 @@
 package cli
 
 import (
-	"encoding/json"
-	"os"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
 
-	"github.com/smashwilson/az-coordinator/slack"
+	"github.com/smashwilson/az-coordinator/leader"
+	"github.com/smashwilson/az-coordinator/notify"
 	"github.com/smashwilson/az-coordinator/state"
 
 	log "github.com/sirupsen/logrus"
 )
 
-func sync() {
+// syncResult is the outcome of a sync reported by the sync command.
+type syncResult struct {
+	Delta  *state.Delta `json:"delta"`
+	Errors []string     `json:"errors"`
+}
+
+func sync(flags *flag.FlagSet, args []string) {
+	var force bool
+	flags.BoolVar(&force, "force", false, "Remove protected units that are no longer desired, and any number of units.")
+	parseFlags(flags, args)
+
+	var result syncResult
+	if remote != nil {
+		result = remoteSync(force)
+	} else {
+		result = localSync(force)
+	}
+
+	emit(result, func(w io.Writer) {
+		if result.Delta != nil {
+			writeDeltaTable(w, *result.Delta)
+		}
+		for _, err := range result.Errors {
+			fmt.Fprintf(w, "error: %s\n", err)
+		}
+	})
+}
+
+// localSync brings this host to its desired state. Protected units are only removed if force is set.
+func localSync(force bool) syncResult {
 	r := prepare(needs{options: true, session: true})
 	defer r.session.Release()
-	delta, errs := r.session.Synchronize(state.SyncSettings{})
+
+	settings := syncSettings(r.options)
+	settings.Trigger = state.LocalTrigger(state.TriggerCLI)
+	settings.Force = force
+	return runLocalSync(r, settings)
+}
+
+// runLocalSync performs a sync with the given settings once this process is the leader, if leader election is
+// enabled.
+func runLocalSync(r results, settings state.SyncSettings) syncResult {
+	if r.options.LeaderElection {
+		elector := leader.NewElector(r.db, leader.DefaultLockKey, leader.DefaultInterval)
+		isLeader, err := elector.Campaign()
+		if err != nil {
+			log.WithError(err).Fatal("Unable to campaign for leadership.")
+		}
+		if !isLeader {
+			log.Fatal("Another coordinator instance is the leader. Request a sync from it instead.")
+		}
+		defer elector.Stop()
+	}
+
+	delta, errs := r.session.Synchronize(context.Background(), settings)
+	if len(errs) == 1 && errs[0] == state.ErrSyncInProgress {
+		log.Fatal("A sync is already running elsewhere.")
+	}
 	if len(errs) > 0 {
 		for _, err := range errs {
 			log.WithError(err).Warn("Synchronization error.")
@@ -22,13 +81,76 @@ func sync() {
 		log.WithField("delta", delta).Debug("Delta applied.")
 	}
 
-	if len(r.options.SlackWebhookURL) > 0 {
-		slack.ReportSync(r.options.SlackWebhookURL, delta, errs)
+	notify.ReportSync(*r.options, delta, errs, settings.Trigger, "")
+
+	result := syncResult{Delta: delta, Errors: make([]string, 0, len(errs))}
+	for _, err := range errs {
+		result.Errors = append(result.Errors, err.Error())
 	}
+	return result
+}
+
+// remoteSyncProgress is the subset of GET /sync that remoteSync follows.
+type remoteSyncProgress struct {
+	InProgress bool `json:"in_progress"`
+	Reports    []struct {
+		Message string `json:"message"`
+	} `json:"reports"`
+	Errors []string     `json:"errors"`
+	Delta  *state.Delta `json:"delta"`
 
-	encoder := json.NewEncoder(os.Stdout)
-	encoder.SetIndent("", "  ")
-	if err := encoder.Encode(delta); err != nil {
-		log.WithError(err).Fatal("Unable to write JSON.")
+	ReportOffset int `json:"report_offset"`
+	NextOffset   int `json:"next_offset"`
+
+	PendingApproval *struct {
+		ID      int      `json:"id"`
+		Reasons []string `json:"reasons"`
+	} `json:"pending_approval"`
+}
+
+// remoteSync asks the coordinator at -server to sync, then follows its progress until it's done.
+func remoteSync(force bool) syncResult {
+	path := "/sync?source=" + state.TriggerCLI
+	if force {
+		path += "&force=true"
+	}
+	if err := remote.do(http.MethodPost, path, nil, nil); err != nil {
+		log.WithError(err).Fatal("Unable to start a sync.")
+	}
+	return followRemoteSync()
+}
+
+// followRemoteSync logs the progress of the sync running on the coordinator at -server until it's done.
+func followRemoteSync() syncResult {
+	seen := 0
+	for {
+		var progress remoteSyncProgress
+		if err := remote.do(http.MethodGet, fmt.Sprintf("/sync?offset=%d", seen), nil, &progress); err != nil {
+			log.WithError(err).Fatal("Unable to check sync progress.")
+		}
+
+		if progress.NextOffset < seen {
+			// A new sync has started since the last check.
+			seen = 0
+			continue
+		}
+		if progress.ReportOffset > seen {
+			log.Warnf("%d log entries were discarded before they could be shown.", progress.ReportOffset-seen)
+		}
+		for _, report := range progress.Reports {
+			log.Info(report.Message)
+		}
+		seen = progress.NextOffset
+
+		if !progress.InProgress {
+			if pending := progress.PendingApproval; pending != nil {
+				log.WithField("reasons", pending.Reasons).Warnf("Sync is waiting for approval. POST /sync/%d/approve to apply it.", pending.ID)
+			}
+			if progress.Errors == nil {
+				progress.Errors = make([]string, 0)
+			}
+			return syncResult{Delta: progress.Delta, Errors: progress.Errors}
+		}
+		time.Sleep(2 * time.Second)
 	}
 }
@@ -0,0 +1,71 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/exec"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/state"
+)
+
+func uninstall(flags *flag.FlagSet, args []string) {
+	var dropTables bool
+
+	flags.BoolVar(&dropTables, "drop-tables", false, "Drop the coordinator's database tables, destroying all desired state and secrets.")
+	parseFlags(flags, args)
+
+	var r = prepare(needs{options: true, db: true})
+
+	// Tearing down units never touches secrets, so the session is created without a decoder ring. This lets a host be
+	// decommissioned even if its KMS key is no longer available.
+	log.Info("Establishing session.")
+	session, err := state.NewSession(r.db, nil, r.options.DockerAPIVersion)
+	if err != nil {
+		log.WithError(err).Fatal("Unable to create session.")
+	}
+	lease := session.Lease()
+	defer lease.Release()
+
+	log.Info("Removing units.")
+	if errs := lease.RemoveAllUnits(context.Background()); len(errs) > 0 {
+		for _, err := range errs {
+			log.WithError(err).Warn("Error encountered while removing units.")
+		}
+	}
+
+	if closed, err := state.CloseFirewallPorts(context.Background()); err != nil {
+		log.WithError(err).Warn("Unable to close firewall ports.")
+	} else if len(closed) > 0 {
+		log.WithField("ports", closed).Info("Firewall ports closed.")
+	}
+
+	for _, confPath := range []string{dbusConfPath, polkitConfPath} {
+		if err := os.Remove(confPath); err != nil && !os.IsNotExist(err) {
+			log.WithError(err).WithField("path", confPath).Warn("Unable to remove configuration file.")
+			continue
+		}
+		log.WithField("path", confPath).Debug("Configuration file removed.")
+	}
+
+	if dropTables {
+		log.WithField("dialect", r.db.Dialect.Name()).Info("Dropping tables.")
+		if err := r.db.DropTables(); err != nil {
+			log.WithError(err).Error("Unable to drop tables.")
+		}
+	}
+
+	if exists, _ := getUserGroups("coordinator"); exists {
+		if output, err := exec.Command("userdel", "coordinator").CombinedOutput(); err != nil {
+			log.WithFields(log.Fields{
+				"err":      err,
+				"userName": "coordinator",
+			}).Errorf("Unable to remove user.\n%s", output)
+		} else {
+			log.WithField("userName", "coordinator").Debug("User removed.")
+		}
+	}
+
+	log.Info("Uninstall complete.")
+}
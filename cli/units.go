@@ -0,0 +1,609 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/state"
+)
+
+// unitSpec describes a desired unit with the same fields accepted by the HTTP API.
+type unitSpec struct {
+	Path      string             `json:"path,omitempty"`
+	Type      *state.UnitType    `json:"type,omitempty"`
+	Container *unitSpecContainer `json:"container,omitempty"`
+	Secrets   []string           `json:"secrets,omitempty"`
+	Env       map[string]string  `json:"env,omitempty"`
+	Ports     map[int]int        `json:"ports,omitempty"`
+	Volumes   map[string]string  `json:"volumes,omitempty"`
+	Schedule  *string            `json:"calendar,omitempty"`
+	Hosts     []string           `json:"hosts,omitempty"`
+	Selector  map[string]string  `json:"selector,omitempty"`
+	App       string             `json:"app,omitempty"`
+
+	Ulimits    map[string]string `json:"ulimits,omitempty"`
+	ShmSize    string            `json:"shm_size,omitempty"`
+	Devices    []string          `json:"devices,omitempty"`
+	ExtraHosts map[string]string `json:"extra_hosts,omitempty"`
+	GPUs       string            `json:"gpus,omitempty"`
+	Enabled    *bool             `json:"enabled,omitempty"`
+	Protected  *bool             `json:"protected,omitempty"`
+
+	// Pinned asks for the unit's container to be pinned to the image it's running now, or to be unpinned.
+	Pinned *bool `json:"pinned,omitempty"`
+
+	// Version is the version of the unit that an update was read from, so that the update is refused if someone else
+	// changed the unit in the meantime.
+	Version *int `json:"version,omitempty"`
+
+	// pin is the image ID that the unit's container is currently pinned to, which updates preserve.
+	pin string
+}
+
+type unitSpecContainer struct {
+	Name      string `json:"name"`
+	ImageName string `json:"image_name"`
+	ImageTag  string `json:"image_tag"`
+}
+
+// listFlag collects each occurrence of a repeatable flag.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// unitFlags are the command-line flags shared by add-unit and update-unit. Any flag that's given overrides the
+// corresponding field of the spec file.
+type unitFlags struct {
+	flags *flag.FlagSet
+
+	specPath      string
+	path          string
+	unitType      string
+	containerName string
+	imageName     string
+	imageTag      string
+	schedule      string
+	secrets       listFlag
+	env           listFlag
+	ports         listFlag
+	volumes       listFlag
+	hosts         listFlag
+	selector      listFlag
+	app           string
+	ulimits       listFlag
+	shmSize       string
+	devices       listFlag
+	extraHosts    listFlag
+	gpus          string
+	enabled       bool
+	protected     bool
+	pinned        bool
+}
+
+// newUnitFlags declares the unit flags on flags.
+func newUnitFlags(flags *flag.FlagSet) *unitFlags {
+	f := &unitFlags{flags: flags}
+	f.flags.StringVar(&f.specPath, "file", "", "Read the unit from this JSON spec file.")
+	f.flags.StringVar(&f.path, "path", "", "Path to the unit file, like /etc/systemd/system/az-web.service.")
+	f.flags.StringVar(&f.unitType, "type", "", "Unit type: simple, oneshot, timer, or self.")
+	f.flags.StringVar(&f.containerName, "container-name", "", "Name of the container run by the unit.")
+	f.flags.StringVar(&f.imageName, "image", "", "Container image name.")
+	f.flags.StringVar(&f.imageTag, "tag", "", "Container image tag.")
+	f.flags.StringVar(&f.schedule, "calendar", "", "OnCalendar schedule for timer units.")
+	f.flags.Var(&f.secrets, "secret", "Secret key to provide to the unit. May be repeated.")
+	f.flags.Var(&f.env, "env", "Environment variable as KEY=VALUE. May be repeated.")
+	f.flags.Var(&f.ports, "port", "Published port as HOST:CONTAINER. May be repeated.")
+	f.flags.Var(&f.volumes, "volume", "Mounted volume as HOST_PATH:CONTAINER_PATH. May be repeated.")
+	f.flags.Var(&f.hosts, "host", "Fleet host to run the unit on. May be repeated. Defaults to every host.")
+	f.flags.Var(&f.selector, "selector", "Host label the unit requires, as KEY=VALUE. May be repeated.")
+	f.flags.StringVar(&f.app, "app", "", "App that the unit belongs to. Pass an empty value to remove it from its app.")
+	f.flags.Var(&f.ulimits, "ulimit", "Container resource limit as NAME=SOFT[:HARD]. May be repeated.")
+	f.flags.StringVar(&f.shmSize, "shm-size", "", "Size of the container's /dev/shm, like 512m.")
+	f.flags.Var(&f.devices, "device", "Host device to expose as HOST_PATH[:CONTAINER_PATH[:PERMISSIONS]]. May be repeated.")
+	f.flags.Var(&f.extraHosts, "extra-host", "Extra /etc/hosts entry for the container as HOST=IP. May be repeated.")
+	f.flags.StringVar(&f.gpus, "gpus", "", "GPUs to expose to the container: all, a count, or device=ID[,ID].")
+	f.flags.BoolVar(&f.enabled, "enabled", true, "Whether the unit is present on its hosts. Use -enabled=false to park it.")
+	f.flags.BoolVar(&f.protected, "protected", false, "Refuse to remove the unit in syncs that aren't forced.")
+	f.flags.BoolVar(&f.pinned, "pinned", false, "Pin the container to the image it's running now. Use -pinned=false to unpin it.")
+	return f
+}
+
+func (f *unitFlags) given(name string) bool {
+	found := false
+	f.flags.Visit(func(fl *flag.Flag) {
+		if fl.Name == name {
+			found = true
+		}
+	})
+	return found
+}
+
+// apply reads the spec file, if one was given, into spec, then overrides its fields with any flags that were given.
+func (f *unitFlags) apply(spec *unitSpec) error {
+	if len(f.specPath) > 0 {
+		inf, err := os.Open(f.specPath)
+		if err != nil {
+			return err
+		}
+		defer inf.Close()
+
+		decoder := json.NewDecoder(inf)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(spec); err != nil {
+			return fmt.Errorf("unable to parse %s: %v", f.specPath, err)
+		}
+	}
+
+	if f.given("path") {
+		spec.Path = f.path
+	}
+	if f.given("type") {
+		tp, err := state.UnitTypeNamed(f.unitType)
+		if err != nil {
+			return err
+		}
+		spec.Type = &tp
+	}
+	if f.given("container-name") || f.given("image") || f.given("tag") {
+		if spec.Container == nil {
+			spec.Container = &unitSpecContainer{}
+		}
+		if f.given("container-name") {
+			spec.Container.Name = f.containerName
+		}
+		if f.given("image") {
+			spec.Container.ImageName = f.imageName
+		}
+		if f.given("tag") {
+			spec.Container.ImageTag = f.imageTag
+		}
+	}
+	if f.given("calendar") {
+		spec.Schedule = &f.schedule
+	}
+	if f.given("secret") {
+		spec.Secrets = f.secrets
+	}
+	if f.given("env") {
+		env, err := splitPairs(f.env, "=")
+		if err != nil {
+			return fmt.Errorf("invalid --env: %v", err)
+		}
+		spec.Env = env
+	}
+	if f.given("port") {
+		pairs, err := splitPairs(f.ports, ":")
+		if err != nil {
+			return fmt.Errorf("invalid --port: %v", err)
+		}
+		spec.Ports = make(map[int]int, len(pairs))
+		for host, container := range pairs {
+			hostPort, err := strconv.Atoi(host)
+			if err != nil {
+				return fmt.Errorf("invalid --port %s:%s: %v", host, container, err)
+			}
+			containerPort, err := strconv.Atoi(container)
+			if err != nil {
+				return fmt.Errorf("invalid --port %s:%s: %v", host, container, err)
+			}
+			spec.Ports[hostPort] = containerPort
+		}
+	}
+	if f.given("volume") {
+		volumes, err := splitPairs(f.volumes, ":")
+		if err != nil {
+			return fmt.Errorf("invalid --volume: %v", err)
+		}
+		spec.Volumes = volumes
+	}
+	if f.given("host") {
+		spec.Hosts = f.hosts
+	}
+	if f.given("selector") {
+		selector, err := splitPairs(f.selector, "=")
+		if err != nil {
+			return fmt.Errorf("invalid --selector: %v", err)
+		}
+		spec.Selector = selector
+	}
+	if f.given("app") {
+		spec.App = f.app
+	}
+	if f.given("ulimit") {
+		ulimits, err := splitPairs(f.ulimits, "=")
+		if err != nil {
+			return fmt.Errorf("invalid --ulimit: %v", err)
+		}
+		spec.Ulimits = ulimits
+	}
+	if f.given("shm-size") {
+		spec.ShmSize = f.shmSize
+	}
+	if f.given("device") {
+		spec.Devices = f.devices
+	}
+	if f.given("extra-host") {
+		extraHosts, err := splitPairs(f.extraHosts, "=")
+		if err != nil {
+			return fmt.Errorf("invalid --extra-host: %v", err)
+		}
+		spec.ExtraHosts = extraHosts
+	}
+	if f.given("gpus") {
+		spec.GPUs = f.gpus
+	}
+	if f.given("enabled") {
+		spec.Enabled = &f.enabled
+	}
+	if f.given("protected") {
+		spec.Protected = &f.protected
+	}
+	if f.given("pinned") {
+		spec.Pinned = &f.pinned
+	}
+	return nil
+}
+
+// splitPairs splits each value at the first occurrence of sep.
+func splitPairs(values []string, sep string) (map[string]string, error) {
+	pairs := make(map[string]string, len(values))
+	for _, value := range values {
+		parts := strings.SplitN(value, sep, 2)
+		if len(parts) != 2 || len(parts[0]) == 0 {
+			return nil, fmt.Errorf("expected a value like A%sB, got %q", sep, value)
+		}
+		pairs[parts[0]] = parts[1]
+	}
+	return pairs, nil
+}
+
+// buildUnit validates spec with builder, collecting every problem it finds.
+func buildUnit(builder state.DesiredSystemdUnitBuilder, spec unitSpec, session *state.SessionLease, setPath bool) (*state.DesiredSystemdUnit, []error) {
+	errs := make([]error, 0)
+	tried := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if setPath {
+		tried(builder.Path(spec.Path))
+	}
+	if spec.Type != nil {
+		tried(builder.Type(*spec.Type))
+	}
+	if spec.Container != nil {
+		tried(builder.Container(spec.Container.ImageName, spec.Container.ImageTag, spec.Container.Name))
+	} else {
+		tried(builder.Container("", "", ""))
+	}
+	tried(builder.Pin(spec.pin))
+	tried(builder.Secrets(spec.Secrets, *session))
+	tried(builder.Volumes(spec.Volumes))
+	tried(builder.Env(spec.Env, *session))
+	tried(builder.Ports(spec.Ports))
+	if spec.Schedule != nil {
+		tried(builder.Schedule(*spec.Schedule))
+	} else {
+		tried(builder.Schedule(""))
+	}
+	tried(builder.Hosts(spec.Hosts))
+	tried(builder.Selector(spec.Selector))
+	tried(builder.App(spec.App, *session))
+	tried(builder.Ulimits(spec.Ulimits))
+	tried(builder.ShmSize(spec.ShmSize))
+	tried(builder.Devices(spec.Devices))
+	tried(builder.ExtraHosts(spec.ExtraHosts))
+	tried(builder.GPUs(spec.GPUs))
+	if spec.Enabled != nil {
+		tried(builder.Enabled(*spec.Enabled))
+	}
+	if spec.Protected != nil {
+		tried(builder.Protected(*spec.Protected))
+	}
+
+	unit, err := builder.Build()
+	tried(err)
+	return unit, errs
+}
+
+func reportInvalidUnit(errs []error) {
+	fmt.Fprintf(os.Stderr, "Invalid desired unit:\n")
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "  %v\n", err)
+	}
+	os.Exit(1)
+}
+
+func printUnit(unit *state.DesiredSystemdUnit) {
+	emit(unit, func(w io.Writer) {
+		if unit.ID != nil {
+			fmt.Fprintf(w, "id\t%d\n", *unit.ID)
+		}
+		fmt.Fprintf(w, "path\t%s\n", unit.Path)
+		fmt.Fprintf(w, "type\t%s\n", unit.Type)
+		fmt.Fprintf(w, "enabled\t%t\n", unit.Enabled)
+		if unit.Protected {
+			fmt.Fprintf(w, "protected\ttrue\n")
+		}
+		if unit.Container != nil {
+			fmt.Fprintf(w, "container\t%s (%s:%s)\n", unit.Container.Name, unit.Container.ImageName, unit.Container.ImageTag)
+			if len(unit.Container.PinnedImageID) > 0 {
+				fmt.Fprintf(w, "pinned\t%s\n", unit.Container.PinnedImageID)
+			}
+		}
+		if len(unit.Schedule) > 0 {
+			fmt.Fprintf(w, "calendar\t%s\n", unit.Schedule)
+		}
+		for _, key := range unit.Secrets {
+			fmt.Fprintf(w, "secret\t%s\n", key)
+		}
+		for key, value := range unit.Env {
+			fmt.Fprintf(w, "env\t%s=%s\n", key, value)
+		}
+		for host, container := range unit.Ports {
+			fmt.Fprintf(w, "port\t%d:%d\n", host, container)
+		}
+		for host, container := range unit.Volumes {
+			fmt.Fprintf(w, "volume\t%s:%s\n", host, container)
+		}
+		for _, host := range unit.Hosts {
+			fmt.Fprintf(w, "host\t%s\n", host)
+		}
+		for key, value := range unit.Selector {
+			fmt.Fprintf(w, "selector\t%s=%s\n", key, value)
+		}
+		for name, limit := range unit.Ulimits {
+			fmt.Fprintf(w, "ulimit\t%s=%s\n", name, limit)
+		}
+		if len(unit.ShmSize) > 0 {
+			fmt.Fprintf(w, "shm-size\t%s\n", unit.ShmSize)
+		}
+		for _, device := range unit.Devices {
+			fmt.Fprintf(w, "device\t%s\n", device)
+		}
+		for host, ip := range unit.ExtraHosts {
+			fmt.Fprintf(w, "extra-host\t%s=%s\n", host, ip)
+		}
+		if len(unit.GPUs) > 0 {
+			fmt.Fprintf(w, "gpus\t%s\n", unit.GPUs)
+		}
+		if len(unit.App) > 0 {
+			fmt.Fprintf(w, "app\t%s\n", unit.App)
+		}
+	})
+}
+
+// parseUnitID reads the desired unit ID from the first positional argument.
+func parseUnitID(flags *flag.FlagSet) int {
+	if flags.NArg() < 1 {
+		usageError(flags, "%s requires the ID of a desired unit.", flags.Name())
+	}
+	id, err := strconv.ParseInt(flags.Arg(0), 10, 32)
+	if err != nil {
+		usageError(flags, "Non-numeric desired unit ID (%s).", flags.Arg(0))
+	}
+	return int(id)
+}
+
+// readUnit loads the desired unit with the given ID, exiting if it doesn't exist.
+func readUnit(ctx context.Context, session *state.SessionLease, id int) *state.DesiredSystemdUnit {
+	unit, err := session.ReadDesiredUnit(ctx, id)
+	if err != nil {
+		log.WithError(err).WithField("id", id).Fatal("Unable to load desired unit.")
+	}
+	if unit == nil {
+		log.WithField("id", id).Fatal("Desired unit not found.")
+	}
+	return unit
+}
+
+// readRemoteUnit finds the desired unit with the given ID through the API, exiting if it doesn't exist.
+func readRemoteUnit(id int) *state.DesiredSystemdUnit {
+	var desired state.DesiredState
+	if err := remote.do(http.MethodGet, "/desired", nil, &desired); err != nil {
+		log.WithError(err).WithField("id", id).Fatal("Unable to load desired unit.")
+	}
+	for i, unit := range desired.Units {
+		if unit.ID != nil && *unit.ID == id {
+			return &desired.Units[i]
+		}
+	}
+	log.WithField("id", id).Fatal("Desired unit not found.")
+	return nil
+}
+
+// specFromUnit describes the current settings of unit, so that an update changes only the fields given in its spec
+// file or flags.
+func specFromUnit(unit *state.DesiredSystemdUnit) unitSpec {
+	tp, schedule, enabled, protected, version := unit.Type, unit.Schedule, unit.Enabled, unit.Protected, unit.Version
+	spec := unitSpec{
+		Path:     unit.Path,
+		Type:     &tp,
+		Secrets:  unit.Secrets,
+		Env:      unit.Env,
+		Ports:    unit.Ports,
+		Volumes:  unit.Volumes,
+		Schedule: &schedule,
+		Hosts:    unit.Hosts,
+		Selector: unit.Selector,
+		App:      unit.App,
+
+		Ulimits:    unit.Ulimits,
+		ShmSize:    unit.ShmSize,
+		Devices:    unit.Devices,
+		ExtraHosts: unit.ExtraHosts,
+		GPUs:       unit.GPUs,
+		Enabled:    &enabled,
+		Protected:  &protected,
+		Version:    &version,
+	}
+	if unit.Container != nil {
+		spec.Container = &unitSpecContainer{
+			Name:      unit.Container.Name,
+			ImageName: unit.Container.ImageName,
+			ImageTag:  unit.Container.ImageTag,
+		}
+		spec.pin = unit.Container.PinnedImageID
+	}
+	return spec
+}
+
+func addUnit(flags *flag.FlagSet, args []string) {
+	f := newUnitFlags(flags)
+	parseFlags(flags, args)
+
+	var spec unitSpec
+	if err := f.apply(&spec); err != nil {
+		log.WithError(err).Fatal("Unable to read unit spec.")
+	}
+	if spec.Type == nil {
+		log.Fatal("The unit spec must include a type.")
+	}
+	if spec.Pinned != nil {
+		log.Fatal("New units can't be pinned. Sync the unit, then pin it with update-unit.")
+	}
+
+	if remote != nil {
+		var unit state.DesiredSystemdUnit
+		if err := remote.do(http.MethodPost, "/desired", spec, &unit); err != nil {
+			log.WithError(err).Fatal("Unable to create desired unit.")
+		}
+		log.WithField("path", unit.Path).Info("Desired unit created. Run sync to apply it.")
+		printUnit(&unit)
+		return
+	}
+
+	var r = prepare(needs{session: true})
+	defer r.session.Close()
+	ctx := context.Background()
+
+	unit, errs := buildUnit(state.BuildDesiredUnit(), spec, r.session, true)
+	if len(errs) > 0 {
+		reportInvalidUnit(errs)
+	}
+	if err := r.session.CheckConflicts(ctx, *unit); err != nil {
+		reportInvalidUnit([]error{err})
+	}
+
+	if err := unit.MakeDesired(ctx, *r.session); err != nil {
+		log.WithError(err).Fatal("Unable to store desired unit in the database.")
+	}
+	log.WithField("path", unit.Path).Info("Desired unit created. Run sync to apply it.")
+	printUnit(unit)
+}
+
+func updateUnit(flags *flag.FlagSet, args []string) {
+	f := newUnitFlags(flags)
+	parseFlags(flags, args)
+	id := parseUnitID(flags)
+	if f.given("path") {
+		log.Fatal("The path of an existing unit can't be changed. Remove it and add a new one instead.")
+	}
+
+	var (
+		r    results
+		unit *state.DesiredSystemdUnit
+		ctx  = context.Background()
+	)
+	if remote != nil {
+		unit = readRemoteUnit(id)
+	} else {
+		r = prepare(needs{session: true})
+		defer r.session.Close()
+		unit = readUnit(ctx, r.session, id)
+	}
+
+	spec := specFromUnit(unit)
+	if err := f.apply(&spec); err != nil {
+		log.WithError(err).Fatal("Unable to read unit spec.")
+	}
+	if spec.Path != unit.Path {
+		log.Fatal("The path of an existing unit can't be changed. Remove it and add a new one instead.")
+	}
+
+	if remote != nil {
+		// The API identifies the unit by ID and doesn't accept a path in updates.
+		spec.Path = ""
+
+		var updated state.DesiredSystemdUnit
+		if err := remote.do(http.MethodPut, fmt.Sprintf("/desired/%d", id), spec, &updated); err != nil {
+			log.WithError(err).Fatal("Unable to update desired unit.")
+		}
+		log.WithField("path", updated.Path).Info("Desired unit updated. Run sync to apply it.")
+		printUnit(&updated)
+		return
+	}
+
+	if spec.Pinned != nil && !*spec.Pinned {
+		spec.pin = ""
+	} else if spec.Pinned != nil && unit.Container == nil {
+		log.Fatal("Only units with a container may be pinned.")
+	} else if spec.Pinned != nil && len(spec.pin) == 0 {
+		pin, err := r.session.CurrentImageID(ctx, *unit.Container)
+		if err != nil {
+			log.WithError(err).Fatal("Unable to find the image to pin.")
+		}
+		if len(pin) == 0 {
+			log.Fatal("The unit has no image to pin yet. Sync it first.")
+		}
+		spec.pin = pin
+	}
+
+	if spec.Version != nil && *spec.Version != unit.Version {
+		log.WithError(state.ErrVersionConflict).Fatal("Unable to update desired unit.")
+	}
+
+	updated, errs := buildUnit(state.ModifyDesiredUnit(unit), spec, r.session, false)
+	if len(errs) > 0 {
+		reportInvalidUnit(errs)
+	}
+	if err := r.session.CheckConflicts(ctx, *updated); err != nil {
+		reportInvalidUnit([]error{err})
+	}
+
+	if err := updated.Update(ctx, *r.session); err != nil {
+		log.WithError(err).Fatal("Unable to store the updated unit in the database.")
+	}
+	log.WithField("path", updated.Path).Info("Desired unit updated. Run sync to apply it.")
+	printUnit(updated)
+}
+
+func removeUnit(flags *flag.FlagSet, args []string) {
+	parseFlags(flags, args)
+	id := parseUnitID(flags)
+
+	if remote != nil {
+		unit := readRemoteUnit(id)
+		if err := remote.do(http.MethodDelete, fmt.Sprintf("/desired/%d", id), nil, nil); err != nil {
+			log.WithError(err).Fatal("Unable to delete unit.")
+		}
+		log.WithField("path", unit.Path).Info("Desired unit removed. Run sync to stop and remove it.")
+		return
+	}
+
+	var r = prepare(needs{session: true})
+	defer r.session.Close()
+	ctx := context.Background()
+
+	unit := readUnit(ctx, r.session, id)
+	if err := r.session.UndesireUnit(ctx, id); err != nil {
+		log.WithError(err).Fatal("Unable to delete unit.")
+	}
+	log.WithField("path", unit.Path).Info("Desired unit removed. Run sync to stop and remove it.")
+}
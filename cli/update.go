@@ -0,0 +1,35 @@
+package cli
+
+import (
+	"context"
+	"flag"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/selfupdate"
+)
+
+func updateSelf(flags *flag.FlagSet, args []string) {
+	parseFlags(flags, args)
+
+	r := prepare(needs{options: true, session: true})
+	defer r.session.Release()
+
+	updater, err := selfupdate.NewUpdater(r.options.SelfUpdate)
+	if err != nil {
+		log.WithError(err).Fatal("Unable to configure self-update.")
+	}
+
+	ctx := context.Background()
+	updated, err := updater.Update(ctx)
+	if err != nil {
+		log.WithError(err).Fatal("Unable to update coordinator binary.")
+	}
+	if !updated {
+		log.Info("Coordinator binary is already up to date.")
+		return
+	}
+
+	if err := r.session.RestartSelf(ctx); err != nil {
+		log.WithError(err).Fatal("Unable to restart coordinator.")
+	}
+}
@@ -0,0 +1,96 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/buildinfo"
+	"github.com/smashwilson/az-coordinator/config"
+	"github.com/smashwilson/az-coordinator/state"
+)
+
+// versionReport is the output of the version command. Runtime is omitted if the options file can't be loaded.
+type versionReport struct {
+	buildinfo.Info
+	Runtime *state.RuntimeVersions `json:"runtime,omitempty"`
+	Errors  []string               `json:"errors"`
+}
+
+// version reports the build of this binary, then the Docker and systemd versions it's working with if the options file
+// can be loaded.
+func version(flags *flag.FlagSet, args []string) {
+	parseFlags(flags, args)
+
+	var report versionReport
+	if remote != nil {
+		report = remoteVersion()
+	} else {
+		runtime, errs := readRuntimeVersions()
+		report = versionReport{Info: buildinfo.Current(), Runtime: runtime, Errors: make([]string, 0, len(errs))}
+		for _, err := range errs {
+			report.Errors = append(report.Errors, err.Error())
+		}
+	}
+
+	emit(report, func(w io.Writer) {
+		fmt.Fprintf(w, "version\t%s\n", report.Version)
+		fmt.Fprintf(w, "commit\t%s\n", report.Commit)
+		fmt.Fprintf(w, "build date\t%s\n", report.Date)
+		fmt.Fprintf(w, "go\t%s\n", report.GoVersion)
+		if report.Runtime != nil {
+			how := "negotiated"
+			if report.Runtime.DockerAPIVersionPinned {
+				how = "pinned"
+			}
+			fmt.Fprintf(w, "docker client api\t%s (%s)\n", report.Runtime.DockerClientAPIVersion, how)
+			fmt.Fprintf(w, "docker server\t%s\n", orUnavailable(report.Runtime.DockerServerVersion))
+			fmt.Fprintf(w, "docker server api\t%s\n", orUnavailable(report.Runtime.DockerServerAPIVersion))
+			fmt.Fprintf(w, "systemd\t%s\n", orUnavailable(report.Runtime.SystemdVersion))
+		}
+		for _, err := range report.Errors {
+			fmt.Fprintf(w, "error\t%s\n", err)
+		}
+	})
+}
+
+// remoteVersion asks the coordinator at -server for its version.
+func remoteVersion() versionReport {
+	var report versionReport
+	if err := remote.do(http.MethodGet, "/version", nil, &report); err != nil {
+		log.WithError(err).Fatal("Unable to read version.")
+	}
+	report.Errors = make([]string, 0)
+	return report
+}
+
+// readRuntimeVersions connects to Docker and systemd with the configured options to ask for their versions.
+func readRuntimeVersions() (*state.RuntimeVersions, []error) {
+	opts, err := config.Load()
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	session, err := state.NewSession(nil, nil, opts.DockerAPIVersion)
+	if err != nil {
+		return nil, []error{err}
+	}
+	defer session.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	versions, errs := session.Lease().ReadRuntimeVersions(ctx, len(opts.DockerAPIVersion) > 0)
+	return &versions, errs
+}
+
+func orUnavailable(s string) string {
+	if len(s) == 0 {
+		return "unavailable"
+	}
+	return s
+}
@@ -1,14 +1,21 @@
 package config
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/kdar/logrus-cloudwatchlogs"
 	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/logship"
+	"github.com/smashwilson/az-coordinator/secrets"
 )
 
 // DefaultOptionsPath is the path that will be used to locate the options file if `AZ_OPTIONS` is not specified.
@@ -16,6 +23,13 @@ const DefaultOptionsPath = "/etc/az-coordinator/options.json"
 
 var startTime int64
 
+// shippingHooks are created once and shared by every logger passed to ShipLogs, so that each destination has only
+// one connection or background sender.
+var (
+	shippingLock  sync.Mutex
+	shippingHooks []log.Hook
+)
+
 // Options contains coordinator-specific configuration options loaded as startup from a JSON file.
 type Options struct {
 	ListenAddress    string `json:"listen_address"`
@@ -23,15 +37,757 @@ type Options struct {
 	AuthToken        string `json:"auth_token"`
 	MasterKeyID      string `json:"master_key_id"`
 	AWSRegion        string `json:"aws_region"`
+	AWSProfile       string `json:"aws_profile"`
+	AWSRoleARN       string `json:"aws_role_arn"`
+	AWSExternalID    string `json:"aws_external_id"`
+	KMSEndpoint      string `json:"kms_endpoint"`
 	CloudwatchGroup  string `json:"cloudwatch_group"`
 	DockerAPIVersion string `json:"docker_api_version"`
 	AllowedOrigin    string `json:"allowed_origin"`
+	PublicURL        string `json:"public_url"`
 	SlackWebhookURL  string `json:"slack_webhook_url"`
+	LeaderElection   bool   `json:"leader_election"`
+	LogFormat        string `json:"log_format"`
+	LogLevel         string `json:"log_level"`
+	OTLPEndpoint     string `json:"otlp_endpoint"`
+
+	// DiscordWebhookURL and Matrix send sync reports to a Discord channel and a Matrix room, with or instead of
+	// SlackWebhookURL. Reports go to every one that's configured.
+	DiscordWebhookURL string        `json:"discord_webhook_url"`
+	Matrix            MatrixOptions `json:"matrix"`
+
+	// EventWebhooks receive a signed JSON event whenever a sync starts or finishes, a unit or secret changes, or a
+	// health threshold is crossed.
+	EventWebhooks []EventWebhookOptions `json:"event_webhooks"`
+
+	// SlackSigningSecret verifies the slash commands and button clicks that Slack sends to /hooks/slack, which is
+	// disabled without it. Only the Slack user IDs listed in SlackAllowedUsers may run them.
+	SlackSigningSecret string   `json:"slack_signing_secret"`
+	SlackAllowedUsers  []string `json:"slack_allowed_users"`
+
+	// ListenSocket is the path of a Unix domain socket to serve plain HTTP on, for a reverse proxy on the same host.
+	// PlainHTTPAddress is a loopback address to serve plain HTTP on. Either may be used with or instead of
+	// ListenAddress, which always serves HTTPS.
+	ListenSocket     string `json:"listen_socket"`
+	PlainHTTPAddress string `json:"plain_http_address"`
+
+	// TLSCertPath and TLSKeyPath locate the certificate chain and private key served on ListenAddress. They default
+	// to the files written from the TLS_CERTIFICATE and TLS_KEY secrets.
+	TLSCertPath string `json:"tls_cert_path"`
+	TLSKeyPath  string `json:"tls_key_path"`
+
+	// ClientCAPath names a PEM bundle of certificate authorities. If set, API clients that present a certificate
+	// signed by one of them are authenticated without the auth token. ClientCertNames, if not empty, limits this to
+	// certificates with one of the listed common names.
+	ClientCAPath    string   `json:"client_ca_path"`
+	ClientCertNames []string `json:"client_cert_names"`
+
+	SyncIntervalMinutes int `json:"sync_interval_minutes"`
+
+	// RestoreDeadContainers starts a sync of a unit as soon as its container dies unexpectedly, to restart it.
+	RestoreDeadContainers bool `json:"restore_dead_containers"`
+
+	// SyncReportCapacity is the number of log entries that GET /sync holds for each sync. Older entries are
+	// discarded once it's reached.
+	SyncReportCapacity int `json:"sync_report_capacity"`
+
+	// ActualCacheSeconds is the time for which the server reuses the actual state it read for GET /actual and GET
+	// /diff. A negative value disables the cache.
+	ActualCacheSeconds int `json:"actual_cache_seconds"`
+
+	// AllowedImages lists the repositories that desired units may run container images from, as name prefixes or glob
+	// patterns. It defaults to the az- images of quay.io/smashwilson and Docker Hub.
+	AllowedImages []string `json:"allowed_images"`
+
+	// UnitPrefix begins the name of every unit that the coordinator manages, and UnitDirectory holds their unit files.
+	// They default to "az-" and "/etc/systemd/system/".
+	UnitPrefix    string `json:"unit_prefix"`
+	UnitDirectory string `json:"unit_directory"`
+
+	PruneThresholdPercent int    `json:"prune_threshold_percent"`
+	PruneMode             string `json:"prune_mode"`
+	PruneMinImageAgeHours int    `json:"prune_min_image_age_hours"`
+
+	Timeouts     TimeoutOptions      `json:"timeouts"`
+	Pulls        PullOptions         `json:"pulls"`
+	DatabasePool DatabasePoolOptions `json:"database_pool"`
+	SelfUpdate   SelfUpdateOptions   `json:"self_update"`
+	LogShipping  LogShippingOptions  `json:"log_shipping"`
+	SecretPolicy SecretPolicyOptions `json:"secret_policy"`
+	OIDC         OIDCOptions         `json:"oidc"`
+	Fleet        FleetOptions        `json:"fleet"`
+	Drain        DrainOptions        `json:"drain"`
+	Approval     ApprovalOptions     `json:"approval"`
+	Alerts       AlertOptions        `json:"alerts"`
+	Guards       GuardOptions        `json:"guards"`
+	Backups      BackupOptions       `json:"backups"`
+	GitHub       GitHubOptions       `json:"github"`
+
+	// DeployMarkers marks the syncs that change units on Grafana and Datadog dashboards.
+	DeployMarkers DeployMarkerOptions `json:"deploy_markers"`
 
 	ProcessStartTime int64  `json:"-"`
 	OptionsPath      string `json:"-"`
 }
 
+// TimeoutOptions bounds the duration of each phase of a sync and of each API request, in seconds. Zero or absent
+// sync phase values mean no limit.
+type TimeoutOptions struct {
+	ReadSeconds    int `json:"read_seconds"`
+	PullSeconds    int `json:"pull_seconds"`
+	ApplySeconds   int `json:"apply_seconds"`
+	RequestSeconds int `json:"request_seconds"`
+
+	// HealthSeconds is the time to wait after a sync restarts units before checking that they're still running. It
+	// defaults to 10 seconds. A negative value skips the check.
+	HealthSeconds int `json:"health_seconds"`
+}
+
+// defaultRequestTimeout is used when no request limit is configured.
+const defaultRequestTimeout = 60 * time.Second
+
+// Read is the limit on each phase that reads desired state, actual state, or Docker images.
+func (t TimeoutOptions) Read() time.Duration {
+	return time.Duration(t.ReadSeconds) * time.Second
+}
+
+// Pull is the limit on the phase that pulls container images.
+func (t TimeoutOptions) Pull() time.Duration {
+	return time.Duration(t.PullSeconds) * time.Second
+}
+
+// Apply is the limit on the phase that applies changes to the host.
+func (t TimeoutOptions) Apply() time.Duration {
+	return time.Duration(t.ApplySeconds) * time.Second
+}
+
+// Request is the limit on handling each API request, including the time spent waiting for a session. It defaults to
+// one minute.
+func (t TimeoutOptions) Request() time.Duration {
+	if t.RequestSeconds <= 0 {
+		return defaultRequestTimeout
+	}
+	return time.Duration(t.RequestSeconds) * time.Second
+}
+
+// defaultHealthDelay is used when no health check delay is configured.
+const defaultHealthDelay = 10 * time.Second
+
+// Health is the time to wait after a sync restarts units before checking them, or zero if the check is skipped.
+func (t TimeoutOptions) Health() time.Duration {
+	if t.HealthSeconds < 0 {
+		return 0
+	}
+	if t.HealthSeconds == 0 {
+		return defaultHealthDelay
+	}
+	return time.Duration(t.HealthSeconds) * time.Second
+}
+
+// PullOptions controls how a sync pulls container images.
+type PullOptions struct {
+	// Concurrency is the number of images pulled at once. It defaults to 4.
+	Concurrency int `json:"concurrency"`
+
+	// TimeoutSeconds limits each attempt to pull an image. Zero or absent means no limit other than pull_seconds in
+	// timeouts.
+	TimeoutSeconds int `json:"timeout_seconds"`
+
+	// Attempts is the number of times each pull is tried before it's reported as failed. It defaults to 3.
+	Attempts int `json:"attempts"`
+}
+
+const (
+	// defaultPullConcurrency is used when no pull concurrency is configured.
+	defaultPullConcurrency = 4
+
+	// defaultPullAttempts is used when no pull attempts are configured.
+	defaultPullAttempts = 3
+)
+
+// Limit is the number of images pulled at once.
+func (p PullOptions) Limit() int {
+	if p.Concurrency <= 0 {
+		return defaultPullConcurrency
+	}
+	return p.Concurrency
+}
+
+// Timeout is the limit on each attempt to pull an image, or zero for no limit.
+func (p PullOptions) Timeout() time.Duration {
+	return time.Duration(p.TimeoutSeconds) * time.Second
+}
+
+// Tries is the number of times each pull is tried.
+func (p PullOptions) Tries() int {
+	if p.Attempts <= 0 {
+		return defaultPullAttempts
+	}
+	return p.Attempts
+}
+
+// DatabasePoolOptions tunes the pool of database connections. Zero or absent values keep the database/sql defaults.
+type DatabasePoolOptions struct {
+	MaxOpen            int `json:"max_open"`
+	MaxIdle            int `json:"max_idle"`
+	MaxLifetimeSeconds int `json:"max_lifetime_seconds"`
+}
+
+// Apply configures db's connection pool to match these options.
+func (p DatabasePoolOptions) Apply(db *sql.DB) {
+	if p.MaxOpen > 0 {
+		db.SetMaxOpenConns(p.MaxOpen)
+	}
+	if p.MaxIdle > 0 {
+		db.SetMaxIdleConns(p.MaxIdle)
+	}
+	if p.MaxLifetimeSeconds > 0 {
+		db.SetConnMaxLifetime(time.Duration(p.MaxLifetimeSeconds) * time.Second)
+	}
+}
+
+// SelfUpdateOptions locates new releases of the coordinator binary. The URLs may point to any HTTP(S) location, like
+// a public S3 object or a GitHub release asset.
+type SelfUpdateOptions struct {
+	// URL is the location of the most recent coordinator binary.
+	URL string `json:"url"`
+
+	// ChecksumURL is the location of a file containing the binary's hex-encoded SHA-256 digest, in the format written
+	// by sha256sum. Defaults to URL with ".sha256" appended.
+	ChecksumURL string `json:"checksum_url"`
+
+	// SignatureURL is the location of an Ed25519 signature of the binary, either raw or base64-encoded. Defaults to URL
+	// with ".sig" appended.
+	SignatureURL string `json:"signature_url"`
+
+	// PublicKey is the base64-encoded Ed25519 key that release binaries are signed with. It's required whenever URL is
+	// set.
+	PublicKey string `json:"public_key"`
+
+	// IntervalMinutes is the time between automatic update checks made by the server. Zero disables them.
+	IntervalMinutes int `json:"interval_minutes"`
+}
+
+// Enabled returns true if a release location has been configured.
+func (u SelfUpdateOptions) Enabled() bool {
+	return len(u.URL) > 0
+}
+
+// Interval is the time between automatic update checks, or zero if they are disabled.
+func (u SelfUpdateOptions) Interval() time.Duration {
+	return time.Duration(u.IntervalMinutes) * time.Minute
+}
+
+// Validate reports an enabled self-update that can't verify the binaries it installs.
+func (u SelfUpdateOptions) Validate() error {
+	if u.Enabled() && len(u.PublicKey) == 0 {
+		return errors.New("self-update requires a public_key")
+	}
+	return nil
+}
+
+// OIDCOptions accepts bearer tokens issued by an OpenID Connect provider as API credentials.
+type OIDCOptions struct {
+	// Issuer is the provider's issuer URL, which must match the "iss" claim of each token.
+	Issuer string `json:"issuer"`
+
+	// Audience must be one of the "aud" claims of each token, usually the client ID of the management UI.
+	Audience string `json:"audience"`
+
+	// JWKSURL is the location of the provider's signing keys. Defaults to the jwks_uri advertised in the issuer's
+	// discovery document.
+	JWKSURL string `json:"jwks_url"`
+
+	// UsernameClaim names the claim used to identify the caller. Defaults to "preferred_username", then "email", then
+	// "sub".
+	UsernameClaim string `json:"username_claim"`
+}
+
+// Enabled returns true if an issuer and audience have been configured.
+func (o OIDCOptions) Enabled() bool {
+	return len(o.Issuer) > 0 && len(o.Audience) > 0
+}
+
+// DrainOptions controls how POST /drain stops the units on this host.
+type DrainOptions struct {
+	// Order names units, like "az-web.service", that are stopped one at a time and in this order before every other
+	// unit is stopped. Units are started again in the reverse order.
+	Order []string `json:"order"`
+
+	// StopSeconds limits the time spent waiting for each stage of a drain or undrain. Defaults to 90 seconds.
+	StopSeconds int `json:"stop_seconds"`
+}
+
+// defaultDrainStopTimeout is used when no drain stop limit is configured.
+const defaultDrainStopTimeout = 90 * time.Second
+
+// StopTimeout is the limit on each stage of a drain or undrain.
+func (d DrainOptions) StopTimeout() time.Duration {
+	if d.StopSeconds <= 0 {
+		return defaultDrainStopTimeout
+	}
+	return time.Duration(d.StopSeconds) * time.Second
+}
+
+// ApprovalOptions parks syncs with a large impact until they're approved with POST /sync/ID/approve.
+type ApprovalOptions struct {
+	// Enabled turns the approval gate on for syncs performed by the server.
+	Enabled bool `json:"enabled"`
+
+	// MaxUnitRestarts is the number of units that a sync may add, change, or restart without approval.
+	MaxUnitRestarts int `json:"max_unit_restarts"`
+
+	// Removals requires approval for any sync that removes a unit.
+	Removals bool `json:"removals"`
+}
+
+// GuardOptions limits the destructive operations that may be performed without being forced, with --force on the
+// command line or ?force=true in the API. Zero uses the default limit, and a negative limit disables the guard.
+type GuardOptions struct {
+	// MaxUnitRemovals is the number of units that a sync may remove without being forced.
+	MaxUnitRemovals int `json:"max_unit_removals"`
+
+	// MaxSecretDeletions is the number of secrets that may be deleted at once without being forced.
+	MaxSecretDeletions int `json:"max_secret_deletions"`
+}
+
+// DefaultMaxUnitRemovals is the number of units that a sync may remove without being forced if
+// guards.max_unit_removals is not set.
+const DefaultMaxUnitRemovals = 5
+
+// DefaultMaxSecretDeletions is the number of secrets that may be deleted at once without being forced if
+// guards.max_secret_deletions is not set.
+const DefaultMaxSecretDeletions = 5
+
+// UnitRemovalLimit is the number of units that a sync may remove without being forced, or 0 if there's no limit.
+func (g GuardOptions) UnitRemovalLimit() int {
+	return guardLimit(g.MaxUnitRemovals, DefaultMaxUnitRemovals)
+}
+
+// SecretDeletionLimit is the number of secrets that may be deleted at once without being forced, or 0 if there's no
+// limit.
+func (g GuardOptions) SecretDeletionLimit() int {
+	return guardLimit(g.MaxSecretDeletions, DefaultMaxSecretDeletions)
+}
+
+func guardLimit(configured, fallback int) int {
+	if configured == 0 {
+		return fallback
+	}
+	if configured < 0 {
+		return 0
+	}
+	return configured
+}
+
+// AlertOptions configures the alert rules that the server evaluates on a timer. A rule is reported to Slack, Discord,
+// and Matrix when it's breached, and again when it recovers. Rules with a zero threshold are disabled.
+type AlertOptions struct {
+	// IntervalSeconds is the time between evaluations. It defaults to one minute.
+	IntervalSeconds int `json:"interval_seconds"`
+
+	// DiskUsagePercent is breached by each watched partition whose usage reaches it.
+	DiskUsagePercent int `json:"disk_usage_percent"`
+
+	// UnitRestartsPerHour is breached by each managed unit that systemd has restarted this many times in the last
+	// hour.
+	UnitRestartsPerHour int `json:"unit_restarts_per_hour"`
+
+	// FailedSyncs is breached once this many syncs in a row have failed.
+	FailedSyncs int `json:"failed_syncs"`
+}
+
+// defaultAlertInterval is used when no alert interval is configured.
+const defaultAlertInterval = time.Minute
+
+// Interval is the time between evaluations of the alert rules.
+func (a AlertOptions) Interval() time.Duration {
+	if a.IntervalSeconds <= 0 {
+		return defaultAlertInterval
+	}
+	return time.Duration(a.IntervalSeconds) * time.Second
+}
+
+// BackupOptions schedules automatic backups of the database to an S3 bucket. Backups are disabled unless a bucket is
+// set.
+type BackupOptions struct {
+	Bucket string `json:"bucket"`
+
+	// Prefix begins the key of each backup. It defaults to "az-coordinator/".
+	Prefix string `json:"prefix"`
+
+	// IntervalHours is the time between backups. It defaults to 24.
+	IntervalHours int `json:"interval_hours"`
+
+	// Retain is the number of backups to keep. Older backups are deleted after each new one is uploaded. It defaults
+	// to 14.
+	Retain int `json:"retain"`
+
+	// KMSKeyID encrypts backups with a KMS key instead of with S3's own keys.
+	KMSKeyID string `json:"kms_key_id"`
+}
+
+// Defaults for the backups options that aren't set.
+const (
+	defaultBackupPrefix   = "az-coordinator/"
+	defaultBackupInterval = 24 * time.Hour
+	defaultBackupRetain   = 14
+)
+
+// Enabled returns true if a bucket has been configured to receive backups.
+func (b BackupOptions) Enabled() bool {
+	return len(b.Bucket) > 0
+}
+
+// KeyPrefix is the prefix of the key of each backup.
+func (b BackupOptions) KeyPrefix() string {
+	if len(b.Prefix) == 0 {
+		return defaultBackupPrefix
+	}
+	return b.Prefix
+}
+
+// Interval is the time between backups.
+func (b BackupOptions) Interval() time.Duration {
+	if b.IntervalHours <= 0 {
+		return defaultBackupInterval
+	}
+	return time.Duration(b.IntervalHours) * time.Hour
+}
+
+// RetainCount is the number of backups to keep.
+func (b BackupOptions) RetainCount() int {
+	if b.Retain <= 0 {
+		return defaultBackupRetain
+	}
+	return b.Retain
+}
+
+// MatrixOptions sends sync reports to a Matrix room as the user whose access token is given. The user must already
+// have joined the room.
+type MatrixOptions struct {
+	HomeserverURL string `json:"homeserver_url"`
+	RoomID        string `json:"room_id"`
+	AccessToken   string `json:"access_token"`
+}
+
+// Enabled returns true if reports should be sent to a Matrix room.
+func (m MatrixOptions) Enabled() bool {
+	return len(m.HomeserverURL) > 0 && len(m.RoomID) > 0 && len(m.AccessToken) > 0
+}
+
+// GitHubOptions records a GitHub Deployment for each container that a sync updates, if its image's labels name the
+// repository and commit that it was built from, and optionally gates its rollout on the commit's checks. GitHub is
+// accessed with Token, or as a GitHub App installation if AppID is set.
+type GitHubOptions struct {
+	Token string `json:"token"`
+
+	AppID          int64  `json:"app_id"`
+	InstallationID int64  `json:"installation_id"`
+	PrivateKeyPath string `json:"private_key_path"`
+
+	// Environment names the environment that containers are deployed to. It defaults to "production".
+	Environment string `json:"environment"`
+
+	// APIURL is the base URL of the GitHub API, for GitHub Enterprise. It defaults to "https://api.github.com".
+	APIURL string `json:"api_url"`
+
+	// RequirePassingChecks keeps syncs from rolling out a new image until every status and check run of the commit
+	// that it was built from has passed.
+	RequirePassingChecks bool `json:"require_passing_checks"`
+}
+
+// Enabled returns true if a token or a GitHub App has been configured.
+func (g GitHubOptions) Enabled() bool {
+	return len(g.Token) > 0 || g.AppID != 0
+}
+
+// EnvironmentName is the environment that containers are deployed to.
+func (g GitHubOptions) EnvironmentName() string {
+	if len(g.Environment) == 0 {
+		return "production"
+	}
+	return g.Environment
+}
+
+// BaseURL is the base URL of the GitHub API, without a trailing slash.
+func (g GitHubOptions) BaseURL() string {
+	if len(g.APIURL) == 0 {
+		return "https://api.github.com"
+	}
+	return strings.TrimSuffix(g.APIURL, "/")
+}
+
+// DeployMarkerOptions marks each sync that changes units on dashboards, as a Grafana annotation, a Datadog event, or
+// both, so that changes in metrics can be matched with deploys.
+type DeployMarkerOptions struct {
+	Grafana GrafanaOptions `json:"grafana"`
+	Datadog DatadogOptions `json:"datadog"`
+
+	// Tags are added to every marker, along with "deploy" and the host's name.
+	Tags []string `json:"tags"`
+}
+
+// GrafanaOptions posts annotations to a Grafana server with an API key or service account token.
+type GrafanaOptions struct {
+	URL    string `json:"url"`
+	APIKey string `json:"api_key"`
+
+	// DashboardUID limits annotations to one dashboard. Without it, they're shown on every dashboard that queries
+	// annotations by tag.
+	DashboardUID string `json:"dashboard_uid"`
+}
+
+// Enabled returns true if annotations should be posted to Grafana.
+func (g GrafanaOptions) Enabled() bool {
+	return len(g.URL) > 0 && len(g.APIKey) > 0
+}
+
+// DatadogOptions posts events to Datadog with an API key.
+type DatadogOptions struct {
+	APIKey string `json:"api_key"`
+
+	// Site is the Datadog site that the account belongs to, like "datadoghq.eu". It defaults to "datadoghq.com".
+	Site string `json:"site"`
+}
+
+// Enabled returns true if events should be posted to Datadog.
+func (d DatadogOptions) Enabled() bool {
+	return len(d.APIKey) > 0
+}
+
+// BaseURL is the base URL of the Datadog API for the configured site.
+func (d DatadogOptions) BaseURL() string {
+	if len(d.Site) == 0 {
+		return "https://api.datadoghq.com"
+	}
+	return "https://api." + d.Site
+}
+
+// EventWebhookOptions configures a URL that receives events. If Secret is set, each delivery carries an
+// X-Az-Signature header computed with it. If Events isn't empty, only the listed event types are delivered.
+type EventWebhookOptions struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+}
+
+// FleetOptions lets one coordinator manage units on several hosts. The controller keeps the desired state and
+// secrets for every host in its database and serves them to agents, which apply them to their own host without any
+// database or KMS access of their own.
+type FleetOptions struct {
+	// Role is "controller" for the coordinator that agents poll, "agent" for a coordinator that polls a controller,
+	// or empty for a stand-alone coordinator.
+	Role string `json:"role"`
+
+	// HostName identifies this host to the controller and chooses which host-scoped units it runs. Defaults to the
+	// system hostname.
+	HostName string `json:"host_name"`
+
+	// Labels describe this host, like {"role": "web"}. Units with a selector only run on hosts whose labels match it.
+	// An agent's labels are registered with the controller instead.
+	Labels map[string]string `json:"labels"`
+
+	// AgentToken is the secret that an agent presents to the controller. It must match the token registered for the
+	// agent's host in the controller's Agents.
+	AgentToken string `json:"agent_token"`
+
+	// Agents registers each agent that may poll the controller, keyed by its host name. A controller without any
+	// rejects all agents.
+	Agents map[string]AgentRegistration `json:"agents"`
+
+	// ControllerURL is the base URL of the controller's API, used by agents.
+	ControllerURL string `json:"controller_url"`
+
+	// ControllerCAPath names a PEM bundle of certificate authorities that agents trust when connecting to the
+	// controller. Defaults to the system roots.
+	ControllerCAPath string `json:"controller_ca_path"`
+
+	// PollSeconds is the time between an agent's requests to the controller. Defaults to 30 seconds.
+	PollSeconds int `json:"poll_seconds"`
+}
+
+// AgentRegistration is the controller's record of one agent.
+type AgentRegistration struct {
+	// Token is the secret that the agent authenticates with. Give each agent its own, so that one host's token can't
+	// be used to fetch the secrets of another.
+	Token string `json:"token"`
+
+	// Labels describe the agent's host, and choose the units with a selector that it runs.
+	Labels map[string]string `json:"labels"`
+}
+
+const (
+	// FleetController is the Role of a coordinator that serves desired state to agents.
+	FleetController = "controller"
+
+	// FleetAgent is the Role of a coordinator that polls a controller for its desired state.
+	FleetAgent = "agent"
+)
+
+// defaultPollInterval is used when no agent poll interval is configured.
+const defaultPollInterval = 30 * time.Second
+
+// Controller returns true if this coordinator serves desired state to agents.
+func (f FleetOptions) Controller() bool {
+	return f.Role == FleetController
+}
+
+// Agent returns true if this coordinator polls a controller for its desired state.
+func (f FleetOptions) Agent() bool {
+	return f.Role == FleetAgent
+}
+
+// Host is the name of this host within the fleet.
+func (f FleetOptions) Host() string {
+	if len(f.HostName) > 0 {
+		return f.HostName
+	}
+	if name, err := os.Hostname(); err == nil {
+		return name
+	}
+	return "localhost"
+}
+
+// PollInterval is the time between an agent's requests to the controller.
+func (f FleetOptions) PollInterval() time.Duration {
+	if f.PollSeconds <= 0 {
+		return defaultPollInterval
+	}
+	return time.Duration(f.PollSeconds) * time.Second
+}
+
+// Validate reports an unrecognized role or an agent that's missing the settings it needs to reach its controller.
+func (f FleetOptions) Validate() error {
+	switch f.Role {
+	case "":
+		return nil
+	case FleetController:
+		for host, agent := range f.Agents {
+			if len(agent.Token) == 0 {
+				return fmt.Errorf("fleet agent %s requires a token", host)
+			}
+		}
+		return nil
+	case FleetAgent:
+		if len(f.ControllerURL) == 0 {
+			return errors.New("fleet agents require a controller_url")
+		}
+		if len(f.AgentToken) == 0 {
+			return errors.New("fleet agents require an agent_token")
+		}
+		return nil
+	default:
+		return fmt.Errorf("Unrecognized fleet role: %s", f.Role)
+	}
+}
+
+// AWS collects the options that choose how secrets are decrypted with KMS.
+func (o Options) AWS() secrets.AWSOptions {
+	return secrets.AWSOptions{
+		Region:      o.AWSRegion,
+		Profile:     o.AWSProfile,
+		RoleARN:     o.AWSRoleARN,
+		ExternalID:  o.AWSExternalID,
+		KMSEndpoint: o.KMSEndpoint,
+	}
+}
+
+// SecretPolicyOptions constrains the names and values of secrets. Absent fields impose no constraint.
+type SecretPolicyOptions struct {
+	KeyPattern       string   `json:"key_pattern"`
+	RequiredPrefixes []string `json:"required_prefixes"`
+	MaxValueBytes    int      `json:"max_value_bytes"`
+}
+
+// Policy compiles these options into a secrets.Policy.
+func (p SecretPolicyOptions) Policy() (secrets.Policy, error) {
+	policy := secrets.Policy{
+		RequiredPrefixes: p.RequiredPrefixes,
+		MaxValueBytes:    p.MaxValueBytes,
+	}
+	if len(p.KeyPattern) > 0 {
+		rx, err := regexp.Compile(p.KeyPattern)
+		if err != nil {
+			return policy, fmt.Errorf("Invalid secret key_pattern: %v", err)
+		}
+		policy.KeyPattern = rx
+	}
+	return policy, nil
+}
+
+// LogShippingOptions configures log destinations other than CloudWatch.
+type LogShippingOptions struct {
+	// Journald sends log entries to the local systemd journal.
+	Journald bool `json:"journald"`
+
+	Syslog *SyslogOptions `json:"syslog"`
+	Loki   *LokiOptions   `json:"loki"`
+}
+
+// SyslogOptions locates a syslog daemon. Empty network and address fields select the local daemon.
+type SyslogOptions struct {
+	Network string `json:"network"`
+	Address string `json:"address"`
+	Tag     string `json:"tag"`
+}
+
+// LokiOptions locates a Grafana Loki server.
+type LokiOptions struct {
+	URL                  string            `json:"url"`
+	Labels               map[string]string `json:"labels"`
+	FlushIntervalSeconds int               `json:"flush_interval_seconds"`
+}
+
+// DefaultPruneThresholdPercent is the disk usage at which syncs prune unused Docker data if
+// prune_threshold_percent is not set.
+const DefaultPruneThresholdPercent = 70
+
+// TLSCertificate is the path to the certificate chain served on ListenAddress.
+func (o Options) TLSCertificate() string {
+	if len(o.TLSCertPath) > 0 {
+		return o.TLSCertPath
+	}
+	return secrets.FilenameTLSCertificate
+}
+
+// TLSKey is the path to the private key served on ListenAddress.
+func (o Options) TLSKey() string {
+	if len(o.TLSKeyPath) > 0 {
+		return o.TLSKeyPath
+	}
+	return secrets.FilenameTLSKey
+}
+
+// PruneThreshold is the disk usage percentage at which syncs prune unused Docker data. A negative
+// prune_threshold_percent disables automatic pruning, which is reported as zero.
+func (o Options) PruneThreshold() int {
+	if o.PruneThresholdPercent == 0 {
+		return DefaultPruneThresholdPercent
+	}
+	if o.PruneThresholdPercent < 0 {
+		return 0
+	}
+	return o.PruneThresholdPercent
+}
+
+// PruneMinImageAge is the age below which images are protected from pruning.
+func (o Options) PruneMinImageAge() time.Duration {
+	return time.Duration(o.PruneMinImageAgeHours) * time.Hour
+}
+
+// NewLogFormatter creates the logrus Formatter named by format: "text" (the default when format is empty) or "json".
+func NewLogFormatter(format string) (log.Formatter, error) {
+	switch format {
+	case "", "text":
+		return &log.TextFormatter{}, nil
+	case "json":
+		return &log.JSONFormatter{}, nil
+	default:
+		return nil, fmt.Errorf("Unrecognized log format: %s", format)
+	}
+}
+
 func getEnvironmentSetting(varName string, defaultValue string) string {
 	if value, ok := os.LookupEnv(varName); ok {
 		return value
@@ -89,6 +845,55 @@ func (o Options) CloudwatchLogger(logger *log.Logger) bool {
 		return false
 	}
 	logger.AddHook(hook)
-	log.SetFormatter(&logrus_cloudwatchlogs.DevFormatter{})
+	if _, isJSON := logger.Formatter.(*log.JSONFormatter); !isJSON {
+		log.SetFormatter(&logrus_cloudwatchlogs.DevFormatter{})
+	}
 	return true
 }
+
+// ShipLogs configures a logrus logger to emit records to CloudWatch and to each destination in log_shipping.
+// Destinations that can't be reached are logged and skipped.
+func (o Options) ShipLogs(logger *log.Logger) {
+	o.CloudwatchLogger(logger)
+
+	shippingLock.Lock()
+	defer shippingLock.Unlock()
+
+	if shippingHooks == nil {
+		shippingHooks = o.LogShipping.hooks(logger)
+	}
+	for _, hook := range shippingHooks {
+		logger.AddHook(hook)
+	}
+}
+
+func (s LogShippingOptions) hooks(logger *log.Logger) []log.Hook {
+	hooks := make([]log.Hook, 0, 3)
+
+	if s.Journald {
+		if hook, err := logship.NewJournaldHook(); err != nil {
+			logger.WithError(err).Error("Unable to create journald hook.")
+		} else {
+			hooks = append(hooks, hook)
+		}
+	}
+
+	if s.Syslog != nil {
+		if hook, err := logship.NewSyslogHook(s.Syslog.Network, s.Syslog.Address, s.Syslog.Tag); err != nil {
+			logger.WithError(err).Error("Unable to create syslog hook.")
+		} else {
+			hooks = append(hooks, hook)
+		}
+	}
+
+	if s.Loki != nil && len(s.Loki.URL) > 0 {
+		interval := time.Duration(s.Loki.FlushIntervalSeconds) * time.Second
+		if interval <= 0 {
+			interval = time.Second
+		}
+		logger.WithField("url", s.Loki.URL).Info("Initializing Loki logger.")
+		hooks = append(hooks, logship.NewLokiHook(s.Loki.URL, s.Loki.Labels, interval))
+	}
+
+	return hooks
+}
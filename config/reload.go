@@ -0,0 +1,111 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// liveFields are the options, by JSON name, that a running server picks up when its options are reloaded. Changes to
+// any other option only take effect after a restart.
+var liveFields = map[string]bool{
+	"slack_webhook_url":         true,
+	"discord_webhook_url":       true,
+	"matrix":                    true,
+	"event_webhooks":            true,
+	"slack_signing_secret":      true,
+	"slack_allowed_users":       true,
+	"allowed_origin":            true,
+	"public_url":                true,
+	"sync_interval_minutes":     true,
+	"restore_dead_containers":   true,
+	"sync_report_capacity":      true,
+	"actual_cache_seconds":      true,
+	"log_level":                 true,
+	"timeouts":                  true,
+	"pulls":                     true,
+	"prune_threshold_percent":   true,
+	"prune_mode":                true,
+	"prune_min_image_age_hours": true,
+	"approval":                  true,
+	"alerts":                    true,
+	"guards":                    true,
+	"backups":                   true,
+	"github":                    true,
+	"deploy_markers":            true,
+}
+
+// SyncInterval is the time between syncs started on a schedule by the server, or zero if they are disabled.
+func (o Options) SyncInterval() time.Duration {
+	return time.Duration(o.SyncIntervalMinutes) * time.Minute
+}
+
+// DefaultSyncReportCapacity is used when no sync_report_capacity is configured.
+const DefaultSyncReportCapacity = 1000
+
+// ReportCapacity is the number of log entries held for each sync.
+func (o Options) ReportCapacity() int {
+	if o.SyncReportCapacity <= 0 {
+		return DefaultSyncReportCapacity
+	}
+	return o.SyncReportCapacity
+}
+
+// defaultActualCacheTTL is used when no actual_cache_seconds is configured.
+const defaultActualCacheTTL = 5 * time.Second
+
+// ActualCacheTTL is the time for which the server reuses the actual state that it read, or zero if it's read anew for
+// every request.
+func (o Options) ActualCacheTTL() time.Duration {
+	if o.ActualCacheSeconds < 0 {
+		return 0
+	}
+	if o.ActualCacheSeconds == 0 {
+		return defaultActualCacheTTL
+	}
+	return time.Duration(o.ActualCacheSeconds) * time.Second
+}
+
+// ApplyLogLevel sets the level of the standard logger to LogLevel. An empty LogLevel leaves the level unchanged.
+func (o Options) ApplyLogLevel() error {
+	if len(o.LogLevel) == 0 {
+		return nil
+	}
+
+	level, err := log.ParseLevel(o.LogLevel)
+	if err != nil {
+		return err
+	}
+	log.SetLevel(level)
+	return nil
+}
+
+// Reload produces the options that a running server should use after its options file was re-read as next. The
+// result is a copy of o with the live options taken from next. The JSON names of options that changed but can't be
+// applied without a restart are also returned.
+func (o Options) Reload(next Options) (*Options, []string) {
+	reloaded := o
+	restartRequired := make([]string, 0)
+
+	current := reflect.ValueOf(&reloaded).Elem()
+	incoming := reflect.ValueOf(next)
+	for i := 0; i < current.NumField(); i++ {
+		name := strings.Split(current.Type().Field(i).Tag.Get("json"), ",")[0]
+		if len(name) == 0 || name == "-" {
+			continue
+		}
+		if reflect.DeepEqual(current.Field(i).Interface(), incoming.Field(i).Interface()) {
+			continue
+		}
+
+		if liveFields[name] {
+			current.Field(i).Set(incoming.Field(i))
+		} else {
+			restartRequired = append(restartRequired, name)
+		}
+	}
+
+	return &reloaded, restartRequired
+}
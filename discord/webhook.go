@@ -0,0 +1,278 @@
+package discord
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/secrets"
+	"github.com/smashwilson/az-coordinator/state"
+)
+
+// maxDescriptionLength keeps a report within the length that Discord accepts for an embed's description.
+const maxDescriptionLength = 4000
+
+// maxDiffLength keeps each unit diff short enough that a report can hold a few of them.
+const maxDiffLength = 800
+
+// Embed colors, for the bar along the side of a report.
+const (
+	colorSuccess = 0x2eb67d
+	colorPartial = 0xecb22e
+	colorFailure = 0xe01e5a
+)
+
+type embed struct {
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	URL         string `json:"url,omitempty"`
+	Color       int    `json:"color,omitempty"`
+}
+
+type discordPayload struct {
+	Embeds []embed `json:"embeds"`
+
+	lines []string
+}
+
+func (payload *discordPayload) appendLine(markdown string) {
+	payload.lines = append(payload.lines, markdown)
+}
+
+func (payload *discordPayload) appendContainerLine(container state.UpdatedContainer) {
+	status := strings.Builder{}
+	fmt.Fprintf(&status, "📦 [**%s**](<%s>):", container.Repository, container.RepositoryURL())
+	fmt.Fprintf(&status, " [`%s`](<%s>)", container.GitOID[0:7], container.CommitURL())
+	if container.GitRef != "master" {
+		fmt.Fprintf(&status, " on [`%s`](<%s>) ([pull request](<%s>))", container.GitRef, container.BranchURL(), container.PullRequestURL())
+	}
+	payload.appendLine(status.String())
+}
+
+func (payload *discordPayload) appendUnitsLine(emoji, verb string, unitNames []string) {
+	if len(unitNames) == 0 {
+		return
+	}
+	payload.appendLine(fmt.Sprintf("%s %s: `%s`", emoji, verb, strings.Join(unitNames, "`, `")))
+}
+
+func (payload *discordPayload) appendDiff(unitName, diff string) {
+	if len(diff) > maxDiffLength {
+		diff = diff[:maxDiffLength] + "\n... (truncated)"
+	}
+	payload.appendLine(fmt.Sprintf("📄 `%s`\n```diff\n%s```", unitName, diff))
+}
+
+// render places the accumulated lines in the payload's embed, shortened to fit Discord's limits.
+func (payload discordPayload) render(title, link string, color int) ([]byte, error) {
+	description := strings.Join(payload.lines, "\n")
+	if len(description) > maxDescriptionLength {
+		description = description[:maxDescriptionLength] + "\n... (truncated)"
+	}
+	payload.Embeds = []embed{{Title: title, Description: description, URL: link, Color: color}}
+	return json.Marshal(payload)
+}
+
+func generatePayload(d *state.Delta, errs []error, trigger state.SyncTrigger) (discordPayload, string, int) {
+	var (
+		updatedContainers []state.UpdatedContainer
+		unitDiffs         map[string]string
+	)
+	if d != nil {
+		updatedContainers = d.UpdatedContainers
+		unitDiffs = d.UnitDiffs
+	}
+	deployed := len(updatedContainers) > 0 || len(unitDiffs) > 0 || (d != nil && d.UnitsChanged())
+
+	payload := discordPayload{lines: make([]string, 0, len(updatedContainers)+len(unitDiffs)+len(errs)+8)}
+	title, color := "", colorSuccess
+
+	if len(errs) > 0 && deployed {
+		title, color = "⚠️ Partially successful deployment.", colorPartial
+	} else if deployed {
+		title = "♻️ Successful deployment."
+	} else if len(errs) > 0 {
+		title, color = "🚨 Failed deployment.", colorFailure
+	}
+
+	if len(trigger.Source) > 0 {
+		payload.appendLine(fmt.Sprintf("👤 Triggered by %s", trigger))
+	}
+
+	for _, err := range errs {
+		payload.appendLine(fmt.Sprintf("❗ Error: %s", err))
+	}
+
+	if d != nil && d.UnitsChanged() {
+		added, restarted, removed := d.UnitNames()
+		payload.appendUnitsLine("➕", "Added", added)
+		payload.appendUnitsLine("🔄", "Restarted", restarted)
+		payload.appendUnitsLine("➖", "Removed", removed)
+		payload.appendLine(fmt.Sprintf("⏱️ Applied in %s.", time.Duration(d.ApplyMillis)*time.Millisecond))
+	}
+
+	if d != nil {
+		for _, result := range d.FailedResults() {
+			payload.appendLine(fmt.Sprintf("❌ Unable to %s `%s`: %s", result.Action, result.Unit, result.Detail()))
+		}
+	}
+
+	if d != nil {
+		for _, h := range d.Health {
+			emoji := "✅"
+			if !h.Healthy {
+				emoji = "❌"
+			}
+			payload.appendLine(fmt.Sprintf("%s `%s` is %s", emoji, h.Unit, h.ActiveState))
+		}
+		for _, f := range d.PullFailures {
+			payload.appendLine(fmt.Sprintf("📦 Unable to pull `%s` after %d attempts: %s", f.Ref, f.Attempts, f.Error))
+		}
+		for _, g := range d.GatedUnits {
+			payload.appendLine(fmt.Sprintf("⛔ Held `%s` at its current image. The checks of %s@`%s` haven't passed: %s", g.Unit, g.Repository, g.ShortCommit(), g.Detail))
+		}
+	}
+
+	for _, container := range updatedContainers {
+		payload.appendContainerLine(container)
+	}
+
+	names := make([]string, 0, len(unitDiffs))
+	for name := range unitDiffs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		payload.appendDiff(name, unitDiffs[name])
+	}
+
+	if d != nil && d.Prune != nil {
+		payload.appendLine(fmt.Sprintf(
+			"🧹 Pruned unused %s docker data: reclaimed %s, disk now %d%% full.",
+			d.Prune.Mode, d.Prune.Reclaimed, d.Prune.DiskUsagePercent,
+		))
+		if len(title) == 0 {
+			title = "Pruned unused docker data."
+		}
+	}
+
+	return payload, title, color
+}
+
+func sendPayload(body []byte, webhookURL string) error {
+	body = []byte(secrets.Redact(string(body)))
+
+	logrus.Debugf("Sending data to Discord webhook:\n%s", string(body))
+
+	resp, err := http.Post(webhookURL, "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		logrus.WithError(err).Warning("Unable to read Discord response body")
+	}
+	logrus.Debugf("Received response from Discord:\n%s", string(respBody))
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Discord webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// ReportSync reports the result of a state sync operation to a Discord webhook. If link isn't empty, the report links
+// to it for the details of the sync.
+func ReportSync(webhookURL string, d *state.Delta, errs []error, trigger state.SyncTrigger, link string) {
+	if len(errs) == 0 && (d == nil || (!d.UnitsChanged() && len(d.UpdatedContainers) == 0 && len(d.UnitDiffs) == 0 && d.Prune == nil && len(d.PullFailures) == 0 && len(d.GatedUnits) == 0)) {
+		logrus.Debug("Nothing to report.")
+		return
+	}
+
+	payload, title, color := generatePayload(d, errs, trigger)
+	body, err := payload.render(title, link, color)
+	if err == nil {
+		err = sendPayload(body, webhookURL)
+	}
+	if err != nil {
+		logrus.WithError(err).Warning("Unable to send payload to Discord webhook.")
+	}
+}
+
+// ReportPendingApproval reports a sync whose Delta is waiting to be approved to a Discord webhook.
+func ReportPendingApproval(webhookURL string, id int, reasons []string, trigger state.SyncTrigger) {
+	payload := discordPayload{lines: make([]string, 0, len(reasons)+2)}
+	payload.appendLine(fmt.Sprintf("Approve it with `POST /sync/%d/approve`.", id))
+	if len(trigger.Source) > 0 {
+		payload.appendLine(fmt.Sprintf("👤 Triggered by %s", trigger))
+	}
+	for _, reason := range reasons {
+		payload.appendLine(fmt.Sprintf("⚠️ %s", reason))
+	}
+
+	body, err := payload.render("✋ Deployment awaiting approval.", "", colorPartial)
+	if err == nil {
+		err = sendPayload(body, webhookURL)
+	}
+	if err != nil {
+		logrus.WithError(err).Warning("Unable to send payload to Discord webhook.")
+	}
+}
+
+// ReportContainerDeath reports a managed container that stopped unexpectedly to a Discord webhook.
+func ReportContainerDeath(webhookURL string, d state.ContainerDeath) {
+	payload := discordPayload{lines: make([]string, 0, 2)}
+	payload.appendLine(fmt.Sprintf("Container `%s` of `%s` %s.", d.Container, d.Unit, d.Cause()))
+	if d.Restoring {
+		payload.appendLine("♻️ Restarting it with a sync.")
+	}
+
+	body, err := payload.render("💀 Container died.", "", colorFailure)
+	if err == nil {
+		err = sendPayload(body, webhookURL)
+	}
+	if err != nil {
+		logrus.WithError(err).Warning("Unable to send payload to Discord webhook.")
+	}
+}
+
+// ReportDrift reports a change to a managed unit that the coordinator didn't make to a Discord webhook.
+func ReportDrift(webhookURL string, e state.DriftEvent) {
+	payload := discordPayload{lines: make([]string, 0, 1)}
+	payload.appendLine(fmt.Sprintf("Unit `%s` on %s: %s.", e.Unit, e.Host, e.Detail))
+
+	body, err := payload.render("🔍 Unit drifted.", "", colorPartial)
+	if err == nil {
+		err = sendPayload(body, webhookURL)
+	}
+	if err != nil {
+		logrus.WithError(err).Warning("Unable to send payload to Discord webhook.")
+	}
+}
+
+// ReportAlert reports an alert rule that was breached, or that has recovered, to a Discord webhook.
+func ReportAlert(webhookURL string, a state.Alert) {
+	payload := discordPayload{lines: make([]string, 0, 1)}
+	title, color := "🚨 Alert firing.", colorFailure
+	if a.Firing {
+		payload.appendLine(fmt.Sprintf("`%s` on %s: %s (threshold %d).", a.Rule, a.Host, a.Detail, a.Threshold))
+	} else {
+		title, color = "✅ Alert recovered.", colorSuccess
+		payload.appendLine(fmt.Sprintf("`%s` on %s had reported that %s.", a.Rule, a.Host, a.Detail))
+	}
+
+	body, err := payload.render(title, "", color)
+	if err == nil {
+		err = sendPayload(body, webhookURL)
+	}
+	if err != nil {
+		logrus.WithError(err).Warning("Unable to send payload to Discord webhook.")
+	}
+}
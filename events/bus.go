@@ -0,0 +1,80 @@
+package events
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Bus delivers each published Event to every current Subscription.
+type Bus struct {
+	lock          sync.Mutex
+	subscriptions map[*Subscription]bool
+}
+
+// NewBus creates a Bus with no subscriptions.
+func NewBus() *Bus {
+	return &Bus{subscriptions: make(map[*Subscription]bool)}
+}
+
+// Subscription receives the events published on a Bus from the time it's created until it's closed.
+type Subscription struct {
+	// C receives events in the order that they were published. It's closed when the Subscription is closed.
+	C <-chan Event
+
+	c     chan Event
+	bus   *Bus
+	types map[Type]bool
+}
+
+// Subscribe starts receiving events. Up to buffer events wait to be received; events published while the buffer is
+// full are dropped for this Subscription, so that a slow subscriber never blocks the publisher. If types are given,
+// only events of those types are received.
+func (b *Bus) Subscribe(buffer int, types ...Type) *Subscription {
+	c := make(chan Event, buffer)
+	sub := &Subscription{C: c, c: c, bus: b}
+	if len(types) > 0 {
+		sub.types = make(map[Type]bool, len(types))
+		for _, t := range types {
+			sub.types[t] = true
+		}
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.subscriptions[sub] = true
+	return sub
+}
+
+// Close stops delivering events to this Subscription and closes its channel.
+func (s *Subscription) Close() {
+	s.bus.lock.Lock()
+	defer s.bus.lock.Unlock()
+
+	if s.bus.subscriptions[s] {
+		delete(s.bus.subscriptions, s)
+		close(s.c)
+	}
+}
+
+// Publish delivers an event to each subscription that wants it.
+func (b *Bus) Publish(event Event) {
+	if b == nil {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for sub := range b.subscriptions {
+		if sub.types != nil && !sub.types[event.Type] {
+			continue
+		}
+
+		select {
+		case sub.c <- event:
+		default:
+			log.WithField("eventType", event.Type).WithField("eventID", event.ID).Warn("Event subscriber is falling behind. Dropping event.")
+		}
+	}
+}
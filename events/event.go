@@ -0,0 +1,48 @@
+package events
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// Type identifies the kind of change that an Event describes.
+type Type string
+
+// The types of event published by the coordinator.
+const (
+	SyncStarted     Type = "sync.started"
+	SyncFinished    Type = "sync.finished"
+	UnitCreated     Type = "unit.created"
+	UnitUpdated     Type = "unit.updated"
+	UnitDeleted     Type = "unit.deleted"
+	SecretChanged   Type = "secret.changed"
+	HealthThreshold Type = "health.threshold"
+	ContainerDied   Type = "container.died"
+	UnitDrifted     Type = "unit.drifted"
+)
+
+// Event is a change in the coordinator's state that subscribers and external systems may react to. Data is a
+// SyncData, SyncFinishedData, UnitData, SecretData, HealthData, state.ContainerDeath, or state.DriftEvent, chosen
+// by the Type.
+type Event struct {
+	ID    string      `json:"id"`
+	Type  Type        `json:"type"`
+	Time  int64       `json:"time"`
+	Actor string      `json:"actor,omitempty"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+// New creates an Event of the given type that happened now.
+func New(t Type, actor string, data interface{}) Event {
+	var id [16]byte
+	rand.Read(id[:])
+
+	return Event{
+		ID:    hex.EncodeToString(id[:]),
+		Type:  t,
+		Time:  time.Now().Unix(),
+		Actor: actor,
+		Data:  data,
+	}
+}
@@ -0,0 +1,44 @@
+package events
+
+import "github.com/smashwilson/az-coordinator/state"
+
+// SyncData is the Data of SyncStarted events.
+type SyncData struct {
+	ID      int               `json:"id"`
+	Trigger state.SyncTrigger `json:"trigger"`
+}
+
+// SyncFinishedData is the Data of SyncFinished events.
+type SyncFinishedData struct {
+	SyncData
+
+	Added           []string `json:"added,omitempty"`
+	Restarted       []string `json:"restarted,omitempty"`
+	Removed         []string `json:"removed,omitempty"`
+	ApplyMillis     int64    `json:"apply_ms,omitempty"`
+	Errors          []string `json:"errors,omitempty"`
+	PendingApproval bool     `json:"pending_approval,omitempty"`
+}
+
+// UnitData is the Data of UnitCreated, UnitUpdated, and UnitDeleted events. Either field may be missing if it wasn't
+// known when the event was published.
+type UnitData struct {
+	ID   int    `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+// SecretData is the Data of SecretChanged events. It names the secrets that changed, but never carries their values.
+type SecretData struct {
+	Action string   `json:"action"`
+	Keys   []string `json:"keys"`
+}
+
+// HealthData is the Data of HealthThreshold events. Unit and ActiveState are set for a unit that's unhealthy after a
+// sync; the other fields are set when disk usage reached the prune threshold.
+type HealthData struct {
+	Unit             string `json:"unit,omitempty"`
+	ActiveState      string `json:"active_state,omitempty"`
+	DiskUsagePercent int    `json:"disk_usage_percent,omitempty"`
+	ThresholdPercent int    `json:"threshold_percent,omitempty"`
+	Reclaimed        string `json:"reclaimed,omitempty"`
+}
@@ -0,0 +1,173 @@
+package events
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/secrets"
+)
+
+// Headers sent with each webhook delivery.
+const (
+	EventHeader     = "X-Az-Event"
+	DeliveryHeader  = "X-Az-Delivery"
+	TimestampHeader = "X-Az-Timestamp"
+	SignatureHeader = "X-Az-Signature"
+)
+
+const (
+	// queueSize is the number of events that may wait to be delivered. Events published while the queue is full are
+	// dropped, so that a slow receiver can't hold up syncs or API requests.
+	queueSize = 100
+
+	// attempts is the number of times each delivery is tried before it's dropped.
+	attempts = 3
+
+	// initialBackoff is the delay before the second attempt. It doubles after each subsequent failure.
+	initialBackoff = time.Second
+
+	// deliveryTimeout bounds each attempt to deliver an event.
+	deliveryTimeout = 10 * time.Second
+)
+
+// Webhook is a URL that receives events. If Secret is set, each delivery is signed with it. If Types isn't empty,
+// only events of those types are delivered.
+type Webhook struct {
+	URL    string
+	Secret string
+	Types  []string
+}
+
+// Wants returns true if events of type t should be delivered to this webhook.
+func (w Webhook) Wants(t Type) bool {
+	if len(w.Types) == 0 {
+		return true
+	}
+	for _, want := range w.Types {
+		if want == string(t) || want == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Sign computes the signature of a delivery: the hex-encoded HMAC-SHA256, keyed by secret, of the timestamp, a
+// period, and the request body.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+type delivery struct {
+	webhook Webhook
+	event   Event
+	body    []byte
+}
+
+// Emitter delivers the events published on a Bus to webhooks in the background.
+type Emitter struct {
+	webhooks func() []Webhook
+	sub      *Subscription
+	client   *http.Client
+}
+
+// NewEmitter subscribes to bus and starts delivering its events. webhooks is called for each event, so that changes
+// to the configured webhooks take effect without restarting.
+func NewEmitter(bus *Bus, webhooks func() []Webhook) *Emitter {
+	e := &Emitter{
+		webhooks: webhooks,
+		sub:      bus.Subscribe(queueSize),
+		client:   &http.Client{Timeout: deliveryTimeout},
+	}
+	go e.run()
+	return e
+}
+
+// Close stops delivering events.
+func (e *Emitter) Close() {
+	e.sub.Close()
+}
+
+func (e *Emitter) run() {
+	for event := range e.sub.C {
+		var body []byte
+		for _, webhook := range e.webhooks() {
+			if !webhook.Wants(event.Type) {
+				continue
+			}
+
+			if body == nil {
+				encoded, err := json.Marshal(event)
+				if err != nil {
+					log.WithError(err).WithField("eventType", event.Type).Error("Unable to serialize event.")
+					break
+				}
+				body = []byte(secrets.Redact(string(encoded)))
+			}
+			e.deliver(delivery{webhook: webhook, event: event, body: body})
+		}
+	}
+}
+
+// deliver sends one event to one webhook, retrying with an exponentially increasing delay if it fails.
+func (e *Emitter) deliver(d delivery) {
+	logger := log.WithFields(log.Fields{
+		"eventType": d.event.Type,
+		"eventID":   d.event.ID,
+		"url":       d.webhook.URL,
+	})
+
+	backoff := initialBackoff
+	for attempt := 1; attempt <= attempts; attempt++ {
+		err := e.post(d)
+		if err == nil {
+			logger.Debug("Event delivered.")
+			return
+		}
+
+		if attempt == attempts {
+			logger.WithError(err).Warn("Unable to deliver event. Dropping it.")
+			return
+		}
+		logger.WithError(err).WithField("attempt", attempt).Debug("Unable to deliver event. Retrying.")
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (e *Emitter) post(d delivery) error {
+	req, err := http.NewRequest(http.MethodPost, d.webhook.URL, bytes.NewReader(d.body))
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, string(d.event.Type))
+	req.Header.Set(DeliveryHeader, d.event.ID)
+	req.Header.Set(TimestampHeader, timestamp)
+	if len(d.webhook.Secret) > 0 {
+		req.Header.Set(SignatureHeader, Sign(d.webhook.Secret, timestamp, d.body))
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package fleet
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/buildinfo"
+	"github.com/smashwilson/az-coordinator/config"
+	"github.com/smashwilson/az-coordinator/state"
+)
+
+// Agent polls a controller for the Assignment of this host and applies it whenever it changes.
+type Agent struct {
+	host             string
+	token            string
+	base             *url.URL
+	interval         time.Duration
+	dockerAPIVersion string
+	settings         state.SyncSettings
+	http             *http.Client
+
+	lastDigest string
+	lastFailed bool
+}
+
+// NewAgent creates an Agent for the controller named in opts. Each sync it performs is configured by settings.
+func NewAgent(opts *config.Options, settings state.SyncSettings) (*Agent, error) {
+	fleet := opts.Fleet
+	if err := fleet.Validate(); err != nil {
+		return nil, err
+	}
+
+	base, err := url.Parse(fleet.ControllerURL)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment, TLSHandshakeTimeout: 10 * time.Second}
+	if len(fleet.ControllerCAPath) > 0 {
+		pem, err := ioutil.ReadFile(fleet.ControllerCAPath)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", fleet.ControllerCAPath)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	settings.Host = fleet.Host()
+	settings.Trigger = state.SyncTrigger{Source: state.TriggerAgent, Actor: fleet.Host()}
+
+	return &Agent{
+		host:             fleet.Host(),
+		token:            fleet.AgentToken,
+		base:             base,
+		interval:         fleet.PollInterval(),
+		dockerAPIVersion: opts.DockerAPIVersion,
+		settings:         settings,
+		http:             &http.Client{Transport: transport, Timeout: time.Minute},
+	}, nil
+}
+
+// Run polls the controller forever. Errors are logged and retried at the next poll.
+func (a *Agent) Run() {
+	for {
+		if err := a.Poll(context.Background()); err != nil {
+			log.WithError(err).Warn("Unable to poll the fleet controller.")
+		}
+		time.Sleep(a.interval)
+	}
+}
+
+// Poll fetches this host's Assignment from the controller. If it has changed since the last successful sync, or if
+// the last sync failed, the host is synchronized to match it and the outcome is reported to the controller.
+func (a *Agent) Poll(ctx context.Context) error {
+	var assignment Assignment
+	if err := a.do(ctx, http.MethodGet, "/agent/assignment", nil, &assignment); err != nil {
+		return err
+	}
+
+	digest, err := assignment.Digest()
+	if err != nil {
+		return err
+	}
+	if digest == a.lastDigest && !a.lastFailed {
+		log.WithField("digest", digest).Debug("Assignment unchanged.")
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"digest": digest,
+		"units":  len(assignment.Units),
+	}).Info("Applying assignment from the fleet controller.")
+
+	report := a.apply(ctx, assignment)
+	report.Digest = digest
+
+	a.lastDigest = digest
+	a.lastFailed = len(report.Errors) > 0
+
+	return a.do(ctx, http.MethodPost, "/agent/report", report, nil)
+}
+
+// apply synchronizes this host with an Assignment and describes the outcome.
+func (a *Agent) apply(ctx context.Context, assignment Assignment) Report {
+	report := Report{
+		Host:    a.host,
+		Version: buildinfo.Current().Version,
+		Errors:  make([]string, 0),
+	}
+	failed := func(errs ...error) Report {
+		for _, err := range errs {
+			log.WithError(err).Warn("Synchronization error.")
+			report.Errors = append(report.Errors, err.Error())
+		}
+		report.ReportedAt = time.Now().Unix()
+		return report
+	}
+
+	session, err := state.NewSession(nil, nil, a.dockerAPIVersion)
+	if err != nil {
+		return failed(err)
+	}
+	lease := session.Lease()
+	defer lease.Release()
+
+	bag := assignment.Bag()
+	lease.UseSecrets(bag)
+
+	files, err := bag.DesiredFiles()
+	if err != nil {
+		return failed(err)
+	}
+
+	settings := a.settings
+	settings.Labels = assignment.Labels
+	settings.Desired = &state.DesiredState{Units: assignment.Units, Files: files}
+
+	delta, errs := lease.Synchronize(ctx, settings)
+	report.Delta = delta
+	if len(errs) > 0 {
+		failed(errs...)
+	}
+
+	actual, err := lease.ReadActualState(ctx)
+	if err != nil {
+		return failed(err)
+	}
+	report.Actual = actual
+
+	report.ReportedAt = time.Now().Unix()
+	return report
+}
+
+// do sends a request to the controller, authenticated as this host. A non-nil body is sent as JSON and a successful
+// response is decoded into a non-nil out.
+func (a *Agent) do(ctx context.Context, method, path string, body interface{}, out interface{}) error {
+	ref, err := url.Parse(path)
+	if err != nil {
+		return err
+	}
+
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequest(method, a.base.ResolveReference(ref).String(), reader)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.SetBasicAuth(a.host, a.token)
+
+	resp, err := a.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
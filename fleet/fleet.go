@@ -0,0 +1,145 @@
+// Package fleet lets one coordinator, the controller, manage units on several hosts. Each host runs an agent that
+// polls the controller for the units scoped to it, applies them locally, and reports the outcome back.
+package fleet
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/smashwilson/az-coordinator/retry"
+	"github.com/smashwilson/az-coordinator/secrets"
+	"github.com/smashwilson/az-coordinator/state"
+	"github.com/smashwilson/az-coordinator/store"
+)
+
+// Assignment is the desired state of a single host, as served to its agent by the controller.
+type Assignment struct {
+	Host   string                     `json:"host"`
+	Labels map[string]string          `json:"labels"`
+	Units  []state.DesiredSystemdUnit `json:"units"`
+
+	// Secrets holds the values of the secrets used by Units and of the file-kind secrets that they mount.
+	Secrets map[string]string `json:"secrets"`
+
+	// Files holds the destination of each file-kind secret that Units mount.
+	Files map[string]secrets.FileDestination `json:"files"`
+
+	// SyncRequestedAt is the Unix time at which a sync was last requested from the controller. Agents sync whenever
+	// it changes, even if nothing else has.
+	SyncRequestedAt int64 `json:"sync_requested_at"`
+}
+
+// NewAssignment collects the units from desired that run on host, which carries labels, along with the secrets they
+// need from bag. File-kind secrets are only included if one of those units mounts them.
+func NewAssignment(host string, labels map[string]string, desired state.DesiredState, bag *secrets.Bag, syncRequestedAt int64) Assignment {
+	scoped := desired.ForHost(host, labels)
+	assignment := Assignment{
+		Host:            host,
+		Labels:          labels,
+		Units:           scoped.Units,
+		Secrets:         make(map[string]string),
+		Files:           make(map[string]secrets.FileDestination),
+		SyncRequestedAt: syncRequestedAt,
+	}
+
+	for _, unit := range scoped.Units {
+		for _, key := range unit.UsedSecrets() {
+			if bag.Has(key) {
+				assignment.Secrets[key] = bag.Get(key, "")
+			}
+		}
+	}
+	for key, destination := range bag.FileDestinations() {
+		for _, unit := range scoped.Units {
+			if unit.Mounts(destination.Path) {
+				assignment.Files[key] = destination
+				break
+			}
+		}
+	}
+	for key := range assignment.Files {
+		if bag.Has(key) {
+			assignment.Secrets[key] = bag.Get(key, "")
+		}
+	}
+
+	return assignment
+}
+
+// Digest summarizes the assignment so that agents can tell when it has changed.
+func (a Assignment) Digest() (string, error) {
+	raw, err := json.Marshal(a)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Bag creates a secrets Bag from the assignment's secrets and file destinations.
+func (a Assignment) Bag() *secrets.Bag {
+	return secrets.NewBag(a.Secrets, a.Files)
+}
+
+// Report is an agent's account of the state of its host after its most recent sync.
+type Report struct {
+	Host       string `json:"host"`
+	ReportedAt int64  `json:"reported_at"`
+	Version    string `json:"version"`
+
+	// Digest identifies the Assignment that was last applied.
+	Digest string `json:"digest"`
+
+	Delta  *state.Delta       `json:"delta"`
+	Errors []string           `json:"errors"`
+	Actual *state.ActualState `json:"actual"`
+}
+
+// SaveReport stores the most recent report from an agent, replacing any earlier report from the same host.
+func SaveReport(ctx context.Context, db *store.DB, report Report) error {
+	raw, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	return retry.Transient(ctx, func() error {
+		_, err := db.ExecContext(ctx, `
+		INSERT INTO agent_reports (host, reported_at, report)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (host) DO UPDATE SET reported_at = excluded.reported_at, report = excluded.report
+	`, report.Host, report.ReportedAt, raw)
+		return err
+	})
+}
+
+// LoadReports reads the most recent report from each agent, ordered by host name.
+func LoadReports(ctx context.Context, db *store.DB) ([]Report, error) {
+	var rows *sql.Rows
+	err := retry.Transient(ctx, func() error {
+		var err error
+		rows, err = db.QueryContext(ctx, "SELECT report FROM agent_reports ORDER BY host")
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reports := make([]Report, 0)
+	for rows.Next() {
+		var raw []byte
+		if err := rows.Scan(&raw); err != nil {
+			return nil, err
+		}
+
+		var report Report
+		if err := json.Unmarshal(raw, &report); err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, rows.Err()
+}
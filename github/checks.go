@@ -0,0 +1,97 @@
+package github
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/smashwilson/az-coordinator/config"
+)
+
+// checksAccept opts in to the check runs API.
+const checksAccept = "application/vnd.github.antiope-preview+json"
+
+// passingConclusions are the conclusions of a completed check run that don't hold back a commit.
+var passingConclusions = map[string]bool{
+	"success": true,
+	"neutral": true,
+	"skipped": true,
+}
+
+// CommitState combines the commit statuses and the check runs of a commit into one state: StateSuccess if every one
+// has passed, StatePending if any is still running, or StateFailure if any has failed. A commit without any statuses
+// or check runs has passed. The names of the checks that haven't passed are returned with it.
+func (c *Client) CommitState(ctx context.Context, repository, commit string) (string, []string, error) {
+	var combined struct {
+		Statuses []struct {
+			State   string `json:"state"`
+			Context string `json:"context"`
+		} `json:"statuses"`
+	}
+	if err := c.get(ctx, fmt.Sprintf("/repos/%s/commits/%s/status", repository, commit), deploymentsAccept, &combined); err != nil {
+		return "", nil, err
+	}
+
+	var runs struct {
+		CheckRuns []struct {
+			Name       string `json:"name"`
+			Status     string `json:"status"`
+			Conclusion string `json:"conclusion"`
+		} `json:"check_runs"`
+	}
+	if err := c.get(ctx, fmt.Sprintf("/repos/%s/commits/%s/check-runs?per_page=100", repository, commit), checksAccept, &runs); err != nil {
+		return "", nil, err
+	}
+
+	pending, failing := make([]string, 0), make([]string, 0)
+	for _, status := range combined.Statuses {
+		switch status.State {
+		case StateSuccess:
+		case StatePending:
+			pending = append(pending, status.Context)
+		default:
+			failing = append(failing, status.Context)
+		}
+	}
+	for _, run := range runs.CheckRuns {
+		if run.Status != "completed" {
+			pending = append(pending, run.Name)
+		} else if !passingConclusions[run.Conclusion] {
+			failing = append(failing, run.Name)
+		}
+	}
+
+	if len(failing) > 0 {
+		return StateFailure, failing, nil
+	}
+	if len(pending) > 0 {
+		return StatePending, pending, nil
+	}
+	return StateSuccess, nil, nil
+}
+
+// CheckCommit reports whether every check of a commit has passed. If they haven't, detail gives the state of its
+// checks and the names of those that haven't passed, like "pending: ci/build".
+func (c *Client) CheckCommit(ctx context.Context, repository, commit string) (passed bool, detail string, err error) {
+	state, names, err := c.CommitState(ctx, repository, commit)
+	if err != nil {
+		return false, "", err
+	}
+	if state == StateSuccess {
+		return true, state, nil
+	}
+	return false, state + ": " + strings.Join(names, ", "), nil
+}
+
+// CommitChecker returns a function that checks commits with the credentials in opts, or nil if opts don't require
+// passing checks. If a client can't be created with opts, no commit passes, so that images aren't rolled out ungated.
+func CommitChecker(opts config.GitHubOptions) func(ctx context.Context, repository, commit string) (bool, string, error) {
+	if !opts.RequirePassingChecks {
+		return nil
+	}
+	client, err := NewClient(opts)
+	if err != nil {
+		return func(context.Context, string, string) (bool, string, error) { return false, "", err }
+	}
+	return client.CheckCommit
+}
@@ -0,0 +1,279 @@
+package github
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/smashwilson/az-coordinator/config"
+)
+
+// The states of a deployment that the coordinator reports, and of a commit's checks.
+const (
+	StateInProgress = "in_progress"
+	StateSuccess    = "success"
+	StateFailure    = "failure"
+	StatePending    = "pending"
+)
+
+const (
+	// requestTimeout limits each request to the GitHub API.
+	requestTimeout = 10 * time.Second
+
+	// deploymentsAccept opts in to the in_progress state and to the environment of each deployment status.
+	deploymentsAccept = "application/vnd.github.flash-preview+json, application/vnd.github.ant-man-preview+json"
+
+	// installationAccept opts in to the GitHub App API.
+	installationAccept = "application/vnd.github.machine-man-preview+json"
+
+	// appTokenLifetime is the validity of the JWT that a GitHub App signs to request an installation token. GitHub
+	// accepts up to ten minutes.
+	appTokenLifetime = 9 * time.Minute
+
+	// tokenRefreshMargin is the time before an installation token expires that a new one is requested.
+	tokenRefreshMargin = 5 * time.Minute
+)
+
+// Client creates GitHub Deployments and reports their status, authenticating with a token or as a GitHub App
+// installation.
+type Client struct {
+	baseURL        string
+	token          string
+	appID          int64
+	installationID int64
+	key            *rsa.PrivateKey
+	http           *http.Client
+
+	lock      sync.Mutex
+	appToken  string
+	expiresAt time.Time
+}
+
+// NewClient creates a Client with the credentials in opts. A GitHub App's private key is read from its file now.
+func NewClient(opts config.GitHubOptions) (*Client, error) {
+	if !opts.Enabled() {
+		return nil, errors.New("no GitHub token or app is configured")
+	}
+
+	c := &Client{
+		baseURL: opts.BaseURL(),
+		token:   opts.Token,
+		http:    &http.Client{Timeout: requestTimeout},
+	}
+	if opts.AppID == 0 {
+		return c, nil
+	}
+
+	if opts.InstallationID == 0 || len(opts.PrivateKeyPath) == 0 {
+		return nil, errors.New("a GitHub App requires an installation_id and a private_key_path")
+	}
+	raw, err := ioutil.ReadFile(opts.PrivateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parsePrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", opts.PrivateKeyPath, err)
+	}
+	c.appID, c.installationID, c.key = opts.AppID, opts.InstallationID, key
+	return c, nil
+}
+
+// parsePrivateKey reads an RSA private key from a PEM block, in the PKCS #1 form that GitHub issues or in PKCS #8.
+func parsePrivateKey(raw []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, errors.New("no PEM-encoded private key found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("the private key isn't an RSA key")
+	}
+	return key, nil
+}
+
+// Deployment describes a deployment of one commit of a repository, like "smashwilson/az-web", to an environment.
+type Deployment struct {
+	Repository  string
+	Ref         string
+	Environment string
+	Description string
+
+	// Payload is stored with the deployment, for the tools that read it.
+	Payload map[string]string
+}
+
+// CreateDeployment records a deployment, returning its ID. GitHub's merge of the default branch and its required
+// status checks are skipped, since the commit is already built and about to run.
+func (c *Client) CreateDeployment(ctx context.Context, d Deployment) (int64, error) {
+	body := map[string]interface{}{
+		"ref":               d.Ref,
+		"environment":       d.Environment,
+		"description":       d.Description,
+		"payload":           d.Payload,
+		"auto_merge":        false,
+		"required_contexts": []string{},
+	}
+
+	var created struct {
+		ID int64 `json:"id"`
+	}
+	path := fmt.Sprintf("/repos/%s/deployments", d.Repository)
+	if err := c.post(ctx, path, deploymentsAccept, body, &created); err != nil {
+		return 0, err
+	}
+	return created.ID, nil
+}
+
+// SetStatus reports the state of a deployment. If logURL isn't empty, the status links to it.
+func (c *Client) SetStatus(ctx context.Context, repository string, id int64, state, description, logURL string) error {
+	body := map[string]interface{}{
+		"state":       state,
+		"description": description,
+	}
+	if len(logURL) > 0 {
+		body["log_url"] = logURL
+	}
+
+	path := fmt.Sprintf("/repos/%s/deployments/%d/statuses", repository, id)
+	return c.post(ctx, path, deploymentsAccept, body, nil)
+}
+
+// authorization returns the Authorization header for requests to the API, requesting a new installation token if the
+// client authenticates as a GitHub App and its token is missing or about to expire.
+func (c *Client) authorization(ctx context.Context) (string, error) {
+	if c.key == nil {
+		return "token " + c.token, nil
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.appToken) > 0 && time.Until(c.expiresAt) > tokenRefreshMargin {
+		return "token " + c.appToken, nil
+	}
+
+	jwt, err := c.appJWT()
+	if err != nil {
+		return "", err
+	}
+
+	var issued struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	path := fmt.Sprintf("/app/installations/%d/access_tokens", c.installationID)
+	if err := c.send(ctx, http.MethodPost, path, installationAccept, "Bearer "+jwt, nil, &issued); err != nil {
+		return "", fmt.Errorf("unable to request an installation token: %v", err)
+	}
+	c.appToken, c.expiresAt = issued.Token, issued.ExpiresAt
+	return "token " + c.appToken, nil
+}
+
+// appJWT signs the JSON Web Token that identifies the GitHub App. It's backdated by a minute to allow for clock drift.
+func (c *Client) appJWT() (string, error) {
+	now := time.Now()
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(appTokenLifetime).Unix(),
+		"iss": strconv.FormatInt(c.appID, 10),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, c.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// get reads a resource from the API with the client's credentials, decoding the response into out.
+func (c *Client) get(ctx context.Context, path, accept string, out interface{}) error {
+	authorization, err := c.authorization(ctx)
+	if err != nil {
+		return err
+	}
+	return c.send(ctx, http.MethodGet, path, accept, authorization, nil, out)
+}
+
+// post sends body to the API with the client's credentials, decoding the response into out if it isn't nil.
+func (c *Client) post(ctx context.Context, path, accept string, body, out interface{}) error {
+	authorization, err := c.authorization(ctx)
+	if err != nil {
+		return err
+	}
+	return c.send(ctx, http.MethodPost, path, accept, authorization, body, out)
+}
+
+// send makes a request to the API with body, if it isn't nil, decoding the response into out if it isn't nil.
+func (c *Client) send(ctx context.Context, method, path, accept, authorization string, body, out interface{}) error {
+	var encoded []byte
+	if body != nil {
+		var err error
+		if encoded, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+path, bytes.NewReader(encoded))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", accept)
+	req.Header.Set("Authorization", authorization)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(respBody, &apiErr) == nil && len(apiErr.Message) > 0 {
+			return fmt.Errorf("GitHub responded to %s with %s: %s", path, resp.Status, apiErr.Message)
+		}
+		return fmt.Errorf("GitHub responded to %s with %s", path, resp.Status)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(respBody, out)
+}
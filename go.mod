@@ -5,7 +5,7 @@ go 1.12
 require (
 	github.com/Azure/go-ansiterm v0.0.0-20170929234023-d6e3b3328b78 // indirect
 	github.com/Microsoft/go-winio v0.4.12
-	github.com/aws/aws-sdk-go v1.17.7
+	github.com/aws/aws-sdk-go v1.26.1
 	github.com/coreos/go-systemd v0.0.0-20181031085051-9002847aa142
 	github.com/docker/distribution v2.7.1+incompatible
 	github.com/docker/docker v0.0.0-20190131171824-7e7e100be04f
@@ -20,6 +20,7 @@ require (
 	github.com/kdar/logrus-cloudwatchlogs v0.0.0-20190402042352-9a67b2f09ba3
 	github.com/konsorten/go-windows-terminal-sequences v1.0.2
 	github.com/lib/pq v1.0.0
+	github.com/mattn/go-sqlite3 v1.14.8
 	github.com/morikuni/aec v0.0.0-20170113033406-39771216ff4c // indirect
 	github.com/opencontainers/go-digest v1.0.0-rc1
 	github.com/opencontainers/image-spec v1.0.1
@@ -0,0 +1,215 @@
+package leader
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/store"
+)
+
+// DefaultLockKey identifies the database lock that coordinator instances contend for. It spells "azcoord".
+const DefaultLockKey int64 = 0x617a636f6f7264
+
+// DefaultInterval is the time between leadership checks when no other interval is configured.
+const DefaultInterval = 5 * time.Second
+
+// checkTimeout bounds the database calls made by a single leadership check or by the release of the lock, so that an
+// unresponsive database can't stall an election forever.
+const checkTimeout = 10 * time.Second
+
+// Elector uses a database lock to choose a single leader among several coordinator instances that share a database.
+// With PostgreSQL, this is a session-level advisory lock. The leader performs syncs; followers serve read APIs and
+// take over if the leader's database session ends.
+type Elector struct {
+	db       *store.DB
+	key      int64
+	interval time.Duration
+
+	// lock guards the fields below it. It's never held across a database call, so IsLeader never waits on the
+	// database.
+	lock      sync.Mutex
+	isLeader  bool
+	onElected func()
+	onDeposed func()
+	stopped   bool
+
+	// campaigning serializes Campaign and Stop, which use conn, the database session that holds the lock, outside of
+	// lock.
+	campaigning sync.Mutex
+	conn        *sql.Conn
+
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewElector creates an Elector that contends for the lock identified by key, checking its status every
+// interval once Run is called.
+func NewElector(db *store.DB, key int64, interval time.Duration) *Elector {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+
+	return &Elector{
+		db:       db,
+		key:      key,
+		interval: interval,
+		done:     make(chan struct{}),
+	}
+}
+
+// OnElected registers a callback to be invoked from Run whenever this instance becomes the leader.
+func (e *Elector) OnElected(fn func()) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.onElected = fn
+}
+
+// OnDeposed registers a callback to be invoked from Run whenever this instance loses leadership.
+func (e *Elector) OnDeposed(fn func()) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.onDeposed = fn
+}
+
+// IsLeader returns true if this instance held the lock as of the most recent check.
+func (e *Elector) IsLeader() bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	return e.isLeader
+}
+
+// Campaign makes a single attempt to acquire leadership. If this instance is already the leader, it verifies that the
+// database session holding the lock is still alive. It returns true if this instance is the leader afterwards. Once
+// Stop has been called, it never acquires leadership again.
+func (e *Elector) Campaign() (bool, error) {
+	e.campaigning.Lock()
+	defer e.campaigning.Unlock()
+
+	e.lock.Lock()
+	stopped, wasLeader := e.stopped, e.isLeader
+	e.lock.Unlock()
+
+	if stopped {
+		return false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+
+	if wasLeader {
+		if err := e.conn.PingContext(ctx); err != nil {
+			// The session holding the lock is gone, so PostgreSQL has already released it.
+			e.closeConn()
+			e.setLeader(false)
+			return false, err
+		}
+		return true, nil
+	}
+
+	if e.conn == nil {
+		conn, err := e.db.Conn(ctx)
+		if err != nil {
+			return false, err
+		}
+		e.conn = conn
+	}
+
+	acquired, err := e.db.Dialect.TryLock(ctx, e.conn, e.key)
+	if err != nil {
+		e.closeConn()
+		return false, err
+	}
+
+	e.setLeader(acquired)
+	return acquired, nil
+}
+
+// setLeader publishes the outcome of a leadership check.
+func (e *Elector) setLeader(isLeader bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.isLeader = isLeader
+}
+
+// Run periodically campaigns for leadership until Stop is called, invoking the OnElected and OnDeposed callbacks
+// as leadership changes hands. It blocks, so call it in its own goroutine.
+func (e *Elector) Run() {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.done:
+			return
+		case <-ticker.C:
+		}
+
+		wasLeader := e.IsLeader()
+		isLeader, err := e.Campaign()
+		if err != nil {
+			log.WithError(err).Warn("Unable to check leadership.")
+		}
+
+		e.lock.Lock()
+		onElected, onDeposed := e.onElected, e.onDeposed
+		e.lock.Unlock()
+
+		if !wasLeader && isLeader {
+			log.WithField("lockKey", e.key).Info("Leadership acquired.")
+			if onElected != nil {
+				onElected()
+			}
+		} else if wasLeader && !isLeader {
+			log.WithField("lockKey", e.key).Warn("Leadership lost.")
+			if onDeposed != nil {
+				onDeposed()
+			}
+		}
+	}
+}
+
+// Stop ends a running Run loop and relinquishes leadership if it's held. It's safe to call more than once.
+func (e *Elector) Stop() {
+	e.stopOnce.Do(e.stop)
+}
+
+func (e *Elector) stop() {
+	close(e.done)
+
+	// Wait for any campaign in progress, so that it can't acquire the lock after it's been released.
+	e.campaigning.Lock()
+	defer e.campaigning.Unlock()
+
+	e.lock.Lock()
+	wasLeader := e.isLeader
+	e.stopped = true
+	e.isLeader = false
+	e.lock.Unlock()
+
+	if wasLeader {
+		ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+		defer cancel()
+
+		if err := e.db.Dialect.Unlock(ctx, e.conn, e.key); err != nil {
+			log.WithError(err).Warn("Unable to release leader lock.")
+		}
+	}
+	e.closeConn()
+}
+
+func (e *Elector) closeConn() {
+	if e.conn == nil {
+		return
+	}
+	if err := e.conn.Close(); err != nil {
+		log.WithError(err).Debug("Unable to close leader election connection.")
+	}
+	e.conn = nil
+}
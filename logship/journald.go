@@ -0,0 +1,65 @@
+package logship
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/coreos/go-systemd/journal"
+	log "github.com/sirupsen/logrus"
+)
+
+// JournaldHook sends log entries to the local systemd journal over its native protocol. Entry fields become journal
+// fields, so they can be queried with journalctl.
+type JournaldHook struct{}
+
+// NewJournaldHook creates a JournaldHook, or returns an error if the journal socket isn't available.
+func NewJournaldHook() (*JournaldHook, error) {
+	if !journal.Enabled() {
+		return nil, errors.New("the systemd journal is not available")
+	}
+	return &JournaldHook{}, nil
+}
+
+// Levels reports that every level is sent to the journal.
+func (h *JournaldHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+var journalPriorities = map[log.Level]journal.Priority{
+	log.PanicLevel: journal.PriCrit,
+	log.FatalLevel: journal.PriCrit,
+	log.ErrorLevel: journal.PriErr,
+	log.WarnLevel:  journal.PriWarning,
+	log.InfoLevel:  journal.PriInfo,
+	log.DebugLevel: journal.PriDebug,
+	log.TraceLevel: journal.PriDebug,
+}
+
+// Fire sends a single entry to the journal.
+func (h *JournaldHook) Fire(entry *log.Entry) error {
+	vars := make(map[string]string, len(entry.Data)+1)
+	vars["SYSLOG_IDENTIFIER"] = "az-coordinator"
+	for key, value := range entry.Data {
+		vars[journalFieldName(key)] = fmt.Sprint(value)
+	}
+
+	return journal.Send(entry.Message, journalPriorities[entry.Level], vars)
+}
+
+// journalFieldName converts a logrus field name like "unitName" into a valid journal field name like "AZ_UNITNAME".
+// Journal field names may contain only uppercase letters, digits, and underscores. The prefix keeps fields from
+// colliding with the journal's own.
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+	return "AZ_" + strings.TrimLeft(name, "_")
+}
@@ -0,0 +1,146 @@
+package logship
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// lokiBufferSize is the number of entries that may await delivery before new entries are dropped.
+const lokiBufferSize = 1000
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+type lokiPush struct {
+	Streams []lokiStream `json:"streams"`
+}
+
+type lokiLine struct {
+	level string
+	ts    time.Time
+	line  string
+}
+
+// LokiHook batches log entries and sends them to a Grafana Loki server's push API. Each entry is serialized as JSON
+// and labeled with its level in addition to the configured labels.
+type LokiHook struct {
+	url       string
+	labels    map[string]string
+	formatter log.Formatter
+	client    *http.Client
+	lines     chan lokiLine
+}
+
+// NewLokiHook creates a LokiHook that pushes to the Loki server at baseURL, like "http://loki:3100", every interval.
+func NewLokiHook(baseURL string, labels map[string]string, interval time.Duration) *LokiHook {
+	if labels == nil {
+		labels = make(map[string]string, 1)
+	}
+	if _, ok := labels["job"]; !ok {
+		labels["job"] = "az-coordinator"
+	}
+
+	h := &LokiHook{
+		url:       strings.TrimSuffix(baseURL, "/") + "/loki/api/v1/push",
+		labels:    labels,
+		formatter: &log.JSONFormatter{},
+		client:    &http.Client{Timeout: 10 * time.Second},
+		lines:     make(chan lokiLine, lokiBufferSize),
+	}
+	go h.run(interval)
+	return h
+}
+
+// Levels reports that every level is sent to Loki.
+func (h *LokiHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire queues an entry for delivery. Entries are dropped rather than blocking the caller if the queue is full.
+func (h *LokiHook) Fire(entry *log.Entry) error {
+	formatted, err := h.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case h.lines <- lokiLine{level: entry.Level.String(), ts: entry.Time, line: string(bytes.TrimSpace(formatted))}:
+	default:
+	}
+	return nil
+}
+
+func (h *LokiHook) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		batch := make([]lokiLine, 0, len(h.lines))
+	drain:
+		for {
+			select {
+			case line := <-h.lines:
+				batch = append(batch, line)
+			default:
+				break drain
+			}
+		}
+
+		if len(batch) == 0 {
+			continue
+		}
+		if err := h.push(batch); err != nil {
+			// Logging through logrus here could feed back into this hook, so report on stderr instead.
+			fmt.Fprintf(os.Stderr, "Unable to push %d log entries to Loki: %v\n", len(batch), err)
+		}
+	}
+}
+
+func (h *LokiHook) push(batch []lokiLine) error {
+	streams := make(map[string]*lokiStream)
+	for _, line := range batch {
+		stream, ok := streams[line.level]
+		if !ok {
+			labels := make(map[string]string, len(h.labels)+1)
+			for key, value := range h.labels {
+				labels[key] = value
+			}
+			labels["level"] = line.level
+
+			stream = &lokiStream{Stream: labels}
+			streams[line.level] = stream
+		}
+		stream.Values = append(stream.Values, [2]string{strconv.FormatInt(line.ts.UnixNano(), 10), line.line})
+	}
+
+	var payload lokiPush
+	for _, stream := range streams {
+		payload.Streams = append(payload.Streams, *stream)
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := h.client.Post(h.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Loki responded with %s", resp.Status)
+	}
+	return nil
+}
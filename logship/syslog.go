@@ -0,0 +1,17 @@
+package logship
+
+import (
+	"log/syslog"
+
+	log "github.com/sirupsen/logrus"
+	logrus_syslog "github.com/sirupsen/logrus/hooks/syslog"
+)
+
+// NewSyslogHook creates a hook that sends log entries to a syslog daemon. An empty network and address send them to
+// the local daemon.
+func NewSyslogHook(network, address, tag string) (log.Hook, error) {
+	if len(tag) == 0 {
+		tag = "az-coordinator"
+	}
+	return logrus_syslog.NewSyslogHook(network, address, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+}
@@ -0,0 +1,166 @@
+package manifest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/smashwilson/az-coordinator/state"
+)
+
+// The actions that Apply may take on each unit.
+const (
+	ActionCreated   = "created"
+	ActionUpdated   = "updated"
+	ActionUnchanged = "unchanged"
+)
+
+// Result reports what Apply did with one unit.
+type Result struct {
+	Manifest string `json:"manifest"`
+	Unit     string `json:"unit"`
+	ID       *int   `json:"id,omitempty"`
+	Action   string `json:"action"`
+}
+
+// planned is a unit that Apply has validated, but not yet stored.
+type planned struct {
+	manifest string
+	unit     *state.DesiredSystemdUnit
+	action   string
+}
+
+// Apply creates a desired unit for each container of the manifests, or updates the desired unit with the same path.
+// Updates replace every setting that a manifest can express, and keep those it can't, like a unit's resource limits,
+// pin, and whether it's enabled. Every unit is validated before any is stored, so a manifest with a problem changes
+// nothing, and no results are returned. The units are stored in one transaction, so if one can't be stored, none are,
+// and an empty list of results is returned with the error. Units that no longer appear in a manifest are left alone.
+func Apply(ctx context.Context, session *state.SessionLease, manifests []Manifest) ([]Result, []error) {
+	existing, err := session.ReadDesiredState(ctx)
+	if err != nil {
+		return nil, []error{err}
+	}
+	byPath := make(map[string]state.DesiredSystemdUnit, len(existing.Units))
+	for _, unit := range existing.Units {
+		byPath[unit.Path] = unit
+	}
+
+	errs := make([]error, 0)
+	plans := make([]planned, 0)
+	seen := make(map[string]string)
+	for _, m := range manifests {
+		units, err := m.Units()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s %s: %v", m.Kind, m.Metadata.Name, err))
+			continue
+		}
+
+		for _, unit := range units {
+			if other, ok := seen[unit.Path]; ok {
+				errs = append(errs, fmt.Errorf("%s %s: unit %s is also described by %s", m.Kind, m.Metadata.Name, unit.UnitName(), other))
+				continue
+			}
+			seen[unit.Path] = m.Metadata.Name
+
+			p, unitErrs := planUnit(unit, byPath, session)
+			for _, err := range unitErrs {
+				errs = append(errs, fmt.Errorf("%s %s: unit %s: %v", m.Kind, m.Metadata.Name, unit.UnitName(), err))
+			}
+			if len(unitErrs) == 0 {
+				p.manifest = m.Metadata.Name
+				plans = append(plans, p)
+			}
+		}
+	}
+	if len(errs) == 0 {
+		final := *existing
+		for _, p := range plans {
+			final = final.WithUnit(*p.unit)
+		}
+		for _, p := range plans {
+			if err := state.ConflictsError(final.ConflictsOf(*p.unit)); err != nil {
+				errs = append(errs, fmt.Errorf("%s: unit %s: %v", p.manifest, p.unit.UnitName(), err))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	changes := make([]state.DesiredChange, 0, len(plans))
+	for _, p := range plans {
+		switch p.action {
+		case ActionCreated:
+			changes = append(changes, state.DesiredChange{Op: state.ChangeCreate, Unit: *p.unit})
+		case ActionUpdated:
+			changes = append(changes, state.DesiredChange{Op: state.ChangeUpdate, Unit: *p.unit})
+		}
+	}
+	if err := session.ApplyDesiredChanges(ctx, changes); err != nil {
+		return make([]Result, 0), []error{err}
+	}
+
+	results := make([]Result, 0, len(plans))
+	for _, p := range plans {
+		unit := p.unit
+		if p.action != ActionUnchanged {
+			unit, changes = &changes[0].Unit, changes[1:]
+		}
+		results = append(results, Result{Manifest: p.manifest, Unit: unit.UnitName(), ID: unit.ID, Action: p.action})
+	}
+	return results, nil
+}
+
+// planUnit validates unit, as described by a manifest, as a new unit or as a change to the existing unit at its path.
+func planUnit(unit state.DesiredSystemdUnit, byPath map[string]state.DesiredSystemdUnit, session *state.SessionLease) (planned, []error) {
+	errs := make([]error, 0)
+	tried := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	var (
+		builder state.DesiredSystemdUnitBuilder
+		before  []byte
+		pin     string
+		action  = ActionCreated
+	)
+	if current, ok := byPath[unit.Path]; ok {
+		before, _ = json.Marshal(&current)
+		if current.Container != nil {
+			pin = current.Container.PinnedImageID
+		}
+		builder = state.ModifyDesiredUnit(&current)
+		action = ActionUpdated
+	} else {
+		builder = state.BuildDesiredUnit()
+		tried(builder.Path(unit.Path))
+	}
+
+	tried(builder.Type(unit.Type))
+	tried(builder.Container(unit.Container.ImageName, unit.Container.ImageTag, unit.Container.Name))
+	tried(builder.Pin(pin))
+	tried(builder.Secrets(unit.Secrets, *session))
+	tried(builder.Volumes(unit.Volumes))
+	tried(builder.Env(unit.Env, *session))
+	tried(builder.Ports(unit.Ports))
+	tried(builder.Schedule(""))
+	tried(builder.Hosts(unit.Hosts))
+	tried(builder.Selector(unit.Selector))
+	tried(builder.App(unit.App, *session))
+	tried(builder.ExtraHosts(unit.ExtraHosts))
+
+	built, err := builder.Build()
+	tried(err)
+	if len(errs) > 0 {
+		return planned{}, errs
+	}
+
+	if action == ActionUpdated {
+		if after, _ := json.Marshal(built); string(after) == string(before) {
+			action = ActionUnchanged
+		}
+	}
+	return planned{unit: built, action: action}, nil
+}
@@ -0,0 +1,379 @@
+// Package manifest reads desired units from a minimal, Kubernetes-style format, so that teams who are used to writing
+// Pods and Deployments for kubectl can describe the coordinator's units the same way. Each container of a manifest
+// becomes one unit.
+package manifest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/smashwilson/az-coordinator/state"
+)
+
+// The kinds of Manifest that are understood.
+const (
+	KindPod        = "Pod"
+	KindDeployment = "Deployment"
+)
+
+// Manifest describes one Pod or Deployment. Only the fields that map onto desired units are accepted; any other field
+// is rejected, rather than silently ignored.
+type Manifest struct {
+	APIVersion string   `json:"apiVersion,omitempty"`
+	Kind       string   `json:"kind"`
+	Metadata   Metadata `json:"metadata"`
+	Spec       Spec     `json:"spec"`
+}
+
+// Metadata names a manifest. Its namespace, if set to anything other than "default", is the app that its units
+// belong to. Labels and annotations are accepted, but have no effect.
+type Metadata struct {
+	Name        string            `json:"name"`
+	Namespace   string            `json:"namespace,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Spec holds the PodSpec of a Pod, or the fields of a Deployment.
+type Spec struct {
+	PodSpec
+
+	Replicas *int         `json:"replicas,omitempty"`
+	Selector *Selector    `json:"selector,omitempty"`
+	Template *PodTemplate `json:"template,omitempty"`
+}
+
+// Selector is the label selector of a Deployment. It's accepted, but has no effect.
+type Selector struct {
+	MatchLabels map[string]string `json:"matchLabels,omitempty"`
+}
+
+// PodTemplate is the Pod that a Deployment runs.
+type PodTemplate struct {
+	Metadata *Metadata `json:"metadata,omitempty"`
+	Spec     PodSpec   `json:"spec"`
+}
+
+// PodSpec lists the containers to run, along with the host settings that they share. NodeName limits the units to one
+// host of the fleet and NodeSelector to hosts with matching labels. A RestartPolicy of Never or OnFailure runs each
+// container once, as a oneshot unit, rather than keeping it running.
+type PodSpec struct {
+	Containers    []Container       `json:"containers,omitempty"`
+	NodeName      string            `json:"nodeName,omitempty"`
+	NodeSelector  map[string]string `json:"nodeSelector,omitempty"`
+	RestartPolicy string            `json:"restartPolicy,omitempty"`
+	Volumes       []Volume          `json:"volumes,omitempty"`
+	HostAliases   []HostAlias       `json:"hostAliases,omitempty"`
+}
+
+// Container is one container of a Pod.
+type Container struct {
+	Name         string          `json:"name"`
+	Image        string          `json:"image"`
+	Env          []EnvVar        `json:"env,omitempty"`
+	Ports        []ContainerPort `json:"ports,omitempty"`
+	VolumeMounts []VolumeMount   `json:"volumeMounts,omitempty"`
+}
+
+// EnvVar sets an environment variable to a Value, or to a secret with ValueFrom.
+type EnvVar struct {
+	Name      string        `json:"name"`
+	Value     string        `json:"value,omitempty"`
+	ValueFrom *EnvVarSource `json:"valueFrom,omitempty"`
+}
+
+// EnvVarSource refers to a secret.
+type EnvVarSource struct {
+	SecretKeyRef *SecretKeySelector `json:"secretKeyRef,omitempty"`
+}
+
+// SecretKeySelector names a secret by its Key. The coordinator's secrets aren't grouped, so Name is accepted, but has
+// no effect.
+type SecretKeySelector struct {
+	Name string `json:"name,omitempty"`
+	Key  string `json:"key"`
+}
+
+// ContainerPort publishes a port of the container on HostPort of the host, or on the same port if HostPort is unset.
+type ContainerPort struct {
+	Name          string `json:"name,omitempty"`
+	ContainerPort int    `json:"containerPort"`
+	HostPort      int    `json:"hostPort,omitempty"`
+	Protocol      string `json:"protocol,omitempty"`
+}
+
+// VolumeMount mounts the Volume with Name at MountPath. Mounts are always read-only.
+type VolumeMount struct {
+	Name      string `json:"name"`
+	MountPath string `json:"mountPath"`
+	ReadOnly  bool   `json:"readOnly,omitempty"`
+}
+
+// Volume is a host directory that containers may mount.
+type Volume struct {
+	Name     string          `json:"name"`
+	HostPath *HostPathVolume `json:"hostPath,omitempty"`
+}
+
+// HostPathVolume is a path on the host.
+type HostPathVolume struct {
+	Path string `json:"path"`
+	Type string `json:"type,omitempty"`
+}
+
+// HostAlias adds entries to the containers' /etc/hosts.
+type HostAlias struct {
+	IP        string   `json:"ip"`
+	Hostnames []string `json:"hostnames"`
+}
+
+// Parse reads manifests from data. YAML may hold several manifests, separated by "---". JSON may hold a single
+// manifest or an array of them.
+func Parse(data []byte) ([]Manifest, error) {
+	trimmed := bytes.TrimSpace(data)
+	if bytes.HasPrefix(trimmed, []byte("[")) {
+		var manifests []Manifest
+		if err := decodeStrict(trimmed, &manifests); err != nil {
+			return nil, err
+		}
+		return manifests, nil
+	}
+	if bytes.HasPrefix(trimmed, []byte("{")) {
+		var m Manifest
+		if err := decodeStrict(trimmed, &m); err != nil {
+			return nil, err
+		}
+		return []Manifest{m}, nil
+	}
+
+	documents, err := decodeYAML(data)
+	if err != nil {
+		return nil, err
+	}
+
+	manifests := make([]Manifest, 0, len(documents))
+	for i, document := range documents {
+		// Documents are decoded through their JSON form, so that the JSON struct tags apply to both formats.
+		raw, err := json.Marshal(document)
+		if err != nil {
+			return nil, fmt.Errorf("document %d: %v", i+1, err)
+		}
+		var m Manifest
+		if err := decodeStrict(raw, &m); err != nil {
+			return nil, fmt.Errorf("document %d: %v", i+1, err)
+		}
+		manifests = append(manifests, m)
+	}
+	return manifests, nil
+}
+
+func decodeStrict(raw []byte, out interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(out)
+}
+
+// namePattern matches the names of manifests and containers, which must be usable in unit and container names.
+var namePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// podSpec finds the PodSpec of a Pod or Deployment, rejecting fields that don't belong to the manifest's kind.
+func (m Manifest) podSpec() (*PodSpec, error) {
+	switch m.Kind {
+	case KindPod:
+		if m.Spec.Replicas != nil || m.Spec.Selector != nil || m.Spec.Template != nil {
+			return nil, errors.New("a Pod may not have replicas, a selector, or a template")
+		}
+		return &m.Spec.PodSpec, nil
+	case KindDeployment:
+		if m.Spec.Template == nil {
+			return nil, errors.New("a Deployment must have a template")
+		}
+		if len(m.Spec.Containers) > 0 || len(m.Spec.Volumes) > 0 || len(m.Spec.NodeName) > 0 ||
+			len(m.Spec.NodeSelector) > 0 || len(m.Spec.RestartPolicy) > 0 || len(m.Spec.HostAliases) > 0 {
+			return nil, errors.New("a Deployment's pod settings belong in its template")
+		}
+		if m.Spec.Replicas != nil && *m.Spec.Replicas != 1 {
+			return nil, fmt.Errorf("replicas must be 1, not %d: each host runs one copy of each unit", *m.Spec.Replicas)
+		}
+		if policy := m.Spec.Template.Spec.RestartPolicy; len(policy) > 0 && policy != "Always" {
+			return nil, fmt.Errorf("a Deployment's restartPolicy must be Always, not %s", policy)
+		}
+		return &m.Spec.Template.Spec, nil
+	case "":
+		return nil, errors.New("missing kind")
+	default:
+		return nil, fmt.Errorf("unsupported kind %s: use %s or %s", m.Kind, KindPod, KindDeployment)
+	}
+}
+
+// Units describes the desired unit of each of the manifest's containers. A manifest with one container becomes a unit
+// named after the manifest, like az-web.service for a manifest named "web". Each container of a manifest with several
+// is named after both, like az-web-proxy.service. The units are not validated; build them with a
+// DesiredSystemdUnitBuilder, as Apply does, to check them.
+func (m Manifest) Units() ([]state.DesiredSystemdUnit, error) {
+	if !namePattern.MatchString(m.Metadata.Name) {
+		return nil, fmt.Errorf("invalid name %q: use lowercase letters, digits, and dashes", m.Metadata.Name)
+	}
+
+	spec, err := m.podSpec()
+	if err != nil {
+		return nil, err
+	}
+	if len(spec.Containers) == 0 {
+		return nil, errors.New("at least one container is required")
+	}
+
+	unitType := state.TypeSimple
+	switch spec.RestartPolicy {
+	case "", "Always":
+	case "OnFailure", "Never":
+		unitType = state.TypeOneShot
+	default:
+		return nil, fmt.Errorf("unsupported restartPolicy %s", spec.RestartPolicy)
+	}
+
+	volumes := make(map[string]string, len(spec.Volumes))
+	for _, volume := range spec.Volumes {
+		if volume.HostPath == nil {
+			return nil, fmt.Errorf("volume %s: only hostPath volumes are supported", volume.Name)
+		}
+		volumes[volume.Name] = volume.HostPath.Path
+	}
+
+	var hosts []string
+	if len(spec.NodeName) > 0 {
+		hosts = []string{spec.NodeName}
+	}
+
+	extraHosts := make(map[string]string)
+	for _, alias := range spec.HostAliases {
+		for _, hostname := range alias.Hostnames {
+			extraHosts[hostname] = alias.IP
+		}
+	}
+
+	app := m.Metadata.Namespace
+	if app == "default" {
+		app = ""
+	}
+
+	units := make([]state.DesiredSystemdUnit, 0, len(spec.Containers))
+	for _, container := range spec.Containers {
+		unit, err := m.containerUnit(container, volumes)
+		if err != nil {
+			return nil, fmt.Errorf("container %s: %v", container.Name, err)
+		}
+		if len(spec.Containers) == 1 {
+			unit.Path = state.UnitDirectory() + unitName(m.Metadata.Name) + ".service"
+		} else {
+			unit.Path = state.UnitDirectory() + unitName(m.Metadata.Name+"-"+container.Name) + ".service"
+		}
+		unit.Container.Name = strings.TrimSuffix(unit.UnitName(), ".service")
+		unit.Type = unitType
+		unit.Hosts = hosts
+		unit.Selector = spec.NodeSelector
+		unit.ExtraHosts = extraHosts
+		unit.App = app
+		units = append(units, *unit)
+	}
+	return units, nil
+}
+
+// unitName prefixes name with the unit prefix, as every desired unit's name must be, unless it's already there.
+func unitName(name string) string {
+	prefix := state.UnitPrefix()
+	if strings.HasPrefix(name, prefix) {
+		return name
+	}
+	return prefix + name
+}
+
+// containerUnit maps the settings of one container onto a unit. volumes gives the host path of each of the pod's
+// volumes, by name.
+func (m Manifest) containerUnit(container Container, volumes map[string]string) (*state.DesiredSystemdUnit, error) {
+	if !namePattern.MatchString(container.Name) {
+		return nil, errors.New("invalid name: use lowercase letters, digits, and dashes")
+	}
+
+	imageName, imageTag, err := splitImage(container.Image)
+	if err != nil {
+		return nil, err
+	}
+
+	unit := &state.DesiredSystemdUnit{
+		Container: &state.DesiredDockerContainer{ImageName: imageName, ImageTag: imageTag},
+		Secrets:   make([]string, 0),
+		Env:       make(map[string]string),
+		Ports:     make(map[int]int),
+		Volumes:   make(map[string]string),
+		Enabled:   true,
+	}
+
+	for _, env := range container.Env {
+		if len(env.Name) == 0 {
+			return nil, errors.New("environment variables must have a name")
+		}
+		if _, ok := unit.Env[env.Name]; ok {
+			return nil, fmt.Errorf("duplicate environment variable %s", env.Name)
+		}
+
+		if env.ValueFrom == nil {
+			unit.Env[env.Name] = env.Value
+			continue
+		}
+		if env.ValueFrom.SecretKeyRef == nil || len(env.Value) > 0 {
+			return nil, fmt.Errorf("environment variable %s: valueFrom must hold a secretKeyRef, and no value", env.Name)
+		}
+		if key := env.ValueFrom.SecretKeyRef.Key; key != env.Name {
+			return nil, fmt.Errorf("secret %s must be provided as the environment variable of the same name, not %s", key, env.Name)
+		}
+		unit.Secrets = append(unit.Secrets, env.Name)
+	}
+
+	for _, port := range container.Ports {
+		if len(port.Protocol) > 0 && port.Protocol != "TCP" {
+			return nil, fmt.Errorf("port %d: only TCP ports may be published", port.ContainerPort)
+		}
+		if port.ContainerPort <= 0 {
+			return nil, errors.New("ports must have a containerPort")
+		}
+		hostPort := port.HostPort
+		if hostPort == 0 {
+			hostPort = port.ContainerPort
+		}
+		if _, ok := unit.Ports[hostPort]; ok {
+			return nil, fmt.Errorf("host port %d is published more than once", hostPort)
+		}
+		unit.Ports[hostPort] = port.ContainerPort
+	}
+
+	for _, mount := range container.VolumeMounts {
+		hostPath, ok := volumes[mount.Name]
+		if !ok {
+			return nil, fmt.Errorf("volume mount %s: no volume has that name", mount.Name)
+		}
+		unit.Volumes[hostPath] = mount.MountPath
+	}
+
+	return unit, nil
+}
+
+// splitImage splits an image reference into its name and tag. References without a tag use "latest".
+func splitImage(image string) (string, string, error) {
+	if len(image) == 0 {
+		return "", "", errors.New("an image is required")
+	}
+	if strings.Contains(image, "@") {
+		return "", "", fmt.Errorf("image %s: refer to images by tag, and pin a unit to run a specific image", image)
+	}
+
+	name, tag := image, "latest"
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		name, tag = image[:i], image[i+1:]
+	}
+	return name, tag, nil
+}
@@ -0,0 +1,542 @@
+package manifest
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The YAML read here is the subset that hand-written manifests use: block mappings and sequences, plain and quoted
+// scalars, single-line flow collections like [80, 443] or {app: web}, literal and folded block scalars, comments, and
+// several documents separated by "---". Anchors, aliases, tags, and multi-line flow collections are rejected.
+
+// yamlLine is one line of a YAML document, with its indentation measured and its trailing comment removed.
+type yamlLine struct {
+	number int
+	indent int
+	text   string
+	raw    string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+// decodeYAML parses each document in data into maps, slices, strings, int64s, float64s, bools, and nils.
+func decodeYAML(data []byte) ([]interface{}, error) {
+	documents := make([]interface{}, 0, 1)
+	current := make([]yamlLine, 0)
+
+	finish := func() error {
+		p := &yamlParser{lines: current}
+		if p.skipBlank() {
+			value, err := p.parseNode(p.lines[p.pos].indent)
+			if err != nil {
+				return err
+			}
+			if p.skipBlank() {
+				return p.errorf("unexpected content")
+			}
+			documents = append(documents, value)
+		}
+		current = make([]yamlLine, 0)
+		return nil
+	}
+
+	for i, raw := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n") {
+		trimmed := strings.TrimRight(raw, " \t")
+		if trimmed == "---" || trimmed == "..." || strings.HasPrefix(trimmed, "--- ") {
+			if err := finish(); err != nil {
+				return nil, err
+			}
+			rest := ""
+			if strings.HasPrefix(trimmed, "--- ") {
+				rest = strings.TrimSpace(trimmed[4:])
+			}
+			if len(rest) > 0 && !strings.HasPrefix(rest, "#") {
+				return nil, fmt.Errorf("line %d: content after a document marker isn't supported", i+1)
+			}
+			continue
+		}
+		if strings.HasPrefix(trimmed, "%") {
+			return nil, fmt.Errorf("line %d: YAML directives aren't supported", i+1)
+		}
+
+		body := strings.TrimLeft(trimmed, " ")
+		if strings.HasPrefix(body, "\t") {
+			return nil, fmt.Errorf("line %d: tabs may not be used for indentation", i+1)
+		}
+		current = append(current, yamlLine{
+			number: i + 1,
+			indent: len(trimmed) - len(body),
+			text:   stripComment(body),
+			raw:    raw,
+		})
+	}
+	if err := finish(); err != nil {
+		return nil, err
+	}
+	return documents, nil
+}
+
+// stripComment removes a comment from the end of a line, leaving "#" characters within quoted strings or plain
+// scalars alone.
+func stripComment(s string) string {
+	var quote rune
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			if i == 0 || s[i-1] == ' ' || strings.ContainsRune("[{,:-", rune(s[i-1])) {
+				quote = r
+			}
+		case r == '#' && (i == 0 || s[i-1] == ' '):
+			return strings.TrimRight(s[:i], " ")
+		}
+	}
+	return s
+}
+
+func (p *yamlParser) errorf(format string, args ...interface{}) error {
+	line := 0
+	if p.pos < len(p.lines) {
+		line = p.lines[p.pos].number
+	} else if len(p.lines) > 0 {
+		line = p.lines[len(p.lines)-1].number
+	}
+	return fmt.Errorf("line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+// skipBlank advances past blank and comment-only lines. It returns false if no lines remain.
+func (p *yamlParser) skipBlank() bool {
+	for p.pos < len(p.lines) && len(p.lines[p.pos].text) == 0 {
+		p.pos++
+	}
+	return p.pos < len(p.lines)
+}
+
+// parseNode parses the collection or scalar that begins at the current line, which is indented by indent.
+func (p *yamlParser) parseNode(indent int) (interface{}, error) {
+	line := p.lines[p.pos]
+	if line.indent != indent {
+		return nil, p.errorf("unexpected indentation")
+	}
+	if isSequenceEntry(line.text) {
+		return p.parseSequence(indent)
+	}
+	if _, _, ok := splitKey(line.text); ok {
+		return p.parseMapping(indent)
+	}
+
+	p.pos++
+	value, err := parseInline(line.text)
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %v", line.number, err)
+	}
+	if p.skipBlank() && p.lines[p.pos].indent > indent {
+		return nil, p.errorf("multi-line scalars must use | or >")
+	}
+	return value, nil
+}
+
+func (p *yamlParser) parseMapping(indent int) (interface{}, error) {
+	mapping := make(map[string]interface{})
+	for p.skipBlank() {
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent {
+			return nil, p.errorf("unexpected indentation")
+		}
+		if isSequenceEntry(line.text) {
+			break
+		}
+
+		rawKey, rest, ok := splitKey(line.text)
+		if !ok {
+			return nil, p.errorf("expected a key and a value, like key: value")
+		}
+		key, err := parseKey(rawKey)
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		if _, exists := mapping[key]; exists {
+			return nil, p.errorf("duplicate key %q", key)
+		}
+
+		p.pos++
+		value, err := p.parseValue(indent, rest, true)
+		if err != nil {
+			return nil, err
+		}
+		mapping[key] = value
+	}
+	return mapping, nil
+}
+
+func (p *yamlParser) parseSequence(indent int) (interface{}, error) {
+	sequence := make([]interface{}, 0)
+	for p.skipBlank() {
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent {
+			return nil, p.errorf("unexpected indentation")
+		}
+		if !isSequenceEntry(line.text) {
+			break
+		}
+
+		rest := strings.TrimLeft(line.text[1:], " ")
+		if len(rest) > 0 && (isSequenceEntry(rest) || isKeyLine(rest)) {
+			// The entry is a collection that begins on the same line as its dash. Reread the line as though the
+			// dash were a space, so that the collection's indentation is where its first entry begins.
+			p.lines[p.pos].indent = indent + len(line.text) - len(rest)
+			p.lines[p.pos].text = rest
+			value, err := p.parseNode(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			sequence = append(sequence, value)
+			continue
+		}
+
+		p.pos++
+		value, err := p.parseValue(indent, rest, false)
+		if err != nil {
+			return nil, err
+		}
+		sequence = append(sequence, value)
+	}
+	return sequence, nil
+}
+
+// parseValue parses the value of a mapping key or sequence entry at indent, given the rest of its line. An empty rest
+// introduces a nested collection on the following lines. Sequences nested within a mapping may share the mapping's
+// indentation.
+func (p *yamlParser) parseValue(indent int, rest string, inMapping bool) (interface{}, error) {
+	if rest == "|" || rest == "|-" || rest == ">" || rest == ">-" {
+		return p.parseBlockScalar(indent, rest), nil
+	}
+	if len(rest) > 0 {
+		value, err := parseInline(rest)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", p.lines[p.pos-1].number, err)
+		}
+		return value, nil
+	}
+
+	if !p.skipBlank() {
+		return nil, nil
+	}
+	next := p.lines[p.pos]
+	if next.indent > indent || (inMapping && next.indent == indent && isSequenceEntry(next.text)) {
+		return p.parseNode(next.indent)
+	}
+	return nil, nil
+}
+
+// parseBlockScalar reads the lines of a literal (|) or folded (>) block scalar, which are indented past indent.
+// Comments and blank lines within it are kept.
+func (p *yamlParser) parseBlockScalar(indent int, style string) string {
+	lines := make([]string, 0)
+	blockIndent := -1
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		body := strings.TrimLeft(line.raw, " ")
+		if len(strings.TrimSpace(body)) == 0 {
+			lines = append(lines, "")
+			p.pos++
+			continue
+		}
+		if line.indent <= indent {
+			break
+		}
+		if blockIndent < 0 {
+			blockIndent = line.indent
+		}
+		if line.indent < blockIndent {
+			break
+		}
+		lines = append(lines, line.raw[blockIndent:])
+		p.pos++
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+		p.pos--
+	}
+
+	var text string
+	if strings.HasPrefix(style, ">") {
+		var b strings.Builder
+		for i, line := range lines {
+			// Each blank line is a line break. Other line breaks between lines of text are folded into spaces.
+			if i > 0 {
+				if line == "" {
+					b.WriteString("\n")
+				} else if lines[i-1] != "" {
+					b.WriteString(" ")
+				}
+			}
+			b.WriteString(line)
+		}
+		text = b.String()
+	} else {
+		text = strings.Join(lines, "\n")
+	}
+	if !strings.HasSuffix(style, "-") && len(lines) > 0 {
+		text += "\n"
+	}
+	return text
+}
+
+func isSequenceEntry(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+func isKeyLine(text string) bool {
+	_, _, ok := splitKey(text)
+	return ok
+}
+
+// splitKey splits a "key: value" line at the colon that ends its key. Colons within quotes, and colons that aren't
+// followed by a space, like those in URLs, don't end the key.
+func splitKey(text string) (string, string, bool) {
+	if len(text) == 0 || strings.ContainsRune("[{", rune(text[0])) {
+		return "", "", false
+	}
+	var quote rune
+	for i, r := range text {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case (r == '"' || r == '\'') && i == 0:
+			quote = r
+		case r == ':' && (i == len(text)-1 || text[i+1] == ' '):
+			return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+func parseKey(raw string) (string, error) {
+	value, err := parseInline(raw)
+	if err != nil {
+		return "", err
+	}
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case nil:
+		return "", fmt.Errorf("invalid key %q", raw)
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+// parseInline parses a flow collection or a scalar that's written on one line.
+func parseInline(text string) (interface{}, error) {
+	if strings.HasPrefix(text, "&") || strings.HasPrefix(text, "*") || strings.HasPrefix(text, "!") {
+		return nil, fmt.Errorf("anchors, aliases, and tags aren't supported: %s", text)
+	}
+	if strings.HasPrefix(text, "[") || strings.HasPrefix(text, "{") {
+		f := &flowParser{text: text}
+		value, err := f.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		f.skipSpace()
+		if f.pos != len(f.text) {
+			return nil, fmt.Errorf("unexpected %q after a flow collection", f.text[f.pos:])
+		}
+		return value, nil
+	}
+	return parseScalar(text)
+}
+
+// parseScalar parses a quoted or plain scalar. Plain scalars are resolved to nulls, bools, and numbers as YAML's core
+// schema does; anything else is a string.
+func parseScalar(text string) (interface{}, error) {
+	if strings.HasPrefix(text, "\"") {
+		if len(text) < 2 || !strings.HasSuffix(text, "\"") {
+			return nil, fmt.Errorf("unterminated string: %s", text)
+		}
+		s, err := strconv.Unquote(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid string: %s", text)
+		}
+		return s, nil
+	}
+	if strings.HasPrefix(text, "'") {
+		if len(text) < 2 || !strings.HasSuffix(text, "'") {
+			return nil, fmt.Errorf("unterminated string: %s", text)
+		}
+		return strings.ReplaceAll(text[1:len(text)-1], "''", "'"), nil
+	}
+
+	switch text {
+	case "", "~", "null", "Null", "NULL":
+		return nil, nil
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	}
+	if n, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return n, nil
+	}
+	if strings.ContainsAny(text, "0123456789") && !strings.ContainsAny(text, "_xXoObB") {
+		if f, err := strconv.ParseFloat(text, 64); err == nil {
+			return f, nil
+		}
+	}
+	return text, nil
+}
+
+// flowParser reads a single-line flow collection, like [a, "b", {c: 1}].
+type flowParser struct {
+	text string
+	pos  int
+}
+
+func (f *flowParser) skipSpace() {
+	for f.pos < len(f.text) && f.text[f.pos] == ' ' {
+		f.pos++
+	}
+}
+
+func (f *flowParser) parseValue() (interface{}, error) {
+	f.skipSpace()
+	if f.pos >= len(f.text) {
+		return nil, fmt.Errorf("unterminated flow collection: %s", f.text)
+	}
+	switch f.text[f.pos] {
+	case '[':
+		return f.parseSequence()
+	case '{':
+		return f.parseMapping()
+	default:
+		return parseScalar(f.scanScalar())
+	}
+}
+
+// scanScalar consumes a quoted scalar, or a plain one up to the next comma or closing bracket.
+func (f *flowParser) scanScalar() string {
+	start := f.pos
+	if quote := f.text[f.pos]; quote == '"' || quote == '\'' {
+		f.pos++
+		for f.pos < len(f.text) {
+			c := f.text[f.pos]
+			if c == '\\' && quote == '"' {
+				f.pos += 2
+				continue
+			}
+			f.pos++
+			if c == quote {
+				if quote == '\'' && f.pos < len(f.text) && f.text[f.pos] == '\'' {
+					f.pos++
+					continue
+				}
+				break
+			}
+		}
+		return f.text[start:f.pos]
+	}
+
+	for f.pos < len(f.text) && !strings.ContainsRune(",]}", rune(f.text[f.pos])) {
+		if f.text[f.pos] == ':' && (f.pos+1 == len(f.text) || f.text[f.pos+1] == ' ') {
+			break
+		}
+		f.pos++
+	}
+	return strings.TrimSpace(f.text[start:f.pos])
+}
+
+func (f *flowParser) parseSequence() (interface{}, error) {
+	f.pos++
+	sequence := make([]interface{}, 0)
+	for {
+		f.skipSpace()
+		if f.pos < len(f.text) && f.text[f.pos] == ']' {
+			f.pos++
+			return sequence, nil
+		}
+		value, err := f.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		sequence = append(sequence, value)
+		if err := f.endEntry(']'); err != nil {
+			return nil, err
+		}
+		if f.text[f.pos-1] == ']' {
+			return sequence, nil
+		}
+	}
+}
+
+func (f *flowParser) parseMapping() (interface{}, error) {
+	f.pos++
+	mapping := make(map[string]interface{})
+	for {
+		f.skipSpace()
+		if f.pos < len(f.text) && f.text[f.pos] == '}' {
+			f.pos++
+			return mapping, nil
+		}
+		if f.pos >= len(f.text) {
+			return nil, fmt.Errorf("unterminated flow collection: %s", f.text)
+		}
+
+		key, err := parseKey(f.scanScalar())
+		if err != nil {
+			return nil, err
+		}
+		f.skipSpace()
+		if f.pos >= len(f.text) || f.text[f.pos] != ':' {
+			return nil, fmt.Errorf("expected a colon after %q in %s", key, f.text)
+		}
+		f.pos++
+		if _, exists := mapping[key]; exists {
+			return nil, fmt.Errorf("duplicate key %q", key)
+		}
+
+		value, err := f.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		mapping[key] = value
+		if err := f.endEntry('}'); err != nil {
+			return nil, err
+		}
+		if f.text[f.pos-1] == '}' {
+			return mapping, nil
+		}
+	}
+}
+
+// endEntry consumes the comma after a flow collection entry, or the bracket that closes the collection.
+func (f *flowParser) endEntry(closing byte) error {
+	f.skipSpace()
+	if f.pos >= len(f.text) {
+		return fmt.Errorf("unterminated flow collection: %s", f.text)
+	}
+	switch f.text[f.pos] {
+	case ',':
+		f.pos++
+		return nil
+	case closing:
+		f.pos++
+		return nil
+	default:
+		return fmt.Errorf("unexpected %q in %s", f.text[f.pos:], f.text)
+	}
+}
@@ -0,0 +1,182 @@
+package manifest
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type m = map[string]interface{}
+type s = []interface{}
+
+func TestDecodeYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want []interface{}
+	}{
+		{
+			name: "block mapping",
+			yaml: "name: web\nreplicas: 1\n",
+			want: s{m{"name": "web", "replicas": int64(1)}},
+		},
+		{
+			name: "nested mappings",
+			yaml: "metadata:\n  name: web\n  labels:\n    app: web\nkind: Pod\n",
+			want: s{m{"metadata": m{"name": "web", "labels": m{"app": "web"}}, "kind": "Pod"}},
+		},
+		{
+			name: "block sequence",
+			yaml: "- one\n- two\n- 3\n",
+			want: s{s{"one", "two", int64(3)}},
+		},
+		{
+			name: "sequence of mappings",
+			yaml: "containers:\n  - name: web\n    image: quay.io/smashwilson/az-web:v1\n  - name: worker\n    image: quay.io/smashwilson/az-worker:v2\n",
+			want: s{m{"containers": s{
+				m{"name": "web", "image": "quay.io/smashwilson/az-web:v1"},
+				m{"name": "worker", "image": "quay.io/smashwilson/az-worker:v2"},
+			}}},
+		},
+		{
+			name: "sequence at its mapping's indentation",
+			yaml: "ports:\n- 80\n- 443\nname: web\n",
+			want: s{m{"ports": s{int64(80), int64(443)}, "name": "web"}},
+		},
+		{
+			name: "nested sequences",
+			yaml: "- - a\n  - b\n- - c\n",
+			want: s{s{s{"a", "b"}, s{"c"}}},
+		},
+		{
+			name: "empty values",
+			yaml: "a:\nb: ~\nc: null\n",
+			want: s{m{"a": nil, "b": nil, "c": nil}},
+		},
+		{
+			name: "plain scalar types",
+			yaml: "int: -12\nfloat: 1.5\nyes: true\nno: False\nversion: 1.2.3\nhex: 0x1F\nword: hello world\n",
+			want: s{m{"int": int64(-12), "float": 1.5, "yes": true, "no": false, "version": "1.2.3", "hex": "0x1F", "word": "hello world"}},
+		},
+		{
+			name: "double-quoted scalars",
+			yaml: "a: \"true\"\nb: \"line\\nbreak\"\nc: \"say \\\"hi\\\"\"\nd: \"# not a comment\"\ne: \"\"\n",
+			want: s{m{"a": "true", "b": "line\nbreak", "c": `say "hi"`, "d": "# not a comment", "e": ""}},
+		},
+		{
+			name: "single-quoted scalars",
+			yaml: "a: '42'\nb: 'it''s'\nc: 'back\\slash'\nd: 'a # b'\n",
+			want: s{m{"a": "42", "b": "it's", "c": `back\slash`, "d": "a # b"}},
+		},
+		{
+			name: "quoted keys",
+			yaml: "\"a: b\": 1\n'c': 2\n",
+			want: s{m{"a: b": int64(1), "c": int64(2)}},
+		},
+		{
+			name: "colons that don't end keys",
+			yaml: "url: https://example.com:8443/path\ntime: 12:30\n",
+			want: s{m{"url": "https://example.com:8443/path", "time": "12:30"}},
+		},
+		{
+			name: "comments",
+			yaml: "# leading comment\nname: web # trailing comment\n\n  # indented comment\ntag: v1#not-a-comment\n",
+			want: s{m{"name": "web", "tag": "v1#not-a-comment"}},
+		},
+		{
+			name: "flow collections",
+			yaml: "ports: [80, \"443\", 8080]\nselector: {app: web, tier: 'front, end'}\nempty: []\nnested: [{a: 1}, [b]]\n",
+			want: s{m{
+				"ports":    s{int64(80), "443", int64(8080)},
+				"selector": m{"app": "web", "tier": "front, end"},
+				"empty":    s{},
+				"nested":   s{m{"a": int64(1)}, s{"b"}},
+			}},
+		},
+		{
+			name: "literal block scalar",
+			yaml: "script: |\n  echo one\n    indented\n\n  # kept\nnext: 1\n",
+			want: s{m{"script": "echo one\n  indented\n\n# kept\n", "next": int64(1)}},
+		},
+		{
+			name: "stripped literal block scalar",
+			yaml: "script: |-\n  echo one\n  echo two\n",
+			want: s{m{"script": "echo one\necho two"}},
+		},
+		{
+			name: "folded block scalar",
+			yaml: "text: >\n  one\n  two\n\n  three\n",
+			want: s{m{"text": "one two\nthree\n"}},
+		},
+		{
+			name: "several documents",
+			yaml: "---\nkind: Pod\n---\n# only a comment\n---\nkind: Deployment\n...\n",
+			want: s{m{"kind": "Pod"}, m{"kind": "Deployment"}},
+		},
+		{
+			name: "windows line endings",
+			yaml: "a: 1\r\nb:\r\n  - c\r\n",
+			want: s{m{"a": int64(1), "b": s{"c"}}},
+		},
+		{
+			name: "empty document",
+			yaml: "# nothing here\n",
+			want: s{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := decodeYAML([]byte(test.yaml))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("decodeYAML(%q)\n got %#v\nwant %#v", test.yaml, got, test.want)
+			}
+		})
+	}
+}
+
+func TestDecodeYAMLErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want string
+	}{
+		{"over-indented key", "a: 1\n  b: 2\n", "line 2: unexpected indentation"},
+		{"over-indented sequence entry", "- a\n   - b\n", "line 2: unexpected indentation"},
+		{"under-indented nested key", "a:\n    b: 1\n  c: 2\n", "line 3: unexpected indentation"},
+		{"tab indentation", "a:\n\tb: 1\n", "line 2: tabs may not be used for indentation"},
+		{"multi-line plain scalar", "one\n  two\n", "line 2: multi-line scalars must use | or >"},
+		{"continued mapping value", "a: one\n  two\n", "line 2: unexpected indentation"},
+		{"line without a key", "a: 1\njust text\n", "line 2: expected a key and a value"},
+		{"duplicate key", "a: 1\na: 2\n", "line 2: duplicate key \"a\""},
+		{"duplicate flow key", "a: {b: 1, b: 2}\n", "duplicate key \"b\""},
+		{"anchor", "a: &anchor 1\n", "line 1: anchors, aliases, and tags aren't supported"},
+		{"alias", "a: *anchor\n", "line 1: anchors, aliases, and tags aren't supported"},
+		{"tag", "a: !!str 1\n", "line 1: anchors, aliases, and tags aren't supported"},
+		{"unterminated double quote", "a: \"open\n", "line 1: unterminated string"},
+		{"unterminated single quote", "a: 'open\n", "line 1: unterminated string"},
+		{"invalid escape", "a: \"\\q\"\n", "line 1: invalid string"},
+		{"unterminated flow sequence", "a: [1, 2\n", "line 1: unterminated flow collection"},
+		{"unterminated flow mapping", "a: {b: 1\n", "line 1: unterminated flow collection"},
+		{"flow mapping without colon", "a: {b}\n", "line 1: expected a colon"},
+		{"content after flow collection", "a: [1] 2\n", "line 1: unexpected"},
+		{"directive", "%YAML 1.2\n---\na: 1\n", "line 1: YAML directives aren't supported"},
+		{"content after document marker", "--- a: 1\n", "line 1: content after a document marker"},
+		{"scalar followed by content", "a\nb: 1\n", "line 2: unexpected content"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := decodeYAML([]byte(test.yaml))
+			if err == nil {
+				t.Fatalf("decodeYAML(%q) succeeded, expected %q", test.yaml, test.want)
+			}
+			if !strings.Contains(err.Error(), test.want) {
+				t.Errorf("decodeYAML(%q) = %q, expected it to contain %q", test.yaml, err.Error(), test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package markers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/config"
+	"github.com/smashwilson/az-coordinator/secrets"
+	"github.com/smashwilson/az-coordinator/state"
+)
+
+const (
+	// requestTimeout limits each request to Grafana or Datadog.
+	requestTimeout = 10 * time.Second
+
+	// maxDatadogText is the longest event text that Datadog accepts.
+	maxDatadogText = 4000
+)
+
+var client = &http.Client{Timeout: requestTimeout}
+
+// marker describes a sync that changed units.
+type marker struct {
+	title string
+	lines []string
+	tags  []string
+	start time.Time
+	end   time.Time
+	err   bool
+}
+
+// ReportSync marks a sync that changed units on each dashboard that's configured in opts. Syncs that weren't applied,
+// or that didn't change any unit, aren't marked.
+func ReportSync(opts config.DeployMarkerOptions, host string, d *state.Delta, errs []error, trigger state.SyncTrigger) {
+	if !opts.Grafana.Enabled() && !opts.Datadog.Enabled() {
+		return
+	}
+	if d == nil || !d.UnitsChanged() || len(d.UnitResults) == 0 {
+		logrus.Debug("No deploy to mark.")
+		return
+	}
+
+	m := newMarker(opts, host, d, errs, trigger)
+	if opts.Grafana.Enabled() {
+		if err := postGrafanaAnnotation(opts.Grafana, m); err != nil {
+			logrus.WithError(err).Warning("Unable to post Grafana annotation.")
+		}
+	}
+	if opts.Datadog.Enabled() {
+		if err := postDatadogEvent(opts.Datadog, m); err != nil {
+			logrus.WithError(err).Warning("Unable to post Datadog event.")
+		}
+	}
+}
+
+// newMarker describes each unit that d added, updated, restarted, or removed, with the image and commit that each
+// added or updated unit now runs. The marker spans the time that it took to apply d, ending now.
+func newMarker(opts config.DeployMarkerOptions, host string, d *state.Delta, errs []error, trigger state.SyncTrigger) marker {
+	m := marker{
+		title: fmt.Sprintf("Deployed to %s", host),
+		tags:  append([]string{"deploy", "host:" + host}, opts.Tags...),
+		end:   time.Now(),
+		err:   len(errs) > 0,
+	}
+	m.start = m.end.Add(-time.Duration(d.ApplyMillis) * time.Millisecond)
+	if m.err {
+		m.title = fmt.Sprintf("Partially deployed to %s", host)
+	}
+
+	describe := func(verb string, unit state.DesiredSystemdUnit) {
+		line := fmt.Sprintf("%s %s", verb, unit.UnitName())
+		if c := unit.Container; c != nil && unit.Type != state.TypeTimer {
+			line += fmt.Sprintf(": %s:%s", c.ImageName, c.ImageTag)
+			if len(c.ImageID) > 0 {
+				line += fmt.Sprintf(" (%s)", shortImageID(c.ImageID))
+			}
+			if len(c.Repository) > 0 && len(c.GitOID) > 0 {
+				line += fmt.Sprintf(" from %s@%s", c.Repository, shortCommit(c.GitOID))
+			}
+		}
+		m.lines = append(m.lines, line)
+		m.tags = append(m.tags, "unit:"+unit.UnitName())
+	}
+	for _, unit := range d.UnitsToAdd {
+		describe("added", unit)
+	}
+	for _, unit := range d.UnitsToChange {
+		describe("updated", unit)
+	}
+	for _, unit := range d.UnitsToRestart {
+		m.lines = append(m.lines, "restarted "+unit.UnitName())
+		m.tags = append(m.tags, "unit:"+unit.UnitName())
+	}
+	for _, unit := range d.UnitsToRemove {
+		m.lines = append(m.lines, "removed "+unit.UnitName())
+		m.tags = append(m.tags, "unit:"+unit.UnitName())
+	}
+
+	m.lines = append(m.lines, fmt.Sprintf("applied in %s", time.Duration(d.ApplyMillis)*time.Millisecond))
+	if len(trigger.Source) > 0 {
+		m.lines = append(m.lines, fmt.Sprintf("triggered by %s", trigger))
+	}
+	for _, result := range d.FailedResults() {
+		m.lines = append(m.lines, fmt.Sprintf("unable to %s %s: %s", result.Action, result.Unit, result.Detail()))
+	}
+	return m
+}
+
+// shortImageID abbreviates an image ID to its first twelve hex digits, as Docker does.
+func shortImageID(id string) string {
+	id = strings.TrimPrefix(id, "sha256:")
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// shortCommit abbreviates a commit to its first seven characters, as GitHub does.
+func shortCommit(oid string) string {
+	if len(oid) > 7 {
+		return oid[:7]
+	}
+	return oid
+}
+
+// postGrafanaAnnotation creates an annotation spanning the marker's time range.
+func postGrafanaAnnotation(opts config.GrafanaOptions, m marker) error {
+	body := map[string]interface{}{
+		"time":    m.start.UnixNano() / int64(time.Millisecond),
+		"timeEnd": m.end.UnixNano() / int64(time.Millisecond),
+		"tags":    m.tags,
+		"text":    m.title + "\n" + strings.Join(m.lines, "\n"),
+	}
+	if len(opts.DashboardUID) > 0 {
+		body["dashboardUID"] = opts.DashboardUID
+	}
+
+	url := strings.TrimSuffix(opts.URL, "/") + "/api/annotations"
+	return post(url, map[string]string{"Authorization": "Bearer " + opts.APIKey}, body)
+}
+
+// postDatadogEvent creates an event at the end of the marker's time range. Events of partial deploys are warnings.
+func postDatadogEvent(opts config.DatadogOptions, m marker) error {
+	text := strings.Join(m.lines, "\n")
+	if len(text) > maxDatadogText {
+		text = text[:maxDatadogText-3] + "..."
+	}
+	alertType := "info"
+	if m.err {
+		alertType = "warning"
+	}
+
+	body := map[string]interface{}{
+		"title":           m.title,
+		"text":            text,
+		"tags":            m.tags,
+		"alert_type":      alertType,
+		"date_happened":   m.end.Unix(),
+		"aggregation_key": "az-coordinator-deploy",
+	}
+	return post(opts.BaseURL()+"/api/v1/events", map[string]string{"DD-API-KEY": opts.APIKey}, body)
+}
+
+// post sends body as JSON with the given headers. Secret values are redacted from it first.
+func post(url string, headers map[string]string, body interface{}) error {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	encoded = []byte(secrets.Redact(string(encoded)))
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(encoded))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		logrus.WithError(err).Warning("Unable to read deploy marker response body")
+	}
+	logrus.Debugf("Received response to deploy marker:\n%s", string(respBody))
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s responded with %s", req.URL.Host, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,312 @@
+package matrix
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/secrets"
+	"github.com/smashwilson/az-coordinator/state"
+)
+
+// Room identifies a Matrix room to send reports to, and the access token of the user that sends them.
+type Room struct {
+	HomeserverURL string
+	RoomID        string
+	AccessToken   string
+}
+
+// maxDiffLength keeps each unit diff to a readable length within a report.
+const maxDiffLength = 2800
+
+// txnCounter distinguishes the messages sent by this process, so that the homeserver doesn't drop any as retries of
+// another.
+var txnCounter int64
+
+// message is an m.room.message event. Body is read by clients without HTML support.
+type message struct {
+	MsgType       string `json:"msgtype"`
+	Body          string `json:"body"`
+	Format        string `json:"format"`
+	FormattedBody string `json:"formatted_body"`
+
+	plain     []string
+	formatted []string
+}
+
+func newMessage(lineCount int) message {
+	return message{
+		MsgType:   "m.notice",
+		Format:    "org.matrix.custom.html",
+		plain:     make([]string, 0, lineCount),
+		formatted: make([]string, 0, lineCount),
+	}
+}
+
+func (m *message) appendLine(prefix, text string) {
+	m.plain = append(m.plain, prefix+text)
+	m.formatted = append(m.formatted, html.EscapeString(prefix+text))
+}
+
+// appendCode adds a line of text with code in the middle of it.
+func (m *message) appendCode(prefix, code, suffix string) {
+	m.plain = append(m.plain, prefix+code+suffix)
+	m.formatted = append(m.formatted, html.EscapeString(prefix)+"<code>"+html.EscapeString(code)+"</code>"+html.EscapeString(suffix))
+}
+
+func (m *message) appendHeading(text string) {
+	m.plain = append(m.plain, text)
+	m.formatted = append(m.formatted, "<strong>"+html.EscapeString(text)+"</strong>")
+}
+
+func (m *message) appendLink(prefix, text, link string) {
+	m.plain = append(m.plain, fmt.Sprintf("%s%s: %s", prefix, text, link))
+	m.formatted = append(m.formatted, fmt.Sprintf(`%s<a href="%s">%s</a>`, html.EscapeString(prefix), html.EscapeString(link), html.EscapeString(text)))
+}
+
+func (m *message) appendContainer(container state.UpdatedContainer) {
+	plain := strings.Builder{}
+	formatted := strings.Builder{}
+	fmt.Fprintf(&plain, "📦 %s: %s", container.Repository, container.GitOID[0:7])
+	fmt.Fprintf(&formatted, `📦 <a href="%s"><strong>%s</strong></a>: <a href="%s"><code>%s</code></a>`,
+		html.EscapeString(container.RepositoryURL()), html.EscapeString(container.Repository),
+		html.EscapeString(container.CommitURL()), container.GitOID[0:7])
+	if container.GitRef != "master" {
+		fmt.Fprintf(&plain, " on %s (%s)", container.GitRef, container.PullRequestURL())
+		fmt.Fprintf(&formatted, ` on <a href="%s"><code>%s</code></a> (<a href="%s">pull request</a>)`,
+			html.EscapeString(container.BranchURL()), html.EscapeString(container.GitRef),
+			html.EscapeString(container.PullRequestURL()))
+	}
+	m.plain = append(m.plain, plain.String())
+	m.formatted = append(m.formatted, formatted.String())
+}
+
+func (m *message) appendUnits(emoji, verb string, unitNames []string) {
+	if len(unitNames) == 0 {
+		return
+	}
+	m.appendCode(emoji+" "+verb+": ", strings.Join(unitNames, ", "), "")
+}
+
+func (m *message) appendDiff(unitName, diff string) {
+	if len(diff) > maxDiffLength {
+		diff = diff[:maxDiffLength] + "\n... (truncated)"
+	}
+	m.plain = append(m.plain, fmt.Sprintf("📄 %s\n%s", unitName, diff))
+	m.formatted = append(m.formatted, fmt.Sprintf(
+		"📄 <code>%s</code><pre><code class=\"language-diff\">%s</code></pre>",
+		html.EscapeString(unitName), html.EscapeString(diff),
+	))
+}
+
+func (m message) render() ([]byte, error) {
+	m.Body = strings.Join(m.plain, "\n")
+	m.FormattedBody = strings.Join(m.formatted, "<br>\n")
+	return json.Marshal(m)
+}
+
+func generateMessage(d *state.Delta, errs []error, trigger state.SyncTrigger, link string) message {
+	var (
+		updatedContainers []state.UpdatedContainer
+		unitDiffs         map[string]string
+	)
+	if d != nil {
+		updatedContainers = d.UpdatedContainers
+		unitDiffs = d.UnitDiffs
+	}
+	deployed := len(updatedContainers) > 0 || len(unitDiffs) > 0 || (d != nil && d.UnitsChanged())
+
+	m := newMessage(len(updatedContainers) + len(unitDiffs) + len(errs) + 8)
+
+	if len(errs) > 0 && deployed {
+		m.appendHeading("⚠️ Partially successful deployment.")
+	} else if deployed {
+		m.appendHeading("♻️ Successful deployment.")
+	} else if len(errs) > 0 {
+		m.appendHeading("🚨 Failed deployment.")
+	}
+
+	if len(trigger.Source) > 0 {
+		m.appendLine("👤 ", "Triggered by "+trigger.String())
+	}
+
+	for _, err := range errs {
+		m.appendLine("❗ ", "Error: "+err.Error())
+	}
+
+	if d != nil && d.UnitsChanged() {
+		added, restarted, removed := d.UnitNames()
+		m.appendUnits("➕", "Added", added)
+		m.appendUnits("🔄", "Restarted", restarted)
+		m.appendUnits("➖", "Removed", removed)
+		m.appendLine("⏱️ ", "Applied in "+(time.Duration(d.ApplyMillis)*time.Millisecond).String()+".")
+	}
+
+	if d != nil {
+		for _, result := range d.FailedResults() {
+			m.appendCode("❌ Unable to "+result.Action+" ", result.Unit, ": "+result.Detail())
+		}
+	}
+
+	if d != nil {
+		for _, h := range d.Health {
+			emoji := "✅ "
+			if !h.Healthy {
+				emoji = "❌ "
+			}
+			m.appendCode(emoji, h.Unit, " is "+h.ActiveState)
+		}
+		for _, f := range d.PullFailures {
+			m.appendCode("📦 Unable to pull ", f.Ref, fmt.Sprintf(" after %d attempts: %s", f.Attempts, f.Error))
+		}
+		for _, g := range d.GatedUnits {
+			m.appendCode("⛔ Held ", g.Unit, fmt.Sprintf(" at its current image. The checks of %s@%s haven't passed: %s", g.Repository, g.ShortCommit(), g.Detail))
+		}
+	}
+
+	for _, container := range updatedContainers {
+		m.appendContainer(container)
+	}
+
+	names := make([]string, 0, len(unitDiffs))
+	for name := range unitDiffs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		m.appendDiff(name, unitDiffs[name])
+	}
+
+	if d != nil && d.Prune != nil {
+		m.appendLine("🧹 ", fmt.Sprintf(
+			"Pruned unused %s docker data: reclaimed %s, disk now %d%% full.",
+			d.Prune.Mode, d.Prune.Reclaimed, d.Prune.DiskUsagePercent,
+		))
+	}
+
+	if len(link) > 0 {
+		m.appendLink("🔗 ", "Sync details", link)
+	}
+
+	return m
+}
+
+func (room Room) send(m message) error {
+	rendered, err := m.render()
+	if err != nil {
+		return err
+	}
+	body := []byte(secrets.Redact(string(rendered)))
+
+	txnID := fmt.Sprintf("az-%d-%d", time.Now().UnixNano(), atomic.AddInt64(&txnCounter, 1))
+	sendURL := fmt.Sprintf(
+		"%s/_matrix/client/r0/rooms/%s/send/m.room.message/%s",
+		strings.TrimSuffix(room.HomeserverURL, "/"), url.PathEscape(room.RoomID), txnID,
+	)
+
+	logrus.Debugf("Sending message to Matrix room:\n%s", string(body))
+
+	req, err := http.NewRequest(http.MethodPut, sendURL, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+room.AccessToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		logrus.WithError(err).Warning("Unable to read Matrix response body")
+	}
+	logrus.Debugf("Received response from Matrix:\n%s", string(respBody))
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Matrix homeserver responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// ReportSync reports the result of a state sync operation to a Matrix room. If link isn't empty, the report links to
+// it for the details of the sync.
+func (room Room) ReportSync(d *state.Delta, errs []error, trigger state.SyncTrigger, link string) {
+	if len(errs) == 0 && (d == nil || (!d.UnitsChanged() && len(d.UpdatedContainers) == 0 && len(d.UnitDiffs) == 0 && d.Prune == nil && len(d.PullFailures) == 0 && len(d.GatedUnits) == 0)) {
+		logrus.Debug("Nothing to report.")
+		return
+	}
+
+	if err := room.send(generateMessage(d, errs, trigger, link)); err != nil {
+		logrus.WithError(err).Warning("Unable to send message to Matrix room.")
+	}
+}
+
+// ReportPendingApproval reports a sync whose Delta is waiting to be approved to a Matrix room.
+func (room Room) ReportPendingApproval(id int, reasons []string, trigger state.SyncTrigger) {
+	m := newMessage(len(reasons) + 2)
+	m.appendHeading("✋ Deployment awaiting approval.")
+	m.appendCode("Approve it with ", fmt.Sprintf("POST /sync/%d/approve", id), ".")
+	if len(trigger.Source) > 0 {
+		m.appendLine("👤 ", "Triggered by "+trigger.String())
+	}
+	for _, reason := range reasons {
+		m.appendLine("⚠️ ", reason)
+	}
+
+	if err := room.send(m); err != nil {
+		logrus.WithError(err).Warning("Unable to send message to Matrix room.")
+	}
+}
+
+// ReportContainerDeath reports a managed container that stopped unexpectedly to the room.
+func (room Room) ReportContainerDeath(d state.ContainerDeath) {
+	m := newMessage(3)
+	m.appendHeading("💀 Container died.")
+	m.appendCode("Container ", d.Container, " of "+d.Unit+" "+d.Cause()+".")
+	if d.Restoring {
+		m.appendLine("♻️ ", "Restarting it with a sync.")
+	}
+
+	if err := room.send(m); err != nil {
+		logrus.WithError(err).Warning("Unable to send message to Matrix room.")
+	}
+}
+
+// ReportDrift reports a change to a managed unit that the coordinator didn't make to the room.
+func (room Room) ReportDrift(e state.DriftEvent) {
+	m := newMessage(2)
+	m.appendHeading("🔍 Unit drifted.")
+	m.appendCode("Unit ", e.Unit, " on "+e.Host+": "+e.Detail+".")
+
+	if err := room.send(m); err != nil {
+		logrus.WithError(err).Warning("Unable to send message to Matrix room.")
+	}
+}
+
+// ReportAlert reports an alert rule that was breached, or that has recovered, to the room.
+func (room Room) ReportAlert(a state.Alert) {
+	m := newMessage(2)
+	if a.Firing {
+		m.appendHeading("🚨 Alert firing.")
+		m.appendCode("Rule ", a.Rule, fmt.Sprintf(" on %s: %s (threshold %d).", a.Host, a.Detail, a.Threshold))
+	} else {
+		m.appendHeading("✅ Alert recovered.")
+		m.appendCode("Rule ", a.Rule, " on "+a.Host+" had reported that "+a.Detail+".")
+	}
+
+	if err := room.send(m); err != nil {
+		logrus.WithError(err).Warning("Unable to send message to Matrix room.")
+	}
+}
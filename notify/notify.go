@@ -0,0 +1,89 @@
+package notify
+
+import (
+	"github.com/smashwilson/az-coordinator/config"
+	"github.com/smashwilson/az-coordinator/discord"
+	"github.com/smashwilson/az-coordinator/markers"
+	"github.com/smashwilson/az-coordinator/matrix"
+	"github.com/smashwilson/az-coordinator/slack"
+	"github.com/smashwilson/az-coordinator/state"
+)
+
+func matrixRoom(opts config.MatrixOptions) matrix.Room {
+	return matrix.Room{
+		HomeserverURL: opts.HomeserverURL,
+		RoomID:        opts.RoomID,
+		AccessToken:   opts.AccessToken,
+	}
+}
+
+// ReportSync reports the result of a state sync operation to each chat service that's configured in opts, and marks
+// it on each dashboard that's configured if it changed units. If link isn't empty, the reports link to it for the
+// details of the sync.
+func ReportSync(opts config.Options, d *state.Delta, errs []error, trigger state.SyncTrigger, link string) {
+	if len(opts.SlackWebhookURL) > 0 {
+		slack.ReportSync(opts.SlackWebhookURL, d, errs, trigger, link)
+	}
+	if len(opts.DiscordWebhookURL) > 0 {
+		discord.ReportSync(opts.DiscordWebhookURL, d, errs, trigger, link)
+	}
+	if opts.Matrix.Enabled() {
+		matrixRoom(opts.Matrix).ReportSync(d, errs, trigger, link)
+	}
+	markers.ReportSync(opts.DeployMarkers, opts.Fleet.Host(), d, errs, trigger)
+}
+
+// ReportPendingApproval reports a sync that's waiting for approval to each chat service that's configured in opts.
+func ReportPendingApproval(opts config.Options, id int, reasons []string, trigger state.SyncTrigger) {
+	if len(opts.SlackWebhookURL) > 0 {
+		slack.ReportPendingApproval(opts.SlackWebhookURL, id, reasons, trigger)
+	}
+	if len(opts.DiscordWebhookURL) > 0 {
+		discord.ReportPendingApproval(opts.DiscordWebhookURL, id, reasons, trigger)
+	}
+	if opts.Matrix.Enabled() {
+		matrixRoom(opts.Matrix).ReportPendingApproval(id, reasons, trigger)
+	}
+}
+
+// ReportContainerDeath reports a managed container that stopped unexpectedly to each chat service that's configured in
+// opts.
+func ReportContainerDeath(opts config.Options, d state.ContainerDeath) {
+	if len(opts.SlackWebhookURL) > 0 {
+		slack.ReportContainerDeath(opts.SlackWebhookURL, d)
+	}
+	if len(opts.DiscordWebhookURL) > 0 {
+		discord.ReportContainerDeath(opts.DiscordWebhookURL, d)
+	}
+	if opts.Matrix.Enabled() {
+		matrixRoom(opts.Matrix).ReportContainerDeath(d)
+	}
+}
+
+// ReportAlert reports an alert rule that was breached, or that has recovered, to each chat service that's configured in
+// opts.
+func ReportAlert(opts config.Options, a state.Alert) {
+	if len(opts.SlackWebhookURL) > 0 {
+		slack.ReportAlert(opts.SlackWebhookURL, a)
+	}
+	if len(opts.DiscordWebhookURL) > 0 {
+		discord.ReportAlert(opts.DiscordWebhookURL, a)
+	}
+	if opts.Matrix.Enabled() {
+		matrixRoom(opts.Matrix).ReportAlert(a)
+	}
+}
+
+// ReportDrift reports a change to a managed unit that the coordinator didn't make to each chat service that's
+// configured in opts.
+func ReportDrift(opts config.Options, e state.DriftEvent) {
+	if len(opts.SlackWebhookURL) > 0 {
+		slack.ReportDrift(opts.SlackWebhookURL, e)
+	}
+	if len(opts.DiscordWebhookURL) > 0 {
+		discord.ReportDrift(opts.DiscordWebhookURL, e)
+	}
+	if opts.Matrix.Enabled() {
+		matrixRoom(opts.Matrix).ReportDrift(e)
+	}
+}
@@ -0,0 +1,376 @@
+package oidc
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // Registers SHA-256 for RS256 and ES256.
+	_ "crypto/sha512" // Registers SHA-384 and SHA-512.
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/config"
+)
+
+// ErrInvalidToken is returned when a bearer token is malformed, has a bad signature, or carries unacceptable claims.
+var ErrInvalidToken = errors.New("invalid bearer token")
+
+const (
+	// clockSkew is the leeway allowed when checking a token's validity period.
+	clockSkew = time.Minute
+
+	// keyCacheTTL is how long signing keys are cached before they're fetched again.
+	keyCacheTTL = time.Hour
+
+	// keyRefreshInterval is the shortest time between fetches prompted by a token signed with an unknown key.
+	keyRefreshInterval = time.Minute
+)
+
+// Verifier checks JSON Web Tokens issued by an OpenID Connect provider.
+type Verifier struct {
+	issuer        string
+	audience      string
+	jwksURL       string
+	usernameClaim string
+	client        *http.Client
+
+	lock      sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+// NewVerifier creates a Verifier that accepts tokens described by opts. Signing keys are fetched lazily.
+func NewVerifier(opts config.OIDCOptions) (*Verifier, error) {
+	if !opts.Enabled() {
+		return nil, errors.New("no OIDC issuer and audience are configured")
+	}
+
+	return &Verifier{
+		issuer:        strings.TrimSuffix(opts.Issuer, "/"),
+		audience:      opts.Audience,
+		jwksURL:       opts.JWKSURL,
+		usernameClaim: opts.UsernameClaim,
+		client:        &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// Claims are the parsed claims of a verified token.
+type Claims map[string]interface{}
+
+// Username identifies the caller that a token was issued to.
+func (v *Verifier) Username(claims Claims) string {
+	candidates := []string{"preferred_username", "email", "sub"}
+	if len(v.usernameClaim) > 0 {
+		candidates = []string{v.usernameClaim}
+	}
+	for _, name := range candidates {
+		if value, ok := claims[name].(string); ok && len(value) > 0 {
+			return value
+		}
+	}
+	return ""
+}
+
+type tokenHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+// Verify checks a compact-serialized JWT's signature against the provider's signing keys, then checks its issuer,
+// audience, and validity period. It returns the token's claims if all checks pass.
+func (v *Verifier) Verify(ctx context.Context, token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	var header tokenHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	key, err := v.key(ctx, header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Algorithm, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	var claims Claims
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if err := v.checkClaims(claims, time.Now()); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func decodeSegment(segment string, into interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, into)
+}
+
+// checkClaims verifies the registered claims of a token whose signature has already been checked.
+func (v *Verifier) checkClaims(claims Claims, now time.Time) error {
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != v.issuer {
+		return fmt.Errorf("%v: unexpected issuer %q", ErrInvalidToken, iss)
+	}
+
+	audienceOK := false
+	switch aud := claims["aud"].(type) {
+	case string:
+		audienceOK = aud == v.audience
+	case []interface{}:
+		for _, each := range aud {
+			if each == v.audience {
+				audienceOK = true
+			}
+		}
+	}
+	if !audienceOK {
+		return fmt.Errorf("%v: audience does not include %q", ErrInvalidToken, v.audience)
+	}
+
+	exp, ok := numericClaim(claims, "exp")
+	if !ok {
+		return fmt.Errorf("%v: no expiration", ErrInvalidToken)
+	}
+	if now.After(time.Unix(exp, 0).Add(clockSkew)) {
+		return fmt.Errorf("%v: expired", ErrInvalidToken)
+	}
+	if nbf, ok := numericClaim(claims, "nbf"); ok && now.Add(clockSkew).Before(time.Unix(nbf, 0)) {
+		return fmt.Errorf("%v: not yet valid", ErrInvalidToken)
+	}
+	return nil
+}
+
+func numericClaim(claims Claims, name string) (int64, bool) {
+	n, ok := claims[name].(json.Number)
+	if !ok {
+		return 0, false
+	}
+	if i, err := n.Int64(); err == nil {
+		return i, true
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return 0, false
+	}
+	return int64(f), true
+}
+
+// verifySignature checks a JWS signature made with one of the RSA or ECDSA algorithms.
+func verifySignature(algorithm string, key crypto.PublicKey, signed, signature []byte) error {
+	var hash crypto.Hash
+	switch algorithm {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("%v: unsupported algorithm %q", ErrInvalidToken, algorithm)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(algorithm, "RS") || rsa.VerifyPKCS1v15(pub, hash, digest, signature) != nil {
+			return ErrInvalidToken
+		}
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(algorithm, "ES") || len(signature) != 2*size {
+			return ErrInvalidToken
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return ErrInvalidToken
+		}
+	default:
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// key returns the signing key with ID kid, fetching the provider's keys if they're stale or if kid is unknown.
+func (v *Verifier) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	age := time.Since(v.fetchedAt)
+	key, known := v.keys[kid]
+	if age < keyCacheTTL && (known || age < keyRefreshInterval) {
+		if !known {
+			return nil, fmt.Errorf("%v: unknown signing key %q", ErrInvalidToken, kid)
+		}
+		return key, nil
+	}
+
+	keys, err := v.fetchKeys(ctx)
+	if err != nil {
+		log.WithError(err).Warn("Unable to fetch OIDC signing keys.")
+		if known {
+			return key, nil
+		}
+		return nil, err
+	}
+	v.keys = keys
+	v.fetchedAt = time.Now()
+
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%v: unknown signing key %q", ErrInvalidToken, kid)
+}
+
+// getJSON fetches url and decodes its JSON body into into.
+func (v *Verifier) getJSON(ctx context.Context, url string, into interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := v.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected status fetching %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(into)
+}
+
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+// fetchKeys downloads the provider's JSON Web Key Set, discovering its location from the issuer if necessary.
+func (v *Verifier) fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	jwksURL := v.jwksURL
+	if len(jwksURL) == 0 {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := v.getJSON(ctx, v.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, err
+		}
+		if len(discovery.JWKSURI) == 0 {
+			return nil, errors.New("OIDC discovery document has no jwks_uri")
+		}
+		jwksURL = discovery.JWKSURI
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := v.getJSON(ctx, jwksURL, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if len(jwk.Use) > 0 && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			log.WithError(err).WithField("kid", jwk.KeyID).Debug("Skipping unusable signing key.")
+			continue
+		}
+		keys[jwk.KeyID] = key
+	}
+	return keys, nil
+}
+
+func decodeBigInt(segment string) (*big.Int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(raw), nil
+}
+
+// publicKey converts an RSA or EC JSON Web Key to a public key.
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("RSA exponent too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("Unsupported curve %q", jwk.Curve)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC point is not on its curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported key type %q", jwk.KeyType)
+	}
+}
@@ -0,0 +1,258 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/smashwilson/az-coordinator/config"
+)
+
+const testAudience = "az-coordinator-ui"
+
+// testProvider serves an OIDC discovery document and a key set with one RSA and one EC signing key, and counts the
+// times that its key set is fetched.
+type testProvider struct {
+	server     *httptest.Server
+	rsaKey     *rsa.PrivateKey
+	ecKey      *ecdsa.PrivateKey
+	keyFetches int32
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testProvider{rsaKey: rsaKey, ecKey: ecKey}
+
+	encode := func(n *big.Int) string { return base64.RawURLEncoding.EncodeToString(n.Bytes()) }
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": p.server.URL, "jwks_uri": p.server.URL + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&p.keyFetches, 1)
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []jsonWebKey{
+			{KeyType: "RSA", KeyID: "rsa", Use: "sig", N: encode(rsaKey.N), E: encode(big.NewInt(int64(rsaKey.E)))},
+			{KeyType: "EC", KeyID: "ec", Curve: "P-256", X: encode(ecKey.X), Y: encode(ecKey.Y)},
+		}})
+	})
+	p.server = httptest.NewServer(mux)
+	return p
+}
+
+func (p *testProvider) verifier(t *testing.T) *Verifier {
+	v, err := NewVerifier(config.OIDCOptions{Issuer: p.server.URL, Audience: testAudience})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func (p *testProvider) fetches() int {
+	return int(atomic.LoadInt32(&p.keyFetches))
+}
+
+// sign produces a compact JWT with the given header and claims. The signature is made with the provider's RSA key for
+// "RS" algorithms and with its EC key for "ES" algorithms, regardless of the key that the header names.
+func (p *testProvider) sign(t *testing.T, header map[string]string, claims map[string]interface{}) string {
+	segment := func(v interface{}) string {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(raw)
+	}
+	signed := segment(header) + "." + segment(claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch {
+	case strings.HasPrefix(header["alg"], "RS"):
+		sig, err := rsa.SignPKCS1v15(rand.Reader, p.rsaKey, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = sig
+	case strings.HasPrefix(header["alg"], "ES"):
+		r, s, err := ecdsa.Sign(rand.Reader, p.ecKey, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		// ES256 signatures are the two 32-byte values, left-padded with zeroes.
+		signature = make([]byte, 64)
+		rb, sb := r.Bytes(), s.Bytes()
+		copy(signature[32-len(rb):32], rb)
+		copy(signature[64-len(sb):], sb)
+	default:
+		signature = []byte("unsigned")
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerify(t *testing.T) {
+	p := newTestProvider(t)
+	defer p.server.Close()
+	v := p.verifier(t)
+
+	now := time.Now()
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":                p.server.URL,
+			"aud":                testAudience,
+			"exp":                now.Add(time.Hour).Unix(),
+			"iat":                now.Unix(),
+			"sub":                "1234",
+			"preferred_username": "ash",
+		}
+		for name, value := range overrides {
+			if value == nil {
+				delete(c, name)
+			} else {
+				c[name] = value
+			}
+		}
+		return c
+	}
+
+	tests := []struct {
+		name   string
+		header map[string]string
+		claims map[string]interface{}
+		valid  bool
+	}{
+		{"RS256", map[string]string{"alg": "RS256", "kid": "rsa"}, claims(nil), true},
+		{"ES256", map[string]string{"alg": "ES256", "kid": "ec"}, claims(nil), true},
+		{"audience list", map[string]string{"alg": "RS256", "kid": "rsa"}, claims(map[string]interface{}{"aud": []string{"other", testAudience}}), true},
+		{"issuer with trailing slash", map[string]string{"alg": "RS256", "kid": "rsa"}, claims(map[string]interface{}{"iss": p.server.URL + "/"}), true},
+		{"within clock skew of expiry", map[string]string{"alg": "RS256", "kid": "rsa"}, claims(map[string]interface{}{"exp": now.Add(-30 * time.Second).Unix()}), true},
+
+		{"alg none", map[string]string{"alg": "none", "kid": "rsa"}, claims(nil), false},
+		{"alg HS256", map[string]string{"alg": "HS256", "kid": "rsa"}, claims(nil), false},
+		{"RS256 with an EC key", map[string]string{"alg": "RS256", "kid": "ec"}, claims(nil), false},
+		{"ES256 with an RSA key", map[string]string{"alg": "ES256", "kid": "rsa"}, claims(nil), false},
+		{"expired", map[string]string{"alg": "RS256", "kid": "rsa"}, claims(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()}), false},
+		{"no expiration", map[string]string{"alg": "RS256", "kid": "rsa"}, claims(map[string]interface{}{"exp": nil}), false},
+		{"not yet valid", map[string]string{"alg": "RS256", "kid": "rsa"}, claims(map[string]interface{}{"nbf": now.Add(time.Hour).Unix()}), false},
+		{"wrong audience", map[string]string{"alg": "RS256", "kid": "rsa"}, claims(map[string]interface{}{"aud": "someone-else"}), false},
+		{"audience list without ours", map[string]string{"alg": "RS256", "kid": "rsa"}, claims(map[string]interface{}{"aud": []string{"a", "b"}}), false},
+		{"wrong issuer", map[string]string{"alg": "RS256", "kid": "rsa"}, claims(map[string]interface{}{"iss": "https://evil.example.com"}), false},
+		{"no issuer", map[string]string{"alg": "RS256", "kid": "rsa"}, claims(map[string]interface{}{"iss": nil}), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := v.Verify(context.Background(), p.sign(t, test.header, test.claims))
+			if test.valid {
+				if err != nil {
+					t.Fatalf("expected a valid token, got %v", err)
+				}
+				if username := v.Username(got); username != "ash" {
+					t.Errorf("Username() = %q, want %q", username, "ash")
+				}
+				return
+			}
+			if err == nil {
+				t.Error("expected the token to be rejected")
+			}
+		})
+	}
+}
+
+func TestVerifyMalformedTokens(t *testing.T) {
+	p := newTestProvider(t)
+	defer p.server.Close()
+	v := p.verifier(t)
+
+	valid := p.sign(t, map[string]string{"alg": "RS256", "kid": "rsa"}, map[string]interface{}{
+		"iss": p.server.URL,
+		"aud": testAudience,
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	parts := strings.Split(valid, ".")
+
+	tampered := map[string]interface{}{"iss": p.server.URL, "aud": testAudience, "exp": time.Now().Add(2 * time.Hour).Unix()}
+	rawTampered, _ := json.Marshal(tampered)
+
+	tokens := map[string]string{
+		"empty":             "",
+		"two segments":      parts[0] + "." + parts[1],
+		"bad header":        "!!!." + parts[1] + "." + parts[2],
+		"bad signature":     parts[0] + "." + parts[1] + ".!!!",
+		"tampered payload":  parts[0] + "." + base64.RawURLEncoding.EncodeToString(rawTampered) + "." + parts[2],
+		"swapped signature": parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString([]byte("not a signature")),
+	}
+	for name, token := range tokens {
+		if _, err := v.Verify(context.Background(), token); err == nil {
+			t.Errorf("%s: expected the token to be rejected", name)
+		}
+	}
+}
+
+func TestUnknownKeyRefreshesAreThrottled(t *testing.T) {
+	p := newTestProvider(t)
+	defer p.server.Close()
+	v := p.verifier(t)
+
+	token := func(kid string) string {
+		return p.sign(t, map[string]string{"alg": "RS256", "kid": kid}, map[string]interface{}{
+			"iss": p.server.URL,
+			"aud": testAudience,
+			"exp": time.Now().Add(time.Hour).Unix(),
+		})
+	}
+
+	if _, err := v.Verify(context.Background(), token("rsa")); err != nil {
+		t.Fatal(err)
+	}
+	if fetches := p.fetches(); fetches != 1 {
+		t.Fatalf("fetched keys %d times for the first token, expected 1", fetches)
+	}
+
+	for i := 0; i < 5; i++ {
+		if _, err := v.Verify(context.Background(), token("unknown")); err == nil {
+			t.Fatal("expected a token signed with an unknown key to be rejected")
+		}
+	}
+	if fetches := p.fetches(); fetches != 1 {
+		t.Errorf("fetched keys %d times within the refresh interval, expected 1", fetches)
+	}
+
+	// Once the refresh interval has passed, an unknown key prompts one more fetch.
+	v.lock.Lock()
+	v.fetchedAt = time.Now().Add(-2 * keyRefreshInterval)
+	v.lock.Unlock()
+
+	for i := 0; i < 3; i++ {
+		v.Verify(context.Background(), token("unknown"))
+	}
+	if fetches := p.fetches(); fetches != 2 {
+		t.Errorf("fetched keys %d times after the refresh interval, expected 2", fetches)
+	}
+
+	// Known keys are served from the cache.
+	if _, err := v.Verify(context.Background(), token("rsa")); err != nil {
+		t.Fatal(err)
+	}
+	if fetches := p.fetches(); fetches != 2 {
+		t.Errorf("fetched keys %d times for a known key, expected 2", fetches)
+	}
+}
@@ -0,0 +1,81 @@
+package retry
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"net"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// attempts is the maximum number of times an operation is tried before its error is returned.
+	attempts = 5
+
+	// initialBackoff is the delay before the second attempt. It doubles after each subsequent failure.
+	initialBackoff = 200 * time.Millisecond
+)
+
+// transientClasses are the PostgreSQL SQLSTATE classes that indicate a failure that may succeed if retried.
+var transientClasses = map[pq.ErrorClass]bool{
+	"08": true, // connection_exception
+	"40": true, // transaction_rollback: serialization failures and deadlocks
+	"53": true, // insufficient_resources: too_many_connections and friends
+	"57": true, // operator_intervention: admin_shutdown, cannot_connect_now
+}
+
+// IsTransient returns true if err is a database error that is likely to succeed if the operation is retried, like
+// a dropped connection or a serialization failure.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if err == driver.ErrBadConn || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+
+	if pqErr, ok := err.(*pq.Error); ok {
+		return transientClasses[pqErr.Code.Class()]
+	}
+
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+
+	return false
+}
+
+// Transient calls fn until it succeeds, returns an error that IsTransient does not recognize, or fails too many
+// times. Retries are separated by an exponentially increasing delay and stop early if ctx is done.
+func Transient(ctx context.Context, fn func() error) error {
+	backoff := initialBackoff
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = fn(); !IsTransient(err) {
+			return err
+		}
+
+		if attempt == attempts {
+			break
+		}
+
+		log.WithError(err).WithFields(log.Fields{
+			"attempt": attempt,
+			"backoff": backoff,
+		}).Warn("Transient database error. Retrying.")
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+
+	return err
+}
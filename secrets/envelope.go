@@ -0,0 +1,70 @@
+package secrets
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+)
+
+// EnvelopeTool names an external program that encrypts secret backups to a recipient's public key.
+type EnvelopeTool string
+
+const (
+	// EnvelopeAge encrypts with age (https://age-encryption.org). Recipients are age public keys like "age1...".
+	EnvelopeAge EnvelopeTool = "age"
+
+	// EnvelopeGPG encrypts with GnuPG. Recipients are key IDs or email addresses present in the caller's keyring.
+	EnvelopeGPG EnvelopeTool = "gpg"
+)
+
+// Seal encrypts plaintext to recipient's public key and writes the result to out. The plaintext is only ever passed
+// to the tool through a pipe.
+func (tool EnvelopeTool) Seal(plaintext []byte, recipient string, out io.Writer) error {
+	var cmd *exec.Cmd
+	switch tool {
+	case EnvelopeAge:
+		cmd = exec.Command("age", "--encrypt", "--recipient", recipient)
+	case EnvelopeGPG:
+		cmd = exec.Command("gpg", "--batch", "--yes", "--encrypt", "--recipient", recipient, "--output", "-")
+	default:
+		return fmt.Errorf("Unrecognized envelope tool: %s", tool)
+	}
+
+	return runEnvelopeTool(cmd, bytes.NewReader(plaintext), out)
+}
+
+// Open decrypts an envelope produced by Seal. Age requires identity, the path to a file containing the recipient's
+// private key; GPG uses the caller's keyring and ignores it.
+func (tool EnvelopeTool) Open(in io.Reader, identity string) ([]byte, error) {
+	var cmd *exec.Cmd
+	switch tool {
+	case EnvelopeAge:
+		if len(identity) == 0 {
+			return nil, fmt.Errorf("An identity file is required to decrypt with age")
+		}
+		cmd = exec.Command("age", "--decrypt", "--identity", identity)
+	case EnvelopeGPG:
+		cmd = exec.Command("gpg", "--batch", "--decrypt")
+	default:
+		return nil, fmt.Errorf("Unrecognized envelope tool: %s", tool)
+	}
+
+	var plaintext bytes.Buffer
+	if err := runEnvelopeTool(cmd, in, &plaintext); err != nil {
+		return nil, err
+	}
+	return plaintext.Bytes(), nil
+}
+
+func runEnvelopeTool(cmd *exec.Cmd, in io.Reader, out io.Writer) error {
+	var stderr bytes.Buffer
+	cmd.Stdin = in
+	cmd.Stdout = out
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed (%v)\n%s", cmd.Args[0], err, stderr.Bytes())
+	}
+	return nil
+}
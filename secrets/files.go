@@ -0,0 +1,195 @@
+package secrets
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/smashwilson/az-coordinator/retry"
+	"github.com/smashwilson/az-coordinator/store"
+)
+
+// Kind determines how a secret is delivered to the units that use it.
+type Kind string
+
+const (
+	// KindEnv secrets are provided to units as environment variables.
+	KindEnv Kind = "env"
+
+	// KindFile secrets are written to a file on the host, which units may then mount as a volume.
+	KindFile Kind = "file"
+)
+
+// FileRoot is the directory beneath which file-kind secrets are written.
+const FileRoot = "/etc/ssl/az"
+
+// defaultFileMode is used for file-kind secrets that don't specify permission bits.
+const defaultFileMode os.FileMode = 0600
+
+// FileDestination describes where on the host a file-kind secret is written.
+type FileDestination struct {
+	Path string      `json:"path"`
+	Mode os.FileMode `json:"mode"`
+}
+
+// DesiredFile is the expected content and permission bits of a file written from a secret.
+type DesiredFile struct {
+	Content []byte
+	Mode    os.FileMode
+}
+
+// loadFileDestinations reads the configured destinations of file-kind secrets.
+func loadFileDestinations(db *store.DB) (map[string]FileDestination, error) {
+	destinations := make(map[string]FileDestination)
+
+	var rows *sql.Rows
+	err := retry.Transient(context.Background(), func() error {
+		var err error
+		rows, err = db.Query("SELECT key, path, mode FROM secret_files")
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key, path string
+		var mode int64
+		if err := rows.Scan(&key, &path, &mode); err != nil {
+			return nil, err
+		}
+		destinations[key] = FileDestination{Path: path, Mode: os.FileMode(mode)}
+	}
+	return destinations, rows.Err()
+}
+
+// Kind reports whether the secret with this key is written to a file or provided as an environment variable.
+func (bag Bag) Kind(key string) Kind {
+	if _, ok := bag.FileDestinations()[key]; ok {
+		return KindFile
+	}
+	return KindEnv
+}
+
+// FileDestinations returns the destination of every file-kind secret, keyed by secret key. The TLS certificate, key,
+// and DH parameters are always written to their well-known paths.
+func (bag Bag) FileDestinations() map[string]FileDestination {
+	destinations := make(map[string]FileDestination, len(tlsKeysToPath)+len(bag.files))
+	for key, path := range tlsKeysToPath {
+		destinations[key] = FileDestination{Path: path, Mode: defaultFileMode}
+	}
+	for key, destination := range bag.files {
+		destinations[key] = destination
+	}
+	return destinations
+}
+
+// SetFileDestination makes the secret with this key a file-kind secret written to destination. The path must be
+// beneath FileRoot and must not already be claimed by another secret. A zero mode defaults to 0600.
+func (bag *Bag) SetFileDestination(key string, destination FileDestination) error {
+	if _, ok := tlsKeysToPath[key]; ok {
+		return fmt.Errorf("The destination of secret [%v] cannot be changed", key)
+	}
+
+	destination.Path = filepath.Clean(destination.Path)
+	if !strings.HasPrefix(destination.Path, FileRoot+"/") {
+		return fmt.Errorf("Secret file path %s is not beneath %s", destination.Path, FileRoot)
+	}
+	if destination.Mode == 0 {
+		destination.Mode = defaultFileMode
+	}
+	if destination.Mode&^os.ModePerm != 0 {
+		return fmt.Errorf("Secret file mode %#o is not a permission mode", destination.Mode)
+	}
+
+	for otherKey, other := range bag.FileDestinations() {
+		if otherKey != key && other.Path == destination.Path {
+			return fmt.Errorf("Secret file path %s is already used by secret [%v]", destination.Path, otherKey)
+		}
+	}
+
+	if bag.files == nil {
+		bag.files = make(map[string]FileDestination)
+	}
+	bag.files[key] = destination
+	return nil
+}
+
+// ClearFileDestination makes the secret with this key an env-kind secret again.
+func (bag *Bag) ClearFileDestination(key string) {
+	delete(bag.files, key)
+}
+
+// SaveFileDestinations replaces the persisted destinations of file-kind secrets with this bag's. The transaction is
+// retried if it fails with a transient database error.
+func (bag Bag) SaveFileDestinations(db *store.DB) error {
+	rows := make([][]interface{}, 0, len(bag.files))
+	for key, destination := range bag.files {
+		rows = append(rows, []interface{}{key, destination.Path, int64(destination.Mode)})
+	}
+
+	return retry.Transient(context.Background(), func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		if err := db.Dialect.Truncate(tx, "secret_files"); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := db.Dialect.BulkInsert(tx, "secret_files", []string{"key", "path", "mode"}, rows); err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// DesiredFiles constructs a map whose keys are paths on the filesystem and whose values are the contents and
+// permissions of the files that file-kind secrets are expected to be written to. An error is returned if any
+// file-kind secret has no value, including any of the required TLS secrets.
+func (bag Bag) DesiredFiles() (map[string]DesiredFile, error) {
+	destinations := bag.FileDestinations()
+	desired := make(map[string]DesiredFile, len(destinations))
+	for key, destination := range destinations {
+		content, err := bag.GetRequired(key)
+		if err != nil {
+			return nil, err
+		}
+		desired[destination.Path] = DesiredFile{Content: []byte(content), Mode: destination.Mode}
+	}
+	return desired, nil
+}
+
+// ActualFiles constructs a map whose keys are paths on the filesystem and whose values are the actual
+// contents of files at those locations on disk. Any file not yet present has a value of nil.
+func ActualFiles(paths []string) (map[string][]byte, error) {
+	actualContents := make(map[string][]byte, len(paths))
+	for _, path := range paths {
+		actual, err := ioutil.ReadFile(path)
+		if err == nil {
+			actualContents[path] = actual
+		} else if os.IsNotExist(err) {
+			actualContents[path] = nil
+		} else {
+			return nil, err
+		}
+	}
+	return actualContents, nil
+}
+
+// FilePaths lists the paths that file-kind secrets are written to.
+func (bag Bag) FilePaths() []string {
+	destinations := bag.FileDestinations()
+	paths := make([]string, 0, len(destinations))
+	for _, destination := range destinations {
+		paths = append(paths, destination.Path)
+	}
+	return paths
+}
@@ -1,25 +1,36 @@
 package secrets
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 
-	"github.com/lib/pq"
 	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/retry"
+	"github.com/smashwilson/az-coordinator/store"
 )
 
 // Bag contains a loaded set of secrets.
 type Bag struct {
 	secrets map[string]string
+
+	// files holds the configured destinations of file-kind secrets other than the built-in TLS files.
+	files map[string]FileDestination
 }
 
 // LoadFromDatabase uses a previously initialized DecoderRing to decrypt all secrets currently stored in the database.
-// Rows that have been corrupted or that are unparseable once decrypted are skipped and logged.
-func LoadFromDatabase(db *sql.DB, ring *DecoderRing) (*Bag, error) {
+// Rows that have been corrupted or that are unparseable once decrypted are skipped and logged. Transient database
+// errors are retried.
+func LoadFromDatabase(db *store.DB, ring *DecoderRing) (*Bag, error) {
 	var bag Bag
 	bag.secrets = make(map[string]string)
 
-	rows, err := db.Query("SELECT key, ciphertext FROM secrets")
+	var rows *sql.Rows
+	err := retry.Transient(context.Background(), func() error {
+		var err error
+		rows, err = db.Query("SELECT key, ciphertext FROM secrets")
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -39,11 +50,38 @@ func LoadFromDatabase(db *sql.DB, ring *DecoderRing) (*Bag, error) {
 		}
 
 		bag.secrets[key] = *plaintext
+		DefaultRedactor.Learn(*plaintext)
 	}
 
+	files, err := loadFileDestinations(db)
+	if err != nil {
+		log.WithError(err).Warn("Unable to load secret file destinations. Only TLS files will be written.")
+		files = make(map[string]FileDestination)
+	}
+	bag.files = files
+
 	return &bag, nil
 }
 
+// NewBag creates a Bag from secrets that have already been decrypted, like those served to agents by a fleet
+// controller. files holds the destinations of file-kind secrets.
+func NewBag(values map[string]string, files map[string]FileDestination) *Bag {
+	bag := Bag{
+		secrets: make(map[string]string, len(values)),
+		files:   make(map[string]FileDestination, len(files)),
+	}
+	for key, value := range values {
+		bag.secrets[key] = value
+		DefaultRedactor.Learn(value)
+	}
+	for key, destination := range files {
+		if _, ok := tlsKeysToPath[key]; !ok {
+			bag.files[key] = destination
+		}
+	}
+	return &bag
+}
+
 // Len returns the number of known secrets.
 func (bag Bag) Len() int {
 	return len(bag.secrets)
@@ -52,11 +90,13 @@ func (bag Bag) Len() int {
 // Set adds a new secret to the bag or overwrites an existing secret with a new value.
 func (bag *Bag) Set(key string, value string) {
 	bag.secrets[key] = value
+	DefaultRedactor.Learn(value)
 }
 
-// Delete removes a key from the secrets bag.
+// Delete removes a key from the secrets bag, along with its file destination if it has one.
 func (bag *Bag) Delete(key string) {
 	delete(bag.secrets, key)
+	delete(bag.files, key)
 }
 
 // Get retrieves an existing secret by key, returning a default value if no secret with this key
@@ -94,8 +134,8 @@ func (bag Bag) Keys() []string {
 
 // SaveToDatabase persists the current state of the bag to an open database connection. Existing secrets
 // are truncated, then this bag's contents are encrypted with the provided DecoderRing and written to the
-// table in their place.
-func (bag Bag) SaveToDatabase(db *sql.DB, ring *DecoderRing, truncate bool) error {
+// table in their place. The transaction is retried if it fails with a transient database error.
+func (bag Bag) SaveToDatabase(db *store.DB, ring *DecoderRing, truncate bool) error {
 	var ciphertexts = make(map[string][]byte, len(bag.secrets))
 	for key, value := range bag.secrets {
 		ciphertext, err := ring.Encrypt(value)
@@ -106,6 +146,12 @@ func (bag Bag) SaveToDatabase(db *sql.DB, ring *DecoderRing, truncate bool) erro
 		ciphertexts[key] = ciphertext
 	}
 
+	return retry.Transient(context.Background(), func() error {
+		return writeCiphertexts(db, ciphertexts, truncate)
+	})
+}
+
+func writeCiphertexts(db *store.DB, ciphertexts map[string][]byte, truncate bool) error {
 	tx, err := db.Begin()
 	if err != nil {
 		return err
@@ -122,22 +168,16 @@ func (bag Bag) SaveToDatabase(db *sql.DB, ring *DecoderRing, truncate bool) erro
 	}()
 
 	if truncate {
-		if _, err = tx.Exec("TRUNCATE TABLE secrets"); err != nil {
+		if err = db.Dialect.Truncate(tx, "secrets"); err != nil {
 			return err
 		}
 	}
 
-	insert, err := tx.Prepare(pq.CopyIn("secrets", "key", "ciphertext"))
-	if err != nil {
-		return err
-	}
-
+	rows := make([][]interface{}, 0, len(ciphertexts))
 	for key, ciphertext := range ciphertexts {
-		if _, err = insert.Exec(key, ciphertext); err != nil {
-			return err
-		}
+		rows = append(rows, []interface{}{key, ciphertext})
 	}
-	if _, err = insert.Exec(); err != nil {
+	if err = db.Dialect.BulkInsert(tx, "secrets", []string{"key", "ciphertext"}, rows); err != nil {
 		return err
 	}
 
@@ -149,3 +189,74 @@ func (bag Bag) SaveToDatabase(db *sql.DB, ring *DecoderRing, truncate bool) erro
 
 	return nil
 }
+
+// MigrateCiphertexts re-encrypts every row that's still stored in the legacy ciphertext format. Rows that can't be
+// decrypted are logged and left untouched. It returns the number of rows that were rewritten and the number that were
+// skipped.
+func MigrateCiphertexts(db *store.DB, ring *DecoderRing) (migrated int, skipped int, err error) {
+	legacy := make(map[string][]byte)
+	err = retry.Transient(context.Background(), func() error {
+		rows, err := db.Query("SELECT key, ciphertext FROM secrets")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var key string
+			var ciphertext []byte
+			if err := rows.Scan(&key, &ciphertext); err != nil {
+				return err
+			}
+			if IsLegacyCiphertext(ciphertext) {
+				legacy[key] = ciphertext
+			}
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	reencrypted := make(map[string][]byte, len(legacy))
+	for key, ciphertext := range legacy {
+		plaintext, err := ring.Decrypt(ciphertext)
+		if err != nil {
+			log.WithError(err).WithField("key", key).Warn("Unable to decrypt legacy ciphertext. Skipping row.")
+			skipped++
+			continue
+		}
+
+		updated, err := ring.Encrypt(*plaintext)
+		if err != nil {
+			log.WithError(err).WithField("key", key).Warn("Unable to re-encrypt secret. Skipping row.")
+			skipped++
+			continue
+		}
+		reencrypted[key] = updated
+	}
+
+	if len(reencrypted) == 0 {
+		return 0, skipped, nil
+	}
+
+	err = retry.Transient(context.Background(), func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		for key, ciphertext := range reencrypted {
+			if _, err := tx.Exec("UPDATE secrets SET ciphertext = $1 WHERE key = $2", ciphertext, key); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return 0, skipped, err
+	}
+
+	return len(reencrypted), skipped, nil
+}
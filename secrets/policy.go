@@ -0,0 +1,148 @@
+package secrets
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Policy constrains the names and values of secrets. The zero Policy accepts any key and value, but near-duplicate
+// keys are always rejected.
+type Policy struct {
+	// KeyPattern, if set, must match each key.
+	KeyPattern *regexp.Regexp
+
+	// RequiredPrefixes, if non-empty, lists the prefixes that each key must begin with one of.
+	RequiredPrefixes []string
+
+	// MaxValueBytes, if positive, limits the length of each value.
+	MaxValueBytes int
+}
+
+// PolicyViolation is returned when proposed secrets break the configured Policy.
+type PolicyViolation struct {
+	Problems []string
+}
+
+func (v *PolicyViolation) Error() string {
+	return fmt.Sprintf("Secrets violate the naming policy: %s", strings.Join(v.Problems, "; "))
+}
+
+var (
+	policyLock    sync.Mutex
+	currentPolicy Policy
+)
+
+// ConfigurePolicy installs the process-wide Policy enforced when secrets are changed.
+func ConfigurePolicy(p Policy) {
+	policyLock.Lock()
+	defer policyLock.Unlock()
+
+	currentPolicy = p
+}
+
+// CurrentPolicy returns the process-wide Policy.
+func CurrentPolicy() Policy {
+	policyLock.Lock()
+	defer policyLock.Unlock()
+
+	return currentPolicy
+}
+
+// keyProblems describes each way in which key breaks the policy.
+func (p Policy) keyProblems(key string) []string {
+	problems := make([]string, 0)
+	if len(key) == 0 {
+		return append(problems, "keys may not be empty")
+	}
+
+	if p.KeyPattern != nil && !p.KeyPattern.MatchString(key) {
+		problems = append(problems, fmt.Sprintf("%s does not match %s", key, p.KeyPattern))
+	}
+
+	if len(p.RequiredPrefixes) > 0 {
+		found := false
+		for _, prefix := range p.RequiredPrefixes {
+			if strings.HasPrefix(key, prefix) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			problems = append(problems, fmt.Sprintf("%s does not begin with one of %s", key, strings.Join(p.RequiredPrefixes, ", ")))
+		}
+	}
+	return problems
+}
+
+// ValidateKeys returns a PolicyViolation if any of keys breaks the policy.
+func (p Policy) ValidateKeys(keys []string) error {
+	problems := make([]string, 0)
+	for _, key := range keys {
+		problems = append(problems, p.keyProblems(key)...)
+	}
+	if len(problems) > 0 {
+		return &PolicyViolation{Problems: problems}
+	}
+	return nil
+}
+
+// normalizeKey reduces a key to a form in which near-duplicates, like "DATABASE_URL" and "DATABASE_URl" or
+// "database-url", compare equal.
+func normalizeKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || r == '-' || r == '.' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(key))
+}
+
+// NearDuplicate returns a key among existing that differs from key only in case or punctuation, if there is one.
+func NearDuplicate(key string, existing []string) (string, bool) {
+	normalized := normalizeKey(key)
+	for _, candidate := range existing {
+		if candidate != key && normalizeKey(candidate) == normalized {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+// ValidateUpdates returns a PolicyViolation if any of the proposed updates would break the current Policy or would
+// create a near-duplicate of a key already in the bag or elsewhere in updates.
+func (bag Bag) ValidateUpdates(updates map[string]string) error {
+	policy := CurrentPolicy()
+
+	keys := make([]string, 0, len(updates))
+	for key := range updates {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	existing := bag.Keys()
+	problems := make([]string, 0)
+	for i, key := range keys {
+		problems = append(problems, policy.keyProblems(key)...)
+
+		if policy.MaxValueBytes > 0 && len(updates[key]) > policy.MaxValueBytes {
+			problems = append(problems, fmt.Sprintf("the value of %s is %d bytes, over the limit of %d", key, len(updates[key]), policy.MaxValueBytes))
+		}
+
+		if bag.Has(key) {
+			continue
+		}
+		if match, ok := NearDuplicate(key, existing); ok {
+			problems = append(problems, fmt.Sprintf("%s is too similar to the existing key %s", key, match))
+		} else if match, ok := NearDuplicate(key, keys[:i]); ok {
+			problems = append(problems, fmt.Sprintf("%s is too similar to %s", key, match))
+		}
+	}
+
+	if len(problems) > 0 {
+		return &PolicyViolation{Problems: problems}
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/unitfile"
+)
+
+// Redacted replaces each secret value that's masked by a Redactor.
+const Redacted = "********"
+
+// minRedactedLength is the length of the shortest value that's masked. Shorter secret values, like port numbers or
+// "true", would mask too much unrelated text.
+const minRedactedLength = 6
+
+// Redactor masks known secret values in strings.
+type Redactor struct {
+	lock     sync.RWMutex
+	values   map[string]bool
+	replacer *strings.Replacer
+}
+
+// DefaultRedactor learns the value of every secret that's loaded into or added to a Bag, so that the values can be
+// masked in logs, API responses, and notifications.
+var DefaultRedactor = &Redactor{}
+
+// Redact masks the secret values known to DefaultRedactor in s.
+func Redact(s string) string {
+	return DefaultRedactor.Redact(s)
+}
+
+// Learn adds values to those masked by this Redactor. Each value is also masked as it's escaped in rendered unit
+// files, as each of those forms appears in JSON strings, and line by line if it spans several lines.
+func (r *Redactor) Learn(values ...string) {
+	forms := make([]string, 0, len(values)*8)
+	for _, value := range values {
+		raw := []string{value, unitfile.Escape(value, true), unitfile.Escape(value, false)}
+		if strings.Contains(value, "\n") {
+			raw = append(raw, strings.Split(value, "\n")...)
+		}
+		for _, form := range raw {
+			forms = append(forms, form)
+			forms = append(forms, jsonForms(form)...)
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.values == nil {
+		r.values = make(map[string]bool)
+	}
+	added := false
+	for _, form := range forms {
+		if len(strings.TrimSpace(form)) >= minRedactedLength && !r.values[form] {
+			r.values[form] = true
+			added = true
+		}
+	}
+	if !added {
+		return
+	}
+
+	// Longer values are replaced first, so that a value that contains another is masked completely.
+	known := make([]string, 0, len(r.values))
+	for value := range r.values {
+		known = append(known, value)
+	}
+	sort.Slice(known, func(i, j int) bool {
+		if len(known[i]) != len(known[j]) {
+			return len(known[i]) > len(known[j])
+		}
+		return known[i] < known[j]
+	})
+	pairs := make([]string, 0, len(known)*2)
+	for _, value := range known {
+		pairs = append(pairs, value, Redacted)
+	}
+	r.replacer = strings.NewReplacer(pairs...)
+}
+
+// jsonForms returns the ways value can appear inside a JSON string: escaped as encoding/json does by default, with
+// "<", ">", and "&" as \u003c, \u003e, and \u0026, and escaped by an encoder that leaves them alone.
+func jsonForms(value string) []string {
+	forms := make([]string, 0, 2)
+	for _, escapeHTML := range []bool{true, false} {
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		encoder.SetEscapeHTML(escapeHTML)
+		if err := encoder.Encode(value); err != nil {
+			continue
+		}
+		encoded := strings.TrimSuffix(buf.String(), "\n")
+		forms = append(forms, encoded[1:len(encoded)-1])
+	}
+	return forms
+}
+
+// Redact masks each known secret value in s.
+func (r *Redactor) Redact(s string) string {
+	r.lock.RLock()
+	replacer := r.replacer
+	r.lock.RUnlock()
+
+	if replacer == nil {
+		return s
+	}
+	return replacer.Replace(s)
+}
+
+// Hook creates a logrus hook that masks known secret values in the message and fields of each entry. Add it to a
+// logger before any hook that sends entries elsewhere.
+func (r *Redactor) Hook() log.Hook {
+	return redactingHook{r}
+}
+
+type redactingHook struct {
+	redactor *Redactor
+}
+
+func (h redactingHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h redactingHook) Fire(entry *log.Entry) error {
+	entry.Message = h.redactor.Redact(entry.Message)
+
+	for key, value := range entry.Data {
+		switch v := value.(type) {
+		case string:
+			entry.Data[key] = h.redactor.Redact(v)
+		case error:
+			if message := v.Error(); h.redactor.Redact(message) != message {
+				entry.Data[key] = errors.New(h.redactor.Redact(message))
+			}
+		default:
+			if formatted := fmt.Sprint(v); h.redactor.Redact(formatted) != formatted {
+				entry.Data[key] = h.redactor.Redact(formatted)
+			}
+		}
+	}
+	return nil
+}
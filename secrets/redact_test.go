@@ -0,0 +1,64 @@
+package secrets
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedactorLearn(t *testing.T) {
+	r := &Redactor{}
+	r.Learn(
+		"hunter2hunter2",
+		`pa"ss\word`,
+		"100% $HOME",
+		"first line\nsecond line",
+		"<tag>&amp;",
+		"short",
+	)
+
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"raw", "token=hunter2hunter2;", "token=********;"},
+		{"raw with quotes", `value: pa"ss\word`, "value: ********"},
+		{"json", `{"value":"pa\"ss\\word"}`, `{"value":"********"}`},
+		{"json escaped html", `{"value":"\u003ctag\u003e\u0026amp;"}`, `{"value":"********"}`},
+		{"json unescaped html", `{"value":"<tag>&amp;"}`, `{"value":"********"}`},
+		{"unit file argument", `"--env=A=pa\"ss\\word" \`, `"--env=A=********" \`},
+		{"unit file environment", `Environment="A=100%% $HOME"`, `Environment="A=********"`},
+		{"unit file command line", `"--env=A=100%% $$HOME" \`, `"--env=A=********" \`},
+		{"unit file newline", `"--env=A=first line\nsecond line" \`, `"--env=A=********" \`},
+		{"unit file in json", `{"content":"\"--env=A=pa\\\"ss\\\\word\""}`, `{"content":"\"--env=A=********\""}`},
+		{"each line", "line: first line", "line: ********"},
+		{"multi-line json", `"first line\nsecond line"`, `"********"`},
+		{"too short", "short", "short"},
+		{"unrelated", "nothing to see", "nothing to see"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := r.Redact(test.text); got != test.want {
+				t.Errorf("Redact(%q) = %q, want %q", test.text, got, test.want)
+			}
+		})
+	}
+}
+
+func TestRedactorMasksLongestValueFirst(t *testing.T) {
+	r := &Redactor{}
+	r.Learn("secret", "secret-longer")
+
+	got := r.Redact("a secret-longer value")
+	if strings.Contains(got, "longer") {
+		t.Errorf("Redact left part of a longer value: %q", got)
+	}
+}
+
+func TestEmptyRedactor(t *testing.T) {
+	r := &Redactor{}
+	if got := r.Redact("hunter2hunter2"); got != "hunter2hunter2" {
+		t.Errorf("Redact(%q) = %q with nothing learned", "hunter2hunter2", got)
+	}
+}
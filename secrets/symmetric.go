@@ -1,15 +1,23 @@
 package secrets
 
 import (
+	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
+	"regexp"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/kms"
+	log "github.com/sirupsen/logrus"
 )
 
 // DecoderRing wraps an AWS key management service (KMS) connection with the logic necessary to accomplish
@@ -17,23 +25,169 @@ import (
 type DecoderRing struct {
 	kmsService  *kms.KMS
 	masterKeyID string
+
+	// keyARN is the ARN of the key that masterKeyID identifies or, if masterKeyID is an alias, that the alias targets.
+	keyARN string
 }
 
-// NewDecoderRing connects to external AWS services.
-func NewDecoderRing(masterKeyID, awsRegion string) (*DecoderRing, error) {
-	session, err := session.NewSession(&aws.Config{
-		Region: &awsRegion,
+// AWSOptions chooses the credentials and endpoints that a DecoderRing uses to reach KMS, and that database backups use
+// to reach S3. Empty fields fall back to the AWS SDK's defaults.
+type AWSOptions struct {
+	// Region is the AWS region that hosts the master key.
+	Region string
+
+	// Profile selects a named profile from the shared AWS credentials and config files.
+	Profile string
+
+	// RoleARN is an IAM role to assume before calling KMS, with ExternalID if the role's trust policy requires one.
+	RoleARN    string
+	ExternalID string
+
+	// KMSEndpoint overrides the URL of the KMS service, for VPC endpoints or KMS-compatible services.
+	KMSEndpoint string
+}
+
+// NewSession creates an AWS session in the region and profile that opts choose, assuming opts.RoleARN if it's set.
+func (opts AWSOptions) NewSession() (*session.Session, error) {
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config: aws.Config{
+			Region: aws.String(opts.Region),
+		},
+		Profile:           opts.Profile,
+		SharedConfigState: session.SharedConfigEnable,
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	kmsService := kms.New(session)
-	return &DecoderRing{kmsService: kmsService, masterKeyID: masterKeyID}, nil
+	if len(opts.RoleARN) > 0 {
+		sess = sess.Copy(aws.NewConfig().WithCredentials(stscreds.NewCredentials(sess, opts.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+			if len(opts.ExternalID) > 0 {
+				p.ExternalID = aws.String(opts.ExternalID)
+			}
+		})))
+	}
+	return sess, nil
+}
+
+// NewDecoderRing connects to external AWS services.
+func NewDecoderRing(masterKeyID string, opts AWSOptions) (*DecoderRing, error) {
+	session, err := opts.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	kmsConfig := aws.NewConfig()
+	if len(opts.KMSEndpoint) > 0 {
+		kmsConfig = kmsConfig.WithEndpoint(opts.KMSEndpoint)
+	}
+
+	kmsService := kms.New(session, kmsConfig)
+	ring := &DecoderRing{kmsService: kmsService, masterKeyID: masterKeyID}
+
+	// Resolve aliases to the key they target, so that multi-region keys can be recognized.
+	described, err := kmsService.DescribeKey(&kms.DescribeKeyInput{KeyId: aws.String(masterKeyID)})
+	if err != nil {
+		log.WithError(err).WithField("keyID", masterKeyID).Warn("Unable to describe master key.")
+	} else if described.KeyMetadata != nil && described.KeyMetadata.Arn != nil {
+		ring.keyARN = *described.KeyMetadata.Arn
+		log.WithField("keyARN", ring.keyARN).Debug("Master key resolved.")
+	}
+
+	return ring, nil
+}
+
+// kmsKeyARNRx matches the ARN of a KMS key, capturing its partition, region, account, and key ID.
+var kmsKeyARNRx = regexp.MustCompile(`arn:(aws[a-z-]*):kms:([a-z0-9-]+):(\d{12}):key/((?:mrk-)?[0-9a-fA-F-]{32,36})`)
+
+// isMultiRegionKey returns true if keyID is the ID or ARN of a multi-region key.
+func isMultiRegionKey(keyID string) bool {
+	m := kmsKeyARNRx.FindStringSubmatch(keyID)
+	if m == nil {
+		return strings.HasPrefix(keyID, "mrk-")
+	}
+	return strings.HasPrefix(m[4], "mrk-")
+}
+
+// decryptDataKey recovers the plaintext of a data key generated by Encrypt. If the master key is a multi-region key,
+// the data key is decrypted with the master key as it's resolved in this ring's region, so that keys encrypted under
+// a replica in another region can be read here. Data keys that the master key can't decrypt, like ones encrypted
+// under a master key that's since been replaced, are decrypted with whichever key KMS finds in the ciphertext.
+func (ring DecoderRing) decryptDataKey(keyCiphertext []byte) ([]byte, error) {
+	if len(ring.keyARN) > 0 && isMultiRegionKey(ring.keyARN) {
+		result, err := ring.kmsService.Decrypt(&kms.DecryptInput{
+			CiphertextBlob: keyCiphertext,
+			KeyId:          aws.String(ring.keyARN),
+		})
+		if err == nil {
+			return result.Plaintext, nil
+		}
+		log.WithError(err).WithField("keyARN", ring.keyARN).Debug("Unable to decrypt data key with the master key.")
+	}
+
+	result, err := ring.kmsService.Decrypt(&kms.DecryptInput{CiphertextBlob: keyCiphertext})
+	if err != nil {
+		return nil, err
+	}
+	return result.Plaintext, nil
+}
+
+// Ciphertexts produced by Encrypt begin with a header that identifies their format:
+//
+//	magic (4 bytes) | version (1 byte) | key blob length (2 bytes, big-endian) | key blob | nonce | sealed message
+//
+// Ciphertexts written before the header was introduced are a 168-byte KMS key blob followed by the nonce and sealed
+// message. KMS key blobs never begin with the magic bytes, so the two formats can be told apart.
+var ciphertextMagic = []byte("azsc")
+
+const (
+	ciphertextVersion1   byte = 1
+	ciphertextHeaderSize      = 4 + 1 + 2
+
+	// legacyKeyBlobSize is the length of the KMS key blob in ciphertexts written without a header.
+	legacyKeyBlobSize = 168
+)
+
+// IsLegacyCiphertext returns true if ciphertext was written in the original, headerless format.
+func IsLegacyCiphertext(ciphertext []byte) bool {
+	return !bytes.HasPrefix(ciphertext, ciphertextMagic)
+}
+
+// splitCiphertext separates ciphertext into the encrypted data key and the nonce and sealed message that follow it.
+func splitCiphertext(ciphertext []byte) (keyCiphertext, payload []byte, err error) {
+	if IsLegacyCiphertext(ciphertext) {
+		if len(ciphertext) < legacyKeyBlobSize {
+			return nil, nil, fmt.Errorf("Ciphertext too short: %d", len(ciphertext))
+		}
+		return ciphertext[:legacyKeyBlobSize], ciphertext[legacyKeyBlobSize:], nil
+	}
+
+	if len(ciphertext) < ciphertextHeaderSize {
+		return nil, nil, fmt.Errorf("Ciphertext too short: %d", len(ciphertext))
+	}
+	if version := ciphertext[len(ciphertextMagic)]; version != ciphertextVersion1 {
+		return nil, nil, fmt.Errorf("Unsupported ciphertext version: %d", version)
+	}
+
+	keyLength := int(binary.BigEndian.Uint16(ciphertext[len(ciphertextMagic)+1 : ciphertextHeaderSize]))
+	if len(ciphertext) < ciphertextHeaderSize+keyLength {
+		return nil, nil, fmt.Errorf("Ciphertext too short: %d", len(ciphertext))
+	}
+	return ciphertext[ciphertextHeaderSize : ciphertextHeaderSize+keyLength], ciphertext[ciphertextHeaderSize+keyLength:], nil
+}
+
+// Probe asks KMS for a data key under the master key and discards it, to check that KMS is reachable and that the
+// coordinator may still use the key. Nothing is encrypted.
+func (ring DecoderRing) Probe(ctx context.Context) error {
+	_, err := ring.kmsService.GenerateDataKeyWithContext(ctx, &kms.GenerateDataKeyInput{
+		KeyId:   aws.String(ring.masterKeyID),
+		KeySpec: aws.String("AES_128"),
+	})
+	return err
 }
 
 // Encrypt uses this DecoderRing's master key to generate a one-time encryption key, encrypt the requested
-// payload with it, and return ciphertext containing the encrypted key and payload.
+// payload with it, and return ciphertext containing a format header, the encrypted key, and the payload.
 func (ring DecoderRing) Encrypt(plaintext string) ([]byte, error) {
 	dataKeyResult, err := ring.kmsService.GenerateDataKey(&kms.GenerateDataKeyInput{
 		KeyId:   aws.String(ring.masterKeyID),
@@ -44,6 +198,9 @@ func (ring DecoderRing) Encrypt(plaintext string) ([]byte, error) {
 	}
 	keyPlaintext := dataKeyResult.Plaintext
 	keyCiphertext := dataKeyResult.CiphertextBlob
+	if len(keyCiphertext) > math.MaxUint16 {
+		return nil, fmt.Errorf("Encrypted data key too long: %d", len(keyCiphertext))
+	}
 
 	messagePlaintext := []byte(plaintext)
 	block, err := aes.NewCipher(keyPlaintext)
@@ -62,25 +219,27 @@ func (ring DecoderRing) Encrypt(plaintext string) ([]byte, error) {
 		return nil, err
 	}
 
+	header := make([]byte, ciphertextHeaderSize, ciphertextHeaderSize+len(keyCiphertext))
+	copy(header, ciphertextMagic)
+	header[len(ciphertextMagic)] = ciphertextVersion1
+	binary.BigEndian.PutUint16(header[len(ciphertextMagic)+1:], uint16(len(keyCiphertext)))
+
 	messageCiphertext := gcm.Seal(nonce, nonce, messagePlaintext, nil)
-	return append(keyCiphertext, messageCiphertext...), nil
+	return append(append(header, keyCiphertext...), messageCiphertext...), nil
 }
 
-// Decrypt accepts ciphertext produced by an equivalent DecoderRing's Encrypt method and recovers the original
-// plaintext.
+// Decrypt accepts ciphertext produced by an equivalent DecoderRing's Encrypt method, in either the current or the
+// legacy format, and recovers the original plaintext.
 func (ring DecoderRing) Decrypt(ciphertext []byte) (*string, error) {
-	if len(ciphertext) < 168 {
-		return nil, fmt.Errorf("Ciphertext too short: %d", len(ciphertext))
+	keyCiphertext, payload, err := splitCiphertext(ciphertext)
+	if err != nil {
+		return nil, err
 	}
 
-	keyCiphertext := ciphertext[:168]
-	decryptResult, err := ring.kmsService.Decrypt(&kms.DecryptInput{
-		CiphertextBlob: keyCiphertext,
-	})
+	keyPlaintext, err := ring.decryptDataKey(keyCiphertext)
 	if err != nil {
 		return nil, err
 	}
-	keyPlaintext := decryptResult.Plaintext
 
 	block, err := aes.NewCipher(keyPlaintext)
 	if err != nil {
@@ -92,12 +251,12 @@ func (ring DecoderRing) Decrypt(ciphertext []byte) (*string, error) {
 		return nil, err
 	}
 
-	if len(ciphertext) < 168+gcm.NonceSize() {
+	if len(payload) < gcm.NonceSize() {
 		return nil, fmt.Errorf("Ciphertext too short: %d", len(ciphertext))
 	}
 
-	nonce := ciphertext[168 : 168+gcm.NonceSize()]
-	messageCiphertext := ciphertext[168+gcm.NonceSize():]
+	nonce := payload[:gcm.NonceSize()]
+	messageCiphertext := payload[gcm.NonceSize():]
 
 	messagePlaintext, err := gcm.Open(nil, nonce, messageCiphertext, nil)
 	if err != nil {
@@ -0,0 +1,252 @@
+package selfupdate
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/config"
+)
+
+// ErrChecksumMismatch is returned when a downloaded binary doesn't match its published checksum.
+var ErrChecksumMismatch = errors.New("downloaded binary does not match its published checksum")
+
+// ErrBadSignature is returned when a downloaded binary isn't signed by the configured public key.
+var ErrBadSignature = errors.New("downloaded binary has an invalid signature")
+
+// Updater replaces the running coordinator binary with the most recent release from a configured location.
+type Updater struct {
+	binaryURL    string
+	checksumURL  string
+	signatureURL string
+	publicKey    ed25519.PublicKey
+	executable   string
+	client       *http.Client
+}
+
+// NewUpdater creates an Updater that downloads releases from the locations in opts and installs them over the
+// currently running executable. The directory that contains the executable must be writable by this process, so that
+// a new release can be moved into place.
+func NewUpdater(opts config.SelfUpdateOptions) (*Updater, error) {
+	if !opts.Enabled() {
+		return nil, errors.New("no self-update url is configured")
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	executable, err = filepath.EvalSymlinks(executable)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &Updater{
+		binaryURL:    opts.URL,
+		checksumURL:  opts.ChecksumURL,
+		signatureURL: opts.SignatureURL,
+		executable:   executable,
+		client:       &http.Client{Timeout: 5 * time.Minute},
+	}
+	if len(u.checksumURL) == 0 {
+		u.checksumURL = opts.URL + ".sha256"
+	}
+	if len(u.signatureURL) == 0 {
+		u.signatureURL = opts.URL + ".sig"
+	}
+
+	key, err := base64.StdEncoding.DecodeString(opts.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode self-update public key: %v", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("Self-update public key must be %d bytes, not %d", ed25519.PublicKeySize, len(key))
+	}
+	u.publicKey = ed25519.PublicKey(key)
+
+	if err := checkWritable(filepath.Dir(executable)); err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// checkWritable verifies that a new binary can be written to dir, which the coordinator's user (usually
+// "coordinator") must be able to write to, rather than discovering that it can't after a release has been downloaded.
+func checkWritable(dir string) error {
+	probe, err := ioutil.TempFile(dir, ".az-coordinator-write-check.")
+	if err != nil {
+		return fmt.Errorf("Unable to self-update: %s isn't writable by this user (%v)", dir, err)
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// Executable returns the path of the binary that will be replaced.
+func (u *Updater) Executable() string {
+	return u.executable
+}
+
+func (u *Updater) fetch(ctx context.Context, url string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := u.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Unable to download %s: %s", url, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func (u *Updater) fetchAll(ctx context.Context, url string) ([]byte, error) {
+	body, err := u.fetch(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return ioutil.ReadAll(io.LimitReader(body, 64*1024))
+}
+
+// publishedChecksum downloads the SHA-256 digest of the latest release. The first field of the first line that
+// names the release binary (or of the only line) is used, so both bare digests and sha256sum output are accepted.
+func (u *Updater) publishedChecksum(ctx context.Context) ([]byte, error) {
+	raw, err := u.fetchAll(ctx, u.checksumURL)
+	if err != nil {
+		return nil, err
+	}
+
+	binaryName := filepath.Base(u.binaryURL)
+	lines := strings.Split(strings.TrimSpace(string(raw)), "\n")
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(lines) == 1 || (len(fields) > 1 && strings.TrimPrefix(fields[1], "*") == binaryName) {
+			return hex.DecodeString(fields[0])
+		}
+	}
+	return nil, fmt.Errorf("No checksum for %s found at %s", binaryName, u.checksumURL)
+}
+
+func (u *Updater) currentChecksum() ([]byte, error) {
+	f, err := os.Open(u.executable)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+func (u *Updater) verifySignature(ctx context.Context, contents []byte) error {
+	signature, err := u.fetchAll(ctx, u.signatureURL)
+	if err != nil {
+		return err
+	}
+	if len(signature) != ed25519.SignatureSize {
+		if signature, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature))); err != nil {
+			return ErrBadSignature
+		}
+	}
+
+	if !ed25519.Verify(u.publicKey, contents, signature) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// Update downloads the published release if it differs from the running binary, verifies its checksum and its
+// signature, and atomically moves it into place. It returns true if the binary was
+// replaced. The running process is unaffected until it's restarted.
+func (u *Updater) Update(ctx context.Context) (bool, error) {
+	published, err := u.publishedChecksum(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	current, err := u.currentChecksum()
+	if err != nil {
+		return false, err
+	}
+	if bytes.Equal(published, current) {
+		log.WithField("checksum", hex.EncodeToString(current)).Debug("Coordinator binary is up to date.")
+		return false, nil
+	}
+
+	log.WithField("url", u.binaryURL).Info("Downloading coordinator binary.")
+	body, err := u.fetch(ctx, u.binaryURL)
+	if err != nil {
+		return false, err
+	}
+	defer body.Close()
+
+	contents, err := ioutil.ReadAll(body)
+	if err != nil {
+		return false, err
+	}
+
+	downloaded := sha256.Sum256(contents)
+	if !bytes.Equal(downloaded[:], published) {
+		return false, ErrChecksumMismatch
+	}
+	if err := u.verifySignature(ctx, contents); err != nil {
+		return false, err
+	}
+
+	// Write to a temporary file in the same directory so the final rename is atomic.
+	tmp, err := ioutil.TempFile(filepath.Dir(u.executable), "."+filepath.Base(u.executable)+".")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Chmod(0755); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+
+	if err := os.Rename(tmp.Name(), u.executable); err != nil {
+		return false, err
+	}
+
+	log.WithFields(log.Fields{
+		"path":     u.executable,
+		"checksum": hex.EncodeToString(published),
+	}).Info("Coordinator binary updated.")
+	return true, nil
+}
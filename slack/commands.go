@@ -0,0 +1,161 @@
+package slack
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/secrets"
+)
+
+// maxRequestAge is the age beyond which signed requests are rejected, so that captured requests can't be replayed.
+const maxRequestAge = 5 * time.Minute
+
+// ActionApproveSync is the action ID of the button that approves a sync waiting for approval. Its value is the sync's
+// ID.
+const ActionApproveSync = "approve_sync"
+
+// VerifyRequest checks the signature that Slack sends with each slash command and interactive request, using the
+// app's signing secret. body is the raw request body.
+func VerifyRequest(signingSecret string, header http.Header, body []byte) error {
+	timestamp := header.Get("X-Slack-Request-Timestamp")
+	signature := header.Get("X-Slack-Signature")
+	if len(timestamp) == 0 || len(signature) == 0 {
+		return errors.New("missing Slack signature headers")
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid Slack request timestamp %q", timestamp)
+	}
+	if age := time.Since(time.Unix(ts, 0)); age > maxRequestAge || age < -maxRequestAge {
+		return errors.New("Slack request timestamp is too far from the current time")
+	}
+
+	mac := hmac.New(sha256.New, []byte(signingSecret))
+	fmt.Fprintf(mac, "v0:%s:", timestamp)
+	mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return errors.New("Slack request signature doesn't match")
+	}
+	return nil
+}
+
+// Command is a request from Slack, either a slash command or a click on an interactive button. Text holds the
+// arguments of a slash command, like "freeze 2h" for "/deploy freeze 2h". A button click is presented as the
+// equivalent command.
+type Command struct {
+	UserID      string
+	UserName    string
+	Text        string
+	ResponseURL string
+
+	// Interactive is true if the command came from a button rather than a slash command.
+	Interactive bool
+}
+
+// Args splits the command's text into words.
+func (c Command) Args() []string {
+	return strings.Fields(c.Text)
+}
+
+type interactionPayload struct {
+	Type string `json:"type"`
+	User struct {
+		ID       string `json:"id"`
+		Username string `json:"username"`
+	} `json:"user"`
+	ResponseURL string `json:"response_url"`
+	Actions     []struct {
+		ActionID string `json:"action_id"`
+		Value    string `json:"value"`
+	} `json:"actions"`
+}
+
+// ParseCommand interprets the form-encoded body of a slash command or interactive request.
+func ParseCommand(body []byte) (*Command, error) {
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+
+	raw := form.Get("payload")
+	if len(raw) == 0 {
+		return &Command{
+			UserID:      form.Get("user_id"),
+			UserName:    form.Get("user_name"),
+			Text:        form.Get("text"),
+			ResponseURL: form.Get("response_url"),
+		}, nil
+	}
+
+	var payload interactionPayload
+	if err := json.Unmarshal([]byte(raw), &payload); err != nil {
+		return nil, err
+	}
+	if payload.Type != "block_actions" || len(payload.Actions) == 0 {
+		return nil, fmt.Errorf("unsupported Slack interaction: %s", payload.Type)
+	}
+
+	action := payload.Actions[0]
+	if action.ActionID != ActionApproveSync {
+		return nil, fmt.Errorf("unrecognized Slack action: %s", action.ActionID)
+	}
+	return &Command{
+		UserID:      payload.User.ID,
+		UserName:    payload.User.Username,
+		Text:        "approve " + action.Value,
+		ResponseURL: payload.ResponseURL,
+		Interactive: true,
+	}, nil
+}
+
+// commandResponse is the message sent back to the channel that a command came from.
+type commandResponse struct {
+	ResponseType    string `json:"response_type"`
+	Text            string `json:"text"`
+	ReplaceOriginal bool   `json:"replace_original"`
+}
+
+// Respond answers a command with a message that's visible to the whole channel. Slash commands are answered in the
+// body of the response to their request. Slack ignores the response body of interactive requests, so their answers
+// are posted to the response URL instead.
+func Respond(w http.ResponseWriter, c Command, text string) {
+	resp := commandResponse{ResponseType: "in_channel", Text: text}
+
+	if c.Interactive {
+		w.WriteHeader(http.StatusOK)
+		if len(c.ResponseURL) == 0 {
+			return
+		}
+		go func() {
+			body, err := json.Marshal(resp)
+			if err != nil {
+				logrus.WithError(err).Warning("Unable to produce Slack response.")
+				return
+			}
+			posted, err := http.Post(c.ResponseURL, "application/json", bytes.NewReader([]byte(secrets.Redact(string(body)))))
+			if err != nil {
+				logrus.WithError(err).Warning("Unable to send Slack response.")
+				return
+			}
+			posted.Body.Close()
+		}()
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&resp)
+}
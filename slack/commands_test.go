@@ -0,0 +1,65 @@
+package slack
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + timestamp + ":"))
+	mac.Write(body)
+	return "v0=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyRequest(t *testing.T) {
+	const secret = "8f742231b10e8888abcd99yyyzzz85a5"
+	body := []byte("token=xyz&team_id=T1&user_id=U012ABCDEF&user_name=ash&command=%2Fdeploy&text=sync")
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-10*time.Minute).Unix(), 10)
+	future := strconv.FormatInt(time.Now().Add(10*time.Minute).Unix(), 10)
+
+	tests := []struct {
+		name      string
+		timestamp string
+		signature string
+		body      []byte
+		valid     bool
+	}{
+		{"valid signature", now, sign(secret, now, body), body, true},
+		{"tampered body", now, sign(secret, now, body), []byte("token=xyz&user_id=U999&command=%2Fdeploy&text=sync"), false},
+		{"wrong secret", now, sign("not-the-secret", now, body), body, false},
+		{"malformed signature", now, "v0=nothex", body, false},
+		{"signature for another timestamp", now, sign(secret, stale, body), body, false},
+		{"stale timestamp", stale, sign(secret, stale, body), body, false},
+		{"future timestamp", future, sign(secret, future, body), body, false},
+		{"non-numeric timestamp", "yesterday", sign(secret, "yesterday", body), body, false},
+		{"missing timestamp", "", sign(secret, now, body), body, false},
+		{"missing signature", now, "", body, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := make(http.Header)
+			if len(test.timestamp) > 0 {
+				header.Set("X-Slack-Request-Timestamp", test.timestamp)
+			}
+			if len(test.signature) > 0 {
+				header.Set("X-Slack-Signature", test.signature)
+			}
+
+			err := VerifyRequest(secret, header, test.body)
+			if test.valid && err != nil {
+				t.Errorf("expected a valid request, got %v", err)
+			}
+			if !test.valid && err == nil {
+				t.Error("expected the request to be rejected")
+			}
+		})
+	}
+}
@@ -6,9 +6,13 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/secrets"
 	"github.com/smashwilson/az-coordinator/state"
 )
 
@@ -51,22 +55,64 @@ func (payload *slackPayload) appendContainerBlock(container state.UpdatedContain
 	payload.appendMarkdownBlock(status.String())
 }
 
+func (payload *slackPayload) appendPruneBlock(result *state.PruneResult) {
+	payload.appendMarkdownBlock(fmt.Sprintf(
+		":broom: Pruned unused %s docker data: reclaimed %s, disk now %d%% full.",
+		result.Mode, result.Reclaimed, result.DiskUsagePercent,
+	))
+}
+
+// maxDiffLength keeps each unit diff within the length that Slack accepts for the text of a section block.
+const maxDiffLength = 2800
+
+func (payload *slackPayload) appendDiffBlock(unitName, diff string) {
+	if len(diff) > maxDiffLength {
+		diff = diff[:maxDiffLength] + "\n... (truncated)"
+	}
+	payload.appendMarkdownBlock(fmt.Sprintf(":page_facing_up: `%s`\n```%s```", unitName, diff))
+}
+
+// appendUnitsBlock lists the units that a sync acted on, if there are any.
+func (payload *slackPayload) appendUnitsBlock(emoji, verb string, unitNames []string) {
+	if len(unitNames) == 0 {
+		return
+	}
+	payload.appendMarkdownBlock(fmt.Sprintf("%s %s: `%s`", emoji, verb, strings.Join(unitNames, "`, `")))
+}
+
+func (payload *slackPayload) appendHealthBlock(health []state.UnitHealth) {
+	lines := make([]string, 0, len(health))
+	for _, h := range health {
+		emoji := ":white_check_mark:"
+		if !h.Healthy {
+			emoji = ":x:"
+		}
+		lines = append(lines, fmt.Sprintf("%s `%s` is %s", emoji, h.Unit, h.ActiveState))
+	}
+	payload.appendMarkdownBlock(strings.Join(lines, "\n"))
+}
+
 func (payload slackPayload) render() ([]byte, error) {
 	return json.Marshal(payload)
 }
 
-func generatePayload(d *state.Delta, errs []error) slackPayload {
-	var updatedContainers []state.UpdatedContainer
+func generatePayload(d *state.Delta, errs []error, trigger state.SyncTrigger, link string) slackPayload {
+	var (
+		updatedContainers []state.UpdatedContainer
+		unitDiffs         map[string]string
+	)
 	if d != nil {
 		updatedContainers = d.UpdatedContainers
+		unitDiffs = d.UnitDiffs
 	}
+	deployed := len(updatedContainers) > 0 || len(unitDiffs) > 0 || (d != nil && d.UnitsChanged())
 
-	payload := newSlackPayload(len(updatedContainers) + len(errs))
+	payload := newSlackPayload(len(updatedContainers) + len(unitDiffs) + len(errs) + 8)
 
-	if len(errs) > 0 && len(updatedContainers) > 0 {
+	if len(errs) > 0 && deployed {
 		payload.appendMarkdownBlock(":warning: *Partially successful deployment.*")
 		payload.Text = "Partially successful deployment."
-	} else if len(updatedContainers) > 0 {
+	} else if deployed {
 		payload.appendMarkdownBlock(":recycle: *Successful deployment.*")
 		payload.Text = "Successful deployment."
 	} else if len(errs) > 0 {
@@ -74,26 +120,78 @@ func generatePayload(d *state.Delta, errs []error) slackPayload {
 		payload.Text = "Failed deployment."
 	}
 
+	if len(trigger.Source) > 0 {
+		payload.appendMarkdownBlock(fmt.Sprintf(":bust_in_silhouette: Triggered by %s", trigger))
+	}
+
 	if len(errs) > 0 {
 		for _, err := range errs {
 			payload.appendErrorBlock(err)
 		}
 	}
 
+	if d != nil && d.UnitsChanged() {
+		added, restarted, removed := d.UnitNames()
+		payload.appendUnitsBlock(":heavy_plus_sign:", "Added", added)
+		payload.appendUnitsBlock(":arrows_counterclockwise:", "Restarted", restarted)
+		payload.appendUnitsBlock(":heavy_minus_sign:", "Removed", removed)
+		payload.appendMarkdownBlock(fmt.Sprintf(":stopwatch: Applied in %s.", time.Duration(d.ApplyMillis)*time.Millisecond))
+	}
+
+	if d != nil {
+		for _, result := range d.FailedResults() {
+			payload.appendMarkdownBlock(fmt.Sprintf(":x: Unable to %s `%s`: %s", result.Action, result.Unit, result.Detail()))
+		}
+	}
+
+	if d != nil && len(d.Health) > 0 {
+		payload.appendHealthBlock(d.Health)
+	}
+
+	if d != nil {
+		for _, f := range d.PullFailures {
+			payload.appendMarkdownBlock(fmt.Sprintf(":package: Unable to pull `%s` after %d attempts: %s", f.Ref, f.Attempts, f.Error))
+		}
+		for _, g := range d.GatedUnits {
+			payload.appendMarkdownBlock(fmt.Sprintf(":no_entry: Held `%s` at its current image. The checks of %s@`%s` haven't passed: %s", g.Unit, g.Repository, g.ShortCommit(), g.Detail))
+		}
+	}
+
 	if len(updatedContainers) > 0 {
 		for _, container := range updatedContainers {
 			payload.appendContainerBlock(container)
 		}
 	}
 
+	names := make([]string, 0, len(unitDiffs))
+	for name := range unitDiffs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		payload.appendDiffBlock(name, unitDiffs[name])
+	}
+
+	if d != nil && d.Prune != nil {
+		payload.appendPruneBlock(d.Prune)
+		if len(payload.Text) == 0 {
+			payload.Text = "Pruned unused docker data."
+		}
+	}
+
+	if len(link) > 0 {
+		payload.appendMarkdownBlock(fmt.Sprintf(":link: <%s|Sync details>", link))
+	}
+
 	return payload
 }
 
 func sendPayload(payload slackPayload, webhookURL string) error {
-	body, err := payload.render()
+	rendered, err := payload.render()
 	if err != nil {
 		return err
 	}
+	body := []byte(secrets.Redact(string(rendered)))
 
 	logrus.Debugf("Sending data to Slack webhook:\n%s", string(body))
 
@@ -110,16 +208,86 @@ func sendPayload(payload slackPayload, webhookURL string) error {
 	return nil
 }
 
-// ReportSync reports the result of a state sync operation to a Slack webhook.
-func ReportSync(webhookURL string, d *state.Delta, errs []error) {
-	if len(errs) == 0 && (d == nil || len(d.UpdatedContainers) == 0) {
+// ReportSync reports the result of a state sync operation to a Slack webhook. If link isn't empty, the report links to
+// it for the details of the sync.
+func ReportSync(webhookURL string, d *state.Delta, errs []error, trigger state.SyncTrigger, link string) {
+	if len(errs) == 0 && (d == nil || (!d.UnitsChanged() && len(d.UpdatedContainers) == 0 && len(d.UnitDiffs) == 0 && d.Prune == nil && len(d.PullFailures) == 0 && len(d.GatedUnits) == 0)) {
 		logrus.Debug("Nothing to report.")
 		return
 	}
 
-	payload := generatePayload(d, errs)
+	payload := generatePayload(d, errs, trigger, link)
 	err := sendPayload(payload, webhookURL)
 	if err != nil {
 		logrus.WithError(err).Warning("Unable to produce payload for Slack webhook.")
 	}
 }
+
+// ReportPendingApproval reports a sync whose Delta is waiting to be approved to a Slack webhook.
+func ReportPendingApproval(webhookURL string, id int, reasons []string, trigger state.SyncTrigger) {
+	payload := newSlackPayload(len(reasons) + 4)
+	payload.appendMarkdownBlock(fmt.Sprintf(":raised_hand: *Deployment awaiting approval.* Approve it with `POST /sync/%d/approve`, `/deploy approve %d`, or the button below.", id, id))
+	payload.Text = "Deployment awaiting approval."
+
+	if len(trigger.Source) > 0 {
+		payload.appendMarkdownBlock(fmt.Sprintf(":bust_in_silhouette: Triggered by %s", trigger))
+	}
+	for _, reason := range reasons {
+		payload.appendMarkdownBlock(fmt.Sprintf(":warning: %s", reason))
+	}
+	payload.Blocks = append(payload.Blocks, jo{
+		"type": "actions",
+		"elements": []jo{{
+			"type":      "button",
+			"text":      jo{"type": "plain_text", "text": "Approve"},
+			"style":     "primary",
+			"action_id": ActionApproveSync,
+			"value":     strconv.Itoa(id),
+		}},
+	})
+
+	if err := sendPayload(payload, webhookURL); err != nil {
+		logrus.WithError(err).Warning("Unable to produce payload for Slack webhook.")
+	}
+}
+
+// ReportContainerDeath reports a managed container that stopped unexpectedly to a Slack webhook.
+func ReportContainerDeath(webhookURL string, d state.ContainerDeath) {
+	payload := newSlackPayload(2)
+	payload.appendMarkdownBlock(fmt.Sprintf(":skull: *Container `%s` of `%s` %s.*", d.Container, d.Unit, d.Cause()))
+	payload.Text = fmt.Sprintf("Container %s %s.", d.Container, d.Cause())
+	if d.Restoring {
+		payload.appendMarkdownBlock(":recycle: Restarting it with a sync.")
+	}
+
+	if err := sendPayload(payload, webhookURL); err != nil {
+		logrus.WithError(err).Warning("Unable to produce payload for Slack webhook.")
+	}
+}
+
+// ReportDrift reports a change to a managed unit that the coordinator didn't make to a Slack webhook.
+func ReportDrift(webhookURL string, e state.DriftEvent) {
+	payload := newSlackPayload(1)
+	payload.appendMarkdownBlock(fmt.Sprintf(":mag: *Unit `%s` drifted on %s:* %s.", e.Unit, e.Host, e.Detail))
+	payload.Text = fmt.Sprintf("Unit %s drifted: %s.", e.Unit, e.Detail)
+
+	if err := sendPayload(payload, webhookURL); err != nil {
+		logrus.WithError(err).Warning("Unable to produce payload for Slack webhook.")
+	}
+}
+
+// ReportAlert reports an alert rule that was breached, or that has recovered, to a Slack webhook.
+func ReportAlert(webhookURL string, a state.Alert) {
+	payload := newSlackPayload(1)
+	if a.Firing {
+		payload.appendMarkdownBlock(fmt.Sprintf(":rotating_light: *Alert `%s` on %s:* %s (threshold %d).", a.Rule, a.Host, a.Detail, a.Threshold))
+		payload.Text = fmt.Sprintf("Alert %s: %s.", a.Rule, a.Detail)
+	} else {
+		payload.appendMarkdownBlock(fmt.Sprintf(":white_check_mark: *Alert `%s` on %s recovered.* It had reported that %s.", a.Rule, a.Host, a.Detail))
+		payload.Text = fmt.Sprintf("Alert %s recovered.", a.Rule)
+	}
+
+	if err := sendPayload(payload, webhookURL); err != nil {
+		logrus.WithError(err).Warning("Unable to produce payload for Slack webhook.")
+	}
+}
@@ -1,14 +1,18 @@
 package state
 
 import (
+	"bytes"
 	"context"
 	"io/ioutil"
+	"os"
 	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
 
 	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/filters"
-	"github.com/docker/docker/client"
 	"github.com/smashwilson/az-coordinator/secrets"
+	"github.com/smashwilson/az-coordinator/tracing"
 )
 
 // ActualState represents a view of SystemD units and files presently on the host as of the time ReadActualState() is called.
@@ -18,6 +22,41 @@ type ActualState struct {
 
 	// Files is a map of paths and content of files that are currently on the filesystem.
 	Files map[string][]byte `json:"-"`
+
+	// Images lists the Docker images present on the host that were built from managed repositories.
+	Images []ActualImage `json:"images"`
+
+	// Containers lists the Docker containers, running or not, that carry the ManagedLabel.
+	Containers []ActualContainer `json:"containers"`
+
+	// UnmanagedImageIDs holds the IDs of the images used by containers, running or not, that don't carry the
+	// ManagedLabel. Those images are never removed as orphans.
+	UnmanagedImageIDs map[string]bool `json:"-"`
+}
+
+// ActualImage is a Docker image that is present on this host.
+type ActualImage struct {
+	ID       string   `json:"id"`
+	RepoTags []string `json:"repo_tags"`
+
+	// GitOID, GitRef, and Repository name the commit that the image was built from, if its labels record it.
+	GitOID     string `json:"git_oid,omitempty"`
+	GitRef     string `json:"git_ref,omitempty"`
+	Repository string `json:"repository,omitempty"`
+}
+
+// ActualContainer is a Docker container that is present on this host.
+type ActualContainer struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Image   string `json:"image"`
+	ImageID string `json:"image_id"`
+	State   string `json:"state"`
+}
+
+// Running returns true if the container's process is still alive.
+func (c ActualContainer) Running() bool {
+	return c.State == "running"
 }
 
 // ActualSystemdUnit is information about a SystemD unit that is currently loaded on this host.
@@ -25,41 +64,116 @@ type ActualSystemdUnit struct {
 	// Path is the path to the source of this unit on disk.
 	Path string `json:"path"`
 
-	// ImageID is the ID of the currently running Docker image.
-	ImageID string `json:"image_id"`
+	// ImageID is the ID of the currently running Docker image, and GitOID, GitRef, and Repository name the commit that
+	// it was built from. They're set by ReadImages.
+	ImageID    string `json:"image_id"`
+	GitOID     string `json:"git_oid,omitempty"`
+	GitRef     string `json:"git_ref,omitempty"`
+	Repository string `json:"repository,omitempty"`
 
 	// Content is the current content of the unit file on disk.
 	Content []byte `json:"-"`
+
+	// Managed is true if the unit file carries the UnitMarker, so it was written by the coordinator. Unit files without
+	// it are only replaced if a desired unit has the same name, and are never removed.
+	Managed bool `json:"managed"`
+
+	// Orphaned is true if the unit file is in the unit directory, but systemd doesn't list it, as happens when the
+	// coordinator crashes between writing a unit file and reloading systemd. Orphaned units aren't stopped or disabled
+	// when they're removed, since systemd doesn't know about them.
+	Orphaned bool `json:"orphaned"`
+
+	// Protected is true if the unit file runs the coordinator itself or carries the ProtectedMarker. Syncs refuse to
+	// remove protected units unless they're forced.
+	Protected bool `json:"protected"`
+}
+
+// UnitMarker is the comment that the coordinator writes into every unit file that it generates.
+const UnitMarker = "# io.azcoordinator.managed=true"
+
+// ProtectedMarker is the comment that the coordinator writes into the unit files of protected units.
+const ProtectedMarker = "# io.azcoordinator.protected=true"
+
+// selfDescription is the Description line that the coordinator writes into its own unit file.
+const selfDescription = "Description=az-coordinator"
+
+// hasUnitMarker returns true if the contents of a unit file include the UnitMarker on a line of its own.
+func hasUnitMarker(content []byte) bool {
+	return hasLine(content, UnitMarker)
+}
+
+// isProtectedUnit returns true if the contents of a unit file show that it runs the coordinator, or that it was
+// written for a protected unit.
+func isProtectedUnit(content []byte) bool {
+	return hasLine(content, ProtectedMarker) || hasLine(content, selfDescription)
+}
+
+// hasLine returns true if content includes want on a line of its own.
+func hasLine(content []byte, want string) bool {
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		if string(bytes.TrimSpace(line)) == want {
+			return true
+		}
+	}
+	return false
 }
 
 // ReadActualState introspects SystemD and the filesystem to construct an ActualState instance that captures a
 // snapshot of the aspects of the host state that we care about managing.
-func (session SessionLease) ReadActualState() (*ActualState, error) {
+func (session SessionLease) ReadActualState(ctx context.Context) (_ *ActualState, err error) {
+	ctx, span := tracing.Start(ctx, "ReadActualState")
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+
 	var (
 		conn = session.conn
 		log  = session.Log
 	)
 
-	listedUnits, err := conn.ListUnitFilesByPatterns(nil, []string{"az*"})
+	listedUnits, err := conn.ListUnitFilesByPatterns(nil, unitFilePatterns())
 	if err != nil {
 		return nil, err
 	}
 
 	units := make([]ActualSystemdUnit, 0, len(listedUnits))
+	listedNames := make(map[string]bool, len(listedUnits))
 	for _, listedUnit := range listedUnits {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		content, readErr := ioutil.ReadFile(listedUnit.Path)
 		if readErr != nil {
 			log.WithError(readErr).WithField("path", listedUnit.Path).Warn("Unable to read unit file contents.")
 			content = nil
 		}
 
+		listedNames[path.Base(listedUnit.Path)] = true
 		units = append(units, ActualSystemdUnit{
-			Path:    listedUnit.Path,
-			Content: content,
+			Path:      listedUnit.Path,
+			Content:   content,
+			Managed:   hasUnitMarker(content),
+			Protected: isProtectedUnit(content),
 		})
 	}
 
-	files, err := secrets.ActualTLSFiles()
+	orphans, err := readOrphanedUnits(listedNames)
+	if err != nil {
+		return nil, err
+	}
+	for _, orphan := range orphans {
+		log.WithField("path", orphan.Path).Debug("Unit file isn't listed by systemd.")
+	}
+	units = append(units, orphans...)
+
+	bag, err := session.GetSecrets()
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := secrets.ActualFiles(bag.FilePaths())
 	if err != nil {
 		return nil, err
 	}
@@ -67,60 +181,157 @@ func (session SessionLease) ReadActualState() (*ActualState, error) {
 	return &ActualState{Units: units, Files: files}, nil
 }
 
-// ReadImages loads ImageIDs where possible by querying pre-pulled Docker images.
-func (state *ActualState) ReadImages(session *SessionLease, desired DesiredState) []error {
+// readOrphanedUnits finds the unit files in the unit directory that begin with the unit prefix, but whose names
+// aren't in listedNames.
+func readOrphanedUnits(listedNames map[string]bool) ([]ActualSystemdUnit, error) {
+	paths, err := filepath.Glob(filepath.Join(UnitDirectory(), UnitPrefix()+"*"))
+	if err != nil {
+		return nil, err
+	}
+
+	orphans := make([]ActualSystemdUnit, 0)
+	for _, unitPath := range paths {
+		if listedNames[filepath.Base(unitPath)] {
+			continue
+		}
+
+		info, err := os.Stat(unitPath)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		content, err := ioutil.ReadFile(unitPath)
+		if err != nil {
+			return nil, err
+		}
+
+		orphans = append(orphans, ActualSystemdUnit{
+			Path:      unitPath,
+			Content:   content,
+			Managed:   hasUnitMarker(content),
+			Orphaned:  true,
+			Protected: isProtectedUnit(content),
+		})
+	}
+	return orphans, nil
+}
+
+// ReadImages loads ImageIDs where possible by querying pre-pulled Docker images. It also inventories the managed
+// images and containers present on the host, so that orphans can be found, and labels each unit with the commit that
+// its image was built from.
+func (state *ActualState) ReadImages(ctx context.Context, session *SessionLease, desired DesiredState) []error {
 	var (
 		desiredByName = make(map[string]DesiredSystemdUnit)
 		errs          = make([]error, 0)
 	)
 
-	for _, unit := range desired.Units {
+	for _, unit := range desired.managedUnits() {
 		desiredByName[unit.UnitName()] = unit
 	}
 
 	for i := range state.Units {
 		actual := &state.Units[i]
 		if desired, ok := desiredByName[actual.UnitName()]; ok {
-			if desired.Container == nil {
+			if desired.Container == nil || desired.Type == TypeTimer {
 				continue
 			}
 
-			if len(desired.Container.Name) > 0 {
-				// Load the image ID associated with a running container.
-				container, err := session.cli.ContainerInspect(context.Background(), desired.Container.Name)
-				if client.IsErrNotFound(err) {
-					// The container isn't running. Fall back to an image query, because that's the image that will be used
-					// the next time this container starts anyway.
-				} else if err != nil {
-					errs = append(errs, err)
-					continue
-				} else {
-					actual.ImageID = container.Image
-					continue
-				}
-			}
-
-			imageSummaries, err := session.cli.ImageList(context.Background(), types.ImageListOptions{
-				Filters: filters.NewArgs(filters.Arg("reference", desired.Container.ImageName+":"+desired.Container.ImageTag)),
-			})
+			id, err := session.CurrentImageID(ctx, *desired.Container)
 			if err != nil {
 				errs = append(errs, err)
 				continue
 			}
+			actual.ImageID = id
+		}
+	}
 
-			var highest int64
-			for _, imageSummary := range imageSummaries {
-				if imageSummary.Created > highest {
-					actual.ImageID = imageSummary.ID
-					highest = imageSummary.Created
-				}
-			}
+	if err := state.readDockerInventory(ctx, session); err != nil {
+		errs = append(errs, err)
+	}
+
+	imagesByID := make(map[string]ActualImage, len(state.Images))
+	for _, image := range state.Images {
+		imagesByID[image.ID] = image
+	}
+	for i := range state.Units {
+		actual := &state.Units[i]
+		if image, ok := imagesByID[actual.ImageID]; ok {
+			actual.GitOID, actual.GitRef, actual.Repository = image.GitOID, image.GitRef, image.Repository
 		}
 	}
 
 	return errs
 }
 
+func (state *ActualState) readDockerInventory(ctx context.Context, session *SessionLease) error {
+	imageSummaries, err := session.cli.ImageList(ctx, types.ImageListOptions{})
+	if err != nil {
+		return err
+	}
+
+	state.Images = make([]ActualImage, 0, len(imageSummaries))
+	for _, imageSummary := range imageSummaries {
+		// Dangling images left behind by a pull have no tags, but still have a digest from their repository.
+		managed := false
+		for _, refs := range [][]string{imageSummary.RepoTags, imageSummary.RepoDigests} {
+			for _, ref := range refs {
+				managed = managed || isManagedImageName(ref)
+			}
+		}
+		if !managed {
+			continue
+		}
+
+		state.Images = append(state.Images, ActualImage{
+			ID:         imageSummary.ID,
+			RepoTags:   imageSummary.RepoTags,
+			GitOID:     imageSummary.Labels[gitCommitLabel],
+			GitRef:     imageSummary.Labels[gitRefLabel],
+			Repository: imageSummary.Labels[gitRepositoryLabel],
+		})
+	}
+
+	containers, err := session.cli.ContainerList(ctx, types.ContainerListOptions{All: true})
+	if err != nil {
+		return err
+	}
+
+	state.Containers = make([]ActualContainer, 0, len(containers))
+	state.UnmanagedImageIDs = make(map[string]bool)
+	for _, container := range containers {
+		if !isManagedContainer(container.Labels) {
+			state.UnmanagedImageIDs[container.ImageID] = true
+			continue
+		}
+
+		name := ""
+		if len(container.Names) > 0 {
+			name = strings.TrimPrefix(container.Names[0], "/")
+		}
+
+		state.Containers = append(state.Containers, ActualContainer{
+			ID:      container.ID,
+			Name:    name,
+			Image:   container.Image,
+			ImageID: container.ImageID,
+			State:   container.State,
+		})
+	}
+
+	return nil
+}
+
+var containerNameRx = regexp.MustCompile(`--name (\S+)`)
+
+// ContainerName parses the name of the Docker container run by this unit from its unit file, or returns an empty
+// string if the unit doesn't run a named container.
+func (unit ActualSystemdUnit) ContainerName() string {
+	m := containerNameRx.FindSubmatch(unit.Content)
+	if len(m) != 2 {
+		return ""
+	}
+	return string(m[1])
+}
+
 // UnitName derives the internal name that SystemD uses for a unit from the path to its source file.
 func (unit ActualSystemdUnit) UnitName() string {
 	return path.Base(unit.Path)
@@ -0,0 +1,68 @@
+package state
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ActualCache holds the most recent ActualState read through it, along with its Docker images and containers, for a
+// short time. Image IDs are read for the units of the desired state given to the read that filled the cache, so changes
+// to desired state should Invalidate it, as should anything that changes the host.
+type ActualCache struct {
+	ttl func() time.Duration
+
+	lock       sync.Mutex
+	actual     *ActualState
+	errs       []error
+	readAt     time.Time
+	generation uint64
+}
+
+// NewActualCache creates a cache that holds each ActualState for the duration returned by ttl. ttl is called on each
+// read, so that it may change; a duration of zero or less disables the cache.
+func NewActualCache(ttl func() time.Duration) *ActualCache {
+	return &ActualCache{ttl: ttl}
+}
+
+// Invalidate discards the cached ActualState, including one that's being read right now.
+func (c *ActualCache) Invalidate() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.actual = nil
+	c.errs = nil
+	c.generation++
+}
+
+// Read returns the cached ActualState if it's fresh enough, or reads it with ReadActualState and ReadImages and caches
+// it. The errors returned by ReadImages are cached along with it. The returned ActualState is shared by every caller
+// until it expires, so it must not be modified.
+func (c *ActualCache) Read(ctx context.Context, session *SessionLease, desired DesiredState) (*ActualState, []error, error) {
+	ttl := c.ttl()
+
+	c.lock.Lock()
+	if ttl > 0 && c.actual != nil && time.Since(c.readAt) < ttl {
+		actual, errs := c.actual, c.errs
+		c.lock.Unlock()
+		session.Log.Debug("Using cached actual state.")
+		return actual, errs, nil
+	}
+	generation := c.generation
+	c.lock.Unlock()
+
+	actual, err := session.ReadActualState(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	errs := actual.ReadImages(ctx, session, desired)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if ttl > 0 && c.generation == generation {
+		c.actual = actual
+		c.errs = errs
+		c.readAt = time.Now()
+	}
+	return actual, errs, nil
+}
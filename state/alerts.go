@@ -0,0 +1,25 @@
+package state
+
+// The rules that alerts are raised by.
+const (
+	AlertDiskUsage    = "disk_usage"
+	AlertUnitRestarts = "unit_restarts"
+	AlertFailedSyncs  = "failed_syncs"
+)
+
+// Alert reports that one of the configured alert rules was breached on a host, or that it has recovered. Subject
+// names what the rule was evaluated for, like a path or a unit, if the rule is evaluated for more than one thing.
+type Alert struct {
+	Rule      string `json:"rule"`
+	Subject   string `json:"subject,omitempty"`
+	Host      string `json:"host"`
+	Firing    bool   `json:"firing"`
+	Value     int    `json:"value"`
+	Threshold int    `json:"threshold"`
+	Detail    string `json:"detail"`
+}
+
+// Key identifies the rule and subject of an alert, so that its recovery can be matched with its breach.
+func (a Alert) Key() string {
+	return a.Rule + ":" + a.Subject
+}
@@ -0,0 +1,80 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+)
+
+// DefaultAllowedImages are the repositories that desired units may run container images from when no others are
+// configured.
+var DefaultAllowedImages = []string{"quay.io/smashwilson/az-", "smashwilson/az-"}
+
+var (
+	allowedImagesLock sync.Mutex
+	allowedImages     = DefaultAllowedImages
+)
+
+// ConfigureAllowedImages installs the process-wide list of repositories that desired units may run container images
+// from. Each pattern is a prefix of the repository's name, like "quay.io/myorg/", unless it contains one of the glob
+// characters "*?[", in which case it's matched against the whole name, like "quay.io/*/az-*". An empty list restores
+// DefaultAllowedImages.
+func ConfigureAllowedImages(patterns []string) error {
+	if err := CheckAllowedImages(patterns); err != nil {
+		return err
+	}
+	if len(patterns) == 0 {
+		patterns = DefaultAllowedImages
+	}
+
+	allowedImagesLock.Lock()
+	defer allowedImagesLock.Unlock()
+
+	allowedImages = patterns
+	return nil
+}
+
+// CheckAllowedImages returns an error if any of patterns can't be used to allow images.
+func CheckAllowedImages(patterns []string) error {
+	for _, pattern := range patterns {
+		if len(pattern) == 0 {
+			return errors.New("empty image pattern")
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid image pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// imageRepository removes the tag or digest from an image reference, leaving the name of its repository.
+func imageRepository(ref string) string {
+	if at := strings.Index(ref, "@"); at >= 0 {
+		ref = ref[:at]
+	}
+	if colon := strings.LastIndex(ref, ":"); colon > strings.LastIndex(ref, "/") {
+		ref = ref[:colon]
+	}
+	return ref
+}
+
+// isManagedImageName returns true if an image name, tag, or digest reference belongs to an allowed repository.
+func isManagedImageName(imageName string) bool {
+	allowedImagesLock.Lock()
+	patterns := allowedImages
+	allowedImagesLock.Unlock()
+
+	repository := imageRepository(imageName)
+	for _, pattern := range patterns {
+		if strings.ContainsAny(pattern, "*?[") {
+			if matched, _ := path.Match(pattern, repository); matched {
+				return true
+			}
+		} else if strings.HasPrefix(repository, pattern) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+package state
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+)
+
+// The actions that applying a Delta takes on each unit.
+const (
+	ApplyActionAdd     = "add"
+	ApplyActionChange  = "change"
+	ApplyActionRestart = "restart"
+	ApplyActionRemove  = "remove"
+)
+
+// The outcomes of applying a Delta to each unit.
+const (
+	// ApplyOK units were written, started, restarted, or removed as the Delta required.
+	ApplyOK = "ok"
+
+	// ApplyWriteFailed units couldn't have their unit files written or removed.
+	ApplyWriteFailed = "write_failed"
+
+	// ApplyStartFailed units were written, but couldn't be started, restarted, or enabled.
+	ApplyStartFailed = "start_failed"
+
+	// ApplyStopFailed units couldn't be stopped cleanly before they were removed, and were killed instead.
+	ApplyStopFailed = "stop_failed"
+
+	// ApplyProtected units were left in place, because they're protected and the Delta wasn't computed to remove them.
+	ApplyProtected = "protected"
+
+	// ApplySkipped units were left alone, because something that they depend on failed or the apply was cut short.
+	ApplySkipped = "skipped"
+)
+
+// UnitApplyResult reports what happened to one unit when a Delta was applied.
+type UnitApplyResult struct {
+	Unit   string `json:"unit"`
+	Action string `json:"action"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Failed returns true if the unit didn't reach the state that the Delta required.
+func (r UnitApplyResult) Failed() bool {
+	return r.Status != ApplyOK
+}
+
+// Detail describes the outcome for a report, like "start failed: job failed".
+func (r UnitApplyResult) Detail() string {
+	detail := strings.Replace(r.Status, "_", " ", -1)
+	if len(r.Error) > 0 {
+		detail += ": " + r.Error
+	}
+	return detail
+}
+
+// FailedResults lists the units that didn't reach the state that the Delta required when it was applied.
+func (d Delta) FailedResults() []UnitApplyResult {
+	failed := make([]UnitApplyResult, 0)
+	for _, result := range d.UnitResults {
+		if result.Failed() {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+// applyResults tracks the outcome of each unit while a Delta is applied. Units that are still pending have an empty
+// status.
+type applyResults struct {
+	order  []string
+	byName map[string]*UnitApplyResult
+}
+
+func newApplyResults() *applyResults {
+	return &applyResults{byName: make(map[string]*UnitApplyResult)}
+}
+
+// track begins tracking a unit that the Delta takes action on.
+func (r *applyResults) track(name, action string) {
+	if _, ok := r.byName[name]; ok {
+		return
+	}
+	r.order = append(r.order, name)
+	r.byName[name] = &UnitApplyResult{Unit: name, Action: action}
+}
+
+// fail records that a pending unit didn't reach its desired state. Units that already failed keep their first
+// failure.
+func (r *applyResults) fail(name, status string, err error) {
+	result, ok := r.byName[name]
+	if !ok || len(result.Status) > 0 {
+		return
+	}
+	result.Status = status
+	result.Error = err.Error()
+}
+
+// pending returns true if nothing has gone wrong with the unit yet.
+func (r *applyResults) pending(name string) bool {
+	result, ok := r.byName[name]
+	return ok && len(result.Status) == 0
+}
+
+// list reports the outcome of every unit, in the order that they were tracked. Units that are still pending are
+// reported as skipped, with reason, if one is given, and as successful otherwise.
+func (r *applyResults) list(reason error) []UnitApplyResult {
+	results := make([]UnitApplyResult, 0, len(r.order))
+	for _, name := range r.order {
+		result := *r.byName[name]
+		if len(result.Status) == 0 {
+			if reason != nil {
+				result.Status = ApplySkipped
+				result.Error = reason.Error()
+			} else {
+				result.Status = ApplyOK
+			}
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// companionName returns the name of the service unit that a timer unit fires.
+func companionName(timerName string) string {
+	return strings.TrimSuffix(timerName, filepath.Ext(timerName)) + ".service"
+}
+
+// awaitUnitJobs waits for the result of the systemd job queued for each unit, like "done" or "failed", giving up early
+// if ctx is done.
+func awaitUnitJobs(ctx context.Context, jobs map[string]chan string) (map[string]string, error) {
+	results := make(map[string]string, len(jobs))
+	for name, job := range jobs {
+		select {
+		case result := <-job:
+			results[name] = result
+		case <-ctx.Done():
+			return results, ctx.Err()
+		}
+	}
+	return results, nil
+}
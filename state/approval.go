@@ -0,0 +1,53 @@
+package state
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrApprovalRequired is returned by Synchronize, along with the computed Delta, when the Delta exceeds the sync's
+// ApprovalPolicy and hasn't been approved. Nothing has been applied.
+var ErrApprovalRequired = errors.New("delta requires approval before it's applied")
+
+// ApprovalPolicy decides which Deltas are parked until someone approves them.
+type ApprovalPolicy struct {
+	// Enabled turns the approval gate on.
+	Enabled bool
+
+	// MaxUnitRestarts is the number of units that may be added, changed, or restarted without approval.
+	MaxUnitRestarts int
+
+	// Removals requires approval for any Delta that removes a unit.
+	Removals bool
+}
+
+// Reasons explains why d requires approval under this policy. It's empty if d may be applied without approval.
+func (p ApprovalPolicy) Reasons(d Delta) []string {
+	reasons := make([]string, 0, 2)
+	if !p.Enabled {
+		return reasons
+	}
+
+	restarts := len(d.UnitsToAdd) + len(d.UnitsToChange) + len(d.UnitsToRestart)
+	if restarts > p.MaxUnitRestarts {
+		reasons = append(reasons, fmt.Sprintf("%d units would restart (at most %d may restart without approval)", restarts, p.MaxUnitRestarts))
+	}
+	if p.Removals && len(d.UnitsToRemove) > 0 {
+		reasons = append(reasons, fmt.Sprintf("%d units would be removed", len(d.UnitsToRemove)))
+	}
+	return reasons
+}
+
+// Fingerprint summarizes the changes that d would make, so that an approved Delta can be recognized when it's
+// computed again.
+func (d Delta) Fingerprint() string {
+	lines := strings.Split(d.String(), "\n")
+	sort.Strings(lines)
+
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:])
+}
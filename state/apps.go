@@ -0,0 +1,306 @@
+package state
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+
+	"github.com/smashwilson/az-coordinator/retry"
+	"github.com/smashwilson/az-coordinator/store"
+)
+
+// App groups desired units that are synced, frozen, and rolled back together, like the several units of one product.
+type App struct {
+	ID     int    `json:"id"`
+	Name   string `json:"name"`
+	Frozen bool   `json:"frozen"`
+
+	// Released holds the image tag of each of the app's containers, keyed by unit ID, as of the most recent sync that
+	// changed any of them. Previous holds the tags of the release before that one, which RollBackApp restores.
+	Released map[int]string `json:"released"`
+	Previous map[int]string `json:"previous"`
+}
+
+// ErrNoPreviousRelease is returned by RollBackApp when an app has no earlier release to return to.
+var ErrNoPreviousRelease = errors.New("app has no previous release")
+
+// appNamePattern matches valid app names.
+var appNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+func readApps(ctx context.Context, db *store.DB) ([]App, error) {
+	var rows *sql.Rows
+	err := retry.Transient(ctx, func() error {
+		var err error
+		rows, err = db.QueryContext(ctx, "SELECT id, name, frozen, released, previous FROM apps ORDER BY name")
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	apps := make([]App, 0)
+	for rows.Next() {
+		var (
+			app         App
+			rawReleased []byte
+			rawPrevious []byte
+		)
+		if err := rows.Scan(&app.ID, &app.Name, &app.Frozen, &rawReleased, &rawPrevious); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(rawReleased, &app.Released); err != nil {
+			return nil, fmt.Errorf("malformed released column for app %s: %v", app.Name, err)
+		}
+		if err := json.Unmarshal(rawPrevious, &app.Previous); err != nil {
+			return nil, fmt.Errorf("malformed previous column for app %s: %v", app.Name, err)
+		}
+		apps = append(apps, app)
+	}
+	return apps, rows.Err()
+}
+
+// ReadApps loads every app, ordered by name.
+func (session SessionLease) ReadApps(ctx context.Context) ([]App, error) {
+	return readApps(ctx, session.db)
+}
+
+// ReadApp loads the app with the given name. It returns nil if no such app exists.
+func (session SessionLease) ReadApp(ctx context.Context, name string) (*App, error) {
+	apps, err := readApps(ctx, session.db)
+	if err != nil {
+		return nil, err
+	}
+	for _, app := range apps {
+		if app.Name == name {
+			return &app, nil
+		}
+	}
+	return nil, nil
+}
+
+// CreateApp creates a new, empty app. Names must be lower-case letters, digits, and dashes.
+func (session SessionLease) CreateApp(ctx context.Context, name string) (*App, error) {
+	if !appNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("Invalid app name: %q", name)
+	}
+
+	app := App{Name: name, Released: make(map[int]string), Previous: make(map[int]string)}
+
+	// Inserts are not retried: one whose acknowledgement was lost with its connection would be reported as a
+	// conflict.
+	row := session.db.QueryRowContext(ctx, "INSERT INTO apps (name) VALUES ($1) RETURNING id", name)
+	if err := row.Scan(&app.ID); err != nil {
+		return nil, err
+	}
+	return &app, nil
+}
+
+// DeleteApp removes an app. Its units remain desired, but no longer belong to any app.
+func (session SessionLease) DeleteApp(ctx context.Context, id int) error {
+	return retry.Transient(ctx, func() error {
+		tx, err := session.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, "UPDATE state_systemd_units SET app_id = NULL WHERE app_id = $1", id); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM apps WHERE id = $1", id); err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// SetAppFrozen freezes or unfreezes an app. Syncs leave the units of a frozen app exactly as they are, even if their
+// desired state changes.
+func (session SessionLease) SetAppFrozen(ctx context.Context, id int, frozen bool) error {
+	return retry.Transient(ctx, func() error {
+		_, err := session.db.ExecContext(ctx, "UPDATE apps SET frozen = $1 WHERE id = $2", frozen, id)
+		return err
+	})
+}
+
+// RollBackApp sets the image tag of each of the app's containers back to its previous release. The rolled-back tags
+// become the app's released tags, so a second rollback returns to the release that was just rolled back. The host
+// isn't changed until the next sync.
+func (session SessionLease) RollBackApp(ctx context.Context, app *App) error {
+	if len(app.Previous) == 0 {
+		return ErrNoPreviousRelease
+	}
+
+	for id, tag := range app.Previous {
+		unit, err := session.ReadDesiredUnit(ctx, id)
+		if err != nil {
+			return err
+		}
+		if unit == nil || unit.Container == nil {
+			continue
+		}
+
+		unit.Container.ImageTag = tag
+		if err := unit.Update(ctx, session); err != nil {
+			return err
+		}
+	}
+
+	app.Released, app.Previous = app.Previous, app.Released
+	return saveAppReleases(ctx, session.db, *app)
+}
+
+func saveAppReleases(ctx context.Context, db *store.DB, app App) error {
+	rawReleased, err := json.Marshal(app.Released)
+	if err != nil {
+		return err
+	}
+	rawPrevious, err := json.Marshal(app.Previous)
+	if err != nil {
+		return err
+	}
+
+	return retry.Transient(ctx, func() error {
+		_, err := db.ExecContext(ctx, "UPDATE apps SET released = $1, previous = $2 WHERE id = $3", rawReleased, rawPrevious, app.ID)
+		return err
+	})
+}
+
+// recordAppReleases notes the image tags of each app whose units were all synced, so that a later release can be
+// rolled back to them.
+func (session SessionLease) recordAppReleases(ctx context.Context, units []DesiredSystemdUnit) error {
+	apps, err := readApps(ctx, session.db)
+	if err != nil {
+		return err
+	}
+
+	for _, app := range apps {
+		tags := make(map[int]string)
+		synced := true
+		for _, unit := range units {
+			if unit.AppID == nil || *unit.AppID != app.ID {
+				continue
+			}
+			if unit.Held {
+				synced = false
+				break
+			}
+			if unit.Container != nil {
+				tags[*unit.ID] = unit.Container.ImageTag
+			}
+		}
+		if !synced || len(tags) == 0 || reflect.DeepEqual(tags, app.Released) {
+			continue
+		}
+
+		app.Previous, app.Released = app.Released, tags
+		if err := saveAppReleases(ctx, session.db, app); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HoldAllBut holds every unit that doesn't belong to the app with the given ID, so that a sync changes only that
+// app. Units that are no longer desired are kept, because there's no way to tell which app they belonged to.
+func (state *DesiredState) HoldAllBut(appID int) {
+	for i := range state.Units {
+		unit := &state.Units[i]
+		if unit.AppID == nil || *unit.AppID != appID {
+			unit.Held = true
+		}
+	}
+	state.KeepUndesired = true
+}
+
+// App assigns the unit to the named app, or to no app if name is empty. The app must already exist.
+func (builder *DesiredSystemdUnitBuilder) App(name string, session SessionLease) error {
+	if len(name) == 0 {
+		builder.unit.AppID = nil
+		builder.unit.App = ""
+		return nil
+	}
+
+	app, err := session.ReadApp(context.Background(), name)
+	if err != nil {
+		return err
+	}
+	if app == nil {
+		return fmt.Errorf("unknown app: %s", name)
+	}
+
+	builder.unit.AppID = &app.ID
+	builder.unit.App = app.Name
+	return nil
+}
+
+// AppStatus summarizes the state of an app's units on this host.
+type AppStatus struct {
+	Name   string `json:"name"`
+	Frozen bool   `json:"frozen"`
+
+	// Units lists the names of the app's units that should be present on this host.
+	Units []string `json:"units"`
+
+	// Present counts the units whose unit files are installed. Running counts the units whose containers are running,
+	// or that are installed and don't run a long-lived container.
+	Present int `json:"present"`
+	Running int `json:"running"`
+
+	// Status is "running" if every unit is running, "stopped" if none are, "degraded" otherwise, or "empty" if the app
+	// has no units on this host.
+	Status string `json:"status"`
+}
+
+// AppStatuses summarizes the units of each app that should be present on this host. actual must have been read with
+// ReadImages, so that its containers are known.
+func AppStatuses(apps []App, desired DesiredState, actual ActualState) []AppStatus {
+	present := make(map[string]bool, len(actual.Units))
+	for _, unit := range actual.Units {
+		present[unit.UnitName()] = true
+	}
+	running := make(map[string]bool, len(actual.Containers))
+	for _, container := range actual.Containers {
+		if container.Running() {
+			running[container.Name] = true
+		}
+	}
+
+	statuses := make([]AppStatus, 0, len(apps))
+	for _, app := range apps {
+		status := AppStatus{Name: app.Name, Frozen: app.Frozen, Units: make([]string, 0)}
+		for _, unit := range desired.Units {
+			if unit.AppID == nil || *unit.AppID != app.ID || !unit.Enabled {
+				continue
+			}
+
+			status.Units = append(status.Units, unit.UnitName())
+			if !present[unit.UnitName()] {
+				continue
+			}
+			status.Present++
+			if unit.Type != TypeSimple || (unit.Container != nil && running[unit.Container.Name]) {
+				status.Running++
+			}
+		}
+
+		switch {
+		case len(status.Units) == 0:
+			status.Status = "empty"
+		case status.Running == len(status.Units):
+			status.Status = "running"
+		case status.Running == 0:
+			status.Status = "stopped"
+		default:
+			status.Status = "degraded"
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
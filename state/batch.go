@@ -0,0 +1,75 @@
+package state
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// The kinds of DesiredChange.
+const (
+	ChangeCreate = "create"
+	ChangeUpdate = "update"
+	ChangeDelete = "delete"
+)
+
+// DesiredChange is one change to desired state in a batch. Unit is the unit to create, the new settings of a unit to
+// update, or the unit to delete. Units that are updated or deleted must be at the Version that's stored.
+type DesiredChange struct {
+	Op   string
+	Unit DesiredSystemdUnit
+}
+
+// ChangeError identifies the change that kept a batch from being stored.
+type ChangeError struct {
+	Index int
+	Err   error
+}
+
+func (e *ChangeError) Error() string {
+	return fmt.Sprintf("change %d: %v", e.Index, e.Err)
+}
+
+// ApplyDesiredChanges stores every change in one transaction, so that either all of them are stored or none are. If
+// a change can't be stored, a *ChangeError identifies it. Otherwise, the unit of each change is updated to match the
+// stored unit: created units gain their IDs, and the versions of updated units advance.
+func (session SessionLease) ApplyDesiredChanges(ctx context.Context, changes []DesiredChange) error {
+	stored := make([]DesiredSystemdUnit, len(changes))
+
+	// Batches are not retried, because they may include inserts.
+	err := session.inTransaction(ctx, func(tx *sql.Tx) error {
+		for i, change := range changes {
+			unit := change.Unit
+
+			var err error
+			switch {
+			case change.Op == ChangeCreate && unit.ID != nil:
+				err = errors.New("units to create can't have an ID")
+			case change.Op == ChangeCreate:
+				err = unit.insert(ctx, tx)
+			case change.Op != ChangeUpdate && change.Op != ChangeDelete:
+				err = fmt.Errorf("unknown change: %q", change.Op)
+			case unit.ID == nil:
+				err = errors.New("units to change must have an ID")
+			case change.Op == ChangeUpdate:
+				err = unit.update(ctx, tx)
+			default:
+				err = unit.remove(ctx, tx)
+			}
+			if err != nil {
+				return &ChangeError{Index: i, Err: err}
+			}
+			stored[i] = unit
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range changes {
+		changes[i].Unit = stored[i]
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package state
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/smashwilson/az-coordinator/retry"
+)
+
+// SyncPhase names the step that a sync has reached.
+type SyncPhase string
+
+// The phases of Synchronize, in order.
+const (
+	PhaseReadDesired SyncPhase = "read_desired"
+	PhaseReadActual  SyncPhase = "read_actual"
+	PhasePull        SyncPhase = "pull"
+	PhaseCompute     SyncPhase = "compute"
+	PhaseApply       SyncPhase = "apply"
+	PhaseHealth      SyncPhase = "health"
+	PhasePrune       SyncPhase = "prune"
+	PhaseDone        SyncPhase = "done"
+)
+
+// The outcomes of a finished sync.
+const (
+	OutcomeSucceeded       = "succeeded"
+	OutcomeFailed          = "failed"
+	OutcomePendingApproval = "pending_approval"
+	OutcomeCanceled        = "canceled"
+)
+
+// SyncCheckpoint records the progress of the most recent sync on one host, so that a sync that was interrupted by a
+// restart can be reported, and repeated, afterward. FinishedAt is zero while the sync is running.
+type SyncCheckpoint struct {
+	Host       string      `json:"host"`
+	Phase      SyncPhase   `json:"phase"`
+	Trigger    SyncTrigger `json:"trigger"`
+	App        *int        `json:"app_id,omitempty"`
+	Unit       *int        `json:"unit_id,omitempty"`
+	StartedAt  int64       `json:"started_at"`
+	UpdatedAt  int64       `json:"updated_at"`
+	FinishedAt int64       `json:"finished_at,omitempty"`
+	Outcome    string      `json:"outcome,omitempty"`
+}
+
+// Interrupted returns true if the sync never finished.
+func (c SyncCheckpoint) Interrupted() bool {
+	return c.FinishedAt == 0
+}
+
+// checkpointer writes the SyncCheckpoint of one sync as it moves through its phases. Failures to write are logged
+// rather than failing the sync.
+type checkpointer struct {
+	session    *SessionLease
+	checkpoint SyncCheckpoint
+}
+
+// startCheckpoint begins recording the progress of a sync with the given settings, replacing the checkpoint of the
+// previous sync on the same host.
+func (s *SessionLease) startCheckpoint(ctx context.Context, settings SyncSettings) *checkpointer {
+	now := time.Now().Unix()
+	c := &checkpointer{
+		session: s,
+		checkpoint: SyncCheckpoint{
+			Host:      settings.Host,
+			Phase:     PhaseReadDesired,
+			Trigger:   settings.Trigger,
+			App:       settings.App,
+			Unit:      settings.Unit,
+			StartedAt: now,
+			UpdatedAt: now,
+		},
+	}
+	c.write(ctx)
+	return c
+}
+
+// reach records that the sync has started a new phase. A nil checkpointer records nothing.
+func (c *checkpointer) reach(ctx context.Context, phase SyncPhase) {
+	if c == nil {
+		return
+	}
+	c.checkpoint.Phase = phase
+	c.checkpoint.UpdatedAt = time.Now().Unix()
+	c.write(ctx)
+}
+
+// finish records the outcome of the sync, which has failed if any errors are given. The phase is left at the one
+// that failed.
+func (c *checkpointer) finish(errs []error) {
+	if c == nil {
+		return
+	}
+	now := time.Now().Unix()
+	c.checkpoint.UpdatedAt = now
+	c.checkpoint.FinishedAt = now
+
+	switch {
+	case len(errs) == 1 && errs[0] == ErrApprovalRequired:
+		c.checkpoint.Outcome = OutcomePendingApproval
+	case syncCanceled(errs):
+		c.checkpoint.Outcome = OutcomeCanceled
+	case len(errs) > 0:
+		c.checkpoint.Outcome = OutcomeFailed
+	default:
+		c.checkpoint.Phase = PhaseDone
+		c.checkpoint.Outcome = OutcomeSucceeded
+	}
+
+	// The sync's own Context may have expired, but its outcome should still be recorded.
+	c.write(context.Background())
+}
+
+func (c *checkpointer) write(ctx context.Context) {
+	trigger, err := json.Marshal(c.checkpoint.Trigger)
+	if err != nil {
+		c.session.Log.WithError(err).Warn("Unable to serialize sync trigger.")
+		return
+	}
+
+	cp := c.checkpoint
+	err = retry.Transient(ctx, func() error {
+		_, err := c.session.db.ExecContext(
+			ctx,
+			`INSERT INTO sync_checkpoints (host, phase, trigger, app_id, unit_id, started_at, updated_at, finished_at, outcome)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			ON CONFLICT (host) DO UPDATE SET
+				phase = excluded.phase, trigger = excluded.trigger, app_id = excluded.app_id, unit_id = excluded.unit_id,
+				started_at = excluded.started_at, updated_at = excluded.updated_at, finished_at = excluded.finished_at,
+				outcome = excluded.outcome`,
+			cp.Host, string(cp.Phase), string(trigger), cp.App, cp.Unit, cp.StartedAt, cp.UpdatedAt, cp.FinishedAt,
+			cp.Outcome,
+		)
+		return err
+	})
+	if err != nil {
+		c.session.Log.WithError(err).WithField("phase", cp.Phase).Warn("Unable to record sync checkpoint.")
+	}
+}
+
+// ReadSyncCheckpoint loads the checkpoint of the most recent sync on a host, or returns nil if it has none.
+func (s SessionLease) ReadSyncCheckpoint(ctx context.Context, host string) (*SyncCheckpoint, error) {
+	var (
+		c       SyncCheckpoint
+		phase   string
+		trigger string
+		app     sql.NullInt64
+		unit    sql.NullInt64
+	)
+
+	err := retry.Transient(ctx, func() error {
+		return s.db.QueryRowContext(
+			ctx,
+			"SELECT host, phase, trigger, app_id, unit_id, started_at, updated_at, finished_at, outcome "+
+				"FROM sync_checkpoints WHERE host = $1",
+			host,
+		).Scan(&c.Host, &phase, &trigger, &app, &unit, &c.StartedAt, &c.UpdatedAt, &c.FinishedAt, &c.Outcome)
+	})
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c.Phase = SyncPhase(phase)
+	if err := json.Unmarshal([]byte(trigger), &c.Trigger); err != nil {
+		return nil, err
+	}
+	if app.Valid {
+		id := int(app.Int64)
+		c.App = &id
+	}
+	if unit.Valid {
+		id := int(unit.Int64)
+		c.Unit = &id
+	}
+	return &c, nil
+}
@@ -0,0 +1,103 @@
+package state
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+)
+
+// CommitChecker reports whether the checks of a commit of a GitHub repository, like "smashwilson/az-web", have passed.
+// If they haven't, detail describes their state, like "pending" or "failure".
+type CommitChecker func(ctx context.Context, repository, commit string) (passed bool, detail string, err error)
+
+// GatedUnit is a unit that was left running its current image, because the checks of the commit that its new image
+// was built from haven't passed.
+type GatedUnit struct {
+	Unit       string `json:"unit"`
+	Repository string `json:"repository"`
+	Commit     string `json:"commit"`
+	ImageID    string `json:"image_id"`
+	Detail     string `json:"detail"`
+}
+
+// gateCommits holds each desired unit that would start running a new image whose commit's checks haven't passed,
+// returning the units that were held. Commits that can't be checked are treated as failing. Images without
+// repository and commit labels aren't gated.
+func (session *SessionLease) gateCommits(ctx context.Context, desired *DesiredState, actual *ActualState, check CommitChecker) []GatedUnit {
+	actualImages := make(map[string]string, len(actual.Units))
+	for _, unit := range actual.Units {
+		actualImages[unit.UnitName()] = unit.ImageID
+	}
+
+	type outcome struct {
+		passed bool
+		detail string
+	}
+	checked := make(map[string]outcome)
+
+	gated := make([]GatedUnit, 0)
+	units := make([]DesiredSystemdUnit, len(desired.Units))
+	copy(units, desired.Units)
+	for i, unit := range units {
+		container := unit.Container
+		if unit.Held || container == nil || len(container.ImageID) == 0 {
+			continue
+		}
+		if len(container.Repository) == 0 || len(container.GitOID) == 0 {
+			continue
+		}
+
+		// A timer's container is run by its companion unit.
+		running := unit.UnitName()
+		if companion := unit.CompanionUnit(); companion != nil {
+			running = companion.UnitName()
+		}
+		if actualImages[running] == container.ImageID {
+			continue
+		}
+
+		key := container.Repository + "@" + container.GitOID
+		result, ok := checked[key]
+		if !ok {
+			passed, detail, err := check(ctx, container.Repository, container.GitOID)
+			if err != nil {
+				session.Log.WithError(err).WithFields(logrus.Fields{
+					"repository": container.Repository,
+					"commit":     container.GitOID,
+				}).Warn("Unable to check commit status.")
+				passed, detail = false, "unable to check: "+err.Error()
+			}
+			result = outcome{passed: passed, detail: detail}
+			checked[key] = result
+		}
+		if result.passed {
+			continue
+		}
+
+		session.Log.WithFields(logrus.Fields{
+			"unitName":   unit.UnitName(),
+			"repository": container.Repository,
+			"commit":     container.GitOID,
+			"detail":     result.detail,
+		}).Warn("Commit checks haven't passed. Holding unit.")
+		units[i].Held = true
+		gated = append(gated, GatedUnit{
+			Unit:       unit.UnitName(),
+			Repository: container.Repository,
+			Commit:     container.GitOID,
+			ImageID:    container.ImageID,
+			Detail:     result.detail,
+		})
+	}
+
+	desired.Units = units
+	return gated
+}
+
+// ShortCommit abbreviates the commit to its first seven characters, as GitHub does.
+func (g GatedUnit) ShortCommit() string {
+	if len(g.Commit) > 7 {
+		return g.Commit[:7]
+	}
+	return g.Commit
+}
@@ -0,0 +1,184 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The kinds of UnitConflict.
+const (
+	// ConflictHostPort units publish the same port on the host.
+	ConflictHostPort = "host_port"
+
+	// ConflictContainerName units run containers with the same name.
+	ConflictContainerName = "container_name"
+
+	// ConflictUnitPath units are written to the same unit file.
+	ConflictUnitPath = "unit_path"
+)
+
+// UnitConflict is something that more than one desired unit claims on a host that they may share, like a published
+// host port. Only one of them can have it, so the others fail when they're applied.
+type UnitConflict struct {
+	Kind   string   `json:"kind"`
+	Value  string   `json:"value"`
+	Units  []string `json:"units"`
+	Detail string   `json:"detail"`
+}
+
+// claim is something that a unit needs to itself on each host that it runs on.
+type claim struct {
+	kind  string
+	value string
+}
+
+// claims lists what the unit needs to itself. A timer's container and ports are claimed by its companion instead.
+func (unit DesiredSystemdUnit) claims() []claim {
+	claims := []claim{{kind: ConflictUnitPath, value: unit.Path}}
+	if unit.Type == TypeTimer || unit.Container == nil {
+		return claims
+	}
+
+	if len(unit.Container.Name) > 0 {
+		claims = append(claims, claim{kind: ConflictContainerName, value: unit.Container.Name})
+	}
+	for hostPort := range unit.Ports {
+		claims = append(claims, claim{kind: ConflictHostPort, value: strconv.Itoa(hostPort)})
+	}
+	return claims
+}
+
+// mayShareHost returns true if there could be a host that both units run on: their host lists overlap, and their
+// selectors don't require different values for the same label.
+func mayShareHost(a, b DesiredSystemdUnit) bool {
+	for key, value := range a.Selector {
+		if other, ok := b.Selector[key]; ok && other != value {
+			return false
+		}
+	}
+
+	if len(a.Hosts) == 0 || len(b.Hosts) == 0 {
+		return true
+	}
+	for _, host := range a.Hosts {
+		for _, other := range b.Hosts {
+			if host == other {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Conflicts finds the host ports, container names, and unit paths that more than one enabled unit claims on a host
+// that they may share.
+func (state DesiredState) Conflicts() []UnitConflict {
+	claimants := make(map[claim][]DesiredSystemdUnit)
+	for _, unit := range state.managedUnits() {
+		for _, c := range unit.claims() {
+			claimants[c] = append(claimants[c], unit)
+		}
+	}
+
+	conflicts := make([]UnitConflict, 0)
+	for c, units := range claimants {
+		names := make([]string, 0)
+		for i, unit := range units {
+			for j, other := range units {
+				if i != j && mayShareHost(unit, other) {
+					names = append(names, unit.UnitName())
+					break
+				}
+			}
+		}
+		if len(names) == 0 {
+			continue
+		}
+
+		sort.Strings(names)
+		conflicts = append(conflicts, UnitConflict{
+			Kind:   c.kind,
+			Value:  c.value,
+			Units:  names,
+			Detail: fmt.Sprintf("%s is claimed by %s", describeClaim(c), strings.Join(names, ", ")),
+		})
+	}
+
+	sort.Slice(conflicts, func(i, j int) bool {
+		if conflicts[i].Kind != conflicts[j].Kind {
+			return conflicts[i].Kind < conflicts[j].Kind
+		}
+		return conflicts[i].Value < conflicts[j].Value
+	})
+	return conflicts
+}
+
+// describeClaim names a claim in a message.
+func describeClaim(c claim) string {
+	switch c.kind {
+	case ConflictHostPort:
+		return "host port " + c.value
+	case ConflictContainerName:
+		return "container name " + c.value
+	default:
+		return "unit path " + c.value
+	}
+}
+
+// WithUnit returns a copy of the state in which unit replaces the unit with the same ID, or is added if it has none.
+func (state DesiredState) WithUnit(unit DesiredSystemdUnit) DesiredState {
+	units := make([]DesiredSystemdUnit, 0, len(state.Units)+1)
+	for _, each := range state.Units {
+		if unit.ID == nil || each.ID == nil || *each.ID != *unit.ID {
+			units = append(units, each)
+		}
+	}
+	state.Units = append(units, unit)
+	return state
+}
+
+// ConflictsOf lists the conflicts of the state that involve unit or its companion.
+func (state DesiredState) ConflictsOf(unit DesiredSystemdUnit) []UnitConflict {
+	names := map[string]bool{unit.UnitName(): true}
+	if companion := unit.CompanionUnit(); companion != nil {
+		names[companion.UnitName()] = true
+	}
+
+	involved := make([]UnitConflict, 0)
+	for _, conflict := range state.Conflicts() {
+		for _, name := range conflict.Units {
+			if names[name] {
+				involved = append(involved, conflict)
+				break
+			}
+		}
+	}
+	return involved
+}
+
+// ConflictsError describes the conflicts of a unit as a validation error, or returns nil if there are none.
+func ConflictsError(conflicts []UnitConflict) error {
+	if len(conflicts) == 0 {
+		return nil
+	}
+
+	details := make([]string, 0, len(conflicts))
+	for _, conflict := range conflicts {
+		details = append(details, conflict.Detail)
+	}
+	return errors.New("conflicts with other units: " + strings.Join(details, "; "))
+}
+
+// CheckConflicts returns an error if storing unit would leave it claiming a host port, container name, or unit path
+// that another desired unit claims on a host that they may share. The unit replaces the stored unit with its ID.
+func (session SessionLease) CheckConflicts(ctx context.Context, unit DesiredSystemdUnit) error {
+	existing, err := session.ReadDesiredState(ctx)
+	if err != nil {
+		return err
+	}
+	return ConflictsError(existing.WithUnit(unit).ConflictsOf(unit))
+}
@@ -0,0 +1,114 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+)
+
+// ContainerStats is a sample of the resources that a unit's container is using, read from the Docker stats API.
+// Network and block IO are counted since the container started.
+type ContainerStats struct {
+	Unit      string `json:"unit"`
+	Container string `json:"container"`
+	ReadAt    int64  `json:"read_at"`
+
+	// CPUPercent is the share of one CPU used since the previous sample, so a container that keeps two CPUs busy
+	// reports 200.
+	CPUPercent float64 `json:"cpu_percent"`
+
+	// MemoryUsageBytes excludes the page cache, as "docker stats" does.
+	MemoryUsageBytes uint64  `json:"memory_usage_bytes"`
+	MemoryLimitBytes uint64  `json:"memory_limit_bytes"`
+	MemoryPercent    float64 `json:"memory_percent"`
+
+	NetworkRxBytes  uint64 `json:"network_rx_bytes"`
+	NetworkTxBytes  uint64 `json:"network_tx_bytes"`
+	BlockReadBytes  uint64 `json:"block_read_bytes"`
+	BlockWriteBytes uint64 `json:"block_write_bytes"`
+	PIDs            uint64 `json:"pids"`
+}
+
+// ReadContainerStats reads samples of the resources used by a unit's container, calling each with every sample as it
+// arrives. One sample is read if samples is 1 or less; otherwise, Docker sends one about every second. It stops early
+// if each returns an error, which is returned, or once ctx is done.
+func (session SessionLease) ReadContainerStats(ctx context.Context, unit DesiredSystemdUnit, samples int, each func(ContainerStats) error) error {
+	if samples < 1 {
+		samples = 1
+	}
+	resp, err := session.cli.ContainerStats(ctx, unit.Container.Name, samples > 1)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for read := 0; read < samples; read++ {
+		var raw types.StatsJSON
+		if err := decoder.Decode(&raw); err == io.EOF {
+			return nil
+		} else if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		stats := summarizeStats(raw)
+		stats.Unit = unit.UnitName()
+		stats.Container = unit.Container.Name
+		if err := each(stats); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// summarizeStats computes the figures that "docker stats" reports from a raw sample.
+func summarizeStats(raw types.StatsJSON) ContainerStats {
+	stats := ContainerStats{
+		ReadAt:           raw.Read.Unix(),
+		MemoryLimitBytes: raw.MemoryStats.Limit,
+		PIDs:             raw.PidsStats.Current,
+	}
+
+	cpuDelta := float64(raw.CPUStats.CPUUsage.TotalUsage) - float64(raw.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(raw.CPUStats.SystemUsage) - float64(raw.PreCPUStats.SystemUsage)
+	cpus := float64(raw.CPUStats.OnlineCPUs)
+	if cpus == 0 {
+		cpus = float64(len(raw.CPUStats.CPUUsage.PercpuUsage))
+	}
+	if cpuDelta > 0 && systemDelta > 0 {
+		stats.CPUPercent = cpuDelta / systemDelta * cpus * 100
+	}
+
+	// cgroup v1 reports the page cache as "cache", and cgroup v2 as "inactive_file".
+	cache := raw.MemoryStats.Stats["cache"]
+	if inactive, ok := raw.MemoryStats.Stats["inactive_file"]; ok {
+		cache = inactive
+	}
+	stats.MemoryUsageBytes = raw.MemoryStats.Usage
+	if cache < stats.MemoryUsageBytes {
+		stats.MemoryUsageBytes -= cache
+	}
+	if stats.MemoryLimitBytes > 0 {
+		stats.MemoryPercent = float64(stats.MemoryUsageBytes) / float64(stats.MemoryLimitBytes) * 100
+	}
+
+	for _, network := range raw.Networks {
+		stats.NetworkRxBytes += network.RxBytes
+		stats.NetworkTxBytes += network.TxBytes
+	}
+	for _, entry := range raw.BlkioStats.IoServiceBytesRecursive {
+		switch strings.ToLower(entry.Op) {
+		case "read":
+			stats.BlockReadBytes += entry.Value
+		case "write":
+			stats.BlockWriteBytes += entry.Value
+		}
+	}
+	return stats
+}
@@ -2,14 +2,18 @@ package state
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
+	"github.com/docker/docker/api/types"
 	"github.com/sirupsen/logrus"
 	"github.com/smashwilson/az-coordinator/secrets"
+	"github.com/smashwilson/az-coordinator/tracing"
 )
 
 // UpdatedContainer captures information about a container image that has been modified.
@@ -44,14 +48,65 @@ type Delta struct {
 	UnitsToRemove  []ActualSystemdUnit  `json:"units_to_remove"`
 	FilesToWrite   []string             `json:"files_to_write"`
 
+	// ProtectedUnits lists the protected units that are no longer desired, but that weren't removed because the sync
+	// wasn't forced.
+	ProtectedUnits []string `json:"protected_units,omitempty"`
+
+	// SecretsChanged lists, for each unit that will be restarted because of it, the secrets whose values changed
+	// since its unit file was written.
+	SecretsChanged map[string][]string `json:"secrets_changed"`
+
+	// UnitDiffs holds a unified diff of the current and new content of each unit file that will be rewritten, by
+	// unit name. Secret values are redacted.
+	UnitDiffs map[string]string `json:"unit_diffs"`
+
+	ContainersToRemove []ActualContainer `json:"containers_to_remove"`
+	ImagesToRemove     []ActualImage     `json:"images_to_remove"`
+
+	// Conflicts lists the host ports, container names, and unit paths that more than one desired unit claims. The
+	// Delta is applied regardless, but all but one of the units in each conflict are likely to fail.
+	Conflicts []UnitConflict `json:"conflicts"`
+
+	// Prune is populated by Synchronize if unused Docker data was pruned after the Delta was applied.
+	Prune *PruneResult `json:"prune,omitempty"`
+
+	// ApplyMillis is the time that Synchronize spent applying the Delta, in milliseconds.
+	ApplyMillis int64 `json:"apply_ms,omitempty"`
+
+	// PullFailures is populated by Synchronize with the images that couldn't be pulled. Their units are synchronized
+	// with the local copy of the image, if there is one.
+	PullFailures []PullFailure `json:"pull_failures,omitempty"`
+
+	// GatedUnits is populated by Synchronize with the units that were left running their current image, because the
+	// checks of the commit that their new image was built from haven't passed.
+	GatedUnits []GatedUnit `json:"gated_units,omitempty"`
+
+	// UnitResults is populated by Synchronize with the outcome of applying the Delta to each unit. If some units
+	// couldn't be applied, Synchronize returns the Delta along with its errors.
+	UnitResults []UnitApplyResult `json:"unit_results,omitempty"`
+
+	// Health is populated by Synchronize with the state of each started or restarted unit shortly after the Delta was
+	// applied.
+	Health []UnitHealth `json:"health,omitempty"`
+
 	UpdatedContainers []UpdatedContainer `json:"-"`
 
-	fileContent map[string][]byte
+	fileContent map[string]secrets.DesiredFile
+
+	// publishedPorts holds the host ports published by every unit that will run after the Delta is applied, or is
+	// nil if they can't be known because undesired units are kept.
+	publishedPorts map[int]bool
+
+	// removeProtected is true if the Delta was computed to remove protected units.
+	removeProtected bool
 }
 
 // Between compares desired and actual system state and produces a Delta necessary to convert the observed actual
 // state to the desired state.
-func (session *SessionLease) Between(desired *DesiredState, actual *ActualState) Delta {
+func (session *SessionLease) Between(ctx context.Context, desired *DesiredState, actual *ActualState) Delta {
+	_, span := tracing.Start(ctx, "Between")
+	defer span.End()
+
 	var (
 		log = session.Log
 
@@ -59,42 +114,75 @@ func (session *SessionLease) Between(desired *DesiredState, actual *ActualState)
 		unitsToChange  = make([]DesiredSystemdUnit, 0)
 		unitsToRestart = make([]DesiredSystemdUnit, 0)
 		unitsToRemove  = make([]ActualSystemdUnit, 0)
+		protectedUnits = make([]string, 0)
 		filesToWrite   = make([]string, 0, len(desired.Files))
 
 		updatedContainers = make([]UpdatedContainer, 0)
 
-		fileContentByPath = make(map[string][]byte, len(desired.Files))
+		secretsChanged    = make(map[string][]string)
+		unitDiffs         = make(map[string]string)
+		fileContentByPath = make(map[string]secrets.DesiredFile, len(desired.Files))
 		desiredByName     = make(map[string]DesiredSystemdUnit)
 		desiredRemaining  = make(map[string]bool)
 	)
 
-	for filePath, desiredContent := range desired.Files {
+	for filePath, desiredFile := range desired.Files {
 		log.WithField("filePath", filePath).Debug("Verifying expected file.")
 		actualContent, ok := actual.Files[filePath]
-		if !ok || !bytes.Equal(desiredContent, actualContent) {
+		if !ok || !bytes.Equal(desiredFile.Content, actualContent) {
 			filesToWrite = append(filesToWrite, filePath)
-			fileContentByPath[filePath] = desiredContent
+			fileContentByPath[filePath] = desiredFile
 			log.WithField("filePath", filePath).Debug("File was absent or different.")
 		} else {
 			log.WithField("filePath", filePath).Debug("Nothing to do.")
 		}
 	}
 
-	for _, unit := range desired.Units {
+	bag, err := session.GetSecrets()
+	if err != nil {
+		log.WithError(err).Warn("Unable to load secrets. Secret changes will not be detected.")
+	}
+
+	for _, unit := range desired.managedUnits() {
 		desiredByName[unit.UnitName()] = unit
 		desiredRemaining[unit.UnitName()] = true
 	}
 
+	// Disabled units are removed even by syncs that otherwise keep undesired units.
+	disabledNames := make(map[string]bool)
+	for _, unit := range desired.Units {
+		if !unit.Enabled && !unit.Held {
+			disabledNames[unit.UnitName()] = true
+			if companion := unit.CompanionUnit(); companion != nil {
+				disabledNames[companion.UnitName()] = true
+			}
+		}
+	}
+
+	keepUndesired, removeProtected := desired.KeepUndesired, desired.RemoveProtected
 	for _, actual := range actual.Units {
 		if desired, ok := desiredByName[actual.UnitName()]; ok {
 			log.WithField("unitName", actual.UnitName()).Debug("Verifying systemd unit.")
 			desiredRemaining[desired.UnitName()] = false
 
+			if desired.Held {
+				log.WithField("unitName", actual.UnitName()).Debug("Unit is held.")
+				continue
+			}
+
 			willUpdate := false
 			shouldRestart := false
 
-			// Determine if the ID of the running Docker container image will change.
-			if desired.Container != nil {
+			// A unit file that systemd doesn't list is rewritten, so that systemd is reloaded and the unit is started.
+			if actual.Orphaned {
+				log.WithField("unitName", actual.UnitName()).Debug("Unit file isn't known to systemd.")
+				willUpdate = true
+				shouldRestart = true
+			}
+
+			// Determine if the ID of the running Docker container image will change. A timer's container is run by its
+			// companion unit, so only the companion is updated when its image changes.
+			if desired.Container != nil && desired.Type != TypeTimer {
 				if desired.Container.ImageID != actual.ImageID && len(desired.Container.ImageID) > 0 {
 					willUpdate = true
 					shouldRestart = true
@@ -114,26 +202,41 @@ func (session *SessionLease) Between(desired *DesiredState, actual *ActualState)
 				}
 			} else if !bytes.Equal(expected.Bytes(), actual.Content) {
 				log.WithField("unitName", actual.UnitName()).Debug("Unit content differs.")
+				unitDiffs[desired.UnitName()] = unitDiff(actual.Path, actual.Content, expected.Bytes(), desired.sensitiveEnv())
 				willUpdate = true
 				shouldRestart = true
 			}
 
+			// Schedule the unit for restart if the value of a secret that it uses has changed.
+			if changed := changedSecrets(desired, actual.Content, bag); len(changed) > 0 {
+				log.WithFields(logrus.Fields{
+					"unitName":   actual.UnitName(),
+					"secretKeys": changed,
+				}).Debug("Secret values have changed.")
+				secretsChanged[desired.UnitName()] = changed
+				shouldRestart = true
+			}
+
 			// Schedule the unit for restart if a volume-mounted file is due to be modified.
 			for hostPath := range desired.Volumes {
-				if _, ok := fileContentByPath[hostPath]; ok {
+				if filePath, ok := mountedFile(hostPath, fileContentByPath); ok {
 					// A mounted file has been written. Restart the unit to pick it up.
 					log.WithFields(logrus.Fields{
 						"unitName":        actual.UnitName(),
-						"mountedFilePath": hostPath,
+						"mountedFilePath": filePath,
 					}).Debug("Mounted volume file has been changed.")
 					shouldRestart = true
 					break
 				}
 			}
 
-			if willUpdate && desired.Container != nil {
+			// Units whose rendered content changes, including those that embed a changed secret, must have their
+			// unit files rewritten before they're restarted.
+			if willUpdate {
 				unitsToChange = append(unitsToChange, desired)
-				updatedContainers = append(updatedContainers, UpdatedContainer(*desired.Container))
+				if desired.Container != nil && desired.Type != TypeTimer {
+					updatedContainers = append(updatedContainers, UpdatedContainer(*desired.Container))
+				}
 			} else if shouldRestart {
 				unitsToRestart = append(unitsToRestart, desired)
 			}
@@ -142,6 +245,13 @@ func (session *SessionLease) Between(desired *DesiredState, actual *ActualState)
 			if !willUpdate && !shouldRestart {
 				log.WithField("unitName", actual.UnitName()).Debug("Nothing to do.")
 			}
+		} else if !actual.Managed {
+			log.WithField("unitName", actual.UnitName()).Debug("Unit file wasn't written by the coordinator. Leaving it alone.")
+		} else if keepUndesired && !disabledNames[actual.UnitName()] {
+			log.WithField("unitName", actual.UnitName()).Debug("Unit is no longer desired, but is being kept.")
+		} else if actual.Protected && !removeProtected {
+			log.WithField("unitName", actual.UnitName()).Warn("Unit is no longer desired, but is protected. Force a sync to remove it.")
+			protectedUnits = append(protectedUnits, actual.UnitName())
 		} else {
 			// Unit is no longer desired.
 			log.WithField("unitName", actual.UnitName()).Debug("Unit is no longer desired.")
@@ -152,176 +262,383 @@ func (session *SessionLease) Between(desired *DesiredState, actual *ActualState)
 	// Create remaining units anew.
 	for desiredName, remaining := range desiredRemaining {
 		if remaining {
-			if desired, ok := desiredByName[desiredName]; ok {
+			if desired, ok := desiredByName[desiredName]; ok && !desired.Held {
 				log.WithField("unitName", desired.UnitName()).Debug("Unit is not yet present.")
 				unitsToAdd = append(unitsToAdd, desired)
 			}
 		}
 	}
 
+	containersToRemove, imagesToRemove := make([]ActualContainer, 0), make([]ActualImage, 0)
+	if !desired.KeepUndesired {
+		containersToRemove, imagesToRemove = orphans(desired, actual, unitsToRemove)
+	}
+	for _, container := range containersToRemove {
+		log.WithFields(logrus.Fields{
+			"containerName": container.Name,
+			"containerID":   container.ID,
+		}).Debug("Container is orphaned.")
+	}
+	for _, image := range imagesToRemove {
+		log.WithFields(logrus.Fields{
+			"imageID":  image.ID,
+			"repoTags": image.RepoTags,
+		}).Debug("Image is no longer referenced.")
+	}
+
+	conflicts := desired.Conflicts()
+	for _, conflict := range conflicts {
+		log.WithField("units", conflict.Units).Warnf("Desired units conflict: %s.", conflict.Detail)
+	}
+
+	span.SetAttribute("units.add", len(unitsToAdd))
+	span.SetAttribute("units.change", len(unitsToChange))
+	span.SetAttribute("units.restart", len(unitsToRestart))
+	span.SetAttribute("units.remove", len(unitsToRemove))
+	span.SetAttribute("files.write", len(filesToWrite))
+	var publishedPorts map[int]bool
+	if !keepUndesired && len(protectedUnits) == 0 {
+		publishedPorts = make(map[int]bool)
+		for _, unit := range desired.Units {
+			if unit.Enabled || unit.Held {
+				for hostPort := range unit.Ports {
+					publishedPorts[hostPort] = true
+				}
+			}
+		}
+	}
+
+	span.SetAttribute("containers.remove", len(containersToRemove))
+	span.SetAttribute("images.remove", len(imagesToRemove))
+
 	return Delta{
-		UnitsToAdd:        unitsToAdd,
-		UnitsToChange:     unitsToChange,
-		UnitsToRestart:    unitsToRestart,
-		UnitsToRemove:     unitsToRemove,
-		FilesToWrite:      filesToWrite,
+		UnitsToAdd:     unitsToAdd,
+		UnitsToChange:  unitsToChange,
+		UnitsToRestart: unitsToRestart,
+		UnitsToRemove:  unitsToRemove,
+		FilesToWrite:   filesToWrite,
+		ProtectedUnits: protectedUnits,
+		SecretsChanged: secretsChanged,
+		UnitDiffs:      unitDiffs,
+
+		ContainersToRemove: containersToRemove,
+		ImagesToRemove:     imagesToRemove,
+		Conflicts:          conflicts,
+
 		UpdatedContainers: updatedContainers,
 		fileContent:       fileContentByPath,
+		publishedPorts:    publishedPorts,
+		removeProtected:   desired.RemoveProtected,
 	}
 }
 
-// CoordinatorRestartNeeded returns true if this Delta will require the coordinator itself to restart.
-func (d Delta) CoordinatorRestartNeeded() bool {
-	for _, filePath := range d.FilesToWrite {
-		if secrets.IsTLSFile(filePath) {
+// orphans finds the containers left behind by units that are being removed or that no desired unit will run, and
+// the images that no desired unit, pin, app release, or surviving container references. Containers that the
+// coordinator didn't start count as references, but are never orphaned themselves. Running containers are only
+// orphaned if they belong to a unit that's being removed, so that in-flight one-shot containers aren't disturbed.
+func orphans(desired *DesiredState, actual *ActualState, unitsToRemove []ActualSystemdUnit) ([]ActualContainer, []ActualImage) {
+	var (
+		containersToRemove = make([]ActualContainer, 0)
+		imagesToRemove     = make([]ActualImage, 0)
+
+		desiredContainerNames = make(map[string]bool)
+		removedContainerNames = make(map[string]bool)
+		referencedImageIDs    = make(map[string]bool)
+	)
+
+	for _, unit := range desired.managedUnits() {
+		if unit.Container == nil {
+			continue
+		}
+		if len(unit.Container.Name) > 0 {
+			desiredContainerNames[unit.Container.Name] = true
+		}
+		if len(unit.Container.ImageID) > 0 {
+			referencedImageIDs[unit.Container.ImageID] = true
+		}
+	}
+
+	// Pinned images are kept even while their units are disabled, so that they're present when the units are enabled.
+	for _, unit := range desired.Units {
+		if unit.Container != nil && len(unit.Container.PinnedImageID) > 0 {
+			referencedImageIDs[unit.Container.PinnedImageID] = true
+		}
+	}
+
+	for _, unit := range unitsToRemove {
+		if name := unit.ContainerName(); len(name) > 0 {
+			removedContainerNames[name] = true
+		}
+	}
+
+	// Images used by containers that the coordinator didn't start can't be removed, and aren't its to remove.
+	for imageID := range actual.UnmanagedImageIDs {
+		referencedImageIDs[imageID] = true
+	}
+
+	for _, container := range actual.Containers {
+		removed := removedContainerNames[container.Name]
+		stale := !container.Running() && !desiredContainerNames[container.Name]
+
+		if removed || stale {
+			containersToRemove = append(containersToRemove, container)
+		} else {
+			referencedImageIDs[container.ImageID] = true
+		}
+	}
+
+	for _, image := range actual.Images {
+		retained := false
+		for _, tag := range image.RepoTags {
+			retained = retained || desired.RetainedImages[tag]
+		}
+		if !referencedImageIDs[image.ID] && !retained {
+			imagesToRemove = append(imagesToRemove, image)
+		}
+	}
+
+	return containersToRemove, imagesToRemove
+}
+
+// changedSecrets lists the secrets used by unit whose current values differ from the digests recorded in the unit
+// file's content. Secrets without a recorded digest are not reported.
+func changedSecrets(unit DesiredSystemdUnit, content []byte, bag *secrets.Bag) []string {
+	used := unit.UsedSecrets()
+	if bag == nil || len(used) == 0 {
+		return nil
+	}
+
+	recorded := renderedSecretHashes(content)
+	changed := make([]string, 0)
+	for _, key := range used {
+		hash, ok := recorded[key]
+		if !ok || !bag.Has(key) {
+			continue
+		}
+		if secretHash(bag.Get(key, "")) != hash {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// mountedFile returns the path of a file about to be written that lies at or beneath hostPath, if there is one.
+func mountedFile(hostPath string, files map[string]secrets.DesiredFile) (string, bool) {
+	for filePath := range files {
+		if mountsPath(hostPath, filePath) {
+			return filePath, true
+		}
+	}
+	return "", false
+}
+
+// mountsPath returns true if a volume of hostPath exposes the file at filePath.
+func mountsPath(hostPath, filePath string) bool {
+	return filePath == hostPath || strings.HasPrefix(filePath, strings.TrimSuffix(hostPath, "/")+"/")
+}
+
+// Mounts returns true if one of the unit's volumes exposes the host file at filePath.
+func (unit DesiredSystemdUnit) Mounts(filePath string) bool {
+	for hostPath := range unit.Volumes {
+		if mountsPath(hostPath, filePath) {
 			return true
 		}
 	}
 	return false
 }
 
-// Apply enacts the changes described by a Delta on the system. Individual operations that fail append errors to
-// the returned error slice, but do not prevent subsequent operations from being attempted.
-func (d Delta) Apply(session *SessionLease, uid, gid int) []error {
+// awaitJobs waits for count systemd job results to arrive on results, giving up early if ctx is done.
+func awaitJobs(ctx context.Context, results <-chan string, count int) error {
+	for i := 0; i < count; i++ {
+		select {
+		case <-results:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Apply enacts the changes described by a Delta on the system, and reports the outcome for each unit. Individual
+// operations that fail append errors to the returned error slice, but do not prevent independent operations from
+// being attempted: a unit whose file can't be written isn't started or restarted, and neither are the timers that fire
+// it or the units that mount a file that couldn't be written, but every other unit is. If ctx is done while waiting
+// on systemd jobs, the remaining operations are abandoned and their units are reported as skipped.
+func (d Delta) Apply(ctx context.Context, session *SessionLease, uid, gid int) (results []UnitApplyResult, errs []error) {
+	ctx, span := tracing.Start(ctx, "Delta.Apply")
+	defer func() {
+		span.RecordErrors(errs)
+		span.End()
+	}()
+
+	errs = make([]error, 0)
+
 	var (
-		errs         = make([]error, 0)
 		log          = session.Log
 		needsReload  = false
-		restartUnits = make([]string, 0, len(d.UnitsToChange)+len(d.UnitsToRestart))
+		tracked      = newApplyResults()
+		failedFiles  = make(map[string]error)
+		writtenPaths = make([]string, 0, len(d.fileContent)+len(d.UnitsToAdd)+len(d.UnitsToChange))
 	)
 
-	for filePath, fileContent := range d.fileContent {
-		dir := filepath.Dir(filePath)
+	// abandon reports every unit that hasn't been dealt with yet as skipped because of err.
+	abandon := func(err error) ([]UnitApplyResult, []error) {
+		return tracked.list(err), append(errs, err)
+	}
 
-		if err := os.MkdirAll(dir, 0750); err != nil {
+	for _, unit := range d.UnitsToAdd {
+		tracked.track(unit.UnitName(), ApplyActionAdd)
+	}
+	for _, unit := range d.UnitsToChange {
+		tracked.track(unit.UnitName(), ApplyActionChange)
+	}
+	for _, unit := range d.UnitsToRestart {
+		tracked.track(unit.UnitName(), ApplyActionRestart)
+	}
+	for _, unit := range d.UnitsToRemove {
+		tracked.track(unit.UnitName(), ApplyActionRemove)
+	}
+
+	// Protected units are only removed by a Delta that was computed to remove them, no matter how it was assembled.
+	removals := make([]ActualSystemdUnit, 0, len(d.UnitsToRemove))
+	for _, unit := range d.UnitsToRemove {
+		if unit.Protected && !d.removeProtected {
+			err := fmt.Errorf("Refusing to remove protected unit %s", unit.UnitName())
 			errs = append(errs, err)
+			tracked.fail(unit.UnitName(), ApplyProtected, err)
 			continue
 		}
+		removals = append(removals, unit)
+	}
+	d.UnitsToRemove = removals
 
-		if uid != -1 || gid != -1 {
-			if err := os.Chown(dir, uid, gid); err != nil {
-				errs = append(errs, err)
-				continue
-			}
-			log.WithFields(logrus.Fields{
-				"dirPath": dir,
-				"uid":     uid,
-				"gid":     gid,
-			}).Info("Directory ownership modified.")
+	for filePath, desiredFile := range d.fileContent {
+		if err := ctx.Err(); err != nil {
+			return abandon(err)
 		}
 
-		if err := ioutil.WriteFile(filePath, fileContent, 0600); err != nil {
+		if err := writeFile(filePath, desiredFile, uid, gid, log); err != nil {
 			errs = append(errs, err)
+			failedFiles[filePath] = err
 			continue
 		}
-		log.WithField("filePath", filePath).Info("File content written.")
+		writtenPaths = append(writtenPaths, filePath)
+	}
 
-		if uid != -1 || gid != -1 {
-			if err := os.Chown(filePath, uid, gid); err != nil {
+	// Write the unit files of new and changed units.
+	for _, units := range [][]DesiredSystemdUnit{d.UnitsToAdd, d.UnitsToChange} {
+		for _, unit := range units {
+			needsReload = true
+			if err := writeUnitFile(session, unit, uid, gid); err != nil {
 				errs = append(errs, err)
+				tracked.fail(unit.UnitName(), ApplyWriteFailed, err)
 				continue
 			}
-			log.WithFields(logrus.Fields{
-				"filePath": filePath,
-				"uid":      uid,
-				"gid":      gid,
-			}).Info("File ownership modified.")
+			writtenPaths = append(writtenPaths, unit.Path)
 		}
 	}
 
-	for _, unit := range d.UnitsToAdd {
-		needsReload = true
-		f, err := os.OpenFile(unit.Path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
-		if err != nil {
-			errs = append(errs, fmt.Errorf("Unable to create unit file %s (%v)", unit.Path, err))
-			continue
+	// Units that mount a file that couldn't be written are left alone, and so are timers whose service was.
+	affected := [][]DesiredSystemdUnit{d.UnitsToAdd, d.UnitsToChange, d.UnitsToRestart}
+	for _, units := range affected {
+		for _, unit := range units {
+			for hostPath := range unit.Volumes {
+				for filePath, err := range failedFiles {
+					if filePath == hostPath || strings.HasPrefix(filePath, strings.TrimSuffix(hostPath, "/")+"/") {
+						tracked.fail(unit.UnitName(), ApplySkipped, fmt.Errorf("mounted file %s wasn't written (%v)", filePath, err))
+					}
+				}
+			}
 		}
-
-		errs = append(errs, session.WriteUnit(unit, f)...)
-		f.Close()
-
-		log.WithFields(logrus.Fields{
-			"unitName":     unit.UnitName(),
-			"unitFilePath": unit.Path,
-		}).Info("Unit file created.")
-
-		if uid != -1 || gid != -1 {
-			if err := os.Chown(unit.Path, uid, gid); err != nil {
-				errs = append(errs, err)
-				continue
+	}
+	for _, units := range affected {
+		for _, unit := range units {
+			companion := companionName(unit.UnitName())
+			if _, ok := tracked.byName[companion]; ok && unit.Type == TypeTimer && !tracked.pending(companion) {
+				tracked.fail(unit.UnitName(), ApplySkipped, fmt.Errorf("its service %s wasn't applied", companion))
 			}
-
-			log.WithFields(logrus.Fields{
-				"unitFilePath": unit.Path,
-				"uid":          uid,
-				"gid":          gid,
-			}).Info("Unit file ownership modified.")
 		}
 	}
 
-	for _, unit := range d.UnitsToChange {
-		needsReload = true
-		restartUnits = append(restartUnits, unit.UnitName())
-
-		f, err := os.OpenFile(unit.Path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
-		if err != nil {
-			errs = append(errs, fmt.Errorf("Unable to overwrite unit file %s (%v)", unit.Path, err))
-			continue
+	// Relabel written files so that systemd can read unit files and containers can read mounted secrets.
+	if SELinuxEnforcing() {
+		if err := restoreContexts(ctx, writtenPaths, false); err != nil {
+			errs = append(errs, err)
+		} else if len(writtenPaths) > 0 {
+			log.WithField("count", len(writtenPaths)).Debug("SELinux contexts restored.")
 		}
+	}
 
-		errs = append(errs, session.WriteUnit(unit, f)...)
-		f.Close()
-
-		log.WithFields(logrus.Fields{
-			"unitName":     unit.UnitName(),
-			"unitFilePath": unit.Path,
-		}).Info("Unit file modified.")
-
-		if uid != -1 || gid != -1 {
-			if err := os.Chown(unit.Path, uid, gid); err != nil {
-				errs = append(errs, err)
+	// Open the host ports published by new and changed units.
+	ports := make([]int, 0)
+	for _, units := range [][]DesiredSystemdUnit{d.UnitsToAdd, d.UnitsToChange} {
+		for _, unit := range units {
+			if !tracked.pending(unit.UnitName()) {
 				continue
 			}
-
-			log.WithFields(logrus.Fields{
-				"unitFilePath": unit.Path,
-				"uid":          uid,
-				"gid":          gid,
-			}).Info("Unit file ownership modified.")
+			for hostPort := range unit.Ports {
+				ports = append(ports, hostPort)
+			}
 		}
 	}
-
-	for _, unit := range d.UnitsToRestart {
-		restartUnits = append(restartUnits, unit.UnitName())
+	// Close the ports that were opened for units that no longer publish them.
+	opened, closed, err := syncFirewallPorts(ctx, ports, d.publishedPorts)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if len(opened) > 0 {
+		log.WithField("ports", opened).Info("Firewall ports opened.")
+	}
+	if len(closed) > 0 {
+		log.WithField("ports", closed).Info("Firewall ports closed.")
 	}
 
 	// Stop and disable unit files we intend to remove.
 	if len(d.UnitsToRemove) > 0 {
-		stops := make(chan string, len(d.UnitsToRemove))
+		stops := make(map[string]chan string, len(d.UnitsToRemove))
 		disableUnitNames := make([]string, 0, len(d.UnitsToRemove))
 		for _, unit := range d.UnitsToRemove {
+			if unit.Orphaned {
+				log.WithField("unitName", unit.UnitName()).Debug("Unit isn't known to systemd. Its file will be removed.")
+				continue
+			}
 			disableUnitNames = append(disableUnitNames, unit.UnitName())
 
 			log.WithField("unitName", unit.UnitName()).Debug("Stopping unit.")
-			if _, err := session.conn.StopUnit(unit.UnitName(), "replace", stops); err != nil {
-				errs = append(errs, fmt.Errorf("Unable to stop unit %s (%v)", unit.UnitName(), err))
-				stops <- ""
+			stop := make(chan string, 1)
+			if _, err := session.conn.StopUnit(unit.UnitName(), "replace", stop); err != nil {
+				err = fmt.Errorf("Unable to stop unit %s (%v)", unit.UnitName(), err)
+				errs = append(errs, err)
+				tracked.fail(unit.UnitName(), ApplyStopFailed, err)
 
 				log.WithField("unitName", unit.UnitName()).Info("Killing unit.")
 				session.conn.KillUnit(unit.Path, 9)
 				log.WithField("unitName", unit.UnitName()).Info("Unit killed.")
+				continue
 			}
+			stops[unit.UnitName()] = stop
 		}
-		for i := 0; i < len(d.UnitsToRemove); i++ {
-			<-stops
+		jobs, err := awaitUnitJobs(ctx, stops)
+		if err != nil {
+			return abandon(fmt.Errorf("Timed out waiting for units to stop (%v)", err))
+		}
+		for unitName, job := range jobs {
+			if job != "done" {
+				err := fmt.Errorf("Unable to stop unit %s (job %s)", unitName, job)
+				errs = append(errs, err)
+				tracked.fail(unitName, ApplyStopFailed, err)
+			}
 		}
 		log.WithField("count", len(d.UnitsToRemove)).Debug("Units stopped or killed.")
 
-		log.WithField("unitPaths", disableUnitNames).Debug("Disabling units.")
-		if _, err := session.conn.DisableUnitFiles(disableUnitNames, false); err != nil {
-			errs = append(errs, fmt.Errorf("Unable to disable units %v (%v)", disableUnitNames, err))
+		if len(disableUnitNames) > 0 {
+			log.WithField("unitPaths", disableUnitNames).Debug("Disabling units.")
+			if _, err := session.conn.DisableUnitFiles(disableUnitNames, false); err != nil {
+				errs = append(errs, fmt.Errorf("Unable to disable units %v (%v)", disableUnitNames, err))
+			}
+			log.WithField("count", len(disableUnitNames)).Debug("Units disabled.")
 		}
-		log.WithField("count", len(disableUnitNames)).Debug("Units disabled.")
 	} else {
 		log.Debug("No units to remove.")
 	}
@@ -330,55 +647,100 @@ func (d Delta) Apply(session *SessionLease, uid, gid int) []error {
 	if needsReload {
 		log.Debug("Reloading systemd unit files.")
 		if err := session.conn.Reload(); err != nil {
-			errs = append(errs, fmt.Errorf("Unable to trigger a systemd reload (%v)", err))
-			return errs
+			return abandon(fmt.Errorf("Unable to trigger a systemd reload (%v)", err))
 		}
 		log.Debug("Reloaded successfully.")
 	}
 
-	// Start and enable newly created units.
-	if len(d.UnitsToAdd) > 0 {
-		log.WithField("count", len(d.UnitsToAdd)).Debug("Starting and enabling units.")
+	// Start and enable newly created units. Companion units are left for their timers to start.
+	startUnits := make([]DesiredSystemdUnit, 0, len(d.UnitsToAdd))
+	for _, unit := range d.UnitsToAdd {
+		if !unit.Companion && tracked.pending(unit.UnitName()) {
+			startUnits = append(startUnits, unit)
+		}
+	}
+	if len(startUnits) > 0 {
+		log.WithField("count", len(startUnits)).Debug("Starting and enabling units.")
 
-		starts := make(chan string, len(d.UnitsToAdd))
-		enablePaths := make([]string, 0, len(d.UnitsToAdd))
-		for _, unit := range d.UnitsToAdd {
-			enablePaths = append(enablePaths, unit.Path)
+		starts := make(map[string]chan string, len(startUnits))
+		for _, unit := range startUnits {
 			log.WithField("unitName", unit.UnitName()).Debug("Starting unit.")
-			if _, err := session.conn.StartUnit(unit.UnitName(), "replace", starts); err != nil {
-				errs = append(errs, fmt.Errorf("Unable to start unit %s (%v)", unit.UnitName(), err))
-				starts <- ""
+			start := make(chan string, 1)
+			if _, err := session.conn.StartUnit(unit.UnitName(), "replace", start); err != nil {
+				err = fmt.Errorf("Unable to start unit %s (%v)", unit.UnitName(), err)
+				errs = append(errs, err)
+				tracked.fail(unit.UnitName(), ApplyStartFailed, err)
+				continue
 			}
+			starts[unit.UnitName()] = start
 		}
-		for i := 0; i < len(d.UnitsToAdd); i++ {
-			<-starts
+		jobs, err := awaitUnitJobs(ctx, starts)
+		if err != nil {
+			return abandon(fmt.Errorf("Timed out waiting for units to start (%v)", err))
+		}
+		for unitName, job := range jobs {
+			if job != "done" {
+				err := fmt.Errorf("Unable to start unit %s (job %s)", unitName, job)
+				errs = append(errs, err)
+				tracked.fail(unitName, ApplyStartFailed, err)
+			}
 		}
-		log.WithField("count", len(d.UnitsToAdd)).Info("Units started.")
+		log.WithField("count", len(startUnits)).Info("Units started.")
 
+		// Units that were written are enabled even if they failed to start, so that they're retried at boot.
+		enablePaths := make([]string, 0, len(startUnits))
+		for _, unit := range startUnits {
+			enablePaths = append(enablePaths, unit.Path)
+		}
 		log.WithField("count", len(enablePaths)).Info("Enabling units.")
 		if _, _, err := session.conn.EnableUnitFiles(enablePaths, false, true); err != nil {
-			errs = append(errs, fmt.Errorf("Unable to enable units %v (%v)", enablePaths, err))
+			err = fmt.Errorf("Unable to enable units %v (%v)", enablePaths, err)
+			errs = append(errs, err)
+			for _, unit := range startUnits {
+				tracked.fail(unit.UnitName(), ApplyStartFailed, err)
+			}
 		}
 		log.WithField("count", len(enablePaths)).Debug("Units enabled.")
 	} else {
 		log.Debug("No units to start and enable.")
 	}
 
-	// Restart changed units and units whose containers have been updated.
+	// Restart changed units and units whose containers have been updated. Companion units pick up their changes the
+	// next time that their timer fires them.
+	restartUnits := make([]string, 0, len(d.UnitsToChange)+len(d.UnitsToRestart))
+	for _, units := range [][]DesiredSystemdUnit{d.UnitsToChange, d.UnitsToRestart} {
+		for _, unit := range units {
+			if !unit.Companion && tracked.pending(unit.UnitName()) {
+				restartUnits = append(restartUnits, unit.UnitName())
+			}
+		}
+	}
 	if len(restartUnits) > 0 {
 		log.WithField("count", len(restartUnits)).Debug("Restarting units.")
 
-		restarts := make(chan string, len(restartUnits))
+		restarts := make(map[string]chan string, len(restartUnits))
 		for _, unitName := range restartUnits {
 			log.WithField("unitName", unitName).Debug("Restarting unit.")
-			if _, err := session.conn.RestartUnit(unitName, "replace", restarts); err != nil {
-				errs = append(errs, fmt.Errorf("Unable to restart unit %s (%v)", unitName, err))
-				restarts <- ""
+			restart := make(chan string, 1)
+			if _, err := session.conn.RestartUnit(unitName, "replace", restart); err != nil {
+				err = fmt.Errorf("Unable to restart unit %s (%v)", unitName, err)
+				errs = append(errs, err)
+				tracked.fail(unitName, ApplyStartFailed, err)
+				continue
 			}
+			restarts[unitName] = restart
 		}
 
-		for i := 0; i < len(restartUnits); i++ {
-			<-restarts
+		jobs, err := awaitUnitJobs(ctx, restarts)
+		if err != nil {
+			return abandon(fmt.Errorf("Timed out waiting for units to restart (%v)", err))
+		}
+		for unitName, job := range jobs {
+			if job != "done" {
+				err := fmt.Errorf("Unable to restart unit %s (job %s)", unitName, job)
+				errs = append(errs, err)
+				tracked.fail(unitName, ApplyStartFailed, err)
+			}
 		}
 		log.WithField("count", len(restartUnits)).Info("Units restarted.")
 	} else {
@@ -390,7 +752,10 @@ func (d Delta) Apply(session *SessionLease, uid, gid int) []error {
 		for _, unit := range d.UnitsToRemove {
 			log.WithField("unitFilePath", unit.Path).Debug("Removing unit file.")
 			if err := os.Remove(unit.Path); err != nil {
-				errs = append(errs, fmt.Errorf("Unable to remove unit source for %s (%v)", unit.Path, err))
+				err = fmt.Errorf("Unable to remove unit source for %s (%v)", unit.Path, err)
+				errs = append(errs, err)
+				tracked.fail(unit.UnitName(), ApplyWriteFailed, err)
+				continue
 			}
 			log.WithField("unitFilePath", unit.Path).Info("Removed unit file.")
 		}
@@ -398,12 +763,163 @@ func (d Delta) Apply(session *SessionLease, uid, gid int) []error {
 		log.Debug("No unit files to remove.")
 	}
 
-	if d.CoordinatorRestartNeeded() {
-		log.Info("Restarting coordinator.")
-		os.Exit(0)
+	// Clean up orphaned containers, then the images they were using. Failures here are logged rather than reported,
+	// because the desired state has already been reached.
+	for _, container := range d.ContainersToRemove {
+		err := session.cli.ContainerRemove(ctx, container.ID, types.ContainerRemoveOptions{Force: true})
+		if err != nil {
+			log.WithError(err).WithField("containerName", container.Name).Warn("Unable to remove orphaned container.")
+			continue
+		}
+		log.WithField("containerName", container.Name).Info("Removed orphaned container.")
 	}
 
-	return errs
+	for _, image := range d.ImagesToRemove {
+		_, err := session.cli.ImageRemove(ctx, image.ID, types.ImageRemoveOptions{PruneChildren: true})
+		if err != nil {
+			log.WithError(err).WithField("imageID", image.ID).Warn("Unable to remove unreferenced image.")
+			continue
+		}
+		log.WithFields(logrus.Fields{
+			"imageID":  image.ID,
+			"repoTags": image.RepoTags,
+		}).Info("Removed unreferenced image.")
+	}
+
+	return tracked.list(nil), errs
+}
+
+// writeFile writes a desired file, creating its directory if necessary, and gives both to uid and gid unless they're
+// -1.
+func writeFile(filePath string, desiredFile secrets.DesiredFile, uid, gid int, log *logrus.Logger) error {
+	dir := filepath.Dir(filePath)
+
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+
+	if uid != -1 || gid != -1 {
+		if err := os.Chown(dir, uid, gid); err != nil {
+			return err
+		}
+		log.WithFields(logrus.Fields{
+			"dirPath": dir,
+			"uid":     uid,
+			"gid":     gid,
+		}).Info("Directory ownership modified.")
+	}
+
+	if err := ioutil.WriteFile(filePath, desiredFile.Content, desiredFile.Mode); err != nil {
+		return err
+	}
+	// WriteFile only applies the mode to new files.
+	if err := os.Chmod(filePath, desiredFile.Mode); err != nil {
+		return err
+	}
+	log.WithField("filePath", filePath).Info("File content written.")
+
+	if uid != -1 || gid != -1 {
+		if err := os.Chown(filePath, uid, gid); err != nil {
+			return err
+		}
+		log.WithFields(logrus.Fields{
+			"filePath": filePath,
+			"uid":      uid,
+			"gid":      gid,
+		}).Info("File ownership modified.")
+	}
+	return nil
+}
+
+// writeUnitFile renders unit to its unit file and gives the file to uid and gid unless they're -1.
+func writeUnitFile(session *SessionLease, unit DesiredSystemdUnit, uid, gid int) error {
+	log := session.Log
+
+	f, err := os.OpenFile(unit.Path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to write unit file %s (%v)", unit.Path, err)
+	}
+
+	writeErrs := session.WriteUnit(unit, f)
+	f.Close()
+	if len(writeErrs) > 0 {
+		return fmt.Errorf("Unable to render unit file %s (%v)", unit.Path, writeErrs[0])
+	}
+
+	log.WithFields(logrus.Fields{
+		"unitName":     unit.UnitName(),
+		"unitFilePath": unit.Path,
+	}).Info("Unit file written.")
+
+	if uid != -1 || gid != -1 {
+		if err := os.Chown(unit.Path, uid, gid); err != nil {
+			return err
+		}
+
+		log.WithFields(logrus.Fields{
+			"unitFilePath": unit.Path,
+			"uid":          uid,
+			"gid":          gid,
+		}).Info("Unit file ownership modified.")
+	}
+	return nil
+}
+
+// restartUnits adds the named units to UnitsToRestart, unless they're held, aren't desired, or are already being
+// added, changed, or restarted.
+func (d *Delta) restartUnits(desired DesiredState, names []string) {
+	if len(names) == 0 {
+		return
+	}
+
+	touched := make(map[string]bool)
+	for _, units := range [][]DesiredSystemdUnit{d.UnitsToAdd, d.UnitsToChange, d.UnitsToRestart} {
+		for _, unit := range units {
+			touched[unit.UnitName()] = true
+		}
+	}
+
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[name] = true
+	}
+
+	for _, unit := range desired.managedUnits() {
+		if wanted[unit.UnitName()] && !unit.Held && !touched[unit.UnitName()] {
+			d.UnitsToRestart = append(d.UnitsToRestart, unit)
+			touched[unit.UnitName()] = true
+		}
+	}
+}
+
+// UnitsChanged returns true if applying the Delta adds, changes, restarts, or removes any unit.
+func (d Delta) UnitsChanged() bool {
+	return len(d.UnitsToAdd)+len(d.UnitsToChange)+len(d.UnitsToRestart)+len(d.UnitsToRemove) > 0
+}
+
+// UnitNames lists, in sorted order, the names of the units that applying the Delta adds, restarts (whether or not
+// their unit files change), and removes.
+func (d Delta) UnitNames() (added, restarted, removed []string) {
+	added = make([]string, 0, len(d.UnitsToAdd))
+	for _, unit := range d.UnitsToAdd {
+		added = append(added, unit.UnitName())
+	}
+	restarted = make([]string, 0, len(d.UnitsToChange)+len(d.UnitsToRestart))
+	for _, unit := range d.UnitsToChange {
+		restarted = append(restarted, unit.UnitName())
+	}
+	for _, unit := range d.UnitsToRestart {
+		restarted = append(restarted, unit.UnitName())
+	}
+	removed = make([]string, 0, len(d.UnitsToRemove))
+	for _, unit := range d.UnitsToRemove {
+		removed = append(removed, unit.UnitName())
+	}
+
+	sort.Strings(added)
+	sort.Strings(restarted)
+	sort.Strings(removed)
+	return added, restarted, removed
 }
 
 func (d Delta) String() string {
@@ -431,13 +947,30 @@ func (d Delta) String() string {
 		writeDesiredUnit(u)
 	}
 
+	for _, u := range d.UnitsToRestart {
+		b.WriteString("restart unit: ")
+		writeDesiredUnit(u)
+	}
+
 	for _, u := range d.UnitsToRemove {
 		b.WriteString("remove unit: ")
 		writeActualUnit(u)
 	}
 
+	for unitName, keys := range d.SecretsChanged {
+		fmt.Fprintf(&b, "secrets changed: %s %v\n", unitName, keys)
+	}
+
 	for _, f := range d.FilesToWrite {
-		fmt.Fprintf(&b, "write file: %s contentlen=%d\n", f, len(d.fileContent[f]))
+		fmt.Fprintf(&b, "write file: %s contentlen=%d mode=%#o\n", f, len(d.fileContent[f].Content), d.fileContent[f].Mode)
+	}
+
+	for _, c := range d.ContainersToRemove {
+		fmt.Fprintf(&b, "remove container: %s (%s)\n", c.Name, c.ID)
+	}
+
+	for _, i := range d.ImagesToRemove {
+		fmt.Fprintf(&b, "remove image: %s %v\n", i.ID, i.RepoTags)
 	}
 
 	return b.String()
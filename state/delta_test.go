@@ -0,0 +1,104 @@
+package state
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestOrphansKeepsReleasedAndPinnedImages(t *testing.T) {
+	id := func(n int) *int { return &n }
+
+	units := []DesiredSystemdUnit{
+		{
+			ID:      id(1),
+			Path:    "/etc/systemd/system/az-pushbot.service",
+			Type:    TypeSimple,
+			Enabled: true,
+			Container: &DesiredDockerContainer{
+				Name:      "pushbot",
+				ImageName: "quay.io/smashwilson/az-pushbot",
+				ImageTag:  "v3",
+				ImageID:   "sha256:current",
+			},
+		},
+		{
+			ID:      id(2),
+			Path:    "/etc/systemd/system/az-parked.service",
+			Type:    TypeSimple,
+			Enabled: false,
+			Container: &DesiredDockerContainer{
+				Name:          "parked",
+				ImageName:     "quay.io/smashwilson/az-parked",
+				ImageTag:      "latest",
+				PinnedImageID: "sha256:pinned",
+			},
+		},
+	}
+	apps := []App{{
+		ID:       1,
+		Name:     "pushbot",
+		Released: map[int]string{1: "v3"},
+		Previous: map[int]string{1: "v2"},
+	}}
+
+	desired := &DesiredState{Units: units, RetainedImages: releasedImages(units, apps)}
+	actual := &ActualState{
+		Images: []ActualImage{
+			{ID: "sha256:current", RepoTags: []string{"quay.io/smashwilson/az-pushbot:v3"}},
+			{ID: "sha256:previous", RepoTags: []string{"quay.io/smashwilson/az-pushbot:v2"}},
+			{ID: "sha256:ancient", RepoTags: []string{"quay.io/smashwilson/az-pushbot:v1"}},
+			{ID: "sha256:pinned", RepoTags: []string{}},
+			{ID: "sha256:dangling", RepoTags: []string{}},
+		},
+	}
+
+	_, images := orphans(desired, actual, nil)
+
+	removed := make([]string, 0, len(images))
+	for _, image := range images {
+		removed = append(removed, image.ID)
+	}
+	sort.Strings(removed)
+
+	expected := []string{"sha256:ancient", "sha256:dangling"}
+	if len(removed) != len(expected) {
+		t.Fatalf("removed %v, expected %v", removed, expected)
+	}
+	for i := range expected {
+		if removed[i] != expected[i] {
+			t.Fatalf("removed %v, expected %v", removed, expected)
+		}
+	}
+}
+
+func TestOrphansKeepsImagesOfUnmanagedContainers(t *testing.T) {
+	desired := &DesiredState{}
+	actual := &ActualState{
+		Images: []ActualImage{
+			{ID: "sha256:unmanaged", RepoTags: []string{"quay.io/smashwilson/az-debug:latest"}},
+			{ID: "sha256:stopped", RepoTags: []string{"quay.io/smashwilson/az-old:latest"}},
+			{ID: "sha256:unused", RepoTags: []string{"quay.io/smashwilson/az-unused:latest"}},
+		},
+		Containers: []ActualContainer{
+			{ID: "c1", Name: "old", ImageID: "sha256:stopped", State: "exited"},
+		},
+		UnmanagedImageIDs: map[string]bool{"sha256:unmanaged": true},
+	}
+
+	containers, images := orphans(desired, actual, nil)
+
+	if len(containers) != 1 || containers[0].ID != "c1" {
+		t.Errorf("removed containers %v, expected only the stopped managed container", containers)
+	}
+
+	removed := make([]string, 0, len(images))
+	for _, image := range images {
+		removed = append(removed, image.ID)
+	}
+	sort.Strings(removed)
+
+	expected := []string{"sha256:stopped", "sha256:unused"}
+	if len(removed) != len(expected) || removed[0] != expected[0] || removed[1] != expected[1] {
+		t.Errorf("removed %v, expected %v", removed, expected)
+	}
+}
@@ -0,0 +1,186 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The outcomes of probing a dependency.
+const (
+	DependencyOK      = "ok"
+	DependencyFailed  = "failed"
+	DependencySkipped = "skipped"
+)
+
+// dockerHubRegistry is the registry that serves images whose names don't begin with a registry host.
+const dockerHubRegistry = "registry-1.docker.io"
+
+// DependencyStatus reports whether one of the services that the coordinator relies on answered a probe, and how long
+// it took to answer. Critical dependencies are those that the coordinator can't sync without.
+type DependencyStatus struct {
+	Name          string `json:"name"`
+	Critical      bool   `json:"critical"`
+	Status        string `json:"status"`
+	LatencyMillis int64  `json:"latency_ms"`
+	Error         string `json:"error,omitempty"`
+}
+
+// DependenciesHealthy returns true if every critical dependency answered its probe.
+func DependenciesHealthy(statuses []DependencyStatus) bool {
+	for _, status := range statuses {
+		if status.Critical && status.Status == DependencyFailed {
+			return false
+		}
+	}
+	return true
+}
+
+// dependencyProbe checks one dependency, giving up once ctx is done.
+type dependencyProbe struct {
+	name     string
+	critical bool
+	check    func(ctx context.Context) error
+}
+
+// ProbeDependencies checks the database, the Docker daemon, systemd's DBus API, KMS, and the registry of every
+// desired unit's image at once, giving each probe up to timeout. Registries are reported as "registry <host>" and
+// aren't critical, since units keep running while their registry is unreachable.
+func (session SessionLease) ProbeDependencies(ctx context.Context, timeout time.Duration) []DependencyStatus {
+	probes := []dependencyProbe{
+		{name: "database", critical: true, check: session.db.PingContext},
+		{name: "docker", critical: true, check: func(ctx context.Context) error {
+			_, err := session.cli.ServerVersion(ctx)
+			return err
+		}},
+		{name: "dbus", critical: true, check: func(context.Context) error {
+			_, err := session.conn.ListUnitFilesByPatterns(nil, unitFilePatterns())
+			return err
+		}},
+	}
+	if session.ring != nil {
+		probes = append(probes, dependencyProbe{name: "kms", critical: true, check: session.ring.Probe})
+	}
+
+	registries, err := session.desiredRegistries(ctx)
+	if err != nil {
+		session.Log.WithError(err).Warn("Unable to list the registries of desired images.")
+	}
+	for _, registry := range registries {
+		registry := registry
+		probes = append(probes, dependencyProbe{
+			name:  "registry " + registry,
+			check: func(ctx context.Context) error { return probeRegistry(ctx, registry) },
+		})
+	}
+
+	statuses := make([]DependencyStatus, len(probes))
+	var wg sync.WaitGroup
+	for i, probe := range probes {
+		wg.Add(1)
+		go func(i int, probe dependencyProbe) {
+			defer wg.Done()
+			statuses[i] = runProbe(ctx, probe, timeout)
+		}(i, probe)
+	}
+	wg.Wait()
+
+	if session.ring == nil {
+		statuses = append(statuses, DependencyStatus{Name: "kms", Critical: true, Status: DependencySkipped})
+	}
+	return statuses
+}
+
+// runProbe performs one probe, abandoning it if it takes longer than timeout. Probes that don't accept a Context, like
+// the DBus one, are left to finish in the background.
+func runProbe(ctx context.Context, probe dependencyProbe, timeout time.Duration) DependencyStatus {
+	probeCtx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- probe.check(probeCtx) }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-probeCtx.Done():
+		err = fmt.Errorf("no answer within %s", timeout)
+	}
+
+	status := DependencyStatus{
+		Name:          probe.name,
+		Critical:      probe.critical,
+		Status:        DependencyOK,
+		LatencyMillis: time.Since(start).Nanoseconds() / int64(time.Millisecond),
+	}
+	if err != nil {
+		status.Status = DependencyFailed
+		status.Error = err.Error()
+	}
+	return status
+}
+
+// desiredRegistries lists the hosts of the registries that desired units' images are pulled from, sorted.
+func (session SessionLease) desiredRegistries(ctx context.Context) ([]string, error) {
+	desired, err := session.ReadDesiredState(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	registries := make([]string, 0)
+	for _, unit := range desired.Units {
+		if unit.Container == nil {
+			continue
+		}
+		registry := imageRegistry(unit.Container.ImageName)
+		if !seen[registry] {
+			seen[registry] = true
+			registries = append(registries, registry)
+		}
+	}
+	sort.Strings(registries)
+	return registries, nil
+}
+
+// imageRegistry returns the host of the registry that an image is pulled from. As in Docker, the first component of
+// the image's name is a registry host only if it contains a "." or a ":", or is "localhost".
+func imageRegistry(imageName string) string {
+	slash := strings.Index(imageName, "/")
+	if slash < 0 {
+		return dockerHubRegistry
+	}
+	first := imageName[:slash]
+	if !strings.ContainsAny(first, ".:") && first != "localhost" {
+		return dockerHubRegistry
+	}
+	if first == "docker.io" || first == "index.docker.io" {
+		return dockerHubRegistry
+	}
+	return first
+}
+
+// probeRegistry requests the base of a registry's API. Any answer short of a server error, including the 401 that
+// asks for credentials, shows that the registry is reachable.
+func probeRegistry(ctx context.Context, registry string) error {
+	req, err := http.NewRequest(http.MethodGet, "https://"+registry+"/v2/", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
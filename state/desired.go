@@ -2,16 +2,19 @@ package state
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
+	"unicode"
 
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/filters"
 	"github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/retry"
+	"github.com/smashwilson/az-coordinator/secrets"
 )
 
 // UnitType is an enumeration used to choose which template should be used to create a DesiredSystemdUnit's unit
@@ -22,7 +25,8 @@ const (
 	// TypeSimple units manage a persistent Docker container as a daemon.
 	TypeSimple UnitType = iota
 
-	// TypeTimer units fire another unit on a schedule.
+	// TypeTimer units fire another unit on a schedule. Timers that specify a container fire a companion oneshot unit
+	// that runs it, which the coordinator writes and removes along with the timer.
 	TypeTimer
 
 	// TypeOneShot units execute a container and expect it to terminate in an order fashion.
@@ -68,6 +72,11 @@ func (t *UnitType) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// String returns the name of a UnitType, as accepted by UnitTypeNamed.
+func (t UnitType) String() string {
+	return namesByType[t]
+}
+
 // MarshalJSON serializes a UnitType as a JSON string.
 func (t *UnitType) MarshalJSON() ([]byte, error) {
 	return json.Marshal(namesByType[*t])
@@ -75,19 +84,45 @@ func (t *UnitType) MarshalJSON() ([]byte, error) {
 
 // DesiredState describes the target state of the system based on the contents of the coordinator database.
 type DesiredState struct {
-	Units []DesiredSystemdUnit `json:"units"`
-	Files map[string][]byte    `json:"-"`
+	Units []DesiredSystemdUnit           `json:"units"`
+	Files map[string]secrets.DesiredFile `json:"-"`
+
+	// KeepUndesired leaves units that are present on the host but no longer desired in place, along with their
+	// containers and images.
+	KeepUndesired bool `json:"-"`
+
+	// RemoveProtected allows protected units that are no longer desired to be removed.
+	RemoveProtected bool `json:"-"`
+
+	// RetainedImages holds the image references, like "quay.io/smashwilson/az-pushbot:20190101", of each app's
+	// current and previous release. Their images are kept when orphaned images are removed, so that the app can be
+	// rolled back without pulling them again.
+	RetainedImages map[string]bool `json:"-"`
 }
 
+// The labels that record the Git commit, ref, and repository that an image was built from.
+const (
+	gitCommitLabel     = "net.azurefire.commit"
+	gitRefLabel        = "net.azurefire.ref"
+	gitRepositoryLabel = "net.azurefire.repository"
+)
+
 // DesiredDockerContainer contains information about the Docker container image to be used by a SystemD unit.
 type DesiredDockerContainer struct {
-	Name       string `json:"name,omitempty"`
-	ImageName  string `json:"image_name"`
-	ImageTag   string `json:"image_tag"`
-	ImageID    string `json:"-"`
-	GitOID     string `json:"-"`
-	GitRef     string `json:"-"`
-	Repository string `json:"-"`
+	Name      string `json:"name,omitempty"`
+	ImageName string `json:"image_name"`
+	ImageTag  string `json:"image_tag"`
+
+	// ImageID is the image that the container should run, and GitOID, GitRef, and Repository name the commit that it
+	// was built from. They aren't stored; ReadImages reads them from Docker.
+	ImageID    string `json:"image_id,omitempty"`
+	GitOID     string `json:"git_oid,omitempty"`
+	GitRef     string `json:"git_ref,omitempty"`
+	Repository string `json:"repository,omitempty"`
+
+	// PinnedImageID, if set, is run in place of the most recent image with ImageName and ImageTag. Images are still
+	// pulled, but the container isn't updated until it's unpinned.
+	PinnedImageID string `json:"pinned_image_id,omitempty"`
 }
 
 // DesiredSystemdUnit contains information about a SystemD unit managed by the coordinator.
@@ -101,22 +136,70 @@ type DesiredSystemdUnit struct {
 	Ports     map[int]int             `json:"ports"`
 	Volumes   map[string]string       `json:"volumes"`
 	Schedule  string                  `json:"calendar,omitempty"`
+
+	// Ulimits, ShmSize, Devices, ExtraHosts, and GPUs are passed to docker run as --ulimit, --shm-size, --device,
+	// --add-host, and --gpus.
+	Ulimits    map[string]string `json:"ulimits,omitempty"`
+	ShmSize    string            `json:"shm_size,omitempty"`
+	Devices    []string          `json:"devices,omitempty"`
+	ExtraHosts map[string]string `json:"extra_hosts,omitempty"`
+	GPUs       string            `json:"gpus,omitempty"`
+
+	// Enabled units are present on their hosts. Disabled units are stopped and their unit files removed, but their
+	// definitions are kept so that they can be enabled again.
+	Enabled bool `json:"enabled"`
+
+	// Protected units aren't removed by a sync unless it's forced, even once they're no longer desired. The
+	// coordinator's own unit is always protected.
+	Protected bool `json:"protected,omitempty"`
+
+	// Hosts lists the hosts in the fleet that this unit runs on. Units with no hosts run on every host.
+	Hosts []string `json:"hosts,omitempty"`
+
+	// Selector limits the unit to hosts that carry every one of these labels. An empty selector matches every host.
+	Selector map[string]string `json:"selector,omitempty"`
+
+	// AppID and App identify the app that this unit belongs to, if any.
+	AppID *int   `json:"app_id,omitempty"`
+	App   string `json:"app,omitempty"`
+
+	// Held units are left as they are by syncs, because their app is frozen or because the sync is limited to
+	// another app.
+	Held bool `json:"held,omitempty"`
+
+	// Companion is set on the oneshot unit generated to run the container of a timer unit. Companions are written and
+	// removed with their timer, but only the timer starts them.
+	Companion bool `json:"-"`
+
+	// Version counts the changes stored to the unit, and UpdatedAt records when the last one was made. Update only
+	// stores a unit if its Version is still current, so that concurrent changes aren't silently lost.
+	Version   int   `json:"version"`
+	UpdatedAt int64 `json:"updated_at"`
 }
 
-func (session SessionLease) readDesiredUnits(whereClause string, queryArgs ...interface{}) ([]DesiredSystemdUnit, error) {
+// ErrVersionConflict is returned by Update when the unit was changed by someone else since it was read.
+var ErrVersionConflict = errors.New("desired unit was changed since it was read")
+
+func (session SessionLease) readDesiredUnits(ctx context.Context, whereClause string, queryArgs ...interface{}) ([]DesiredSystemdUnit, error) {
 	var (
 		db  = session.db
 		log = session.Log
 	)
 
-	unitRows, err := db.Query(`
+	var unitRows *sql.Rows
+	err := retry.Transient(ctx, func() error {
+		var err error
+		unitRows, err = db.QueryContext(ctx, `
     	SELECT
       		id, path, type,
-      		container_name, container_image_name, container_image_tag,
+      		container_name, container_image_name, container_image_tag, pinned_image_id,
       		secrets, env, ports, volumes,
-      		schedule
+      		schedule, selector, app_id, runtime, enabled, protected,
+      		version, updated_at
 		FROM state_systemd_units
   	`+whereClause, queryArgs...)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -125,10 +208,12 @@ func (session SessionLease) readDesiredUnits(whereClause string, queryArgs ...in
 	units := make([]DesiredSystemdUnit, 0, 10)
 	for unitRows.Next() {
 		var (
-			rawSecrets []byte
-			rawEnv     []byte
-			rawPorts   []byte
-			rawVolumes []byte
+			rawSecrets  []byte
+			rawEnv      []byte
+			rawPorts    []byte
+			rawVolumes  []byte
+			rawSelector []byte
+			rawRuntime  []byte
 		)
 
 		unit := DesiredSystemdUnit{
@@ -136,9 +221,10 @@ func (session SessionLease) readDesiredUnits(whereClause string, queryArgs ...in
 		}
 		if err = unitRows.Scan(
 			&unit.ID, &unit.Path, &unit.Type,
-			&unit.Container.Name, &unit.Container.ImageName, &unit.Container.ImageTag,
+			&unit.Container.Name, &unit.Container.ImageName, &unit.Container.ImageTag, &unit.Container.PinnedImageID,
 			&rawSecrets, &rawEnv, &rawPorts, &rawVolumes,
-			&unit.Schedule,
+			&unit.Schedule, &rawSelector, &unit.AppID, &rawRuntime, &unit.Enabled, &unit.Protected,
+			&unit.Version, &unit.UpdatedAt,
 		); err != nil {
 			log.WithError(err).Warn("Unable to load state_systemd_units row.")
 			continue
@@ -166,39 +252,110 @@ func (session SessionLease) readDesiredUnits(whereClause string, queryArgs ...in
 			log.Warnf("Contents:\n%s\n---\n", rawVolumes)
 		}
 
+		if err = json.Unmarshal(rawSelector, &unit.Selector); err != nil {
+			log.WithError(err).WithField("unit", unit.UnitName()).Warn("Malformed selector column in state_systemd_units row")
+			log.Warnf("Contents:\n%s\n---\n", rawSelector)
+		}
+
+		if err = unit.unmarshalRuntime(rawRuntime); err != nil {
+			log.WithError(err).WithField("unit", unit.UnitName()).Warn("Malformed runtime column in state_systemd_units row")
+			log.Warnf("Contents:\n%s\n---\n", rawRuntime)
+		}
+
 		unit.normalizeNils()
 
 		units = append(units, unit)
 	}
 
+	hosts, err := readUnitHosts(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	apps, err := readApps(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	appsByID := make(map[int]App, len(apps))
+	for _, app := range apps {
+		appsByID[app.ID] = app
+	}
+
+	for i := range units {
+		units[i].Hosts = hosts[*units[i].ID]
+		if units[i].AppID != nil {
+			app := appsByID[*units[i].AppID]
+			units[i].App = app.Name
+			units[i].Held = app.Frozen
+		}
+	}
+
 	return units, nil
 }
 
 // ReadDesiredState queries the database for the currently configured desired system state. DesiredDockerContainers
 // within the returned state will have no ImageID.
-func (session SessionLease) ReadDesiredState() (*DesiredState, error) {
+func (session SessionLease) ReadDesiredState(ctx context.Context) (*DesiredState, error) {
 	secrets, err := session.GetSecrets()
 	if err != nil {
 		return nil, err
 	}
 
-	units, err := session.readDesiredUnits("")
+	units, err := session.readDesiredUnits(ctx, "")
 	if err != nil {
 		return nil, err
 	}
 
-	files, err := secrets.DesiredTLSFiles()
+	files, err := secrets.DesiredFiles()
 	if err != nil {
 		return nil, err
 	}
 
-	return &DesiredState{Units: units, Files: files}, nil
+	apps, err := readApps(ctx, session.db)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DesiredState{Units: units, Files: files, RetainedImages: releasedImages(units, apps)}, nil
+}
+
+// releasedImages lists the image references of the containers in each app's current and previous release.
+func releasedImages(units []DesiredSystemdUnit, apps []App) map[string]bool {
+	unitsByID := make(map[int]DesiredSystemdUnit, len(units))
+	for _, unit := range units {
+		unitsByID[*unit.ID] = unit
+	}
+
+	images := make(map[string]bool)
+	for _, app := range apps {
+		for _, release := range []map[int]string{app.Released, app.Previous} {
+			for id, tag := range release {
+				if unit, ok := unitsByID[id]; ok && unit.Container != nil {
+					images[unit.Container.ImageName+":"+tag] = true
+				}
+			}
+		}
+	}
+	return images
 }
 
 // ReadDesiredUnit queries the database to load one specific desired systemd unit. It returns nil if no unit with the
 // requested id exists.
-func (session SessionLease) ReadDesiredUnit(id int) (*DesiredSystemdUnit, error) {
-	units, err := session.readDesiredUnits("WHERE id = $1", id)
+func (session SessionLease) ReadDesiredUnit(ctx context.Context, id int) (*DesiredSystemdUnit, error) {
+	units, err := session.readDesiredUnits(ctx, "WHERE id = $1", id)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(units) == 0 {
+		return nil, nil
+	}
+
+	return &units[0], nil
+}
+
+// ReadDesiredUnitByPath loads the desired unit whose unit file is written to path. It returns nil if there is none.
+func (session SessionLease) ReadDesiredUnitByPath(ctx context.Context, path string) (*DesiredSystemdUnit, error) {
+	units, err := session.readDesiredUnits(ctx, "WHERE path = $1", path)
 	if err != nil {
 		return nil, err
 	}
@@ -211,39 +368,35 @@ func (session SessionLease) ReadDesiredUnit(id int) (*DesiredSystemdUnit, error)
 }
 
 // ReadImages queries Docker for the most recently created container images corresponding to the image names and tags requested by
-// each DesiredSystemdUnit. This call populates the ImageID of each DesiredDockerContainer.
-func (state *DesiredState) ReadImages(session *SessionLease) error {
+// each DesiredSystemdUnit. This call populates the ImageID of each DesiredDockerContainer. Pinned containers keep their
+// pinned image.
+func (state *DesiredState) ReadImages(ctx context.Context, session *SessionLease) error {
 	for i := range state.Units {
 		unit := &state.Units[i]
 		if unit.Container == nil {
 			continue
 		}
 
-		imageSummaries, err := session.cli.ImageList(context.Background(), types.ImageListOptions{
-			Filters: filters.NewArgs(filters.Arg("reference", unit.Container.ImageName+":"+unit.Container.ImageTag)),
-		})
-		if err != nil {
-			return err
-		}
-
-		var highest int64
-		for _, imageSummary := range imageSummaries {
-			if imageSummary.Created > highest {
-				unit.Container.ImageID = imageSummary.ID
-				highest = imageSummary.Created
+		if len(unit.Container.PinnedImageID) > 0 {
+			unit.Container.ImageID = unit.Container.PinnedImageID
+		} else {
+			id, err := session.newestImageID(ctx, *unit.Container)
+			if err != nil {
+				return err
 			}
+			unit.Container.ImageID = id
 		}
 
 		if len(unit.Container.ImageID) > 0 {
-			image, _, err := session.cli.ImageInspectWithRaw(context.Background(), unit.Container.ImageID)
+			image, _, err := session.cli.ImageInspectWithRaw(ctx, unit.Container.ImageID)
 			if err != nil {
 				return err
 			}
 
 			labels := image.Config.Labels
-			unit.Container.GitOID = labels["net.azurefire.commit"]
-			unit.Container.GitRef = labels["net.azurefire.ref"]
-			unit.Container.Repository = labels["net.azurefire.repository"]
+			unit.Container.GitOID = labels[gitCommitLabel]
+			unit.Container.GitRef = labels[gitRefLabel]
+			unit.Container.Repository = labels[gitRepositoryLabel]
 		}
 	}
 
@@ -251,129 +404,241 @@ func (state *DesiredState) ReadImages(session *SessionLease) error {
 }
 
 // UndesireUnit requests that a unit should no longer be present on the system by removing it from the database.
-func (session Session) UndesireUnit(id int) error {
-	var db = session.db
+func (session SessionLease) UndesireUnit(ctx context.Context, id int) error {
+	unit, err := session.ReadDesiredUnit(ctx, id)
+	if err != nil || unit == nil {
+		return err
+	}
 
-	_, err := db.Exec(`
-		DELETE FROM state_systemd_units WHERE id = $1
-	`, id)
-	return err
+	return session.inTransaction(ctx, func(tx *sql.Tx) error {
+		return unit.remove(ctx, tx)
+	})
 }
 
 // MakeDesired persists its caller within the database. Future calls to ReadDesiredState will include this unit
-// in its output.
-func (unit DesiredSystemdUnit) MakeDesired(session SessionLease) error {
+// in its output. Like Update and UndesireUnit, it records the change in the unit's history. Once it's stored, the
+// unit is updated to match the stored unit, including its new ID and version.
+func (unit *DesiredSystemdUnit) MakeDesired(ctx context.Context, session SessionLease) error {
 	if unit.ID != nil {
-		return fmt.Errorf("Attempt to re-persist already persisted unit: %d", unit.ID)
+		return fmt.Errorf("Attempt to re-persist already persisted unit: %d", *unit.ID)
 	}
-	unit.normalizeNils()
 
-	var db = session.db
+	// Inserts are not retried: one whose acknowledgement was lost with its connection would be duplicated.
+	stored := *unit
+	err := session.inTransaction(ctx, func(tx *sql.Tx) error {
+		return stored.insert(ctx, tx)
+	})
+	if err != nil {
+		return err
+	}
 
-	rawSecrets, err := json.Marshal(unit.Secrets)
+	*unit = stored
+	return nil
+}
+
+// Update modifies an existing unit in the database to match its in-memory representation, as long as the stored unit
+// is still at the unit's Version. If it isn't, nothing is changed and ErrVersionConflict is returned. Otherwise, the
+// unit's Version and UpdatedAt are advanced to match the stored unit.
+func (unit *DesiredSystemdUnit) Update(ctx context.Context, session SessionLease) error {
+	if unit.ID == nil {
+		return errors.New("Attempt to update an un-persisted desired unit")
+	}
+
+	var stored DesiredSystemdUnit
+	err := retry.Transient(ctx, func() error {
+		stored = *unit
+		return session.inTransaction(ctx, func(tx *sql.Tx) error {
+			return stored.update(ctx, tx)
+		})
+	})
 	if err != nil {
 		return err
 	}
 
-	rawEnv, err := json.Marshal(unit.Env)
+	*unit = stored
+	return nil
+}
+
+// querier runs statements with either the database or a transaction.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// inTransaction calls fn with a new transaction, which is committed if fn succeeds and rolled back if it doesn't.
+func (session SessionLease) inTransaction(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := session.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// columnValues encodes the settings of the unit as the values of the state_systemd_units columns from path through
+// enabled, in the order that they're declared.
+func (unit DesiredSystemdUnit) columnValues() ([]interface{}, error) {
+	rawSecrets, err := json.Marshal(unit.Secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	rawEnv, err := json.Marshal(unit.Env)
+	if err != nil {
+		return nil, err
+	}
+
 	rawPorts, err := json.Marshal(unit.Ports)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	rawVolumes, err := json.Marshal(unit.Volumes)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	rawSelector, err := json.Marshal(unit.Selector)
+	if err != nil {
+		return nil, err
+	}
+
+	rawRuntime, err := unit.marshalRuntime()
+	if err != nil {
+		return nil, err
 	}
 
 	var (
 		containerName      = ""
 		containerImageName = ""
 		containerImageTag  = ""
+		pinnedImageID      = ""
 	)
 	if unit.Container != nil {
 		containerName = unit.Container.Name
 		containerImageName = unit.Container.ImageName
 		containerImageTag = unit.Container.ImageTag
+		pinnedImageID = unit.Container.PinnedImageID
+	}
+
+	return []interface{}{
+		unit.Path, unit.Type,
+		containerName, containerImageName, containerImageTag, pinnedImageID,
+		rawSecrets, rawEnv, rawPorts, rawVolumes,
+		unit.Schedule, rawSelector, unit.AppID, rawRuntime, unit.Enabled, unit.Protected,
+	}, nil
+}
+
+// insert stores the unit as a new desired unit with q, and records its creation in its history. The unit's ID,
+// Version, and UpdatedAt are set to match the stored unit.
+func (unit *DesiredSystemdUnit) insert(ctx context.Context, q querier) error {
+	unit.normalizeNils()
+
+	values, err := unit.columnValues()
+	if err != nil {
+		return err
 	}
 
-	createdRow := db.QueryRow(`
+	createdAt := time.Now().Unix()
+	createdRow := q.QueryRowContext(ctx, `
     INSERT INTO state_systemd_units
       (path, type,
-        container_name, container_image_name, container_image_tag,
+        container_name, container_image_name, container_image_tag, pinned_image_id,
         secrets, env, ports, volumes,
-        schedule)
-    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+        schedule, selector, app_id, runtime, enabled, protected,
+        version, updated_at)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, 1, $17)
 	RETURNING id
-  `,
-		unit.Path, unit.Type,
-		containerName, containerImageName, containerImageTag,
-		rawSecrets, rawEnv, rawPorts, rawVolumes,
-		unit.Schedule,
-	)
-
-	return createdRow.Scan(&unit.ID)
-}
+  `, append(values, createdAt)...)
 
-// Update modifies an existing unit in the database to match its in-memory representation.
-func (unit DesiredSystemdUnit) Update(session SessionLease) error {
-	if unit.ID == nil {
-		return errors.New("Attempt to update an un-persisted desired unit")
+	if err := createdRow.Scan(&unit.ID); err != nil {
+		return err
 	}
+	unit.Version, unit.UpdatedAt = 1, createdAt
 
-	var db = session.db
+	if err := replaceUnitHosts(ctx, q, *unit.ID, unit.Hosts); err != nil {
+		return err
+	}
+	return recordRevision(ctx, q, *unit, RevisionCreated)
+}
 
-	rawSecrets, err := json.Marshal(unit.Secrets)
+// update stores the settings of the unit with q, as long as the stored unit is still at the unit's Version, and
+// records the change in its history. The unit's Version and UpdatedAt are advanced to match the stored unit.
+func (unit *DesiredSystemdUnit) update(ctx context.Context, q querier) error {
+	values, err := unit.columnValues()
 	if err != nil {
 		return err
 	}
 
-	rawEnv, err := json.Marshal(unit.Env)
+	updatedAt := time.Now().Unix()
+	result, err := q.ExecContext(ctx, `
+	UPDATE state_systemd_units
+	SET
+		path = $1, type = $2,
+		container_name = $3, container_image_name = $4, container_image_tag = $5, pinned_image_id = $6,
+		secrets = $7, env = $8, ports = $9, volumes = $10,
+		schedule = $11, selector = $12, app_id = $13, runtime = $14, enabled = $15, protected = $16,
+		version = version + 1, updated_at = $17
+	WHERE id = $18 AND version = $19
+	`, append(values, updatedAt, *unit.ID, unit.Version)...)
 	if err != nil {
 		return err
 	}
+	if updated, err := result.RowsAffected(); err != nil {
+		return err
+	} else if updated == 0 {
+		return ErrVersionConflict
+	}
+	unit.Version++
+	unit.UpdatedAt = updatedAt
 
-	rawPorts, err := json.Marshal(unit.Ports)
-	if err != nil {
+	if err := replaceUnitHosts(ctx, q, *unit.ID, unit.Hosts); err != nil {
 		return err
 	}
+	return recordRevision(ctx, q, *unit, RevisionUpdated)
+}
 
-	rawVolumes, err := json.Marshal(unit.Volumes)
+// remove deletes the unit with q, as long as the stored unit is still at the unit's Version, and records its removal
+// in its history.
+func (unit DesiredSystemdUnit) remove(ctx context.Context, q querier) error {
+	result, err := q.ExecContext(ctx, "DELETE FROM state_systemd_units WHERE id = $1 AND version = $2", *unit.ID, unit.Version)
 	if err != nil {
 		return err
 	}
+	if deleted, err := result.RowsAffected(); err != nil {
+		return err
+	} else if deleted == 0 {
+		return ErrVersionConflict
+	}
 
-	var (
-		containerName      = ""
-		containerImageName = ""
-		containerImageTag  = ""
-	)
-	if unit.Container != nil {
-		containerName = unit.Container.Name
-		containerImageName = unit.Container.ImageName
-		containerImageTag = unit.Container.ImageTag
+	if err := replaceUnitHosts(ctx, q, *unit.ID, nil); err != nil {
+		return err
 	}
+	return recordRevision(ctx, q, unit, RevisionDeleted)
+}
 
-	_, err = db.Exec(`
-	UPDATE state_systemd_units
-	SET
-		path = $1, type = $2,
-		container_name = $3, container_image_name = $4, container_image_tag = $5,
-		secrets = $6, env = $7, ports = $8, volumes = $9,
-		schedule = $10
-	WHERE id = $11
-	`,
-		unit.Path, unit.Type,
-		containerName, containerImageName, containerImageTag,
-		rawSecrets, rawEnv, rawPorts, rawVolumes,
-		unit.Schedule,
-		unit.ID,
-	)
-	return err
+// UnitNamed returns the managed unit with the given systemd unit name, or nil if none has it.
+func (state DesiredState) UnitNamed(name string) *DesiredSystemdUnit {
+	for _, unit := range state.managedUnits() {
+		if unit.UnitName() == name {
+			return &unit
+		}
+	}
+	return nil
+}
+
+// UnitForContainer returns the managed unit that runs the container with the given name, or nil if none does.
+func (state DesiredState) UnitForContainer(name string) *DesiredSystemdUnit {
+	for _, unit := range state.managedUnits() {
+		if unit.Container != nil && unit.Container.Name == name {
+			return &unit
+		}
+	}
+	return nil
 }
 
 // UnitName derives the SystemD logical unit name from the path of its source on disk.
@@ -381,6 +646,17 @@ func (unit DesiredSystemdUnit) UnitName() string {
 	return path.Base(unit.Path)
 }
 
+// ETag identifies the stored version of the unit, as a quoted HTTP entity tag, so that clients can tell whether the
+// unit has changed since they read it. The ID is included so that a unit that's removed and created again doesn't
+// match the tags of the one it replaced.
+func (unit DesiredSystemdUnit) ETag() string {
+	id := 0
+	if unit.ID != nil {
+		id = *unit.ID
+	}
+	return fmt.Sprintf(`"%d-%d"`, id, unit.Version)
+}
+
 // Ensure slice and map members are initialized to zero-length objects instead of nil. This prevents them
 // from appearing in JSON output as "null".
 func (unit *DesiredSystemdUnit) normalizeNils() {
@@ -396,6 +672,9 @@ func (unit *DesiredSystemdUnit) normalizeNils() {
 	if unit.Volumes == nil {
 		unit.Volumes = make(map[string]string, 0)
 	}
+	if unit.Selector == nil {
+		unit.Selector = make(map[string]string, 0)
+	}
 }
 
 // DesiredSystemdUnitBuilder incrementally constructs and validates a DesiredUnit.
@@ -406,7 +685,7 @@ type DesiredSystemdUnitBuilder struct {
 // BuildDesiredUnit creates a builder that can construct a new DesiredSystemdUnit.
 func BuildDesiredUnit() DesiredSystemdUnitBuilder {
 	return DesiredSystemdUnitBuilder{
-		unit: &DesiredSystemdUnit{},
+		unit: &DesiredSystemdUnit{Enabled: true},
 	}
 }
 
@@ -435,25 +714,65 @@ func (builder *DesiredSystemdUnitBuilder) validate() error {
 			return errors.New("Invalid missing container")
 		}
 
-		if !strings.HasPrefix(builder.unit.Container.ImageName, "quay.io/smashwilson/az-") && !strings.HasPrefix(builder.unit.Container.ImageName, "smashwilson/az-") {
+		if !isManagedImageName(builder.unit.Container.ImageName) {
 			logrus.WithField("imageName", builder.unit.Container.ImageName).Warn("Attempt to create desired unit with invalid container image.")
-			return errors.New("invalid container image name")
+			return errors.New("invalid container image name: not in allowed_images")
 		}
 
 		if len(builder.unit.Container.ImageTag) == 0 {
 			return errors.New("invalid empty container image tag")
 		}
+	case TypeTimer:
+		if builder.unit.Container == nil {
+			break
+		}
+
+		if !isManagedImageName(builder.unit.Container.ImageName) {
+			logrus.WithField("imageName", builder.unit.Container.ImageName).Warn("Attempt to create desired unit with invalid container image.")
+			return errors.New("invalid container image name: not in allowed_images")
+		}
+
+		if len(builder.unit.Container.ImageTag) == 0 {
+			return errors.New("invalid empty container image tag")
+		}
+
+		if filepath.Ext(builder.unit.Path) != ".timer" {
+			return errors.New("timer units that run a container must have a path ending in .timer")
+		}
 	default:
 		if builder.unit.Container != nil {
 			return errors.New("attempt to specify container information for unit type that does not use one")
 		}
 	}
 
+	if builder.unit.Container != nil {
+		if len(builder.unit.Container.Name) > 0 && !dockerNameRx.MatchString(builder.unit.Container.Name) {
+			return fmt.Errorf("invalid container name: %q", builder.unit.Container.Name)
+		}
+
+		if len(builder.unit.Container.ImageTag) > 0 && !imageTagRx.MatchString(builder.unit.Container.ImageTag) {
+			return fmt.Errorf("invalid container image tag: %q", builder.unit.Container.ImageTag)
+		}
+	}
+
+	if builder.unit.Container == nil && builder.unit.hasRuntime() {
+		return errors.New("attempt to specify docker run flags for a unit without a container")
+	}
+
+	if builder.unit.Type == TypeSelf && !builder.unit.Enabled {
+		return errors.New("the coordinator's own unit may not be disabled")
+	}
+
 	// Check schedule.
 	if builder.unit.Type == TypeTimer {
 		if len(builder.unit.Schedule) == 0 {
 			return errors.New("timer units must have a schedule")
 		}
+
+		// OnCalendar= can't be quoted, so a schedule must not be able to start a new line.
+		if strings.IndexFunc(builder.unit.Schedule, unicode.IsControl) >= 0 {
+			return fmt.Errorf("invalid schedule: %q", builder.unit.Schedule)
+		}
 	} else {
 		if len(builder.unit.Schedule) > 0 {
 			return errors.New("non-timer units may not have a schedule")
@@ -465,18 +784,18 @@ func (builder *DesiredSystemdUnitBuilder) validate() error {
 	return nil
 }
 
-// Path populates the path on disk to the unit file. Must be within the directory `/etc/systemd/system` and
-// begin with `az-`.
+// Path populates the path on disk to the unit file. Must be within the configured unit directory, like
+// `/etc/systemd/system`, and begin with the configured unit prefix, like `az-`.
 func (builder *DesiredSystemdUnitBuilder) Path(path string) error {
 	path = filepath.Clean(path)
 	dirName, fileName := filepath.Split(path)
 
-	if dirName != "/etc/systemd/system/" {
+	if dirName != UnitDirectory() {
 		logrus.WithField("path", path).Warn("Attempt to create desired unit file in invalid directory.")
 		return errors.New("attempt to create desired unit in invalid directory")
 	}
 
-	if !strings.HasPrefix(fileName, "az-") {
+	if !strings.HasPrefix(fileName, UnitPrefix()) {
 		logrus.WithField("path", path).Warn("Attempt to create desired unit file with invalid prefix.")
 		return errors.New("Attempt to create desired unit with invalid filename")
 	}
@@ -495,7 +814,7 @@ func (builder *DesiredSystemdUnitBuilder) Type(tp UnitType) error {
 }
 
 // Container validates and populates information about the container used by this service. The container's image must
-// begin with `smashwilson/az-`. If the type has already been set, it is used to validate whether or not
+// be from one of the allowed repositories. If the type has already been set, it is used to validate whether or not
 // a container is expected to be set or not.
 func (builder *DesiredSystemdUnitBuilder) Container(imageName string, imageTag string, name string) error {
 	if len(imageName) == 0 && len(imageTag) == 0 {
@@ -511,8 +830,12 @@ func (builder *DesiredSystemdUnitBuilder) Container(imageName string, imageTag s
 	return nil
 }
 
-// Secrets populates the secrets requested by this unit.
+// Secrets populates the secrets requested by this unit. Each key must satisfy the secret naming policy and be
+// present in the session's secrets.
 func (builder *DesiredSystemdUnitBuilder) Secrets(keys []string, session SessionLease) error {
+	if err := secrets.CurrentPolicy().ValidateKeys(keys); err != nil {
+		return err
+	}
 	if err := session.ValidateSecretKeys(keys); err != nil {
 		return err
 	}
@@ -540,8 +863,28 @@ func (builder *DesiredSystemdUnitBuilder) Volumes(volumes map[string]string) err
 	return nil
 }
 
-// Env populates the environment variable map given to the container or process.
-func (builder *DesiredSystemdUnitBuilder) Env(env map[string]string) error {
+// Env populates the environment variable map given to the container or process. Values may refer to secrets with
+// {{ secret "KEY" }}, which is replaced with the secret's value when the unit is rendered.
+func (builder *DesiredSystemdUnitBuilder) Env(env map[string]string, session SessionLease) error {
+	keys := make([]string, 0)
+	for name, value := range env {
+		if !envNameRx.MatchString(name) {
+			return fmt.Errorf("invalid env name %q: use letters, digits, and underscores", name)
+		}
+		if err := checkEnvSecrets(name, value); err != nil {
+			return err
+		}
+		keys = append(keys, secretRefs(value)...)
+	}
+	if len(keys) > 0 {
+		if err := secrets.CurrentPolicy().ValidateKeys(keys); err != nil {
+			return err
+		}
+		if err := session.ValidateSecretKeys(keys); err != nil {
+			return err
+		}
+	}
+
 	builder.unit.Env = env
 	return nil
 }
@@ -558,6 +901,19 @@ func (builder *DesiredSystemdUnitBuilder) Schedule(schedule string) error {
 	return nil
 }
 
+// Enabled chooses whether the unit is present on its hosts. Disabling a unit removes it from its hosts, but keeps its
+// definition.
+func (builder *DesiredSystemdUnitBuilder) Enabled(enabled bool) error {
+	builder.unit.Enabled = enabled
+	return nil
+}
+
+// Protected chooses whether syncs refuse to remove the unit unless they're forced.
+func (builder *DesiredSystemdUnitBuilder) Protected(protected bool) error {
+	builder.unit.Protected = protected
+	return nil
+}
+
 // Build performs final validation checks and, if successful, returns the constructed DesiredSystemdUnit.
 func (builder *DesiredSystemdUnitBuilder) Build() (*DesiredSystemdUnit, error) {
 	if err := builder.validate(); err != nil {
@@ -0,0 +1,117 @@
+package state
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/store"
+)
+
+// testSession leases a session backed by a fresh SQLite database, for tests that only touch stored state.
+func testSession(t *testing.T) (SessionLease, func()) {
+	dir, err := ioutil.TempDir("", "az-coordinator-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := store.Open("sqlite://" + filepath.Join(dir, "state.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	cleanup := func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+
+	for _, statement := range db.Dialect.Schema() {
+		if _, err := db.Exec(statement); err != nil {
+			cleanup()
+			t.Fatalf("unable to create schema: %v", err)
+		}
+	}
+
+	return SessionLease{Session: &Session{db: db}, Log: logrus.StandardLogger()}, cleanup
+}
+
+func TestMakeDesiredReturnsStoredID(t *testing.T) {
+	ctx := context.Background()
+	session, cleanup := testSession(t)
+	defer cleanup()
+
+	created := make([]*DesiredSystemdUnit, 0, 2)
+	for _, name := range []string{"first", "second"} {
+		unit := &DesiredSystemdUnit{
+			Path: filepath.Join(UnitDirectory(), UnitPrefix()+name+".service"),
+			Type: TypeSimple,
+			Container: &DesiredDockerContainer{
+				Name:      name,
+				ImageName: "quay.io/smashwilson/" + name,
+				ImageTag:  "latest",
+			},
+			Env:     map[string]string{"NAME": name},
+			Enabled: true,
+		}
+		if err := unit.MakeDesired(ctx, session); err != nil {
+			t.Fatalf("unable to create %s: %v", name, err)
+		}
+		if unit.ID == nil {
+			t.Fatalf("created %s has no ID", name)
+		}
+		if unit.Version != 1 {
+			t.Errorf("created %s has version %d, expected 1", name, unit.Version)
+		}
+		created = append(created, unit)
+	}
+	if *created[0].ID == *created[1].ID {
+		t.Fatalf("both units were given ID %d", *created[0].ID)
+	}
+
+	listed, err := session.readDesiredUnits(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != len(created) {
+		t.Fatalf("listed %d units, expected %d", len(listed), len(created))
+	}
+
+	for _, unit := range created {
+		var stored *DesiredSystemdUnit
+		for i := range listed {
+			if *listed[i].ID == *unit.ID {
+				stored = &listed[i]
+			}
+		}
+		if stored == nil {
+			t.Errorf("no stored unit has ID %d, returned for %s", *unit.ID, unit.Path)
+			continue
+		}
+		if stored.Path != unit.Path {
+			t.Errorf("stored unit %d has path %s, expected %s", *unit.ID, stored.Path, unit.Path)
+		}
+		if stored.Container == nil || stored.Container.Name != unit.Container.Name {
+			t.Errorf("stored unit %d has container %v, expected %s", *unit.ID, stored.Container, unit.Container.Name)
+		}
+		if stored.Version != unit.Version || stored.UpdatedAt != unit.UpdatedAt {
+			t.Errorf(
+				"stored unit %d is at version %d (%d), returned at version %d (%d)",
+				*unit.ID, stored.Version, stored.UpdatedAt, unit.Version, unit.UpdatedAt,
+			)
+		}
+		if stored.ETag() != unit.ETag() {
+			t.Errorf("stored unit %d has ETag %s, returned %s", *unit.ID, stored.ETag(), unit.ETag())
+		}
+	}
+
+	read, err := session.ReadDesiredUnit(ctx, *created[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read == nil || read.Path != created[1].Path {
+		t.Errorf("ReadDesiredUnit(%d) returned %v, expected %s", *created[1].ID, read, created[1].Path)
+	}
+}
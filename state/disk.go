@@ -0,0 +1,76 @@
+package state
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// DockerDataPath is the directory that stores Docker images and containers. Its usage level drives automatic prunes.
+const DockerDataPath = "/var/lib/docker"
+
+// WatchedPaths lists the directories whose partitions are included in health reports.
+var WatchedPaths = []string{DockerDataPath, "/", "/etc/ssl/az"}
+
+// DiskUsage describes the capacity of the partition that contains a path.
+type DiskUsage struct {
+	Path         string `json:"path"`
+	TotalBytes   uint64 `json:"total_bytes"`
+	FreeBytes    uint64 `json:"free_bytes"`
+	UsagePercent int    `json:"usage_percent"`
+}
+
+// ReadPathUsage reports the capacity of the partition that contains path. Like df, free space counts only the blocks
+// that are available to unprivileged users, and the usage percentage is rounded up.
+func ReadPathUsage(path string) (DiskUsage, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return DiskUsage{Path: path}, err
+	}
+
+	blockSize := uint64(stat.Bsize)
+	used := stat.Blocks - stat.Bfree
+	usable := used + stat.Bavail
+
+	usage := DiskUsage{
+		Path:       path,
+		TotalBytes: stat.Blocks * blockSize,
+		FreeBytes:  stat.Bavail * blockSize,
+	}
+	if usable > 0 {
+		usage.UsagePercent = int((used*100 + usable - 1) / usable)
+	}
+	return usage, nil
+}
+
+// ReadDiskUsage reads the current usage level of the disk partition that stores Docker images and returns it as a
+// percentage.
+func (s SessionLease) ReadDiskUsage(ctx context.Context) (int, error) {
+	usage, err := ReadPathUsage(DockerDataPath)
+	if err != nil {
+		return 0, err
+	}
+
+	s.Log.WithFields(logrus.Fields{
+		"path":      usage.Path,
+		"freeBytes": usage.FreeBytes,
+		"usage":     usage.UsagePercent,
+	}).Debug("Disk usage read.")
+	return usage.UsagePercent, nil
+}
+
+// ReadWatchedDiskUsage reports the capacity of each partition in WatchedPaths. Paths that can't be read are logged
+// and omitted.
+func (s SessionLease) ReadWatchedDiskUsage(ctx context.Context) []DiskUsage {
+	usages := make([]DiskUsage, 0, len(WatchedPaths))
+	for _, path := range WatchedPaths {
+		usage, err := ReadPathUsage(path)
+		if err != nil {
+			s.Log.WithError(err).WithField("path", path).Warn("Unable to read disk usage.")
+			continue
+		}
+		usages = append(usages, usage)
+	}
+	return usages
+}
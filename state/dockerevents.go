@@ -0,0 +1,106 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// dockerEventsBackoff is the delay before the Docker event stream is reopened after it fails.
+const dockerEventsBackoff = 5 * time.Second
+
+// DockerEvent is a change to a container or image that was reported by the Docker daemon.
+type DockerEvent struct {
+	// Type is "container" or "image".
+	Type string
+
+	// Action is what happened, like "start", "die", "oom", or "pull".
+	Action string
+
+	// ID identifies the container or image. For image pulls, it's the image reference.
+	ID string
+
+	// Attributes are the details that Docker attached to the event, like the container's "name" and "image", or the
+	// "exitCode" of a container that died.
+	Attributes map[string]string
+
+	Time time.Time
+}
+
+// ContainerDeath describes a managed container that stopped when it wasn't expected to.
+type ContainerDeath struct {
+	Unit      string `json:"unit"`
+	Container string `json:"container"`
+	ExitCode  string `json:"exit_code,omitempty"`
+
+	// OOM is true if the container was killed for running out of memory.
+	OOM bool `json:"oom,omitempty"`
+
+	// Restoring is true if a sync was started to restart the container's unit.
+	Restoring bool `json:"restoring,omitempty"`
+}
+
+// Cause explains why the container stopped.
+func (d ContainerDeath) Cause() string {
+	if d.OOM {
+		return "was killed for running out of memory"
+	}
+	return fmt.Sprintf("exited with code %s", d.ExitCode)
+}
+
+// WatchDockerEvents calls handle with each container and image event reported by the Docker daemon until ctx is done.
+// If the event stream fails, it's reopened after a short delay. Container exec and health check events are frequent
+// and never change the host, so they're skipped.
+func (s SessionLease) WatchDockerEvents(ctx context.Context, handle func(DockerEvent)) {
+	options := types.EventsOptions{
+		Filters: filters.NewArgs(filters.Arg("type", "container"), filters.Arg("type", "image")),
+	}
+
+	for {
+		messages, errs := s.cli.Events(ctx, options)
+		s.Log.Debug("Watching Docker events.")
+
+	stream:
+		for {
+			select {
+			case message := <-messages:
+				if strings.HasPrefix(message.Action, "exec_") || strings.HasPrefix(message.Action, "health_status") {
+					continue
+				}
+				handle(DockerEvent{
+					Type:       message.Type,
+					Action:     message.Action,
+					ID:         message.Actor.ID,
+					Attributes: message.Actor.Attributes,
+					Time:       time.Unix(0, message.TimeNano),
+				})
+			case err := <-errs:
+				if ctx.Err() != nil {
+					return
+				}
+				s.Log.WithError(err).WithField("backoff", dockerEventsBackoff).Warn("Docker event stream failed. Reopening it.")
+				break stream
+			}
+		}
+
+		select {
+		case <-time.After(dockerEventsBackoff):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ContainerOOMKilled returns true if the container with the given ID was killed for running out of memory. A container
+// that's already been removed is assumed not to have been.
+func (s SessionLease) ContainerOOMKilled(ctx context.Context, id string) bool {
+	container, err := s.cli.ContainerInspect(ctx, id)
+	if err != nil || container.ContainerJSONBase == nil || container.State == nil {
+		return false
+	}
+	return container.State.OOMKilled
+}
@@ -2,79 +2,355 @@ package state
 
 import (
 	"context"
-	"io/ioutil"
-	"os/exec"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"regexp"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/network"
+	units "github.com/docker/go-units"
 	"github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/tracing"
 )
 
-// PullAllImages concurrently pulls the latest versions of all Docker container images used by desired SystemD units
-// referenced by the current system state. Call this between ReadDesiredState and ReadImages to desire the most recently
-// published version of each image.
-func (s SessionLease) PullAllImages(state DesiredState) []error {
-	errs := make([]error, 0)
+// PullPolicy limits the image pulls performed by a sync.
+type PullPolicy struct {
+	// Concurrency is the number of images pulled at once. Zero or less pulls them all at once.
+	Concurrency int
+
+	// Timeout limits each attempt to pull an image. Zero means no limit.
+	Timeout time.Duration
+
+	// Attempts is the number of times each pull is tried before it fails. Zero or less tries each pull once.
+	Attempts int
+}
+
+// PullFailure reports an image that couldn't be pulled.
+type PullFailure struct {
+	Ref      string `json:"ref"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error"`
+}
+
+// initialPullBackoff is the delay before an image pull is retried for the first time. It doubles after each subsequent
+// failure.
+const initialPullBackoff = 2 * time.Second
+
+// PullAllImages pulls the latest versions of all Docker container images used by desired SystemD units referenced by
+// the current system state, as many at once as policy allows. Call this between ReadDesiredState and ReadImages to
+// desire the most recently published version of each image. Images whose local copy already matches the digest in
+// their registry aren't pulled again. Failed pulls are retried with an exponentially increasing
+// delay, and those that still fail are returned, sorted by image reference, without interrupting the others. Pulls
+// that haven't finished when ctx is done are abandoned and returned as failures. If onProgress is non-nil, it's called
+// with the progress of each pull as it's downloaded, from the goroutine performing that pull.
+func (s SessionLease) PullAllImages(ctx context.Context, state DesiredState, policy PullPolicy, onProgress func(ImagePullProgress)) (failures []PullFailure) {
+	ctx, span := tracing.Start(ctx, "PullAllImages")
+	defer func() {
+		span.SetAttribute("images.failed", len(failures))
+		span.End()
+	}()
+
+	failures = make([]PullFailure, 0)
 
 	imageRefs := make(map[string]bool, len(state.Units))
 	for _, unit := range state.Units {
-		if unit.Container != nil && len(unit.Container.ImageName) > 0 && len(unit.Container.ImageTag) > 0 {
+		if !unit.Held && unit.Enabled && unit.Container != nil && len(unit.Container.ImageName) > 0 && len(unit.Container.ImageTag) > 0 {
 			ref := unit.Container.ImageName + ":" + unit.Container.ImageTag
 			imageRefs[ref] = true
 			s.Log.WithField("ref", ref).Debug("Scheduling docker pull.")
 		}
 	}
 
-	s.Log.WithField("count", len(imageRefs)).Debug("Beginning docker pulls.")
-	results := make(chan error, len(imageRefs))
+	concurrency := policy.Concurrency
+	if concurrency <= 0 || concurrency > len(imageRefs) {
+		concurrency = len(imageRefs)
+	}
+
+	span.SetAttribute("images.count", len(imageRefs))
+	s.Log.WithFields(logrus.Fields{
+		"count":       len(imageRefs),
+		"concurrency": concurrency,
+	}).Debug("Beginning docker pulls.")
+
+	type pullResult struct {
+		ref      string
+		attempts int
+		err      error
+		skipped  bool
+	}
+
+	results := make(chan pullResult, len(imageRefs))
+	slots := make(chan struct{}, concurrency)
 	for ref := range imageRefs {
-		go s.pullImage(ref, results)
+		go func(ref string) {
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-ctx.Done():
+				results <- pullResult{ref: ref, err: ctx.Err()}
+				return
+			}
+
+			if s.imageUnchanged(ctx, ref) {
+				if onProgress != nil {
+					onProgress(ImagePullProgress{Ref: ref, Status: "Digest unchanged", Layers: map[string]LayerProgress{}, Done: true})
+				}
+				results <- pullResult{ref: ref, skipped: true}
+				return
+			}
+
+			attempts, err := s.pullImageWithRetries(ctx, ref, policy, onProgress)
+			results <- pullResult{ref: ref, attempts: attempts, err: err}
+		}(ref)
 	}
-	for i := 0; i < len(imageRefs); i++ {
-		err := <-results
-		if err != nil {
-			errs = append(errs, err)
+
+	skipped := 0
+	pending := imageRefs
+	for len(pending) > 0 {
+		select {
+		case result := <-results:
+			delete(pending, result.ref)
+			if result.skipped {
+				skipped++
+			}
+			if result.err != nil {
+				failures = append(failures, PullFailure{Ref: result.ref, Attempts: result.attempts, Error: result.err.Error()})
+			}
+		case <-ctx.Done():
+			for ref := range pending {
+				failures = append(failures, PullFailure{Ref: ref, Error: ctx.Err().Error()})
+			}
+			pending = nil
 		}
 	}
-	s.Log.WithField("count", len(imageRefs)).Debug("Docker pulls complete.")
+	sort.Slice(failures, func(i, j int) bool { return failures[i].Ref < failures[j].Ref })
+
+	for _, failure := range failures {
+		span.RecordError(fmt.Errorf("unable to pull %s: %s", failure.Ref, failure.Error))
+		s.Log.WithFields(logrus.Fields{
+			"ref":      failure.Ref,
+			"attempts": failure.Attempts,
+			"error":    failure.Error,
+		}).Warn("Unable to pull container image.")
+	}
+	span.SetAttribute("images.skipped", skipped)
+	s.Log.WithFields(logrus.Fields{
+		"count":   len(imageRefs),
+		"skipped": skipped,
+		"failed":  len(failures),
+	}).Debug("Docker pulls complete.")
 
-	return errs
+	return failures
 }
 
+// imageUnchanged returns true if the local copy of an image has the same manifest digest as the one in its registry,
+// so that pulling it again would change nothing. Images that aren't present locally, and those whose registry can't be
+// asked, are assumed to have changed.
+func (s SessionLease) imageUnchanged(ctx context.Context, ref string) bool {
+	local, _, err := s.cli.ImageInspectWithRaw(ctx, ref)
+	if err != nil || len(local.RepoDigests) == 0 {
+		return false
+	}
+
+	remote, err := s.cli.DistributionInspect(ctx, ref, "")
+	if err != nil {
+		s.Log.WithError(err).WithField("ref", ref).Debug("Unable to read the image's digest from its registry.")
+		return false
+	}
+
+	digest := remote.Descriptor.Digest.String()
+	for _, repoDigest := range local.RepoDigests {
+		if strings.HasSuffix(repoDigest, "@"+digest) {
+			s.Log.WithFields(logrus.Fields{
+				"ref":    ref,
+				"digest": digest,
+			}).Debug("Container image digest unchanged. Skipping pull.")
+			return true
+		}
+	}
+	return false
+}
+
+// pullImageWithRetries pulls an image, retrying failed attempts as policy allows. It returns the number of attempts
+// that were made and the error of the last one.
+func (s SessionLease) pullImageWithRetries(ctx context.Context, ref string, policy PullPolicy, onProgress func(ImagePullProgress)) (int, error) {
+	backoff := initialPullBackoff
+	attempt := 1
+	for {
+		attemptCtx, cancel := withTimeout(ctx, policy.Timeout)
+		err := s.pullImage(attemptCtx, ref, onProgress)
+		cancel()
+		if err == nil || attempt >= policy.Attempts || ctx.Err() != nil {
+			return attempt, err
+		}
+
+		s.Log.WithError(err).WithFields(logrus.Fields{
+			"ref":     ref,
+			"attempt": attempt,
+			"backoff": backoff,
+		}).Warn("Unable to pull container image. Retrying.")
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return attempt, err
+		}
+		backoff *= 2
+		attempt++
+	}
+}
+
+// LayerProgress is the state of one layer of an image that's being pulled.
+type LayerProgress struct {
+	Status  string `json:"status"`
+	Current int64  `json:"current,omitempty"`
+	Total   int64  `json:"total,omitempty"`
+}
+
+// ImagePullProgress is the state of one image pull, as reported by the Docker daemon.
+type ImagePullProgress struct {
+	Ref    string                   `json:"ref"`
+	Status string                   `json:"status"`
+	Layers map[string]LayerProgress `json:"layers"`
+	Done   bool                     `json:"done"`
+}
+
+// Downloaded sums the bytes downloaded so far and the total size of the layers whose size is known.
+func (p ImagePullProgress) Downloaded() (current, total int64) {
+	for _, layer := range p.Layers {
+		current += layer.Current
+		total += layer.Total
+	}
+	return current, total
+}
+
+// pullMessage is one of the JSON messages streamed by the Docker daemon during an image pull.
+type pullMessage struct {
+	ID             string `json:"id"`
+	Status         string `json:"status"`
+	ProgressDetail struct {
+		Current int64 `json:"current"`
+		Total   int64 `json:"total"`
+	} `json:"progressDetail"`
+	Error string `json:"error"`
+}
+
+const (
+	// pullProgressInterval is the least time between two progress callbacks for the same pull.
+	pullProgressInterval = time.Second
+
+	// pullLogInterval is the least time between two progress log entries for the same pull.
+	pullLogInterval = 10 * time.Second
+)
+
 var (
 	rxUpToDate        = regexp.MustCompile(`Status: Image is up to date`)
 	rxDownloadedNewer = regexp.MustCompile(`Status: Downloaded newer image`)
 )
 
-func (s SessionLease) pullImage(ref string, done chan<- error) {
-	progress, err := s.cli.ImagePull(context.Background(), ref, types.ImagePullOptions{})
+func (s SessionLease) pullImage(ctx context.Context, ref string, onProgress func(ImagePullProgress)) error {
+	ctx, span := tracing.Start(ctx, "pullImage")
+	span.SetAttribute("image.ref", ref)
+	defer span.End()
+
+	stream, err := s.cli.ImagePull(ctx, ref, types.ImagePullOptions{})
 	if err != nil {
-		done <- err
-		return
+		span.RecordError(err)
+		return err
 	}
-	defer progress.Close()
+	defer stream.Close()
 
-	payload, err := ioutil.ReadAll(progress)
-	if err != nil {
-		done <- err
-		return
+	progress := ImagePullProgress{Ref: ref, Layers: make(map[string]LayerProgress)}
+	var lastReport, lastLog time.Time
+	report := func(force bool) {
+		now := time.Now()
+		if onProgress != nil && (force || now.Sub(lastReport) >= pullProgressInterval) {
+			onProgress(progress.snapshot())
+			lastReport = now
+		}
+		if now.Sub(lastLog) >= pullLogInterval {
+			if !lastLog.IsZero() && !progress.Done {
+				current, total := progress.Downloaded()
+				s.Log.WithFields(logrus.Fields{
+					"ref":        ref,
+					"layers":     len(progress.Layers),
+					"downloaded": current,
+					"total":      total,
+				}).Info("Pulling container image.")
+			}
+			lastLog = now
+		}
+	}
+	report(true)
+
+	final := ""
+	decoder := json.NewDecoder(stream)
+	for {
+		var message pullMessage
+		if err := decoder.Decode(&message); err == io.EOF {
+			break
+		} else if err != nil {
+			span.RecordError(err)
+			return err
+		}
+
+		if len(message.Error) > 0 {
+			err := errors.New(message.Error)
+			span.RecordError(err)
+			return err
+		}
+
+		if len(message.ID) == 0 || strings.HasPrefix(message.Status, "Pulling from") {
+			// Messages without a layer ID describe the pull as a whole.
+			progress.Status = message.Status
+			if rxUpToDate.MatchString(message.Status) || rxDownloadedNewer.MatchString(message.Status) {
+				final = message.Status
+			}
+		} else {
+			layer := progress.Layers[message.ID]
+			layer.Status = message.Status
+			if message.ProgressDetail.Total > 0 {
+				layer.Current = message.ProgressDetail.Current
+				layer.Total = message.ProgressDetail.Total
+			}
+			progress.Layers[message.ID] = layer
+		}
+		report(false)
 	}
 
-	if rxUpToDate.Match(payload) {
+	progress.Done = true
+	report(true)
+
+	if rxUpToDate.MatchString(final) {
 		s.Log.WithField("ref", ref).Debug("Container image already current.")
-	} else if rxDownloadedNewer.Match(payload) {
+	} else if rxDownloadedNewer.MatchString(final) {
 		s.Log.WithField("ref", ref).Info("Container image updated.")
 	} else {
-		s.Log.WithField("ref", ref).Warningf("Unrecognized ImagePull payload:\n%s\n---\n", payload)
+		s.Log.WithField("ref", ref).Warningf("Unrecognized ImagePull status: %s", progress.Status)
 	}
 
-	done <- nil
+	return nil
+}
+
+// snapshot copies the progress, so that it isn't changed by the messages that follow.
+func (p ImagePullProgress) snapshot() ImagePullProgress {
+	layers := make(map[string]LayerProgress, len(p.Layers))
+	for id, layer := range p.Layers {
+		layers[id] = layer
+	}
+	p.Layers = layers
+	return p
 }
 
 // CreateNetwork ensures that the expected Docker backplane network is present.
-func (s SessionLease) CreateNetwork() error {
-	networks, err := s.cli.NetworkList(context.Background(), types.NetworkListOptions{})
+func (s SessionLease) CreateNetwork(ctx context.Context) error {
+	networks, err := s.cli.NetworkList(ctx, types.NetworkListOptions{})
 	if err != nil {
 		return err
 	}
@@ -91,13 +367,14 @@ func (s SessionLease) CreateNetwork() error {
 		}
 	}
 
-	response, err := s.cli.NetworkCreate(context.Background(), "local", types.NetworkCreate{
+	response, err := s.cli.NetworkCreate(ctx, "local", types.NetworkCreate{
 		CheckDuplicate: true,
 		Driver:         "bridge",
 		IPAM: &network.IPAM{
 			Driver: "default",
 		},
 		Internal: false,
+		Labels:   map[string]string{ManagedLabel: "true"},
 	})
 	if err != nil {
 		return err
@@ -107,14 +384,150 @@ func (s SessionLease) CreateNetwork() error {
 	return nil
 }
 
-// Prune removes stopped containers and unused container images to reclaim disk space.
-func (s SessionLease) Prune() {
-	out, err := exec.Command("docker", "system", "prune", "--all", "--force").Output()
-	if err != nil {
-		if exitError, ok := err.(*exec.ExitError); ok {
-			s.Log.WithField("exitCode", exitError.ExitCode()).Warnf("docker prune command exited abnormally:\n%s\n", exitError.Stderr)
+// PruneMode selects the unused Docker data that Prune removes.
+type PruneMode string
+
+const (
+	// PruneImages removes only unused container images.
+	PruneImages PruneMode = "images"
+
+	// PruneAll removes stopped containers and unused networks that carry the ManagedLabel, as well as unused images.
+	PruneAll PruneMode = "all"
+)
+
+// ManagedLabel is set to "true" on the containers that the coordinator's units run and the network that it creates.
+// Only containers and networks with this label are pruned or removed as orphans, so that unrelated Docker workloads on
+// the same host are left alone.
+const ManagedLabel = "io.azcoordinator.managed"
+
+// legacyManagedLabel marks the containers that were run by units rendered before ManagedLabel was introduced.
+const legacyManagedLabel = "az-managed"
+
+// isManagedContainer returns true if a container's labels mark it as run by one of the coordinator's units.
+func isManagedContainer(labels map[string]string) bool {
+	return labels[ManagedLabel] == "true" || labels[legacyManagedLabel] == "true"
+}
+
+// PrunePolicy configures automatic pruning during a sync.
+type PrunePolicy struct {
+	// ThresholdPercent is the disk usage at or above which a sync prunes. Zero disables automatic pruning.
+	ThresholdPercent int
+
+	// Mode chooses what is pruned. The zero value behaves like PruneAll.
+	Mode PruneMode
+
+	// MinImageAge protects images, containers, and networks created more recently than this from being pruned.
+	MinImageAge time.Duration
+}
+
+// PruneCategory reports what a prune removed of one kind of Docker data. Removing networks reclaims no space.
+type PruneCategory struct {
+	Deleted        int    `json:"deleted"`
+	ReclaimedBytes uint64 `json:"reclaimed_bytes"`
+}
+
+// PruneResult reports the outcome of a prune. Reclaimed totals the space reclaimed by every category.
+type PruneResult struct {
+	Mode             PruneMode     `json:"mode"`
+	DiskUsagePercent int           `json:"disk_usage_percent"`
+	Reclaimed        string        `json:"reclaimed"`
+	Images           PruneCategory `json:"images"`
+	Containers       PruneCategory `json:"containers"`
+	Networks         PruneCategory `json:"networks"`
+	Timestamp        int64         `json:"timestamp"`
+}
+
+// Prune removes unused Docker data, as chosen by policy's Mode and MinImageAge, to reclaim disk space. Containers are
+// pruned first, so that the images that only they used can be pruned too.
+func (s SessionLease) Prune(ctx context.Context, policy PrunePolicy) (*PruneResult, error) {
+	mode := policy.Mode
+	if len(mode) == 0 {
+		mode = PruneAll
+	}
+	if mode != PruneImages && mode != PruneAll {
+		return nil, fmt.Errorf("Unrecognized prune mode: %s", mode)
+	}
+
+	age := filters.NewArgs()
+	if policy.MinImageAge > 0 {
+		age.Add("until", policy.MinImageAge.String())
+	}
+	managedFilters := make([]filters.Args, 0, 2)
+	for _, label := range []string{ManagedLabel, legacyManagedLabel} {
+		managed := age.Clone()
+		managed.Add("label", label+"=true")
+		managedFilters = append(managedFilters, managed)
+	}
+
+	result := &PruneResult{Mode: mode, Timestamp: time.Now().Unix()}
+
+	if mode == PruneAll {
+		for _, managed := range managedFilters {
+			containers, err := s.cli.ContainersPrune(ctx, managed)
+			if err != nil {
+				return nil, err
+			}
+			result.Containers.Deleted += len(containers.ContainersDeleted)
+			result.Containers.ReclaimedBytes += containers.SpaceReclaimed
+
+			networks, err := s.cli.NetworksPrune(ctx, managed)
+			if err != nil {
+				return nil, err
+			}
+			result.Networks.Deleted += len(networks.NetworksDeleted)
 		}
-		return
 	}
-	s.Log.Debugf("docker system prune --all --force:\n%s\n", out)
+
+	// Without dangling=false, only untagged images would be pruned.
+	unused := age.Clone()
+	unused.Add("dangling", "false")
+	images, err := s.cli.ImagesPrune(ctx, unused)
+	if err != nil {
+		return nil, err
+	}
+	result.Images = PruneCategory{Deleted: len(images.ImagesDeleted), ReclaimedBytes: images.SpaceReclaimed}
+
+	result.Reclaimed = units.HumanSize(float64(result.Images.ReclaimedBytes + result.Containers.ReclaimedBytes))
+
+	if usage, err := s.ReadDiskUsage(ctx); err == nil {
+		result.DiskUsagePercent = usage
+	}
+
+	s.Log.WithFields(logrus.Fields{
+		"mode":       result.Mode,
+		"reclaimed":  result.Reclaimed,
+		"images":     result.Images.Deleted,
+		"containers": result.Containers.Deleted,
+		"networks":   result.Networks.Deleted,
+		"usage":      result.DiskUsagePercent,
+	}).Info("Pruned unused docker data.")
+
+	return result, nil
+}
+
+// autoPrune prunes if the disk usage has reached the policy's threshold. It returns nil if no prune was needed.
+func (s SessionLease) autoPrune(ctx context.Context, policy PrunePolicy) (*PruneResult, error) {
+	if policy.ThresholdPercent <= 0 {
+		s.Log.Debug("Automatic pruning is disabled.")
+		return nil, nil
+	}
+
+	usage, err := s.ReadDiskUsage(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if usage < policy.ThresholdPercent {
+		s.Log.WithFields(logrus.Fields{
+			"usage":     usage,
+			"threshold": policy.ThresholdPercent,
+		}).Info("No prune necessary yet.")
+		return nil, nil
+	}
+
+	s.Log.WithFields(logrus.Fields{
+		"usage":     usage,
+		"threshold": policy.ThresholdPercent,
+	}).Warn("Disk is getting full: pruning unused docker data.")
+	return s.Prune(ctx, policy)
 }
@@ -0,0 +1,150 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"time"
+)
+
+// drainableUnits lists the managed units on this host, other than the one that runs the coordinator. Units that
+// systemd would start at boot, because their unit files have an [Install] section, are listed in bootUnits as well.
+func (session SessionLease) drainableUnits(ctx context.Context) (units []string, bootUnits map[string]bool, err error) {
+	selfName := DefaultSelfUnitName()
+	if session.db != nil {
+		if self, err := session.ReadSelfUnit(ctx); err != nil {
+			session.Log.WithError(err).Warn("Unable to read the coordinator's unit. Sparing the default unit.")
+		} else if self != nil {
+			selfName = self.UnitName()
+		}
+	}
+
+	listedUnits, err := session.conn.ListUnitFilesByPatterns(nil, unitFilePatterns())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	units = make([]string, 0, len(listedUnits))
+	bootUnits = make(map[string]bool, len(listedUnits))
+	for _, listedUnit := range listedUnits {
+		unitName := path.Base(listedUnit.Path)
+		if unitName == selfName {
+			continue
+		}
+		units = append(units, unitName)
+
+		content, err := ioutil.ReadFile(listedUnit.Path)
+		if err != nil {
+			session.Log.WithError(err).WithField("path", listedUnit.Path).Warn("Unable to read unit file contents.")
+			continue
+		}
+		if bytes.Contains(content, []byte("\n[Install]\n")) {
+			bootUnits[unitName] = true
+		}
+	}
+	return units, bootUnits, nil
+}
+
+// drainStages groups units into the stages that a drain stops them in: each unit named in order, one at a time, then
+// every remaining unit together. Names in order that aren't among units are skipped.
+func drainStages(units []string, order []string) [][]string {
+	present := make(map[string]bool, len(units))
+	for _, unitName := range units {
+		present[unitName] = true
+	}
+
+	stages := make([][]string, 0, len(order)+1)
+	ordered := make(map[string]bool, len(order))
+	for _, unitName := range order {
+		if present[unitName] && !ordered[unitName] {
+			ordered[unitName] = true
+			stages = append(stages, []string{unitName})
+		}
+	}
+
+	rest := make([]string, 0, len(units))
+	for _, unitName := range units {
+		if !ordered[unitName] {
+			rest = append(rest, unitName)
+		}
+	}
+	if len(rest) > 0 {
+		stages = append(stages, rest)
+	}
+	return stages
+}
+
+// runStage starts or stops each unit in a stage, then waits up to timeout for systemd to finish.
+func (session SessionLease) runStage(ctx context.Context, units []string, start bool, timeout time.Duration) []error {
+	errs := make([]error, 0)
+	results := make(chan string, len(units))
+
+	for _, unitName := range units {
+		var err error
+		if start {
+			session.Log.WithField("unitName", unitName).Debug("Starting unit.")
+			_, err = session.conn.StartUnit(unitName, "replace", results)
+		} else {
+			session.Log.WithField("unitName", unitName).Debug("Stopping unit.")
+			_, err = session.conn.StopUnit(unitName, "replace", results)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Unable to start or stop unit %s (%v)", unitName, err))
+			results <- ""
+		}
+	}
+
+	stageCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := awaitJobs(stageCtx, results, len(units)); err != nil {
+		errs = append(errs, fmt.Errorf("Timed out waiting for units %v (%v)", units, err))
+	}
+	return errs
+}
+
+// Drain stops every managed unit on this host except the coordinator's own, for maintenance. Units named in order are
+// stopped first, one at a time; the rest are stopped together. Each stage waits up to timeout. Unit files and desired
+// state are left alone, so that Undrain or a reboot brings the units back. The names of the stopped units are
+// returned.
+func (session SessionLease) Drain(ctx context.Context, order []string, timeout time.Duration) ([]string, []error) {
+	units, _, err := session.drainableUnits(ctx)
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	errs := make([]error, 0)
+	for _, stage := range drainStages(units, order) {
+		errs = append(errs, session.runStage(ctx, stage, false, timeout)...)
+	}
+	session.Log.WithField("count", len(units)).Info("Units drained.")
+
+	return units, errs
+}
+
+// Undrain starts the managed units that would be started at boot, reversing the stages of Drain: every unit that
+// isn't named in order first, then the units named in order, last to first. Oneshot units are not run. The names of
+// the started units are returned.
+func (session SessionLease) Undrain(ctx context.Context, order []string, timeout time.Duration) ([]string, []error) {
+	units, bootUnits, err := session.drainableUnits(ctx)
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	started := make([]string, 0, len(bootUnits))
+	for _, unitName := range units {
+		if bootUnits[unitName] {
+			started = append(started, unitName)
+		}
+	}
+
+	errs := make([]error, 0)
+	stages := drainStages(started, order)
+	for i := len(stages) - 1; i >= 0; i-- {
+		errs = append(errs, session.runStage(ctx, stages[i], true, timeout)...)
+	}
+	session.Log.WithField("count", len(started)).Info("Units undrained.")
+
+	return started, errs
+}
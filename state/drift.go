@@ -0,0 +1,80 @@
+package state
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/smashwilson/az-coordinator/retry"
+)
+
+// The kinds of DriftEvent.
+const (
+	// DriftStopped units became inactive while the coordinator wasn't stopping them.
+	DriftStopped = "stopped"
+
+	// DriftFailed units entered systemd's failed state.
+	DriftFailed = "failed"
+
+	// DriftEdited units had their unit files changed on disk since systemd last loaded them.
+	DriftEdited = "edited"
+
+	// DriftUnmanaged units were started even though they aren't desired on the host.
+	DriftUnmanaged = "unmanaged"
+)
+
+// DriftEvent records a change to a managed unit that the coordinator didn't make, like a unit that was stopped or
+// edited by hand.
+type DriftEvent struct {
+	ID         int    `json:"id"`
+	Host       string `json:"host"`
+	Unit       string `json:"unit"`
+	Kind       string `json:"kind"`
+	Detail     string `json:"detail"`
+	DetectedAt int64  `json:"detected_at"`
+}
+
+// RecordDrift stores a DriftEvent that was detected now.
+func (session SessionLease) RecordDrift(ctx context.Context, e DriftEvent) (*DriftEvent, error) {
+	e.DetectedAt = time.Now().Unix()
+
+	// Inserts are not retried, as in CreateApp.
+	row := session.db.QueryRowContext(
+		ctx,
+		"INSERT INTO drift_events (host, unit, kind, detail, detected_at) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		e.Host, e.Unit, e.Kind, e.Detail, e.DetectedAt,
+	)
+	if err := row.Scan(&e.ID); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// ReadDrift loads the most recent DriftEvents detected on a host, newest first.
+func (session SessionLease) ReadDrift(ctx context.Context, host string, limit int) ([]DriftEvent, error) {
+	var rows *sql.Rows
+	err := retry.Transient(ctx, func() error {
+		var err error
+		rows, err = session.db.QueryContext(
+			ctx,
+			"SELECT id, host, unit, kind, detail, detected_at FROM drift_events "+
+				"WHERE host = $1 ORDER BY detected_at DESC, id DESC LIMIT $2",
+			host, limit,
+		)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	drift := make([]DriftEvent, 0)
+	for rows.Next() {
+		var e DriftEvent
+		if err := rows.Scan(&e.ID, &e.Host, &e.Unit, &e.Kind, &e.Detail, &e.DetectedAt); err != nil {
+			return nil, err
+		}
+		drift = append(drift, e)
+	}
+	return drift, rows.Err()
+}
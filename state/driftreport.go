@@ -0,0 +1,271 @@
+package state
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/smashwilson/az-coordinator/retry"
+)
+
+// The kinds of DriftFinding.
+const (
+	// FindingMissing units are desired, but absent from the host.
+	FindingMissing = "missing"
+
+	// FindingModified units have files that were changed on disk since the coordinator last wrote them.
+	FindingModified = "modified"
+
+	// FindingOutdated units have files or images that the coordinator would update, because desired state or the
+	// unit's image changed since the last sync.
+	FindingOutdated = "outdated"
+
+	// FindingRestartPending units would be restarted, because a secret or a mounted file that they use changed.
+	FindingRestartPending = "restart_pending"
+
+	// FindingUndesired units are present on the host, but no longer desired.
+	FindingUndesired = "undesired"
+
+	// FindingOrphanedContainer containers carry the ManagedLabel, but no unit runs them any more.
+	FindingOrphanedContainer = "orphaned_container"
+
+	// FindingUnmanagedContainer containers are named like the coordinator's, but weren't started by a desired unit.
+	FindingUnmanagedContainer = "unmanaged_container"
+
+	// FindingUnmanagedUnit unit files are named like the coordinator's, but weren't written by it and aren't desired.
+	FindingUnmanagedUnit = "unmanaged_unit"
+)
+
+// DriftFinding is one difference between the host and its desired state.
+type DriftFinding struct {
+	Kind      string `json:"kind"`
+	Unit      string `json:"unit,omitempty"`
+	Container string `json:"container,omitempty"`
+	Detail    string `json:"detail"`
+}
+
+// DriftReport classifies the differences between the host and its desired state, without pulling images or changing
+// anything.
+type DriftReport struct {
+	Host      string         `json:"host"`
+	CheckedAt int64          `json:"checked_at"`
+	Findings  []DriftFinding `json:"findings"`
+	Counts    map[string]int `json:"counts"`
+	Delta     Delta          `json:"delta"`
+}
+
+// hashUnitContent computes the digest of a unit file that's recorded when the coordinator writes it.
+func hashUnitContent(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// recordUnitHashes records the digest of each unit file that the Delta wrote on host, so that later changes made by
+// hand can be told apart from changes to desired state. Removed units are forgotten.
+func (s SessionLease) recordUnitHashes(ctx context.Context, host string, d Delta) error {
+	now := time.Now().Unix()
+	for _, units := range [][]DesiredSystemdUnit{d.UnitsToAdd, d.UnitsToChange} {
+		for _, unit := range units {
+			content, err := ioutil.ReadFile(unit.Path)
+			if err != nil {
+				return err
+			}
+
+			err = retry.Transient(ctx, func() error {
+				_, err := s.db.ExecContext(
+					ctx,
+					`INSERT INTO unit_file_hashes (host, path, hash, written_at) VALUES ($1, $2, $3, $4)
+					ON CONFLICT (host, path) DO UPDATE SET hash = excluded.hash, written_at = excluded.written_at`,
+					host, unit.Path, hashUnitContent(content), now,
+				)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, unit := range d.UnitsToRemove {
+		err := retry.Transient(ctx, func() error {
+			_, err := s.db.ExecContext(ctx, "DELETE FROM unit_file_hashes WHERE host = $1 AND path = $2", host, unit.Path)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readUnitHashes loads the digests of the unit files that the coordinator last wrote on host, by path.
+func (s SessionLease) readUnitHashes(ctx context.Context, host string) (map[string]string, error) {
+	var rows *sql.Rows
+	err := retry.Transient(ctx, func() error {
+		var err error
+		rows, err = s.db.QueryContext(ctx, "SELECT path, hash FROM unit_file_hashes WHERE host = $1", host)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hashes := make(map[string]string)
+	for rows.Next() {
+		var path, hash string
+		if err := rows.Scan(&path, &hash); err != nil {
+			return nil, err
+		}
+		hashes[path] = hash
+	}
+	return hashes, rows.Err()
+}
+
+// DetectDrift compares the host with the desired state of the units that run on it, and classifies each difference.
+// Unlike a sync, it uses the images that are already present rather than pulling new ones, and changes nothing.
+func (s SessionLease) DetectDrift(ctx context.Context, host string, labels map[string]string) (*DriftReport, error) {
+	all, err := s.ReadDesiredState(ctx)
+	if err != nil {
+		return nil, err
+	}
+	desired := all.ForHost(host, labels)
+	if err := desired.ReadImages(ctx, &s); err != nil {
+		return nil, err
+	}
+
+	actual, err := s.ReadActualState(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if errs := actual.ReadImages(ctx, &s, desired); len(errs) > 0 {
+		return nil, errs[0]
+	}
+
+	hashes, err := s.readUnitHashes(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	delta := s.Between(ctx, &desired, actual)
+	report := &DriftReport{
+		Host:      host,
+		CheckedAt: time.Now().Unix(),
+		Findings:  make([]DriftFinding, 0),
+		Counts:    make(map[string]int),
+		Delta:     delta,
+	}
+	add := func(f DriftFinding) {
+		report.Findings = append(report.Findings, f)
+		report.Counts[f.Kind]++
+	}
+
+	actualByPath := make(map[string]ActualSystemdUnit, len(actual.Units))
+	for _, unit := range actual.Units {
+		actualByPath[unit.Path] = unit
+	}
+
+	for _, unit := range delta.UnitsToAdd {
+		add(DriftFinding{Kind: FindingMissing, Unit: unit.UnitName(), Detail: "desired, but not present on the host"})
+	}
+
+	for _, unit := range delta.UnitsToChange {
+		recorded, ok := hashes[unit.Path]
+		if ok && recorded != hashUnitContent(actualByPath[unit.Path].Content) {
+			add(DriftFinding{Kind: FindingModified, Unit: unit.UnitName(), Detail: "unit file was changed since the coordinator wrote it"})
+		} else if _, differs := delta.UnitDiffs[unit.UnitName()]; differs {
+			add(DriftFinding{Kind: FindingOutdated, Unit: unit.UnitName(), Detail: "desired state changed since the last sync"})
+		} else {
+			add(DriftFinding{Kind: FindingOutdated, Unit: unit.UnitName(), Detail: "a newer container image is present"})
+		}
+	}
+
+	for _, unit := range delta.UnitsToRestart {
+		detail := "a mounted file changed"
+		if changed := delta.SecretsChanged[unit.UnitName()]; len(changed) > 0 {
+			detail = fmt.Sprintf("secrets changed: %s", strings.Join(changed, ", "))
+		}
+		add(DriftFinding{Kind: FindingRestartPending, Unit: unit.UnitName(), Detail: detail})
+	}
+
+	for _, unit := range delta.UnitsToRemove {
+		detail := "present on the host, but no longer desired"
+		if unit.Orphaned {
+			detail = "unit file left on disk, but not loaded by systemd"
+		}
+		add(DriftFinding{Kind: FindingUndesired, Unit: unit.UnitName(), Detail: detail})
+	}
+
+	desiredNames := make(map[string]bool)
+	for _, unit := range desired.managedUnits() {
+		desiredNames[unit.UnitName()] = true
+	}
+	for _, unit := range actual.Units {
+		if !unit.Managed && !desiredNames[unit.UnitName()] {
+			add(DriftFinding{Kind: FindingUnmanagedUnit, Unit: unit.UnitName(), Detail: "unit file lacks the coordinator's marker"})
+		}
+	}
+
+	for _, container := range delta.ContainersToRemove {
+		add(DriftFinding{Kind: FindingOrphanedContainer, Container: container.Name, Detail: fmt.Sprintf("%s, created from %s", container.State, container.Image)})
+	}
+
+	unmanaged, err := s.unmanagedContainers(ctx, desired)
+	if err != nil {
+		return nil, err
+	}
+	for _, container := range unmanaged {
+		add(DriftFinding{Kind: FindingUnmanagedContainer, Container: container.Name, Detail: fmt.Sprintf("%s, created from %s", container.State, container.Image)})
+	}
+
+	sort.SliceStable(report.Findings, func(i, j int) bool {
+		a, b := report.Findings[i], report.Findings[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Unit+a.Container < b.Unit+b.Container
+	})
+	return report, nil
+}
+
+// unmanagedContainers lists the containers with names beginning with the unit prefix that no desired unit runs and that
+// don't carry the ManagedLabel, like those started by hand with "docker run".
+func (s SessionLease) unmanagedContainers(ctx context.Context, desired DesiredState) ([]ActualContainer, error) {
+	containers, err := s.cli.ContainerList(ctx, types.ContainerListOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+
+	desiredNames := make(map[string]bool)
+	for _, unit := range desired.managedUnits() {
+		if unit.Container != nil {
+			desiredNames[unit.Container.Name] = true
+		}
+	}
+
+	unmanaged := make([]ActualContainer, 0)
+	for _, container := range containers {
+		if len(container.Names) == 0 || isManagedContainer(container.Labels) {
+			continue
+		}
+		name := strings.TrimPrefix(container.Names[0], "/")
+		if !strings.HasPrefix(name, UnitPrefix()) || desiredNames[name] {
+			continue
+		}
+		unmanaged = append(unmanaged, ActualContainer{
+			ID:      container.ID,
+			Name:    name,
+			Image:   container.Image,
+			ImageID: container.ImageID,
+			State:   container.State,
+		})
+	}
+	return unmanaged, nil
+}
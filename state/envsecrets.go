@@ -0,0 +1,91 @@
+package state
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/smashwilson/az-coordinator/secrets"
+)
+
+// envSecretRx matches a reference to a secret within an environment variable's value, like {{ secret "DB_PASS" }}.
+var envSecretRx = regexp.MustCompile(`\{\{\s*secret\s+"([^"]+)"\s*\}\}`)
+
+// malformedEnvSecretRx matches what looks like the start of a secret reference, to catch those that envSecretRx
+// doesn't accept.
+var malformedEnvSecretRx = regexp.MustCompile(`\{\{\s*secret\b`)
+
+// secretRefs lists the secret keys that an environment variable's value refers to, in order of appearance.
+func secretRefs(value string) []string {
+	keys := make([]string, 0)
+	for _, m := range envSecretRx.FindAllStringSubmatch(value, -1) {
+		keys = append(keys, m[1])
+	}
+	return keys
+}
+
+// checkEnvSecrets returns an error if the value of the environment variable name has a secret reference that can't be
+// parsed.
+func checkEnvSecrets(name, value string) error {
+	if malformedEnvSecretRx.MatchString(envSecretRx.ReplaceAllString(value, "")) {
+		return fmt.Errorf(`env %s: malformed secret reference: use {{ secret "KEY" }}`, name)
+	}
+	return nil
+}
+
+// interpolateSecrets replaces each secret reference in value with the secret's value from bag.
+func interpolateSecrets(value string, bag *secrets.Bag) (string, error) {
+	var missing error
+	interpolated := envSecretRx.ReplaceAllStringFunc(value, func(ref string) string {
+		key := envSecretRx.FindStringSubmatch(ref)[1]
+		v, err := bag.GetRequired(key)
+		if err != nil && missing == nil {
+			missing = err
+		}
+		return v
+	})
+	return interpolated, missing
+}
+
+// envSecretKeys lists the secret keys that the unit's environment variables refer to, sorted and without duplicates.
+func (unit DesiredSystemdUnit) envSecretKeys() []string {
+	seen := make(map[string]bool)
+	keys := make([]string, 0)
+	for _, value := range unit.Env {
+		for _, key := range secretRefs(value) {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// UsedSecrets lists every secret key that the unit is rendered with: those it requests as environment variables of
+// the same name, and those its environment variables refer to.
+func (unit DesiredSystemdUnit) UsedSecrets() []string {
+	keys := append([]string{}, unit.Secrets...)
+	for _, key := range unit.envSecretKeys() {
+		found := false
+		for _, existing := range unit.Secrets {
+			found = found || existing == key
+		}
+		if !found {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// sensitiveEnv lists the environment variables whose values contain secrets, and so are redacted from unit diffs.
+func (unit DesiredSystemdUnit) sensitiveEnv() []string {
+	names := append([]string{}, unit.Secrets...)
+	for name, value := range unit.Env {
+		if envSecretRx.MatchString(value) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
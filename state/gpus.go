@@ -0,0 +1,80 @@
+package state
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// gpuDevicesGlob matches the device node of each NVIDIA GPU on the host.
+const gpuDevicesGlob = "/dev/nvidia[0-9]*"
+
+// gpuHookName is the NVIDIA container toolkit hook that Docker needs to satisfy --gpus.
+const gpuHookName = "nvidia-container-runtime-hook"
+
+// gpusRx matches the GPU requests accepted by docker run --gpus: "all", a count, or a list of device indices or UUIDs.
+var gpusRx = regexp.MustCompile(`^(all|[1-9][0-9]*|device=[A-Za-z0-9-]+(,[A-Za-z0-9-]+)*)$`)
+
+// HostGPUs counts the NVIDIA GPUs that containers on this host can use. It returns zero if the NVIDIA container
+// toolkit isn't installed, because Docker can't expose GPUs to containers without it.
+func HostGPUs() int {
+	if _, err := exec.LookPath(gpuHookName); err != nil {
+		return 0
+	}
+	devices, err := filepath.Glob(gpuDevicesGlob)
+	if err != nil {
+		return 0
+	}
+	return len(devices)
+}
+
+// GPUs populates the GPUs exposed to the unit's container, as accepted by docker run --gpus: "all", a count like
+// "2", or specific devices like "device=0,1". An empty request exposes none.
+func (builder *DesiredSystemdUnitBuilder) GPUs(gpus string) error {
+	if len(gpus) > 0 && !gpusRx.MatchString(gpus) {
+		return fmt.Errorf("invalid GPU request: %q", gpus)
+	}
+
+	builder.unit.GPUs = gpus
+	return nil
+}
+
+// checkGPUs verifies that this host exposes enough GPUs for each unit that requests them. Held units aren't checked,
+// because they won't be changed.
+func checkGPUs(units []DesiredSystemdUnit) []error {
+	errs := make([]error, 0)
+	available := -1
+
+	for _, unit := range units {
+		if len(unit.GPUs) == 0 || unit.Held {
+			continue
+		}
+		if available < 0 {
+			available = HostGPUs()
+		}
+
+		if available == 0 {
+			errs = append(errs, fmt.Errorf("unit %s requests GPUs, but this host exposes none", unit.UnitName()))
+			continue
+		}
+
+		if count, err := strconv.Atoi(unit.GPUs); err == nil && count > available {
+			errs = append(errs, fmt.Errorf("unit %s requests %d GPUs, but this host exposes %d", unit.UnitName(), count, available))
+			continue
+		}
+
+		if strings.HasPrefix(unit.GPUs, "device=") {
+			for _, id := range strings.Split(strings.TrimPrefix(unit.GPUs, "device="), ",") {
+				// Devices may also be named by UUID, which can't be checked without the NVIDIA driver.
+				if index, err := strconv.Atoi(id); err == nil && index >= available {
+					errs = append(errs, fmt.Errorf("unit %s requests GPU %d, but this host exposes %d", unit.UnitName(), index, available))
+				}
+			}
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,23 @@
+package state
+
+import "fmt"
+
+// ForceRequiredError is returned by operations that would destroy more than their guard allows unless they're forced.
+// Nothing has been changed.
+type ForceRequiredError struct {
+	Reason string
+	Limit  int
+}
+
+func (e ForceRequiredError) Error() string {
+	return fmt.Sprintf("refusing to %s without force (the limit is %d)", e.Reason, e.Limit)
+}
+
+// CheckForce returns a ForceRequiredError if count exceeds limit and force isn't set. A limit of zero disables the
+// check. what describes the operation, like "remove %d units".
+func CheckForce(what string, count, limit int, force bool) error {
+	if force || limit <= 0 || count <= limit {
+		return nil
+	}
+	return ForceRequiredError{Reason: fmt.Sprintf(what, count), Limit: limit}
+}
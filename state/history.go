@@ -0,0 +1,151 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/smashwilson/az-coordinator/retry"
+)
+
+// The actions recorded in a unit's history.
+const (
+	RevisionCreated = "created"
+	RevisionUpdated = "updated"
+	RevisionDeleted = "deleted"
+)
+
+// UnitRevision records one change to a desired unit: who made it, when, and the unit's settings afterwards. Deletions
+// record the settings that the unit had when it was removed.
+type UnitRevision struct {
+	ID        int             `json:"id"`
+	UnitID    int             `json:"unit_id"`
+	Version   int             `json:"version"`
+	Action    string          `json:"action"`
+	Actor     string          `json:"actor"`
+	ChangedAt int64           `json:"changed_at"`
+	Unit      json.RawMessage `json:"unit"`
+
+	// Changes lists the settings that differ from the revision before, if it's known.
+	Changes []SettingChange `json:"changes"`
+}
+
+// SettingChange is one setting of a unit that differs between two revisions, with the JSON of its old and new values.
+type SettingChange struct {
+	Field string          `json:"field"`
+	From  json.RawMessage `json:"from,omitempty"`
+	To    json.RawMessage `json:"to,omitempty"`
+}
+
+// revisionIgnoredFields are members of a unit's JSON that change without being settings.
+var revisionIgnoredFields = map[string]bool{"id": true, "version": true, "updated_at": true, "held": true}
+
+type actorKey struct{}
+
+// WithActor returns a context that attributes the changes made to desired units with it to actor.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// actorFrom identifies who is responsible for changes made with ctx. Changes without an actor are attributed to the
+// user running this process, as they are for syncs.
+func actorFrom(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey{}).(string); ok && len(actor) > 0 {
+		return actor
+	}
+	return LocalTrigger("").Actor
+}
+
+// recordRevision adds a revision of unit to its history with q. It's stored in the same transaction as the change, so
+// that no change is missing from the history.
+func recordRevision(ctx context.Context, q querier, unit DesiredSystemdUnit, action string) error {
+	unit.Held = false
+	unit.normalizeNils()
+	encoded, err := json.Marshal(&unit)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.ExecContext(
+		ctx,
+		"INSERT INTO state_systemd_units_history (unit_id, version, action, actor, changed_at, unit) "+
+			"VALUES ($1, $2, $3, $4, $5, $6)",
+		*unit.ID, unit.Version, action, actorFrom(ctx), time.Now().Unix(), string(encoded),
+	)
+	return err
+}
+
+// ReadUnitHistory loads the revisions of one unit, most recent first, with the settings that each one changed.
+func (session SessionLease) ReadUnitHistory(ctx context.Context, unitID int) ([]UnitRevision, error) {
+	var rows *sql.Rows
+	err := retry.Transient(ctx, func() error {
+		var err error
+		rows, err = session.db.QueryContext(
+			ctx,
+			"SELECT id, unit_id, version, action, actor, changed_at, unit FROM state_systemd_units_history "+
+				"WHERE unit_id = $1 ORDER BY id",
+			unitID,
+		)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := make([]UnitRevision, 0)
+	for rows.Next() {
+		var (
+			rev UnitRevision
+			raw []byte
+		)
+		if err := rows.Scan(&rev.ID, &rev.UnitID, &rev.Version, &rev.Action, &rev.Actor, &rev.ChangedAt, &raw); err != nil {
+			return nil, err
+		}
+		rev.Unit = json.RawMessage(raw)
+		rev.Changes = make([]SettingChange, 0)
+		if len(revisions) > 0 && rev.Action != RevisionDeleted {
+			rev.Changes = diffRevisions(revisions[len(revisions)-1].Unit, rev.Unit)
+		}
+		revisions = append(revisions, rev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(revisions)-1; i < j; i, j = i+1, j-1 {
+		revisions[i], revisions[j] = revisions[j], revisions[i]
+	}
+	return revisions, nil
+}
+
+// diffRevisions lists the settings that differ between two revisions of a unit, by name.
+func diffRevisions(before, after json.RawMessage) []SettingChange {
+	var from, to map[string]json.RawMessage
+	if json.Unmarshal(before, &from) != nil || json.Unmarshal(after, &to) != nil {
+		return make([]SettingChange, 0)
+	}
+
+	fields := make([]string, 0, len(to))
+	for field := range from {
+		if _, ok := to[field]; !ok {
+			fields = append(fields, field)
+		}
+	}
+	for field := range to {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	changes := make([]SettingChange, 0)
+	for _, field := range fields {
+		if revisionIgnoredFields[field] || bytes.Equal(from[field], to[field]) {
+			continue
+		}
+		changes = append(changes, SettingChange{Field: field, From: from[field], To: to[field]})
+	}
+	return changes
+}
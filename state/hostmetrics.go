@@ -0,0 +1,131 @@
+package state
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// restartScheduledMessageID identifies the journal entries that systemd writes when it schedules the automatic
+// restart of a unit that exited, like "Scheduled restart job, restart counter is at 3".
+const restartScheduledMessageID = "5eb03494b6584870a536b337290809b3"
+
+// HostMetrics summarizes the condition of the host.
+type HostMetrics struct {
+	// LoadAverage is the system load averaged over the last 1, 5, and 15 minutes.
+	LoadAverage [3]float64 `json:"load_average"`
+
+	// MemoryAvailableBytes counts the memory that can be given to new processes without swapping, including reclaimable
+	// caches.
+	MemoryTotalBytes     uint64 `json:"memory_total_bytes"`
+	MemoryAvailableBytes uint64 `json:"memory_available_bytes"`
+	MemoryUsagePercent   int    `json:"memory_usage_percent"`
+
+	// OpenFiles counts the file handles allocated across the host, out of MaxOpenFiles. CoordinatorOpenFiles counts
+	// the file descriptors held by this process.
+	OpenFiles            uint64 `json:"open_files"`
+	MaxOpenFiles         uint64 `json:"max_open_files"`
+	CoordinatorOpenFiles int    `json:"coordinator_open_files"`
+}
+
+// ReadHostMetrics reads the load average, memory usage, and open files of the host from /proc. Figures that can't be
+// read are left at zero, and their errors are returned.
+func ReadHostMetrics() (HostMetrics, []error) {
+	var metrics HostMetrics
+	errs := make([]error, 0)
+
+	if raw, err := ioutil.ReadFile("/proc/loadavg"); err != nil {
+		errs = append(errs, err)
+	} else if _, err := fmt.Sscanf(string(raw), "%f %f %f", &metrics.LoadAverage[0], &metrics.LoadAverage[1], &metrics.LoadAverage[2]); err != nil {
+		errs = append(errs, fmt.Errorf("/proc/loadavg: %v", err))
+	}
+
+	if raw, err := ioutil.ReadFile("/proc/meminfo"); err != nil {
+		errs = append(errs, err)
+	} else {
+		info := parseMeminfo(raw)
+		metrics.MemoryTotalBytes = info["MemTotal"]
+		metrics.MemoryAvailableBytes = info["MemAvailable"]
+		if metrics.MemoryTotalBytes > 0 && metrics.MemoryAvailableBytes <= metrics.MemoryTotalBytes {
+			used := metrics.MemoryTotalBytes - metrics.MemoryAvailableBytes
+			metrics.MemoryUsagePercent = int(used * 100 / metrics.MemoryTotalBytes)
+		}
+	}
+
+	// file-nr holds the allocated handles, the free allocated handles, and the maximum.
+	if raw, err := ioutil.ReadFile("/proc/sys/fs/file-nr"); err != nil {
+		errs = append(errs, err)
+	} else if _, err := fmt.Sscanf(string(raw), "%d %d %d", &metrics.OpenFiles, new(uint64), &metrics.MaxOpenFiles); err != nil {
+		errs = append(errs, fmt.Errorf("/proc/sys/fs/file-nr: %v", err))
+	}
+
+	if fds, err := ioutil.ReadDir("/proc/self/fd"); err != nil {
+		errs = append(errs, err)
+	} else {
+		metrics.CoordinatorOpenFiles = len(fds)
+	}
+
+	return metrics, errs
+}
+
+// parseMeminfo reads the sizes in /proc/meminfo, like "MemTotal: 16318496 kB", in bytes.
+func parseMeminfo(raw []byte) map[string]uint64 {
+	info := make(map[string]uint64)
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		if len(fields) > 2 && fields[2] == "kB" {
+			value *= 1024
+		}
+		info[strings.TrimSuffix(fields[0], ":")] = value
+	}
+	return info
+}
+
+// ReadUnitRestarts counts the automatic restarts that systemd has scheduled for each managed unit within window, from
+// the journal. Units that weren't restarted are omitted. Restarts made by syncs aren't counted.
+func ReadUnitRestarts(ctx context.Context, window time.Duration) (map[string]int, error) {
+	since := fmt.Sprintf("@%d", time.Now().Add(-window).Unix())
+	out, err := exec.CommandContext(
+		ctx,
+		"journalctl", "--no-pager", "--quiet", "--output=json", "--output-fields=UNIT",
+		"--since="+since, "MESSAGE_ID="+restartScheduledMessageID,
+	).Output()
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := UnitPrefix()
+	restarts := make(map[string]int)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry struct {
+			Unit interface{} `json:"UNIT"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+
+		// Fields that aren't valid UTF-8 are written as arrays of bytes, and can't be unit names.
+		unit, ok := entry.Unit.(string)
+		if ok && strings.HasPrefix(unit, prefix) {
+			restarts[unit]++
+		}
+	}
+	return restarts, scanner.Err()
+}
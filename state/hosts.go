@@ -0,0 +1,133 @@
+package state
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/smashwilson/az-coordinator/retry"
+	"github.com/smashwilson/az-coordinator/store"
+)
+
+// hostNamePattern matches the names that units may be scoped to.
+var hostNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9.-]*$`)
+
+// labelPattern matches the keys and values of host labels and unit selectors.
+var labelPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// RunsOn returns true if this unit should be present on the named host, which carries labels. Units that aren't
+// scoped to any hosts and have an empty selector run on every host.
+func (unit DesiredSystemdUnit) RunsOn(host string, labels map[string]string) bool {
+	for key, value := range unit.Selector {
+		if actual, ok := labels[key]; !ok || actual != value {
+			return false
+		}
+	}
+
+	if len(unit.Hosts) == 0 {
+		return true
+	}
+	for _, each := range unit.Hosts {
+		if each == host {
+			return true
+		}
+	}
+	return false
+}
+
+// ForHost returns the subset of this state that should be present on the named host, which carries labels. An empty
+// host keeps every unit.
+func (state DesiredState) ForHost(host string, labels map[string]string) DesiredState {
+	if len(host) == 0 {
+		return state
+	}
+
+	units := make([]DesiredSystemdUnit, 0, len(state.Units))
+	for _, unit := range state.Units {
+		if unit.RunsOn(host, labels) {
+			units = append(units, unit)
+		}
+	}
+	return DesiredState{
+		Units:           units,
+		Files:           state.Files,
+		KeepUndesired:   state.KeepUndesired,
+		RemoveProtected: state.RemoveProtected,
+	}
+}
+
+// readUnitHosts loads the hosts that each unit is scoped to, keyed by unit ID.
+func readUnitHosts(ctx context.Context, db *store.DB) (map[int][]string, error) {
+	var rows *sql.Rows
+	err := retry.Transient(ctx, func() error {
+		var err error
+		rows, err = db.QueryContext(ctx, "SELECT unit_id, host FROM unit_hosts")
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hosts := make(map[int][]string)
+	for rows.Next() {
+		var (
+			id   int
+			host string
+		)
+		if err := rows.Scan(&id, &host); err != nil {
+			return nil, err
+		}
+		hosts[id] = append(hosts[id], host)
+	}
+	for _, each := range hosts {
+		sort.Strings(each)
+	}
+	return hosts, rows.Err()
+}
+
+// replaceUnitHosts replaces the hosts that the unit with this ID is scoped to.
+func replaceUnitHosts(ctx context.Context, q querier, id int, hosts []string) error {
+	if _, err := q.ExecContext(ctx, "DELETE FROM unit_hosts WHERE unit_id = $1", id); err != nil {
+		return err
+	}
+	for _, host := range hosts {
+		if _, err := q.ExecContext(ctx, "INSERT INTO unit_hosts (unit_id, host) VALUES ($1, $2)", id, host); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Hosts scopes the unit to the named hosts. An empty list makes it run on every host.
+func (builder *DesiredSystemdUnitBuilder) Hosts(hosts []string) error {
+	seen := make(map[string]bool, len(hosts))
+	scoped := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		if !hostNamePattern.MatchString(host) {
+			return fmt.Errorf("invalid host name: %q", host)
+		}
+		if !seen[host] {
+			seen[host] = true
+			scoped = append(scoped, host)
+		}
+	}
+	sort.Strings(scoped)
+
+	builder.unit.Hosts = scoped
+	return nil
+}
+
+// Selector limits the unit to hosts that carry every one of the given labels. An empty selector matches every host.
+func (builder *DesiredSystemdUnitBuilder) Selector(selector map[string]string) error {
+	for key, value := range selector {
+		if !labelPattern.MatchString(key) || !labelPattern.MatchString(value) {
+			return fmt.Errorf("invalid selector label: %q=%q", key, value)
+		}
+	}
+
+	builder.unit.Selector = selector
+	return nil
+}
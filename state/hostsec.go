@@ -0,0 +1,226 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// selinuxEnforcePath reports whether SELinux is loaded and, if so, whether it's enforcing.
+const selinuxEnforcePath = "/sys/fs/selinux/enforce"
+
+// selinuxFileContext is a file context rule: files with paths that match Pattern are labelled with Type.
+type selinuxFileContext struct {
+	Type    string
+	Pattern string
+}
+
+// selinuxFileContexts are the file context rules that let systemd read generated unit files and let containers read
+// volume-mounted secrets.
+func selinuxFileContexts() []selinuxFileContext {
+	return []selinuxFileContext{
+		{Type: "systemd_unit_file_t", Pattern: regexp.QuoteMeta(UnitDirectory()+UnitPrefix()) + ".*"},
+		{Type: "container_file_t", Pattern: "/etc/ssl/az(/.*)?"},
+	}
+}
+
+// SELinuxEnforcing returns true if SELinux is enabled and in enforcing mode on this host.
+func SELinuxEnforcing() bool {
+	content, err := ioutil.ReadFile(selinuxEnforcePath)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(bytes.TrimSpace(content), []byte("1"))
+}
+
+// InstallSELinuxContexts registers the file context rules for the paths that the coordinator writes, then relabels the
+// files already present.
+func InstallSELinuxContexts(ctx context.Context) error {
+	for _, rule := range selinuxFileContexts() {
+		// Adding a rule that already exists fails, so fall back to modifying it.
+		add := exec.CommandContext(ctx, "semanage", "fcontext", "--add", "--type", rule.Type, rule.Pattern)
+		if _, err := add.CombinedOutput(); err != nil {
+			modify := exec.CommandContext(ctx, "semanage", "fcontext", "--modify", "--type", rule.Type, rule.Pattern)
+			if output, err := modify.CombinedOutput(); err != nil {
+				return fmt.Errorf("Unable to install SELinux file context for %s (%v)\n%s", rule.Pattern, err, output)
+			}
+		}
+	}
+
+	return restoreContexts(ctx, []string{filepath.Clean(UnitDirectory()), "/etc/ssl/az"}, true)
+}
+
+// restoreContexts resets the SELinux labels of paths to match the installed file context rules.
+func restoreContexts(ctx context.Context, paths []string, recursive bool) error {
+	if len(paths) == 0 {
+		return nil
+	}
+
+	args := make([]string, 0, len(paths)+1)
+	if recursive {
+		args = append(args, "-R")
+	}
+	args = append(args, paths...)
+
+	if output, err := exec.CommandContext(ctx, "restorecon", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("Unable to restore SELinux contexts (%v)\n%s", err, output)
+	}
+	return nil
+}
+
+// firewalldRunning returns true if firewalld is managing this host's firewall.
+func firewalldRunning(ctx context.Context) bool {
+	return exec.CommandContext(ctx, "firewall-cmd", "--state").Run() == nil
+}
+
+// openedPortsPath records the host ports that the coordinator has opened in firewalld, so that it can close them again
+// once no unit publishes them.
+const openedPortsPath = "/etc/az-coordinator/firewall-ports.json"
+
+// readOpenedPorts loads the host ports that the coordinator has opened. A missing record means that none have been.
+func readOpenedPorts() (map[int]bool, error) {
+	opened := make(map[int]bool)
+
+	content, err := ioutil.ReadFile(openedPortsPath)
+	if os.IsNotExist(err) {
+		return opened, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var ports []int
+	if err := json.Unmarshal(content, &ports); err != nil {
+		return nil, fmt.Errorf("Unable to parse %s (%v)", openedPortsPath, err)
+	}
+	for _, port := range ports {
+		opened[port] = true
+	}
+	return opened, nil
+}
+
+// writeOpenedPorts replaces the record of the host ports that the coordinator has opened.
+func writeOpenedPorts(opened map[int]bool) error {
+	if len(opened) == 0 {
+		if err := os.Remove(openedPortsPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	content, err := json.Marshal(sortedPorts(opened))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(openedPortsPath, content, 0640)
+}
+
+func sortedPorts(set map[int]bool) []int {
+	ports := make([]int, 0, len(set))
+	for port := range set {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+// syncFirewallPorts allows inbound TCP traffic to each port in open, and blocks it again on each port that the
+// coordinator opened earlier but that's no longer in published. Ports that were already open, because someone other
+// than the coordinator opened them, are never recorded, and so are never closed. A nil published closes nothing.
+func syncFirewallPorts(ctx context.Context, open []int, published map[int]bool) (opened, closed []int, err error) {
+	recorded, err := readOpenedPorts()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	toClose := make([]int, 0)
+	if published != nil {
+		for port := range recorded {
+			if !published[port] {
+				toClose = append(toClose, port)
+			}
+		}
+	}
+	if (len(open) == 0 && len(toClose) == 0) || !firewalldRunning(ctx) {
+		return nil, nil, nil
+	}
+
+	toOpen := make([]int, 0, len(open))
+	for _, port := range open {
+		if !recorded[port] && !firewallPortOpen(ctx, port) {
+			toOpen = append(toOpen, port)
+		}
+	}
+
+	if err := changeFirewallPorts(ctx, "--add-port", toOpen); err != nil {
+		return nil, nil, err
+	}
+	for _, port := range toOpen {
+		recorded[port] = true
+	}
+
+	closeErr := changeFirewallPorts(ctx, "--remove-port", toClose)
+	if closeErr == nil {
+		for _, port := range toClose {
+			delete(recorded, port)
+		}
+	} else {
+		toClose = nil
+	}
+
+	if err := writeOpenedPorts(recorded); err != nil {
+		return toOpen, toClose, fmt.Errorf("Unable to record opened firewall ports (%v)", err)
+	}
+	return toOpen, toClose, closeErr
+}
+
+// CloseFirewallPorts blocks inbound traffic again on every port that the coordinator has opened, and forgets them.
+func CloseFirewallPorts(ctx context.Context) ([]int, error) {
+	recorded, err := readOpenedPorts()
+	if err != nil || len(recorded) == 0 {
+		return nil, err
+	}
+
+	ports := sortedPorts(recorded)
+	if firewalldRunning(ctx) {
+		if err := changeFirewallPorts(ctx, "--remove-port", ports); err != nil {
+			return nil, err
+		}
+	}
+	return ports, writeOpenedPorts(nil)
+}
+
+// firewallPortOpen returns true if firewalld already allows inbound TCP traffic to port.
+func firewallPortOpen(ctx context.Context, port int) bool {
+	return exec.CommandContext(ctx, "firewall-cmd", "--query-port="+strconv.Itoa(port)+"/tcp").Run() == nil
+}
+
+// changeFirewallPorts adds or removes each TCP port with the firewall-cmd option op, both immediately and across
+// firewalld reloads.
+func changeFirewallPorts(ctx context.Context, op string, ports []int) error {
+	if len(ports) == 0 {
+		return nil
+	}
+
+	sort.Ints(ports)
+	args := make([]string, 0, len(ports))
+	for _, port := range ports {
+		args = append(args, op+"="+strconv.Itoa(port)+"/tcp")
+	}
+
+	for _, scope := range [][]string{nil, {"--permanent"}} {
+		cmd := exec.CommandContext(ctx, "firewall-cmd", append(scope, args...)...)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("Unable to change firewall ports %v (%v)\n%s", ports, err, output)
+		}
+	}
+	return nil
+}
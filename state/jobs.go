@@ -0,0 +1,199 @@
+package state
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/smashwilson/az-coordinator/retry"
+)
+
+// The kinds of long-running operation that run as Jobs.
+const (
+	JobSync     = "sync"
+	JobPrune    = "prune"
+	JobRollback = "rollback"
+	JobBackup   = "backup"
+)
+
+// The statuses of a Job.
+const (
+	// JobRunning jobs haven't finished yet.
+	JobRunning = "running"
+
+	// JobSucceeded jobs finished without error.
+	JobSucceeded = "succeeded"
+
+	// JobFailed jobs finished with an error.
+	JobFailed = "failed"
+
+	// JobCanceled jobs were canceled before they finished.
+	JobCanceled = "canceled"
+
+	// JobInterrupted jobs were still running when the coordinator that ran them stopped.
+	JobInterrupted = "interrupted"
+)
+
+// Job records a long-running operation, like a sync or a prune, that was started by a request and finishes in the
+// background.
+type Job struct {
+	ID         int             `json:"id"`
+	Kind       string          `json:"kind"`
+	Status     string          `json:"status"`
+	Host       string          `json:"host"`
+	Actor      string          `json:"actor"`
+	Trigger    SyncTrigger     `json:"trigger"`
+	CreatedAt  int64           `json:"created_at"`
+	FinishedAt int64           `json:"finished_at,omitempty"`
+	Result     json.RawMessage `json:"result,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+// Finished returns true once the job is no longer running.
+func (j Job) Finished() bool {
+	return j.Status != JobRunning
+}
+
+// CreateJob records a job of kind that trigger started on host just now.
+func (session SessionLease) CreateJob(ctx context.Context, kind, host string, trigger SyncTrigger) (*Job, error) {
+	j := Job{Kind: kind, Status: JobRunning, Host: host, Actor: trigger.Actor, Trigger: trigger, CreatedAt: time.Now().Unix()}
+
+	encoded, err := json.Marshal(trigger)
+	if err != nil {
+		return nil, err
+	}
+
+	// Inserts are not retried, as in CreateApp.
+	row := session.db.QueryRowContext(
+		ctx,
+		"INSERT INTO jobs (kind, status, host, actor, trigger, created_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
+		j.Kind, j.Status, j.Host, j.Actor, string(encoded), j.CreatedAt,
+	)
+	if err := row.Scan(&j.ID); err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// FinishJob records the outcome of a running job: its final status, its result, which is stored as JSON, and the
+// error that it failed with, if any.
+func (session SessionLease) FinishJob(ctx context.Context, id int, status string, result interface{}, jobErr error) error {
+	encoded := []byte("null")
+	if result != nil {
+		var err error
+		if encoded, err = json.Marshal(result); err != nil {
+			return err
+		}
+	}
+	message := ""
+	if jobErr != nil {
+		message = jobErr.Error()
+	}
+
+	return retry.Transient(ctx, func() error {
+		_, err := session.db.ExecContext(
+			ctx,
+			"UPDATE jobs SET status = $1, finished_at = $2, result = $3, error = $4 WHERE id = $5 AND status = $6",
+			status, time.Now().Unix(), string(encoded), message, id, JobRunning,
+		)
+		return err
+	})
+}
+
+// InterruptJobs marks the jobs that are still recorded as running on host as interrupted. It's called when a
+// coordinator starts, since no job that it ran before it stopped can still be running.
+func (session SessionLease) InterruptJobs(ctx context.Context, host string) error {
+	return retry.Transient(ctx, func() error {
+		_, err := session.db.ExecContext(
+			ctx,
+			"UPDATE jobs SET status = $1, finished_at = $2 WHERE host = $3 AND status = $4",
+			JobInterrupted, time.Now().Unix(), host, JobRunning,
+		)
+		return err
+	})
+}
+
+// ReadJob loads a job by its ID, or returns nil if there's no such job.
+func (session SessionLease) ReadJob(ctx context.Context, id int) (*Job, error) {
+	var (
+		j       Job
+		trigger string
+		result  sql.NullString
+	)
+	err := retry.Transient(ctx, func() error {
+		return session.db.QueryRowContext(
+			ctx,
+			"SELECT id, kind, status, host, actor, trigger, created_at, finished_at, result, error FROM jobs WHERE id = $1",
+			id,
+		).Scan(&j.ID, &j.Kind, &j.Status, &j.Host, &j.Actor, &trigger, &j.CreatedAt, &j.FinishedAt, &result, &j.Error)
+	})
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(trigger), &j.Trigger); err != nil {
+		return nil, err
+	}
+	if result.Valid && result.String != "null" {
+		j.Result = json.RawMessage(result.String)
+	}
+	return &j, nil
+}
+
+// ReadLastJob loads the job of kind with status that finished most recently, or returns nil if there's no such job.
+func (session SessionLease) ReadLastJob(ctx context.Context, kind, status string) (*Job, error) {
+	var id int
+	err := retry.Transient(ctx, func() error {
+		return session.db.QueryRowContext(
+			ctx,
+			"SELECT id FROM jobs WHERE kind = $1 AND status = $2 ORDER BY finished_at DESC, id DESC LIMIT 1",
+			kind, status,
+		).Scan(&id)
+	})
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return session.ReadJob(ctx, id)
+}
+
+// ReadJobs lists the most recently created jobs, newest first. Their results are omitted; read each job to see its
+// result.
+func (session SessionLease) ReadJobs(ctx context.Context, limit int) ([]Job, error) {
+	var rows *sql.Rows
+	err := retry.Transient(ctx, func() error {
+		var err error
+		rows, err = session.db.QueryContext(
+			ctx,
+			"SELECT id, kind, status, host, actor, trigger, created_at, finished_at, error FROM jobs "+
+				"ORDER BY created_at DESC, id DESC LIMIT $1",
+			limit,
+		)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := make([]Job, 0)
+	for rows.Next() {
+		var (
+			j       Job
+			trigger string
+		)
+		if err := rows.Scan(&j.ID, &j.Kind, &j.Status, &j.Host, &j.Actor, &trigger, &j.CreatedAt, &j.FinishedAt, &j.Error); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(trigger), &j.Trigger); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
@@ -0,0 +1,66 @@
+package state
+
+import (
+	"context"
+	"errors"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+)
+
+// newestImageID finds the most recently created local image with the container's image name and tag. It returns an
+// empty string if there is none.
+func (session *SessionLease) newestImageID(ctx context.Context, container DesiredDockerContainer) (string, error) {
+	imageSummaries, err := session.cli.ImageList(ctx, types.ImageListOptions{
+		Filters: filters.NewArgs(filters.Arg("reference", container.ImageName+":"+container.ImageTag)),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var (
+		id      string
+		highest int64
+	)
+	for _, imageSummary := range imageSummaries {
+		if imageSummary.Created > highest {
+			id = imageSummary.ID
+			highest = imageSummary.Created
+		}
+	}
+	return id, nil
+}
+
+// CurrentImageID finds the ID of the image that a container is running. If it isn't running, the newest local image
+// with its image name and tag is used instead, because that's the image it will run the next time it starts. An
+// empty string is returned if neither can be found.
+func (session *SessionLease) CurrentImageID(ctx context.Context, container DesiredDockerContainer) (string, error) {
+	if len(container.Name) > 0 {
+		inspected, err := session.cli.ContainerInspect(ctx, container.Name)
+		if err == nil {
+			return inspected.Image, nil
+		}
+		if !client.IsErrNotFound(err) {
+			return "", err
+		}
+	}
+
+	if len(container.PinnedImageID) > 0 {
+		return container.PinnedImageID, nil
+	}
+	return session.newestImageID(ctx, container)
+}
+
+// Pin freezes the unit's container at the image with the given ID, or unpins it if id is empty.
+func (builder *DesiredSystemdUnitBuilder) Pin(id string) error {
+	if builder.unit.Container == nil {
+		if len(id) == 0 {
+			return nil
+		}
+		return errors.New("only units with a container may be pinned")
+	}
+
+	builder.unit.Container.PinnedImageID = id
+	return nil
+}
@@ -1,18 +1,26 @@
 package state
 
 import (
+	"context"
+	"errors"
 	"sync"
+	"time"
 
 	"github.com/smashwilson/az-coordinator/secrets"
 
 	"github.com/sirupsen/logrus"
 )
 
+// ErrPoolExhausted is returned by Take when every session in the pool remains in use for the pool's entire wait
+// timeout.
+var ErrPoolExhausted = errors.New("timed out waiting for an available session")
+
 // SessionLease wraps a Session temporarily acquired from a Pool. Call Release() when done.
 type SessionLease struct {
 	*Session
 
 	pool    *Pool
+	token   uint64
 	secrets *secrets.Bag
 	Log     *logrus.Logger
 }
@@ -27,91 +35,148 @@ func (session *Session) Lease() *SessionLease {
 	}
 }
 
-type poolEntry struct {
-	session *Session
-	used    bool
+// PoolStats is a snapshot of a Pool's occupancy and lifetime counters.
+type PoolStats struct {
+	InUse   int
+	Idle    int
+	Created int64
+	Closed  int64
 }
 
-// Pool maintains a burstable pool of pre-connected Sessions.
+// Pool maintains a bounded pool of pre-connected Sessions. Each Take issues a lease token that must be presented
+// to return the session, so a lease that is released twice can't return a session that another caller now holds.
 type Pool struct {
-	creator   func() (*Session, error)
-	lock      sync.Mutex
-	available []*poolEntry
+	creator func() (*Session, error)
+	wait    time.Duration
+	low     int
+
+	// slots holds one token for each session that may be leased concurrently.
+	slots chan struct{}
 
-	low int
+	lock      sync.Mutex
+	idle      []*Session
+	leased    map[uint64]*Session
+	nextToken uint64
+	created   int64
+	closed    int64
 }
 
-// NewPool creates and pre-allocates a pool of a given size.
-func NewPool(creator func() (*Session, error), low int) (*Pool, error) {
-	available := make([]*poolEntry, 0, low*2)
+// NewPool creates a pool that pre-allocates low sessions, keeps at most low sessions idle, allows at most high
+// sessions to be leased at once, and waits up to wait for a session to be released when all are in use.
+func NewPool(creator func() (*Session, error), low, high int, wait time.Duration) (*Pool, error) {
+	if high < low {
+		high = low
+	}
+
+	pool := &Pool{
+		creator: creator,
+		wait:    wait,
+		low:     low,
+		slots:   make(chan struct{}, high),
+		idle:    make([]*Session, 0, low),
+		leased:  make(map[uint64]*Session, high),
+	}
+
+	for i := 0; i < high; i++ {
+		pool.slots <- struct{}{}
+	}
+
 	for i := 0; i < low; i++ {
 		session, err := creator()
 		if err != nil {
 			return nil, err
 		}
-		available = append(available, &poolEntry{session: session, used: false})
+		pool.idle = append(pool.idle, session)
+		pool.created++
 	}
 
-	return &Pool{
-		creator:   creator,
-		low:       low,
-		available: available,
-	}, nil
+	return pool, nil
 }
 
-// Take allocates and returns a session from the pool if one is already available and not in use. Otherwise, it
-// attempts to allocate a new session and place it in the pool.
+// Take leases an idle session from the pool, or allocates a new one if none are idle. If the pool is already at its
+// maximum size, Take waits for a session to be released and returns ErrPoolExhausted if none is released in time.
 func (pool *Pool) Take() (*SessionLease, error) {
+	return pool.TakeContext(context.Background())
+}
+
+// TakeContext leases a session like Take, but also gives up waiting for one with ctx's error if ctx is done first.
+func (pool *Pool) TakeContext(ctx context.Context) (*SessionLease, error) {
+	timer := time.NewTimer(pool.wait)
+	defer timer.Stop()
+
+	select {
+	case <-pool.slots:
+	case <-timer.C:
+		logrus.WithField("wait", pool.wait).Warn("Session pool exhausted.")
+		return nil, ErrPoolExhausted
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
 	pool.lock.Lock()
 	defer pool.lock.Unlock()
 
-	for _, entry := range pool.available {
-		if !entry.used {
-			entry.used = true
-			return &SessionLease{Session: entry.session, pool: pool, Log: logrus.StandardLogger()}, nil
+	var session *Session
+	if n := len(pool.idle); n > 0 {
+		session = pool.idle[n-1]
+		pool.idle = pool.idle[:n-1]
+	} else {
+		logrus.WithField("in use", len(pool.leased)).Info("Allocating additional session.")
+		created, err := pool.creator()
+		if err != nil {
+			pool.slots <- struct{}{}
+			return nil, err
 		}
+		session = created
+		pool.created++
 	}
 
-	logrus.WithField("pool size", len(pool.available)).Info("Allocating additional session.")
-	overage, err := pool.creator()
-	if err != nil {
-		return nil, err
-	}
+	pool.nextToken++
+	token := pool.nextToken
+	pool.leased[token] = session
 
-	pool.available = append(pool.available, &poolEntry{session: overage, used: true})
-	return &SessionLease{Session: overage, pool: pool, Log: logrus.StandardLogger()}, nil
+	return &SessionLease{Session: session, pool: pool, token: token, Log: logrus.StandardLogger()}, nil
 }
 
-// Return returns a session borrowed from the pool with Take.
-func (pool *Pool) Return(session *Session) {
+// Return gives back a session leased with Take. Sessions beyond the pool's idle limit are closed. Returning a lease
+// that has already been returned does nothing.
+func (pool *Pool) Return(lease *SessionLease) {
 	pool.lock.Lock()
 	defer pool.lock.Unlock()
 
-	keep := make([]*poolEntry, 0, pool.low)
-	closed := 0
-
-	for _, entry := range pool.available {
-		if entry.session == session {
-			entry.used = false
-		}
+	session, ok := pool.leased[lease.token]
+	if !ok {
+		logrus.WithField("token", lease.token).Warn("Attempt to return a session that is not leased.")
+		return
+	}
+	delete(pool.leased, lease.token)
 
-		if len(keep) <= pool.low || entry.used {
-			keep = append(keep, entry)
-		} else if !entry.used {
-			if err := entry.session.Close(); err != nil {
-				logrus.WithError(err).Warn("Unable to close session.")
-			}
-			closed++
+	if len(pool.idle) < pool.low {
+		pool.idle = append(pool.idle, session)
+	} else {
+		if err := session.Close(); err != nil {
+			logrus.WithError(err).Warn("Unable to close session.")
 		}
+		pool.closed++
+		logrus.WithFields(logrus.Fields{
+			"idle":   len(pool.idle),
+			"in use": len(pool.leased),
+		}).Info("Unused overage session closed.")
 	}
 
-	pool.available = keep
+	pool.slots <- struct{}{}
+}
 
-	if closed > 0 {
-		logrus.WithFields(logrus.Fields{
-			"pool size": len(keep),
-			"closed":    closed,
-		}).Info("Unused overage sessions closed.")
+// Stats reports the pool's current occupancy and the number of sessions it has created and closed.
+func (pool *Pool) Stats() PoolStats {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	return PoolStats{
+		InUse:   len(pool.leased),
+		Idle:    len(pool.idle),
+		Created: pool.created,
+		Closed:  pool.closed,
 	}
 }
 
@@ -138,10 +203,16 @@ func (lease *SessionLease) GetSecrets() (*secrets.Bag, error) {
 	return bag, err
 }
 
+// UseSecrets caches bag as this lease's secrets, so that they're used instead of the secrets in the database. Agents
+// use it to synchronize with the secrets served by their controller.
+func (lease *SessionLease) UseSecrets(bag *secrets.Bag) {
+	lease.secrets = bag
+}
+
 // Release resets a session to its original state and returns it to the pool to make it available for other callers.
 func (lease *SessionLease) Release() {
 	if lease.pool != nil {
-		lease.pool.Return(lease.Session)
+		lease.pool.Return(lease)
 	} else {
 		lease.Session.Close()
 	}
@@ -0,0 +1,138 @@
+package state
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/smashwilson/az-coordinator/retry"
+)
+
+// Promotion records one image moving from a unit's staging tag to the tag that the unit runs.
+type Promotion struct {
+	ID         int    `json:"id"`
+	UnitID     int    `json:"unit_id"`
+	FromTag    string `json:"from_tag"`
+	ToTag      string `json:"to_tag"`
+	ImageID    string `json:"image_id"`
+	Digest     string `json:"digest"`
+	Actor      string `json:"actor"`
+	PromotedAt int64  `json:"promoted_at"`
+}
+
+// PromoteUnit pulls the image that fromTag names for the unit's container, tags it locally with the unit's own image
+// tag, and pins the unit to it, so that later pulls of that tag don't move the unit until the next promotion or an
+// unpin. The promotion is recorded and returned. The unit is saved but not synced.
+func (session SessionLease) PromoteUnit(ctx context.Context, unit *DesiredSystemdUnit, fromTag, actor string) (*Promotion, error) {
+	if unit.ID == nil {
+		return nil, errors.New("Attempt to promote an un-persisted desired unit")
+	}
+	if unit.Container == nil {
+		return nil, errors.New("only units with a container may be promoted")
+	}
+	if len(fromTag) == 0 || fromTag == unit.Container.ImageTag {
+		return nil, fmt.Errorf("invalid tag to promote from: %q", fromTag)
+	}
+
+	staged := *unit.Container
+	staged.ImageTag = fromTag
+	stagedRef := staged.ImageName + ":" + fromTag
+
+	if err := session.pullImage(ctx, stagedRef, nil); err != nil {
+		session.Log.WithError(err).WithField("ref", stagedRef).Warn("Unable to pull staged image. Using the local copy.")
+	}
+
+	id, err := session.newestImageID(ctx, staged)
+	if err != nil {
+		return nil, err
+	}
+	if len(id) == 0 {
+		return nil, fmt.Errorf("no image found for %s", stagedRef)
+	}
+
+	inspected, _, err := session.cli.ImageInspectWithRaw(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	digest := ""
+	if len(inspected.RepoDigests) > 0 {
+		digest = inspected.RepoDigests[0]
+	}
+
+	if err := session.cli.ImageTag(ctx, id, unit.Container.ImageName+":"+unit.Container.ImageTag); err != nil {
+		return nil, err
+	}
+
+	unit.Container.PinnedImageID = id
+	if err := unit.Update(ctx, session); err != nil {
+		return nil, err
+	}
+
+	promotion := Promotion{
+		UnitID:     *unit.ID,
+		FromTag:    fromTag,
+		ToTag:      unit.Container.ImageTag,
+		ImageID:    id,
+		Digest:     digest,
+		Actor:      actor,
+		PromotedAt: time.Now().Unix(),
+	}
+
+	// Inserts are not retried, as in CreateApp.
+	row := session.db.QueryRowContext(
+		ctx,
+		"INSERT INTO promotions (unit_id, from_tag, to_tag, image_id, digest, actor, promoted_at) "+
+			"VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id",
+		promotion.UnitID, promotion.FromTag, promotion.ToTag, promotion.ImageID, promotion.Digest, promotion.Actor,
+		promotion.PromotedAt,
+	)
+	if err := row.Scan(&promotion.ID); err != nil {
+		return nil, err
+	}
+
+	session.Log.WithField("unitID", promotion.UnitID).WithField("imageID", id).WithField("digest", digest).Info("Unit promoted.")
+	return &promotion, nil
+}
+
+// ReadPromotions loads the promotions of one unit, most recent first.
+func (session SessionLease) ReadPromotions(ctx context.Context, unitID int) ([]Promotion, error) {
+	var rows *sql.Rows
+	err := retry.Transient(ctx, func() error {
+		var err error
+		rows, err = session.db.QueryContext(
+			ctx,
+			"SELECT id, unit_id, from_tag, to_tag, image_id, digest, actor, promoted_at FROM promotions "+
+				"WHERE unit_id = $1 ORDER BY promoted_at DESC, id DESC",
+			unitID,
+		)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	promotions := make([]Promotion, 0)
+	for rows.Next() {
+		var p Promotion
+		if err := rows.Scan(&p.ID, &p.UnitID, &p.FromTag, &p.ToTag, &p.ImageID, &p.Digest, &p.Actor, &p.PromotedAt); err != nil {
+			return nil, err
+		}
+		promotions = append(promotions, p)
+	}
+	return promotions, rows.Err()
+}
+
+// HoldAllButUnit holds every unit other than the one with the given ID, so that a sync changes only that unit.
+// Units that are no longer desired are kept.
+func (state *DesiredState) HoldAllButUnit(unitID int) {
+	for i := range state.Units {
+		unit := &state.Units[i]
+		if unit.ID == nil || *unit.ID != unitID {
+			unit.Held = true
+		}
+	}
+	state.KeepUndesired = true
+}
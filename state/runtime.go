@@ -0,0 +1,126 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// dockerRuntime holds the docker run flags of a unit, as stored in its runtime column.
+type dockerRuntime struct {
+	Ulimits    map[string]string `json:"ulimits,omitempty"`
+	ShmSize    string            `json:"shm_size,omitempty"`
+	Devices    []string          `json:"devices,omitempty"`
+	ExtraHosts map[string]string `json:"extra_hosts,omitempty"`
+	GPUs       string            `json:"gpus,omitempty"`
+}
+
+func (unit DesiredSystemdUnit) marshalRuntime() ([]byte, error) {
+	return json.Marshal(dockerRuntime{
+		Ulimits:    unit.Ulimits,
+		ShmSize:    unit.ShmSize,
+		Devices:    unit.Devices,
+		ExtraHosts: unit.ExtraHosts,
+		GPUs:       unit.GPUs,
+	})
+}
+
+func (unit *DesiredSystemdUnit) unmarshalRuntime(raw []byte) error {
+	var runtime dockerRuntime
+	if err := json.Unmarshal(raw, &runtime); err != nil {
+		return err
+	}
+	unit.Ulimits = runtime.Ulimits
+	unit.ShmSize = runtime.ShmSize
+	unit.Devices = runtime.Devices
+	unit.ExtraHosts = runtime.ExtraHosts
+	unit.GPUs = runtime.GPUs
+	return nil
+}
+
+// hasRuntime returns true if any docker run flags are set on the unit.
+func (unit DesiredSystemdUnit) hasRuntime() bool {
+	return len(unit.Ulimits) > 0 || len(unit.ShmSize) > 0 || len(unit.Devices) > 0 || len(unit.ExtraHosts) > 0 ||
+		len(unit.GPUs) > 0
+}
+
+// ulimitNames are the resource limits that docker run accepts.
+var ulimitNames = map[string]bool{
+	"core": true, "cpu": true, "data": true, "fsize": true, "locks": true, "memlock": true, "msgqueue": true,
+	"nice": true, "nofile": true, "nproc": true, "rss": true, "rtprio": true, "rttime": true, "sigpending": true,
+	"stack": true,
+}
+
+var (
+	ulimitValueRx = regexp.MustCompile(`^(-1|[0-9]+)(:(-1|[0-9]+))?$`)
+	shmSizeRx     = regexp.MustCompile(`^[0-9]+[bkmg]?$`)
+	devicePermsRx = regexp.MustCompile(`^[rwm]{1,3}$`)
+	devicePathRx  = regexp.MustCompile(`^/[^\s\x00-\x1f\x7f:]*$`)
+)
+
+// Ulimits populates the resource limits of the unit's container, keyed by name, like "nofile" => "1024:2048".
+func (builder *DesiredSystemdUnitBuilder) Ulimits(ulimits map[string]string) error {
+	for name, value := range ulimits {
+		if !ulimitNames[name] {
+			return fmt.Errorf("invalid ulimit name: %q", name)
+		}
+		if !ulimitValueRx.MatchString(value) {
+			return fmt.Errorf("invalid ulimit value for %s: %q", name, value)
+		}
+	}
+
+	builder.unit.Ulimits = ulimits
+	return nil
+}
+
+// ShmSize populates the size of the container's /dev/shm, like "512m". An empty size uses Docker's default.
+func (builder *DesiredSystemdUnitBuilder) ShmSize(size string) error {
+	if len(size) > 0 && !shmSizeRx.MatchString(size) {
+		return fmt.Errorf("invalid shm size: %q", size)
+	}
+
+	builder.unit.ShmSize = size
+	return nil
+}
+
+// Devices populates the host devices exposed to the container, each given as HOST_PATH[:CONTAINER_PATH[:PERMISSIONS]].
+// Host paths must lie beneath `/dev/`, and neither path may contain whitespace or control characters.
+func (builder *DesiredSystemdUnitBuilder) Devices(devices []string) error {
+	for _, device := range devices {
+		parts := strings.Split(device, ":")
+		if len(parts) > 3 {
+			return fmt.Errorf("invalid device: %q", device)
+		}
+		hostPath := filepath.Clean(parts[0])
+		if !strings.HasPrefix(hostPath, "/dev/") || hostPath != parts[0] || !devicePathRx.MatchString(hostPath) {
+			return fmt.Errorf("invalid device host path: %q", device)
+		}
+		if len(parts) > 1 && !devicePathRx.MatchString(parts[1]) {
+			return fmt.Errorf("invalid device container path: %q", device)
+		}
+		if len(parts) > 2 && !devicePermsRx.MatchString(parts[2]) {
+			return fmt.Errorf("invalid device permissions: %q", device)
+		}
+	}
+
+	builder.unit.Devices = devices
+	return nil
+}
+
+// ExtraHosts populates additional entries for the container's /etc/hosts, mapping host names to IP addresses.
+func (builder *DesiredSystemdUnitBuilder) ExtraHosts(extraHosts map[string]string) error {
+	for host, ip := range extraHosts {
+		if !hostNamePattern.MatchString(host) {
+			return fmt.Errorf("invalid extra host name: %q", host)
+		}
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("invalid IP address for extra host %s: %q", host, ip)
+		}
+	}
+
+	builder.unit.ExtraHosts = extraHosts
+	return nil
+}
@@ -3,19 +3,25 @@ package state
 import (
 	"fmt"
 	"strings"
+
+	"github.com/smashwilson/az-coordinator/secrets"
 )
 
 // ValidateSecretKeys returns an error if any of the keys requested in a set are not loaded in the
 // session's SecretBag and nil if all are present.
 func (s SessionLease) ValidateSecretKeys(secretKeys []string) error {
-	secrets, err := s.GetSecrets()
+	bag, err := s.GetSecrets()
 	if err != nil {
 		return err
 	}
 
+	existing := bag.Keys()
 	missing := make([]string, 0)
 	for _, key := range secretKeys {
-		if !secrets.Has(key) {
+		if !bag.Has(key) {
+			if match, ok := secrets.NearDuplicate(key, existing); ok {
+				key = fmt.Sprintf("%s (did you mean %s?)", key, match)
+			}
 			missing = append(missing, key)
 		}
 	}
@@ -36,7 +42,8 @@ func (s SessionLease) ListSecretKeys() []string {
 }
 
 // SetSecrets adds or updates the values associated with many secrets at once, then persists
-// them to the database.
+// them to the database. It returns a secrets.PolicyViolation without changing anything if the new secrets
+// break the naming policy.
 func (s SessionLease) SetSecrets(secrets map[string]string) error {
 	if len(secrets) == 0 {
 		return nil
@@ -47,6 +54,10 @@ func (s SessionLease) SetSecrets(secrets map[string]string) error {
 		return err
 	}
 
+	if err := bag.ValidateUpdates(secrets); err != nil {
+		return err
+	}
+
 	for key, value := range secrets {
 		bag.Set(key, value)
 	}
@@ -70,5 +81,59 @@ func (s SessionLease) DeleteSecrets(keys []string) error {
 		bag.Delete(key)
 	}
 
-	return bag.SaveToDatabase(s.db, s.ring, true)
+	if err := bag.SaveToDatabase(s.db, s.ring, true); err != nil {
+		return err
+	}
+	return bag.SaveFileDestinations(s.db)
+}
+
+// ListSecretFiles reports the destination of each file-kind secret, keyed by secret key.
+func (s SessionLease) ListSecretFiles() (map[string]secrets.FileDestination, error) {
+	bag, err := s.GetSecrets()
+	if err != nil {
+		return nil, err
+	}
+	return bag.FileDestinations(), nil
+}
+
+// SetSecretFiles makes each secret a file-kind secret written to its FileDestination, then persists the destinations
+// to the database. Nothing is persisted if any destination is invalid.
+func (s SessionLease) SetSecretFiles(destinations map[string]secrets.FileDestination) error {
+	if len(destinations) == 0 {
+		return nil
+	}
+
+	bag, err := s.GetSecrets()
+	if err != nil {
+		return err
+	}
+
+	for key, destination := range destinations {
+		if !bag.Has(key) {
+			return fmt.Errorf("Unrecognized secret key: %s", key)
+		}
+		if err := bag.SetFileDestination(key, destination); err != nil {
+			return err
+		}
+	}
+
+	return bag.SaveFileDestinations(s.db)
+}
+
+// ClearSecretFiles makes each secret an env-kind secret again, then persists the destinations to the database.
+func (s SessionLease) ClearSecretFiles(keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	bag, err := s.GetSecrets()
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		bag.ClearFileDestination(key)
+	}
+
+	return bag.SaveFileDestinations(s.db)
 }
@@ -0,0 +1,109 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultSelfUnitName returns the systemd unit that runs the coordinator when no TypeSelf unit is desired, like
+// "az-coordinator.service".
+func DefaultSelfUnitName() string {
+	return UnitPrefix() + "coordinator.service"
+}
+
+// DefaultSelfUnitPath returns the location of the unit file that InstallSelfUnit creates.
+func DefaultSelfUnitPath() string {
+	return filepath.Join(UnitDirectory(), DefaultSelfUnitName())
+}
+
+// ReadSelfUnit queries the database for the desired unit that manages the coordinator itself. It returns nil if no
+// TypeSelf unit exists.
+func (session SessionLease) ReadSelfUnit(ctx context.Context) (*DesiredSystemdUnit, error) {
+	units, err := session.readDesiredUnits(ctx, "WHERE type = $1", TypeSelf)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(units) == 0 {
+		return nil, nil
+	}
+
+	return &units[0], nil
+}
+
+// RestartSelf asks systemd to restart the unit that runs the coordinator, so that a newly installed binary takes
+// effect. The restart job is not awaited, because it stops this process.
+func (session SessionLease) RestartSelf(ctx context.Context) error {
+	unitName := DefaultSelfUnitName()
+	unit, err := session.ReadSelfUnit(ctx)
+	if err != nil {
+		session.Log.WithError(err).Warn("Unable to read the coordinator's unit. Restarting the default unit.")
+	} else if unit != nil {
+		unitName = unit.UnitName()
+	}
+
+	session.Log.WithField("unitName", unitName).Info("Restarting coordinator.")
+	_, err = session.conn.RestartUnit(unitName, "replace", nil)
+	return err
+}
+
+// InstallSelfUnit ensures that a TypeSelf unit is desired, creating one at DefaultSelfUnitPath if none exists. It then
+// renders the unit file, owned by uid and gid, and enables it, so that subsequent syncs find the coordinator already
+// running under its own management. The unit is not started.
+func (session SessionLease) InstallSelfUnit(ctx context.Context, uid, gid int) (*DesiredSystemdUnit, error) {
+	unit, err := session.ReadSelfUnit(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if unit == nil {
+		builder := BuildDesiredUnit()
+		if err := builder.Path(DefaultSelfUnitPath()); err != nil {
+			return nil, err
+		}
+		if err := builder.Type(TypeSelf); err != nil {
+			return nil, err
+		}
+		if unit, err = builder.Build(); err != nil {
+			return nil, err
+		}
+
+		if err := unit.MakeDesired(ctx, session); err != nil {
+			return nil, err
+		}
+		session.Log.WithField("unitFilePath", unit.Path).Info("Coordinator unit is now desired.")
+	}
+
+	f, err := os.OpenFile(unit.Path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	errs := session.WriteUnit(*unit, f)
+	f.Close()
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("Unable to render unit file %s (%v)", unit.Path, errs)
+	}
+
+	if err := os.Chown(unit.Path, uid, gid); err != nil {
+		return nil, err
+	}
+	session.Log.WithFields(logrus.Fields{
+		"unitFilePath": unit.Path,
+		"uid":          uid,
+		"gid":          gid,
+	}).Info("Coordinator unit file written.")
+
+	if err := session.conn.Reload(); err != nil {
+		return nil, fmt.Errorf("Unable to trigger a systemd reload (%v)", err)
+	}
+	if _, _, err := session.conn.EnableUnitFiles([]string{unit.Path}, false, true); err != nil {
+		return nil, fmt.Errorf("Unable to enable unit %s (%v)", unit.UnitName(), err)
+	}
+	session.Log.WithField("unitName", unit.UnitName()).Info("Coordinator unit enabled.")
+
+	return unit, nil
+}
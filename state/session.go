@@ -1,28 +1,56 @@
 package state
 
 import (
-	"database/sql"
+	"context"
+	"time"
 
 	"github.com/coreos/go-systemd/dbus"
 	"github.com/docker/docker/client"
 	"github.com/sirupsen/logrus"
 	"github.com/smashwilson/az-coordinator/secrets"
+	"github.com/smashwilson/az-coordinator/store"
 )
 
 // Session centralizes all of the resources necessary for a single request or operation.
 type Session struct {
-	db   *sql.DB
+	db   *store.DB
 	ring *secrets.DecoderRing
 	cli  *client.Client
 	conn *dbus.Conn
 }
 
-// NewSession establishes all of the connections necessary to perform an operation.
-func NewSession(db *sql.DB, ring *secrets.DecoderRing, dockerAPIVersion string) (*Session, error) {
+// negotiationTimeout limits how long NewDockerClient waits for the Docker daemon to report its API version.
+const negotiationTimeout = 10 * time.Second
+
+// NewDockerClient connects to the Docker daemon named by the environment. If dockerAPIVersion is set, every request
+// uses that API version. Otherwise, the client asks the daemon for the newest API version that both of them support,
+// so that upgrading the daemon doesn't strand the coordinator on an API version that it no longer accepts. If the
+// daemon can't be reached, the client's own API version is used.
+func NewDockerClient(dockerAPIVersion string) (*client.Client, error) {
+	if len(dockerAPIVersion) > 0 {
+		return client.NewClientWithOpts(client.WithVersion(dockerAPIVersion), client.FromEnv)
+	}
+
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), negotiationTimeout)
+	defer cancel()
+	cli.NegotiateAPIVersion(ctx)
+
+	logrus.WithField("version", cli.ClientVersion()).Debug("Negotiated Docker API version.")
+	return cli, nil
+}
+
+// NewSession establishes all of the connections necessary to perform an operation. An empty dockerAPIVersion
+// negotiates the API version with the daemon, as in NewDockerClient.
+func NewSession(db *store.DB, ring *secrets.DecoderRing, dockerAPIVersion string) (*Session, error) {
 	log := logrus.StandardLogger()
 
 	log.Debug("Creating Docker client.")
-	cli, err := client.NewClientWithOpts(client.WithVersion(dockerAPIVersion), client.FromEnv)
+	cli, err := NewDockerClient(dockerAPIVersion)
 	if err != nil {
 		return nil, err
 	}
@@ -41,6 +69,11 @@ func NewSession(db *sql.DB, ring *secrets.DecoderRing, dockerAPIVersion string)
 	}, nil
 }
 
+// DockerAPIVersion returns the Docker API version that the session's requests use, as pinned or negotiated.
+func (s Session) DockerAPIVersion() string {
+	return s.cli.ClientVersion()
+}
+
 // Close disposes of any connection resources acquired by NewSession.
 func (s Session) Close() error {
 	s.conn.Close()
@@ -1,48 +1,188 @@
 package state
 
 import (
+	"context"
+	"database/sql"
 	"errors"
-	"fmt"
-	"os/exec"
-	"regexp"
-	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/tracing"
 )
 
 // SyncSettings configures synchronization behavior.
 type SyncSettings struct {
 	UID int
 	GID int
+
+	// ReadTimeout limits each phase that reads desired state, actual state, or Docker images. Zero means no limit.
+	ReadTimeout time.Duration
+
+	// PullTimeout limits the phase that pulls container images. Zero means no limit.
+	PullTimeout time.Duration
+
+	// ApplyTimeout limits the phase that applies the computed Delta. Zero means no limit.
+	ApplyTimeout time.Duration
+
+	// HealthDelay is the time to wait after a successful apply before checking that the units it started are still
+	// running. Zero skips the check.
+	HealthDelay time.Duration
+
+	// Trigger records who or what requested the sync.
+	Trigger SyncTrigger
+
+	// Prune decides whether and how unused Docker data is pruned after the Delta is applied.
+	Prune PrunePolicy
+
+	// Host limits the sync to the units that run on this host. Empty means every unit.
+	Host string
+
+	// Labels are the labels carried by Host, which are matched against each unit's selector.
+	Labels map[string]string
+
+	// App, if set, limits the sync to the units of the app with this ID. Every other unit is held, and units that are
+	// no longer desired are kept.
+	App *int
+
+	// Unit, if set, limits the sync to the desired unit with this ID, like App.
+	Unit *int
+
+	// Approval parks Deltas that exceed it: Synchronize returns them with ErrApprovalRequired instead of applying them.
+	Approval ApprovalPolicy
+
+	// Approved is the Fingerprint of a Delta that has been approved. A Delta with this fingerprint is applied even if
+	// it exceeds Approval.
+	Approved string
+
+	// Pulls limits the concurrency, duration, and retries of the image pulls.
+	Pulls PullPolicy
+
+	// Force allows the sync to remove protected units that are no longer desired, including the unit that runs the
+	// coordinator itself, and to remove more than MaxUnitRemovals units. Without it, protected units are left in place
+	// and listed in the Delta's ProtectedUnits.
+	Force bool
+
+	// MaxUnitRemovals is the number of units that the sync may remove unless it's forced. Zero means no limit.
+	MaxUnitRemovals int
+
+	// Restart names units that are restarted even if nothing about them changed, like one whose container died.
+	// Held units are left alone.
+	Restart []string
+
+	// OnPullProgress, if set, is called with the progress of each image pull as it's downloaded. It may be called from
+	// several goroutines at once.
+	OnPullProgress func(ImagePullProgress)
+
+	// CheckCommit, if set, gates the rollout of new images on the checks of the commits that they were built from.
+	// Units whose new image's checks haven't passed are held, and listed in the Delta's GatedUnits.
+	CheckCommit CommitChecker
+
+	// OnApply, if set, is called with the Delta just before it's applied. It isn't called if the sync stops before
+	// then, like when the Delta needs approval.
+	OnApply func(Delta)
+
+	// Desired, if set, is used instead of the desired state in the database. The sync lock is only taken when the
+	// desired state is read from the database, so an agent that has no database of its own can still synchronize.
+	Desired *DesiredState
 }
 
-var dfPercentRx = regexp.MustCompile(`(\d+)%`)
+// withTimeout derives a Context from parent that expires after timeout, or that is only cancelled explicitly if
+// timeout is zero.
+func withTimeout(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, timeout)
+}
 
-// ReadDiskUsage reads the current usage level of the disk partition that stores Docker images and returns it as a
-// percentage.
-func (s SessionLease) ReadDiskUsage() (int, error) {
-	out, err := exec.Command("df", "/var/lib/docker").Output()
-	if err != nil {
-		if exitError, ok := err.(*exec.ExitError); ok {
-			s.Log.WithField("exitCode", exitError.ExitCode()).Warnf("df command exited abnormally:\n%s\n", exitError.Stderr)
+// syncLockKey identifies the database lock held for the duration of each sync. It spells "azsync".
+const syncLockKey int64 = 0x617a73796e63
+
+// ErrSyncInProgress is returned by Synchronize when another process that shares the database is already performing a
+// sync.
+var ErrSyncInProgress = errors.New("sync already running elsewhere")
+
+// ErrSyncCanceled is returned by Synchronize when its Context is canceled before the Delta is applied. Nothing has
+// been applied.
+var ErrSyncCanceled = errors.New("sync canceled")
+
+// checkCanceled returns ErrSyncCanceled if ctx has been canceled. Synchronize checks it between phases, so that a
+// canceled sync stops before it applies anything.
+func checkCanceled(ctx context.Context) []error {
+	if ctx.Err() == context.Canceled {
+		return []error{ErrSyncCanceled}
+	}
+	return nil
+}
+
+// syncCanceled returns true if errs show that a sync was canceled, either between phases or during one.
+func syncCanceled(errs []error) bool {
+	for _, err := range errs {
+		if err == ErrSyncCanceled || err == context.Canceled {
+			return true
 		}
-		return 0, err
 	}
-	s.Log.Debugf("df /var/lib/docker:\n%s\n", out)
+	return false
+}
+
+// detachedContext carries the values of its Context, but is never cancelled and has no deadline. Applying a Delta
+// uses one, so that a canceled sync never leaves a Delta half-applied.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// acquireSyncLock takes an advisory lock that prevents any other process sharing the database from synchronizing at
+// the same time. It returns ErrSyncInProgress if the lock is already held. Call the returned function to release it.
+func (s *SessionLease) acquireSyncLock(ctx context.Context) (func(), error) {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
 
-	matches := dfPercentRx.FindAllSubmatch(out, 2)
-	if matches == nil {
-		return 0, fmt.Errorf("Unable to parse partition use percentage from df output: %s", out)
+	acquired, err := s.db.Dialect.TryLock(ctx, conn, syncLockKey)
+	if err != nil {
+		conn.Close()
+		return nil, err
 	}
-	if len(matches) > 1 {
-		return 0, fmt.Errorf("Found multiple percentages in df output: %s", out)
+	if !acquired {
+		conn.Close()
+		return nil, ErrSyncInProgress
 	}
-	match := matches[0][1]
-	i64, err := strconv.ParseInt(string(match), 10, 32)
-	return int(i64), err
+
+	return func() {
+		if err := s.db.Dialect.Unlock(context.Background(), conn, syncLockKey); err != nil {
+			s.Log.WithError(err).Warn("Unable to release sync lock.")
+		}
+		if err := conn.Close(); err != nil && err != sql.ErrConnDone {
+			s.Log.WithError(err).Warn("Unable to close sync lock connection.")
+		}
+	}, nil
 }
 
 // Synchronize brings local Docker images up to date, then reads desired and actual state, computes a
-// Delta between them, and applies it. The applied Delta is returned.
-func (s *SessionLease) Synchronize(settings SyncSettings) (*Delta, []error) {
+// Delta between them, and applies it. The applied Delta is returned. Each phase is bounded by the timeouts in
+// settings. If ctx is cancelled before the Delta is applied, the sync stops at the next phase or image pull, and the
+// only error returned is ErrSyncCanceled; once the Delta is being applied, it's applied in full, and only the health
+// check and pruning that follow are skipped. If another process is already synchronizing,
+// the only error returned is ErrSyncInProgress. If the Delta needs approval, it's returned unapplied with
+// ErrApprovalRequired as the only error. If only some of the Delta could be applied, it's returned with the errors,
+// and its UnitResults report which units were.
+func (s *SessionLease) Synchronize(ctx context.Context, settings SyncSettings) (delta *Delta, errs []error) {
+	ctx, span := tracing.Start(ctx, "Synchronize")
+	span.SetAttribute("trigger.source", settings.Trigger.Source)
+	span.SetAttribute("trigger.actor", settings.Trigger.Actor)
+	defer func() {
+		if delta == nil && syncCanceled(errs) {
+			errs = []error{ErrSyncCanceled}
+		}
+		span.RecordErrors(errs)
+		span.End()
+	}()
+
 	uid := -1
 	gid := -1
 	if settings.UID != 0 {
@@ -52,50 +192,161 @@ func (s *SessionLease) Synchronize(settings SyncSettings) (*Delta, []error) {
 		gid = settings.GID
 	}
 
-	s.Log.Info("Reading desired state.")
-	desired, err := s.ReadDesiredState()
-	if err != nil {
-		return nil, []error{err}
+	s.Log.WithFields(logrus.Fields{
+		"source": settings.Trigger.Source,
+		"actor":  settings.Trigger.Actor,
+		"reason": settings.Trigger.Reason,
+	}).Info("Sync requested.")
+
+	readCtx, cancelRead := withTimeout(ctx, settings.ReadTimeout)
+	defer cancelRead()
+
+	// Syncs are checkpointed only while they hold the sync lock, so that they never overwrite the checkpoint of a
+	// sync that's running elsewhere.
+	var cp *checkpointer
+
+	desired := settings.Desired
+	if desired == nil {
+		s.Log.Info("Acquiring sync lock.")
+		release, err := s.acquireSyncLock(ctx)
+		if err != nil {
+			return nil, []error{err}
+		}
+		defer release()
+
+		cp = s.startCheckpoint(ctx, settings)
+		defer func() { cp.finish(errs) }()
+
+		s.Log.Info("Reading desired state.")
+		desired, err = s.ReadDesiredState(readCtx)
+		if err != nil {
+			return nil, []error{err}
+		}
 	}
+	if settings.App != nil {
+		desired.HoldAllBut(*settings.App)
+	}
+	if settings.Unit != nil {
+		desired.HoldAllButUnit(*settings.Unit)
+	}
+	all := desired.Units
+	scoped := desired.ForHost(settings.Host, settings.Labels)
+	scoped.RemoveProtected = settings.Force
+	desired = &scoped
 
+	if errs := checkGPUs(desired.Units); len(errs) > 0 {
+		return nil, append(errs, errors.New("requested GPUs are unavailable"))
+	}
+
+	cp.reach(ctx, PhaseReadActual)
 	s.Log.Info("Reading actual state.")
-	actual, err := s.ReadActualState()
+	actual, err := s.ReadActualState(readCtx)
 	if err != nil {
 		return nil, []error{err, errors.New("unable to read system state")}
 	}
 
 	s.Log.Info("Reading original docker images.")
-	if errs := actual.ReadImages(s, *desired); len(errs) > 0 {
+	if errs := actual.ReadImages(readCtx, s, *desired); len(errs) > 0 {
 		return nil, append(errs, errors.New("unable to read original images"))
 	}
 
+	if errs := checkCanceled(ctx); errs != nil {
+		return nil, errs
+	}
+
+	cp.reach(ctx, PhasePull)
 	s.Log.Info("Pulling referenced images.")
-	if errs := s.PullAllImages(*desired); len(errs) > 0 {
-		return nil, append(errs, errors.New("pull errors"))
+	pullCtx, cancelPull := withTimeout(ctx, settings.PullTimeout)
+	defer cancelPull()
+
+	pullFailures := s.PullAllImages(pullCtx, *desired, settings.Pulls, settings.OnPullProgress)
+	if len(pullFailures) > 0 {
+		s.Log.WithField("count", len(pullFailures)).Warn("Some images could not be pulled. Continuing with the local copies.")
+	}
+
+	if errs := checkCanceled(ctx); errs != nil {
+		return nil, errs
 	}
 
 	s.Log.Info("Reading updated docker images.")
-	if err = desired.ReadImages(s); err != nil {
+	rereadCtx, cancelReread := withTimeout(ctx, settings.ReadTimeout)
+	defer cancelReread()
+
+	if err = desired.ReadImages(rereadCtx, s); err != nil {
 		return nil, []error{err, errors.New("unable to pull docker images")}
 	}
 
+	var gated []GatedUnit
+	if settings.CheckCommit != nil {
+		s.Log.Info("Checking commit statuses.")
+		gated = s.gateCommits(rereadCtx, desired, actual, settings.CheckCommit)
+	}
+
+	cp.reach(ctx, PhaseCompute)
 	s.Log.Info("Computing delta.")
-	delta := s.Between(desired, actual)
+	computed := s.Between(ctx, desired, actual)
+	computed.PullFailures = pullFailures
+	computed.GatedUnits = gated
+	computed.restartUnits(*desired, settings.Restart)
 
-	if errs := delta.Apply(s, uid, gid); len(errs) > 0 {
-		return nil, append(errs, errors.New("unable to apply delta"))
+	if err := CheckForce("remove %d units", len(computed.UnitsToRemove), settings.MaxUnitRemovals, settings.Force); err != nil {
+		s.Log.WithError(err).Warn("Delta removes too many units. Nothing was applied.")
+		return &computed, []error{err}
 	}
 
-	usage, err := s.ReadDiskUsage()
-	if err != nil {
-		s.Log.WithError(err).Warn("Unable to read disk usage")
-	} else if usage >= 70 {
-    s.Log.WithField("usage", usage).Warn("Disk is getting full: prune advised.")
-		s.Log.Info("Pruning unused docker data.")
-		s.Prune()
+	if reasons := settings.Approval.Reasons(computed); len(reasons) > 0 {
+		if computed.Fingerprint() != settings.Approved {
+			s.Log.WithField("reasons", reasons).Warn("Delta requires approval. Nothing was applied.")
+			return &computed, []error{ErrApprovalRequired}
+		}
+		s.Log.WithField("reasons", reasons).Info("Applying approved delta.")
+	}
+
+	if errs := checkCanceled(ctx); errs != nil {
+		return nil, errs
+	}
+
+	cp.reach(ctx, PhaseApply)
+	if settings.OnApply != nil {
+		settings.OnApply(computed)
+	}
+	applyCtx, cancelApply := withTimeout(detachedContext{ctx}, settings.ApplyTimeout)
+	defer cancelApply()
+
+	applyStart := time.Now()
+	results, applyErrs := computed.Apply(applyCtx, s, uid, gid)
+	computed.UnitResults = results
+	computed.ApplyMillis = time.Since(applyStart).Nanoseconds() / int64(time.Millisecond)
+	if len(applyErrs) > 0 {
+		// The Delta is returned with the errors, so that the units that were applied can be reported.
+		return &computed, append(applyErrs, errors.New("unable to apply delta"))
+	}
+
+	if settings.Desired == nil {
+		if err := s.recordAppReleases(detachedContext{ctx}, all); err != nil {
+			s.Log.WithError(err).Warn("Unable to record app releases.")
+		}
+		if err := s.recordUnitHashes(detachedContext{ctx}, settings.Host, computed); err != nil {
+			s.Log.WithError(err).Warn("Unable to record unit file digests.")
+		}
+	}
+
+	if ctx.Err() == context.Canceled {
+		s.Log.Warn("Sync canceled after its delta was applied. Skipping health checks and pruning.")
+		return &computed, nil
+	}
+
+	if settings.HealthDelay > 0 {
+		cp.reach(ctx, PhaseHealth)
+		computed.Health = s.CheckHealth(ctx, computed, settings.HealthDelay)
+	}
+
+	cp.reach(ctx, PhasePrune)
+	if result, err := s.autoPrune(ctx, settings.Prune); err != nil {
+		s.Log.WithError(err).Warn("Unable to prune unused docker data.")
 	} else {
-		s.Log.WithField("usage", usage).Info("No prune necessary yet.")
+		computed.Prune = result
 	}
 
-	return &delta, nil
+	return &computed, nil
 }
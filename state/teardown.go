@@ -0,0 +1,63 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+)
+
+// RemoveAllUnits stops, disables, and deletes every managed unit file known to systemd, including the coordinator's own
+// unit. Failures are collected and returned, but do not prevent the remaining units from being removed.
+func (session SessionLease) RemoveAllUnits(ctx context.Context) []error {
+	var (
+		conn = session.conn
+		log  = session.Log
+		errs = make([]error, 0)
+	)
+
+	listedUnits, err := conn.ListUnitFilesByPatterns(nil, unitFilePatterns())
+	if err != nil {
+		return append(errs, err)
+	}
+	if len(listedUnits) == 0 {
+		log.Info("No units to remove.")
+		return errs
+	}
+
+	unitNames := make([]string, 0, len(listedUnits))
+	stops := make(chan string, len(listedUnits))
+	for _, listedUnit := range listedUnits {
+		unitName := path.Base(listedUnit.Path)
+		unitNames = append(unitNames, unitName)
+
+		log.WithField("unitName", unitName).Debug("Stopping unit.")
+		if _, err := conn.StopUnit(unitName, "replace", stops); err != nil {
+			errs = append(errs, fmt.Errorf("Unable to stop unit %s (%v)", unitName, err))
+			stops <- ""
+		}
+	}
+	if err := awaitJobs(ctx, stops, len(listedUnits)); err != nil {
+		return append(errs, fmt.Errorf("Timed out waiting for units to stop (%v)", err))
+	}
+	log.WithField("count", len(unitNames)).Info("Units stopped.")
+
+	if _, err := conn.DisableUnitFiles(unitNames, false); err != nil {
+		errs = append(errs, fmt.Errorf("Unable to disable units %v (%v)", unitNames, err))
+	}
+	log.WithField("count", len(unitNames)).Info("Units disabled.")
+
+	for _, listedUnit := range listedUnits {
+		if err := os.Remove(listedUnit.Path); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, fmt.Errorf("Unable to remove unit file %s (%v)", listedUnit.Path, err))
+			continue
+		}
+		log.WithField("unitFilePath", listedUnit.Path).Info("Removed unit file.")
+	}
+
+	if err := conn.Reload(); err != nil {
+		errs = append(errs, fmt.Errorf("Unable to trigger a systemd reload (%v)", err))
+	}
+
+	return errs
+}
@@ -1,22 +1,62 @@
 package state
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
-	"strings"
+	"regexp"
 	"text/template"
 )
 
 type resolvedSystemdUnit struct {
-	U        DesiredSystemdUnit
-	UnitName string
-	Env      map[string]string
-	Argv0    string
+	U            DesiredSystemdUnit
+	UnitName     string
+	Env          map[string]string
+	SecretHashes map[string]string
+	Argv0        string
+
+	// Image is the image that the unit's container runs: its pinned image ID, or its image name and tag.
+	Image string
+
+	// Marker and ManagedLabel identify the unit file and its container as the coordinator's. The Marker of a protected
+	// unit also carries the ProtectedMarker.
+	Marker       string
+	ManagedLabel string
+}
+
+// secretHashRx matches the comments that record a digest of each secret value a unit file was rendered with.
+var secretHashRx = regexp.MustCompile(`(?m)^# secret (\S+) sha256:([0-9a-f]+)$`)
+
+// secretHash returns an abbreviated digest of a secret value, so that changes to it can be detected without
+// comparing the value itself.
+func secretHash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:8])
+}
+
+// renderedSecretHashes parses the secret digests recorded in the contents of a unit file.
+func renderedSecretHashes(content []byte) map[string]string {
+	hashes := make(map[string]string)
+	for _, m := range secretHashRx.FindAllSubmatch(content, -1) {
+		hashes[string(m[1])] = string(m[2])
+	}
+	return hashes
+}
+
+// templateFuncs quote values for the unit file templates.
+var templateFuncs = template.FuncMap{
+	"execArg":               execArg,
+	"environmentAssignment": environmentAssignment,
 }
 
 const simpleSource = `[Unit]
+{{ .Marker }}
+{{- range $key, $hash := .SecretHashes }}
+# secret {{ $key }} sha256:{{ $hash }}
+{{- end }}
 Description={{ .UnitName }}
 After=docker.service
 Requires=docker.service
@@ -28,28 +68,48 @@ ExecStartPre=-/usr/bin/docker rm {{ .U.Container.Name }}
 ExecStart=/usr/bin/docker run \
   --log-driver=awslogs \
   --log-opt awslogs-region=us-east-1 \
-  --log-opt awslogs-group={{ .UnitName }}.{{ .U.Container.ImageTag }} \
+  --log-opt {{ execArg (printf "awslogs-group=%s.%s" .UnitName .U.Container.ImageTag) }} \
   --log-opt awslogs-create-group=true \
   --network local \
+  --label {{ .ManagedLabel }}=true \
 {{- range $key, $value := .Env }}
-  --env {{ $key }}="{{ $value }}" \
+  {{ execArg (printf "--env=%s=%s" $key $value) }} \
 {{- end }}
 {{- range $hostPath, $containerPath := .U.Volumes }}
-  --volume {{ $hostPath }}:{{ $containerPath }}:ro,z \
+  {{ execArg (printf "--volume=%s:%s:ro,z" $hostPath $containerPath) }} \
 {{- end }}
 {{- range $localPort, $externalPort := .U.Ports }}
   --publish {{ $localPort }}:{{ $externalPort }} \
+{{- end }}
+{{- range $name, $limit := .U.Ulimits }}
+  --ulimit {{ $name }}={{ $limit }} \
+{{- end }}
+{{- if .U.ShmSize }}
+  --shm-size {{ .U.ShmSize }} \
+{{- end }}
+{{- range .U.Devices }}
+  {{ execArg (printf "--device=%s" .) }} \
+{{- end }}
+{{- range $host, $ip := .U.ExtraHosts }}
+  --add-host {{ $host }}:{{ $ip }} \
+{{- end }}
+{{- if .U.GPUs }}
+  --gpus '"{{ .U.GPUs }}"' \
 {{- end }}
   --name {{ .U.Container.Name }} \
-  {{ .U.Container.ImageName }}:{{ .U.Container.ImageTag }}
+  {{ execArg .Image }}
 
 [Install]
 WantedBy=multi-user.target
 `
 
-var simpleTemplate = template.Must(template.New("simple").Parse(simpleSource))
+var simpleTemplate = template.Must(template.New("simple").Funcs(templateFuncs).Parse(simpleSource))
 
 const oneShotSource = `[Unit]
+{{ .Marker }}
+{{- range $key, $hash := .SecretHashes }}
+# secret {{ $key }} sha256:{{ $hash }}
+{{- end }}
 Description={{ .UnitName }}
 Requires=docker.service
 
@@ -58,24 +118,41 @@ Type=oneshot
 ExecStart=/usr/bin/docker run --rm \
   --log-driver=awslogs \
   --log-opt awslogs-region=us-east-1 \
-  --log-opt awslogs-group={{ .UnitName }}.{{ .U.Container.ImageTag }} \
+  --log-opt {{ execArg (printf "awslogs-group=%s.%s" .UnitName .U.Container.ImageTag) }} \
   --log-opt awslogs-create-group=true \
   --network local \
+  --label {{ .ManagedLabel }}=true \
 {{- range $key, $value := .Env }}
-  --env {{ $key }}="{{ $value }}" \
+  {{ execArg (printf "--env=%s=%s" $key $value) }} \
 {{- end }}
 {{- range $hostPath, $containerPath := .U.Volumes }}
-  --volume {{ $hostPath }}:{{ $containerPath }}:ro,z \
+  {{ execArg (printf "--volume=%s:%s:ro,z" $hostPath $containerPath) }} \
 {{- end }}
 {{- range $localPort, $externalPort := .U.Ports }}
   --publish {{ $localPort }}:{{ $externalPort }} \
 {{- end }}
-  {{ .U.Container.ImageName }}:{{ .U.Container.ImageTag }}
+{{- range $name, $limit := .U.Ulimits }}
+  --ulimit {{ $name }}={{ $limit }} \
+{{- end }}
+{{- if .U.ShmSize }}
+  --shm-size {{ .U.ShmSize }} \
+{{- end }}
+{{- range .U.Devices }}
+  {{ execArg (printf "--device=%s" .) }} \
+{{- end }}
+{{- range $host, $ip := .U.ExtraHosts }}
+  --add-host {{ $host }}:{{ $ip }} \
+{{- end }}
+{{- if .U.GPUs }}
+  --gpus '"{{ .U.GPUs }}"' \
+{{- end }}
+  {{ execArg .Image }}
 `
 
-var oneShotTemplate = template.Must(template.New("one-shot").Parse(oneShotSource))
+var oneShotTemplate = template.Must(template.New("one-shot").Funcs(templateFuncs).Parse(oneShotSource))
 
 const timerSource = `[Unit]
+{{ .Marker }}
 Description={{ .UnitName }}
 
 [Timer]
@@ -85,9 +162,13 @@ OnCalendar={{ .U.Schedule }}
 WantedBy=timers.target
 `
 
-var timerTemplate = template.Must(template.New("timer").Parse(timerSource))
+var timerTemplate = template.Must(template.New("timer").Funcs(templateFuncs).Parse(timerSource))
 
 const selfSource = `[Unit]
+{{ .Marker }}
+{{- range $key, $hash := .SecretHashes }}
+# secret {{ $key }} sha256:{{ $hash }}
+{{- end }}
 Description=az-coordinator
 After=docker.service
 Wants=docker.service
@@ -96,7 +177,7 @@ Wants=docker.service
 User=coordinator
 Restart=always
 {{- range $key, $value := .Env }}
-Environment="{{ $key }}={{ $value }}"
+Environment={{ environmentAssignment $key $value }}
 {{- end }}
 ExecStart={{ .Argv0 }} serve
 
@@ -104,7 +185,7 @@ ExecStart={{ .Argv0 }} serve
 WantedBy=multi-user.target
 `
 
-var selfTemplate = template.Must(template.New("self").Parse(selfSource))
+var selfTemplate = template.Must(template.New("self").Funcs(templateFuncs).Parse(selfSource))
 
 var templatesByType = map[UnitType]*template.Template{
 	TypeSimple:  simpleTemplate,
@@ -122,6 +203,7 @@ func getTemplate(templateType UnitType) (*template.Template, error) {
 
 func resolveDesiredUnit(unit DesiredSystemdUnit, session *SessionLease) (*resolvedSystemdUnit, []error) {
 	fullEnv := make(map[string]string, len(unit.Env)+len(unit.Secrets))
+	secretHashes := make(map[string]string, len(unit.Secrets))
 	errs := make([]error, 0)
 
 	bag, err := session.GetSecrets()
@@ -131,7 +213,17 @@ func resolveDesiredUnit(unit DesiredSystemdUnit, session *SessionLease) (*resolv
 	}
 
 	for k, v := range unit.Env {
-		fullEnv[k] = strings.ReplaceAll(v, "\n", "\\n\\\n")
+		v, err := interpolateSecrets(v, bag)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		fullEnv[k] = v
+	}
+	for _, k := range unit.envSecretKeys() {
+		if bag.Has(k) {
+			secretHashes[k] = secretHash(bag.Get(k, ""))
+		}
 	}
 
 	for _, k := range unit.Secrets {
@@ -140,7 +232,8 @@ func resolveDesiredUnit(unit DesiredSystemdUnit, session *SessionLease) (*resolv
 			errs = append(errs, err)
 			continue
 		}
-		fullEnv[k] = strings.ReplaceAll(v, "\n", "\\n\\\n")
+		fullEnv[k] = v
+		secretHashes[k] = secretHash(v)
 	}
 
 	argv0, err := exec.LookPath(os.Args[0])
@@ -157,11 +250,28 @@ func resolveDesiredUnit(unit DesiredSystemdUnit, session *SessionLease) (*resolv
 		unitName = unit.Container.Name
 	}
 
+	image := ""
+	if unit.Container != nil {
+		image = unit.Container.ImageName + ":" + unit.Container.ImageTag
+		if len(unit.Container.PinnedImageID) > 0 {
+			image = unit.Container.PinnedImageID
+		}
+	}
+
+	marker := UnitMarker
+	if unit.Protected && unit.Type != TypeSelf {
+		marker += "\n" + ProtectedMarker
+	}
+
 	return &resolvedSystemdUnit{
-		U:        unit,
-		UnitName: unitName,
-		Env:      fullEnv,
-		Argv0:    argv0,
+		U:            unit,
+		UnitName:     unitName,
+		Env:          fullEnv,
+		SecretHashes: secretHashes,
+		Argv0:        argv0,
+		Image:        image,
+		Marker:       marker,
+		ManagedLabel: ManagedLabel,
 	}, errs
 }
 
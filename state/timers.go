@@ -0,0 +1,55 @@
+package state
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// CompanionUnit returns the oneshot unit that a timer unit fires to run its container, or nil if this isn't a timer
+// unit with a container. The companion shares the timer's path, with a .service extension, so that systemd
+// activates it when the timer elapses.
+func (unit DesiredSystemdUnit) CompanionUnit() *DesiredSystemdUnit {
+	if unit.Type != TypeTimer || unit.Container == nil {
+		return nil
+	}
+
+	return &DesiredSystemdUnit{
+		Path:      strings.TrimSuffix(unit.Path, filepath.Ext(unit.Path)) + ".service",
+		Type:      TypeOneShot,
+		Container: unit.Container,
+		Secrets:   unit.Secrets,
+		Env:       unit.Env,
+		Ports:     unit.Ports,
+		Volumes:   unit.Volumes,
+
+		Ulimits:    unit.Ulimits,
+		ShmSize:    unit.ShmSize,
+		Devices:    unit.Devices,
+		ExtraHosts: unit.ExtraHosts,
+		GPUs:       unit.GPUs,
+
+		Hosts:     unit.Hosts,
+		Selector:  unit.Selector,
+		AppID:     unit.AppID,
+		App:       unit.App,
+		Held:      unit.Held,
+		Enabled:   unit.Enabled,
+		Companion: true,
+	}
+}
+
+// managedUnits returns the desired units that should be present on the host, along with the companion of each timer
+// unit that runs a container. Disabled units are omitted unless they're held.
+func (state DesiredState) managedUnits() []DesiredSystemdUnit {
+	units := make([]DesiredSystemdUnit, 0, len(state.Units))
+	for _, unit := range state.Units {
+		if !unit.Enabled && !unit.Held {
+			continue
+		}
+		units = append(units, unit)
+		if companion := unit.CompanionUnit(); companion != nil {
+			units = append(units, *companion)
+		}
+	}
+	return units
+}
@@ -0,0 +1,76 @@
+package state
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+)
+
+// Recognized SyncTrigger sources.
+const (
+	// TriggerCLI syncs were requested by running the sync command.
+	TriggerCLI = "cli"
+
+	// TriggerInit syncs are performed by the init command.
+	TriggerInit = "init"
+
+	// TriggerStartup syncs are performed when the server starts.
+	TriggerStartup = "startup"
+
+	// TriggerLeadership syncs are performed when this instance becomes the leader.
+	TriggerLeadership = "leadership"
+
+	// TriggerAPI syncs were requested with a POST to the management API.
+	TriggerAPI = "api"
+
+	// TriggerWebhook syncs were requested by an external service's webhook, like a container registry.
+	TriggerWebhook = "webhook"
+
+	// TriggerScheduler syncs were started on a schedule.
+	TriggerScheduler = "scheduler"
+
+	// TriggerSlack syncs were requested with a Slack slash command or button.
+	TriggerSlack = "slack"
+
+	// TriggerDocker syncs were started to restore a container that the Docker daemon reported dead.
+	TriggerDocker = "docker"
+
+	// TriggerAgent syncs were performed by a fleet agent after its controller's desired state changed.
+	TriggerAgent = "agent"
+)
+
+// SyncTrigger records who or what initiated a sync and why.
+type SyncTrigger struct {
+	// Source is the mechanism that started the sync, like TriggerCLI or TriggerAPI.
+	Source string `json:"source"`
+
+	// Actor identifies the person or service responsible, like a local user name or API username.
+	Actor string `json:"actor,omitempty"`
+
+	// Reason is an optional free-form explanation.
+	Reason string `json:"reason,omitempty"`
+}
+
+// LocalTrigger creates a SyncTrigger attributed to the user running this process. If the process was started with
+// sudo, the invoking user is reported instead of root.
+func LocalTrigger(source string) SyncTrigger {
+	actor := os.Getenv("SUDO_USER")
+	if len(actor) == 0 {
+		if current, err := user.Current(); err == nil {
+			actor = current.Username
+		}
+	}
+
+	return SyncTrigger{Source: source, Actor: actor}
+}
+
+func (t SyncTrigger) String() string {
+	description := t.Source
+	if len(t.Actor) > 0 {
+		description = fmt.Sprintf("%s (%s)", description, t.Actor)
+	}
+	if len(t.Reason) > 0 {
+		description = fmt.Sprintf("%s: %s", description, t.Reason)
+	}
+	return description
+}
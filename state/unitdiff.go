@@ -0,0 +1,191 @@
+package state
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around each change in a unit diff.
+const diffContext = 3
+
+// redactedValue replaces the values of secrets in unit diffs.
+const redactedValue = "********"
+
+// secretEnvRx matches the line of a unit file that begins passing an environment variable to a container, either as
+// one quoted argument or, in unit files written by earlier versions, with only the value quoted.
+var secretEnvRx = regexp.MustCompile(`^(\s*(?:"--env=([^=\s]+)=|--env ([^=\s]+)="))`)
+
+// redactUnitContent replaces the values of the environment variables named by secretKeys with redactedValue.
+// Multi-line values in older unit files, which are continued with a trailing "\n\", are collapsed into the redacted
+// line.
+func redactUnitContent(content string, secretKeys map[string]bool) []string {
+	lines := strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	redacted := make([]string, 0, len(lines))
+
+	for i := 0; i < len(lines); i++ {
+		m := secretEnvRx.FindStringSubmatch(lines[i])
+		if m == nil || !secretKeys[m[2]+m[3]] {
+			redacted = append(redacted, lines[i])
+			continue
+		}
+
+		for i < len(lines)-1 && strings.HasSuffix(lines[i], `\n\`) {
+			i++
+		}
+		line := m[1] + redactedValue + `"`
+		if strings.HasSuffix(lines[i], `\`) {
+			line += ` \`
+		}
+		redacted = append(redacted, line)
+	}
+	return redacted
+}
+
+// unitDiff produces a unified diff between the actual and expected contents of a unit file. The values of the
+// environment variables named by sensitiveEnv, and of any secrets recorded in the actual content, are redacted from
+// both.
+func unitDiff(path string, actual, expected []byte, sensitiveEnv []string) string {
+	keys := make(map[string]bool, len(sensitiveEnv))
+	for _, key := range sensitiveEnv {
+		keys[key] = true
+	}
+	for key := range renderedSecretHashes(actual) {
+		keys[key] = true
+	}
+
+	return unifiedDiff(
+		"a"+path, "b"+path,
+		redactUnitContent(string(actual), keys),
+		redactUnitContent(string(expected), keys),
+	)
+}
+
+// diffOp is one line of an edit script: ' ' for a line common to both sides, '-' for a removed line, or '+' for an
+// added line.
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// editScript finds the shortest sequence of line insertions and removals that turns a into b, using a longest
+// common subsequence table. Unit files are small enough that its quadratic cost doesn't matter.
+func editScript(a, b []string) []diffOp {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	ops := make([]diffOp, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			ops = append(ops, diffOp{' ', a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, diffOp{'-', a[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		ops = append(ops, diffOp{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		ops = append(ops, diffOp{'+', b[j]})
+	}
+	return ops
+}
+
+// unifiedDiff formats the differences between a and b in unified diff format, or returns an empty string if they're
+// the same.
+func unifiedDiff(nameA, nameB string, a, b []string) string {
+	ops := editScript(a, b)
+
+	var out strings.Builder
+	for start := 0; start < len(ops); {
+		// Find the next change, then extend the hunk until a run of more than twice the context is unchanged.
+		first := start
+		for first < len(ops) && ops[first].kind == ' ' {
+			first++
+		}
+		if first == len(ops) {
+			break
+		}
+
+		last := first
+		for k := first; k < len(ops); k++ {
+			if ops[k].kind != ' ' {
+				last = k
+			} else if k-last > 2*diffContext {
+				break
+			}
+		}
+
+		from := first - diffContext
+		if from < start {
+			from = start
+		}
+		to := last + diffContext + 1
+		if to > len(ops) {
+			to = len(ops)
+		}
+
+		// Count the lines on each side that precede the hunk to find its starting line numbers.
+		lineA, lineB := 1, 1
+		for _, op := range ops[:from] {
+			if op.kind != '+' {
+				lineA++
+			}
+			if op.kind != '-' {
+				lineB++
+			}
+		}
+		countA, countB := 0, 0
+		for _, op := range ops[from:to] {
+			if op.kind != '+' {
+				countA++
+			}
+			if op.kind != '-' {
+				countB++
+			}
+		}
+
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", nameA, nameB)
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(lineA, countA), hunkRange(lineB, countB))
+		for _, op := range ops[from:to] {
+			fmt.Fprintf(&out, "%c%s\n", op.kind, op.line)
+		}
+
+		start = to
+	}
+	return out.String()
+}
+
+// hunkRange formats the start and length of one side of a hunk. An empty side is numbered from the line before it.
+func hunkRange(start, count int) string {
+	if count == 0 {
+		start--
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
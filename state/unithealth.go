@@ -0,0 +1,66 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// UnitHealth reports the state of a unit shortly after a sync started or restarted it.
+type UnitHealth struct {
+	Unit        string `json:"unit"`
+	ActiveState string `json:"active_state"`
+	Healthy     bool   `json:"healthy"`
+}
+
+// startedUnits lists the units that applying d starts or restarts. Companion units are left for their timers.
+func (d Delta) startedUnits() []DesiredSystemdUnit {
+	units := make([]DesiredSystemdUnit, 0, len(d.UnitsToAdd)+len(d.UnitsToChange)+len(d.UnitsToRestart))
+	for _, group := range [][]DesiredSystemdUnit{d.UnitsToAdd, d.UnitsToChange, d.UnitsToRestart} {
+		for _, unit := range group {
+			if !unit.Companion {
+				units = append(units, unit)
+			}
+		}
+	}
+	return units
+}
+
+// CheckHealth waits for delay, then reads the systemd state of each unit that applying d started or restarted.
+// Units that run a long-lived container are healthy if they're still active. Other units are healthy unless they
+// failed.
+func (session *SessionLease) CheckHealth(ctx context.Context, d Delta, delay time.Duration) []UnitHealth {
+	units := d.startedUnits()
+	if len(units) == 0 {
+		return nil
+	}
+
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+		return nil
+	}
+
+	results := make([]UnitHealth, 0, len(units))
+	for _, unit := range units {
+		health := UnitHealth{Unit: unit.UnitName(), ActiveState: "unknown"}
+
+		prop, err := session.conn.GetUnitProperty(unit.UnitName(), "ActiveState")
+		if err != nil {
+			session.Log.WithError(err).WithField("unitName", unit.UnitName()).Warn("Unable to read unit state.")
+		} else {
+			health.ActiveState = fmt.Sprint(prop.Value.Value())
+			if unit.Type == TypeSimple {
+				health.Healthy = health.ActiveState == "active"
+			} else {
+				health.Healthy = health.ActiveState != "failed"
+			}
+		}
+
+		if !health.Healthy {
+			session.Log.WithField("unitName", health.Unit).WithField("activeState", health.ActiveState).Warn("Unit is unhealthy after sync.")
+		}
+		results = append(results, health)
+	}
+	return results
+}
@@ -0,0 +1,75 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// DefaultUnitPrefix begins the name of every managed unit when no other prefix is configured.
+const DefaultUnitPrefix = "az-"
+
+// DefaultUnitDirectory is the directory that unit files are written to when no other directory is configured.
+const DefaultUnitDirectory = "/etc/systemd/system/"
+
+var (
+	unitLayoutLock sync.Mutex
+	unitPrefix     = DefaultUnitPrefix
+	unitDirectory  = DefaultUnitDirectory
+)
+
+// ConfigureUnitLayout installs the process-wide prefix that the name of every managed unit begins with and the
+// directory that their unit files are written to. Empty values restore DefaultUnitPrefix and DefaultUnitDirectory.
+func ConfigureUnitLayout(prefix, directory string) error {
+	if err := CheckUnitLayout(prefix, directory); err != nil {
+		return err
+	}
+	if len(prefix) == 0 {
+		prefix = DefaultUnitPrefix
+	}
+	if len(directory) == 0 {
+		directory = DefaultUnitDirectory
+	}
+
+	unitLayoutLock.Lock()
+	defer unitLayoutLock.Unlock()
+
+	unitPrefix = prefix
+	unitDirectory = filepath.Clean(directory) + "/"
+	return nil
+}
+
+// CheckUnitLayout returns an error if prefix can't begin the names of units, or directory can't hold their files.
+// Empty values are accepted, since they stand for the defaults.
+func CheckUnitLayout(prefix, directory string) error {
+	if strings.ContainsAny(prefix, "/*?[]\\") {
+		return fmt.Errorf("invalid unit prefix %q", prefix)
+	}
+	if len(directory) > 0 && !filepath.IsAbs(directory) {
+		return errors.New("unit directory must be an absolute path")
+	}
+	return nil
+}
+
+// UnitPrefix returns the prefix that the name of every managed unit begins with, like "az-".
+func UnitPrefix() string {
+	unitLayoutLock.Lock()
+	defer unitLayoutLock.Unlock()
+
+	return unitPrefix
+}
+
+// UnitDirectory returns the directory that every managed unit file is written to, with a trailing slash.
+func UnitDirectory() string {
+	unitLayoutLock.Lock()
+	defer unitLayoutLock.Unlock()
+
+	return unitDirectory
+}
+
+// unitFilePatterns are the patterns that systemd matches against unit names to list the managed units.
+func unitFilePatterns() []string {
+	return []string{UnitPrefix() + "*"}
+}
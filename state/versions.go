@@ -0,0 +1,59 @@
+package state
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+)
+
+// RuntimeVersions reports the versions of the Docker and systemd APIs that the coordinator is talking to.
+type RuntimeVersions struct {
+	DockerClientAPIVersion string `json:"docker_client_api_version"`
+	DockerAPIVersionPinned bool   `json:"docker_api_version_pinned"`
+	DockerServerVersion    string `json:"docker_server_version,omitempty"`
+	DockerServerAPIVersion string `json:"docker_server_api_version,omitempty"`
+	SystemdVersion         string `json:"systemd_version,omitempty"`
+}
+
+// ReadRuntimeVersions queries the Docker daemon and systemd for their versions. Versions that can't be read are left
+// empty and their errors are returned. pinned reports whether the Docker API version was set by docker_api_version
+// rather than negotiated.
+func (session SessionLease) ReadRuntimeVersions(ctx context.Context, pinned bool) (RuntimeVersions, []error) {
+	errs := make([]error, 0)
+	versions := RuntimeVersions{
+		DockerClientAPIVersion: session.cli.ClientVersion(),
+		DockerAPIVersionPinned: pinned,
+	}
+
+	server, err := session.cli.ServerVersion(ctx)
+	if err != nil {
+		errs = append(errs, err)
+	} else {
+		versions.DockerServerVersion = server.Version
+		versions.DockerServerAPIVersion = server.APIVersion
+	}
+
+	systemd, err := readSystemdVersion(ctx)
+	if err != nil {
+		errs = append(errs, err)
+	} else {
+		versions.SystemdVersion = systemd
+	}
+
+	return versions, errs
+}
+
+// readSystemdVersion parses the version from the first line of "systemctl --version", which looks like
+// "systemd 239 (239-1ubuntu1)".
+func readSystemdVersion(ctx context.Context) (string, error) {
+	out, err := exec.CommandContext(ctx, "systemctl", "--version").Output()
+	if err != nil {
+		return "", err
+	}
+
+	fields := strings.Fields(strings.SplitN(string(out), "\n", 2)[0])
+	if len(fields) < 2 {
+		return strings.TrimSpace(string(out)), nil
+	}
+	return fields[1], nil
+}
@@ -0,0 +1,256 @@
+package store
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// archiveVersion is the format of the archives written by Backup. Restore refuses archives of any other version.
+const archiveVersion = 1
+
+// ArchiveTables lists the tables that Backup includes, in the order that Restore loads them: desired units and their
+// hosts, apps, history, and promotions, along with the encrypted secrets and the destinations of file secrets. State
+// that's specific to a host or is rebuilt by the coordinator, like checkpoints, drift events, and jobs, is left out.
+var ArchiveTables = []string{
+	"secrets", "secret_files", "apps", "state_systemd_units", "unit_hosts", "state_systemd_units_history", "promotions",
+}
+
+// serialTables lists the tables whose id column is assigned from a sequence, which must be advanced past the restored
+// rows.
+var serialTables = map[string]bool{
+	"apps": true, "state_systemd_units": true, "state_systemd_units_history": true, "promotions": true,
+}
+
+// binaryColumns lists the columns, by table, that hold bytes rather than text. They're base64-encoded in archives.
+var binaryColumns = map[string]map[string]bool{
+	"secrets": {"ciphertext": true},
+}
+
+// Archive is a copy of the rows of ArchiveTables. Secrets are archived as the ciphertexts that are stored in the
+// database, so an archive can only be restored by a coordinator with access to the same master key.
+type Archive struct {
+	Version   int            `json:"version"`
+	CreatedAt int64          `json:"created_at"`
+	Dialect   string         `json:"dialect"`
+	Tables    []ArchiveTable `json:"tables"`
+}
+
+// ArchiveTable holds the rows of one table. Each value is a string, or nil for NULL; the values of binary columns are
+// base64-encoded []byte.
+type ArchiveTable struct {
+	Name    string          `json:"name"`
+	Columns []string        `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+// Counts reports the number of rows archived from each table.
+func (a Archive) Counts() map[string]int {
+	counts := make(map[string]int, len(a.Tables))
+	for _, table := range a.Tables {
+		counts[table.Name] = len(table.Rows)
+	}
+	return counts
+}
+
+// Write writes the archive to w as gzipped JSON.
+func (a Archive) Write(w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	if err := json.NewEncoder(gz).Encode(&a); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// ReadArchive reads an archive written by Write.
+func ReadArchive(r io.Reader) (*Archive, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	var archive Archive
+	if err := json.NewDecoder(gz).Decode(&archive); err != nil {
+		return nil, err
+	}
+	if archive.Version != archiveVersion {
+		return nil, fmt.Errorf("unsupported archive version %d", archive.Version)
+	}
+	return &archive, nil
+}
+
+// Backup copies the rows of every table in ArchiveTables within a single transaction, so that the archive is
+// consistent.
+func (db *DB) Backup(ctx context.Context) (*Archive, error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	archive := &Archive{
+		Version:   archiveVersion,
+		CreatedAt: time.Now().Unix(),
+		Dialect:   db.Dialect.Name(),
+		Tables:    make([]ArchiveTable, 0, len(ArchiveTables)),
+	}
+	for _, name := range ArchiveTables {
+		table, err := backupTable(ctx, tx, name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		archive.Tables = append(archive.Tables, *table)
+	}
+	return archive, nil
+}
+
+func backupTable(ctx context.Context, tx *sql.Tx, name string) (*ArchiveTable, error) {
+	columns := tableColumns[name]
+	query := "SELECT " + strings.Join(columns, ", ") + " FROM " + name
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	table := &ArchiveTable{Name: name, Columns: columns, Rows: make([][]interface{}, 0)}
+	for rows.Next() {
+		raw := make([]sql.RawBytes, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range raw {
+			dest[i] = &raw[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+
+		row := make([]interface{}, len(columns))
+		for i, column := range columns {
+			switch {
+			case raw[i] == nil:
+				row[i] = nil
+			case binaryColumns[name][column]:
+				row[i] = append([]byte(nil), raw[i]...)
+			default:
+				row[i] = string(raw[i])
+			}
+		}
+		table.Rows = append(table.Rows, row)
+	}
+	return table, rows.Err()
+}
+
+// Restore loads the rows of an archive within a single transaction. Unless replace is set, it refuses to load any rows
+// into a database whose archived tables aren't all empty; with replace, those tables are truncated first. The tables
+// must already exist.
+func (db *DB) Restore(ctx context.Context, archive *Archive, replace bool) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range archive.Tables {
+		if err := checkArchiveColumns(table); err != nil {
+			return err
+		}
+
+		if replace {
+			if err := db.Dialect.Truncate(tx, table.Name); err != nil {
+				return fmt.Errorf("%s: %v", table.Name, err)
+			}
+		} else {
+			var count int
+			if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+table.Name).Scan(&count); err != nil {
+				return fmt.Errorf("%s: %v", table.Name, err)
+			}
+			if count > 0 {
+				return fmt.Errorf("table %s already holds %d rows", table.Name, count)
+			}
+		}
+	}
+
+	for _, table := range archive.Tables {
+		rows, err := restoredRows(table)
+		if err != nil {
+			return fmt.Errorf("%s: %v", table.Name, err)
+		}
+		if len(rows) > 0 {
+			if err := db.Dialect.BulkInsert(tx, table.Name, table.Columns, rows); err != nil {
+				return fmt.Errorf("%s: %v", table.Name, err)
+			}
+		}
+		if serialTables[table.Name] {
+			if err := db.Dialect.ResetSequence(tx, table.Name); err != nil {
+				return fmt.Errorf("%s: %v", table.Name, err)
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// checkArchiveColumns returns an error if an archived table isn't one that Backup includes, or has a column that this
+// version of the coordinator doesn't know. Archives made before a column was added are restored with its default.
+func checkArchiveColumns(table ArchiveTable) error {
+	known := make(map[string]bool)
+	for _, column := range tableColumns[table.Name] {
+		known[column] = true
+	}
+	if !contains(ArchiveTables, table.Name) {
+		return fmt.Errorf("unexpected table %s in archive", table.Name)
+	}
+	for _, column := range table.Columns {
+		if !known[column] {
+			return fmt.Errorf("unknown column %s.%s in archive", table.Name, column)
+		}
+	}
+	return nil
+}
+
+// restoredRows converts the values of an archived table to the ones that are inserted.
+func restoredRows(table ArchiveTable) ([][]interface{}, error) {
+	rows := make([][]interface{}, 0, len(table.Rows))
+	for _, archived := range table.Rows {
+		if len(archived) != len(table.Columns) {
+			return nil, fmt.Errorf("row has %d values for %d columns", len(archived), len(table.Columns))
+		}
+
+		row := make([]interface{}, len(archived))
+		for i, value := range archived {
+			if value == nil {
+				continue
+			}
+			text, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("column %s holds a %T", table.Columns[i], value)
+			}
+			if binaryColumns[table.Name][table.Columns[i]] {
+				decoded, err := base64.StdEncoding.DecodeString(text)
+				if err != nil {
+					return nil, fmt.Errorf("column %s: %v", table.Columns[i], err)
+				}
+				row[i] = decoded
+			} else {
+				row[i] = text
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func contains(values []string, want string) bool {
+	for _, value := range values {
+		if value == want {
+			return true
+		}
+	}
+	return false
+}
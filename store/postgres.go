@@ -0,0 +1,217 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+type postgresDialect struct{}
+
+func openPostgres(url string) (*DB, error) {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+	return &DB{DB: db, Dialect: postgresDialect{}}, nil
+}
+
+func (postgresDialect) Name() string {
+	return "postgres"
+}
+
+func (postgresDialect) Schema() []string {
+	return []string{
+		`
+		CREATE TABLE IF NOT EXISTS secrets (
+			key TEXT NOT NULL,
+			ciphertext bytea NOT NULL
+		)
+		`,
+		`
+		CREATE TABLE IF NOT EXISTS secret_files (
+			key TEXT PRIMARY KEY,
+			path TEXT NOT NULL,
+			mode INTEGER NOT NULL
+		)
+		`,
+		`
+		CREATE TABLE IF NOT EXISTS state_systemd_units (
+			id SERIAL PRIMARY KEY,
+			path TEXT NOT NULL,
+			type INTEGER NOT NULL,
+			container_name TEXT NOT NULL,
+			container_image_name TEXT NOT NULL,
+			container_image_tag TEXT NOT NULL,
+			pinned_image_id TEXT NOT NULL DEFAULT '',
+			secrets JSONB NOT NULL,
+			env JSONB NOT NULL,
+			ports JSONB NOT NULL,
+			volumes JSONB NOT NULL,
+			schedule TEXT,
+			selector JSONB NOT NULL DEFAULT '{}',
+			app_id INTEGER,
+			runtime JSONB NOT NULL DEFAULT '{}',
+			enabled BOOLEAN NOT NULL DEFAULT TRUE,
+			protected BOOLEAN NOT NULL DEFAULT FALSE,
+			version INTEGER NOT NULL DEFAULT 1,
+			updated_at BIGINT NOT NULL DEFAULT 0
+		)
+		`,
+		`
+		CREATE TABLE IF NOT EXISTS unit_hosts (
+			unit_id INTEGER NOT NULL,
+			host TEXT NOT NULL,
+			PRIMARY KEY (unit_id, host)
+		)
+		`,
+		`
+		CREATE TABLE IF NOT EXISTS agent_reports (
+			host TEXT PRIMARY KEY,
+			reported_at BIGINT NOT NULL,
+			report JSONB NOT NULL
+		)
+		`,
+		`
+		CREATE TABLE IF NOT EXISTS apps (
+			id SERIAL PRIMARY KEY,
+			name TEXT NOT NULL UNIQUE,
+			frozen BOOLEAN NOT NULL DEFAULT FALSE,
+			released JSONB NOT NULL DEFAULT '{}',
+			previous JSONB NOT NULL DEFAULT '{}'
+		)
+		`,
+		`
+		CREATE TABLE IF NOT EXISTS promotions (
+			id SERIAL PRIMARY KEY,
+			unit_id INTEGER NOT NULL,
+			from_tag TEXT NOT NULL,
+			to_tag TEXT NOT NULL,
+			image_id TEXT NOT NULL,
+			digest TEXT NOT NULL,
+			actor TEXT NOT NULL,
+			promoted_at BIGINT NOT NULL
+		)
+		`,
+		`
+		CREATE TABLE IF NOT EXISTS state_systemd_units_history (
+			id SERIAL PRIMARY KEY,
+			unit_id INTEGER NOT NULL,
+			version INTEGER NOT NULL,
+			action TEXT NOT NULL,
+			actor TEXT NOT NULL,
+			changed_at BIGINT NOT NULL,
+			unit TEXT NOT NULL
+		)
+		`,
+		`
+		CREATE TABLE IF NOT EXISTS sync_checkpoints (
+			host TEXT PRIMARY KEY,
+			phase TEXT NOT NULL,
+			trigger JSONB NOT NULL,
+			app_id INTEGER,
+			unit_id INTEGER,
+			started_at BIGINT NOT NULL,
+			updated_at BIGINT NOT NULL,
+			finished_at BIGINT NOT NULL DEFAULT 0,
+			outcome TEXT NOT NULL DEFAULT ''
+		)
+		`,
+		`
+		CREATE TABLE IF NOT EXISTS drift_events (
+			id SERIAL PRIMARY KEY,
+			host TEXT NOT NULL,
+			unit TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			detail TEXT NOT NULL,
+			detected_at BIGINT NOT NULL
+		)
+		`,
+		`
+		CREATE TABLE IF NOT EXISTS jobs (
+			id SERIAL PRIMARY KEY,
+			kind TEXT NOT NULL,
+			status TEXT NOT NULL,
+			host TEXT NOT NULL,
+			actor TEXT NOT NULL,
+			trigger JSONB NOT NULL DEFAULT '{}',
+			created_at BIGINT NOT NULL,
+			finished_at BIGINT NOT NULL DEFAULT 0,
+			result TEXT,
+			error TEXT NOT NULL DEFAULT ''
+		)
+		`,
+		`
+		CREATE TABLE IF NOT EXISTS unit_file_hashes (
+			host TEXT NOT NULL,
+			path TEXT NOT NULL,
+			hash TEXT NOT NULL,
+			written_at BIGINT NOT NULL,
+			PRIMARY KEY (host, path)
+		)
+		`,
+	}
+}
+
+func (postgresDialect) AddedColumns() map[string]map[string]string {
+	return map[string]map[string]string{
+		"state_systemd_units": {
+			"selector":        "JSONB NOT NULL DEFAULT '{}'",
+			"app_id":          "INTEGER",
+			"pinned_image_id": "TEXT NOT NULL DEFAULT ''",
+			"runtime":         "JSONB NOT NULL DEFAULT '{}'",
+			"enabled":         "BOOLEAN NOT NULL DEFAULT TRUE",
+			"protected":       "BOOLEAN NOT NULL DEFAULT FALSE",
+			"version":         "INTEGER NOT NULL DEFAULT 1",
+			"updated_at":      "BIGINT NOT NULL DEFAULT 0",
+		},
+		"jobs": {
+			"trigger": "JSONB NOT NULL DEFAULT '{}'",
+		},
+	}
+}
+
+func (postgresDialect) Truncate(tx *sql.Tx, table string) error {
+	_, err := tx.Exec(fmt.Sprintf("TRUNCATE TABLE %s", pq.QuoteIdentifier(table)))
+	return err
+}
+
+// BulkInsert streams rows to the server with COPY.
+func (postgresDialect) BulkInsert(tx *sql.Tx, table string, columns []string, rows [][]interface{}) error {
+	insert, err := tx.Prepare(pq.CopyIn(table, columns...))
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+
+	for _, row := range rows {
+		if _, err = insert.Exec(row...); err != nil {
+			return err
+		}
+	}
+	_, err = insert.Exec()
+	return err
+}
+
+// ResetSequence sets the sequence behind the table's SERIAL id column to its largest id.
+func (postgresDialect) ResetSequence(tx *sql.Tx, table string) error {
+	_, err := tx.Exec(fmt.Sprintf(
+		"SELECT setval(pg_get_serial_sequence('%s', 'id'), COALESCE(MAX(id), 0) + 1, false) FROM %s",
+		table, pq.QuoteIdentifier(table),
+	))
+	return err
+}
+
+// TryLock uses a session-level advisory lock, so the lock is shared among every process using the same database.
+func (postgresDialect) TryLock(ctx context.Context, conn *sql.Conn, key int64) (bool, error) {
+	var acquired bool
+	err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&acquired)
+	return acquired, err
+}
+
+func (postgresDialect) Unlock(ctx context.Context, conn *sql.Conn, key int64) error {
+	_, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", key)
+	return err
+}
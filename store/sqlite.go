@@ -0,0 +1,261 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+
+	// Register the "sqlite3" database/sql driver.
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteDialect stores coordinator state in a local database file for single-host installs.
+type sqliteDialect struct {
+	path string
+
+	// A SQLite database file belongs to a single host, so locks are flock(2)-ed files alongside it.
+	lock sync.Mutex
+	held map[int64]*os.File
+}
+
+func openSQLite(path string) (*DB, error) {
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_busy_timeout=5000&_foreign_keys=on", path))
+	if err != nil {
+		return nil, err
+	}
+	return &DB{DB: db, Dialect: &sqliteDialect{path: path, held: make(map[int64]*os.File)}}, nil
+}
+
+func (*sqliteDialect) Name() string {
+	return "sqlite"
+}
+
+// Schema stores JSON documents as TEXT, since SQLite has no JSONB type.
+func (*sqliteDialect) Schema() []string {
+	return []string{
+		`
+		CREATE TABLE IF NOT EXISTS secrets (
+			key TEXT NOT NULL,
+			ciphertext BLOB NOT NULL
+		)
+		`,
+		`
+		CREATE TABLE IF NOT EXISTS secret_files (
+			key TEXT PRIMARY KEY,
+			path TEXT NOT NULL,
+			mode INTEGER NOT NULL
+		)
+		`,
+		`
+		CREATE TABLE IF NOT EXISTS state_systemd_units (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			path TEXT NOT NULL,
+			type INTEGER NOT NULL,
+			container_name TEXT NOT NULL,
+			container_image_name TEXT NOT NULL,
+			container_image_tag TEXT NOT NULL,
+			pinned_image_id TEXT NOT NULL DEFAULT '',
+			secrets TEXT NOT NULL,
+			env TEXT NOT NULL,
+			ports TEXT NOT NULL,
+			volumes TEXT NOT NULL,
+			schedule TEXT,
+			selector TEXT NOT NULL DEFAULT '{}',
+			app_id INTEGER,
+			runtime TEXT NOT NULL DEFAULT '{}',
+			enabled BOOLEAN NOT NULL DEFAULT 1,
+			protected BOOLEAN NOT NULL DEFAULT 0,
+			version INTEGER NOT NULL DEFAULT 1,
+			updated_at INTEGER NOT NULL DEFAULT 0
+		)
+		`,
+		`
+		CREATE TABLE IF NOT EXISTS unit_hosts (
+			unit_id INTEGER NOT NULL,
+			host TEXT NOT NULL,
+			PRIMARY KEY (unit_id, host)
+		)
+		`,
+		`
+		CREATE TABLE IF NOT EXISTS agent_reports (
+			host TEXT PRIMARY KEY,
+			reported_at INTEGER NOT NULL,
+			report TEXT NOT NULL
+		)
+		`,
+		`
+		CREATE TABLE IF NOT EXISTS apps (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL UNIQUE,
+			frozen BOOLEAN NOT NULL DEFAULT 0,
+			released TEXT NOT NULL DEFAULT '{}',
+			previous TEXT NOT NULL DEFAULT '{}'
+		)
+		`,
+		`
+		CREATE TABLE IF NOT EXISTS promotions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			unit_id INTEGER NOT NULL,
+			from_tag TEXT NOT NULL,
+			to_tag TEXT NOT NULL,
+			image_id TEXT NOT NULL,
+			digest TEXT NOT NULL,
+			actor TEXT NOT NULL,
+			promoted_at INTEGER NOT NULL
+		)
+		`,
+		`
+		CREATE TABLE IF NOT EXISTS state_systemd_units_history (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			unit_id INTEGER NOT NULL,
+			version INTEGER NOT NULL,
+			action TEXT NOT NULL,
+			actor TEXT NOT NULL,
+			changed_at INTEGER NOT NULL,
+			unit TEXT NOT NULL
+		)
+		`,
+		`
+		CREATE TABLE IF NOT EXISTS sync_checkpoints (
+			host TEXT PRIMARY KEY,
+			phase TEXT NOT NULL,
+			trigger TEXT NOT NULL,
+			app_id INTEGER,
+			unit_id INTEGER,
+			started_at INTEGER NOT NULL,
+			updated_at INTEGER NOT NULL,
+			finished_at INTEGER NOT NULL DEFAULT 0,
+			outcome TEXT NOT NULL DEFAULT ''
+		)
+		`,
+		`
+		CREATE TABLE IF NOT EXISTS drift_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			host TEXT NOT NULL,
+			unit TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			detail TEXT NOT NULL,
+			detected_at INTEGER NOT NULL
+		)
+		`,
+		`
+		CREATE TABLE IF NOT EXISTS jobs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			kind TEXT NOT NULL,
+			status TEXT NOT NULL,
+			host TEXT NOT NULL,
+			actor TEXT NOT NULL,
+			trigger TEXT NOT NULL DEFAULT '{}',
+			created_at INTEGER NOT NULL,
+			finished_at INTEGER NOT NULL DEFAULT 0,
+			result TEXT,
+			error TEXT NOT NULL DEFAULT ''
+		)
+		`,
+		`
+		CREATE TABLE IF NOT EXISTS unit_file_hashes (
+			host TEXT NOT NULL,
+			path TEXT NOT NULL,
+			hash TEXT NOT NULL,
+			written_at INTEGER NOT NULL,
+			PRIMARY KEY (host, path)
+		)
+		`,
+	}
+}
+
+func (*sqliteDialect) AddedColumns() map[string]map[string]string {
+	return map[string]map[string]string{
+		"state_systemd_units": {
+			"selector":        "TEXT NOT NULL DEFAULT '{}'",
+			"app_id":          "INTEGER",
+			"pinned_image_id": "TEXT NOT NULL DEFAULT ''",
+			"runtime":         "TEXT NOT NULL DEFAULT '{}'",
+			"enabled":         "BOOLEAN NOT NULL DEFAULT 1",
+			"protected":       "BOOLEAN NOT NULL DEFAULT 0",
+			"version":         "INTEGER NOT NULL DEFAULT 1",
+			"updated_at":      "INTEGER NOT NULL DEFAULT 0",
+		},
+		"jobs": {
+			"trigger": "TEXT NOT NULL DEFAULT '{}'",
+		},
+	}
+}
+
+// Truncate deletes all rows, because SQLite has no TRUNCATE statement.
+func (*sqliteDialect) Truncate(tx *sql.Tx, table string) error {
+	_, err := tx.Exec(fmt.Sprintf(`DELETE FROM "%s"`, table))
+	return err
+}
+
+// BulkInsert executes a prepared INSERT once per row.
+func (*sqliteDialect) BulkInsert(tx *sql.Tx, table string, columns []string, rows [][]interface{}) error {
+	placeholders := make([]string, len(columns))
+	for i := range columns {
+		placeholders[i] = "?"
+	}
+
+	insert, err := tx.Prepare(fmt.Sprintf(
+		`INSERT INTO "%s" (%s) VALUES (%s)`,
+		table, strings.Join(columns, ", "), strings.Join(placeholders, ", "),
+	))
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+
+	for _, row := range rows {
+		if _, err = insert.Exec(row...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ResetSequence does nothing, because SQLite advances AUTOINCREMENT ids past any id that's inserted explicitly.
+func (*sqliteDialect) ResetSequence(tx *sql.Tx, table string) error {
+	return nil
+}
+
+func (d *sqliteDialect) TryLock(ctx context.Context, conn *sql.Conn, key int64) (bool, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if _, ok := d.held[key]; ok {
+		return false, nil
+	}
+
+	f, err := os.OpenFile(fmt.Sprintf("%s.%x.lock", d.path, key), os.O_CREATE|os.O_RDWR, 0660)
+	if err != nil {
+		return false, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return false, nil
+		}
+		return false, err
+	}
+
+	d.held[key] = f
+	return true, nil
+}
+
+func (d *sqliteDialect) Unlock(ctx context.Context, conn *sql.Conn, key int64) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	f, ok := d.held[key]
+	if !ok {
+		return nil
+	}
+	delete(d.held, key)
+
+	// Closing the file releases the flock.
+	return f.Close()
+}
@@ -0,0 +1,145 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+)
+
+// sqlitePrefix is the scheme that selects the SQLite backend in a database URL.
+const sqlitePrefix = "sqlite://"
+
+// Dialect captures the behavior that differs among the SQL databases the coordinator can store its state in.
+type Dialect interface {
+	// Name identifies the dialect in log messages.
+	Name() string
+
+	// Schema returns the statements that create the coordinator's tables if they don't already exist.
+	Schema() []string
+
+	// AddedColumns returns the definitions of columns that were added to tables after they were first created, by
+	// table and then column name, so that existing tables can be upgraded to match Schema.
+	AddedColumns() map[string]map[string]string
+
+	// Truncate removes every row from a table within a transaction.
+	Truncate(tx *sql.Tx, table string) error
+
+	// BulkInsert inserts many rows into a table within a transaction. Each row provides one value per column.
+	BulkInsert(tx *sql.Tx, table string, columns []string, rows [][]interface{}) error
+
+	// ResetSequence advances the source of a table's generated ids past the largest id that it holds, after rows
+	// were inserted with explicit ids.
+	ResetSequence(tx *sql.Tx, table string) error
+
+	// TryLock attempts to acquire a lock, identified by key, that is held until Unlock is called on the same conn or
+	// conn is closed. It returns false without blocking if another process already holds the lock.
+	TryLock(ctx context.Context, conn *sql.Conn, key int64) (bool, error)
+
+	// Unlock releases a lock acquired with TryLock.
+	Unlock(ctx context.Context, conn *sql.Conn, key int64) error
+}
+
+// Tables lists the tables created by each Dialect's Schema.
+var Tables = []string{"secrets", "secret_files", "state_systemd_units", "unit_hosts", "agent_reports", "apps", "promotions", "sync_checkpoints", "drift_events", "unit_file_hashes", "state_systemd_units_history", "jobs"}
+
+// tableColumns lists the columns that each table in Tables is expected to have.
+var tableColumns = map[string][]string{
+	"secrets":      {"key", "ciphertext"},
+	"secret_files": {"key", "path", "mode"},
+	"state_systemd_units": {
+		"id", "path", "type",
+		"container_name", "container_image_name", "container_image_tag", "pinned_image_id",
+		"secrets", "env", "ports", "volumes",
+		"schedule", "selector", "app_id", "runtime", "enabled", "protected",
+		"version", "updated_at",
+	},
+	"unit_hosts":    {"unit_id", "host"},
+	"agent_reports": {"host", "reported_at", "report"},
+	"apps":          {"id", "name", "frozen", "released", "previous"},
+	"promotions":    {"id", "unit_id", "from_tag", "to_tag", "image_id", "digest", "actor", "promoted_at"},
+	"sync_checkpoints": {
+		"host", "phase", "trigger", "app_id", "unit_id", "started_at", "updated_at", "finished_at", "outcome",
+	},
+	"drift_events":     {"id", "host", "unit", "kind", "detail", "detected_at"},
+	"unit_file_hashes": {"host", "path", "hash", "written_at"},
+	"state_systemd_units_history": {
+		"id", "unit_id", "version", "action", "actor", "changed_at", "unit",
+	},
+	"jobs": {"id", "kind", "status", "host", "actor", "trigger", "created_at", "finished_at", "result", "error"},
+}
+
+// DB is a pool of database connections paired with the Dialect used to speak to them.
+type DB struct {
+	*sql.DB
+
+	Dialect Dialect
+}
+
+// Open prepares a connection pool for the database at url. URLs that begin with "sqlite://" open or create a SQLite
+// database file at the remainder of the URL; any other URL is treated as a PostgreSQL connection string.
+func Open(url string) (*DB, error) {
+	if strings.HasPrefix(url, sqlitePrefix) {
+		return openSQLite(strings.TrimPrefix(url, sqlitePrefix))
+	}
+	return openPostgres(url)
+}
+
+// DropTables removes every table listed in Tables, along with all of the coordinator's state.
+func (db *DB) DropTables() error {
+	for _, table := range Tables {
+		if _, err := db.Exec("DROP TABLE IF EXISTS " + table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MissingColumns reports the expected columns that table lacks. It returns an error if the table can't be queried,
+// which usually means that it doesn't exist.
+func (db *DB) MissingColumns(table string) ([]string, error) {
+	rows, err := db.Query("SELECT * FROM " + table + " LIMIT 0")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	actual, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	present := make(map[string]bool, len(actual))
+	for _, column := range actual {
+		present[column] = true
+	}
+
+	missing := make([]string, 0)
+	for _, column := range tableColumns[table] {
+		if !present[column] {
+			missing = append(missing, column)
+		}
+	}
+	return missing, nil
+}
+
+// AddMissingColumns adds any of the dialect's AddedColumns that table lacks. Columns that are missing but have no
+// known definition are returned, and must be added by hand.
+func (db *DB) AddMissingColumns(table string) ([]string, error) {
+	missing, err := db.MissingColumns(table)
+	if err != nil {
+		return nil, err
+	}
+
+	definitions := db.Dialect.AddedColumns()[table]
+	remaining := make([]string, 0)
+	for _, column := range missing {
+		definition, ok := definitions[column]
+		if !ok {
+			remaining = append(remaining, column)
+			continue
+		}
+		if _, err := db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition); err != nil {
+			return nil, err
+		}
+	}
+	return remaining, nil
+}
@@ -0,0 +1,226 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// OTLP span kind and status codes. See opentelemetry-proto's trace.proto.
+const (
+	spanKindInternal = 1
+	statusCodeOK     = 1
+	statusCodeError  = 2
+)
+
+type otlpValue map[string]interface{}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+// exportQueueSize bounds the number of finished traces waiting to be sent. Traces that finish while the queue is full
+// are dropped, so that a slow or unreachable collector never holds up the operations being traced.
+const exportQueueSize = 64
+
+// exportTimeout limits each request to the collector.
+const exportTimeout = 5 * time.Second
+
+// exportBatch is one trace queued for export, or a marker that's reached once every trace queued before it is sent.
+type exportBatch struct {
+	spans   []otlpSpan
+	flushed chan struct{}
+}
+
+// exporter sends spans to an OTLP/HTTP collector using the JSON encoding. Traces are sent one at a time by a
+// background goroutine.
+type exporter struct {
+	url    string
+	client *http.Client
+	queue  chan exportBatch
+}
+
+func newExporter(endpoint string) *exporter {
+	e := &exporter{
+		url:    strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		client: &http.Client{Timeout: exportTimeout},
+		queue:  make(chan exportBatch, exportQueueSize),
+	}
+	go e.run()
+	return e
+}
+
+func toOTLPValue(value interface{}) otlpValue {
+	switch v := value.(type) {
+	case string:
+		return otlpValue{"stringValue": v}
+	case bool:
+		return otlpValue{"boolValue": v}
+	case int:
+		return otlpValue{"intValue": strconv.FormatInt(int64(v), 10)}
+	case int64:
+		return otlpValue{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return otlpValue{"doubleValue": v}
+	default:
+		return otlpValue{"stringValue": fmt.Sprintf("%v", v)}
+	}
+}
+
+func toOTLPSpan(s *Span) otlpSpan {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	attributes := make([]otlpAttribute, 0, len(s.attributes))
+	for key, value := range s.attributes {
+		attributes = append(attributes, otlpAttribute{Key: key, Value: toOTLPValue(value)})
+	}
+
+	status := otlpStatus{Code: statusCodeOK}
+	if s.err != nil {
+		status = otlpStatus{Code: statusCodeError, Message: s.err.Error()}
+	}
+
+	span := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              spanKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Attributes:        attributes,
+		Status:            status,
+	}
+	if !s.isRoot() {
+		span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	return span
+}
+
+// export queues a finished trace to be sent to the collector. It never blocks.
+func (e *exporter) export(spans []*Span) {
+	converted := make([]otlpSpan, len(spans))
+	for i, span := range spans {
+		converted[i] = toOTLPSpan(span)
+	}
+
+	select {
+	case e.queue <- exportBatch{spans: converted}:
+	default:
+		log.WithField("spanCount", len(spans)).Warn("Trace export queue is full. Dropping trace.")
+	}
+}
+
+// flush waits up to timeout for every trace queued so far to be sent. It returns false if they weren't.
+func (e *exporter) flush(timeout time.Duration) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	flushed := make(chan struct{})
+	select {
+	case e.queue <- exportBatch{flushed: flushed}:
+	case <-deadline.C:
+		return false
+	}
+
+	select {
+	case <-flushed:
+		return true
+	case <-deadline.C:
+		return false
+	}
+}
+
+func (e *exporter) run() {
+	for batch := range e.queue {
+		if batch.flushed != nil {
+			close(batch.flushed)
+			continue
+		}
+		e.send(batch.spans)
+	}
+}
+
+func (e *exporter) send(spans []otlpSpan) {
+	payload := otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpAttribute{{Key: "service.name", Value: toOTLPValue(ServiceName)}},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: ServiceName},
+				Spans: spans,
+			}},
+		}},
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.WithError(err).Warn("Unable to serialize trace.")
+		return
+	}
+
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.WithError(err).WithField("url", e.url).Warn("Unable to export trace.")
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		log.WithFields(log.Fields{
+			"url":    e.url,
+			"status": resp.StatusCode,
+		}).Warn("Trace collector rejected spans.")
+		return
+	}
+
+	log.WithField("spanCount", len(spans)).Debug("Trace exported.")
+}
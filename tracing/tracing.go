@@ -0,0 +1,176 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ServiceName identifies the coordinator in exported spans.
+const ServiceName = "az-coordinator"
+
+// FlushTimeout is long enough for Flush to send a couple of queued traces before the process exits.
+const FlushTimeout = 10 * time.Second
+
+// defaultTracer is the process-wide Tracer used by Start. Spans are discarded while it's nil.
+var (
+	defaultLock   sync.Mutex
+	defaultTracer *Tracer
+)
+
+// Tracer collects finished spans and exports each completed trace to an OpenTelemetry collector over OTLP/HTTP.
+type Tracer struct {
+	exporter *exporter
+
+	lock    sync.Mutex
+	pending map[[16]byte][]*Span
+}
+
+// Configure installs a process-wide Tracer that exports to the OTLP/HTTP collector at endpoint, like
+// "http://localhost:4318". An empty endpoint disables tracing.
+func Configure(endpoint string) {
+	defaultLock.Lock()
+	defer defaultLock.Unlock()
+
+	if len(endpoint) == 0 {
+		defaultTracer = nil
+		return
+	}
+
+	defaultTracer = &Tracer{
+		exporter: newExporter(endpoint),
+		pending:  make(map[[16]byte][]*Span),
+	}
+}
+
+// Flush waits up to timeout for the traces that have finished so far to be sent to the collector. Call it before the
+// process exits.
+func Flush(timeout time.Duration) {
+	tracer := currentTracer()
+	if tracer == nil {
+		return
+	}
+
+	if !tracer.exporter.flush(timeout) {
+		log.WithField("timeout", timeout).Warn("Timed out sending traces to the collector.")
+	}
+}
+
+func currentTracer() *Tracer {
+	defaultLock.Lock()
+	defer defaultLock.Unlock()
+
+	return defaultTracer
+}
+
+type spanKey struct{}
+
+// Span records the timing and outcome of a single operation. All methods are safe to call on a nil Span.
+type Span struct {
+	tracer   *Tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+
+	lock       sync.Mutex
+	start      time.Time
+	end        time.Time
+	attributes map[string]interface{}
+	err        error
+}
+
+// Start begins a span named name as a child of any span already carried by ctx. It returns a derived Context that
+// carries the new span. Call End on the span when the operation is complete.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	tracer := currentTracer()
+	if tracer == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		tracer:     tracer,
+		name:       name,
+		start:      time.Now(),
+		attributes: make(map[string]interface{}),
+	}
+	rand.Read(span.spanID[:])
+
+	if parent, ok := ctx.Value(spanKey{}).(*Span); ok && parent != nil {
+		span.traceID = parent.traceID
+		span.parentID = parent.spanID
+	} else {
+		rand.Read(span.traceID[:])
+	}
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// SetAttribute annotates the span with a key and a string, integer, boolean, or floating-point value.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.attributes[key] = value
+}
+
+// RecordError marks the span as failed. Only the first non-nil error is kept.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// RecordErrors marks the span as failed if errs is non-empty.
+func (s *Span) RecordErrors(errs []error) {
+	for _, err := range errs {
+		s.RecordError(err)
+	}
+}
+
+// End finishes the span. When a root span ends, its entire trace is queued for export.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	s.end = time.Now()
+	s.lock.Unlock()
+
+	s.tracer.finish(s)
+}
+
+func (s *Span) isRoot() bool {
+	return s.parentID == [8]byte{}
+}
+
+func (t *Tracer) finish(span *Span) {
+	t.lock.Lock()
+	t.pending[span.traceID] = append(t.pending[span.traceID], span)
+
+	if !span.isRoot() {
+		t.lock.Unlock()
+		return
+	}
+
+	spans := t.pending[span.traceID]
+	delete(t.pending, span.traceID)
+	t.lock.Unlock()
+
+	t.exporter.export(spans)
+}
@@ -0,0 +1,44 @@
+// Package unitfile escapes values to be written into systemd unit files.
+package unitfile
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Escape escapes value to appear within double quotes in a unit file, so that systemd reads it back unchanged.
+// Backslashes, double quotes, and control characters are written as C-style escapes, and "%" specifiers are doubled.
+// If expandsVariables is set, as it is for ExecStart= lines, "$" is doubled too, so that it isn't read as a reference
+// to an environment variable. Newlines are only ever written as "\n": systemd would join a line that ends in a
+// backslash to the next with a space, changing the value.
+func Escape(value string, expandsVariables bool) string {
+	var b strings.Builder
+	for _, r := range value {
+		switch {
+		case r == '\\':
+			b.WriteString(`\\`)
+		case r == '"':
+			b.WriteString(`\"`)
+		case r == '%':
+			b.WriteString("%%")
+		case r == '$' && expandsVariables:
+			b.WriteString("$$")
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// Quote escapes value with Escape and encloses it in double quotes.
+func Quote(value string, expandsVariables bool) string {
+	return `"` + Escape(value, expandsVariables) + `"`
+}
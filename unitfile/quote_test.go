@@ -0,0 +1,38 @@
+package unitfile
+
+import "testing"
+
+func TestQuote(t *testing.T) {
+	tests := []struct {
+		name             string
+		value            string
+		expandsVariables bool
+		want             string
+	}{
+		{"plain", "plain", false, `"plain"`},
+		{"empty", "", false, `""`},
+		{"spaces", "two words  here", false, `"two words  here"`},
+		{"double quotes", `say "hi"`, false, `"say \"hi\""`},
+		{"single quotes", `it's`, false, `"it's"`},
+		{"specifiers", "100%", false, `"100%%"`},
+		{"specifier names", "%h/%n", true, `"%%h/%%n"`},
+		{"dollar in environment", "$HOME", false, `"$HOME"`},
+		{"dollar in command line", "$HOME", true, `"$$HOME"`},
+		{"braced variable", "${HOME}", true, `"$${HOME}"`},
+		{"backslashes", `C:\path\`, false, `"C:\\path\\"`},
+		{"escaped quote", `\"`, false, `"\\\""`},
+		{"tab and carriage return", "a\tb\r", false, `"a\tb\r"`},
+		{"control characters", "bell\x07del\x7f", false, `"bell\x07del\x7f"`},
+		{"newline", "one\ntwo", false, `"one\ntwo"`},
+		{"trailing newline", "one\n", false, `"one\n"`},
+		{"unicode", "héllo ☃", false, `"héllo ☃"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Quote(test.value, test.expandsVariables); got != test.want {
+				t.Errorf("Quote(%q, %v) = %q, want %q", test.value, test.expandsVariables, got, test.want)
+			}
+		})
+	}
+}
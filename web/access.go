@@ -0,0 +1,196 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/secrets"
+)
+
+// requestIDHeader carries the ID assigned to each request, so that client reports can be matched with server logs.
+const requestIDHeader = "X-Request-ID"
+
+// clientRequestIDRx matches request IDs supplied by clients that are safe to reuse in logs and responses.
+var clientRequestIDRx = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type requestIDKey struct{}
+
+type requestIdentityKey struct{}
+
+// identity describes an authenticated API caller.
+type identity struct {
+	// method is the means of authentication: "token", "cert", or "oidc".
+	method string
+
+	// name is the basic auth username, certificate common name, or OIDC username claim.
+	name string
+}
+
+func (id identity) String() string {
+	if len(id.method) == 0 {
+		return ""
+	}
+	return id.method + ":" + id.name
+}
+
+// newRequestID generates a random identifier for a request.
+func newRequestID() string {
+	var id [8]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// withRequestID assigns r an ID, reusing the client's X-Request-ID if it's well-formed, and echoes it in the response.
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := r.Header.Get(requestIDHeader)
+	if !clientRequestIDRx.MatchString(id) {
+		id = newRequestID()
+	}
+	w.Header().Set(requestIDHeader, id)
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+// withIdentity records the authenticated identity of the caller that sent r, for attribution in logs.
+func withIdentity(r *http.Request, method, name string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestIdentityKey{}, identity{method: method, name: name}))
+}
+
+// requestIdentity returns the identity recorded by withIdentity, or a zero identity if the caller wasn't
+// authenticated.
+func requestIdentity(r *http.Request) identity {
+	id, _ := r.Context().Value(requestIdentityKey{}).(identity)
+	return id
+}
+
+// requestLog returns a log entry tagged with the ID of the request being handled.
+func requestLog(r *http.Request) *log.Entry {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return log.WithField("requestID", id)
+}
+
+// statusRecorder captures the status code and response size written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+// Flush sends any buffered response data to the client, for handlers that stream their responses.
+func (rec *statusRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// unredactedPaths lists the API paths whose responses may contain secret values. Fleet agents are sent the secrets
+// for their host on purpose.
+var unredactedPaths = map[string]bool{
+	"/agent/assignment": true,
+}
+
+// redactingWriter masks known secret values in the body of a response. The body is held back until the handler
+// flushes it or returns, so that a secret value split across several writes is still masked as a whole.
+type redactingWriter struct {
+	http.ResponseWriter
+	pending bytes.Buffer
+}
+
+func (w *redactingWriter) Write(b []byte) (int, error) {
+	return w.pending.Write(b)
+}
+
+// emit writes the redacted body that's been held back so far.
+func (w *redactingWriter) emit() error {
+	if w.pending.Len() == 0 {
+		return nil
+	}
+	body := secrets.Redact(w.pending.String())
+	w.pending.Reset()
+	_, err := io.WriteString(w.ResponseWriter, body)
+	return err
+}
+
+// Flush sends the body written so far. Streaming handlers flush after each complete event.
+func (w *redactingWriter) Flush() {
+	w.emit()
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// finish sends the rest of the body once the handler has returned.
+func (w *redactingWriter) finish() {
+	if err := w.emit(); err != nil {
+		log.WithError(err).Debug("Unable to write response body.")
+	}
+}
+
+// Hijack lets WebSocket handlers take over the connection.
+func (rec *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection can't be hijacked")
+	}
+	if rec.status == 0 {
+		rec.status = http.StatusSwitchingProtocols
+	}
+	return hijacker.Hijack()
+}
+
+func (w *redactingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection can't be hijacked")
+	}
+	return hijacker.Hijack()
+}
+
+// streamingPaths lists the API paths whose responses stream for as long as the client stays connected. They aren't
+// bound by the request timeout.
+var streamingPaths = map[string]bool{
+	"/events":    true,
+	"/sync/logs": true,
+}
+
+// logAccess records a completed request. Credentials are never logged.
+func logAccess(r *http.Request, rec *statusRecorder, start time.Time) {
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	requestLog(r).WithFields(log.Fields{
+		"method":     r.Method,
+		"path":       r.URL.Path,
+		"status":     status,
+		"bytes":      rec.bytes,
+		"durationMs": time.Since(start).Milliseconds(),
+		"remoteAddr": r.RemoteAddr,
+		"identity":   requestIdentity(r).String(),
+	}).Info("Request handled.")
+}
@@ -4,10 +4,17 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"regexp"
+	"strconv"
 
+	"github.com/docker/docker/client"
 	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/state"
 )
 
+// actualDriftLimit is the number of recent drift events included in GET /actual.
+const actualDriftLimit = 20
+
 func (s Server) handleActualRoot(w http.ResponseWriter, r *http.Request) {
 	s.methods(w, r, methodHandlerMap{
 		http.MethodGet: func() { s.handleListActual(w, r) },
@@ -15,27 +22,184 @@ func (s Server) handleActualRoot(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s Server) handleListActual(w http.ResponseWriter, r *http.Request) {
-	session, err := s.pool.Take()
+	type actualResponse struct {
+		*state.ActualState
+		Apps  []state.AppStatus  `json:"apps"`
+		Drift []state.DriftEvent `json:"drift"`
+	}
+
+	session, err := s.takeSession(w, r)
 	if err != nil {
-		log.WithError(err).Error("Unable to establish a session.")
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "Unable to establish a session.\n")
 		return
 	}
 	defer session.Release()
 
-	actual, err := session.ReadActualState()
+	desired, err := session.ReadDesiredState(r.Context())
+	if err != nil {
+		log.WithError(err).Error("Unable to load the desired system state.")
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Unable to load the desired system state.\n")
+		return
+	}
+	scoped := desired.ForHost(s.opts().Fleet.Host(), s.opts().Fleet.Labels)
+
+	// Container inventory is best-effort: app status is reported from whatever could be read.
+	actual, errs, err := s.actualCache.Read(r.Context(), session, scoped)
 	if err != nil {
 		log.WithError(err).Error("Unable to load the actual system state.")
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "Unable to load the actual system state.\n")
 		return
 	}
+	for _, err := range errs {
+		log.WithError(err).Warn("Unable to read actual image.")
+	}
+
+	apps, err := session.ReadApps(r.Context())
+	if err != nil {
+		log.WithError(err).Error("Unable to load apps.")
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Unable to load apps.\n")
+		return
+	}
 
-	if err = json.NewEncoder(w).Encode(&actual); err != nil {
+	drift, err := session.ReadDrift(r.Context(), s.opts().Fleet.Host(), actualDriftLimit)
+	if err != nil {
+		log.WithError(err).Error("Unable to load drift events.")
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Unable to load drift events.\n")
+		return
+	}
+
+	response := actualResponse{ActualState: actual, Apps: state.AppStatuses(apps, scoped, *actual), Drift: drift}
+	if err = json.NewEncoder(w).Encode(&response); err != nil {
 		log.WithError(err).Error("Unable to serialize JSON.")
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "Unable to serialize JSON.\n")
 		return
 	}
 }
+
+// maxStatsSamples limits the number of samples streamed by GET /actual/{unit}/stats.
+const maxStatsSamples = 60
+
+var actualStatsRx = regexp.MustCompile(`^/actual/([^/]+)/stats$`)
+
+func (s Server) handleActual(w http.ResponseWriter, r *http.Request) {
+	ms := actualStatsRx.FindStringSubmatch(r.URL.Path)
+	if len(ms) != 2 {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not found"))
+		return
+	}
+
+	s.methods(w, r, methodHandlerMap{
+		http.MethodGet: func() { s.handleGetUnitStats(w, r, ms[1]) },
+	})
+}
+
+// handleGetUnitStats reports the CPU, memory, network, and block IO used by a unit's container. By default, it
+// responds with one sample as JSON. With "?samples=N", it streams N samples, about a second apart, as server-sent
+// events.
+func (s Server) handleGetUnitStats(w http.ResponseWriter, r *http.Request, name string) {
+	samples := 1
+	if raw := r.URL.Query().Get("samples"); len(raw) > 0 {
+		var err error
+		if samples, err = strconv.Atoi(raw); err != nil || samples < 1 || samples > maxStatsSamples {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "samples must be between 1 and %d", maxStatsSamples)
+			return
+		}
+	}
+
+	session, err := s.takeSession(w, r)
+	if err != nil {
+		return
+	}
+	defer session.Release()
+
+	desired, err := session.ReadDesiredState(r.Context())
+	if err != nil {
+		log.WithError(err).Error("Unable to load the desired system state.")
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Unable to load the desired system state.\n")
+		return
+	}
+	var unit *state.DesiredSystemdUnit
+	for _, u := range desired.ForHost(s.opts().Fleet.Host(), s.opts().Fleet.Labels).Units {
+		if u.UnitName() == name && u.Container != nil {
+			u := u
+			unit = &u
+		}
+	}
+	if unit == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "No container unit named %s runs on this host.\n", name)
+		return
+	}
+
+	if samples == 1 {
+		var sample state.ContainerStats
+		err := session.ReadContainerStats(r.Context(), *unit, 1, func(stats state.ContainerStats) error {
+			sample = stats
+			return nil
+		})
+		if client.IsErrNotFound(err) {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "The container of %s isn't running.\n", name)
+			return
+		}
+		if err != nil {
+			log.WithError(err).WithField("unit", name).Error("Unable to read container stats.")
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Unable to read container stats.\n")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err = json.NewEncoder(w).Encode(&sample); err != nil {
+			log.WithError(err).Error("Unable to serialize JSON.")
+		}
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Streaming is not supported"))
+		return
+	}
+
+	started := false
+	err = session.ReadContainerStats(r.Context(), *unit, samples, func(stats state.ContainerStats) error {
+		if !started {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("X-Accel-Buffering", "no")
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+		encoded, err := json.Marshal(&stats)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: stats\ndata: %s\n\n", encoded); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	})
+	if started || r.Context().Err() != nil {
+		return
+	}
+	if client.IsErrNotFound(err) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "The container of %s isn't running.\n", name)
+		return
+	}
+	if err != nil {
+		log.WithError(err).WithField("unit", name).Error("Unable to read container stats.")
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Unable to read container stats.\n")
+	}
+}
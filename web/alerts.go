@@ -0,0 +1,178 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/config"
+	"github.com/smashwilson/az-coordinator/notify"
+	"github.com/smashwilson/az-coordinator/state"
+)
+
+// alertRestartWindow is the window that unit restarts are counted within.
+const alertRestartWindow = time.Hour
+
+// alertTracker remembers the alerts that are firing, so that each is reported once when it's breached and once when
+// it recovers.
+type alertTracker struct {
+	lock   sync.Mutex
+	firing map[string]state.Alert
+}
+
+func newAlertTracker() *alertTracker {
+	return &alertTracker{firing: make(map[string]state.Alert)}
+}
+
+// update records the alerts that are breached by the rules in evaluated, returning the alerts that have begun firing
+// and the alerts that have recovered since the last update. Alerts of rules that weren't evaluated are left as they
+// were; alerts of rules in dropped are forgotten without being reported.
+func (t *alertTracker) update(breached []state.Alert, evaluated, dropped map[string]bool) []state.Alert {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	changed := make([]state.Alert, 0)
+	seen := make(map[string]bool, len(breached))
+	for _, alert := range breached {
+		key := alert.Key()
+		seen[key] = true
+		if _, ok := t.firing[key]; !ok {
+			changed = append(changed, alert)
+		}
+		t.firing[key] = alert
+	}
+
+	for key, alert := range t.firing {
+		if seen[key] {
+			continue
+		}
+		if dropped[alert.Rule] {
+			delete(t.firing, key)
+			continue
+		}
+		if evaluated[alert.Rule] {
+			delete(t.firing, key)
+			alert.Firing = false
+			changed = append(changed, alert)
+		}
+	}
+	return changed
+}
+
+// active lists the alerts that are firing, ordered by rule and subject.
+func (t *alertTracker) active() []state.Alert {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	alerts := make([]state.Alert, 0, len(t.firing))
+	for _, alert := range t.firing {
+		alerts = append(alerts, alert)
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].Key() < alerts[j].Key() })
+	return alerts
+}
+
+// noteSyncOutcome counts the syncs that have failed in a row, for the failed_syncs alert rule.
+func (s *Server) noteSyncOutcome(failed bool) {
+	if failed {
+		atomic.AddInt32(s.failedSyncs, 1)
+	} else {
+		atomic.StoreInt32(s.failedSyncs, 0)
+	}
+}
+
+// runAlerts evaluates the configured alert rules on a timer, reporting each alert that begins firing or recovers.
+func (s *Server) runAlerts() {
+	for {
+		time.Sleep(s.opts().Alerts.Interval())
+		s.evaluateAlerts(s.opts().Alerts)
+	}
+}
+
+// evaluateAlerts checks each enabled alert rule once.
+func (s *Server) evaluateAlerts(alertOpts config.AlertOptions) {
+	host := s.opts().Fleet.Host()
+	breached := make([]state.Alert, 0)
+	evaluated := make(map[string]bool)
+	dropped := make(map[string]bool)
+
+	if threshold := alertOpts.DiskUsagePercent; threshold > 0 {
+		evaluated[state.AlertDiskUsage] = true
+		for _, path := range state.WatchedPaths {
+			usage, err := state.ReadPathUsage(path)
+			if err != nil {
+				log.WithError(err).WithField("path", path).Debug("Unable to read disk usage for alerts.")
+				continue
+			}
+			if usage.UsagePercent >= threshold {
+				breached = append(breached, state.Alert{
+					Rule:      state.AlertDiskUsage,
+					Subject:   path,
+					Host:      host,
+					Firing:    true,
+					Value:     usage.UsagePercent,
+					Threshold: threshold,
+					Detail:    fmt.Sprintf("the partition containing %s is %d%% full", path, usage.UsagePercent),
+				})
+			}
+		}
+	} else {
+		dropped[state.AlertDiskUsage] = true
+	}
+
+	if threshold := alertOpts.UnitRestartsPerHour; threshold > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), alertOpts.Interval())
+		restarts, err := state.ReadUnitRestarts(ctx, alertRestartWindow)
+		cancel()
+		if err != nil {
+			log.WithError(err).Warn("Unable to count unit restarts for alerts.")
+		} else {
+			evaluated[state.AlertUnitRestarts] = true
+			for unit, count := range restarts {
+				if count >= threshold {
+					breached = append(breached, state.Alert{
+						Rule:      state.AlertUnitRestarts,
+						Subject:   unit,
+						Host:      host,
+						Firing:    true,
+						Value:     count,
+						Threshold: threshold,
+						Detail:    fmt.Sprintf("unit %s was restarted %d times in the last hour", unit, count),
+					})
+				}
+			}
+		}
+	} else {
+		dropped[state.AlertUnitRestarts] = true
+	}
+
+	if threshold := alertOpts.FailedSyncs; threshold > 0 {
+		evaluated[state.AlertFailedSyncs] = true
+		if failed := int(atomic.LoadInt32(s.failedSyncs)); failed >= threshold {
+			breached = append(breached, state.Alert{
+				Rule:      state.AlertFailedSyncs,
+				Host:      host,
+				Firing:    true,
+				Value:     failed,
+				Threshold: threshold,
+				Detail:    fmt.Sprintf("the last %d syncs failed", failed),
+			})
+		}
+	} else {
+		dropped[state.AlertFailedSyncs] = true
+	}
+
+	for _, alert := range s.alerts.update(breached, evaluated, dropped) {
+		log.WithFields(log.Fields{
+			"rule":    alert.Rule,
+			"subject": alert.Subject,
+			"firing":  alert.Firing,
+			"value":   alert.Value,
+		}).Warn("Alert changed.")
+		notify.ReportAlert(*s.opts(), alert)
+	}
+}
@@ -0,0 +1,293 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/state"
+)
+
+func (s *Server) handleAppsRoot(w http.ResponseWriter, r *http.Request) {
+	s.methods(w, r, methodHandlerMap{
+		http.MethodGet:  func() { s.handleListApps(w, r) },
+		http.MethodPost: func() { s.handleCreateApp(w, r) },
+	})
+}
+
+var appRx = regexp.MustCompile(`^/apps/([^/]+)(?:/(sync|freeze|unfreeze|rollback))?$`)
+
+func (s *Server) handleApp(w http.ResponseWriter, r *http.Request) {
+	ms := appRx.FindStringSubmatch(r.URL.Path)
+	if len(ms) != 3 {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not found"))
+		return
+	}
+	name, action := ms[1], ms[2]
+
+	switch action {
+	case "":
+		s.methods(w, r, methodHandlerMap{
+			http.MethodDelete: func() { s.handleDeleteApp(w, r, name) },
+		})
+	case "sync":
+		s.methods(w, r, methodHandlerMap{
+			http.MethodPost: func() { s.handleSyncApp(w, r, name) },
+		})
+	case "freeze":
+		s.methods(w, r, methodHandlerMap{
+			http.MethodPost: func() { s.handleFreezeApp(w, r, name, true) },
+		})
+	case "unfreeze":
+		s.methods(w, r, methodHandlerMap{
+			http.MethodPost: func() { s.handleFreezeApp(w, r, name, false) },
+		})
+	case "rollback":
+		s.methods(w, r, methodHandlerMap{
+			http.MethodPost: func() { s.handleRollBackApp(w, r, name) },
+		})
+	}
+}
+
+func (s *Server) handleListApps(w http.ResponseWriter, r *http.Request) {
+	session, err := s.takeSession(w, r)
+	if err != nil {
+		return
+	}
+	defer session.Release()
+
+	apps, err := session.ReadApps(r.Context())
+	if err != nil {
+		log.WithError(err).Error("Unable to load apps.")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Unable to load apps"))
+		return
+	}
+
+	if err = json.NewEncoder(w).Encode(apps); err != nil {
+		log.WithError(err).Error("Unable to serialize JSON.")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Unable to serialize JSON"))
+		return
+	}
+}
+
+func (s *Server) handleCreateApp(w http.ResponseWriter, r *http.Request) {
+	type createRequest struct {
+		Name string `json:"name"`
+	}
+
+	session, err := s.takeSession(w, r)
+	if err != nil {
+		return
+	}
+	defer session.Release()
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	var appReq createRequest
+	if err = decoder.Decode(&appReq); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Unable to parse request body as JSON: %v", err)
+		return
+	}
+
+	existing, err := session.ReadApp(r.Context(), appReq.Name)
+	if err != nil {
+		log.WithError(err).Error("Unable to load apps.")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Unable to load apps"))
+		return
+	}
+	if existing != nil {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "App %s already exists", appReq.Name)
+		return
+	}
+
+	app, err := session.CreateApp(r.Context(), appReq.Name)
+	if err != nil {
+		log.WithError(err).Warn("Unable to create app.")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Unable to create app: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(app)
+}
+
+// readApp loads the named app for a request. If it can't be loaded, an error response is written and nil is returned.
+func readApp(w http.ResponseWriter, r *http.Request, session *state.SessionLease, name string) *state.App {
+	app, err := session.ReadApp(r.Context(), name)
+	if err != nil {
+		log.WithError(err).WithField("app", name).Error("Unable to load app.")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Unable to load app"))
+		return nil
+	}
+	if app == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("App not found"))
+		return nil
+	}
+	return app
+}
+
+func (s *Server) handleDeleteApp(w http.ResponseWriter, r *http.Request, name string) {
+	session, err := s.takeSession(w, r)
+	if err != nil {
+		return
+	}
+	defer session.Release()
+
+	app := readApp(w, r, session, name)
+	if app == nil {
+		return
+	}
+
+	if err := session.DeleteApp(r.Context(), app.ID); err != nil {
+		log.WithError(err).WithField("app", name).Error("Unable to delete app.")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Unable to delete app"))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleFreezeApp(w http.ResponseWriter, r *http.Request, name string, frozen bool) {
+	session, err := s.takeSession(w, r)
+	if err != nil {
+		return
+	}
+	defer session.Release()
+
+	app := readApp(w, r, session, name)
+	if app == nil {
+		return
+	}
+
+	if err := session.SetAppFrozen(r.Context(), app.ID, frozen); err != nil {
+		log.WithError(err).WithField("app", name).Error("Unable to freeze or unfreeze app.")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Unable to update app"))
+		return
+	}
+	app.Frozen = frozen
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(app)
+}
+
+func (s *Server) handleSyncApp(w http.ResponseWriter, r *http.Request, name string) {
+	session, err := s.takeSession(w, r)
+	if err != nil {
+		return
+	}
+	app := readApp(w, r, session, name)
+	session.Release()
+	if app == nil {
+		return
+	}
+
+	s.startAppSync(w, r, app)
+}
+
+// handleRollBackApp restores the app's previous release, then syncs the app to apply it, as a job.
+func (s *Server) handleRollBackApp(w http.ResponseWriter, r *http.Request, name string) {
+	if !s.isLeader() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("This coordinator is a follower. Request a rollback from the leader."))
+		return
+	}
+
+	session, err := s.takeSession(w, r)
+	if err != nil {
+		return
+	}
+	app := readApp(w, r, session, name)
+	session.Release()
+	if app == nil {
+		return
+	}
+	if len(app.Previous) == 0 {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "App %s has no previous release", name)
+		return
+	}
+
+	if err := s.syncRefused(); err != nil {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	trigger := requestTrigger(r)
+	if len(trigger.Reason) == 0 {
+		trigger.Reason = "roll back app " + app.Name
+	}
+	syncing := s.currentSync.request(trigger)
+	sync := s.syncWork(trigger, func(settings *state.SyncSettings) { settings.App = &app.ID })
+
+	job := s.startJob(state.JobRollback, trigger, func(ctx context.Context) (interface{}, error) {
+		session, err := s.pool.TakeContext(ctx)
+		if err == nil {
+			err = session.RollBackApp(state.WithActor(ctx, trigger.Actor), app)
+			session.Release()
+		}
+		if err != nil {
+			log.WithError(err).WithField("app", name).Error("Unable to roll back app.")
+			if syncing {
+				s.currentSync.setErrors([]error{err})
+			}
+			return nil, err
+		}
+		if !syncing {
+			log.WithField("app", name).Warn("Sync already in progress. The rollback will be applied by the next sync.")
+			return app, nil
+		}
+		return sync(ctx)
+	})
+
+	writeJobLocation(w, job)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("Rollback started."))
+}
+
+// startAppSync begins a sync of a single app in the background.
+func (s *Server) startAppSync(w http.ResponseWriter, r *http.Request, app *state.App) {
+	if !s.isLeader() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("This coordinator is a follower. Request a sync from the leader."))
+		return
+	}
+
+	if err := s.syncRefused(); err != nil {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	trigger := requestTrigger(r)
+	if len(trigger.Reason) == 0 {
+		trigger.Reason = "app " + app.Name
+	}
+	if !s.currentSync.request(trigger) {
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("Sync already in progress"))
+		return
+	}
+
+	job := s.startScopedSync(trigger, func(settings *state.SyncSettings) { settings.App = &app.ID })
+
+	writeJobLocation(w, job)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("Sync started."))
+}
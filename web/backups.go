@@ -0,0 +1,128 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/backup"
+	"github.com/smashwilson/az-coordinator/config"
+	"github.com/smashwilson/az-coordinator/state"
+)
+
+const (
+	// backupCheckInterval is the time between checks for whether a scheduled backup is due.
+	backupCheckInterval = time.Minute
+
+	// backupRetryDelay is the time to wait after a scheduled backup fails before trying again.
+	backupRetryDelay = 15 * time.Minute
+)
+
+// backupStatus reports the most recent scheduled backup that succeeded. A backup is stale once it's older than two
+// intervals, or if none has succeeded.
+type backupStatus struct {
+	Enabled      bool   `json:"enabled"`
+	LastBackupAt int64  `json:"last_backup_at,omitempty"`
+	AgeSeconds   int64  `json:"age_seconds,omitempty"`
+	URL          string `json:"url,omitempty"`
+	Stale        bool   `json:"stale"`
+}
+
+// runBackups takes a backup whenever the last one that succeeded is older than the configured interval. Backups are
+// recorded as jobs, so that the schedule is shared by every coordinator and survives restarts; only the leader takes
+// them.
+func (s *Server) runBackups() {
+	var retryAt time.Time
+	for {
+		time.Sleep(backupCheckInterval)
+
+		backupOpts := s.opts().Backups
+		if !backupOpts.Enabled() || !s.isLeader() || time.Now().Before(retryAt) {
+			continue
+		}
+
+		last, err := s.lastBackup(context.Background())
+		if err != nil {
+			log.WithError(err).Warn("Unable to read the last backup.")
+			continue
+		}
+		if last != nil && time.Since(time.Unix(last.FinishedAt, 0)) < backupOpts.Interval() {
+			continue
+		}
+
+		if err := s.takeBackup(backupOpts); err != nil {
+			log.WithError(err).Error("Unable to back up the database.")
+			retryAt = time.Now().Add(backupRetryDelay)
+		}
+	}
+}
+
+// takeBackup uploads a backup of the database as a job, then deletes the backups beyond those to be retained.
+func (s *Server) takeBackup(backupOpts config.BackupOptions) error {
+	var backupErr error
+	s.runJob(s.newJob(state.JobBackup, state.SyncTrigger{Source: state.TriggerScheduler, Actor: state.TriggerScheduler}), func(ctx context.Context) (interface{}, error) {
+		sess, err := s.opts().AWS().NewSession()
+		if err != nil {
+			backupErr = err
+			return nil, err
+		}
+
+		scheduler := backup.NewScheduler(sess, backupOpts.Bucket, backupOpts.KeyPrefix(), backupOpts.KMSKeyID)
+		snapshot, err := scheduler.Take(ctx, s.db, backupOpts.RetainCount())
+		if err != nil {
+			backupErr = err
+			return nil, err
+		}
+
+		entry := log.WithFields(log.Fields{"url": snapshot.URL, "rows": snapshot.Rows, "deleted": len(snapshot.Deleted)})
+		if len(snapshot.PruneError) > 0 {
+			entry.WithField("prune_error", snapshot.PruneError).Warn("Database backed up, but older backups weren't deleted.")
+		} else {
+			entry.Info("Database backed up.")
+		}
+		return snapshot, nil
+	})
+	return backupErr
+}
+
+// lastBackup loads the job of the most recent backup that succeeded, or returns nil if there hasn't been one.
+func (s *Server) lastBackup(ctx context.Context) (*state.Job, error) {
+	session, err := s.pool.TakeContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Release()
+
+	return session.ReadLastJob(ctx, state.JobBackup, state.JobSucceeded)
+}
+
+// backupHealth reports the age of the most recent backup that succeeded for GET /health, or nil if backups aren't
+// enabled.
+func (s *Server) backupHealth(ctx context.Context, session *state.SessionLease) *backupStatus {
+	backupOpts := s.opts().Backups
+	if !backupOpts.Enabled() {
+		return nil
+	}
+
+	status := &backupStatus{Enabled: true, Stale: true}
+	last, err := session.ReadLastJob(ctx, state.JobBackup, state.JobSucceeded)
+	if err != nil {
+		session.Log.WithError(err).Warn("Unable to read the last backup.")
+		return status
+	}
+	if last == nil {
+		return status
+	}
+
+	age := time.Since(time.Unix(last.FinishedAt, 0))
+	status.LastBackupAt = last.FinishedAt
+	status.AgeSeconds = int64(age / time.Second)
+	status.Stale = age > 2*backupOpts.Interval()
+
+	var snapshot backup.Snapshot
+	if err := json.Unmarshal(last.Result, &snapshot); err == nil {
+		status.URL = snapshot.URL
+	}
+	return status
+}
@@ -0,0 +1,339 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/events"
+	"github.com/smashwilson/az-coordinator/state"
+)
+
+// The statuses of each change in a batch.
+const (
+	batchCreated    = "created"
+	batchUpdated    = "updated"
+	batchDeleted    = "deleted"
+	batchInvalid    = "invalid"
+	batchNotFound   = "not_found"
+	batchConflict   = "conflict"
+	batchFailed     = "failed"
+	batchNotApplied = "not_applied"
+)
+
+func (s Server) handleDesiredBatchRoot(w http.ResponseWriter, r *http.Request) {
+	s.methods(w, r, methodHandlerMap{
+		http.MethodPost: func() { s.handleDesiredBatch(w, r) },
+	})
+}
+
+// handleDesiredBatch creates, updates, and deletes several desired units at once. Either every change is stored, or
+// none are. Updates replace every setting of a unit, like a PUT to /desired/by-name/, and keep its path and pin.
+func (s Server) handleDesiredBatch(w http.ResponseWriter, r *http.Request) {
+	type batchUnitContainer struct {
+		Name      string `json:"name"`
+		ImageName string `json:"image_name"`
+		ImageTag  string `json:"image_tag"`
+	}
+
+	type batchUnit struct {
+		Path      string              `json:"path"`
+		Type      state.UnitType      `json:"type"`
+		Container *batchUnitContainer `json:"container,omitempty"`
+		Secrets   []string            `json:"secrets"`
+		Env       map[string]string   `json:"env"`
+		Ports     map[int]int         `json:"ports"`
+		Volumes   map[string]string   `json:"volumes"`
+		Schedule  string              `json:"calendar"`
+		Hosts     []string            `json:"hosts"`
+		Selector  map[string]string   `json:"selector"`
+		App       string              `json:"app"`
+
+		Ulimits    map[string]string `json:"ulimits"`
+		ShmSize    string            `json:"shm_size"`
+		Devices    []string          `json:"devices"`
+		ExtraHosts map[string]string `json:"extra_hosts"`
+		GPUs       string            `json:"gpus"`
+
+		// Enabled defaults to true.
+		Enabled *bool `json:"enabled"`
+
+		Protected bool `json:"protected"`
+	}
+
+	type batchChange struct {
+		Op   string     `json:"op"`
+		ID   *int       `json:"id"`
+		Unit *batchUnit `json:"unit"`
+
+		// Version, if present, is the version of the unit that an update or delete was made to. The change is refused
+		// if the unit has changed since.
+		Version *int `json:"version"`
+	}
+
+	type batchRequest struct {
+		Changes []batchChange `json:"changes"`
+	}
+
+	type batchResult struct {
+		Index  int                       `json:"index"`
+		Op     string                    `json:"op"`
+		Status string                    `json:"status"`
+		Errors []string                  `json:"errors,omitempty"`
+		Unit   *state.DesiredSystemdUnit `json:"unit,omitempty"`
+	}
+
+	type batchResponse struct {
+		Applied bool          `json:"applied"`
+		Results []batchResult `json:"results"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	var batchReq batchRequest
+	if err := decoder.Decode(&batchReq); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Unable to parse request body as JSON: %v", err)
+		return
+	}
+	if len(batchReq.Changes) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("No changes given"))
+		return
+	}
+
+	session, err := s.takeSession(w, r)
+	if err != nil {
+		return
+	}
+	defer session.Release()
+
+	existing, err := session.ReadDesiredState(r.Context())
+	if err != nil {
+		log.WithError(err).Error("Unable to load the desired system state.")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Unable to load the desired system state"))
+		return
+	}
+	byID := make(map[int]state.DesiredSystemdUnit, len(existing.Units))
+	for _, unit := range existing.Units {
+		byID[*unit.ID] = unit
+	}
+
+	respond := func(status int, applied bool, results []batchResult) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(batchResponse{Applied: applied, Results: results})
+	}
+
+	results := make([]batchResult, len(batchReq.Changes))
+	changes := make([]state.DesiredChange, len(batchReq.Changes))
+	seen := make(map[int]int)
+	status := http.StatusOK
+	refuse := func(i int, resultStatus string, httpStatus int, errs ...error) {
+		results[i].Status = resultStatus
+		for _, err := range errs {
+			results[i].Errors = append(results[i].Errors, err.Error())
+		}
+		if status == http.StatusOK || httpStatus == http.StatusBadRequest {
+			status = httpStatus
+		}
+	}
+
+	for i, change := range batchReq.Changes {
+		results[i] = batchResult{Index: i, Op: change.Op}
+
+		var current *state.DesiredSystemdUnit
+		switch change.Op {
+		case state.ChangeCreate:
+			if change.ID != nil || change.Version != nil {
+				refuse(i, batchInvalid, http.StatusBadRequest, errors.New("units to create can't have an id or version"))
+				continue
+			}
+		case state.ChangeUpdate, state.ChangeDelete:
+			if change.ID == nil {
+				refuse(i, batchInvalid, http.StatusBadRequest, fmt.Errorf("units to %s must have an id", change.Op))
+				continue
+			}
+			if other, ok := seen[*change.ID]; ok {
+				refuse(i, batchInvalid, http.StatusBadRequest, fmt.Errorf("unit %d is also changed by change %d", *change.ID, other))
+				continue
+			}
+			seen[*change.ID] = i
+
+			unit, ok := byID[*change.ID]
+			if !ok {
+				refuse(i, batchNotFound, http.StatusBadRequest, fmt.Errorf("desired unit %d not found", *change.ID))
+				continue
+			}
+			if change.Version != nil && *change.Version != unit.Version {
+				results[i].Unit = &unit
+				refuse(i, batchConflict, http.StatusConflict, state.ErrVersionConflict)
+				continue
+			}
+			current = &unit
+		default:
+			refuse(i, batchInvalid, http.StatusBadRequest, fmt.Errorf("unknown op %q: use create, update, or delete", change.Op))
+			continue
+		}
+
+		if change.Op == state.ChangeDelete {
+			if change.Unit != nil {
+				refuse(i, batchInvalid, http.StatusBadRequest, errors.New("units to delete can't have settings"))
+				continue
+			}
+			changes[i] = state.DesiredChange{Op: change.Op, Unit: *current}
+			continue
+		}
+		if change.Unit == nil {
+			refuse(i, batchInvalid, http.StatusBadRequest, fmt.Errorf("units to %s must have settings", change.Op))
+			continue
+		}
+
+		errs := make([]error, 0)
+		tried := func(err error) {
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+
+		var (
+			req     = change.Unit
+			builder state.DesiredSystemdUnitBuilder
+			pin     string
+		)
+		if current != nil {
+			if len(req.Path) > 0 && req.Path != current.Path {
+				tried(errors.New("the path of an existing unit can't be changed"))
+			}
+			if current.Container != nil {
+				pin = current.Container.PinnedImageID
+			}
+			builder = state.ModifyDesiredUnit(current)
+		} else {
+			builder = state.BuildDesiredUnit()
+			tried(builder.Path(req.Path))
+		}
+
+		tried(builder.Type(req.Type))
+		if req.Container != nil {
+			tried(builder.Container(req.Container.ImageName, req.Container.ImageTag, req.Container.Name))
+		} else {
+			tried(builder.Container("", "", ""))
+		}
+		tried(builder.Pin(pin))
+		tried(builder.Secrets(req.Secrets, *session))
+		tried(builder.Volumes(req.Volumes))
+		tried(builder.Env(req.Env, *session))
+		tried(builder.Ports(req.Ports))
+		tried(builder.Schedule(req.Schedule))
+		tried(builder.Hosts(req.Hosts))
+		tried(builder.Selector(req.Selector))
+		tried(builder.App(req.App, *session))
+		tried(builder.Ulimits(req.Ulimits))
+		tried(builder.ShmSize(req.ShmSize))
+		tried(builder.Devices(req.Devices))
+		tried(builder.ExtraHosts(req.ExtraHosts))
+		tried(builder.GPUs(req.GPUs))
+		enabled := true
+		if req.Enabled != nil {
+			enabled = *req.Enabled
+		}
+		tried(builder.Enabled(enabled))
+		tried(builder.Protected(req.Protected))
+
+		unit, err := builder.Build()
+		tried(err)
+
+		if len(errs) > 0 {
+			for _, err := range errs {
+				log.WithError(err).Warn("Invalid desired unit.")
+			}
+			refuse(i, batchInvalid, http.StatusBadRequest, errs...)
+			continue
+		}
+		changes[i] = state.DesiredChange{Op: change.Op, Unit: *unit}
+	}
+
+	if status == http.StatusOK {
+		// Check the units that are created or updated against each other, as well as the units that remain.
+		final := *existing
+		final.Units = make([]state.DesiredSystemdUnit, 0, len(existing.Units))
+		for _, unit := range existing.Units {
+			if i, ok := seen[*unit.ID]; !ok || changes[i].Op != state.ChangeDelete {
+				final.Units = append(final.Units, unit)
+			}
+		}
+		for _, change := range changes {
+			if change.Op != state.ChangeDelete {
+				final = final.WithUnit(change.Unit)
+			}
+		}
+		for i, change := range changes {
+			if change.Op == state.ChangeDelete {
+				continue
+			}
+			if err := state.ConflictsError(final.ConflictsOf(change.Unit)); err != nil {
+				refuse(i, batchInvalid, http.StatusBadRequest, err)
+			}
+		}
+	}
+
+	if status != http.StatusOK {
+		for i := range results {
+			if len(results[i].Status) == 0 {
+				results[i].Status = batchNotApplied
+			}
+		}
+		respond(status, false, results)
+		return
+	}
+
+	if err := session.ApplyDesiredChanges(r.Context(), changes); err != nil {
+		changeErr, ok := err.(*state.ChangeError)
+		if !ok {
+			log.WithError(err).Error("Unable to store a batch of desired units.")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Unable to store the batch in the database"))
+			return
+		}
+
+		for i := range results {
+			results[i].Status = batchNotApplied
+		}
+		if changeErr.Err == state.ErrVersionConflict {
+			// The unit was changed by another request after it was read.
+			if current, err := session.ReadDesiredUnit(r.Context(), *changes[changeErr.Index].Unit.ID); err == nil {
+				results[changeErr.Index].Unit = current
+			}
+			refuse(changeErr.Index, batchConflict, http.StatusConflict, changeErr.Err)
+		} else {
+			log.WithError(err).Error("Unable to store a batch of desired units.")
+			refuse(changeErr.Index, batchFailed, http.StatusInternalServerError, changeErr.Err)
+		}
+		respond(status, false, results)
+		return
+	}
+
+	for i, change := range changes {
+		unit := change.Unit
+		data := events.UnitData{ID: *unit.ID, Name: unit.UnitName()}
+		switch change.Op {
+		case state.ChangeCreate:
+			results[i].Status = batchCreated
+			s.emitFrom(r, events.UnitCreated, data)
+		case state.ChangeUpdate:
+			results[i].Status = batchUpdated
+			s.emitFrom(r, events.UnitUpdated, data)
+		case state.ChangeDelete:
+			results[i].Status = batchDeleted
+			s.emitFrom(r, events.UnitDeleted, data)
+			continue
+		}
+		results[i].Unit = &unit
+	}
+	respond(http.StatusOK, true, results)
+}
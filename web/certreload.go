@@ -0,0 +1,69 @@
+package web
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// certReloader serves a TLS certificate and key from disk, loading them again whenever either file changes. This lets
+// a sync that renews the certificate take effect on the next handshake, without restarting the server.
+type certReloader struct {
+	certPath string
+	keyPath  string
+
+	lock     sync.Mutex
+	cert     *tls.Certificate
+	certTime time.Time
+	keyTime  time.Time
+}
+
+// newCertReloader loads the initial certificate and key, failing if they can't be read.
+func newCertReloader(certPath, keyPath string) (*certReloader, error) {
+	r := &certReloader{certPath: certPath, keyPath: keyPath}
+	if _, err := r.current(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// current returns the loaded certificate, first reloading it if either file has been modified since it was loaded. If
+// the modified files can't be loaded, the previous certificate continues to be served.
+func (r *certReloader) current() (*tls.Certificate, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	certInfo, certErr := os.Stat(r.certPath)
+	keyInfo, keyErr := os.Stat(r.keyPath)
+	if certErr == nil && keyErr == nil && r.cert != nil &&
+		certInfo.ModTime().Equal(r.certTime) && keyInfo.ModTime().Equal(r.keyTime) {
+		return r.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		if r.cert != nil {
+			log.WithError(err).Warn("Unable to reload TLS certificate. Continuing with the previous one.")
+			return r.cert, nil
+		}
+		return nil, err
+	}
+
+	if r.cert != nil {
+		log.WithField("certPath", r.certPath).Info("TLS certificate reloaded.")
+	}
+	r.cert = &cert
+	if certErr == nil && keyErr == nil {
+		r.certTime = certInfo.ModTime()
+		r.keyTime = keyInfo.ModTime()
+	}
+	return r.cert, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.current()
+}
@@ -0,0 +1,51 @@
+package web
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// clientTLSConfig builds a TLS configuration that asks API clients for a certificate and verifies any that are
+// presented against the certificate authorities in the PEM bundle at caPath. Clients without a certificate may still
+// connect and authenticate with the auth token.
+func clientTLSConfig(caPath string) (*tls.Config, error) {
+	bundle, err := ioutil.ReadFile(caPath)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("No certificates found in client CA bundle %s", caPath)
+	}
+
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+	}, nil
+}
+
+// certIdentity returns the common name of the verified client certificate presented with r, if there is one and it's
+// permitted to use the API.
+func (s Server) certIdentity(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if len(name) == 0 {
+		return "", false
+	}
+
+	if len(s.opts().ClientCertNames) == 0 {
+		return name, true
+	}
+	for _, allowed := range s.opts().ClientCertNames {
+		if name == allowed {
+			return name, true
+		}
+	}
+	return "", false
+}
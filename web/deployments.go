@@ -0,0 +1,149 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/github"
+	"github.com/smashwilson/az-coordinator/state"
+)
+
+// deploymentTimeout limits the time spent reporting the deployments of one sync to GitHub.
+const deploymentTimeout = time.Minute
+
+// githubDeployment is a GitHub Deployment created for a unit whose container a sync updated.
+type githubDeployment struct {
+	unit       string
+	repository string
+	id         int64
+}
+
+// deploymentRecorder reports the containers that a sync updates to GitHub as Deployments. They're reported in the
+// background, so that a slow or unreachable GitHub doesn't hold up the sync. A nil deploymentRecorder reports nothing.
+type deploymentRecorder struct {
+	client      *github.Client
+	environment string
+	host        string
+	logURL      string
+
+	// started is true once the Delta is being applied. created receives the deployments once they've been created.
+	started bool
+	created chan []githubDeployment
+}
+
+// newDeploymentRecorder prepares to report a sync's deployments with the github options, or returns nil if they aren't
+// configured.
+func (s *Server) newDeploymentRecorder() *deploymentRecorder {
+	githubOpts := s.opts().GitHub
+	if !githubOpts.Enabled() {
+		return nil
+	}
+
+	client, err := github.NewClient(githubOpts)
+	if err != nil {
+		log.WithError(err).Warn("Unable to create GitHub client. Deployments won't be reported.")
+		return nil
+	}
+	return &deploymentRecorder{
+		client:      client,
+		environment: githubOpts.EnvironmentName(),
+		host:        s.opts().Fleet.Host(),
+		logURL:      s.syncLink(),
+		created:     make(chan []githubDeployment, 1),
+	}
+}
+
+// start creates an in-progress deployment for each unit whose container d updates, if the labels of its new image name
+// the repository and commit that it was built from.
+func (r *deploymentRecorder) start(d state.Delta, trigger state.SyncTrigger) {
+	if r == nil {
+		return
+	}
+	r.started = true
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), deploymentTimeout)
+		defer cancel()
+
+		deployments := make([]githubDeployment, 0)
+		for _, unit := range d.UnitsToChange {
+			container := unit.Container
+			if container == nil || unit.Type == state.TypeTimer || len(container.Repository) == 0 || len(container.GitOID) == 0 {
+				continue
+			}
+			entry := log.WithFields(log.Fields{
+				"unit":       unit.UnitName(),
+				"repository": container.Repository,
+				"commit":     container.GitOID,
+			})
+
+			id, err := r.client.CreateDeployment(ctx, github.Deployment{
+				Repository:  container.Repository,
+				Ref:         container.GitOID,
+				Environment: r.environment,
+				Description: fmt.Sprintf("Deploying %s to %s", unit.UnitName(), r.host),
+				Payload: map[string]string{
+					"unit":     unit.UnitName(),
+					"host":     r.host,
+					"image_id": container.ImageID,
+					"actor":    trigger.Actor,
+				},
+			})
+			if err != nil {
+				entry.WithError(err).Warn("Unable to create GitHub deployment.")
+				continue
+			}
+			deployments = append(deployments, githubDeployment{unit: unit.UnitName(), repository: container.Repository, id: id})
+
+			if err := r.client.SetStatus(ctx, container.Repository, id, github.StateInProgress, "Applying sync", r.logURL); err != nil {
+				entry.WithError(err).Warn("Unable to report GitHub deployment status.")
+			}
+		}
+		r.created <- deployments
+	}()
+}
+
+// finish reports the outcome of each deployment once it's been created. A deployment fails if its unit couldn't be
+// applied, or wasn't healthy afterwards.
+func (r *deploymentRecorder) finish(d *state.Delta) {
+	if r == nil || !r.started {
+		return
+	}
+
+	go func() {
+		deployments := <-r.created
+
+		ctx, cancel := context.WithTimeout(context.Background(), deploymentTimeout)
+		defer cancel()
+
+		for _, deployment := range deployments {
+			status, description := deploymentOutcome(d, deployment.unit, r.host)
+			if err := r.client.SetStatus(ctx, deployment.repository, deployment.id, status, description, r.logURL); err != nil {
+				log.WithError(err).WithFields(log.Fields{
+					"unit":       deployment.unit,
+					"repository": deployment.repository,
+				}).Warn("Unable to report GitHub deployment status.")
+			}
+		}
+	}()
+}
+
+// deploymentOutcome decides the final state of a unit's deployment from the applied Delta, with a description of it.
+func deploymentOutcome(d *state.Delta, unit, host string) (string, string) {
+	if d == nil {
+		return github.StateFailure, "The sync failed"
+	}
+	for _, result := range d.UnitResults {
+		if result.Unit == unit && result.Failed() {
+			return github.StateFailure, result.Detail()
+		}
+	}
+	for _, health := range d.Health {
+		if health.Unit == unit && !health.Healthy {
+			return github.StateFailure, fmt.Sprintf("%s is %s after the sync", unit, health.ActiveState)
+		}
+	}
+	return github.StateSuccess, fmt.Sprintf("Running on %s", host)
+}
@@ -9,6 +9,7 @@ import (
 	"strings"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/events"
 	"github.com/smashwilson/az-coordinator/state"
 )
 
@@ -19,13 +20,16 @@ func (s Server) handleDesiredRoot(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-var desiredRx = regexp.MustCompile(`^/desired/(\d+)$`)
+var desiredRx = regexp.MustCompile(`^/desired/(\d+)(?:/(promote|promotions|history))?$`)
 
 func (s Server) handleDesired(w http.ResponseWriter, r *http.Request) {
-	rawID, ok := extractID(desiredRx, w, r)
-	if !ok {
+	ms := desiredRx.FindStringSubmatch(r.URL.Path)
+	if len(ms) != 3 {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not found"))
 		return
 	}
+	rawID, action := ms[1], ms[2]
 
 	id, err := strconv.ParseInt(rawID, 10, 32)
 	if err != nil {
@@ -34,29 +38,46 @@ func (s Server) handleDesired(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.methods(w, r, methodHandlerMap{
-		http.MethodPut:    func() { s.handleUpdateDesired(w, r, int(id)) },
-		http.MethodDelete: func() { s.handleDeleteDesired(w, r, int(id)) },
-	})
+	switch action {
+	case "":
+		s.methods(w, r, methodHandlerMap{
+			http.MethodPut:    func() { s.handleUpdateDesired(w, r, int(id)) },
+			http.MethodDelete: func() { s.handleDeleteDesired(w, r, int(id)) },
+		})
+	case "promote":
+		s.methods(w, r, methodHandlerMap{
+			http.MethodPost: func() { s.handlePromoteDesired(w, r, int(id)) },
+		})
+	case "promotions":
+		s.methods(w, r, methodHandlerMap{
+			http.MethodGet: func() { s.handleListPromotions(w, r, int(id)) },
+		})
+	case "history":
+		s.methods(w, r, methodHandlerMap{
+			http.MethodGet: func() { s.handleUnitHistory(w, r, int(id)) },
+		})
+	}
 }
 
+// handleListDesired lists the desired units. Each container is annotated with the image that it should run and the
+// commit that the image was built from, as far as the images on this host allow.
 func (s Server) handleListDesired(w http.ResponseWriter, r *http.Request) {
-	session, err := s.pool.Take()
+	session, err := s.takeSession(w, r)
 	if err != nil {
-		log.WithError(err).Error("Unable to establish a session.")
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Unable to establish a session"))
 		return
 	}
 	defer session.Release()
 
-	desired, err := session.ReadDesiredState()
+	desired, err := session.ReadDesiredState(r.Context())
 	if err != nil {
 		log.WithError(err).Error("Unable to load the desired system state.")
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("Unable to load the desired system state"))
 		return
 	}
+	if err = desired.ReadImages(r.Context(), session); err != nil {
+		log.WithError(err).Warn("Unable to read desired images.")
+	}
 
 	if err = json.NewEncoder(w).Encode(&desired); err != nil {
 		log.WithError(err).Error("Unable to serialize JSON.")
@@ -82,13 +103,24 @@ func (s Server) handleCreateDesired(w http.ResponseWriter, r *http.Request) {
 		Ports     map[int]int             `json:"ports"`
 		Volumes   map[string]string       `json:"volumes"`
 		Schedule  string                  `json:"calendar"`
+		Hosts     []string                `json:"hosts"`
+		Selector  map[string]string       `json:"selector"`
+		App       string                  `json:"app"`
+
+		Ulimits    map[string]string `json:"ulimits"`
+		ShmSize    string            `json:"shm_size"`
+		Devices    []string          `json:"devices"`
+		ExtraHosts map[string]string `json:"extra_hosts"`
+		GPUs       string            `json:"gpus"`
+
+		// Enabled defaults to true.
+		Enabled *bool `json:"enabled"`
+
+		Protected bool `json:"protected"`
 	}
 
-	session, err := s.pool.Take()
+	session, err := s.takeSession(w, r)
 	if err != nil {
-		log.WithError(err).Error("Unable to establish a session.")
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Unable to establish a session"))
 		return
 	}
 	defer session.Release()
@@ -118,12 +150,27 @@ func (s Server) handleCreateDesired(w http.ResponseWriter, r *http.Request) {
 	}
 	tried(builder.Secrets(desiredReq.Secrets, *session))
 	tried(builder.Volumes(desiredReq.Volumes))
-	tried(builder.Env(desiredReq.Env))
+	tried(builder.Env(desiredReq.Env, *session))
 	tried(builder.Ports(desiredReq.Ports))
 	tried(builder.Schedule(desiredReq.Schedule))
+	tried(builder.Hosts(desiredReq.Hosts))
+	tried(builder.Selector(desiredReq.Selector))
+	tried(builder.App(desiredReq.App, *session))
+	tried(builder.Ulimits(desiredReq.Ulimits))
+	tried(builder.ShmSize(desiredReq.ShmSize))
+	tried(builder.Devices(desiredReq.Devices))
+	tried(builder.ExtraHosts(desiredReq.ExtraHosts))
+	tried(builder.GPUs(desiredReq.GPUs))
+	if desiredReq.Enabled != nil {
+		tried(builder.Enabled(*desiredReq.Enabled))
+	}
+	tried(builder.Protected(desiredReq.Protected))
 
 	desired, err := builder.Build()
 	tried(err)
+	if len(errs) == 0 {
+		tried(session.CheckConflicts(r.Context(), *desired))
+	}
 
 	if len(errs) > 0 {
 		var message strings.Builder
@@ -141,16 +188,18 @@ func (s Server) handleCreateDesired(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err = desired.MakeDesired(*session); err != nil {
+	if err = desired.MakeDesired(r.Context(), *session); err != nil {
 		log.WithError(err).Error("Unable to serialize desired unit.")
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("Unable to store desired unit in the database"))
 		return
 	}
+	s.emitFrom(r, events.UnitCreated, events.UnitData{ID: *desired.ID, Name: desired.UnitName()})
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", desired.ETag())
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(&desired)
+	json.NewEncoder(w).Encode(desired)
 }
 
 func (s Server) handleUpdateDesired(w http.ResponseWriter, r *http.Request, id int) {
@@ -168,18 +217,35 @@ func (s Server) handleUpdateDesired(w http.ResponseWriter, r *http.Request, id i
 		Ports     map[int]int            `json:"ports"`
 		Volumes   map[string]string      `json:"volumes"`
 		Schedule  string                 `json:"calendar,omitempty"`
+		Hosts     []string               `json:"hosts,omitempty"`
+		Selector  map[string]string      `json:"selector,omitempty"`
+		App       string                 `json:"app,omitempty"`
+
+		Ulimits    map[string]string `json:"ulimits,omitempty"`
+		ShmSize    string            `json:"shm_size,omitempty"`
+		Devices    []string          `json:"devices,omitempty"`
+		ExtraHosts map[string]string `json:"extra_hosts,omitempty"`
+		GPUs       string            `json:"gpus,omitempty"`
+
+		// Enabled and Protected are left unchanged if they're omitted.
+		Enabled   *bool `json:"enabled,omitempty"`
+		Protected *bool `json:"protected,omitempty"`
+
+		// Pinned freezes the container at the image it's running now, or unpins it. It's left unchanged if omitted.
+		Pinned *bool `json:"pinned,omitempty"`
+
+		// Version, if present, is the version of the unit that the change was made to. Like an If-Match header with
+		// the unit's ETag, it keeps the request from overwriting changes that were stored since.
+		Version *int `json:"version,omitempty"`
 	}
 
-	session, err := s.pool.Take()
+	session, err := s.takeSession(w, r)
 	if err != nil {
-		log.WithError(err).Error("Unable to establish a session.")
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Unable to establish a session"))
 		return
 	}
 	defer session.Release()
 
-	unit, err := session.ReadDesiredUnit(id)
+	unit, err := session.ReadDesiredUnit(r.Context(), id)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"err": err,
@@ -206,6 +272,42 @@ func (s Server) handleUpdateDesired(w http.ResponseWriter, r *http.Request, id i
 		return
 	}
 
+	stale := updateReq.Version != nil && *updateReq.Version != unit.Version
+	if ifMatch := r.Header.Get("If-Match"); len(ifMatch) > 0 && !etagMatches(ifMatch, unit.ETag()) {
+		stale = true
+	}
+	if stale {
+		writeCurrentUnit(w, unit, http.StatusConflict)
+		return
+	}
+
+	// Pins survive other changes to the container, and are only added or removed when requested.
+	pin := ""
+	if unit.Container != nil {
+		pin = unit.Container.PinnedImageID
+	}
+	if updateReq.Pinned != nil && !*updateReq.Pinned {
+		pin = ""
+	} else if updateReq.Pinned != nil && len(pin) == 0 {
+		if unit.Container == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Only units with a container may be pinned"))
+			return
+		}
+		pin, err = session.CurrentImageID(r.Context(), *unit.Container)
+		if err != nil {
+			log.WithError(err).WithField("id", id).Error("Unable to find the image to pin.")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Unable to find the image to pin"))
+			return
+		}
+		if len(pin) == 0 {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte("The unit has no image to pin yet. Sync it first."))
+			return
+		}
+	}
+
 	// Normalize and sanitize the request to modify the loaded unit.
 	builder := state.ModifyDesiredUnit(unit)
 	errs := make([]error, 0)
@@ -219,11 +321,29 @@ func (s Server) handleUpdateDesired(w http.ResponseWriter, r *http.Request, id i
 	tried(builder.Container(updateReq.Container.ImageName, updateReq.Container.ImageTag, updateReq.Container.Name))
 	tried(builder.Secrets(updateReq.Secrets, *session))
 	tried(builder.Volumes(updateReq.Volumes))
-	tried(builder.Env(updateReq.Env))
+	tried(builder.Env(updateReq.Env, *session))
 	tried(builder.Ports(updateReq.Ports))
 	tried(builder.Schedule(updateReq.Schedule))
+	tried(builder.Hosts(updateReq.Hosts))
+	tried(builder.Selector(updateReq.Selector))
+	tried(builder.App(updateReq.App, *session))
+	tried(builder.Ulimits(updateReq.Ulimits))
+	tried(builder.ShmSize(updateReq.ShmSize))
+	tried(builder.Devices(updateReq.Devices))
+	tried(builder.ExtraHosts(updateReq.ExtraHosts))
+	tried(builder.GPUs(updateReq.GPUs))
+	if updateReq.Enabled != nil {
+		tried(builder.Enabled(*updateReq.Enabled))
+	}
+	if updateReq.Protected != nil {
+		tried(builder.Protected(*updateReq.Protected))
+	}
+	tried(builder.Pin(pin))
 	_, err = builder.Build()
 	tried(err)
+	if len(errs) == 0 {
+		tried(session.CheckConflicts(r.Context(), *unit))
+	}
 
 	if len(errs) > 0 {
 		var message strings.Builder
@@ -241,32 +361,61 @@ func (s Server) handleUpdateDesired(w http.ResponseWriter, r *http.Request, id i
 		return
 	}
 
-	if err = unit.Update(*session); err != nil {
+	if err = unit.Update(r.Context(), *session); err == state.ErrVersionConflict {
+		s.writeVersionConflict(w, r, session, id)
+		return
+	} else if err != nil {
 		log.WithError(err).Error("Unable to serialize desired unit.")
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("Unable to store the updated unit in the database"))
 		return
 	}
+	s.emitFrom(r, events.UnitUpdated, events.UnitData{ID: id, Name: unit.UnitName()})
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", unit.ETag())
 	json.NewEncoder(w).Encode(unit)
 }
 
+// writeCurrentUnit responds with the server's copy of a unit and its ETag, so that a client whose change was refused
+// can reconcile its change with the stored one.
+func writeCurrentUnit(w http.ResponseWriter, current *state.DesiredSystemdUnit, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", current.ETag())
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(current)
+}
+
+// writeVersionConflict responds to an update that lost a race with another change to the same unit with a 409 and the
+// unit as it was stored by the other change.
+func (s Server) writeVersionConflict(w http.ResponseWriter, r *http.Request, session *state.SessionLease, id int) {
+	current, err := session.ReadDesiredUnit(r.Context(), id)
+	if err != nil || current == nil {
+		log.WithError(err).WithField("id", id).Error("Unable to reload a desired unit.")
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("The unit was changed by someone else. Reload it and try again."))
+		return
+	}
+	writeCurrentUnit(w, current, http.StatusConflict)
+}
+
 func (s Server) handleDeleteDesired(w http.ResponseWriter, r *http.Request, id int) {
-	session, err := s.pool.Take()
+	session, err := s.takeSession(w, r)
 	if err != nil {
-		log.WithError(err).Error("Unable to establish a session.")
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Unable to establish a session"))
 		return
 	}
 	defer session.Release()
 
-	if err := session.UndesireUnit(id); err != nil {
+	if err := session.UndesireUnit(r.Context(), id); err == state.ErrVersionConflict {
+		s.writeVersionConflict(w, r, session, id)
+		return
+	} else if err != nil {
 		log.WithError(err).Error("Unable to delete unit.")
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("Unable to delete unit"))
+		return
 	}
+	s.emitFrom(r, events.UnitDeleted, events.UnitData{ID: id})
 
 	w.WriteHeader(http.StatusCreated)
 }
@@ -0,0 +1,372 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/events"
+	"github.com/smashwilson/az-coordinator/state"
+)
+
+// desiredByNamePrefix begins the paths of desired units that are addressed by their unit name, like
+// /desired/by-name/az-web.service.
+const desiredByNamePrefix = "/desired/by-name/"
+
+func (s Server) handleDesiredByName(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, desiredByNamePrefix)
+	if len(name) == 0 || strings.Contains(name, "/") {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not found"))
+		return
+	}
+
+	s.methods(w, r, methodHandlerMap{
+		http.MethodGet:    func() { s.handleGetDesiredByName(w, r, name) },
+		http.MethodPut:    func() { s.handlePutDesiredByName(w, r, name) },
+		http.MethodDelete: func() { s.handleDeleteDesiredByName(w, r, name) },
+	})
+}
+
+// etagMatches returns true if an If-Match or If-None-Match header lists etag, or is "*". Weak tags match their
+// strong counterparts.
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPreconditions compares the If-Match and If-None-Match headers of r with the current unit, which is nil if it
+// doesn't exist. If they don't hold, it responds with a 412, along with the current unit and its ETag, and returns
+// false.
+func checkPreconditions(w http.ResponseWriter, r *http.Request, current *state.DesiredSystemdUnit) bool {
+	ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+
+	failed := false
+	if len(ifMatch) > 0 {
+		failed = current == nil || !etagMatches(ifMatch, current.ETag())
+	}
+	if len(ifNoneMatch) > 0 && current != nil && etagMatches(ifNoneMatch, current.ETag()) {
+		failed = true
+	}
+	if !failed {
+		return true
+	}
+
+	if current == nil {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		w.Write([]byte("Desired unit not found"))
+		return false
+	}
+	writeCurrentUnit(w, current, http.StatusPreconditionFailed)
+	return false
+}
+
+func (s Server) handleGetDesiredByName(w http.ResponseWriter, r *http.Request, name string) {
+	session, err := s.takeSession(w, r)
+	if err != nil {
+		return
+	}
+	defer session.Release()
+
+	unit, err := session.ReadDesiredUnitByPath(r.Context(), state.UnitDirectory()+name)
+	if err != nil {
+		log.WithError(err).WithField("unit", name).Error("Unable to load a desired unit.")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Something went wrong with the database"))
+		return
+	}
+	if unit == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Desired unit not found"))
+		return
+	}
+
+	etag := unit.ETag()
+	if noneMatch := r.Header.Get("If-None-Match"); len(noneMatch) > 0 && etagMatches(noneMatch, etag) {
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag)
+	json.NewEncoder(w).Encode(unit)
+}
+
+// handlePutDesiredByName creates the named unit, or replaces every setting of it if it exists, so that declarative
+// tools don't need to choose between creating and updating. The unit keeps its ID and its pin. Conditional requests
+// guard against concurrent changes: If-Match with the unit's ETag replaces only the version that the client read, and
+// If-None-Match: * only creates.
+func (s Server) handlePutDesiredByName(w http.ResponseWriter, r *http.Request, name string) {
+	type upsertRequestContainer struct {
+		Name      string `json:"name"`
+		ImageName string `json:"image_name"`
+		ImageTag  string `json:"image_tag"`
+	}
+
+	type upsertRequest struct {
+		Type      state.UnitType          `json:"type"`
+		Container *upsertRequestContainer `json:"container,omitempty"`
+		Secrets   []string                `json:"secrets"`
+		Env       map[string]string       `json:"env"`
+		Ports     map[int]int             `json:"ports"`
+		Volumes   map[string]string       `json:"volumes"`
+		Schedule  string                  `json:"calendar"`
+		Hosts     []string                `json:"hosts"`
+		Selector  map[string]string       `json:"selector"`
+		App       string                  `json:"app"`
+
+		Ulimits    map[string]string `json:"ulimits"`
+		ShmSize    string            `json:"shm_size"`
+		Devices    []string          `json:"devices"`
+		ExtraHosts map[string]string `json:"extra_hosts"`
+		GPUs       string            `json:"gpus"`
+
+		// Enabled defaults to true.
+		Enabled *bool `json:"enabled"`
+
+		Protected bool `json:"protected"`
+
+		// Pinned freezes the container at the image it's running now, or unpins it. The pin is left unchanged if
+		// it's omitted.
+		Pinned *bool `json:"pinned"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	var upsertReq upsertRequest
+	if err := decoder.Decode(&upsertReq); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Unable to parse request body as JSON: %v", err)
+		return
+	}
+
+	session, err := s.takeSession(w, r)
+	if err != nil {
+		return
+	}
+	defer session.Release()
+
+	s.desiredLock.Lock()
+	defer s.desiredLock.Unlock()
+
+	path := state.UnitDirectory() + name
+	current, err := session.ReadDesiredUnitByPath(r.Context(), path)
+	if err != nil {
+		log.WithError(err).WithField("unit", name).Error("Unable to load a desired unit.")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Something went wrong with the database"))
+		return
+	}
+	if !checkPreconditions(w, r, current) {
+		return
+	}
+
+	errs := make([]error, 0)
+	tried := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	var (
+		builder state.DesiredSystemdUnitBuilder
+		before  []byte
+		pin     string
+	)
+	if current != nil {
+		before, _ = json.Marshal(current)
+		if current.Container != nil {
+			pin = current.Container.PinnedImageID
+		}
+		builder = state.ModifyDesiredUnit(current)
+	} else {
+		if upsertReq.Pinned != nil && *upsertReq.Pinned {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("New units can't be pinned. Sync the unit, then pin it."))
+			return
+		}
+		builder = state.BuildDesiredUnit()
+		tried(builder.Path(path))
+	}
+
+	if upsertReq.Pinned != nil && !*upsertReq.Pinned {
+		pin = ""
+	} else if upsertReq.Pinned != nil && len(pin) == 0 {
+		if current.Container == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Only units with a container may be pinned"))
+			return
+		}
+		pin, err = session.CurrentImageID(r.Context(), *current.Container)
+		if err != nil {
+			log.WithError(err).WithField("unit", name).Error("Unable to find the image to pin.")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Unable to find the image to pin"))
+			return
+		}
+		if len(pin) == 0 {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte("The unit has no image to pin yet. Sync it first."))
+			return
+		}
+	}
+
+	tried(builder.Type(upsertReq.Type))
+	if upsertReq.Container != nil {
+		tried(builder.Container(upsertReq.Container.ImageName, upsertReq.Container.ImageTag, upsertReq.Container.Name))
+	} else {
+		tried(builder.Container("", "", ""))
+	}
+	tried(builder.Pin(pin))
+	tried(builder.Secrets(upsertReq.Secrets, *session))
+	tried(builder.Volumes(upsertReq.Volumes))
+	tried(builder.Env(upsertReq.Env, *session))
+	tried(builder.Ports(upsertReq.Ports))
+	tried(builder.Schedule(upsertReq.Schedule))
+	tried(builder.Hosts(upsertReq.Hosts))
+	tried(builder.Selector(upsertReq.Selector))
+	tried(builder.App(upsertReq.App, *session))
+	tried(builder.Ulimits(upsertReq.Ulimits))
+	tried(builder.ShmSize(upsertReq.ShmSize))
+	tried(builder.Devices(upsertReq.Devices))
+	tried(builder.ExtraHosts(upsertReq.ExtraHosts))
+	tried(builder.GPUs(upsertReq.GPUs))
+	enabled := true
+	if upsertReq.Enabled != nil {
+		enabled = *upsertReq.Enabled
+	}
+	tried(builder.Enabled(enabled))
+	tried(builder.Protected(upsertReq.Protected))
+
+	unit, err := builder.Build()
+	tried(err)
+	if len(errs) == 0 {
+		tried(session.CheckConflicts(r.Context(), *unit))
+	}
+
+	if len(errs) > 0 {
+		var message strings.Builder
+		message.WriteString("Invalid desired unit:\n")
+		for i, err := range errs {
+			log.WithError(err).Warn("Invalid desired unit.")
+			message.WriteString(err.Error())
+			if i != len(errs)-1 {
+				message.WriteString("\n")
+			}
+		}
+
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(message.String()))
+		return
+	}
+
+	status, changed := http.StatusOK, false
+	switch {
+	case current == nil:
+		if err = unit.MakeDesired(r.Context(), *session); err != nil {
+			log.WithError(err).Error("Unable to serialize desired unit.")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Unable to store desired unit in the database"))
+			return
+		}
+		status = http.StatusCreated
+	default:
+		if after, _ := json.Marshal(unit); string(after) == string(before) {
+			break
+		}
+		if err = unit.Update(r.Context(), *session); err == state.ErrVersionConflict {
+			// Another request, perhaps to another coordinator, changed the unit after it was read.
+			conflict := http.StatusConflict
+			if len(r.Header.Get("If-Match")) > 0 {
+				conflict = http.StatusPreconditionFailed
+			}
+			stored, err := session.ReadDesiredUnitByPath(r.Context(), path)
+			if err != nil || stored == nil {
+				w.WriteHeader(conflict)
+				w.Write([]byte("The unit was changed by someone else. Reload it and try again."))
+				return
+			}
+			writeCurrentUnit(w, stored, conflict)
+			return
+		} else if err != nil {
+			log.WithError(err).Error("Unable to serialize desired unit.")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Unable to store the updated unit in the database"))
+			return
+		}
+		changed = true
+	}
+
+	// Read the unit back, so that the response includes whether the unit is held by a frozen app.
+	stored, err := session.ReadDesiredUnitByPath(r.Context(), path)
+	if err != nil || stored == nil {
+		log.WithError(err).WithField("unit", name).Error("Unable to reload a desired unit.")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Something went wrong with the database"))
+		return
+	}
+
+	switch {
+	case status == http.StatusCreated:
+		s.emitFrom(r, events.UnitCreated, events.UnitData{ID: *stored.ID, Name: stored.UnitName()})
+		w.Header().Set("Location", desiredByNamePrefix+name)
+	case changed:
+		s.emitFrom(r, events.UnitUpdated, events.UnitData{ID: *stored.ID, Name: stored.UnitName()})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", stored.ETag())
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(stored)
+}
+
+// handleDeleteDesiredByName removes the named unit. With If-Match, it's only removed if it hasn't changed since the
+// client read it.
+func (s Server) handleDeleteDesiredByName(w http.ResponseWriter, r *http.Request, name string) {
+	session, err := s.takeSession(w, r)
+	if err != nil {
+		return
+	}
+	defer session.Release()
+
+	s.desiredLock.Lock()
+	defer s.desiredLock.Unlock()
+
+	current, err := session.ReadDesiredUnitByPath(r.Context(), state.UnitDirectory()+name)
+	if err != nil {
+		log.WithError(err).WithField("unit", name).Error("Unable to load a desired unit.")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Something went wrong with the database"))
+		return
+	}
+	if current == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Desired unit not found"))
+		return
+	}
+	if !checkPreconditions(w, r, current) {
+		return
+	}
+
+	if err := session.UndesireUnit(r.Context(), *current.ID); err == state.ErrVersionConflict {
+		s.writeVersionConflict(w, r, session, *current.ID)
+		return
+	} else if err != nil {
+		log.WithError(err).Error("Unable to delete unit.")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Unable to delete unit"))
+		return
+	}
+	s.emitFrom(r, events.UnitDeleted, events.UnitData{ID: *current.ID, Name: name})
+
+	w.WriteHeader(http.StatusNoContent)
+}
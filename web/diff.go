@@ -3,8 +3,6 @@ package web
 import (
 	"encoding/json"
 	"net/http"
-
-	log "github.com/sirupsen/logrus"
 )
 
 func (s Server) handleDiffRoot(w http.ResponseWriter, r *http.Request) {
@@ -14,39 +12,37 @@ func (s Server) handleDiffRoot(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s Server) handleGetDiff(w http.ResponseWriter, r *http.Request) {
-	session, err := s.pool.Take()
+	session, err := s.takeSession(w, r)
 	if err != nil {
-		log.WithError(err).Error("Unable to establish a session.")
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Unable to establish a session."))
 		return
 	}
 	defer session.Release()
 
-	actual, err := session.ReadActualState()
-	if err != nil {
-		session.Log.WithError(err).Error("Unable to load the actual system state.")
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Unable to load the actual system state."))
-		return
-	}
-
-	desired, err := session.ReadDesiredState()
+	desired, err := session.ReadDesiredState(r.Context())
 	if err != nil {
 		session.Log.WithError(err).Error("Unable to load the desired system state.")
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("Unable to load the desired system state."))
 		return
 	}
+	scoped := desired.ForHost(s.opts().Fleet.Host(), s.opts().Fleet.Labels)
+	desired = &scoped
 
-	if err = desired.ReadImages(session); err != nil {
+	if err = desired.ReadImages(r.Context(), session); err != nil {
 		session.Log.WithError(err).Error("Unable to read current container images.")
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("Unable to read desired container images."))
 		return
 	}
 
-	if errs := actual.ReadImages(session, *desired); len(errs) > 0 {
+	actual, errs, err := s.actualCache.Read(r.Context(), session, *desired)
+	if err != nil {
+		session.Log.WithError(err).Error("Unable to load the actual system state.")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Unable to load the actual system state."))
+		return
+	}
+	if len(errs) > 0 {
 		for _, err := range errs {
 			session.Log.WithError(err).Warn("Unable to read actual image.")
 		}
@@ -55,7 +51,7 @@ func (s Server) handleGetDiff(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	delta := session.Between(desired, actual)
+	delta := session.Between(r.Context(), desired, actual)
 	if err = json.NewEncoder(w).Encode(&delta); err != nil {
 		session.Log.WithError(err).Error("Unable to serialize JSON.")
 		w.WriteHeader(http.StatusInternalServerError)
@@ -0,0 +1,111 @@
+package web
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/events"
+	"github.com/smashwilson/az-coordinator/notify"
+	"github.com/smashwilson/az-coordinator/state"
+)
+
+// dockerSessionBackoff is the delay before another session is created for the Docker event watcher after one can't be.
+const dockerSessionBackoff = 30 * time.Second
+
+// watchDockerEvents reacts to the container and image events reported by the Docker daemon for as long as the server
+// runs. It uses a session of its own, outside of the pool, so that it doesn't hold one of the pool's sessions forever.
+func (s *Server) watchDockerEvents() {
+	session, err := s.newSession()
+	for err != nil {
+		log.WithError(err).Warn("Unable to create a session to watch Docker events.")
+		time.Sleep(dockerSessionBackoff)
+		session, err = s.newSession()
+	}
+
+	lease := session.Lease()
+	defer lease.Release()
+	lease.WatchDockerEvents(context.Background(), s.handleDockerEvent)
+}
+
+func (s *Server) handleDockerEvent(e state.DockerEvent) {
+	log.WithFields(log.Fields{
+		"type":   e.Type,
+		"action": e.Action,
+		"id":     e.ID,
+	}).Trace("Docker event.")
+	s.actualCache.Invalidate()
+
+	if e.Type == "container" && e.Action == "die" {
+		go s.handleContainerDied(e)
+	}
+}
+
+// handleContainerDied reports a managed container that stopped while no sync was running and the host wasn't drained,
+// and restores it with a sync of its unit if restore_dead_containers is set. Containers that exit cleanly, like those
+// of scheduled jobs, are expected to stop.
+func (s *Server) handleContainerDied(e state.DockerEvent) {
+	name, exitCode := e.Attributes["name"], e.Attributes["exitCode"]
+	if exitCode == "0" || s.currentSync.running() || s.isDrained() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts().Timeouts.Request())
+	defer cancel()
+
+	session, err := s.pool.TakeContext(ctx)
+	if err != nil {
+		log.WithError(err).Warn("Unable to establish session.")
+		return
+	}
+	defer session.Release()
+
+	desired, err := session.ReadDesiredState(ctx)
+	if err != nil {
+		log.WithError(err).Warn("Unable to load the desired system state.")
+		return
+	}
+	scoped := desired.ForHost(s.opts().Fleet.Host(), s.opts().Fleet.Labels)
+	unit := scoped.UnitForContainer(name)
+	if unit == nil {
+		return
+	}
+
+	death := state.ContainerDeath{
+		Unit:      unit.UnitName(),
+		Container: name,
+		ExitCode:  exitCode,
+		OOM:       session.ContainerOOMKilled(ctx, e.ID),
+	}
+	log.WithFields(log.Fields{
+		"unit":      death.Unit,
+		"container": death.Container,
+		"exitCode":  death.ExitCode,
+		"oom":       death.OOM,
+	}).Warn("Managed container died unexpectedly.")
+
+	if s.opts().RestoreDeadContainers && s.isLeader() && unit.ID != nil && !unit.Held && s.syncRefused() == nil {
+		trigger := state.SyncTrigger{Source: state.TriggerDocker, Reason: "restore " + death.Unit}
+		if s.currentSync.request(trigger) {
+			id := *unit.ID
+			death.Restoring = true
+			s.startScopedSync(trigger, func(settings *state.SyncSettings) {
+				settings.Unit = &id
+				settings.Restart = []string{death.Unit}
+			})
+		}
+	}
+
+	s.emit(events.ContainerDied, "", death)
+	notify.ReportContainerDeath(*s.opts(), death)
+}
+
+// invalidateActualOnEvents discards the cached actual state whenever a sync finishes or desired state changes.
+func (s *Server) invalidateActualOnEvents() {
+	sub := s.bus.Subscribe(eventStreamBuffer,
+		events.SyncFinished, events.UnitCreated, events.UnitUpdated, events.UnitDeleted, events.SecretChanged,
+	)
+	for range sub.C {
+		s.actualCache.Invalidate()
+	}
+}
@@ -0,0 +1,96 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// errDrained is reported by syncs requested while this host is drained.
+var errDrained = errors.New("this host is drained; undrain it before syncing")
+
+type drainResponse struct {
+	Drained bool     `json:"drained"`
+	Units   []string `json:"units"`
+	Errors  []string `json:"errors"`
+}
+
+// isDrained returns true if this host's units have been stopped by POST /drain.
+func (s *Server) isDrained() bool {
+	return atomic.LoadInt32(s.drained) == 1
+}
+
+func (s *Server) handleDrainRoot(w http.ResponseWriter, r *http.Request) {
+	s.methods(w, r, methodHandlerMap{
+		http.MethodGet:  func() { s.writeDrain(w, drainResponse{Drained: s.isDrained()}) },
+		http.MethodPost: func() { s.handleDrain(w, r, true) },
+	})
+}
+
+func (s *Server) handleUndrainRoot(w http.ResponseWriter, r *http.Request) {
+	s.methods(w, r, methodHandlerMap{
+		http.MethodPost: func() { s.handleDrain(w, r, false) },
+	})
+}
+
+// handleDrain stops or starts this host's units. Syncs are refused while the host is drained, so that they don't
+// bring units back early.
+func (s *Server) handleDrain(w http.ResponseWriter, r *http.Request, drain bool) {
+	session, err := s.takeSession(w, r)
+	if err != nil {
+		return
+	}
+	defer session.Release()
+
+	opts := s.opts().Drain
+
+	// Each stage is bounded by the drain timeout rather than by the request's.
+	var (
+		units []string
+		errs  []error
+	)
+	if drain {
+		atomic.StoreInt32(s.drained, 1)
+		requestLog(r).Info("Draining units.")
+		units, errs = session.Drain(context.Background(), opts.Order, opts.StopTimeout())
+	} else {
+		requestLog(r).Info("Undraining units.")
+		units, errs = session.Undrain(context.Background(), opts.Order, opts.StopTimeout())
+		atomic.StoreInt32(s.drained, 0)
+	}
+
+	resp := drainResponse{Drained: drain, Units: units, Errors: make([]string, 0, len(errs))}
+	for _, err := range errs {
+		requestLog(r).WithError(err).Warn("Drain error.")
+		resp.Errors = append(resp.Errors, err.Error())
+	}
+	if len(errs) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(&resp)
+		return
+	}
+
+	s.writeDrain(w, resp)
+}
+
+func (s *Server) writeDrain(w http.ResponseWriter, resp drainResponse) {
+	if resp.Units == nil {
+		resp.Units = make([]string, 0)
+	}
+	if resp.Errors == nil {
+		resp.Errors = make([]string, 0)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		log.WithError(err).Error("Unable to serialize JSON.")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Unable to serialize JSON"))
+		return
+	}
+}
@@ -0,0 +1,36 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+func (s Server) handleDriftRoot(w http.ResponseWriter, r *http.Request) {
+	s.methods(w, r, methodHandlerMap{
+		http.MethodGet: func() { s.handleGetDrift(w, r) },
+	})
+}
+
+// handleGetDrift audits the host against its desired state without pulling images or applying anything.
+func (s Server) handleGetDrift(w http.ResponseWriter, r *http.Request) {
+	session, err := s.takeSession(w, r)
+	if err != nil {
+		return
+	}
+	defer session.Release()
+
+	report, err := session.DetectDrift(r.Context(), s.opts().Fleet.Host(), s.opts().Fleet.Labels)
+	if err != nil {
+		session.Log.WithError(err).Error("Unable to detect drift.")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Unable to detect drift."))
+		return
+	}
+
+	if err = json.NewEncoder(w).Encode(report); err != nil {
+		session.Log.WithError(err).Error("Unable to serialize JSON.")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Unable to serialize JSON"))
+		return
+	}
+}
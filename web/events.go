@@ -0,0 +1,137 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/events"
+	"github.com/smashwilson/az-coordinator/state"
+)
+
+const (
+	// eventStreamBuffer is the number of events that may wait to be written to each GET /events stream.
+	eventStreamBuffer = 50
+
+	// eventKeepAlive is the interval between the comments written to idle event streams, so that proxies don't close
+	// them.
+	eventKeepAlive = 30 * time.Second
+)
+
+func (s *Server) handleEventsRoot(w http.ResponseWriter, r *http.Request) {
+	s.methods(w, r, methodHandlerMap{
+		http.MethodGet: func() { s.handleStreamEvents(w, r) },
+	})
+}
+
+// handleStreamEvents streams the events published on the server's bus as server-sent events until the client
+// disconnects. The "types" query parameter, like "?types=sync.started,sync.finished", limits the types that are sent.
+func (s *Server) handleStreamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Streaming is not supported"))
+		return
+	}
+
+	types := make([]events.Type, 0)
+	for _, t := range strings.Split(r.URL.Query().Get("types"), ",") {
+		if t = strings.TrimSpace(t); len(t) > 0 {
+			types = append(types, events.Type(t))
+		}
+	}
+
+	sub := s.bus.Subscribe(eventStreamBuffer, types...)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := w.Write([]byte(": keep-alive\n\n")); err != nil {
+				return
+			}
+		case event, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			encoded, err := json.Marshal(event)
+			if err != nil {
+				log.WithError(err).WithField("eventType", event.Type).Error("Unable to serialize event.")
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, encoded); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// eventWebhooks returns the webhooks in the current options.
+func (s *Server) eventWebhooks() []events.Webhook {
+	configured := s.opts().EventWebhooks
+	webhooks := make([]events.Webhook, 0, len(configured))
+	for _, w := range configured {
+		webhooks = append(webhooks, events.Webhook{URL: w.URL, Secret: w.Secret, Types: w.Events})
+	}
+	return webhooks
+}
+
+// emit publishes an event to the subscribers of the server's bus, including the webhook emitter.
+func (s Server) emit(t events.Type, actor string, data interface{}) {
+	s.bus.Publish(events.New(t, actor, data))
+}
+
+// emitFrom publishes an event caused by an API request.
+func (s Server) emitFrom(r *http.Request, t events.Type, data interface{}) {
+	s.emit(t, requestTrigger(r).Actor, data)
+}
+
+// emitSyncFinished publishes the outcome of a sync, followed by an event for each health
+// threshold that the sync found crossed.
+func (s *Server) emitSyncFinished(id int, trigger state.SyncTrigger, delta *state.Delta, errs []error, pending bool) {
+	data := events.SyncFinishedData{
+		SyncData:        events.SyncData{ID: id, Trigger: trigger},
+		PendingApproval: pending,
+	}
+	for _, err := range errs {
+		if err != state.ErrApprovalRequired {
+			data.Errors = append(data.Errors, err.Error())
+		}
+	}
+	if delta != nil && !pending {
+		data.Added, data.Restarted, data.Removed = delta.UnitNames()
+		data.ApplyMillis = delta.ApplyMillis
+	}
+	s.emit(events.SyncFinished, trigger.Actor, data)
+
+	if delta == nil || pending {
+		return
+	}
+	for _, h := range delta.Health {
+		if !h.Healthy {
+			s.emit(events.HealthThreshold, trigger.Actor, events.HealthData{Unit: h.Unit, ActiveState: h.ActiveState})
+		}
+	}
+	if delta.Prune != nil {
+		s.emit(events.HealthThreshold, trigger.Actor, events.HealthData{
+			DiskUsagePercent: delta.Prune.DiskUsagePercent,
+			ThresholdPercent: s.opts().PruneThreshold(),
+			Reclaimed:        delta.Prune.Reclaimed,
+		})
+	}
+}
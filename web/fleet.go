@@ -0,0 +1,139 @@
+package web
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/config"
+	"github.com/smashwilson/az-coordinator/fleet"
+)
+
+// agentAuth authenticates a request from a fleet agent, which presents its host name and the token registered for
+// that host with basic auth. It writes an error response and returns false if the request is not from a registered
+// agent.
+func (s Server) agentAuth(w http.ResponseWriter, r *http.Request) (string, config.AgentRegistration, bool) {
+	host, token, ok := r.BasicAuth()
+	agent, registered := s.opts().Fleet.Agents[host]
+	if !ok || !registered || len(agent.Token) == 0 || subtle.ConstantTimeCompare([]byte(token), []byte(agent.Token)) != 1 {
+		s.unauthorized(w, r, clientAddress(r))
+		return "", agent, false
+	}
+	return host, agent, true
+}
+
+// noteFleetSync records that a sync was started, so that every agent also syncs at its next poll.
+func (s Server) noteFleetSync() {
+	atomic.StoreInt64(s.fleetSyncRequested, time.Now().Unix())
+}
+
+func (s *Server) handleAgentAssignmentRoot(w http.ResponseWriter, r *http.Request) {
+	s.methods(w, r, methodHandlerMap{
+		http.MethodGet: func() { s.handleGetAgentAssignment(w, r) },
+	})
+}
+
+func (s *Server) handleGetAgentAssignment(w http.ResponseWriter, r *http.Request) {
+	host, agent, ok := s.agentAuth(w, r)
+	if !ok {
+		return
+	}
+
+	session, err := s.takeSession(w, r)
+	if err != nil {
+		return
+	}
+	defer session.Release()
+
+	desired, err := session.ReadDesiredState(r.Context())
+	if err != nil {
+		session.Log.WithError(err).Error("Unable to load the desired system state.")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Unable to load the desired system state."))
+		return
+	}
+
+	bag, err := session.GetSecrets()
+	if err != nil {
+		session.Log.WithError(err).Error("Unable to load secrets.")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Unable to load secrets."))
+		return
+	}
+
+	assignment := fleet.NewAssignment(host, agent.Labels, *desired, bag, atomic.LoadInt64(s.fleetSyncRequested))
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(&assignment); err != nil {
+		session.Log.WithError(err).Error("Unable to serialize JSON.")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Unable to serialize JSON"))
+		return
+	}
+}
+
+func (s *Server) handleAgentReportRoot(w http.ResponseWriter, r *http.Request) {
+	s.methods(w, r, methodHandlerMap{
+		http.MethodPost: func() { s.handleCreateAgentReport(w, r) },
+	})
+}
+
+func (s *Server) handleCreateAgentReport(w http.ResponseWriter, r *http.Request) {
+	host, _, ok := s.agentAuth(w, r)
+	if !ok {
+		return
+	}
+
+	var report fleet.Report
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Unable to parse request body as JSON: %v", err)
+		return
+	}
+	if report.Host != host {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "Agent %s may not report for host %s", host, report.Host)
+		return
+	}
+
+	if err := fleet.SaveReport(r.Context(), s.db, report); err != nil {
+		requestLog(r).WithError(err).Error("Unable to save agent report.")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Unable to save agent report."))
+		return
+	}
+
+	requestLog(r).WithFields(log.Fields{
+		"host":   host,
+		"errors": len(report.Errors),
+	}).Info("Agent reported.")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleAgentsRoot(w http.ResponseWriter, r *http.Request) {
+	s.methods(w, r, methodHandlerMap{
+		http.MethodGet: func() { s.handleListAgents(w, r) },
+	})
+}
+
+func (s *Server) handleListAgents(w http.ResponseWriter, r *http.Request) {
+	reports, err := fleet.LoadReports(r.Context(), s.db)
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to load agent reports.")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Unable to load agent reports."))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(reports); err != nil {
+		requestLog(r).WithError(err).Error("Unable to serialize JSON.")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Unable to serialize JSON"))
+		return
+	}
+}
@@ -0,0 +1,93 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type freezeResponse struct {
+	Frozen bool  `json:"frozen"`
+	Until  int64 `json:"until,omitempty"`
+}
+
+// frozenUntil returns the time at which the current deploy freeze ends, or the zero time if there isn't one.
+func (s *Server) frozenUntil() time.Time {
+	until := atomic.LoadInt64(s.frozen)
+	if until == 0 || time.Now().Unix() >= until {
+		return time.Time{}
+	}
+	return time.Unix(until, 0)
+}
+
+// freeze refuses syncs for the given duration. It replaces any freeze that's already in effect.
+func (s *Server) freeze(d time.Duration) time.Time {
+	until := time.Now().Add(d)
+	atomic.StoreInt64(s.frozen, until.Unix())
+	return until
+}
+
+// unfreeze ends the current deploy freeze.
+func (s *Server) unfreeze() {
+	atomic.StoreInt64(s.frozen, 0)
+}
+
+// syncRefused explains why a sync can't start now, because this host is drained or deploys are frozen. It returns nil
+// if syncs may start.
+func (s *Server) syncRefused() error {
+	if s.isDrained() {
+		return errDrained
+	}
+	if until := s.frozenUntil(); !until.IsZero() {
+		return fmt.Errorf("deploys are frozen until %s; unfreeze them before syncing", until.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (s *Server) handleFreezeRoot(w http.ResponseWriter, r *http.Request) {
+	s.methods(w, r, methodHandlerMap{
+		http.MethodGet:    func() { s.writeFreeze(w) },
+		http.MethodPost:   func() { s.handleFreeze(w, r) },
+		http.MethodDelete: func() { s.handleUnfreeze(w, r) },
+	})
+}
+
+// handleFreeze refuses syncs for the duration given by the "duration" query parameter, like "2h".
+func (s *Server) handleFreeze(w http.ResponseWriter, r *http.Request) {
+	d, err := time.ParseDuration(r.URL.Query().Get("duration"))
+	if err != nil || d <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("A positive duration, like ?duration=2h, is required"))
+		return
+	}
+
+	until := s.freeze(d)
+	requestLog(r).WithField("until", until).Info("Deploys frozen.")
+	s.writeFreeze(w)
+}
+
+func (s *Server) handleUnfreeze(w http.ResponseWriter, r *http.Request) {
+	s.unfreeze()
+	requestLog(r).Info("Deploys unfrozen.")
+	s.writeFreeze(w)
+}
+
+func (s *Server) writeFreeze(w http.ResponseWriter) {
+	resp := freezeResponse{}
+	if until := s.frozenUntil(); !until.IsZero() {
+		resp.Frozen = true
+		resp.Until = until.Unix()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		log.WithError(err).Error("Unable to serialize JSON.")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Unable to serialize JSON"))
+		return
+	}
+}
@@ -1,15 +1,35 @@
 package web
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/state"
+)
+
+const (
+	// dependencyProbeTimeout limits how long GET /health waits for each dependency to answer.
+	dependencyProbeTimeout = 5 * time.Second
+
+	// unitRestartWindow is the period over which GET /health counts each unit's restarts.
+	unitRestartWindow = 24 * time.Hour
 )
 
 type healthReport struct {
-	DiskUsagePercent int `json:"diskUsagePercent"`
+	Healthy          bool                     `json:"healthy"`
+	DiskUsagePercent int                      `json:"diskUsagePercent"`
+	Disks            []state.DiskUsage        `json:"disks"`
+	Leader           bool                     `json:"leader"`
+	LastPrune        *state.PruneResult       `json:"lastPrune,omitempty"`
+	Dependencies     []state.DependencyStatus `json:"dependencies,omitempty"`
+	Host             state.HostMetrics        `json:"host"`
+	UnitRestarts     map[string]int           `json:"unit_restarts"`
+	Alerts           []state.Alert            `json:"alerts"`
+	Backup           *backupStatus            `json:"backup,omitempty"`
 }
 
 func (s *Server) handleHealthRoot(w http.ResponseWriter, r *http.Request) {
@@ -19,25 +39,51 @@ func (s *Server) handleHealthRoot(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// handleGetHealth reports disk usage and probes each of the coordinator's dependencies. It responds with 503 Service
+// Unavailable if a critical dependency didn't answer, so that it can back load balancer health checks. Probes are
+// skipped with ?dependencies=false.
 func (s *Server) handleGetHealth(w http.ResponseWriter, r *http.Request) {
-	session, err := s.pool.Take()
+	session, err := s.takeSession(w, r)
 	if err != nil {
-		log.WithError(err).Error("Unable to establish a session.")
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Unable to establish a session."))
 		return
 	}
 	defer session.Release()
 
-	diskUsage, err := session.ReadDiskUsage()
+	diskUsage, err := session.ReadDiskUsage(r.Context())
 	if err != nil {
 		session.Log.WithError(err).Warn("Unable to read disk usage")
 	}
 
 	report := healthReport{
+		Healthy:          true,
 		DiskUsagePercent: diskUsage,
+		Disks:            session.ReadWatchedDiskUsage(r.Context()),
+		Leader:           s.isLeader(),
+		LastPrune:        s.currentSync.getPrune(),
+		Alerts:           s.alerts.active(),
+		Backup:           s.backupHealth(r.Context(), session),
 	}
+	host, errs := state.ReadHostMetrics()
+	for _, err := range errs {
+		session.Log.WithError(err).Warn("Unable to read host metrics.")
+	}
+	report.Host = host
 
+	report.UnitRestarts, err = state.ReadUnitRestarts(r.Context(), unitRestartWindow)
+	if err != nil {
+		session.Log.WithError(err).Warn("Unable to count unit restarts.")
+		report.UnitRestarts = make(map[string]int)
+	}
+
+	if probe, err := strconv.ParseBool(r.URL.Query().Get("dependencies")); err != nil || probe {
+		report.Dependencies = session.ProbeDependencies(r.Context(), dependencyProbeTimeout)
+		report.Healthy = state.DependenciesHealthy(report.Dependencies)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !report.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
 	if err = json.NewEncoder(w).Encode(&report); err != nil {
 		session.Log.WithError(err).Error("Unable to serialize JSON.")
 		w.WriteHeader(http.StatusInternalServerError)
@@ -51,15 +97,6 @@ type healthRequest struct {
 }
 
 func (s *Server) handlePostHealth(w http.ResponseWriter, r *http.Request) {
-	session, err := s.pool.Take()
-	if err != nil {
-		log.WithError(err).Error("Unable to establish session.")
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Unable to establish session."))
-		return
-	}
-	defer session.Release()
-
 	var req healthRequest
 	decoder := json.NewDecoder(r.Body)
 	if err := decoder.Decode(&req); err != nil {
@@ -70,8 +107,11 @@ func (s *Server) handlePostHealth(w http.ResponseWriter, r *http.Request) {
 
 	switch req.Action {
 	case "prune":
-		session.Prune()
-		w.Write([]byte("ok"))
+		job := s.startJob(state.JobPrune, requestTrigger(r), s.pruneWork)
+
+		writeJobLocation(w, job)
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("Prune started."))
 		return
 	case "":
 		w.WriteHeader(http.StatusBadRequest)
@@ -83,3 +123,20 @@ func (s *Server) handlePostHealth(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// pruneWork removes unused images and containers as a job. The job's result is the PruneResult.
+func (s *Server) pruneWork(ctx context.Context) (interface{}, error) {
+	session, err := s.pool.TakeContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Release()
+
+	result, err := session.Prune(ctx, s.prunePolicy())
+	if err != nil {
+		session.Log.WithError(err).Error("Unable to prune.")
+		return nil, err
+	}
+	s.currentSync.setPrune(result)
+	return result, nil
+}
@@ -0,0 +1,34 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// handleUnitHistory lists every recorded change to a unit, most recent first. The history of a removed unit remains
+// available by its ID.
+func (s Server) handleUnitHistory(w http.ResponseWriter, r *http.Request, id int) {
+	session, err := s.takeSession(w, r)
+	if err != nil {
+		return
+	}
+	defer session.Release()
+
+	revisions, err := session.ReadUnitHistory(r.Context(), id)
+	if err != nil {
+		log.WithError(err).WithField("unitID", id).Error("Unable to load unit history.")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Unable to load unit history"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(revisions); err != nil {
+		log.WithError(err).Error("Unable to serialize JSON.")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Unable to serialize JSON"))
+		return
+	}
+}
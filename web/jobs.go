@@ -0,0 +1,308 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/state"
+)
+
+// jobListLimit is the number of jobs listed by GET /jobs.
+const jobListLimit = 50
+
+// jobWork performs the operation of a job, returning the result to record with it.
+type jobWork func(ctx context.Context) (interface{}, error)
+
+// runningJob is a job that's been recorded, but whose work hasn't finished. Jobs that couldn't be recorded have an ID
+// of 0; their work is still done, but they can't be looked up, or canceled by ID.
+type runningJob struct {
+	id     int
+	kind   string
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// jobRunner tracks the jobs that are running in this process, so that they can be canceled.
+type jobRunner struct {
+	lock    sync.Mutex
+	running map[*runningJob]bool
+}
+
+func newJobRunner() *jobRunner {
+	return &jobRunner{running: make(map[*runningJob]bool)}
+}
+
+func (j *jobRunner) add(job *runningJob) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.running[job] = true
+}
+
+func (j *jobRunner) remove(job *runningJob) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	delete(j.running, job)
+}
+
+// cancel cancels the job with the given ID, returning false if it isn't running in this process.
+func (j *jobRunner) cancel(id int) bool {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	for job := range j.running {
+		if job.id == id && id != 0 {
+			job.cancel()
+			return true
+		}
+	}
+	return false
+}
+
+// cancelKinds cancels every running job of the given kinds, returning the number that were canceled.
+func (j *jobRunner) cancelKinds(kinds ...string) int {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	count := 0
+	for job := range j.running {
+		for _, kind := range kinds {
+			if job.kind == kind {
+				job.cancel()
+				count++
+				break
+			}
+		}
+	}
+	return count
+}
+
+// newJob records a job of kind that trigger started.
+func (s *Server) newJob(kind string, trigger state.SyncTrigger) *runningJob {
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &runningJob{kind: kind, ctx: ctx, cancel: cancel}
+
+	// The job is tracked once its ID is known, even if it couldn't be recorded.
+	defer s.jobs.add(job)
+
+	session, err := s.pool.Take()
+	if err != nil {
+		log.WithError(err).WithField("kind", kind).Warn("Unable to record job.")
+		return job
+	}
+	defer session.Release()
+
+	recorded, err := session.CreateJob(ctx, kind, s.opts().Fleet.Host(), trigger)
+	if err != nil {
+		log.WithError(err).WithField("kind", kind).Warn("Unable to record job.")
+		return job
+	}
+	job.id = recorded.ID
+	return job
+}
+
+// runJob performs the work of a job, then records its outcome.
+func (s *Server) runJob(job *runningJob, work jobWork) {
+	result, err := work(job.ctx)
+	canceled := job.ctx.Err() == context.Canceled
+	s.jobs.remove(job)
+	job.cancel()
+
+	status := state.JobSucceeded
+	if canceled {
+		status = state.JobCanceled
+	} else if err != nil {
+		status = state.JobFailed
+	}
+	if job.id == 0 {
+		return
+	}
+
+	session, takeErr := s.pool.Take()
+	if takeErr != nil {
+		log.WithError(takeErr).WithField("job", job.id).Warn("Unable to record job outcome.")
+		return
+	}
+	defer session.Release()
+
+	if finishErr := session.FinishJob(context.Background(), job.id, status, result, err); finishErr != nil {
+		log.WithError(finishErr).WithField("job", job.id).Warn("Unable to record job outcome.")
+	}
+}
+
+// startJob records a job of kind that trigger started, then performs its work in the background.
+func (s *Server) startJob(kind string, trigger state.SyncTrigger, work jobWork) *runningJob {
+	job := s.newJob(kind, trigger)
+	go s.runJob(job, work)
+	return job
+}
+
+// interruptJobs marks the jobs left running by an earlier coordinator process on this host as interrupted.
+func (s *Server) interruptJobs() {
+	session, err := s.pool.Take()
+	if err != nil {
+		log.WithError(err).Warn("Unable to mark interrupted jobs.")
+		return
+	}
+	defer session.Release()
+
+	if err := session.InterruptJobs(context.Background(), s.opts().Fleet.Host()); err != nil {
+		log.WithError(err).Warn("Unable to mark interrupted jobs.")
+	}
+}
+
+// jobError combines the errors of an operation into the error recorded with its job.
+func jobError(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	messages := make([]string, 0, len(errs))
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	return errors.New(strings.Join(messages, "; "))
+}
+
+// writeJobLocation points the response at the job's status, if the job was recorded.
+func writeJobLocation(w http.ResponseWriter, job *runningJob) {
+	if job.id != 0 {
+		w.Header().Set("Location", fmt.Sprintf("/jobs/%d", job.id))
+	}
+}
+
+func (s *Server) handleJobsRoot(w http.ResponseWriter, r *http.Request) {
+	s.methods(w, r, methodHandlerMap{
+		http.MethodGet: func() { s.handleListJobs(w, r) },
+	})
+}
+
+var jobRx = regexp.MustCompile(`^/jobs/(\d+)(/cancel)?$`)
+
+func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
+	ms := jobRx.FindStringSubmatch(r.URL.Path)
+	if len(ms) != 3 {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not found"))
+		return
+	}
+
+	id, err := strconv.Atoi(ms[1])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid job ID"))
+		return
+	}
+
+	if len(ms[2]) > 0 {
+		s.methods(w, r, methodHandlerMap{
+			http.MethodPost: func() { s.handleCancelJob(w, r, id) },
+		})
+		return
+	}
+
+	s.methods(w, r, methodHandlerMap{
+		http.MethodGet:    func() { s.handleGetJob(w, r, id) },
+		http.MethodDelete: func() { s.handleCancelJob(w, r, id) },
+	})
+}
+
+// handleListJobs lists the most recent jobs, newest first.
+func (s *Server) handleListJobs(w http.ResponseWriter, r *http.Request) {
+	session, err := s.takeSession(w, r)
+	if err != nil {
+		return
+	}
+	defer session.Release()
+
+	jobs, err := session.ReadJobs(r.Context(), jobListLimit)
+	if err != nil {
+		session.Log.WithError(err).Error("Unable to load jobs.")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Unable to load jobs"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(jobs); err != nil {
+		session.Log.WithError(err).Error("Unable to serialize JSON.")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Unable to serialize JSON"))
+		return
+	}
+}
+
+// handleGetJob reports the status of a job, and its result once it's finished.
+func (s *Server) handleGetJob(w http.ResponseWriter, r *http.Request, id int) {
+	session, err := s.takeSession(w, r)
+	if err != nil {
+		return
+	}
+	defer session.Release()
+
+	job, err := session.ReadJob(r.Context(), id)
+	if err != nil {
+		session.Log.WithError(err).WithField("job", id).Error("Unable to load job.")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Unable to load job"))
+		return
+	}
+	if job == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "No job with ID %d", id)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(job); err != nil {
+		session.Log.WithError(err).Error("Unable to serialize JSON.")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Unable to serialize JSON"))
+		return
+	}
+}
+
+// handleCancelJob cancels a running job. Only the coordinator that's running a job can cancel it. The job's status
+// becomes "canceled" once its work has stopped.
+func (s *Server) handleCancelJob(w http.ResponseWriter, r *http.Request, id int) {
+	if s.jobs.cancel(id) {
+		requestLog(r).WithField("job", id).Info("Job canceled.")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("Job canceling."))
+		return
+	}
+
+	session, err := s.takeSession(w, r)
+	if err != nil {
+		return
+	}
+	defer session.Release()
+
+	job, err := session.ReadJob(r.Context(), id)
+	if err != nil {
+		session.Log.WithError(err).WithField("job", id).Error("Unable to load job.")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Unable to load job"))
+		return
+	}
+	switch {
+	case job == nil:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "No job with ID %d", id)
+	case job.Finished():
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Job %d has already finished", id)
+	default:
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Job %d is running on %s. Cancel it there.", id, job.Host)
+	}
+}
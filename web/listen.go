@@ -0,0 +1,95 @@
+package web
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Listen serves the management API on each configured address: HTTPS on the listen address, and plain HTTP on a Unix
+// socket or loopback address. It only returns if there's an error.
+func (s Server) Listen() error {
+	errs := make(chan error, 3)
+	listeners := 0
+
+	if len(s.opts().ListenAddress) > 0 {
+		listeners++
+		go func() { errs <- s.listenTLS() }()
+	}
+	if len(s.opts().PlainHTTPAddress) > 0 {
+		listeners++
+		go func() { errs <- s.listenPlain() }()
+	}
+	if len(s.opts().ListenSocket) > 0 {
+		listeners++
+		go func() { errs <- s.listenSocket() }()
+	}
+
+	if listeners == 0 {
+		return errors.New("No listen_address, plain_http_address, or listen_socket is configured")
+	}
+	return <-errs
+}
+
+// listenTLS serves HTTPS on the listen address, optionally verifying client certificates.
+func (s Server) listenTLS() error {
+	tlsConfig := &tls.Config{}
+	if len(s.opts().ClientCAPath) > 0 {
+		var err error
+		tlsConfig, err = clientTLSConfig(s.opts().ClientCAPath)
+		if err != nil {
+			return err
+		}
+		log.WithField("clientCAPath", s.opts().ClientCAPath).Info("Accepting client certificates.")
+	}
+
+	reloader, err := newCertReloader(s.opts().TLSCertificate(), s.opts().TLSKey())
+	if err != nil {
+		return err
+	}
+	tlsConfig.GetCertificate = reloader.GetCertificate
+
+	server := &http.Server{Addr: s.opts().ListenAddress, TLSConfig: tlsConfig}
+	log.WithField("address", s.opts().ListenAddress).Info("Now serving.")
+	return server.ListenAndServeTLS("", "")
+}
+
+// listenPlain serves plain HTTP on a loopback address. Other addresses are refused, so that the auth token is never
+// sent in the clear across a network.
+func (s Server) listenPlain() error {
+	host, _, err := net.SplitHostPort(s.opts().PlainHTTPAddress)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("plain_http_address %s is not a loopback address", s.opts().PlainHTTPAddress)
+	}
+
+	log.WithField("address", s.opts().PlainHTTPAddress).Info("Now serving plain HTTP.")
+	return http.ListenAndServe(s.opts().PlainHTTPAddress, nil)
+}
+
+// listenSocket serves plain HTTP on a Unix domain socket that's accessible to the coordinator's user and group.
+func (s Server) listenSocket() error {
+	if err := os.Remove(s.opts().ListenSocket); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	listener, err := net.Listen("unix", s.opts().ListenSocket)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	if err := os.Chmod(s.opts().ListenSocket, 0660); err != nil {
+		return err
+	}
+
+	log.WithField("socket", s.opts().ListenSocket).Info("Now serving on Unix socket.")
+	return http.Serve(listener, nil)
+}
@@ -1,59 +1,194 @@
 package web
 
 import (
-	"database/sql"
+	"context"
+	"crypto/subtle"
 	"net/http"
-	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/smashwilson/az-coordinator/state"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/smashwilson/az-coordinator/config"
+	"github.com/smashwilson/az-coordinator/events"
+	"github.com/smashwilson/az-coordinator/leader"
+	"github.com/smashwilson/az-coordinator/oidc"
 	"github.com/smashwilson/az-coordinator/secrets"
+	"github.com/smashwilson/az-coordinator/selfupdate"
+	"github.com/smashwilson/az-coordinator/store"
+)
+
+const (
+	// poolIdleSessions is the number of sessions kept connected and ready for incoming requests.
+	poolIdleSessions = 10
+
+	// poolMaxSessions is the maximum number of sessions that may be in use at once.
+	poolMaxSessions = 30
+
+	// poolWait is the time a request waits for a session to be released once poolMaxSessions are in use.
+	poolWait = 10 * time.Second
 )
 
 // Server represents the persistent state associated with any HTTP handlers.
 type Server struct {
-	opts *config.Options
-	db   *sql.DB
+	// liveOpts holds the current *config.Options, which are replaced when the options file is reloaded.
+	liveOpts *atomic.Value
+
+	db   *store.DB
 	ring *secrets.DecoderRing
 	pool *state.Pool
 
+	elector     *leader.Elector
 	currentSync *syncProgress
+	limiter     *clientLimiter
+	verifier    *oidc.Verifier
+	bus         *events.Bus
+	actualCache *state.ActualCache
+	jobs        *jobRunner
+	alerts      *alertTracker
+
+	// desiredLock serializes conditional writes to desired units, so that the unit compared with a request's If-Match
+	// header is the one that's replaced.
+	desiredLock *sync.Mutex
+
+	// fleetSyncRequested holds the Unix time of the most recent sync, which is passed on to fleet agents.
+	fleetSyncRequested *int64
+
+	// drained is 1 while this host's units are stopped for maintenance.
+	drained *int32
+
+	// frozen holds the Unix time at which the current deploy freeze ends, or 0 if deploys aren't frozen.
+	frozen *int64
+
+	// failedSyncs counts the syncs that have failed in a row.
+	failedSyncs *int32
+
+	// started is 1 once the server has finished starting up, including its initial sync.
+	started *int32
 }
 
-// NewServer creates (but does not start) an HTTP server for the coordinator management interface.
-func NewServer(opts *config.Options, db *sql.DB, ring *secrets.DecoderRing) (*Server, error) {
+// NewServer creates (but does not start) an HTTP server for the coordinator management interface. If elector is
+// non-nil, syncs are only performed while this instance is the leader.
+func NewServer(opts *config.Options, db *store.DB, ring *secrets.DecoderRing, elector *leader.Elector) (*Server, error) {
 	s := Server{
-		opts:        opts,
+		liveOpts:    &atomic.Value{},
 		db:          db,
 		ring:        ring,
+		elector:     elector,
 		currentSync: &syncProgress{},
+		limiter:     newClientLimiter(),
+		bus:         events.NewBus(),
+		desiredLock: &sync.Mutex{},
+		jobs:        newJobRunner(),
+		alerts:      newAlertTracker(),
+
+		fleetSyncRequested: new(int64),
+		drained:            new(int32),
+		frozen:             new(int64),
+		failedSyncs:        new(int32),
+		started:            new(int32),
+	}
+	s.liveOpts.Store(opts)
+	s.currentSync.capacity = func() int { return s.opts().ReportCapacity() }
+	s.actualCache = state.NewActualCache(func() time.Duration { return s.opts().ActualCacheTTL() })
+	events.NewEmitter(s.bus, s.eventWebhooks)
+	go s.invalidateActualOnEvents()
+
+	if opts.OIDC.Enabled() {
+		verifier, err := oidc.NewVerifier(opts.OIDC)
+		if err != nil {
+			return nil, err
+		}
+		s.verifier = verifier
 	}
 
-	pool, err := state.NewPool(s.newSession, 10)
+	pool, err := state.NewPool(s.newSession, poolIdleSessions, poolMaxSessions, poolWait)
 	if err != nil {
 		return nil, err
 	}
 	s.pool = pool
+	s.interruptJobs()
 
 	http.HandleFunc("/", s.wrap(s.handleRoot, false))
 	http.HandleFunc("/secrets", s.wrap(s.handleSecretsRoot, true))
+	http.HandleFunc("/secrets/files", s.wrap(s.handleSecretFilesRoot, true))
 	http.HandleFunc("/desired", s.wrap(s.handleDesiredRoot, true))
 	http.HandleFunc("/desired/", s.wrap(s.handleDesired, true))
+	http.HandleFunc("/desired/manifest", s.wrap(s.handleDesiredManifestRoot, true))
+	http.HandleFunc("/desired/batch", s.wrap(s.handleDesiredBatchRoot, true))
+	http.HandleFunc("/desired/by-name/", s.wrap(s.handleDesiredByName, true))
 	http.HandleFunc("/actual", s.wrap(s.handleActualRoot, true))
+	http.HandleFunc("/actual/", s.wrap(s.handleActual, true))
+	http.HandleFunc("/apps", s.wrap(s.handleAppsRoot, true))
+	http.HandleFunc("/apps/", s.wrap(s.handleApp, true))
 	http.HandleFunc("/diff", s.wrap(s.handleDiffRoot, true))
+	http.HandleFunc("/drift", s.wrap(s.handleDriftRoot, true))
 	http.HandleFunc("/sync", s.wrap(s.handleSyncRoot, true))
+	http.HandleFunc("/sync/", s.wrap(s.handleSync, true))
+	http.HandleFunc("/sync/logs", s.wrap(s.handleSyncLogsRoot, true))
+	http.HandleFunc("/sync/cancel", s.wrap(s.handleSyncCancelRoot, true))
+	http.HandleFunc("/drain", s.wrap(s.handleDrainRoot, true))
+	http.HandleFunc("/undrain", s.wrap(s.handleUndrainRoot, true))
+	http.HandleFunc("/freeze", s.wrap(s.handleFreezeRoot, true))
 	http.HandleFunc("/health", s.wrap(s.handleHealthRoot, true))
+	http.HandleFunc("/healthz", s.wrap(s.handleLivenessRoot, false))
+	http.HandleFunc("/readyz", s.wrap(s.handleReadinessRoot, false))
+	http.HandleFunc("/jobs", s.wrap(s.handleJobsRoot, true))
+	http.HandleFunc("/jobs/", s.wrap(s.handleJob, true))
+	http.HandleFunc("/events", s.wrap(s.handleEventsRoot, true))
+	http.HandleFunc("/metrics", s.wrap(s.handleMetricsRoot, true))
+	http.HandleFunc("/config/reload", s.wrap(s.handleConfigReloadRoot, true))
+	http.HandleFunc("/version", s.wrap(s.handleVersionRoot, true))
+	http.HandleFunc("/hooks/slack", s.wrap(s.handleSlackHooksRoot, false))
+
+	if opts.Fleet.Controller() {
+		http.HandleFunc("/agent/assignment", s.wrap(s.handleAgentAssignmentRoot, false))
+		http.HandleFunc("/agent/report", s.wrap(s.handleAgentReportRoot, false))
+		http.HandleFunc("/agents", s.wrap(s.handleAgentsRoot, true))
+	}
+
+	if elector != nil {
+		elector.OnElected(s.handleElected)
+		go elector.Run()
+	}
+
+	if interval := opts.SelfUpdate.Interval(); opts.SelfUpdate.Enabled() && interval > 0 {
+		updater, err := selfupdate.NewUpdater(opts.SelfUpdate)
+		if err != nil {
+			return nil, err
+		}
+		go s.runSelfUpdates(updater, interval)
+	}
+
+	go s.watchDockerEvents()
+	go s.watchUnits()
+	go s.reloadOnHangup()
+	go s.runScheduledSyncs()
+	go s.runAlerts()
+	go s.runBackups()
 
 	return &s, nil
 }
 
-// Listen binds a socket to the address requested by the current Options. It only returns if there's an error.
-func (s Server) Listen() error {
-	log.WithField("address", s.opts.ListenAddress).Info("Now serving.")
-	return http.ListenAndServeTLS(s.opts.ListenAddress, secrets.FilenameTLSCertificate, secrets.FilenameTLSKey, nil)
+// opts returns the options currently in effect.
+func (s Server) opts() *config.Options {
+	return s.liveOpts.Load().(*config.Options)
+}
+
+// Shutdown relinquishes leadership, if this instance holds it, so that another instance can take over without waiting
+// for this one's database session to time out. Call it before the process exits.
+func (s Server) Shutdown() {
+	if s.elector != nil {
+		s.elector.Stop()
+	}
+}
+
+// isLeader returns true if this instance should perform syncs.
+func (s Server) isLeader() bool {
+	return s.elector == nil || s.elector.IsLeader()
 }
 
 var allowedMethods = map[string]bool{
@@ -74,20 +209,31 @@ func buildMethodList() string {
 
 func (s Server) wrap(handler func(http.ResponseWriter, *http.Request), protected bool) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		r = withRequestID(w, r)
+		rec := &statusRecorder{ResponseWriter: w}
+		w = rec
+		defer func() { logAccess(r, rec, start) }()
+		if !unredactedPaths[r.URL.Path] {
+			redactor := &redactingWriter{ResponseWriter: rec}
+			defer redactor.finish()
+			w = redactor
+		}
+
+		addr := clientAddress(r)
+		if allowed, wait := s.limiter.allow(addr); !allowed {
+			retryAfter(w, wait)
+			return
+		}
+
 		username, password, ok := r.BasicAuth()
-		log.WithFields(log.Fields{
-			"method":   r.Method,
-			"username": username,
-			"password": password,
-			"path":     r.URL.Path,
-			"headers":  r.Header,
-		}).Debug("Request.")
 
 		// CORS preflight requests
-		w.Header().Set("Access-Control-Allow-Origin", s.opts.AllowedOrigin)
+		w.Header().Set("Access-Control-Allow-Origin", s.opts().AllowedOrigin)
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
 		w.Header().Set("Access-Control-Allow-Methods", buildMethodList())
-		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match, If-None-Match")
+		w.Header().Set("Access-Control-Expose-Headers", requestIDHeader+", ETag, Location")
 		w.Header().Set("Access-Control-Max-Age", "60")
 
 		if r.Method == http.MethodOptions {
@@ -102,14 +248,61 @@ func (s Server) wrap(handler func(http.ResponseWriter, *http.Request), protected
 			return
 		}
 
-		if protected && (!ok || password != s.opts.AuthToken) {
-			w.WriteHeader(401)
-			w.Write([]byte("Unauthorized"))
+		if name, certOK := s.certIdentity(r); protected && certOK {
+			r = withIdentity(r, "cert", name)
+			s.limiter.authSucceeded(addr)
+		} else if bearer, isBearer := bearerToken(r); protected && isBearer && s.verifier != nil {
+			claims, err := s.verifier.Verify(r.Context(), bearer)
+			if err != nil {
+				requestLog(r).WithError(err).Debug("Bearer token rejected.")
+				s.unauthorized(w, r, addr)
+				return
+			}
+			r = withIdentity(r, "oidc", s.verifier.Username(claims))
+			s.limiter.authSucceeded(addr)
+		} else if protected {
+			if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(s.opts().AuthToken)) != 1 {
+				s.unauthorized(w, r, addr)
+				return
+			}
+			r = withIdentity(r, "token", username)
+			s.limiter.authSucceeded(addr)
+		}
+
+		// Changes to desired units are recorded in their history under the requester's name.
+		r = r.WithContext(state.WithActor(r.Context(), requestTrigger(r).Actor))
+
+		if streamingPaths[r.URL.Path] {
+			handler(w, r)
 			return
 		}
 
-		handler(w, r)
+		ctx, cancel := context.WithTimeout(r.Context(), s.opts().Timeouts.Request())
+		defer cancel()
+
+		handler(w, r.WithContext(ctx))
+	}
+}
+
+// unauthorized rejects a request that failed to authenticate, counting the failure against the client's address.
+func (s Server) unauthorized(w http.ResponseWriter, r *http.Request, addr string) {
+	if lockout := s.limiter.authFailed(addr); lockout > 0 {
+		requestLog(r).WithFields(log.Fields{
+			"remoteAddr": addr,
+			"lockout":    lockout,
+		}).Warn("Client locked out after repeated authentication failures.")
 	}
+	w.WriteHeader(401)
+	w.Write([]byte("Unauthorized"))
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(header[7:]), true
 }
 
 type methodHandlerMap map[string]func()
@@ -125,18 +318,23 @@ func (s Server) methods(w http.ResponseWriter, r *http.Request, handlers methodH
 	handler()
 }
 
-func (s Server) newSession() (*state.Session, error) {
-	return state.NewSession(s.db, s.ring, s.opts.DockerAPIVersion)
+// takeSession leases a session from the pool for the duration of a request, giving up at the request's deadline. If no
+// session can be acquired, it writes an error response and returns the error. Callers must Release the lease.
+func (s Server) takeSession(w http.ResponseWriter, r *http.Request) (*state.SessionLease, error) {
+	session, err := s.pool.TakeContext(r.Context())
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to establish a session.")
+		if err == state.ErrPoolExhausted || err == context.DeadlineExceeded {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		w.Write([]byte("Unable to establish a session."))
+		return nil, err
+	}
+	return session, nil
 }
 
-func extractID(rx *regexp.Regexp, w http.ResponseWriter, r *http.Request) (string, bool) {
-	ms := rx.FindStringSubmatch(r.URL.Path)
-	// (0) full match; (1) extracted id
-	if len(ms) != 2 {
-		log.WithField("path", r.URL.Path).Error("ID extraction regexp did not match")
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte("Not found"))
-		return "", false
-	}
-	return ms[1], true
+func (s Server) newSession() (*state.Session, error) {
+	return state.NewSession(s.db, s.ring, s.opts().DockerAPIVersion)
 }
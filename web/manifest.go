@@ -0,0 +1,90 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/events"
+	"github.com/smashwilson/az-coordinator/manifest"
+)
+
+func (s Server) handleDesiredManifestRoot(w http.ResponseWriter, r *http.Request) {
+	s.methods(w, r, methodHandlerMap{
+		http.MethodPost: func() { s.handleApplyManifest(w, r) },
+	})
+}
+
+// handleApplyManifest creates or updates the desired units described by a YAML or JSON body of Pod and Deployment
+// manifests.
+func (s Server) handleApplyManifest(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Unable to read request body: %v", err)
+		return
+	}
+
+	manifests, err := manifest.Parse(body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Unable to parse manifest: %v", err)
+		return
+	}
+	if len(manifests) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("No manifests given"))
+		return
+	}
+
+	session, err := s.takeSession(w, r)
+	if err != nil {
+		return
+	}
+	defer session.Release()
+
+	results, errs := manifest.Apply(r.Context(), session, manifests)
+	if results == nil {
+		var message strings.Builder
+		message.WriteString("Invalid manifest:\n")
+		for i, err := range errs {
+			log.WithError(err).Warn("Invalid manifest.")
+			message.WriteString(err.Error())
+			if i != len(errs)-1 {
+				message.WriteString("\n")
+			}
+		}
+
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(message.String()))
+		return
+	}
+
+	for _, result := range results {
+		data := events.UnitData{Name: result.Unit}
+		if result.ID != nil {
+			data.ID = *result.ID
+		}
+		switch result.Action {
+		case manifest.ActionCreated:
+			s.emitFrom(r, events.UnitCreated, data)
+		case manifest.ActionUpdated:
+			s.emitFrom(r, events.UnitUpdated, data)
+		}
+	}
+
+	if len(errs) > 0 {
+		for _, err := range errs {
+			log.WithError(err).Error("Unable to store desired unit.")
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Unable to store the desired units in the database"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
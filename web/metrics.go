@@ -0,0 +1,30 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+)
+
+func (s *Server) handleMetricsRoot(w http.ResponseWriter, r *http.Request) {
+	s.methods(w, r, methodHandlerMap{
+		http.MethodGet: func() { s.handleGetMetrics(w, r) },
+	})
+}
+
+// handleGetMetrics reports internal counters in the Prometheus text exposition format.
+func (s *Server) handleGetMetrics(w http.ResponseWriter, r *http.Request) {
+	stats := s.pool.Stats()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writeMetric := func(name, kind, help string, value int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+		fmt.Fprintf(w, "%s %d\n", name, value)
+	}
+
+	writeMetric("az_coordinator_pool_sessions_in_use", "gauge", "Sessions currently leased from the pool.", int64(stats.InUse))
+	writeMetric("az_coordinator_pool_sessions_idle", "gauge", "Connected sessions waiting to be leased.", int64(stats.Idle))
+	writeMetric("az_coordinator_pool_sessions_created_total", "counter", "Sessions created by the pool.", stats.Created)
+	writeMetric("az_coordinator_pool_sessions_closed_total", "counter", "Sessions closed by the pool.", stats.Closed)
+}
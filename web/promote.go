@@ -0,0 +1,109 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/events"
+	"github.com/smashwilson/az-coordinator/state"
+)
+
+// handlePromoteDesired moves the image at a unit's staging tag to the tag that it runs, then syncs that unit alone.
+func (s *Server) handlePromoteDesired(w http.ResponseWriter, r *http.Request, id int) {
+	type promoteRequest struct {
+		FromTag string `json:"from_tag"`
+	}
+
+	if !s.isLeader() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("This coordinator is a follower. Request a promotion from the leader."))
+		return
+	}
+
+	if err := s.syncRefused(); err != nil {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	var promoteReq promoteRequest
+	if err := decoder.Decode(&promoteReq); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Unable to parse request body as JSON: %v", err)
+		return
+	}
+
+	session, err := s.takeSession(w, r)
+	if err != nil {
+		return
+	}
+
+	unit, err := session.ReadDesiredUnit(r.Context(), id)
+	if err != nil {
+		session.Release()
+		log.WithError(err).WithField("unitID", id).Error("Unable to load desired unit.")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Unable to load desired unit"))
+		return
+	}
+	if unit == nil {
+		session.Release()
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Desired unit not found"))
+		return
+	}
+
+	trigger := requestTrigger(r)
+	promotion, err := session.PromoteUnit(r.Context(), unit, promoteReq.FromTag, trigger.Actor)
+	session.Release()
+	if err != nil {
+		requestLog(r).WithError(err).WithField("unitID", id).Warn("Unable to promote unit.")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Unable to promote unit: %v", err)
+		return
+	}
+	s.emit(events.UnitUpdated, trigger.Actor, events.UnitData{ID: id, Name: unit.UnitName()})
+
+	if len(trigger.Reason) == 0 {
+		trigger.Reason = fmt.Sprintf("promote %s from %s", unit.UnitName(), promotion.FromTag)
+	}
+	if s.currentSync.request(trigger) {
+		job := s.startScopedSync(trigger, func(settings *state.SyncSettings) { settings.Unit = &id })
+		writeJobLocation(w, job)
+	} else {
+		requestLog(r).Warn("Sync already in progress. The promoted unit will be applied by the next sync.")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(promotion)
+}
+
+func (s *Server) handleListPromotions(w http.ResponseWriter, r *http.Request, id int) {
+	session, err := s.takeSession(w, r)
+	if err != nil {
+		return
+	}
+	defer session.Release()
+
+	promotions, err := session.ReadPromotions(r.Context(), id)
+	if err != nil {
+		log.WithError(err).WithField("unitID", id).Error("Unable to load promotions.")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Unable to load promotions"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(promotions); err != nil {
+		log.WithError(err).Error("Unable to serialize JSON.")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Unable to serialize JSON"))
+		return
+	}
+}
@@ -0,0 +1,145 @@
+package web
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// rateLimitPerSecond is the sustained rate of requests accepted from each client address.
+	rateLimitPerSecond = 5
+
+	// rateLimitBurst is the number of requests a client may make at once before being limited.
+	rateLimitBurst = 20
+
+	// lockoutThreshold is the number of consecutive failed authentication attempts a client may make before it's
+	// locked out.
+	lockoutThreshold = 5
+
+	// lockoutBase is the length of the first lockout. Each further failure doubles it, up to lockoutMax.
+	lockoutBase = 2 * time.Second
+	lockoutMax  = 15 * time.Minute
+
+	// clientIdleExpiry is how long a client's state is kept after its last request.
+	clientIdleExpiry = time.Hour
+)
+
+// clientState tracks the request budget and authentication failures of one client address.
+type clientState struct {
+	tokens      float64
+	lastSeen    time.Time
+	failures    int
+	lockedUntil time.Time
+}
+
+// clientLimiter throttles each client address and locks out addresses that repeatedly fail to authenticate.
+type clientLimiter struct {
+	lock      sync.Mutex
+	clients   map[string]*clientState
+	lastSweep time.Time
+}
+
+func newClientLimiter() *clientLimiter {
+	return &clientLimiter{clients: make(map[string]*clientState), lastSweep: time.Now()}
+}
+
+// clientAddress identifies the client that sent r by its IP address.
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// client returns the state of addr, creating it if necessary. The caller must hold the lock.
+func (l *clientLimiter) client(addr string, now time.Time) *clientState {
+	if now.Sub(l.lastSweep) > time.Minute {
+		for other, state := range l.clients {
+			if now.Sub(state.lastSeen) > clientIdleExpiry && now.After(state.lockedUntil) {
+				delete(l.clients, other)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	state, ok := l.clients[addr]
+	if !ok {
+		state = &clientState{tokens: rateLimitBurst, lastSeen: now}
+		l.clients[addr] = state
+	}
+	return state
+}
+
+// allow consumes one request from addr's budget. If addr is rate limited or locked out, it returns false and the time
+// the client should wait before trying again.
+func (l *clientLimiter) allow(addr string) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	state := l.client(addr, now)
+
+	if now.Before(state.lockedUntil) {
+		return false, state.lockedUntil.Sub(now)
+	}
+
+	state.tokens += now.Sub(state.lastSeen).Seconds() * rateLimitPerSecond
+	if state.tokens > rateLimitBurst {
+		state.tokens = rateLimitBurst
+	}
+	state.lastSeen = now
+
+	if state.tokens < 1 {
+		return false, time.Duration((1 - state.tokens) / rateLimitPerSecond * float64(time.Second))
+	}
+	state.tokens--
+	return true, 0
+}
+
+// authFailed records a failed authentication attempt from addr, locking it out once it has failed too many times in a
+// row. It returns the length of the lockout, or zero if addr isn't locked out.
+func (l *clientLimiter) authFailed(addr string) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	state := l.client(addr, now)
+	state.failures++
+	if state.failures < lockoutThreshold {
+		return 0
+	}
+
+	lockout := lockoutMax
+	if shift := uint(state.failures - lockoutThreshold); shift < 16 {
+		if d := lockoutBase << shift; d < lockoutMax {
+			lockout = d
+		}
+	}
+	state.lockedUntil = now.Add(lockout)
+	return lockout
+}
+
+// authSucceeded clears addr's record of failed authentication attempts.
+func (l *clientLimiter) authSucceeded(addr string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if state, ok := l.clients[addr]; ok {
+		state.failures = 0
+	}
+}
+
+// retryAfter writes a 429 response that asks the client to wait for d.
+func retryAfter(w http.ResponseWriter, d time.Duration) {
+	seconds := int(d / time.Second)
+	if d%time.Second > 0 {
+		seconds++
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write([]byte("Too many requests"))
+}
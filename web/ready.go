@@ -0,0 +1,103 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/smashwilson/az-coordinator/state"
+)
+
+// readinessTimeout limits how long GET /readyz waits for the database to answer.
+const readinessTimeout = 2 * time.Second
+
+// readinessReport explains whether the coordinator is ready to serve requests. Each check is "ok" or describes why it
+// isn't.
+type readinessReport struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+// StartInitialSync records that the sync performed at startup is running, so that GET /sync reports it, other syncs
+// wait for it, and drift isn't reported while it restarts units.
+func (s *Server) StartInitialSync(trigger state.SyncTrigger) {
+	s.currentSync.request(trigger)
+}
+
+// FinishInitialSync records the outcome of the sync performed at startup, then marks the server as ready.
+func (s *Server) FinishInitialSync(delta *state.Delta, errs []error) {
+	if len(errs) > 0 {
+		s.currentSync.setFailure(delta, errs)
+	} else {
+		s.currentSync.setDelta(delta)
+	}
+	s.noteSyncOutcome(len(errs) > 0)
+	s.MarkReady()
+}
+
+// MarkReady reports that the server has finished starting up. Followers, which don't sync at startup, are ready as soon
+// as they're serving.
+func (s *Server) MarkReady() {
+	atomic.StoreInt32(s.started, 1)
+}
+
+func (s *Server) handleLivenessRoot(w http.ResponseWriter, r *http.Request) {
+	s.methods(w, r, methodHandlerMap{
+		http.MethodGet: func() { s.handleGetLiveness(w, r) },
+	})
+}
+
+// handleGetLiveness answers as long as the process is able to serve requests. It doesn't require authentication, so
+// that a watchdog can poll it.
+func (s *Server) handleGetLiveness(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+func (s *Server) handleReadinessRoot(w http.ResponseWriter, r *http.Request) {
+	s.methods(w, r, methodHandlerMap{
+		http.MethodGet: func() { s.handleGetReadiness(w, r) },
+	})
+}
+
+// handleGetReadiness reports whether the initial sync has finished, the session pool holds a connected session, and
+// the database answers. It responds with 503 Service Unavailable until all three are true. It doesn't require
+// authentication, and reveals nothing but the outcome of each check.
+func (s *Server) handleGetReadiness(w http.ResponseWriter, r *http.Request) {
+	report := readinessReport{Ready: true, Checks: make(map[string]string)}
+	check := func(name, problem string) {
+		if len(problem) == 0 {
+			report.Checks[name] = "ok"
+			return
+		}
+		report.Checks[name] = problem
+		report.Ready = false
+	}
+
+	if atomic.LoadInt32(s.started) == 0 {
+		check("initial_sync", "running")
+	} else {
+		check("initial_sync", "")
+	}
+
+	if stats := s.pool.Stats(); stats.Created-stats.Closed > 0 {
+		check("pool", "")
+	} else {
+		check("pool", "no sessions connected")
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+	if err := s.db.PingContext(ctx); err != nil {
+		check("database", "unreachable")
+	} else {
+		check("database", "")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !report.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(&report)
+}
@@ -0,0 +1,85 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/config"
+)
+
+// reloadLock serializes reloads requested by signal and over HTTP.
+var reloadLock sync.Mutex
+
+type reloadResponse struct {
+	RestartRequired []string `json:"restart_required"`
+}
+
+// reloadOptions re-reads the options file and puts the options that can change while running into effect. It returns
+// the names of changed options that will only take effect after a restart.
+func (s Server) reloadOptions() ([]string, error) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	next, err := config.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	previous := s.opts()
+	reloaded, restartRequired := previous.Reload(*next)
+	if reloaded.LogLevel != previous.LogLevel {
+		if err := reloaded.ApplyLogLevel(); err != nil {
+			return nil, err
+		}
+	}
+	s.liveOpts.Store(reloaded)
+
+	entry := log.WithField("path", reloaded.OptionsPath)
+	if len(restartRequired) > 0 {
+		entry.WithField("restartRequired", restartRequired).Warn("Options reloaded. Some changes require a restart.")
+	} else {
+		entry.Info("Options reloaded.")
+	}
+	return restartRequired, nil
+}
+
+// reloadOnHangup reloads the options file each time the process receives SIGHUP.
+func (s Server) reloadOnHangup() {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	for range hangups {
+		if _, err := s.reloadOptions(); err != nil {
+			log.WithError(err).Error("Unable to reload options.")
+		}
+	}
+}
+
+func (s *Server) handleConfigReloadRoot(w http.ResponseWriter, r *http.Request) {
+	s.methods(w, r, methodHandlerMap{
+		http.MethodPost: func() { s.handleConfigReload(w, r) },
+	})
+}
+
+func (s *Server) handleConfigReload(w http.ResponseWriter, r *http.Request) {
+	restartRequired, err := s.reloadOptions()
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to reload options.")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Unable to reload options: " + err.Error()))
+		return
+	}
+
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(reloadResponse{RestartRequired: restartRequired}); err != nil {
+		requestLog(r).WithError(err).Error("Unable to serialize reload result to JSON")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Unable to serialize reload result to JSON"))
+		return
+	}
+}
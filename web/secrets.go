@@ -4,8 +4,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
+	"strconv"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/events"
+	"github.com/smashwilson/az-coordinator/secrets"
+	"github.com/smashwilson/az-coordinator/state"
 )
 
 func (s *Server) handleSecretsRoot(w http.ResponseWriter, r *http.Request) {
@@ -17,11 +22,8 @@ func (s *Server) handleSecretsRoot(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleListSecrets(w http.ResponseWriter, r *http.Request) {
-	session, err := s.pool.Take()
+	session, err := s.takeSession(w, r)
 	if err != nil {
-		log.WithError(err).Error("Unable to establish session.")
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Unable to establish session."))
 		return
 	}
 	defer session.Release()
@@ -40,11 +42,8 @@ func (s *Server) handleListSecrets(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleCreateSecrets(w http.ResponseWriter, r *http.Request) {
-	session, err := s.pool.Take()
+	session, err := s.takeSession(w, r)
 	if err != nil {
-		log.WithError(err).Error("Unable to establish session.")
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Unable to establish session."))
 		return
 	}
 	defer session.Release()
@@ -58,21 +57,25 @@ func (s *Server) handleCreateSecrets(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := session.SetSecrets(toCreate); err != nil {
+		if violation, ok := err.(*secrets.PolicyViolation); ok {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(violation.Error()))
+			return
+		}
+
 		log.WithError(err).Error("Unable to persist secret changes.")
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("Unable to persist secret changes."))
 		return
 	}
+	s.emitFrom(r, events.SecretChanged, events.SecretData{Action: "set", Keys: secretKeys(toCreate)})
 
 	w.WriteHeader(http.StatusAccepted)
 }
 
 func (s *Server) handleDeleteSecrets(w http.ResponseWriter, r *http.Request) {
-	session, err := s.pool.Take()
+	session, err := s.takeSession(w, r)
 	if err != nil {
-		log.WithError(err).Error("Unable to establish session.")
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Unable to establish session."))
 		return
 	}
 	defer session.Release()
@@ -85,12 +88,119 @@ func (s *Server) handleDeleteSecrets(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+	if err := state.CheckForce("delete %d secrets", len(toDelete), s.opts().Guards.SecretDeletionLimit(), force); err != nil {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "%v. Repeat the request with ?force=true to delete them.", err)
+		return
+	}
+
 	if err := session.DeleteSecrets(toDelete); err != nil {
 		log.WithError(err).Error("Unable to persist secret changes.")
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("Unable to persist secret changes."))
 		return
 	}
+	s.emitFrom(r, events.SecretChanged, events.SecretData{Action: "delete", Keys: toDelete})
 
 	w.WriteHeader(http.StatusAccepted)
 }
+
+func (s *Server) handleSecretFilesRoot(w http.ResponseWriter, r *http.Request) {
+	s.methods(w, r, methodHandlerMap{
+		http.MethodGet:    func() { s.handleListSecretFiles(w, r) },
+		http.MethodPost:   func() { s.handleSetSecretFiles(w, r) },
+		http.MethodDelete: func() { s.handleClearSecretFiles(w, r) },
+	})
+}
+
+func (s *Server) handleListSecretFiles(w http.ResponseWriter, r *http.Request) {
+	session, err := s.takeSession(w, r)
+	if err != nil {
+		return
+	}
+	defer session.Release()
+
+	destinations, err := session.ListSecretFiles()
+	if err != nil {
+		log.WithError(err).Error("Unable to load secret file destinations.")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Unable to load secret file destinations."))
+		return
+	}
+
+	encoder := json.NewEncoder(w)
+	if err = encoder.Encode(destinations); err != nil {
+		log.WithError(err).Error("Unable to serialize secret file destinations to JSON")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Unable to serialize secret file destinations to JSON"))
+		return
+	}
+}
+
+func (s *Server) handleSetSecretFiles(w http.ResponseWriter, r *http.Request) {
+	session, err := s.takeSession(w, r)
+	if err != nil {
+		return
+	}
+	defer session.Release()
+
+	toSet := make(map[string]secrets.FileDestination)
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&toSet); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Unable to deserialize secret file destinations: %v", err)
+		return
+	}
+
+	if err := session.SetSecretFiles(toSet); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	keys := make([]string, 0, len(toSet))
+	for key := range toSet {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	s.emitFrom(r, events.SecretChanged, events.SecretData{Action: "set_file", Keys: keys})
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *Server) handleClearSecretFiles(w http.ResponseWriter, r *http.Request) {
+	session, err := s.takeSession(w, r)
+	if err != nil {
+		return
+	}
+	defer session.Release()
+
+	toClear := make([]string, 0, 10)
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&toClear); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Unable to deserialize secret keys to clear: %v", err)
+		return
+	}
+
+	if err := session.ClearSecretFiles(toClear); err != nil {
+		log.WithError(err).Error("Unable to persist secret file changes.")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Unable to persist secret file changes."))
+		return
+	}
+	s.emitFrom(r, events.SecretChanged, events.SecretData{Action: "clear_file", Keys: toClear})
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// secretKeys lists the keys of a map of secrets in sorted order, so that events name the secrets that changed
+// without carrying their values.
+func secretKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,171 @@
+package web
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/smashwilson/az-coordinator/slack"
+	"github.com/smashwilson/az-coordinator/state"
+)
+
+// maxSlackBody limits the size of the requests accepted from Slack.
+const maxSlackBody = 64 * 1024
+
+const slackHelp = "Usage: `sync`, `freeze DURATION` (like `freeze 2h`), `unfreeze`, `approve ID`, or `status`."
+
+func (s *Server) handleSlackHooksRoot(w http.ResponseWriter, r *http.Request) {
+	s.methods(w, r, methodHandlerMap{
+		http.MethodPost: func() { s.handleSlackCommand(w, r) },
+	})
+}
+
+// handleSlackCommand performs a slash command, like "/deploy sync", or the action of a button in a Slack message.
+// Requests are authenticated by their Slack signature rather than by the API token.
+func (s *Server) handleSlackCommand(w http.ResponseWriter, r *http.Request) {
+	signingSecret := s.opts().SlackSigningSecret
+	if len(signingSecret) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not found"))
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSlackBody))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Unable to read request body"))
+		return
+	}
+
+	if err := slack.VerifyRequest(signingSecret, r.Header, body); err != nil {
+		requestLog(r).WithError(err).Warn("Slack request rejected.")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Unauthorized"))
+		return
+	}
+
+	cmd, err := slack.ParseCommand(body)
+	if err != nil {
+		requestLog(r).WithError(err).Warn("Unable to parse Slack request.")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Unable to parse Slack request: %v", err)
+		return
+	}
+
+	if !s.slackUserAllowed(*cmd) {
+		requestLog(r).WithField("slackUser", cmd.UserName).Warn("Slack user is not allowed to run commands.")
+		slack.Respond(w, *cmd, fmt.Sprintf("Sorry, %s isn't allowed to deploy.", cmd.UserName))
+		return
+	}
+
+	requestLog(r).WithField("slackUser", cmd.UserName).WithField("command", cmd.Text).Info("Slack command received.")
+	slack.Respond(w, *cmd, s.runSlackCommand(*cmd))
+}
+
+// slackUserAllowed returns true if the user who sent a Slack command may run it. Users are matched by ID, because
+// Slack user names can be changed by their owners. No one may run commands until allowed users are configured.
+func (s *Server) slackUserAllowed(cmd slack.Command) bool {
+	for _, user := range s.opts().SlackAllowedUsers {
+		if len(user) > 0 && user == cmd.UserID {
+			return true
+		}
+	}
+	return false
+}
+
+// runSlackCommand performs a Slack command and describes the outcome.
+func (s *Server) runSlackCommand(cmd slack.Command) string {
+	args := cmd.Args()
+	if len(args) == 0 {
+		return slackHelp
+	}
+
+	trigger := state.SyncTrigger{Source: state.TriggerSlack, Actor: cmd.UserName}
+
+	switch args[0] {
+	case "sync":
+		if !s.isLeader() {
+			return "This coordinator is a follower. Request a sync from the leader."
+		}
+		if err := s.syncRefused(); err != nil {
+			return fmt.Sprintf("Sync refused: %v.", err)
+		}
+		if !s.currentSync.request(trigger) {
+			return "A sync is already in progress."
+		}
+		s.startSync(trigger)
+		return fmt.Sprintf("Sync started by %s.", cmd.UserName)
+
+	case "freeze":
+		if len(args) < 2 {
+			return "Give the length of the freeze, like `freeze 2h`."
+		}
+		d, err := time.ParseDuration(args[1])
+		if err != nil || d <= 0 {
+			return fmt.Sprintf("Invalid duration %q. Use a duration like `2h` or `30m`.", args[1])
+		}
+		until := s.freeze(d)
+		return fmt.Sprintf("Deploys frozen by %s until %s.", cmd.UserName, until.Format(time.RFC1123))
+
+	case "unfreeze":
+		s.unfreeze()
+		return fmt.Sprintf("Deploys unfrozen by %s.", cmd.UserName)
+
+	case "approve":
+		if len(args) < 2 {
+			return "Give the ID of the sync to approve, like `approve 12`."
+		}
+		id, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Sprintf("Invalid sync ID %q.", args[1])
+		}
+		if !s.isLeader() {
+			return "This coordinator is a follower. Approve the sync on the leader."
+		}
+		if err := s.syncRefused(); err != nil {
+			return fmt.Sprintf("Approval refused: %v.", err)
+		}
+		trigger.Reason = fmt.Sprintf("approve sync %d", id)
+		if s.approveSync(id, trigger) == nil {
+			return fmt.Sprintf("Sync %d is not waiting for approval.", id)
+		}
+		return fmt.Sprintf("Sync %d approved by %s.", id, cmd.UserName)
+
+	case "status":
+		return s.slackStatus()
+
+	default:
+		return slackHelp
+	}
+}
+
+// slackStatus summarizes whether syncs are running, waiting for approval, or refused.
+func (s *Server) slackStatus() string {
+	resp := s.currentSync.response(reportPage{})
+
+	lines := make([]string, 0, 3)
+	switch {
+	case resp.InProgress:
+		lines = append(lines, fmt.Sprintf("Sync %d is in progress, triggered by %s.", resp.ID, resp.Trigger))
+	case resp.PendingApproval != nil:
+		lines = append(lines, fmt.Sprintf(
+			"Sync %d is waiting for approval: %s.",
+			resp.PendingApproval.ID, strings.Join(resp.PendingApproval.Reasons, "; "),
+		))
+	case resp.ID > 0 && len(resp.Errors) > 0:
+		lines = append(lines, fmt.Sprintf("Sync %d failed: %s.", resp.ID, strings.Join(resp.Errors, "; ")))
+	case resp.ID > 0:
+		lines = append(lines, fmt.Sprintf("Sync %d succeeded.", resp.ID))
+	default:
+		lines = append(lines, "No syncs have run since the coordinator started.")
+	}
+
+	if err := s.syncRefused(); err != nil {
+		lines = append(lines, fmt.Sprintf("Syncs are refused: %v.", err))
+	}
+	return strings.Join(lines, "\n")
+}
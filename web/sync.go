@@ -1,19 +1,29 @@
 package web
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
-	"github.com/smashwilson/az-coordinator/slack"
+	"github.com/smashwilson/az-coordinator/events"
+	"github.com/smashwilson/az-coordinator/github"
+	"github.com/smashwilson/az-coordinator/notify"
+	"github.com/smashwilson/az-coordinator/secrets"
 	"github.com/smashwilson/az-coordinator/state"
 )
 
 type syncReport struct {
 	ts      time.Time
 	elapsed time.Duration
+	level   string
 	message string
 	fields  log.Fields
 }
@@ -25,42 +35,255 @@ type syncReportResponse struct {
 	Fields    log.Fields `json:"fields"`
 }
 
+func (r syncReport) response() syncReportResponse {
+	return syncReportResponse{
+		Timestamp: r.ts.Unix(),
+		Elapsed:   r.elapsed.Nanoseconds() / 1000000,
+		Message:   r.message,
+		Fields:    r.fields,
+	}
+}
+
+// queuedSync is a full sync that was requested while another sync was running. It starts as soon as that sync
+// finishes. Requests counts the requests that were coalesced into it.
+type queuedSync struct {
+	Trigger  state.SyncTrigger `json:"trigger"`
+	Requests int               `json:"requests"`
+}
+
+type pendingApprovalResponse struct {
+	ID      int      `json:"id"`
+	Reasons []string `json:"reasons"`
+}
+
 type syncProgressResponse struct {
+	ID         int                  `json:"id"`
 	InProgress bool                 `json:"in_progress"`
+	Trigger    state.SyncTrigger    `json:"trigger"`
 	Reports    []syncReportResponse `json:"reports"`
 	Errors     []string             `json:"errors"`
 	Delta      *state.Delta         `json:"delta"`
+
+	// ReportOffset is the offset of the first of Reports, counting from the start of the sync. NextOffset follows the
+	// last of them, and may be passed as ?offset= to fetch only later reports. ReportCount and ReportLevels count
+	// every report logged by the sync, including the ReportsDropped oldest ones that are no longer held.
+	ReportOffset   int            `json:"report_offset"`
+	NextOffset     int            `json:"next_offset"`
+	ReportCount    int            `json:"report_count"`
+	ReportsDropped int            `json:"reports_dropped"`
+	ReportLevels   map[string]int `json:"report_levels"`
+
+	PendingApproval *pendingApprovalResponse `json:"pending_approval,omitempty"`
+
+	// Queued describes the sync that will start as soon as the current one finishes, if one was queued.
+	Queued *queuedSync `json:"queued,omitempty"`
+
+	// Pulls reports the progress of each container image pulled by the sync, ordered by image reference.
+	Pulls []state.ImagePullProgress `json:"pulls,omitempty"`
+
+	// Interrupted describes a sync that was still running when the server last stopped. It's reported until the next
+	// sync starts.
+	Interrupted *state.SyncCheckpoint `json:"interrupted,omitempty"`
+}
+
+// pendingSync is a sync whose Delta exceeded the approval policy. Approving it repeats the sync with the same scope,
+// and applies the Delta if it's unchanged.
+type pendingSync struct {
+	id          int
+	scope       func(*state.SyncSettings)
+	fingerprint string
+	reasons     []string
 }
 
 type syncProgress struct {
 	lock sync.Mutex
 
+	// capacity returns the number of reports held for each sync.
+	capacity func() int
+
+	// id identifies the current or most recent sync. It's incremented each time a sync is requested.
+	id int
+
 	inProgress bool
-	reports    []syncReport
+	watchers   map[chan syncReport]bool
+	pending    *pendingSync
+	queued     *queuedSync
+	lastPrune  *state.PruneResult
+	trigger    state.SyncTrigger
+	reports    *reportRing
 	delta      *state.Delta
 	errs       []error
+	pulls      map[string]state.ImagePullProgress
+
+	interrupted *state.SyncCheckpoint
 }
 
-func (p *syncProgress) request() bool {
+func (p *syncProgress) request(trigger state.SyncTrigger) bool {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
 	if p.inProgress {
 		return false
 	}
+	p.start(trigger)
+	return true
+}
+
+// requestOrQueue starts a sync like request. If a sync is already running, it queues a full sync to start as soon as
+// that one finishes instead, and returns false. Requests made while a sync is queued are coalesced into it, and keep
+// the trigger of the first.
+func (p *syncProgress) requestOrQueue(trigger state.SyncTrigger) (starting bool, queued *queuedSync) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if !p.inProgress {
+		p.start(trigger)
+		return true, nil
+	}
+	if p.queued == nil {
+		p.queued = &queuedSync{Trigger: trigger}
+	}
+	p.queued.Requests++
+	q := *p.queued
+	return false, &q
+}
+
+// startQueued starts the queued sync, if there is one and no other sync is running. It returns the queued sync's
+// trigger and true if it was started.
+func (p *syncProgress) startQueued() (state.SyncTrigger, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.inProgress || p.queued == nil {
+		return state.SyncTrigger{}, false
+	}
+	trigger := p.queued.Trigger
+	p.queued = nil
+	p.start(trigger)
+	return trigger, true
+}
+
+// dropQueued discards the queued sync, returning true if there was one.
+func (p *syncProgress) dropQueued() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	dropped := p.queued != nil
+	p.queued = nil
+	return dropped
+}
+
+// approve starts a sync that applies the pending sync with the given ID, if it's still pending. A sync requested
+// after the pending one supersedes it.
+func (p *syncProgress) approve(id int, trigger state.SyncTrigger) (*pendingSync, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.inProgress || p.pending == nil || p.pending.id != id {
+		return nil, false
+	}
+
+	pending := p.pending
+	p.start(trigger)
+	return pending, true
+}
 
+// start resets the progress for a new sync. The caller must hold the lock.
+func (p *syncProgress) start(trigger state.SyncTrigger) {
+	p.id++
+	p.pending = nil
 	p.inProgress = true
-	p.reports = make([]syncReport, 0, 10)
+	p.trigger = trigger
+	p.reports = newReportRing(p.capacity())
 	p.delta = nil
 	p.errs = make([]error, 0, 10)
-	return true
+	p.pulls = make(map[string]state.ImagePullProgress)
+	p.interrupted = nil
+}
+
+// ReportInterruptedSync records a sync that was interrupted when the server last stopped, so that GET /sync reports it
+// until the next sync starts.
+func (s *Server) ReportInterruptedSync(checkpoint state.SyncCheckpoint) {
+	s.currentSync.lock.Lock()
+	defer s.currentSync.lock.Unlock()
+
+	s.currentSync.interrupted = &checkpoint
+}
+
+// running returns true while a sync is in progress.
+func (p *syncProgress) running() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.inProgress
+}
+
+// currentID returns the ID of the current or most recent sync.
+func (p *syncProgress) currentID() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.id
 }
 
 func (p *syncProgress) appendReport(r syncReport) {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
-	p.reports = append(p.reports, r)
+	p.reports.append(r)
+
+	for c := range p.watchers {
+		select {
+		case c <- r:
+		default:
+			// The watcher has fallen behind. Closing its channel ends its stream, and it can reconnect to replay the
+			// reports that it missed.
+			delete(p.watchers, c)
+			close(c)
+		}
+	}
+}
+
+// watch returns the reports of the current or most recent sync so far. If the sync is still in progress, it also
+// returns a channel that receives each later report and is closed when the sync finishes.
+func (p *syncProgress) watch() ([]syncReport, chan syncReport) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	replay := make([]syncReport, 0)
+	if p.reports != nil {
+		replay = p.reports.all()
+	}
+	if !p.inProgress {
+		return replay, nil
+	}
+
+	if p.watchers == nil {
+		p.watchers = make(map[chan syncReport]bool)
+	}
+	c := make(chan syncReport, watcherBuffer)
+	p.watchers[c] = true
+	return replay, c
+}
+
+// unwatch stops sending reports to a channel returned by watch.
+func (p *syncProgress) unwatch(c chan syncReport) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.watchers[c] {
+		delete(p.watchers, c)
+		close(c)
+	}
+}
+
+// finish marks the current sync as done and ends the streams that are watching it. The caller must hold the lock.
+func (p *syncProgress) finish() {
+	p.inProgress = false
+	for c := range p.watchers {
+		close(c)
+	}
+	p.watchers = nil
 }
 
 func (p *syncProgress) setErrors(errs []error) {
@@ -68,7 +291,17 @@ func (p *syncProgress) setErrors(errs []error) {
 	defer p.lock.Unlock()
 
 	p.errs = errs
-	p.inProgress = false
+	p.finish()
+}
+
+// setFailure records the errors of a sync that failed, along with the Delta that it partially applied, if any.
+func (p *syncProgress) setFailure(d *state.Delta, errs []error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.delta = d
+	p.errs = errs
+	p.finish()
 }
 
 func (p *syncProgress) setDelta(d *state.Delta) {
@@ -76,21 +309,67 @@ func (p *syncProgress) setDelta(d *state.Delta) {
 	defer p.lock.Unlock()
 
 	p.delta = d
-	p.inProgress = false
+	p.finish()
+	if d != nil && d.Prune != nil {
+		p.lastPrune = d.Prune
+	}
 }
 
-func (p *syncProgress) response() syncProgressResponse {
+// setPending parks the Delta of the current sync until it's approved.
+func (p *syncProgress) setPending(d *state.Delta, reasons []string, scope func(*state.SyncSettings)) int {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
-	reports := make([]syncReportResponse, len(p.reports))
-	for i, r := range p.reports {
-		reports[i] = syncReportResponse{
-			Timestamp: r.ts.Unix(),
-			Elapsed:   r.elapsed.Nanoseconds() / 1000000,
-			Message:   r.message,
-			Fields:    r.fields,
-		}
+	p.delta = d
+	p.errs = []error{state.ErrApprovalRequired}
+	p.finish()
+	p.pending = &pendingSync{id: p.id, scope: scope, fingerprint: d.Fingerprint(), reasons: reasons}
+	return p.id
+}
+
+// setPull records the progress of an image pull performed by the sync with the given ID. Progress reported by an
+// earlier sync's abandoned pulls is ignored.
+func (p *syncProgress) setPull(id int, progress state.ImagePullProgress) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.id != id || p.pulls == nil {
+		return
+	}
+	p.pulls[progress.Ref] = progress
+}
+
+func (p *syncProgress) setPrune(result *state.PruneResult) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.lastPrune = result
+}
+
+func (p *syncProgress) getPrune() *state.PruneResult {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.lastPrune
+}
+
+// response describes the current or most recent sync, including the reports selected by page.
+func (p *syncProgress) response(page reportPage) syncProgressResponse {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	ring := p.reports
+	if ring == nil {
+		ring = newReportRing(0)
+	}
+	selected, offset := ring.page(page)
+	reports := make([]syncReportResponse, len(selected))
+	for i, r := range selected {
+		reports[i] = r.response()
+	}
+	levels := make(map[string]int, len(ring.levels))
+	for level, count := range ring.levels {
+		levels[level] = count
 	}
 
 	errors := make([]string, len(p.errs))
@@ -98,12 +377,33 @@ func (p *syncProgress) response() syncProgressResponse {
 		errors[i] = e.Error()
 	}
 
-	return syncProgressResponse{
+	resp := syncProgressResponse{
+		ID:         p.id,
 		InProgress: p.inProgress,
+		Trigger:    p.trigger,
 		Reports:    reports,
 		Delta:      p.delta,
 		Errors:     errors,
+
+		ReportOffset:   offset,
+		NextOffset:     offset + len(reports),
+		ReportCount:    ring.total,
+		ReportsDropped: ring.offset(),
+		ReportLevels:   levels,
+	}
+	if p.pending != nil {
+		resp.PendingApproval = &pendingApprovalResponse{ID: p.pending.id, Reasons: p.pending.reasons}
+	}
+	if p.queued != nil {
+		q := *p.queued
+		resp.Queued = &q
+	}
+	for _, pull := range p.pulls {
+		resp.Pulls = append(resp.Pulls, pull)
 	}
+	sort.Slice(resp.Pulls, func(i, j int) bool { return resp.Pulls[i].Ref < resp.Pulls[j].Ref })
+	resp.Interrupted = p.interrupted
+	return resp
 }
 
 type syncHook struct {
@@ -124,6 +424,7 @@ func (h *syncHook) Fire(entry *log.Entry) error {
 	report := syncReport{
 		ts:      entry.Time,
 		elapsed: elapsed,
+		level:   entry.Level.String(),
 		message: entry.Message,
 		fields:  entry.Data,
 	}
@@ -133,49 +434,222 @@ func (h *syncHook) Fire(entry *log.Entry) error {
 	return nil
 }
 
-func (s *Server) performSync() {
-	logger := log.New()
-	logger.SetLevel(log.TraceLevel)
-	logger.AddHook(&syncHook{
-		progress: s.currentSync,
-	})
+func (s *Server) performSync(trigger state.SyncTrigger) {
+	s.performScopedSync(trigger, func(*state.SyncSettings) {})
+}
 
-	s.opts.CloudwatchLogger(logger)
+// performScopedSync performs a sync whose settings are narrowed by scope, like to the units of one app, as a job. It
+// returns once the sync has finished.
+func (s *Server) performScopedSync(trigger state.SyncTrigger, scope func(*state.SyncSettings)) {
+	s.runJob(s.newJob(state.JobSync, trigger), s.syncWork(trigger, scope))
+}
 
-	session, err := s.pool.Take()
-	if err != nil {
-		log.WithError(err).Error("Unable to establish session.")
-		s.currentSync.setErrors([]error{err})
+// startSync begins a sync job in the background.
+func (s *Server) startSync(trigger state.SyncTrigger) *runningJob {
+	return s.startScopedSync(trigger, func(*state.SyncSettings) {})
+}
+
+// startScopedSync begins a sync job whose settings are narrowed by scope in the background.
+func (s *Server) startScopedSync(trigger state.SyncTrigger, scope func(*state.SyncSettings)) *runningJob {
+	return s.startJob(state.JobSync, trigger, s.syncWork(trigger, scope))
+}
+
+// startQueuedSync starts the sync that was queued while the last one was running, if any. Queued syncs wait while
+// this instance isn't the leader.
+func (s *Server) startQueuedSync() {
+	if !s.isLeader() {
 		return
 	}
-	defer session.Release()
-	session.WithLogger(logger)
-
-	delta, errs := session.Synchronize(state.SyncSettings{})
-	if len(s.opts.SlackWebhookURL) > 0 {
-		slack.ReportSync(s.opts.SlackWebhookURL, delta, errs)
+	trigger, ok := s.currentSync.startQueued()
+	if !ok {
+		return
 	}
+	log.WithField("actor", trigger.Actor).Info("Starting queued sync.")
+	s.startSync(trigger)
+}
 
-	if len(errs) > 0 {
-		for _, err := range errs {
-			session.Log.WithError(err).Warn("Synchronization error.")
+// syncWork performs a sync whose settings are narrowed by scope. The sync stops early if its job is canceled. The
+// job's result is the sync's Delta. Once it's finished, the sync queued behind it, if any, is started.
+func (s *Server) syncWork(trigger state.SyncTrigger, scope func(*state.SyncSettings)) jobWork {
+	return func(ctx context.Context) (interface{}, error) {
+		defer s.startQueuedSync()
+
+		if err := s.syncRefused(); err != nil {
+			log.WithError(err).Warn("Sync refused.")
+			s.currentSync.setErrors([]error{err})
+			return nil, err
 		}
-		s.currentSync.setErrors(errs)
-		return
+
+		id := s.currentSync.currentID()
+		s.emit(events.SyncStarted, trigger.Actor, events.SyncData{ID: id, Trigger: trigger})
+
+		logger := log.New()
+		logger.SetLevel(log.TraceLevel)
+		logger.SetFormatter(log.StandardLogger().Formatter)
+		logger.AddHook(secrets.DefaultRedactor.Hook())
+		logger.AddHook(&syncHook{
+			progress: s.currentSync,
+		})
+
+		s.opts().ShipLogs(logger)
+		s.noteFleetSync()
+
+		session, err := s.pool.Take()
+		if err != nil {
+			log.WithError(err).Error("Unable to establish session.")
+			s.currentSync.setErrors([]error{err})
+			s.emitSyncFinished(id, trigger, nil, []error{err}, false)
+			s.noteSyncOutcome(true)
+			return nil, err
+		}
+		defer session.Release()
+		session.WithLogger(logger)
+
+		settings := s.syncSettings()
+		settings.Trigger = trigger
+		settings.OnPullProgress = func(progress state.ImagePullProgress) { s.currentSync.setPull(id, progress) }
+		deployments := s.newDeploymentRecorder()
+		settings.OnApply = func(d state.Delta) { deployments.start(d, trigger) }
+		scope(&settings)
+
+		delta, errs := session.Synchronize(ctx, settings)
+		deployments.finish(delta)
+		if len(errs) == 1 && errs[0] == state.ErrSyncCanceled {
+			session.Log.Warn("Sync canceled.")
+			s.currentSync.setErrors(errs)
+			s.emitSyncFinished(id, trigger, nil, errs, false)
+			return nil, errs[0]
+		}
+
+		if len(errs) == 1 && errs[0] == state.ErrSyncInProgress {
+			session.Log.Warn("A sync is already running elsewhere.")
+			s.currentSync.setErrors(errs)
+			s.emitSyncFinished(id, trigger, nil, errs, false)
+			return nil, errs[0]
+		}
+
+		if len(errs) == 1 && errs[0] == state.ErrApprovalRequired {
+			reasons := settings.Approval.Reasons(*delta)
+			s.currentSync.setPending(delta, reasons, scope)
+			session.Log.WithField("id", id).Warn("Sync is waiting for approval.")
+			notify.ReportPendingApproval(*s.opts(), id, reasons, trigger)
+			s.emitSyncFinished(id, trigger, delta, errs, true)
+			return delta, errs[0]
+		}
+
+		notify.ReportSync(*s.opts(), delta, errs, trigger, s.syncLink())
+		s.emitSyncFinished(id, trigger, delta, errs, false)
+
+		if len(errs) > 0 {
+			for _, err := range errs {
+				session.Log.WithError(err).Warn("Synchronization error.")
+			}
+			s.currentSync.setFailure(delta, errs)
+			s.noteSyncOutcome(true)
+			return delta, jobError(errs)
+		}
+
+		s.currentSync.setDelta(delta)
+		s.noteSyncOutcome(false)
+		return delta, nil
+	}
+}
+
+// syncLink returns the URL at which the details of the most recent sync can be found, or an empty string if no
+// public_url is configured.
+func (s *Server) syncLink() string {
+	publicURL := s.opts().PublicURL
+	if len(publicURL) == 0 {
+		return ""
+	}
+	return strings.TrimSuffix(publicURL, "/") + "/sync"
+}
+
+// syncSettings configures a sync with the phase timeouts requested in the server's options.
+func (s *Server) syncSettings() state.SyncSettings {
+	return state.SyncSettings{
+		ReadTimeout:  s.opts().Timeouts.Read(),
+		PullTimeout:  s.opts().Timeouts.Pull(),
+		ApplyTimeout: s.opts().Timeouts.Apply(),
+		HealthDelay:  s.opts().Timeouts.Health(),
+		Prune:        s.prunePolicy(),
+		Host:         s.opts().Fleet.Host(),
+		Labels:       s.opts().Fleet.Labels,
+		Approval:     s.approvalPolicy(),
+		Pulls:        s.pullPolicy(),
+
+		MaxUnitRemovals: s.opts().Guards.UnitRemovalLimit(),
+		CheckCommit:     github.CommitChecker(s.opts().GitHub),
 	}
+}
 
-	s.currentSync.setDelta(delta)
+// pullPolicy configures image pulls with the settings requested in the server's options.
+func (s *Server) pullPolicy() state.PullPolicy {
+	return state.PullPolicy{
+		Concurrency: s.opts().Pulls.Limit(),
+		Timeout:     s.opts().Pulls.Timeout(),
+		Attempts:    s.opts().Pulls.Tries(),
+	}
+}
+
+// approvalPolicy configures the approval gate with the settings requested in the server's options.
+func (s *Server) approvalPolicy() state.ApprovalPolicy {
+	return state.ApprovalPolicy{
+		Enabled:         s.opts().Approval.Enabled,
+		MaxUnitRestarts: s.opts().Approval.MaxUnitRestarts,
+		Removals:        s.opts().Approval.Removals,
+	}
+}
+
+// prunePolicy configures prunes with the settings requested in the server's options.
+func (s *Server) prunePolicy() state.PrunePolicy {
+	return state.PrunePolicy{
+		ThresholdPercent: s.opts().PruneThreshold(),
+		Mode:             state.PruneMode(s.opts().PruneMode),
+		MinImageAge:      s.opts().PruneMinImageAge(),
+	}
 }
 
 func (s *Server) handleSyncRoot(w http.ResponseWriter, r *http.Request) {
 	s.methods(w, r, methodHandlerMap{
-		http.MethodGet:  func() { s.handleGetSync(w, r) },
-		http.MethodPost: func() { s.handleCreateSync(w, r) },
+		http.MethodGet:    func() { s.handleGetSync(w, r) },
+		http.MethodPost:   func() { s.handleCreateSync(w, r) },
+		http.MethodDelete: func() { s.handleCancelSync(w, r) },
 	})
 }
 
+func (s *Server) handleSyncCancelRoot(w http.ResponseWriter, r *http.Request) {
+	s.methods(w, r, methodHandlerMap{
+		http.MethodPost: func() { s.handleCancelSync(w, r) },
+	})
+}
+
+// handleCancelSync cancels the sync that's running on this coordinator, along with the sync queued behind it. The sync
+// stops before it applies anything; one that has already begun applying its Delta finishes applying it, and skips only
+// its health checks and pruning.
+func (s *Server) handleCancelSync(w http.ResponseWriter, r *http.Request) {
+	dropped := s.currentSync.dropQueued()
+	if s.jobs.cancelKinds(state.JobSync, state.JobRollback) == 0 && !dropped {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("No sync is running on this coordinator."))
+		return
+	}
+	requestLog(r).Info("Sync canceled.")
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("Sync canceling."))
+}
+
+// handleGetSync describes the current or most recent sync. Its reports may be paged with the "offset", "since", and
+// "limit" query parameters.
 func (s *Server) handleGetSync(w http.ResponseWriter, r *http.Request) {
-	resp := s.currentSync.response()
+	page, err := parseReportPage(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	resp := s.currentSync.response(page)
 
 	w.Header().Set("Content-Type", "application/json")
 	encoder := json.NewEncoder(w)
@@ -187,16 +661,167 @@ func (s *Server) handleGetSync(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// requestTrigger attributes a sync requested over HTTP. Callers may describe themselves with the optional "source"
+// and "reason" query parameters; a webhook, for example, might POST to /sync?source=webhook&reason=dockerhub.
+func requestTrigger(r *http.Request) state.SyncTrigger {
+	query := r.URL.Query()
+
+	source := query.Get("source")
+	if len(source) == 0 {
+		source = state.TriggerAPI
+	}
+
+	actor, _, _ := r.BasicAuth()
+	if id := requestIdentity(r); len(id.name) > 0 {
+		actor = id.name
+	}
+	if len(actor) == 0 {
+		actor = r.RemoteAddr
+	}
+
+	return state.SyncTrigger{
+		Source: source,
+		Actor:  actor,
+		Reason: query.Get("reason"),
+	}
+}
+
 func (s *Server) handleCreateSync(w http.ResponseWriter, r *http.Request) {
-	starting := s.currentSync.request()
-	if !starting {
+	if !s.isLeader() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("This coordinator is a follower. Request a sync from the leader."))
+		return
+	}
+
+	if err := s.syncRefused(); err != nil {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	trigger := requestTrigger(r)
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+	if queue, _ := strconv.ParseBool(r.URL.Query().Get("queue")); queue && !force {
+		starting, queued := s.currentSync.requestOrQueue(trigger)
+		if !starting {
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprintf(w, "Sync queued to run after the current one (%d requests queued).", queued.Requests)
+			return
+		}
+	} else if !s.currentSync.request(trigger) {
 		w.WriteHeader(http.StatusAccepted)
 		w.Write([]byte("Sync already in progress"))
 		return
 	}
 
-	go s.performSync()
+	job := s.startScopedSync(trigger, func(settings *state.SyncSettings) { settings.Force = force })
+
+	writeJobLocation(w, job)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("Sync started."))
+}
+
+var syncRx = regexp.MustCompile(`^/sync/(\d+)/approve$`)
+
+func (s *Server) handleSync(w http.ResponseWriter, r *http.Request) {
+	ms := syncRx.FindStringSubmatch(r.URL.Path)
+	if len(ms) != 2 {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not found"))
+		return
+	}
+
+	id, err := strconv.Atoi(ms[1])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid sync ID"))
+		return
+	}
+
+	s.methods(w, r, methodHandlerMap{
+		http.MethodPost: func() { s.handleApproveSync(w, r, id) },
+	})
+}
+
+// handleApproveSync repeats a sync that's waiting for approval. Its Delta is applied only if the repeated sync
+// computes the same changes; otherwise the new Delta is checked against the approval policy again.
+func (s *Server) handleApproveSync(w http.ResponseWriter, r *http.Request, id int) {
+	if !s.isLeader() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("This coordinator is a follower. Approve the sync on the leader."))
+		return
+	}
+
+	if err := s.syncRefused(); err != nil {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	trigger := requestTrigger(r)
+	if len(trigger.Reason) == 0 {
+		trigger.Reason = fmt.Sprintf("approve sync %d", id)
+	}
 
+	job := s.approveSync(id, trigger)
+	if job == nil {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Sync %d is not waiting for approval", id)
+		return
+	}
+	requestLog(r).WithField("id", id).Info("Sync approved.")
+
+	writeJobLocation(w, job)
 	w.WriteHeader(http.StatusAccepted)
 	w.Write([]byte("Sync started."))
 }
+
+// approveSync starts a sync job that applies the pending sync with the given ID. It returns nil if that sync isn't
+// waiting for approval.
+func (s *Server) approveSync(id int, trigger state.SyncTrigger) *runningJob {
+	pending, ok := s.currentSync.approve(id, trigger)
+	if !ok {
+		return nil
+	}
+
+	return s.startScopedSync(trigger, func(settings *state.SyncSettings) {
+		pending.scope(settings)
+		settings.Approved = pending.fingerprint
+	})
+}
+
+// handleElected performs a sync when this instance takes over leadership, to pick up any changes that were made
+// while the previous leader was unavailable.
+func (s *Server) handleElected() {
+	trigger := state.SyncTrigger{Source: state.TriggerLeadership}
+	if !s.currentSync.request(trigger) {
+		return
+	}
+
+	log.Info("Performing sync after leadership change.")
+	s.startSync(trigger)
+}
+
+// runScheduledSyncs starts a sync every sync_interval_minutes while this instance is the leader. The interval is read
+// again after each sync, so that reloaded options take effect.
+func (s *Server) runScheduledSyncs() {
+	for {
+		interval := s.opts().SyncInterval()
+		if interval <= 0 {
+			time.Sleep(time.Minute)
+			continue
+		}
+		time.Sleep(interval)
+
+		if s.opts().SyncInterval() <= 0 || !s.isLeader() {
+			continue
+		}
+
+		trigger := state.SyncTrigger{Source: state.TriggerScheduler}
+		if !s.currentSync.request(trigger) {
+			log.Debug("Sync already in progress. Skipping scheduled sync.")
+			continue
+		}
+		s.performSync(trigger)
+	}
+}
@@ -0,0 +1,107 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/secrets"
+	"golang.org/x/net/websocket"
+)
+
+// watcherBuffer is the number of log entries that may wait to be sent to each /sync/logs stream. A stream that falls
+// further behind is closed.
+const watcherBuffer = 256
+
+// syncLogMessage is one message sent on a /sync/logs stream. Each log entry is sent as a Report. The last message
+// has Finished set, along with the sync's errors.
+type syncLogMessage struct {
+	Report   *syncReportResponse `json:"report,omitempty"`
+	Finished bool                `json:"finished,omitempty"`
+	Errors   []string            `json:"errors,omitempty"`
+}
+
+func (s *Server) handleSyncLogsRoot(w http.ResponseWriter, r *http.Request) {
+	s.methods(w, r, methodHandlerMap{
+		http.MethodGet: func() { s.handleStreamSyncLogs(w, r) },
+	})
+}
+
+// handleStreamSyncLogs upgrades the request to a WebSocket and sends the log entries of the current sync as they're
+// written, starting with a replay of those written since the sync started. If no sync is running, the entries of the
+// most recent sync are replayed and the stream ends.
+func (s *Server) handleStreamSyncLogs(w http.ResponseWriter, r *http.Request) {
+	server := websocket.Server{
+		Handshake: s.checkWebSocketOrigin,
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+			s.streamSyncLogs(ws)
+		},
+	}
+	server.ServeHTTP(w, r)
+}
+
+// checkWebSocketOrigin accepts WebSocket connections from clients that don't send an Origin, like the command line,
+// and from browsers on the allowed origin.
+func (s *Server) checkWebSocketOrigin(config *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		return nil
+	}
+	if origin != s.opts().AllowedOrigin {
+		return errors.New("origin not allowed")
+	}
+
+	parsed, err := url.Parse(origin)
+	if err != nil {
+		return err
+	}
+	config.Origin = parsed
+	return nil
+}
+
+func (s *Server) streamSyncLogs(ws *websocket.Conn) {
+	replay, updates := s.currentSync.watch()
+	if updates != nil {
+		defer s.currentSync.unwatch(updates)
+	}
+
+	send := func(message syncLogMessage) bool {
+		encoded, err := json.Marshal(message)
+		if err != nil {
+			log.WithError(err).Error("Unable to serialize sync log message.")
+			return true
+		}
+		if err := websocket.Message.Send(ws, secrets.Redact(string(encoded))); err != nil {
+			log.WithError(err).Debug("Sync log stream closed.")
+			return false
+		}
+		return true
+	}
+
+	for _, report := range replay {
+		resp := report.response()
+		if !send(syncLogMessage{Report: &resp}) {
+			return
+		}
+	}
+
+	if updates != nil {
+		for report := range updates {
+			resp := report.response()
+			if !send(syncLogMessage{Report: &resp}) {
+				return
+			}
+		}
+	}
+
+	progress := s.currentSync.response(reportPage{})
+	if progress.InProgress {
+		// The stream fell behind and was closed before the sync finished.
+		send(syncLogMessage{Errors: []string{"Stream fell behind; reconnect to replay the sync log"}})
+		return
+	}
+	send(syncLogMessage{Finished: true, Errors: progress.Errors})
+}
@@ -0,0 +1,135 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// reportRing holds the most recent reports of a sync, discarding the oldest once it's full. Each report keeps the
+// offset at which it was appended, counting from the start of the sync, so that clients can page through reports
+// even as old ones are discarded.
+type reportRing struct {
+	entries []syncReport
+	first   int
+	count   int
+
+	// total is the number of reports appended since the sync started, including those that were discarded.
+	total int
+
+	// levels counts the reports appended at each log level, including those that were discarded.
+	levels map[string]int
+}
+
+func newReportRing(capacity int) *reportRing {
+	if capacity <= 0 {
+		capacity = 1
+	}
+	return &reportRing{
+		entries: make([]syncReport, capacity),
+		levels:  make(map[string]int),
+	}
+}
+
+func (ring *reportRing) append(r syncReport) {
+	capacity := len(ring.entries)
+	if ring.count < capacity {
+		ring.entries[(ring.first+ring.count)%capacity] = r
+		ring.count++
+	} else {
+		ring.entries[ring.first] = r
+		ring.first = (ring.first + 1) % capacity
+	}
+	ring.total++
+	ring.levels[r.level]++
+}
+
+// offset returns the offset of the oldest report that's still held, which is also the number of reports that were
+// discarded to make room for newer ones.
+func (ring *reportRing) offset() int {
+	return ring.total - ring.count
+}
+
+// at returns the i-th oldest report that's still held.
+func (ring *reportRing) at(i int) syncReport {
+	return ring.entries[(ring.first+i)%len(ring.entries)]
+}
+
+// all copies the reports that are still held, oldest first.
+func (ring *reportRing) all() []syncReport {
+	reports := make([]syncReport, ring.count)
+	for i := range reports {
+		reports[i] = ring.at(i)
+	}
+	return reports
+}
+
+// reportPage selects the reports included in a GET /sync response.
+type reportPage struct {
+	// offset skips the reports appended before it, counting from the start of the sync.
+	offset int
+
+	// since skips the reports logged at or before this Unix time.
+	since int64
+
+	// limit is the largest number of reports returned, or zero for no limit.
+	limit int
+}
+
+// parseReportPage reads the "offset", "since", and "limit" query parameters.
+func parseReportPage(r *http.Request) (reportPage, error) {
+	var page reportPage
+	query := r.URL.Query()
+
+	for _, param := range []struct {
+		name string
+		dest *int
+	}{{"offset", &page.offset}, {"limit", &page.limit}} {
+		if raw := query.Get(param.name); len(raw) > 0 {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 0 {
+				return page, fmt.Errorf("invalid %s parameter: %s", param.name, raw)
+			}
+			*param.dest = n
+		}
+	}
+
+	if raw := query.Get("since"); len(raw) > 0 {
+		since, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return page, fmt.Errorf("invalid since parameter: %s", raw)
+		}
+		page.since = since
+	}
+
+	return page, nil
+}
+
+// page returns the held reports that page selects, along with the offset of the first one.
+func (ring *reportRing) page(page reportPage) ([]syncReport, int) {
+	start := page.offset - ring.offset()
+	if start < 0 {
+		start = 0
+	}
+
+	reports := make([]syncReport, 0)
+	first := -1
+	for i := start; i < ring.count; i++ {
+		r := ring.at(i)
+		if page.since > 0 && r.ts.Unix() <= page.since {
+			continue
+		}
+		if first < 0 {
+			first = ring.offset() + i
+		}
+		reports = append(reports, r)
+		if page.limit > 0 && len(reports) >= page.limit {
+			break
+		}
+	}
+
+	if first < 0 {
+		first = ring.total
+	}
+	return reports, first
+}
@@ -0,0 +1,118 @@
+package web
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/events"
+	"github.com/smashwilson/az-coordinator/notify"
+	"github.com/smashwilson/az-coordinator/state"
+)
+
+// unitWatchBackoff is the delay before the systemd unit watcher starts again after it fails.
+const unitWatchBackoff = 30 * time.Second
+
+// watchUnits records changes to managed units that the coordinator didn't make for as long as the server runs. Like
+// watchDockerEvents, it uses a session of its own.
+func (s *Server) watchUnits() {
+	// recorded holds the kind of drift most recently recorded for each unit, so that repeated signals about the same
+	// change are recorded once.
+	recorded := make(map[string]string)
+
+	for {
+		session, err := s.newSession()
+		if err != nil {
+			log.WithError(err).Warn("Unable to create a session to watch systemd units.")
+			time.Sleep(unitWatchBackoff)
+			continue
+		}
+
+		lease := session.Lease()
+		err = lease.WatchUnits(context.Background(), func(change state.UnitChange) {
+			s.handleUnitChange(change, recorded)
+		})
+		lease.Release()
+
+		log.WithError(err).Warn("Unable to watch systemd units.")
+		time.Sleep(unitWatchBackoff)
+	}
+}
+
+// handleUnitChange classifies a change to a unit's state and records it as drift if the coordinator didn't cause it.
+// Changes made while a sync is running or the host is drained are the coordinator's own, and changes to the
+// coordinator's unit are left to self-updates.
+func (s *Server) handleUnitChange(change state.UnitChange, recorded map[string]string) {
+	s.actualCache.Invalidate()
+
+	if change.Unit == state.DefaultSelfUnitName() {
+		return
+	}
+	if s.currentSync.running() || s.isDrained() {
+		delete(recorded, change.Unit)
+		return
+	}
+
+	switch change.ActiveState {
+	case "active", "inactive", "failed":
+	default:
+		if !change.NeedsReload {
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts().Timeouts.Request())
+	defer cancel()
+
+	session, err := s.pool.TakeContext(ctx)
+	if err != nil {
+		log.WithError(err).Warn("Unable to establish session.")
+		return
+	}
+	defer session.Release()
+
+	desired, err := session.ReadDesiredState(ctx)
+	if err != nil {
+		log.WithError(err).Warn("Unable to load the desired system state.")
+		return
+	}
+	scoped := desired.ForHost(s.opts().Fleet.Host(), s.opts().Fleet.Labels)
+	unit := scoped.UnitNamed(change.Unit)
+
+	drift := state.DriftEvent{Host: s.opts().Fleet.Host(), Unit: change.Unit}
+	switch {
+	case unit == nil:
+		if change.ActiveState == "active" {
+			drift.Kind, drift.Detail = state.DriftUnmanaged, "started, but it isn't desired on this host"
+		}
+	case change.NeedsReload:
+		drift.Kind, drift.Detail = state.DriftEdited, "its unit file was changed on disk"
+	case change.ActiveState == "failed":
+		drift.Kind, drift.Detail = state.DriftFailed, "failed ("+change.SubState+")"
+	case change.ActiveState == "inactive" && unit.Type == state.TypeSimple && unit.Enabled:
+		drift.Kind, drift.Detail = state.DriftStopped, "stopped outside of a sync"
+	}
+
+	if len(drift.Kind) == 0 {
+		delete(recorded, change.Unit)
+		return
+	}
+	if recorded[change.Unit] == drift.Kind {
+		return
+	}
+	recorded[change.Unit] = drift.Kind
+
+	saved, err := session.RecordDrift(ctx, drift)
+	if err != nil {
+		log.WithError(err).Warn("Unable to record drift.")
+		saved = &drift
+	}
+	log.WithFields(log.Fields{
+		"unit":   saved.Unit,
+		"kind":   saved.Kind,
+		"detail": saved.Detail,
+	}).Warn("Unit drifted.")
+
+	s.emit(events.UnitDrifted, "", *saved)
+	notify.ReportDrift(*s.opts(), *saved)
+}
@@ -0,0 +1,47 @@
+package web
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smashwilson/az-coordinator/selfupdate"
+)
+
+// runSelfUpdates periodically installs new coordinator releases, then restarts the coordinator's unit once no sync is
+// in progress. It blocks, so call it in its own goroutine.
+func (s *Server) runSelfUpdates(updater *selfupdate.Updater, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	restartPending := false
+	for range ticker.C {
+		if !restartPending {
+			updated, err := updater.Update(context.Background())
+			if err != nil {
+				log.WithError(err).Warn("Unable to update coordinator binary.")
+				continue
+			}
+			restartPending = updated
+		}
+
+		if !restartPending {
+			continue
+		}
+		if s.currentSync.response(reportPage{}).InProgress {
+			log.Info("Coordinator binary updated. Waiting for the current sync to finish before restarting.")
+			continue
+		}
+
+		session, err := s.pool.Take()
+		if err != nil {
+			log.WithError(err).Warn("Unable to establish session.")
+			continue
+		}
+		err = session.RestartSelf(context.Background())
+		session.Release()
+		if err != nil {
+			log.WithError(err).Warn("Unable to restart coordinator.")
+		}
+	}
+}
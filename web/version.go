@@ -0,0 +1,41 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/smashwilson/az-coordinator/buildinfo"
+	"github.com/smashwilson/az-coordinator/state"
+)
+
+type versionReport struct {
+	buildinfo.Info
+	Runtime state.RuntimeVersions `json:"runtime"`
+}
+
+func (s *Server) handleVersionRoot(w http.ResponseWriter, r *http.Request) {
+	s.methods(w, r, methodHandlerMap{
+		http.MethodGet: func() { s.handleGetVersion(w, r) },
+	})
+}
+
+func (s *Server) handleGetVersion(w http.ResponseWriter, r *http.Request) {
+	session, err := s.takeSession(w, r)
+	if err != nil {
+		return
+	}
+	defer session.Release()
+
+	runtime, errs := session.ReadRuntimeVersions(r.Context(), len(s.opts().DockerAPIVersion) > 0)
+	for _, err := range errs {
+		session.Log.WithError(err).Warn("Unable to read runtime version")
+	}
+
+	report := versionReport{Info: buildinfo.Current(), Runtime: runtime}
+	if err = json.NewEncoder(w).Encode(&report); err != nil {
+		session.Log.WithError(err).Error("Unable to serialize JSON.")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Unable to serialize JSON"))
+		return
+	}
+}